@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"email-tracker/config"
+
+	"github.com/gin-gonic/gin"
+)
+
+var (
+	errAdmissionFull    = errors.New("too many send requests waiting, try again later")
+	errAdmissionTimeout = errors.New("timed out waiting for a send slot, try again later")
+)
+
+// admissionStats describes the send requests being handled and waiting
+type admissionStats struct {
+	InFlight    int    `json:"in_flight"`
+	MaxInFlight int    `json:"max_in_flight"`
+	Queued      int64  `json:"queued"`
+	MaxQueued   int64  `json:"max_queued"`
+	Rejected    uint64 `json:"rejected"`
+	TimedOut    uint64 `json:"timed_out"`
+}
+
+// admission bounds the send requests handled at once, so a slow mail
+// server can't pile up handler goroutines. Requests over the limit wait in
+// a bounded queue for a slot; once the queue is full they are turned away.
+type admission struct {
+	slots     chan struct{}
+	maxQueued int64
+	timeout   time.Duration
+
+	queued   atomic.Int64
+	rejected atomic.Uint64
+	timedOut atomic.Uint64
+}
+
+func newAdmission(cfg *config.Config) *admission {
+	return &admission{
+		slots:     make(chan struct{}, cfg.Sends.MaxInFlight),
+		maxQueued: int64(cfg.Sends.MaxQueued),
+		timeout:   cfg.Sends.QueueTimeout,
+	}
+}
+
+// acquire takes a slot, waiting up to the queue timeout for one. Call
+// release once the send is done.
+func (a *admission) acquire(ctx context.Context) error {
+	select {
+	case a.slots <- struct{}{}:
+		return nil
+	default:
+	}
+
+	if a.queued.Add(1) > a.maxQueued {
+		a.queued.Add(-1)
+		a.rejected.Add(1)
+		return errAdmissionFull
+	}
+	defer a.queued.Add(-1)
+
+	timer := time.NewTimer(a.timeout)
+	defer timer.Stop()
+
+	select {
+	case a.slots <- struct{}{}:
+		return nil
+	case <-timer.C:
+		a.timedOut.Add(1)
+		return errAdmissionTimeout
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (a *admission) release() {
+	<-a.slots
+}
+
+// retryAfter is the Retry-After hint, in whole seconds, given to clients
+// that are turned away: about one queue wait.
+func (a *admission) retryAfter() string {
+	return strconv.Itoa(max(1, int(math.Ceil(a.timeout.Seconds()))))
+}
+
+func (a *admission) stats() admissionStats {
+	return admissionStats{
+		InFlight:    len(a.slots),
+		MaxInFlight: cap(a.slots),
+		Queued:      a.queued.Load(),
+		MaxQueued:   a.maxQueued,
+		Rejected:    a.rejected.Load(),
+		TimedOut:    a.timedOut.Load(),
+	}
+}
+
+// admitSend sheds send requests once the instance is saturated: 429 when
+// the admission queue is full, 503 when a queued request waited too long.
+// Both carry Retry-After.
+func (s *Server) admitSend() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		err := s.sends.acquire(c.Request.Context())
+		switch {
+		case errors.Is(err, errAdmissionFull):
+			c.Header("Retry-After", s.sends.retryAfter())
+			c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{"error": err.Error()})
+			return
+		case err != nil:
+			c.Header("Retry-After", s.sends.retryAfter())
+			c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+			return
+		}
+		defer s.sends.release()
+
+		c.Next()
+	}
+}
@@ -0,0 +1,157 @@
+package analytics
+
+import (
+	"fmt"
+	"math"
+	"sort"
+
+	"email-tracker/models"
+)
+
+const (
+	// abConfidenceZ is the z value for a 95% confidence interval
+	abConfidenceZ = 1.96
+
+	// abSignificance is the p-value below which a difference is declared
+	// statistically significant
+	abSignificance = 0.05
+)
+
+type RateInterval struct {
+	Rate  float64 `json:"rate"`
+	Lower float64 `json:"lower"`
+	Upper float64 `json:"upper"`
+}
+
+type VariantStats struct {
+	Variant   string       `json:"variant"`
+	Emails    int          `json:"emails"`
+	Opened    int          `json:"opened"`
+	Clicked   int          `json:"clicked"`
+	OpenRate  RateInterval `json:"open_rate"`
+	ClickRate RateInterval `json:"click_rate"`
+}
+
+type RateComparison struct {
+	ZScore      float64 `json:"z_score"`
+	PValue      float64 `json:"p_value"`
+	Significant bool    `json:"significant"`
+	Winner      string  `json:"winner,omitempty"`
+}
+
+type ABTestResult struct {
+	TestID   string          `json:"test_id"`
+	Variants []*VariantStats `json:"variants"`
+	Opens    RateComparison  `json:"opens"`
+	Clicks   RateComparison  `json:"clicks"`
+	Winner   string          `json:"winner,omitempty"`
+}
+
+// ABTest compares the open and click rates of the two variants of an A/B
+// test using a two-proportion z-test. With filtered set, bot opens and
+// clicks are ignored. Rates and intervals are percentages of
+// emails sent per variant; intervals are 95% Wilson score intervals.
+func ABTest(testID string, emails []*models.Email, filtered bool) (*ABTestResult, error) {
+	byVariant := make(map[string]*VariantStats)
+	for _, email := range emails {
+		v, ok := byVariant[email.Variant]
+		if !ok {
+			v = &VariantStats{Variant: email.Variant}
+			byVariant[email.Variant] = v
+		}
+		v.Emails++
+		stats := email.OpenStats(filtered)
+		if stats.TotalOpens > 0 {
+			v.Opened++
+		}
+		if stats.TotalClicks > 0 {
+			v.Clicked++
+		}
+	}
+
+	if len(byVariant) != 2 {
+		return nil, fmt.Errorf("A/B test %q has %d variants, expected 2", testID, len(byVariant))
+	}
+
+	result := &ABTestResult{TestID: testID}
+	for _, v := range byVariant {
+		v.OpenRate = wilson(v.Opened, v.Emails)
+		v.ClickRate = wilson(v.Clicked, v.Emails)
+		result.Variants = append(result.Variants, v)
+	}
+	sort.Slice(result.Variants, func(i, j int) bool {
+		return result.Variants[i].Variant < result.Variants[j].Variant
+	})
+
+	a, b := result.Variants[0], result.Variants[1]
+	result.Opens = compareRates(a.Variant, a.Opened, a.Emails, b.Variant, b.Opened, b.Emails)
+	result.Clicks = compareRates(a.Variant, a.Clicked, a.Emails, b.Variant, b.Clicked, b.Emails)
+
+	// Clicks are the stronger signal; fall back to opens when clicks are
+	// inconclusive
+	switch {
+	case result.Clicks.Significant:
+		result.Winner = result.Clicks.Winner
+	case result.Opens.Significant:
+		result.Winner = result.Opens.Winner
+	}
+
+	return result, nil
+}
+
+// wilson returns the Wilson score interval for successes out of n trials
+func wilson(successes, n int) RateInterval {
+	if n == 0 {
+		return RateInterval{}
+	}
+
+	p := float64(successes) / float64(n)
+	z2 := abConfidenceZ * abConfidenceZ
+	nf := float64(n)
+
+	center := (p + z2/(2*nf)) / (1 + z2/nf)
+	margin := abConfidenceZ * math.Sqrt(p*(1-p)/nf+z2/(4*nf*nf)) / (1 + z2/nf)
+
+	return RateInterval{
+		Rate:  round2(p * 100),
+		Lower: round2(math.Max(0, center-margin) * 100),
+		Upper: round2(math.Min(1, center+margin) * 100),
+	}
+}
+
+// compareRates runs a two-sided two-proportion z-test
+func compareRates(nameA string, successA, nA int, nameB string, successB, nB int) RateComparison {
+	if nA == 0 || nB == 0 {
+		return RateComparison{PValue: 1}
+	}
+
+	pA := float64(successA) / float64(nA)
+	pB := float64(successB) / float64(nB)
+	pooled := float64(successA+successB) / float64(nA+nB)
+
+	se := math.Sqrt(pooled * (1 - pooled) * (1/float64(nA) + 1/float64(nB)))
+	if se == 0 {
+		return RateComparison{PValue: 1}
+	}
+
+	z := (pA - pB) / se
+	pValue := math.Erfc(math.Abs(z) / math.Sqrt2)
+
+	cmp := RateComparison{
+		ZScore:      round2(z),
+		PValue:      math.Round(pValue*10000) / 10000,
+		Significant: pValue < abSignificance,
+	}
+	if cmp.Significant {
+		if pA > pB {
+			cmp.Winner = nameA
+		} else {
+			cmp.Winner = nameB
+		}
+	}
+	return cmp
+}
+
+func round2(v float64) float64 {
+	return math.Round(v*100) / 100
+}
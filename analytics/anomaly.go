@@ -0,0 +1,138 @@
+package analytics
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"time"
+
+	"email-tracker/models"
+)
+
+const (
+	// Opens this soon after sending are almost always security scanners
+	instantOpenThreshold = time.Second
+
+	// ispSpikeCount opens from one ISP within ispSpikeWindow is a spike
+	ispSpikeCount  = 5
+	ispSpikeWindow = 5 * time.Minute
+
+	// Consecutive opens further apart than this, faster than
+	// maxTravelSpeedKmh, can't come from the same person
+	minTravelDistanceKm = 500
+	maxTravelSpeedKmh   = 1000
+
+	earthRadiusKm = 6371
+)
+
+// IsInstantOpen reports whether an open or click happened so soon after
+// sending that no human could have caused it.
+func IsInstantOpen(sentAt, at time.Time) bool {
+	delay := at.Sub(sentAt)
+	return delay >= 0 && delay < instantOpenThreshold
+}
+
+// Anomalies inspects the opens of one email for patterns that suggest
+// scanners or proxies rather than a human reader.
+func Anomalies(email *models.Email, events []*models.TrackingEvent) []models.Anomaly {
+	sorted := make([]*models.TrackingEvent, len(events))
+	copy(sorted, events)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].OpenedAt.Before(sorted[j].OpenedAt) })
+
+	var anomalies []models.Anomaly
+	anomalies = append(anomalies, instantOpens(email, sorted)...)
+	anomalies = append(anomalies, ispSpikes(sorted)...)
+
+	// Several recipients share one tracking ID, so travel only makes sense
+	// for single-recipient emails
+	if !strings.Contains(email.To, ",") {
+		anomalies = append(anomalies, impossibleTravel(sorted)...)
+	}
+
+	return anomalies
+}
+
+func instantOpens(email *models.Email, events []*models.TrackingEvent) []models.Anomaly {
+	var anomalies []models.Anomaly
+	for _, event := range events {
+		if IsInstantOpen(email.SentAt, event.OpenedAt) {
+			delay := event.OpenedAt.Sub(email.SentAt)
+			anomalies = append(anomalies, models.Anomaly{
+				Type:    models.AnomalyInstantOpen,
+				EventID: event.ID,
+				At:      event.OpenedAt,
+				Message: fmt.Sprintf("Opened %s after sending from %s, likely a security scanner", delay.Round(time.Millisecond), event.IPAddress),
+			})
+		}
+	}
+	return anomalies
+}
+
+func ispSpikes(events []*models.TrackingEvent) []models.Anomaly {
+	byISP := make(map[string][]*models.TrackingEvent)
+	for _, event := range events {
+		if event.ISP != "" {
+			byISP[event.ISP] = append(byISP[event.ISP], event)
+		}
+	}
+
+	var anomalies []models.Anomaly
+	for isp, ispEvents := range byISP {
+		start := 0
+		for end := range ispEvents {
+			for ispEvents[end].OpenedAt.Sub(ispEvents[start].OpenedAt) > ispSpikeWindow {
+				start++
+			}
+			if end-start+1 >= ispSpikeCount {
+				anomalies = append(anomalies, models.Anomaly{
+					Type:    models.AnomalyISPSpike,
+					EventID: ispEvents[end].ID,
+					At:      ispEvents[end].OpenedAt,
+					Message: fmt.Sprintf("%d opens from %s within %s", end-start+1, isp, ispSpikeWindow),
+				})
+				// Report each spike once
+				break
+			}
+		}
+	}
+	return anomalies
+}
+
+func impossibleTravel(events []*models.TrackingEvent) []models.Anomaly {
+	var anomalies []models.Anomaly
+	var prev *models.TrackingEvent
+
+	for _, event := range events {
+		if event.Lat == 0 && event.Lon == 0 {
+			continue
+		}
+		if prev != nil {
+			distance := haversineKm(prev.Lat, prev.Lon, event.Lat, event.Lon)
+			hours := event.OpenedAt.Sub(prev.OpenedAt).Hours()
+			if distance > minTravelDistanceKm && (hours == 0 || distance/hours > maxTravelSpeedKmh) {
+				anomalies = append(anomalies, models.Anomaly{
+					Type:    models.AnomalyImpossibleTravel,
+					EventID: event.ID,
+					At:      event.OpenedAt,
+					Message: fmt.Sprintf("Opened in %s, %s %.0f km from the previous open in %s, %s only %s earlier",
+						event.City, event.Country, distance, prev.City, prev.Country,
+						event.OpenedAt.Sub(prev.OpenedAt).Round(time.Second)),
+				})
+			}
+		}
+		prev = event
+	}
+	return anomalies
+}
+
+// haversineKm returns the great-circle distance between two coordinates
+func haversineKm(lat1, lon1, lat2, lon2 float64) float64 {
+	toRad := func(deg float64) float64 { return deg * math.Pi / 180 }
+
+	dLat := toRad(lat2 - lat1)
+	dLon := toRad(lon2 - lon1)
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(toRad(lat1))*math.Cos(toRad(lat2))*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * earthRadiusKm * math.Asin(math.Sqrt(a))
+}
@@ -0,0 +1,71 @@
+package analytics
+
+import (
+	"strings"
+
+	"email-tracker/models"
+)
+
+// maxTopLinks limits how many links are reported in campaign rollups
+const maxTopLinks = 10
+
+type CampaignStats struct {
+	CampaignID              string       `json:"campaign_id"`
+	EmailsSent              int          `json:"emails_sent"`
+	Recipients              int          `json:"recipients"`
+	OpenedEmails            int          `json:"opened_emails"`
+	ClickedEmails           int          `json:"clicked_emails"`
+	OpenRate                float64      `json:"open_rate"`
+	ClickRate               float64      `json:"click_rate"`
+	UniqueRecipientsReached int          `json:"unique_recipients_reached"`
+	TotalOpens              int          `json:"total_opens"`
+	TotalClicks             int          `json:"total_clicks"`
+	TopLinks                []*LinkStats `json:"top_links"`
+}
+
+// Campaign rolls up the per-email aggregates of every email in a campaign.
+// Rates are percentages of emails sent. A recipient counts as reached when an
+// email addressed to them was opened. With filtered set, bot opens and
+// clicks are ignored.
+func Campaign(campaignID string, emails []*models.Email, clicks []*models.ClickEvent, filtered bool) *CampaignStats {
+	result := &CampaignStats{
+		CampaignID: campaignID,
+		EmailsSent: len(emails),
+		TopLinks:   TopLinks(clicks, filtered, maxTopLinks),
+	}
+
+	recipients := make(map[string]struct{})
+	reached := make(map[string]struct{})
+
+	for _, email := range emails {
+		stats := email.OpenStats(filtered)
+		opened := stats.TotalOpens > 0
+
+		for _, to := range strings.Split(email.To, ",") {
+			to = strings.ToLower(strings.TrimSpace(to))
+			if to == "" {
+				continue
+			}
+			recipients[to] = struct{}{}
+			if opened {
+				reached[to] = struct{}{}
+			}
+		}
+
+		if opened {
+			result.OpenedEmails++
+		}
+		if stats.TotalClicks > 0 {
+			result.ClickedEmails++
+		}
+		result.TotalOpens += stats.TotalOpens
+		result.TotalClicks += stats.TotalClicks
+	}
+
+	result.Recipients = len(recipients)
+	result.UniqueRecipientsReached = len(reached)
+	result.OpenRate = percentage(result.OpenedEmails, result.EmailsSent)
+	result.ClickRate = percentage(result.ClickedEmails, result.EmailsSent)
+
+	return result
+}
@@ -0,0 +1,78 @@
+package analytics
+
+import (
+	"sort"
+	"time"
+
+	"email-tracker/models"
+)
+
+// CityCluster groups the opens located in one city, positioned at the mean
+// of their coordinates.
+type CityCluster struct {
+	City       string    `json:"city"`
+	Region     string    `json:"region"`
+	Country    string    `json:"country"`
+	Lat        float64   `json:"lat"`
+	Lon        float64   `json:"lon"`
+	Opens      int       `json:"opens"`
+	Emails     int       `json:"emails"`
+	LastOpenAt time.Time `json:"last_open_at"`
+}
+
+// CityClusters clusters opens by city for plotting on a map, largest first.
+// Events without coordinates are left out.
+func CityClusters(events []*models.TrackingEvent) []CityCluster {
+	type acc struct {
+		cluster  CityCluster
+		latSum   float64
+		lonSum   float64
+		emailIDs map[string]struct{}
+	}
+
+	byCity := make(map[string]*acc)
+	for _, event := range events {
+		if event.Lat == 0 && event.Lon == 0 {
+			continue
+		}
+
+		key := event.Country + "|" + event.Region + "|" + event.City
+		a, ok := byCity[key]
+		if !ok {
+			a = &acc{
+				cluster: CityCluster{
+					City:    orUnknown(event.City),
+					Region:  event.Region,
+					Country: orUnknown(event.Country),
+				},
+				emailIDs: make(map[string]struct{}),
+			}
+			byCity[key] = a
+		}
+
+		a.cluster.Opens++
+		a.latSum += event.Lat
+		a.lonSum += event.Lon
+		a.emailIDs[event.TrackingID] = struct{}{}
+		if event.OpenedAt.After(a.cluster.LastOpenAt) {
+			a.cluster.LastOpenAt = event.OpenedAt
+		}
+	}
+
+	clusters := make([]CityCluster, 0, len(byCity))
+	for _, a := range byCity {
+		a.cluster.Lat = a.latSum / float64(a.cluster.Opens)
+		a.cluster.Lon = a.lonSum / float64(a.cluster.Opens)
+		a.cluster.Emails = len(a.emailIDs)
+		clusters = append(clusters, a.cluster)
+	}
+
+	sort.Slice(clusters, func(i, j int) bool {
+		if clusters[i].Opens != clusters[j].Opens {
+			return clusters[i].Opens > clusters[j].Opens
+		}
+		return clusters[i].City < clusters[j].City
+	})
+
+	return clusters
+}
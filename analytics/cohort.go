@@ -0,0 +1,93 @@
+package analytics
+
+import (
+	"sort"
+	"strings"
+	"time"
+
+	"email-tracker/models"
+)
+
+type CohortPeriod struct {
+	Offset   int       `json:"offset"`
+	SendDate time.Time `json:"send_date"`
+	Received int       `json:"received"`
+	Opened   int       `json:"opened"`
+	OpenRate float64   `json:"open_rate"`
+}
+
+type Cohort struct {
+	Start   time.Time      `json:"start"`
+	Size    int            `json:"size"`
+	Periods []CohortPeriod `json:"periods"`
+}
+
+// Cohorts groups the recipients of a recurring campaign by the send in which
+// they first received it, and follows each cohort's open rate through the
+// later sends. Emails sent within the same period (e.g. one day) count as one
+// send. Offset 0 is the cohort's first send. With filtered set, bot opens
+// are ignored.
+func Cohorts(emails []*models.Email, period time.Duration, filtered bool) []Cohort {
+	// recipient -> opened, per send
+	sends := make(map[time.Time]map[string]bool)
+	for _, email := range emails {
+		send := email.SentAt.UTC().Truncate(period)
+		if sends[send] == nil {
+			sends[send] = make(map[string]bool)
+		}
+		for _, to := range strings.Split(email.To, ",") {
+			to = strings.ToLower(strings.TrimSpace(to))
+			if to == "" {
+				continue
+			}
+			sends[send][to] = sends[send][to] || email.OpenStats(filtered).TotalOpens > 0
+		}
+	}
+
+	dates := make([]time.Time, 0, len(sends))
+	for date := range sends {
+		dates = append(dates, date)
+	}
+	sort.Slice(dates, func(i, j int) bool { return dates[i].Before(dates[j]) })
+
+	// Assign each recipient to the cohort of their first send
+	joined := make(map[string]int)
+	for i, date := range dates {
+		for recipient := range sends[date] {
+			if _, ok := joined[recipient]; !ok {
+				joined[recipient] = i
+			}
+		}
+	}
+
+	var cohorts []Cohort
+	for c, start := range dates {
+		cohort := Cohort{Start: start}
+		for _, first := range joined {
+			if first == c {
+				cohort.Size++
+			}
+		}
+		if cohort.Size == 0 {
+			continue
+		}
+
+		for i := c; i < len(dates); i++ {
+			p := CohortPeriod{Offset: i - c, SendDate: dates[i]}
+			for recipient, opened := range sends[dates[i]] {
+				if joined[recipient] != c {
+					continue
+				}
+				p.Received++
+				if opened {
+					p.Opened++
+				}
+			}
+			p.OpenRate = percentage(p.Opened, p.Received)
+			cohort.Periods = append(cohort.Periods, p)
+		}
+		cohorts = append(cohorts, cohort)
+	}
+
+	return cohorts
+}
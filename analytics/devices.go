@@ -0,0 +1,89 @@
+package analytics
+
+import (
+	"sort"
+	"time"
+
+	"email-tracker/models"
+)
+
+type Share struct {
+	Name       string  `json:"name"`
+	Opens      int     `json:"opens"`
+	Percentage float64 `json:"percentage"`
+}
+
+type DeviceBreakdown struct {
+	TotalOpens   int     `json:"total_opens"`
+	DeviceTypes  []Share `json:"device_types"`
+	Browsers     []Share `json:"browsers"`
+	OS           []Share `json:"os"`
+	EmailClients []Share `json:"email_clients"`
+}
+
+// Devices aggregates the device type, browser, OS and mail client parsed
+// from each event's user agent.
+func Devices(events []*models.TrackingEvent) *DeviceBreakdown {
+	return &DeviceBreakdown{
+		TotalOpens:   len(events),
+		DeviceTypes:  shares(events, func(e *models.TrackingEvent) string { return e.DeviceType }),
+		Browsers:     shares(events, func(e *models.TrackingEvent) string { return e.Browser }),
+		OS:           shares(events, func(e *models.TrackingEvent) string { return e.OS }),
+		EmailClients: shares(events, func(e *models.TrackingEvent) string { return e.EmailClient }),
+	}
+}
+
+// shares counts events by the value returned from key, largest first
+func shares(events []*models.TrackingEvent, key func(*models.TrackingEvent) string) []Share {
+	counts := make(map[string]int)
+	for _, event := range events {
+		counts[orUnknown(key(event))]++
+	}
+
+	result := make([]Share, 0, len(counts))
+	for name, opens := range counts {
+		result = append(result, Share{
+			Name:       name,
+			Opens:      opens,
+			Percentage: percentage(opens, len(events)),
+		})
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Opens != result[j].Opens {
+			return result[i].Opens > result[j].Opens
+		}
+		return result[i].Name < result[j].Name
+	})
+	return result
+}
+
+// HumanEvents drops events flagged as coming from bots or scanners.
+func HumanEvents(events []*models.TrackingEvent) []*models.TrackingEvent {
+	var human []*models.TrackingEvent
+	for _, event := range events {
+		if !event.IsBot {
+			human = append(human, event)
+		}
+	}
+	return human
+}
+
+// FilterByTime keeps events opened within [from, to]. A zero bound is open.
+func FilterByTime(events []*models.TrackingEvent, from, to time.Time) []*models.TrackingEvent {
+	if from.IsZero() && to.IsZero() {
+		return events
+	}
+
+	var filtered []*models.TrackingEvent
+	for _, event := range events {
+		if !from.IsZero() && event.OpenedAt.Before(from) {
+			continue
+		}
+		if !to.IsZero() && event.OpenedAt.After(to) {
+			continue
+		}
+		filtered = append(filtered, event)
+	}
+	return filtered
+}
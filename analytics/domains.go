@@ -0,0 +1,106 @@
+package analytics
+
+import (
+	"sort"
+	"strings"
+	"time"
+
+	"email-tracker/models"
+	"email-tracker/utils"
+)
+
+type DomainPeriod struct {
+	Start      time.Time `json:"start"`
+	Sent       int       `json:"sent"`
+	Bounced    int       `json:"bounced"`
+	Opened     int       `json:"opened"`
+	OpenRate   float64   `json:"open_rate"`
+	BounceRate float64   `json:"bounce_rate"`
+}
+
+type DomainStats struct {
+	Domain     string          `json:"domain"`
+	Sent       int             `json:"sent"`
+	Bounced    int             `json:"bounced"`
+	Opened     int             `json:"opened"`
+	OpenRate   float64         `json:"open_rate"`
+	BounceRate float64         `json:"bounce_rate"`
+	Periods    []*DomainPeriod `json:"periods"`
+}
+
+// Domains aggregates sends, bounces and opens per recipient domain, both in
+// total and per period, so a sudden drop for one mailbox provider stands
+// out. An email with several recipients counts once for each of their
+// domains. With filtered set, bot opens are ignored.
+func Domains(emails []*models.Email, period time.Duration, filtered bool) []*DomainStats {
+	byDomain := make(map[string]*DomainStats)
+	periods := make(map[string]map[time.Time]*DomainPeriod)
+
+	for _, email := range emails {
+		start := email.SentAt.UTC().Truncate(period)
+		bounced := email.DeliveryStatus == models.DeliveryStatusBounced
+		opened := email.OpenStats(filtered).TotalOpens > 0
+
+		for _, domain := range recipientDomains(email) {
+			stats, ok := byDomain[domain]
+			if !ok {
+				stats = &DomainStats{Domain: domain}
+				byDomain[domain] = stats
+				periods[domain] = make(map[time.Time]*DomainPeriod)
+			}
+			p, ok := periods[domain][start]
+			if !ok {
+				p = &DomainPeriod{Start: start}
+				periods[domain][start] = p
+				stats.Periods = append(stats.Periods, p)
+			}
+
+			stats.Sent++
+			p.Sent++
+			if bounced {
+				stats.Bounced++
+				p.Bounced++
+			}
+			if opened {
+				stats.Opened++
+				p.Opened++
+			}
+		}
+	}
+
+	result := make([]*DomainStats, 0, len(byDomain))
+	for _, stats := range byDomain {
+		stats.OpenRate = percentage(stats.Opened, stats.Sent)
+		stats.BounceRate = percentage(stats.Bounced, stats.Sent)
+		for _, p := range stats.Periods {
+			p.OpenRate = percentage(p.Opened, p.Sent)
+			p.BounceRate = percentage(p.Bounced, p.Sent)
+		}
+		sort.Slice(stats.Periods, func(i, j int) bool {
+			return stats.Periods[i].Start.Before(stats.Periods[j].Start)
+		})
+		result = append(result, stats)
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Sent != result[j].Sent {
+			return result[i].Sent > result[j].Sent
+		}
+		return result[i].Domain < result[j].Domain
+	})
+	return result
+}
+
+// recipientDomains returns the distinct lowercase domains an email was sent to
+func recipientDomains(email *models.Email) []string {
+	var domains []string
+	seen := make(map[string]bool)
+	for _, to := range strings.Split(email.To, ",") {
+		domain := strings.ToLower(utils.ExtractDomain(strings.TrimSpace(to)))
+		if domain != "" && !seen[domain] {
+			seen[domain] = true
+			domains = append(domains, domain)
+		}
+	}
+	return domains
+}
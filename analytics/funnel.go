@@ -0,0 +1,51 @@
+package analytics
+
+import "email-tracker/models"
+
+type FunnelStage struct {
+	Stage        string  `json:"stage"`
+	Count        int     `json:"count"`
+	PercentSent  float64 `json:"percent_of_sent"`
+	PercentPrior float64 `json:"percent_of_previous"`
+	DropOff      int     `json:"drop_off"`
+}
+
+// Funnel reports how many emails made it through each stage of
+// sent → delivered → opened → clicked. An opened or clicked email is always
+// counted as delivered, whatever its recorded delivery status. With filtered
+// set, bot opens and clicks are ignored.
+func Funnel(emails []*models.Email, filtered bool) []FunnelStage {
+	var delivered, opened, clicked int
+	for _, email := range emails {
+		stats := email.OpenStats(filtered)
+		engaged := stats.TotalOpens > 0 || stats.TotalClicks > 0
+		if engaged || email.DeliveryStatus == models.DeliveryStatusDelivered {
+			delivered++
+		}
+		if stats.TotalOpens > 0 {
+			opened++
+		}
+		if stats.TotalClicks > 0 {
+			clicked++
+		}
+	}
+
+	names := []string{"sent", "delivered", "opened", "clicked"}
+	counts := []int{len(emails), delivered, opened, clicked}
+
+	stages := make([]FunnelStage, len(names))
+	for i := range names {
+		stages[i] = FunnelStage{
+			Stage:       names[i],
+			Count:       counts[i],
+			PercentSent: percentage(counts[i], counts[0]),
+		}
+		if i == 0 {
+			stages[i].PercentPrior = percentage(counts[i], counts[i])
+			continue
+		}
+		stages[i].PercentPrior = percentage(counts[i], counts[i-1])
+		stages[i].DropOff = counts[i-1] - counts[i]
+	}
+	return stages
+}
@@ -0,0 +1,92 @@
+package analytics
+
+import (
+	"math"
+	"sort"
+
+	"email-tracker/models"
+)
+
+const unknownValue = "Unknown"
+
+type GeoShare struct {
+	Country    string  `json:"country"`
+	Region     string  `json:"region,omitempty"`
+	City       string  `json:"city,omitempty"`
+	Opens      int     `json:"opens"`
+	Percentage float64 `json:"percentage"`
+}
+
+type GeoBreakdown struct {
+	TotalOpens int        `json:"total_opens"`
+	Countries  []GeoShare `json:"countries"`
+	Regions    []GeoShare `json:"regions"`
+	Cities     []GeoShare `json:"cities"`
+}
+
+type geoKey struct {
+	country, region, city string
+}
+
+// Geo groups events by country, region and city. Regions and cities are keyed
+// together with their parent so "Springfield" in two states stays separate.
+func Geo(events []*models.TrackingEvent) *GeoBreakdown {
+	countries := make(map[geoKey]int)
+	regions := make(map[geoKey]int)
+	cities := make(map[geoKey]int)
+
+	for _, event := range events {
+		country := orUnknown(event.Country)
+		region := orUnknown(event.Region)
+		city := orUnknown(event.City)
+
+		countries[geoKey{country: country}]++
+		regions[geoKey{country: country, region: region}]++
+		cities[geoKey{country: country, region: region, city: city}]++
+	}
+
+	total := len(events)
+	return &GeoBreakdown{
+		TotalOpens: total,
+		Countries:  geoShares(countries, total),
+		Regions:    geoShares(regions, total),
+		Cities:     geoShares(cities, total),
+	}
+}
+
+func geoShares(counts map[geoKey]int, total int) []GeoShare {
+	shares := make([]GeoShare, 0, len(counts))
+	for key, opens := range counts {
+		shares = append(shares, GeoShare{
+			Country:    key.country,
+			Region:     key.region,
+			City:       key.city,
+			Opens:      opens,
+			Percentage: percentage(opens, total),
+		})
+	}
+
+	sort.Slice(shares, func(i, j int) bool {
+		if shares[i].Opens != shares[j].Opens {
+			return shares[i].Opens > shares[j].Opens
+		}
+		a, b := shares[i], shares[j]
+		return a.Country+a.Region+a.City < b.Country+b.Region+b.City
+	})
+	return shares
+}
+
+// percentage returns part/total as a percentage rounded to two decimals
+func percentage(part, total int) float64 {
+	if total == 0 {
+		return 0
+	}
+	return math.Round(float64(part)/float64(total)*10000) / 100
+}
+
+func orUnknown(value string) string {
+	if value == "" {
+		return unknownValue
+	}
+	return value
+}
@@ -0,0 +1,57 @@
+package analytics
+
+import (
+	"time"
+
+	"email-tracker/models"
+)
+
+type GeoJSONGeometry struct {
+	Type        string     `json:"type"`
+	Coordinates [2]float64 `json:"coordinates"`
+}
+
+type GeoJSONFeature struct {
+	Type       string                 `json:"type"`
+	Geometry   GeoJSONGeometry        `json:"geometry"`
+	Properties map[string]interface{} `json:"properties"`
+}
+
+type GeoJSONFeatureCollection struct {
+	Type     string           `json:"type"`
+	Features []GeoJSONFeature `json:"features"`
+}
+
+// GeoJSON returns one point feature per open that has coordinates. Events
+// where geolocation failed (0,0) are left out.
+func GeoJSON(events []*models.TrackingEvent) *GeoJSONFeatureCollection {
+	collection := &GeoJSONFeatureCollection{
+		Type:     "FeatureCollection",
+		Features: []GeoJSONFeature{},
+	}
+
+	for _, event := range events {
+		if event.Lat == 0 && event.Lon == 0 {
+			continue
+		}
+
+		collection.Features = append(collection.Features, GeoJSONFeature{
+			Type: "Feature",
+			Geometry: GeoJSONGeometry{
+				Type:        "Point",
+				Coordinates: [2]float64{event.Lon, event.Lat},
+			},
+			Properties: map[string]interface{}{
+				"id":          event.ID,
+				"tracking_id": event.TrackingID,
+				"opened_at":   event.OpenedAt.Format(time.RFC3339),
+				"country":     event.Country,
+				"region":      event.Region,
+				"city":        event.City,
+				"device_type": event.DeviceType,
+			},
+		})
+	}
+
+	return collection
+}
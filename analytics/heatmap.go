@@ -0,0 +1,54 @@
+package analytics
+
+import (
+	"time"
+
+	"email-tracker/models"
+)
+
+type Heatmap struct {
+	Timezone   string     `json:"timezone"`
+	Days       [7]string  `json:"days"`
+	Opens      [7][24]int `json:"opens"`
+	TotalOpens int        `json:"total_opens"`
+	MaxOpens   int        `json:"max_opens"`
+}
+
+// OpenHeatmap counts opens per day of week (rows, Sunday first) and hour of
+// day (columns). With local set, each open is placed in the recipient's own
+// timezone when the event has one, falling back to loc otherwise.
+func OpenHeatmap(events []*models.TrackingEvent, loc *time.Location, local bool) *Heatmap {
+	heatmap := &Heatmap{Timezone: loc.String(), TotalOpens: len(events)}
+	if local {
+		heatmap.Timezone = "recipient local"
+	}
+
+	for d := range heatmap.Days {
+		heatmap.Days[d] = time.Weekday(d).String()
+	}
+
+	for _, event := range events {
+		openedAt := event.OpenedAt.In(loc)
+		if local {
+			openedAt = event.OpenedAt.In(EventLocation(event, loc))
+		}
+
+		cell := &heatmap.Opens[openedAt.Weekday()][openedAt.Hour()]
+		*cell++
+		if *cell > heatmap.MaxOpens {
+			heatmap.MaxOpens = *cell
+		}
+	}
+
+	return heatmap
+}
+
+// EventLocation returns the recipient timezone recorded on the event, or
+// fallback when it is missing or unknown.
+func EventLocation(event *models.TrackingEvent, fallback *time.Location) *time.Location {
+	loc, ok := models.LoadTimezone(event.Timezone)
+	if !ok {
+		return fallback
+	}
+	return loc
+}
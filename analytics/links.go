@@ -0,0 +1,97 @@
+package analytics
+
+import (
+	"sort"
+	"time"
+
+	"email-tracker/models"
+)
+
+type LinkStats struct {
+	URL            string     `json:"url"`
+	Index          *int       `json:"index,omitempty"`
+	Clicks         int        `json:"clicks"`
+	UniqueClickers int        `json:"unique_clickers"`
+	FirstClickAt   *time.Time `json:"first_click_at,omitempty"`
+	LastClickAt    *time.Time `json:"last_click_at,omitempty"`
+
+	clickers map[string]struct{}
+}
+
+func (l *LinkStats) add(click *models.ClickEvent) {
+	l.Clicks++
+
+	key := click.IPAddress + "|" + click.UserAgent
+	if _, seen := l.clickers[key]; !seen {
+		l.clickers[key] = struct{}{}
+		l.UniqueClickers++
+	}
+
+	if l.FirstClickAt == nil || click.ClickedAt.Before(*l.FirstClickAt) {
+		at := click.ClickedAt
+		l.FirstClickAt = &at
+	}
+	if l.LastClickAt == nil || click.ClickedAt.After(*l.LastClickAt) {
+		at := click.ClickedAt
+		l.LastClickAt = &at
+	}
+}
+
+// EmailLinks reports every tracked link of one email in the order it appears
+// in the body, including links nobody clicked. With filtered set, bot clicks
+// are ignored.
+func EmailLinks(email *models.Email, clicks []*models.ClickEvent, filtered bool) []*LinkStats {
+	links := make([]*LinkStats, len(email.Links))
+	byURL := make(map[string]*LinkStats)
+	for i, url := range email.Links {
+		index := i
+		links[i] = &LinkStats{URL: url, Index: &index, clickers: make(map[string]struct{})}
+		// Repeated links share stats; clicks only carry the URL
+		if _, ok := byURL[url]; !ok {
+			byURL[url] = links[i]
+		}
+	}
+
+	for _, click := range clicks {
+		if filtered && click.IsBot {
+			continue
+		}
+		if link, ok := byURL[click.URL]; ok {
+			link.add(click)
+		}
+	}
+	return links
+}
+
+// TopLinks aggregates clicks across many emails by URL, most clicked first,
+// returning at most limit entries (0 for all).
+func TopLinks(clicks []*models.ClickEvent, filtered bool, limit int) []*LinkStats {
+	byURL := make(map[string]*LinkStats)
+	for _, click := range clicks {
+		if filtered && click.IsBot {
+			continue
+		}
+		link, ok := byURL[click.URL]
+		if !ok {
+			link = &LinkStats{URL: click.URL, clickers: make(map[string]struct{})}
+			byURL[click.URL] = link
+		}
+		link.add(click)
+	}
+
+	links := make([]*LinkStats, 0, len(byURL))
+	for _, link := range byURL {
+		links = append(links, link)
+	}
+	sort.Slice(links, func(i, j int) bool {
+		if links[i].Clicks != links[j].Clicks {
+			return links[i].Clicks > links[j].Clicks
+		}
+		return links[i].URL < links[j].URL
+	})
+
+	if limit > 0 && len(links) > limit {
+		links = links[:limit]
+	}
+	return links
+}
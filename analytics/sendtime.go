@@ -0,0 +1,83 @@
+package analytics
+
+import (
+	"fmt"
+	"time"
+
+	"email-tracker/models"
+)
+
+const (
+	// sendTimeWindow is the width in hours of the recommended send window
+	sendTimeWindow = 2
+
+	// minSendTimeSample is the number of opens needed before a
+	// recommendation is considered reliable
+	minSendTimeSample = 20
+)
+
+type SendTimeRecommendation struct {
+	Scope          string  `json:"scope"`
+	Timezone       string  `json:"timezone"`
+	SampleSize     int     `json:"sample_size"`
+	HourlyOpens    [24]int `json:"hourly_opens"`
+	BestHourStart  int     `json:"best_hour_start"`
+	BestHourEnd    int     `json:"best_hour_end"`
+	WindowShare    float64 `json:"window_share"`
+	Reliable       bool    `json:"reliable"`
+	Recommendation string  `json:"recommendation"`
+}
+
+// SendTime builds an hour-of-day histogram of opens in loc and picks the
+// busiest window of sendTimeWindow consecutive hours (wrapping past
+// midnight). scope is a human label such as "acme.com recipients".
+func SendTime(scope string, events []*models.TrackingEvent, loc *time.Location) *SendTimeRecommendation {
+	rec := &SendTimeRecommendation{
+		Scope:      scope,
+		Timezone:   loc.String(),
+		SampleSize: len(events),
+	}
+
+	for _, event := range events {
+		rec.HourlyOpens[event.OpenedAt.In(loc).Hour()]++
+	}
+
+	if len(events) == 0 {
+		rec.Recommendation = fmt.Sprintf("No opens recorded yet for %s", scope)
+		return rec
+	}
+
+	best, bestCount := 0, -1
+	for start := 0; start < 24; start++ {
+		count := 0
+		for h := 0; h < sendTimeWindow; h++ {
+			count += rec.HourlyOpens[(start+h)%24]
+		}
+		if count > bestCount {
+			best, bestCount = start, count
+		}
+	}
+
+	rec.BestHourStart = best
+	rec.BestHourEnd = (best + sendTimeWindow) % 24
+	rec.WindowShare = percentage(bestCount, len(events))
+	rec.Reliable = len(events) >= minSendTimeSample
+	rec.Recommendation = fmt.Sprintf("%s typically open between %s and %s (%s), %.0f%% of %d opens",
+		scope, formatHour(rec.BestHourStart), formatHour(rec.BestHourEnd), rec.Timezone,
+		rec.WindowShare, len(events))
+
+	return rec
+}
+
+func formatHour(h int) string {
+	switch {
+	case h == 0:
+		return "12am"
+	case h < 12:
+		return fmt.Sprintf("%dam", h)
+	case h == 12:
+		return "12pm"
+	default:
+		return fmt.Sprintf("%dpm", h-12)
+	}
+}
@@ -0,0 +1,93 @@
+package analytics
+
+import (
+	"sort"
+	"time"
+
+	"email-tracker/models"
+)
+
+// maxTopPerformers limits how many emails are listed as top performers
+const maxTopPerformers = 5
+
+type EmailPerformance struct {
+	TrackingID  string `json:"tracking_id"`
+	Subject     string `json:"subject"`
+	To          string `json:"to"`
+	CampaignID  string `json:"campaign_id,omitempty"`
+	UniqueOpens int    `json:"unique_opens"`
+	TotalOpens  int    `json:"total_opens"`
+	TotalClicks int    `json:"total_clicks"`
+}
+
+type Summary struct {
+	From          time.Time          `json:"from"`
+	To            time.Time          `json:"to"`
+	EmailsSent    int                `json:"emails_sent"`
+	Delivered     int                `json:"delivered"`
+	Bounced       int                `json:"bounced"`
+	OpenedEmails  int                `json:"opened_emails"`
+	ClickedEmails int                `json:"clicked_emails"`
+	OpenRate      float64            `json:"open_rate"`
+	ClickRate     float64            `json:"click_rate"`
+	TotalOpens    int                `json:"total_opens"`
+	TotalClicks   int                `json:"total_clicks"`
+	TopPerformers []EmailPerformance `json:"top_performers"`
+}
+
+// Summarize aggregates the emails sent within [from, to). Rates are
+// percentages of emails sent in the period. With filtered set, bot opens and
+// clicks are ignored.
+func Summarize(emails []*models.Email, from, to time.Time, filtered bool) *Summary {
+	summary := &Summary{From: from, To: to}
+
+	var performers []EmailPerformance
+	for _, email := range emails {
+		if email.SentAt.Before(from) || !email.SentAt.Before(to) {
+			continue
+		}
+
+		summary.EmailsSent++
+		stats := email.OpenStats(filtered)
+		switch email.DeliveryStatus {
+		case models.DeliveryStatusDelivered:
+			summary.Delivered++
+		case models.DeliveryStatusBounced:
+			summary.Bounced++
+		}
+		if stats.TotalOpens > 0 {
+			summary.OpenedEmails++
+		}
+		if stats.TotalClicks > 0 {
+			summary.ClickedEmails++
+		}
+		summary.TotalOpens += stats.TotalOpens
+		summary.TotalClicks += stats.TotalClicks
+
+		performers = append(performers, EmailPerformance{
+			TrackingID:  email.TrackingID,
+			Subject:     email.Subject,
+			To:          email.To,
+			CampaignID:  email.CampaignID,
+			UniqueOpens: stats.UniqueOpens,
+			TotalOpens:  stats.TotalOpens,
+			TotalClicks: stats.TotalClicks,
+		})
+	}
+
+	summary.OpenRate = percentage(summary.OpenedEmails, summary.EmailsSent)
+	summary.ClickRate = percentage(summary.ClickedEmails, summary.EmailsSent)
+
+	sort.Slice(performers, func(i, j int) bool {
+		if performers[i].UniqueOpens != performers[j].UniqueOpens {
+			return performers[i].UniqueOpens > performers[j].UniqueOpens
+		}
+		return performers[i].TotalClicks > performers[j].TotalClicks
+	})
+	if len(performers) > maxTopPerformers {
+		performers = performers[:maxTopPerformers]
+	}
+	summary.TopPerformers = performers
+
+	return summary
+}
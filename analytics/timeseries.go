@@ -0,0 +1,58 @@
+package analytics
+
+import (
+	"fmt"
+	"time"
+
+	"email-tracker/models"
+)
+
+// maxBuckets caps the size of a single time-series response
+const maxBuckets = 5000
+
+type TimeSeriesPoint struct {
+	Start time.Time `json:"start"`
+	Opens int       `json:"opens"`
+}
+
+// BucketSize maps a bucket name ("hour" or "day") to its duration.
+func BucketSize(bucket string) (time.Duration, error) {
+	switch bucket {
+	case "hour":
+		return time.Hour, nil
+	case "day":
+		return 24 * time.Hour, nil
+	default:
+		return 0, fmt.Errorf("unsupported bucket %q, use hour or day", bucket)
+	}
+}
+
+// TimeSeries counts events per bucket between from and to (inclusive).
+// Empty buckets are included so the result can be charted directly.
+func TimeSeries(events []*models.TrackingEvent, size time.Duration, from, to time.Time) ([]TimeSeriesPoint, error) {
+	from = from.UTC().Truncate(size)
+	to = to.UTC().Truncate(size)
+	if to.Before(from) {
+		return nil, fmt.Errorf("range end is before range start")
+	}
+
+	n := int(to.Sub(from)/size) + 1
+	if n > maxBuckets {
+		return nil, fmt.Errorf("range too large: %d buckets (max %d)", n, maxBuckets)
+	}
+
+	points := make([]TimeSeriesPoint, n)
+	for i := range points {
+		points[i].Start = from.Add(time.Duration(i) * size)
+	}
+
+	for _, event := range events {
+		ts := event.OpenedAt.UTC().Truncate(size)
+		if ts.Before(from) || ts.After(to) {
+			continue
+		}
+		points[int(ts.Sub(from)/size)].Opens++
+	}
+
+	return points, nil
+}
@@ -0,0 +1,541 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"email-tracker/analytics"
+	"email-tracker/export"
+	"email-tracker/models"
+	"email-tracker/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+func (s *Server) getTrackingTimeSeries(c *gin.Context) {
+	trackingID := c.Param("id")
+
+	email := s.tracker.GetEmail(trackingID)
+	events := s.tracker.GetAllTrackingEvents(trackingID)
+	if email == nil && len(events) == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Tracking data not found"})
+		return
+	}
+
+	// Default range: from send time (or first open) until now
+	from := time.Now()
+	if email != nil {
+		from = email.SentAt
+	} else if len(events) > 0 {
+		from = events[0].OpenedAt
+	}
+
+	s.respondTimeSeries(c, gin.H{"tracking_id": trackingID}, events, from)
+}
+
+func (s *Server) getCampaignTimeSeries(c *gin.Context) {
+	campaignID := c.Param("id")
+
+	emails := s.tracker.GetCampaignEmails(currentTenant(c), campaignID)
+	if len(emails) == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Campaign not found"})
+		return
+	}
+
+	// Default range: from the first send until now
+	from := time.Now()
+	for _, email := range emails {
+		if email.SentAt.Before(from) {
+			from = email.SentAt
+		}
+	}
+
+	s.respondTimeSeries(c, gin.H{"campaign_id": campaignID}, s.tracker.GetCampaignEvents(currentTenant(c), campaignID), from)
+}
+
+// respondTimeSeries buckets events per ?bucket= between ?from= (default from)
+// and ?to= (default now) and writes the series along with the given scope.
+func (s *Server) respondTimeSeries(c *gin.Context, scope gin.H, events []*models.TrackingEvent, from time.Time) {
+	bucket := c.DefaultQuery("bucket", "hour")
+	size, err := analytics.BucketSize(bucket)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	to := time.Now()
+	if from, err = parseTimeQuery(c, "from", from); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if to, err = parseTimeQuery(c, "to", to); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	points, err := analytics.TimeSeries(s.filterEvents(c, events), size, from, to)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	response := gin.H{
+		"bucket":   bucket,
+		"from":     from.UTC(),
+		"to":       to.UTC(),
+		"filtered": isFiltered(c),
+		"points":   points,
+	}
+	for k, v := range scope {
+		response[k] = v
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+func (s *Server) getTrackingGeo(c *gin.Context) {
+	trackingID := c.Param("id")
+
+	events := s.tracker.GetAllTrackingEvents(trackingID)
+	if s.tracker.GetEmail(trackingID) == nil && len(events) == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Tracking data not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, analytics.Geo(s.filterEvents(c, events)))
+}
+
+func (s *Server) getTrackingGeoJSON(c *gin.Context) {
+	trackingID := c.Param("id")
+
+	events := s.tracker.GetAllTrackingEvents(trackingID)
+	if s.tracker.GetEmail(trackingID) == nil && len(events) == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Tracking data not found"})
+		return
+	}
+
+	c.Header("Content-Type", "application/geo+json")
+	c.JSON(http.StatusOK, analytics.GeoJSON(s.filterEvents(c, events)))
+}
+
+func (s *Server) getServiceGeo(c *gin.Context) {
+	c.JSON(http.StatusOK, analytics.Geo(s.filterEvents(c, s.tracker.AllTrackingEvents(currentTenant(c)))))
+}
+
+func (s *Server) getCampaignStats(c *gin.Context) {
+	campaignID := c.Param("id")
+
+	emails := s.tracker.GetCampaignEmails(currentTenant(c), campaignID)
+	if len(emails) == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Campaign not found"})
+		return
+	}
+
+	var clicks []*models.ClickEvent
+	for _, email := range emails {
+		clicks = append(clicks, s.tracker.GetClickEvents(email.TrackingID)...)
+	}
+
+	c.JSON(http.StatusOK, analytics.Campaign(campaignID, emails, clicks, isFiltered(c)))
+}
+
+func (s *Server) getTrackingLinks(c *gin.Context) {
+	email := s.tracker.GetEmail(c.Param("id"))
+	if email == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Email not found"})
+		return
+	}
+
+	clicks := s.tracker.GetClickEvents(email.TrackingID)
+	c.JSON(http.StatusOK, gin.H{
+		"tracking_id": email.TrackingID,
+		"links":       analytics.EmailLinks(email, clicks, isFiltered(c)),
+	})
+}
+
+func (s *Server) getCampaignLinks(c *gin.Context) {
+	campaignID := c.Param("id")
+
+	emails := s.tracker.GetCampaignEmails(currentTenant(c), campaignID)
+	if len(emails) == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Campaign not found"})
+		return
+	}
+
+	var clicks []*models.ClickEvent
+	for _, email := range emails {
+		clicks = append(clicks, s.tracker.GetClickEvents(email.TrackingID)...)
+	}
+
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "10"))
+	c.JSON(http.StatusOK, gin.H{
+		"campaign_id": campaignID,
+		"links":       analytics.TopLinks(clicks, isFiltered(c), limit),
+	})
+}
+
+func (s *Server) getABTestResult(c *gin.Context) {
+	testID := c.Param("id")
+
+	emails := s.tracker.GetABTestEmails(currentTenant(c), testID)
+	if len(emails) == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "A/B test not found"})
+		return
+	}
+
+	result, err := analytics.ABTest(testID, emails, isFiltered(c))
+	if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, result)
+}
+
+func (s *Server) getTrackingFunnel(c *gin.Context) {
+	email := s.tracker.GetEmail(c.Param("id"))
+	if email == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Email not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"tracking_id": email.TrackingID,
+		"stages":      analytics.Funnel([]*models.Email{email}, isFiltered(c)),
+	})
+}
+
+func (s *Server) getCampaignFunnel(c *gin.Context) {
+	campaignID := c.Param("id")
+
+	emails := s.tracker.GetCampaignEmails(currentTenant(c), campaignID)
+	if len(emails) == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Campaign not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"campaign_id": campaignID,
+		"stages":      analytics.Funnel(emails, isFiltered(c)),
+	})
+}
+
+// getCampaignCohorts shows open-rate retention per subscriber cohort for a
+// recurring campaign. period (day or week) controls how sends are grouped.
+func (s *Server) getCampaignCohorts(c *gin.Context) {
+	campaignID := c.Param("id")
+
+	var period time.Duration
+	switch c.DefaultQuery("period", "day") {
+	case "day":
+		period = 24 * time.Hour
+	case "week":
+		period = 7 * 24 * time.Hour
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "period must be day or week"})
+		return
+	}
+
+	emails := s.tracker.GetCampaignEmails(currentTenant(c), campaignID)
+	if len(emails) == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Campaign not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"campaign_id": campaignID,
+		"cohorts":     analytics.Cohorts(emails, period, isFiltered(c)),
+	})
+}
+
+// getDomainDeliverability reports open and bounce rates per recipient domain
+// for emails sent within from/to, bucketed by day or week.
+func (s *Server) getDomainDeliverability(c *gin.Context) {
+	var period time.Duration
+	switch c.DefaultQuery("bucket", "day") {
+	case "day":
+		period = 24 * time.Hour
+	case "week":
+		period = 7 * 24 * time.Hour
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "bucket must be day or week"})
+		return
+	}
+
+	from, err := parseTimeQuery(c, "from", time.Time{})
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	to, err := parseTimeQuery(c, "to", time.Time{})
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var emails []*models.Email
+	for _, email := range s.tracker.TenantEmails(currentTenant(c)) {
+		if !from.IsZero() && email.SentAt.Before(from) {
+			continue
+		}
+		if !to.IsZero() && email.SentAt.After(to) {
+			continue
+		}
+		emails = append(emails, email)
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"filtered": isFiltered(c),
+		"domains":  analytics.Domains(emails, period, isFiltered(c)),
+	})
+}
+
+// getSendTimeRecommendation analyses historical opens for a recipient address
+// or a recipient domain and recommends when to send. Hours are reported in
+// the timezone given by tz (IANA name, default UTC).
+func (s *Server) getSendTimeRecommendation(c *gin.Context) {
+	loc, err := time.LoadLocation(c.DefaultQuery("tz", "UTC"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "tz must be an IANA timezone name"})
+		return
+	}
+
+	var scope string
+	var match func(string) bool
+
+	if recipient := strings.ToLower(c.Query("recipient")); recipient != "" {
+		scope = recipient
+		match = func(to string) bool { return to == recipient }
+	} else if domain := strings.ToLower(c.Query("domain")); domain != "" {
+		scope = domain + " recipients"
+		match = func(to string) bool { return utils.ExtractDomain(to) == domain }
+	} else {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "recipient or domain is required"})
+		return
+	}
+
+	events := s.filterEvents(c, s.tracker.GetRecipientEvents(currentTenant(c), match))
+	c.JSON(http.StatusOK, analytics.SendTime(scope, events, loc))
+}
+
+// getOpenHeatmap returns a day-of-week by hour-of-day matrix of opens for an
+// email, campaign or everything. Hours are in tz (default UTC), or in each
+// recipient's own timezone with local=true.
+func (s *Server) getOpenHeatmap(c *gin.Context) {
+	loc, err := time.LoadLocation(c.DefaultQuery("tz", "UTC"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "tz must be an IANA timezone name"})
+		return
+	}
+
+	local := c.Query("local") == "true"
+	c.JSON(http.StatusOK, analytics.OpenHeatmap(s.scopedEvents(c), loc, local))
+}
+
+// getRealtimeCounters returns the live open/click counters for a tracking ID,
+// a campaign or a day (YYYY-MM-DD, default today). They are read from Redis
+// and never scan stored events. Days count every tenant's opens, so only
+// the operator's tenant sees them.
+func (s *Server) getRealtimeCounters(c *gin.Context) {
+	ctx := c.Request.Context()
+	tenant := currentTenant(c)
+
+	var scope string
+	var counts map[string]int64
+	var err error
+
+	switch {
+	case c.Query("tracking_id") != "":
+		if !s.tracker.OwnedBy(c.Query("tracking_id"), tenant) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Email not found"})
+			return
+		}
+		scope = "tracking_id"
+		counts, err = s.counters.TrackingCounts(ctx, c.Query("tracking_id"))
+	case c.Query("campaign_id") != "":
+		if tenant != models.DefaultTenant && len(s.tracker.GetCampaignEmails(tenant, c.Query("campaign_id"))) == 0 {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Campaign not found"})
+			return
+		}
+		scope = "campaign_id"
+		counts, err = s.counters.CampaignCounts(ctx, tenant, c.Query("campaign_id"))
+	default:
+		if tenant != models.DefaultTenant {
+			forbidden(c, "Only the operator's tenant can see the whole service")
+			return
+		}
+		scope = "day"
+		day := time.Now()
+		if v := c.Query("day"); v != "" {
+			if day, err = time.Parse("2006-01-02", v); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "day must be formatted as YYYY-MM-DD"})
+				return
+			}
+		}
+		counts, err = s.counters.DayCounts(ctx, day)
+	}
+
+	if err != nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Counters unavailable"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"scope":    scope,
+		"counters": counts,
+	})
+}
+
+// getDeviceBreakdown aggregates device type, browser and OS for one email
+// (tracking_id), one campaign (campaign_id) or everything, optionally limited
+// to a from/to time range.
+func (s *Server) getDeviceBreakdown(c *gin.Context) {
+	from, err := parseTimeQuery(c, "from", time.Time{})
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	to, err := parseTimeQuery(c, "to", time.Time{})
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	events := s.scopedEvents(c)
+	c.JSON(http.StatusOK, analytics.Devices(analytics.FilterByTime(events, from, to)))
+}
+
+// getOpenMap clusters open locations by city for the dashboard map, scoped
+// like the other service-wide analytics.
+func (s *Server) getOpenMap(c *gin.Context) {
+	from, err := parseTimeQuery(c, "from", time.Time{})
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	to, err := parseTimeQuery(c, "to", time.Time{})
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	events := analytics.FilterByTime(s.scopedEvents(c), from, to)
+	c.JSON(http.StatusOK, gin.H{
+		"filtered": isFiltered(c),
+		"clusters": analytics.CityClusters(events),
+	})
+}
+
+// scopedEvents selects the tenant's events by the tracking_id or
+// campaign_id query parameter, falling back to all of them.
+func (s *Server) scopedEvents(c *gin.Context) []*models.TrackingEvent {
+	if trackingID := c.Query("tracking_id"); trackingID != "" {
+		if !s.tracker.OwnedBy(trackingID, currentTenant(c)) {
+			return nil
+		}
+		return s.filterEvents(c, s.tracker.GetAllTrackingEvents(trackingID))
+	}
+	if campaignID := c.Query("campaign_id"); campaignID != "" {
+		return s.filterEvents(c, s.tracker.GetCampaignEvents(currentTenant(c), campaignID))
+	}
+	return s.filterEvents(c, s.tracker.AllTrackingEvents(currentTenant(c)))
+}
+
+// isFiltered reports whether the caller asked for bot-filtered metrics with
+// ?filtered=true. Raw metrics are the default.
+func isFiltered(c *gin.Context) bool {
+	return c.Query("filtered") == "true"
+}
+
+// filterEvents drops bot events when bot-filtered metrics were requested
+func (s *Server) filterEvents(c *gin.Context, events []*models.TrackingEvent) []*models.TrackingEvent {
+	if isFiltered(c) {
+		return analytics.HumanEvents(events)
+	}
+	return events
+}
+
+// parseTimeQuery reads an RFC3339 timestamp from the query string, returning
+// def when the parameter is absent.
+func parseTimeQuery(c *gin.Context, key string, def time.Time) (time.Time, error) {
+	v := c.Query(key)
+	if v == "" {
+		return def, nil
+	}
+	t, err := time.Parse(time.RFC3339, v)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%s must be an RFC3339 timestamp", key)
+	}
+	return t, nil
+}
+
+// exportAnalytics downloads analytics for a campaign (campaign_id) or for all
+// emails sent within a from/to range, as an .xlsx workbook (default) or as a
+// per-recipient CSV with format=csv.
+func (s *Server) exportAnalytics(c *gin.Context) {
+	from, err := parseTimeQuery(c, "from", time.Time{})
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	to, err := parseTimeQuery(c, "to", time.Now())
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	title := "All emails"
+	emails := s.tracker.TenantEmails(currentTenant(c))
+	if campaignID := c.Query("campaign_id"); campaignID != "" {
+		title = "Campaign " + campaignID
+		emails = s.tracker.GetCampaignEmails(currentTenant(c), campaignID)
+	}
+
+	data := &export.Data{Title: title, To: to, Filtered: isFiltered(c)}
+	for _, email := range emails {
+		if email.SentAt.Before(from) || email.SentAt.After(to) {
+			continue
+		}
+		data.Emails = append(data.Emails, email)
+		data.Events = append(data.Events, s.filterEvents(c, s.tracker.GetAllTrackingEvents(email.TrackingID))...)
+	}
+
+	// Without an explicit start, begin at the earliest exported send
+	data.From = from
+	if from.IsZero() {
+		data.From = to
+		for _, email := range data.Emails {
+			if email.SentAt.Before(data.From) {
+				data.From = email.SentAt
+			}
+		}
+	}
+
+	filename := fmt.Sprintf("email-analytics-%s", time.Now().Format("20060102-150405"))
+
+	switch c.DefaultQuery("format", "xlsx") {
+	case "csv":
+		c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.csv"`, filename))
+		c.Header("Content-Type", "text/csv")
+		if err := export.RecipientsCSV(c.Writer, data); err != nil {
+			c.Error(err)
+		}
+	case "xlsx":
+		workbook, err := export.Workbook(data)
+		if err != nil {
+			s.serverError(c, http.StatusInternalServerError, "failed to build the workbook", err)
+			return
+		}
+		defer workbook.Close()
+
+		c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.xlsx"`, filename))
+		c.Header("Content-Type", "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet")
+		if err := workbook.Write(c.Writer); err != nil {
+			c.Error(err)
+		}
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "format must be xlsx or csv"})
+	}
+}
@@ -0,0 +1,388 @@
+// Package audit keeps an append-only trail of sensitive operations: who did
+// what, to what and when.
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"email-tracker/models"
+	"email-tracker/utils"
+)
+
+// Actions recorded in the trail
+const (
+	ActionEmailSend         = "email.send"
+	ActionEmailResend       = "email.resend"
+	ActionEmailDelete       = "email.delete"
+	ActionEmailBounce       = "email.bounce"
+	ActionEmailComplaint    = "email.complaint"
+	ActionCampaignCreate    = "campaign.create"
+	ActionCampaignSchedule  = "campaign.schedule"
+	ActionCampaignSend      = "campaign.send"
+	ActionCampaignRetention = "campaign.retention"
+	ActionCampaignTags      = "campaign.tags"
+	ActionConfigReload      = "config.reload"
+	ActionLogin             = "auth.login"
+	ActionLoginFailed       = "auth.login_failed"
+	ActionLogout            = "auth.logout"
+	ActionDebugAccess       = "admin.debug"
+	ActionRecipientErase    = "data.recipient_erase"
+	ActionSuppressionAdd    = "suppression.add"
+	ActionSuppressionRemove = "suppression.remove"
+	ActionScannerUnban      = "scanner.unban"
+	ActionDataAccess        = "data.access"
+	ActionAuditExport       = "audit.export"
+	ActionAuditErase        = "audit.erase"
+	ActionConsentRequest    = "consent.request"
+	ActionConsentConfirm    = "consent.confirm"
+	ActionConsentWithdraw   = "consent.withdraw"
+	ActionContactCreate     = "contact.create"
+	ActionContactUpdate     = "contact.update"
+	ActionContactDelete     = "contact.delete"
+	ActionContactImport     = "contact.import"
+	ActionSegmentCreate     = "segment.create"
+	ActionSegmentUpdate     = "segment.update"
+	ActionSegmentDelete     = "segment.delete"
+	ActionSendingUpdate     = "tenant.sending_update"
+	ActionSendingRemove     = "tenant.sending_remove"
+	ActionDomainAdd         = "tenant.domain_add"
+	ActionDomainVerify      = "tenant.domain_verify"
+	ActionDomainRemove      = "tenant.domain_remove"
+	ActionTenantCreate      = "tenant.create"
+	ActionTenantUpdate      = "tenant.update"
+	ActionTenantSuspend     = "tenant.suspend"
+	ActionTenantResume      = "tenant.resume"
+	ActionKeyIssue          = "tenant.key_issue"
+	ActionKeyRotate         = "tenant.key_rotate"
+	ActionKeyRevoke         = "tenant.key_revoke"
+	ActionWebhookAdd        = "tenant.webhook_add"
+	ActionWebhookRemove     = "tenant.webhook_remove"
+	ActionNotifyUpdate      = "tenant.notifications_update"
+	ActionNotifyRemove      = "tenant.notifications_remove"
+	ActionBrandingUpdate    = "tenant.branding_update"
+	ActionBrandingRemove    = "tenant.branding_remove"
+)
+
+// ActorSystem is the actor for changes the service makes on its own, like
+// reloading config on SIGHUP
+const ActorSystem = "system"
+
+// Entry is one audited operation
+type Entry struct {
+	ID        string            `json:"id"`
+	Time      time.Time         `json:"time"`
+	Actor     string            `json:"actor"`
+	Action    string            `json:"action"`
+	Target    string            `json:"target,omitempty"`
+	Details   map[string]string `json:"details,omitempty"`
+	IP        string            `json:"ip,omitempty"`
+	RequestID string            `json:"request_id,omitempty"`
+	// Tenant is whose users made the change, empty for the default tenant
+	// and for entries recorded before tenants
+	Tenant string `json:"tenant,omitempty"`
+
+	// Each entry's Hash covers it and the previous entry's hash, so a
+	// changed, removed or reordered entry breaks the chain. Details are
+	// covered through DetailsHash, which survives Erase; Erased marks the
+	// entries whose details no longer match it. Their details are covered
+	// by the audit.erase entry Erase records instead, which holds the hash
+	// of the details it left, by entry ID.
+	DetailsHash string `json:"details_hash,omitempty"`
+	PrevHash    string `json:"prev_hash,omitempty"`
+	Hash        string `json:"hash,omitempty"`
+	Erased      bool   `json:"erased,omitempty"`
+}
+
+// Query narrows down the entries returned by Log.Query. Action matches
+// whole actions or a prefix ending in ".", e.g. "email.".
+type Query struct {
+	Actor  string
+	Action string
+	Target string
+	Since  time.Time
+	Until  time.Time
+	Limit  int
+}
+
+// Log appends entries to a JSON Lines file, when one is configured, and
+// keeps the most recent ones in memory for queries. Entries are never
+// removed from the file, and only changed by Erase. Every entry is chained
+// to the one before it by hash.
+type Log struct {
+	mu         sync.Mutex
+	path       string
+	file       *os.File
+	size       int64
+	entries    []Entry
+	maxEntries int
+	last       string
+}
+
+// Open loads the entries already in path and appends new ones to it. With
+// an empty path the trail is only kept in memory.
+func Open(path string, maxEntries int) (*Log, error) {
+	l := &Log{maxEntries: maxEntries}
+	if path == "" {
+		return l, nil
+	}
+
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("open audit log: %w", err)
+	}
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var entry Entry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			file.Close()
+			return nil, fmt.Errorf("read audit log %s: %w", path, err)
+		}
+		l.keep(entry)
+		l.last = entry.Hash
+	}
+	if err := scanner.Err(); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("read audit log %s: %w", path, err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("read audit log %s: %w", path, err)
+	}
+
+	l.path = path
+	l.file = file
+	l.size = info.Size()
+	return l, nil
+}
+
+// Record stamps entry with an ID, time and hash and appends it.
+func (l *Log) Record(entry Entry) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.record(entry)
+}
+
+// record does Record. Must be called with l.mu held.
+func (l *Log) record(entry Entry) error {
+	entry.ID = utils.GenerateUUID()
+	entry.DetailsHash = detailsHash(entry.Details)
+
+	// Stamped under the lock, so times never go back along the chain
+	entry.Time = time.Now().UTC()
+	entry.PrevHash = l.last
+	entry.Hash = entry.hash()
+
+	l.keep(entry)
+	l.last = entry.Hash
+	if l.file == nil {
+		return nil
+	}
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	n, err := l.file.Write(append(line, '\n'))
+	l.size += int64(n)
+	if err != nil {
+		return fmt.Errorf("write audit log: %w", err)
+	}
+	return nil
+}
+
+func (l *Log) keep(entry Entry) {
+	l.entries = append(l.entries, entry)
+	if l.maxEntries > 0 && len(l.entries) > l.maxEntries {
+		l.entries = append(l.entries[:0:0], l.entries[len(l.entries)-l.maxEntries:]...)
+	}
+}
+
+// Query returns matching entries, newest first.
+func (l *Log) Query(q Query) []Entry {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	matches := []Entry{}
+	for i := len(l.entries) - 1; i >= 0; i-- {
+		entry := l.entries[i]
+		if q.Actor != "" && entry.Actor != q.Actor {
+			continue
+		}
+		if q.Action != "" && entry.Action != q.Action &&
+			!(strings.HasSuffix(q.Action, ".") && strings.HasPrefix(entry.Action, q.Action)) {
+			continue
+		}
+		if q.Target != "" && entry.Target != q.Target {
+			continue
+		}
+		if !q.Since.IsZero() && entry.Time.Before(q.Since) {
+			continue
+		}
+		if !q.Until.IsZero() && !entry.Time.Before(q.Until) {
+			continue
+		}
+
+		matches = append(matches, entry)
+		if q.Limit > 0 && len(matches) == q.Limit {
+			break
+		}
+	}
+	return matches
+}
+
+// addressPattern finds what looks like an email address in a value, so an
+// address is only erased where it stands whole, not inside a longer one
+var addressPattern = regexp.MustCompile(`[\w.%+-]+@[\w.-]+`)
+
+// Erase replaces address, in any case, with replacement in the details of
+// the tenant's entries, in memory and in the file, and reports how many
+// entries in the file had it, or in memory without a file. Only whole
+// addresses are replaced, so erasing bob@example.com leaves
+// jimbob@example.com alone. The file is rewritten alongside and renamed
+// over the old one. The erasure is then recorded as an audit.erase entry
+// with the hash of each changed entry's new details, so the chain still
+// covers them.
+func (l *Log) Erase(tenant, address, replacement string) (int, error) {
+	tenant = models.TenantOr(tenant)
+	replace := func(value string) string {
+		return addressPattern.ReplaceAllStringFunc(value, func(found string) string {
+			// A sentence may end right after the address
+			trimmed := strings.TrimRight(found, ".")
+			if !strings.EqualFold(trimmed, address) {
+				return found
+			}
+			return replacement + found[len(trimmed):]
+		})
+	}
+	// What the changed entries' details hash to now, by entry ID
+	proofs := make(map[string]string)
+	// Details are replaced rather than changed, as queried entries share them
+	erase := func(entry *Entry) bool {
+		if models.TenantOr(entry.Tenant) != tenant {
+			return false
+		}
+		var details map[string]string
+		for key, value := range entry.Details {
+			if erased := replace(value); erased != value {
+				if details == nil {
+					details = maps.Clone(entry.Details)
+				}
+				details[key] = erased
+			}
+		}
+		if details == nil {
+			return false
+		}
+		entry.Details = details
+		entry.Erased = true
+		proofs[entry.ID] = detailsHash(details)
+		return true
+	}
+	recordErasure := func() error {
+		if len(proofs) == 0 {
+			return nil
+		}
+		erasure := Entry{Actor: ActorSystem, Action: ActionAuditErase, Details: proofs}
+		if tenant != models.DefaultTenant {
+			erasure.Tenant = tenant
+		}
+		return l.record(erasure)
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	erased := 0
+	for i := range l.entries {
+		if erase(&l.entries[i]) {
+			erased++
+		}
+	}
+	if l.file == nil {
+		return erased, recordErasure()
+	}
+
+	in, err := os.Open(l.path)
+	if err != nil {
+		return 0, fmt.Errorf("read audit log: %w", err)
+	}
+	defer in.Close()
+
+	tmp, err := os.CreateTemp(filepath.Dir(l.path), filepath.Base(l.path)+".*")
+	if err != nil {
+		return 0, fmt.Errorf("rewrite audit log: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	erased = 0
+	clear(proofs)
+	out := bufio.NewWriter(tmp)
+	scanner := bufio.NewScanner(in)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		var entry Entry
+		if err := json.Unmarshal(line, &entry); err == nil && erase(&entry) {
+			if line, err = json.Marshal(entry); err != nil {
+				return 0, err
+			}
+			erased++
+		}
+		out.Write(line)
+		out.WriteByte('\n')
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, fmt.Errorf("read audit log: %w", err)
+	}
+	if erased == 0 {
+		return 0, nil
+	}
+	if err := out.Flush(); err != nil {
+		return 0, fmt.Errorf("rewrite audit log: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		return 0, fmt.Errorf("rewrite audit log: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), l.path); err != nil {
+		return 0, fmt.Errorf("rewrite audit log: %w", err)
+	}
+
+	// Appends have to go to the new file from now on
+	file, err := os.OpenFile(l.path, os.O_RDWR|os.O_APPEND, 0o600)
+	if err != nil {
+		return erased, fmt.Errorf("reopen audit log: %w", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return erased, fmt.Errorf("reopen audit log: %w", err)
+	}
+	l.file.Close()
+	l.file = file
+	l.size = info.Size()
+	return erased, recordErasure()
+}
+
+// Close closes the file behind the log.
+func (l *Log) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.file == nil {
+		return nil
+	}
+	return l.file.Close()
+}
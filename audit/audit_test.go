@@ -0,0 +1,88 @@
+package audit
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestEraseWholeAddressesOnly(t *testing.T) {
+	tests := []struct {
+		value  string
+		erased string
+	}{
+		{"bob@example.com", "[erased]"},
+		{"Bob@Example.COM", "[erased]"},
+		{"jimbob@example.com", "jimbob@example.com"},
+		{"bob@example.com.au", "bob@example.com.au"},
+		{"alice@example.com, bob@example.com; jimbob@example.com", "alice@example.com, [erased]; jimbob@example.com"},
+		{"Bob <bob@example.com>", "Bob <[erased]>"},
+		{"sent to bob@example.com.", "sent to [erased]."},
+	}
+
+	for _, path := range []string{"", filepath.Join(t.TempDir(), "audit.jsonl")} {
+		l, err := Open(path, 100)
+		if err != nil {
+			t.Fatalf("open: %v", err)
+		}
+		for _, tt := range tests {
+			if err := l.Record(Entry{Actor: "admin", Action: ActionSuppressionAdd, Details: map[string]string{"address": tt.value}}); err != nil {
+				t.Fatalf("record: %v", err)
+			}
+		}
+
+		erased, err := l.Erase("", "bob@example.com", "[erased]")
+		if err != nil {
+			t.Fatalf("erase: %v", err)
+		}
+		if erased != 5 {
+			t.Errorf("erased %d entries, want 5", erased)
+		}
+		entries := l.Query(Query{Action: ActionSuppressionAdd})
+		for i, tt := range tests {
+			entry := entries[len(entries)-1-i]
+			if got := entry.Details["address"]; got != tt.erased {
+				t.Errorf("%q erased to %q, want %q", tt.value, got, tt.erased)
+			}
+			if entry.Erased != (tt.erased != tt.value) {
+				t.Errorf("%q marked erased %v", tt.value, entry.Erased)
+			}
+		}
+		l.Close()
+	}
+}
+
+func TestEraseOnlyTheTenantsEntries(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	l, err := Open(path, 100)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	for _, tenant := range []string{"", "acme", "globex"} {
+		l.Record(Entry{Actor: "admin", Action: ActionContactCreate, Tenant: tenant, Details: map[string]string{"address": "bob@example.com"}})
+	}
+
+	erased, err := l.Erase("acme", "bob@example.com", "[erased]")
+	if err != nil {
+		t.Fatalf("erase: %v", err)
+	}
+	if erased != 1 {
+		t.Fatalf("erased %d entries, want 1", erased)
+	}
+	l.Close()
+
+	// The file, read back, has the same erasure as memory had
+	l, err = Open(path, 100)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	defer l.Close()
+	for _, entry := range l.Query(Query{Action: ActionContactCreate}) {
+		want := "bob@example.com"
+		if entry.Tenant == "acme" {
+			want = "[erased]"
+		}
+		if got := entry.Details["address"]; got != want {
+			t.Errorf("tenant %q entry has %q, want %q", entry.Tenant, got, want)
+		}
+	}
+}
@@ -0,0 +1,402 @@
+package audit
+
+import (
+	"bufio"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"time"
+)
+
+// Manifest sums up an export: the range it covers, how many entries it
+// holds and where they sit in the hash chain. FirstPrevHash is the hash of
+// the entry just before the range, so consecutive exports can be joined.
+// Intact is false when an entry doesn't match its hash or doesn't follow
+// the one before it, or is erased without an erasure to account for its
+// details; BrokenAt is then the first such entry found. Unchained counts
+// entries recorded before the trail was hashed. ErasureHashes are the
+// erasures recorded after the range that account for erased entries in
+// it, which the export carries along.
+type Manifest struct {
+	Since         time.Time `json:"since"`
+	Until         time.Time `json:"until"`
+	GeneratedAt   time.Time `json:"generated_at"`
+	Count         int       `json:"count"`
+	Unchained     int       `json:"unchained"`
+	FirstPrevHash string    `json:"first_prev_hash"`
+	LastHash      string    `json:"last_hash"`
+	Intact        bool      `json:"intact"`
+	BrokenAt      string    `json:"broken_at,omitempty"`
+	ErasureHashes []string  `json:"erasure_hashes,omitempty"`
+}
+
+// exportDocument is an export as written by Export. Signature is the
+// Ed25519 signature of the manifest's exact bytes.
+type exportDocument struct {
+	Entries   []Entry         `json:"entries"`
+	Erasures  []Entry         `json:"erasures,omitempty"`
+	Manifest  json.RawMessage `json:"manifest"`
+	PublicKey string          `json:"public_key,omitempty"`
+	Signature string          `json:"signature,omitempty"`
+}
+
+// hash returns the entry's chain hash: the SHA-256, in hex, of its fields
+// and the previous entry's hash. Details are included as DetailsHash.
+func (e *Entry) hash() string {
+	// A struct, unlike a map, always marshals its fields in the same order
+	data, _ := json.Marshal(struct {
+		ID          string    `json:"id"`
+		Time        time.Time `json:"time"`
+		Actor       string    `json:"actor"`
+		Action      string    `json:"action"`
+		Target      string    `json:"target"`
+		DetailsHash string    `json:"details_hash"`
+		IP          string    `json:"ip"`
+		RequestID   string    `json:"request_id"`
+		PrevHash    string    `json:"prev_hash"`
+		// Left out when empty, so entries from before tenants hash as
+		// they did
+		Tenant string `json:"tenant,omitempty"`
+	}{e.ID, e.Time, e.Actor, e.Action, e.Target, e.DetailsHash, e.IP, e.RequestID, e.PrevHash, e.Tenant})
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// verifies reports whether an entry that isn't erased matches its hashes
+func (e *Entry) verifies() bool {
+	return e.Hash != "" && e.hash() == e.Hash && !e.Erased && detailsHash(e.Details) == e.DetailsHash
+}
+
+// detailsHash returns the SHA-256, in hex, of details, or "" without any.
+// Map keys are marshaled sorted, so equal details hash the same.
+func detailsHash(details map[string]string) string {
+	if len(details) == 0 {
+		return ""
+	}
+	data, _ := json.Marshal(details)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// chainCheck follows the hash chain through consecutive entries and fills
+// in the manifest as it goes. Erased entries are only settled by finish,
+// as the erasures that account for them come later.
+type chainCheck struct {
+	manifest *Manifest
+	prev     string
+	started  bool
+
+	// erased holds what the erased entries' details hash to, by ID, in
+	// the order they were seen
+	erased map[string]string
+	order  []string
+	// proven holds what the last erasure naming an entry says its details
+	// hash to
+	proven map[string]string
+}
+
+func (c *chainCheck) add(entry *Entry) {
+	m := c.manifest
+	m.Count++
+	if entry.Hash == "" {
+		m.Unchained++
+		if c.started {
+			// The chain doesn't go back to unhashed entries once it began
+			c.broken(entry)
+		}
+		return
+	}
+
+	if !c.started {
+		c.started = true
+		m.FirstPrevHash = entry.PrevHash
+	} else if entry.PrevHash != c.prev {
+		c.broken(entry)
+	}
+	if entry.hash() != entry.Hash || (!entry.Erased && detailsHash(entry.Details) != entry.DetailsHash) {
+		c.broken(entry)
+	}
+	if entry.Erased {
+		if c.erased == nil {
+			c.erased = make(map[string]string)
+		}
+		c.erased[entry.ID] = detailsHash(entry.Details)
+		c.order = append(c.order, entry.ID)
+	}
+	c.prove(entry)
+	c.prev = entry.Hash
+	m.LastHash = entry.Hash
+}
+
+// prove takes what an erasure says the details it left hash to
+func (c *chainCheck) prove(entry *Entry) {
+	if entry.Action != ActionAuditErase {
+		return
+	}
+	if c.proven == nil {
+		c.proven = make(map[string]string)
+	}
+	for id, hash := range entry.Details {
+		c.proven[id] = hash
+	}
+}
+
+// accounts reports whether erasure names an erased entry seen so far
+func (c *chainCheck) accounts(erasure *Entry) bool {
+	if erasure.Action != ActionAuditErase {
+		return false
+	}
+	for id := range erasure.Details {
+		if _, ok := c.erased[id]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// finish breaks the chain at the first erased entry whose details aren't
+// the ones its last erasure left, so erased details can't be changed
+// either
+func (c *chainCheck) finish() {
+	for _, id := range c.order {
+		if c.proven[id] != c.erased[id] {
+			c.broken(&Entry{ID: id})
+			return
+		}
+	}
+}
+
+func (c *chainCheck) broken(entry *Entry) {
+	if c.manifest.Intact {
+		c.manifest.Intact = false
+		c.manifest.BrokenAt = entry.ID
+	}
+}
+
+// Export writes every entry recorded in [since, until) as a JSON document
+// with a manifest, checking the hash chain on the way. With a key, the
+// manifest is signed. Entries come from the file, so the export is complete
+// even past the entries kept in memory; without a file, only those are
+// exported. A zero since starts from the first entry. Erasures recorded
+// after until that account for erased entries in the range are carried
+// along, apart from the entries.
+func (l *Log) Export(w io.Writer, since, until time.Time, key ed25519.PrivateKey) (*Manifest, error) {
+	manifest := &Manifest{
+		Since:       since.UTC(),
+		Until:       until.UTC(),
+		GeneratedAt: time.Now().UTC(),
+		Intact:      true,
+	}
+	check := chainCheck{manifest: manifest}
+
+	// Entries are read up to where the file ended when the export began,
+	// so ones recorded meanwhile don't land half-written in it
+	l.mu.Lock()
+	var entries []Entry
+	var source io.Reader
+	if l.file == nil {
+		entries = append(entries, l.entries...)
+	} else {
+		file, err := os.Open(l.path)
+		if err != nil {
+			l.mu.Unlock()
+			return nil, fmt.Errorf("read audit log: %w", err)
+		}
+		defer file.Close()
+		source = io.LimitReader(file, l.size)
+	}
+	l.mu.Unlock()
+
+	out := bufio.NewWriter(w)
+	out.WriteString(`{"entries":[`)
+	write := func(entry *Entry) error {
+		if !since.IsZero() && entry.Time.Before(since) {
+			return nil
+		}
+		if manifest.Count > 0 {
+			out.WriteByte(',')
+		}
+		check.add(entry)
+		line, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		_, err = out.Write(line)
+		return err
+	}
+	var erasures []Entry
+	carry := func(entry *Entry) {
+		if check.accounts(entry) && entry.verifies() {
+			check.prove(entry)
+			erasures = append(erasures, *entry)
+			manifest.ErasureHashes = append(manifest.ErasureHashes, entry.Hash)
+		}
+	}
+
+	if source == nil {
+		for i := range entries {
+			if !entries[i].Time.Before(until) {
+				carry(&entries[i])
+				continue
+			}
+			if err := write(&entries[i]); err != nil {
+				return nil, err
+			}
+		}
+	} else {
+		scanner := bufio.NewScanner(source)
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+		for scanner.Scan() {
+			var entry Entry
+			if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+				return nil, fmt.Errorf("read audit log: %w", err)
+			}
+			// Times only go forward along the file
+			if !entry.Time.Before(until) {
+				carry(&entry)
+				continue
+			}
+			if err := write(&entry); err != nil {
+				return nil, err
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, fmt.Errorf("read audit log: %w", err)
+		}
+	}
+
+	out.WriteByte(']')
+	if len(erasures) > 0 {
+		data, err := json.Marshal(erasures)
+		if err != nil {
+			return nil, err
+		}
+		out.WriteString(`,"erasures":`)
+		out.Write(data)
+	}
+	check.finish()
+
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		return nil, err
+	}
+	out.WriteString(`,"manifest":`)
+	out.Write(data)
+	if key != nil {
+		fmt.Fprintf(out, `,"public_key":%q,"signature":%q`,
+			PublicKey(key), base64.StdEncoding.EncodeToString(ed25519.Sign(key, data)))
+	}
+	out.WriteString("}\n")
+	return manifest, out.Flush()
+}
+
+// Errors from VerifyExport
+var (
+	ErrUnsigned     = errors.New("export is not signed")
+	ErrBadSignature = errors.New("signature does not match the manifest")
+	ErrTampered     = errors.New("entries do not match the manifest")
+	ErrBrokenChain  = errors.New("hash chain is broken")
+)
+
+// VerifyExport checks an export written by Export: the manifest's
+// signature, with publicKey or else the key embedded in the export, and
+// that the entries hash and chain up to what the manifest says. Only a
+// given publicKey shows who signed it. An unsigned export is checked all
+// the same and then fails with ErrUnsigned. The manifest is returned
+// whenever the export could be read.
+func VerifyExport(r io.Reader, publicKey ed25519.PublicKey) (*Manifest, error) {
+	var doc exportDocument
+	if err := json.NewDecoder(r).Decode(&doc); err != nil {
+		return nil, fmt.Errorf("read export: %w", err)
+	}
+	var manifest Manifest
+	if err := json.Unmarshal(doc.Manifest, &manifest); err != nil {
+		return nil, fmt.Errorf("read export manifest: %w", err)
+	}
+
+	if doc.Signature != "" {
+		if publicKey == nil {
+			embedded, err := base64.StdEncoding.DecodeString(doc.PublicKey)
+			if err != nil || len(embedded) != ed25519.PublicKeySize {
+				return &manifest, fmt.Errorf("export has an invalid public key")
+			}
+			publicKey = embedded
+		}
+		signature, err := base64.StdEncoding.DecodeString(doc.Signature)
+		if err != nil || !ed25519.Verify(publicKey, doc.Manifest, signature) {
+			return &manifest, ErrBadSignature
+		}
+	}
+
+	recomputed := Manifest{Intact: true}
+	check := chainCheck{manifest: &recomputed}
+	for i := range doc.Entries {
+		entry := &doc.Entries[i]
+		if entry.Time.Before(manifest.Since) || !entry.Time.Before(manifest.Until) {
+			return &manifest, ErrTampered
+		}
+		check.add(entry)
+	}
+	for i := range doc.Erasures {
+		erasure := &doc.Erasures[i]
+		if erasure.Time.Before(manifest.Until) || !check.accounts(erasure) || !erasure.verifies() {
+			return &manifest, ErrTampered
+		}
+		check.prove(erasure)
+		recomputed.ErasureHashes = append(recomputed.ErasureHashes, erasure.Hash)
+	}
+	check.finish()
+	if recomputed.Count != manifest.Count || recomputed.Unchained != manifest.Unchained ||
+		recomputed.FirstPrevHash != manifest.FirstPrevHash || recomputed.LastHash != manifest.LastHash ||
+		recomputed.Intact != manifest.Intact || recomputed.BrokenAt != manifest.BrokenAt ||
+		!slices.Equal(recomputed.ErasureHashes, manifest.ErasureHashes) {
+		return &manifest, ErrTampered
+	}
+	if !manifest.Intact {
+		return &manifest, fmt.Errorf("%w at entry %s", ErrBrokenChain, manifest.BrokenAt)
+	}
+	if doc.Signature == "" {
+		// The entries are consistent, but anyone could have written them
+		return &manifest, ErrUnsigned
+	}
+	return &manifest, nil
+}
+
+// ParseSigningKey reads AUDIT_SIGNING_KEY: a base64 Ed25519 seed, or a
+// whole private key.
+func ParseSigningKey(encoded string) (ed25519.PrivateKey, error) {
+	raw, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("signing key is not base64: %w", err)
+	}
+	switch len(raw) {
+	case ed25519.SeedSize:
+		return ed25519.NewKeyFromSeed(raw), nil
+	case ed25519.PrivateKeySize:
+		return ed25519.PrivateKey(raw), nil
+	}
+	return nil, fmt.Errorf("signing key must be a %d-byte Ed25519 seed or %d-byte private key", ed25519.SeedSize, ed25519.PrivateKeySize)
+}
+
+// GenerateSigningKey returns a new seed for AUDIT_SIGNING_KEY and its
+// public key, both in base64.
+func GenerateSigningKey() (seed, publicKey string, err error) {
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return "", "", err
+	}
+	return base64.StdEncoding.EncodeToString(private.Seed()), base64.StdEncoding.EncodeToString(public), nil
+}
+
+// PublicKey returns key's public half in base64, as auditors are given it
+func PublicKey(key ed25519.PrivateKey) string {
+	return base64.StdEncoding.EncodeToString(key.Public().(ed25519.PublicKey))
+}
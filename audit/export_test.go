@@ -0,0 +1,147 @@
+package audit
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// erasedLog returns a log file with three entries about bob@example.com,
+// the first two erased, and the erasure
+func erasedLog(t *testing.T) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	l, err := Open(path, 100)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	defer l.Close()
+	for _, tenant := range []string{"", "", "acme"} {
+		l.Record(Entry{Actor: "admin", Action: ActionSuppressionAdd, Tenant: tenant, Details: map[string]string{"address": "bob@example.com"}})
+	}
+	if _, err := l.Erase("", "bob@example.com", "[erased]"); err != nil {
+		t.Fatalf("erase: %v", err)
+	}
+	return path
+}
+
+// tamper rewrites the entries in the file at path with change
+func tamper(t *testing.T, path string, change func(i int, entry *Entry)) {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	var out []byte
+	for i, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		var entry Entry
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("line %d: %v", i, err)
+		}
+		change(i, &entry)
+		line, _ := json.Marshal(entry)
+		out = append(append(out, line...), '\n')
+	}
+	if err := os.WriteFile(path, out, 0o600); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+}
+
+// export exports everything in the file at path before until and verifies
+// the export
+func export(t *testing.T, path string, until time.Time) (*Manifest, error) {
+	t.Helper()
+	l, err := Open(path, 100)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	defer l.Close()
+	_, key, _ := ed25519.GenerateKey(nil)
+	var buf bytes.Buffer
+	if _, err := l.Export(&buf, time.Time{}, until, key); err != nil {
+		t.Fatalf("export: %v", err)
+	}
+	return VerifyExport(&buf, key.Public().(ed25519.PublicKey))
+}
+
+func TestExportCoversErasedDetails(t *testing.T) {
+	path := erasedLog(t)
+	manifest, err := export(t, path, time.Now().Add(time.Minute))
+	if err != nil {
+		t.Fatalf("verify: %v", err)
+	}
+	if !manifest.Intact || manifest.Count != 4 {
+		t.Fatalf("manifest = %+v, want 4 intact entries", manifest)
+	}
+}
+
+func TestExportCarriesLaterErasures(t *testing.T) {
+	path := erasedLog(t)
+	l, _ := Open(path, 100)
+	erasure := l.Query(Query{Action: ActionAuditErase})[0]
+	l.Close()
+
+	manifest, err := export(t, path, erasure.Time)
+	if err != nil {
+		t.Fatalf("verify: %v", err)
+	}
+	if !manifest.Intact || manifest.Count != 3 || len(manifest.ErasureHashes) != 1 {
+		t.Fatalf("manifest = %+v, want 3 intact entries and the erasure", manifest)
+	}
+}
+
+func TestExportFindsTamperedErasures(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(i int, entry *Entry)
+		broken int
+	}{
+		{"erased details changed", func(i int, entry *Entry) {
+			if i == 1 {
+				entry.Details["address"] = "someone else"
+			}
+		}, 1},
+		{"entry marked erased", func(i int, entry *Entry) {
+			if i == 2 {
+				entry.Details["address"] = "[erased]"
+				entry.Erased = true
+			}
+		}, 2},
+		{"erasure changed to cover edits", func(i int, entry *Entry) {
+			edited := map[string]string{"address": "someone else"}
+			if entry.Erased {
+				entry.Details = edited
+			}
+			if entry.Action == ActionAuditErase {
+				for id := range entry.Details {
+					entry.Details[id] = detailsHash(edited)
+				}
+			}
+		}, 3},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := erasedLog(t)
+			var ids []string
+			tamper(t, path, func(i int, entry *Entry) {
+				ids = append(ids, entry.ID)
+				tt.change(i, entry)
+			})
+
+			manifest, err := export(t, path, time.Now().Add(time.Minute))
+			if !errors.Is(err, ErrBrokenChain) {
+				t.Fatalf("verify = %v, want a broken chain", err)
+			}
+			if manifest.BrokenAt != ids[tt.broken] {
+				t.Fatalf("broken at %s, want entry %d", manifest.BrokenAt, tt.broken)
+			}
+		})
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"email-tracker/audit"
+	"email-tracker/config"
+	"email-tracker/logging"
+	"email-tracker/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	defaultAuditLimit = 100
+	maxAuditLimit     = 1000
+)
+
+// recordAudit adds an entry for the signed-in user, or "anonymous" when
+// authentication is off. A failure to write the trail is logged but doesn't
+// fail the request.
+func (s *Server) recordAudit(c *gin.Context, action, target string, details map[string]string) {
+	s.recordAuditAs(c, auditActor(c), action, target, details)
+}
+
+// auditActor is who the trail credits with the request
+func auditActor(c *gin.Context) string {
+	if actor := currentUsername(c); actor != "" {
+		return actor
+	}
+	return "anonymous"
+}
+
+// auditTenant is whose entry it is, left empty for the default tenant
+func auditTenant(c *gin.Context) string {
+	if tenant := currentTenant(c); tenant != models.DefaultTenant {
+		return tenant
+	}
+	return ""
+}
+
+func (s *Server) recordAuditAs(c *gin.Context, actor, action, target string, details map[string]string) {
+	err := s.audit.Record(audit.Entry{
+		Actor:     actor,
+		Action:    action,
+		Target:    target,
+		Details:   details,
+		IP:        c.ClientIP(),
+		RequestID: c.Writer.Header().Get("X-Request-ID"),
+		Tenant:    auditTenant(c),
+	})
+	if err != nil {
+		s.auditFailures.Add(1)
+		slog.Error("failed to record audit entry", "action", action, "error", err)
+	}
+}
+
+// getAuditLog returns audit entries, newest first, filtered by ?actor=,
+// ?action= (e.g. email.delete, or email. for every email action), ?target=,
+// and ?since= and ?until= in RFC 3339.
+func (s *Server) getAuditLog(c *gin.Context) {
+	query := audit.Query{
+		Actor:  c.Query("actor"),
+		Action: c.Query("action"),
+		Target: c.Query("target"),
+		Limit:  defaultAuditLimit,
+	}
+
+	for param, at := range map[string]*time.Time{"since": &query.Since, "until": &query.Until} {
+		if v := c.Query(param); v != "" {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": param + " must be an RFC 3339 time"})
+				return
+			}
+			*at = t
+		}
+	}
+	if v := c.Query("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit < 1 || limit > maxAuditLimit {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "limit must be between 1 and " + strconv.Itoa(maxAuditLimit)})
+			return
+		}
+		query.Limit = limit
+	}
+
+	c.JSON(http.StatusOK, gin.H{"entries": s.audit.Query(query)})
+}
+
+// auditSettings are the audit settings that apply on reload
+type auditSettings struct {
+	signingKey ed25519.PrivateKey
+	dataAccess bool
+}
+
+func (s *Server) storeAuditSettings(cfg *config.Config) {
+	settings := &auditSettings{dataAccess: cfg.Audit.DataAccess}
+	if cfg.Audit.SigningKey != "" {
+		key, err := audit.ParseSigningKey(cfg.Audit.SigningKey)
+		if err != nil {
+			slog.Error("invalid AUDIT_SIGNING_KEY, audit exports are unsigned", "error", err)
+		}
+		settings.signingKey = key
+	}
+	s.auditSettings.Store(settings)
+}
+
+// auditAccess records reads of recipient data in the trail, when
+// AUDIT_DATA_ACCESS is on. Only requests that succeed are recorded, after
+// the handler, so cached responses count too.
+func (s *Server) auditAccess() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Next()
+		if !s.auditSettings.Load().dataAccess || c.Writer.Status() >= http.StatusBadRequest {
+			return
+		}
+		s.recordAudit(c, audit.ActionDataAccess, c.Param("id"), map[string]string{"path": c.FullPath()})
+	}
+}
+
+// exportAuditLog downloads every entry recorded between ?since= and
+// ?until=, in RFC 3339, with a manifest of the hash chain, signed with
+// AUDIT_SIGNING_KEY. until defaults to now and since to the first entry.
+func (s *Server) exportAuditLog(c *gin.Context) {
+	since, until := time.Time{}, time.Now()
+	for param, at := range map[string]*time.Time{"since": &since, "until": &until} {
+		if v := c.Query(param); v != "" {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": param + " must be an RFC 3339 time"})
+				return
+			}
+			*at = t
+		}
+	}
+	if !since.Before(until) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "since must be before until"})
+		return
+	}
+
+	c.Header("Content-Type", "application/json")
+	c.Header("Content-Disposition", `attachment; filename="audit-`+until.UTC().Format("20060102T150405Z")+`.json"`)
+	manifest, err := s.audit.Export(c.Writer, since, until, s.auditSettings.Load().signingKey)
+	if err != nil {
+		if !c.Writer.Written() {
+			c.Writer.Header().Del("Content-Disposition")
+			s.serverError(c, http.StatusInternalServerError, "failed to export the audit log", err)
+			return
+		}
+		logging.FromContext(c.Request.Context()).Error("audit export cut short", "error", err)
+		return
+	}
+	if !manifest.Intact {
+		logging.FromContext(c.Request.Context()).Error("audit log hash chain is broken", "entry", manifest.BrokenAt)
+	}
+	s.recordAudit(c, audit.ActionAuditExport, "", map[string]string{
+		"since":  manifest.Since.Format(time.RFC3339),
+		"until":  manifest.Until.Format(time.RFC3339),
+		"count":  strconv.Itoa(manifest.Count),
+		"intact": strconv.FormatBool(manifest.Intact),
+	})
+}
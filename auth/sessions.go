@@ -0,0 +1,92 @@
+package auth
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"sync"
+	"time"
+)
+
+type Session struct {
+	Username  string
+	ExpiresAt time.Time
+}
+
+// SessionStore keeps dashboard login sessions in memory, keyed by an opaque
+// random token stored in the session cookie.
+type SessionStore struct {
+	mu       sync.Mutex
+	ttl      time.Duration
+	sessions map[string]*Session
+}
+
+func NewSessionStore(ttl time.Duration) *SessionStore {
+	return &SessionStore{
+		ttl:      ttl,
+		sessions: make(map[string]*Session),
+	}
+}
+
+// Create starts a session for username and returns its token.
+func (s *SessionStore) Create(username string) (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	token := base64.RawURLEncoding.EncodeToString(b)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.removeExpired(time.Now())
+	s.sessions[token] = &Session{
+		Username:  username,
+		ExpiresAt: time.Now().Add(s.ttl),
+	}
+	return token, nil
+}
+
+// Get returns the live session for token.
+func (s *SessionStore) Get(token string) (*Session, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	session, exists := s.sessions[token]
+	if !exists {
+		return nil, false
+	}
+	if time.Now().After(session.ExpiresAt) {
+		delete(s.sessions, token)
+		return nil, false
+	}
+	return session, true
+}
+
+// Delete ends the session for token.
+func (s *SessionStore) Delete(token string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.sessions, token)
+}
+
+// TTL is how long a session lasts after login.
+func (s *SessionStore) TTL() time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.ttl
+}
+
+// SetTTL changes the lifetime of sessions created from now on.
+func (s *SessionStore) SetTTL(ttl time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ttl = ttl
+}
+
+func (s *SessionStore) removeExpired(now time.Time) {
+	for token, session := range s.sessions {
+		if now.After(session.ExpiresAt) {
+			delete(s.sessions, token)
+		}
+	}
+}
@@ -0,0 +1,186 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"log/slog"
+	"strings"
+	"sync"
+
+	"email-tracker/config"
+	"email-tracker/models"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Roles, from least to most privileged. Each role may do everything the
+// ones before it may.
+const (
+	// RoleViewer reads stats, emails and campaigns
+	RoleViewer = "viewer"
+	// RoleSender also sends emails and runs campaigns
+	RoleSender = "sender"
+	// RoleAdmin also purges data, changes the suppression list and
+	// retention, and reads the audit trail and /debug
+	RoleAdmin = "admin"
+)
+
+var roleRank = map[string]int{RoleViewer: 1, RoleSender: 2, RoleAdmin: 3}
+
+// ValidRole reports whether role is one of the roles above.
+func ValidRole(role string) bool {
+	return roleRank[role] > 0
+}
+
+type User struct {
+	Username     string
+	PasswordHash string
+	Role         string
+	// Tenant is the workspace whose data the user sees and sends from
+	Tenant string
+}
+
+// Can reports whether the user's role includes role.
+func (u *User) Can(role string) bool {
+	return roleRank[u.Role] >= roleRank[role]
+}
+
+// Store holds the dashboard users and API keys loaded from config.
+type Store struct {
+	mu      sync.RWMutex
+	users   map[string]*User
+	apiKeys map[string]*User
+}
+
+// NewStore builds the user store from AUTH_USERS ("name:bcrypt-hash,...")
+// and API_KEYS ("name:key,..."). An API key belongs to the user with the
+// same name, which is created if it has no password. Roles come from
+// AUTH_ROLES ("name:role,..."); users named in AUTH_ADMINS are admins, and
+// everyone else gets AUTH_DEFAULT_ROLE. AUTH_TENANTS ("name:tenant,...")
+// puts users in tenants; the others are in the default tenant.
+func NewStore(cfg *config.Config) *Store {
+	s := &Store{}
+	s.Reload(cfg)
+	return s
+}
+
+// Reload replaces all users and API keys with the ones in cfg. Sessions of
+// users that no longer exist stop working on their next request.
+func (s *Store) Reload(cfg *config.Config) {
+	users := make(map[string]*User)
+	apiKeys := make(map[string]*User)
+
+	for _, entry := range cfg.Auth.Users {
+		name, hash, ok := strings.Cut(entry, ":")
+		if !ok || name == "" || hash == "" {
+			slog.Warn("ignoring malformed AUTH_USERS entry", "user", name)
+			continue
+		}
+		users[name] = &User{Username: name, PasswordHash: hash, Role: cfg.Auth.DefaultRole, Tenant: models.DefaultTenant}
+	}
+
+	for _, entry := range cfg.Auth.APIKeys {
+		name, key, ok := strings.Cut(entry, ":")
+		if !ok || name == "" || key == "" {
+			slog.Warn("ignoring malformed API_KEYS entry", "key_name", name)
+			continue
+		}
+		user, exists := users[name]
+		if !exists {
+			user = &User{Username: name, Role: cfg.Auth.DefaultRole, Tenant: models.DefaultTenant}
+			users[name] = user
+		}
+		apiKeys[hashKey(key)] = user
+	}
+
+	for _, entry := range cfg.Auth.Roles {
+		name, role, _ := strings.Cut(entry, ":")
+		user, exists := users[name]
+		if !exists || !ValidRole(role) {
+			slog.Warn("ignoring AUTH_ROLES entry without a user or API key, or with an unknown role", "user", name, "role", role)
+			continue
+		}
+		user.Role = role
+	}
+
+	for _, entry := range cfg.Auth.Tenants {
+		name, tenant, _ := strings.Cut(entry, ":")
+		user, exists := users[name]
+		if !exists || !models.ValidTenantID(tenant) {
+			slog.Warn("ignoring AUTH_TENANTS entry without a user or API key, or with an invalid tenant", "user", name, "tenant", tenant)
+			continue
+		}
+		user.Tenant = tenant
+	}
+
+	for _, name := range cfg.Auth.Admins {
+		user, exists := users[name]
+		if !exists {
+			slog.Warn("ignoring AUTH_ADMINS entry without a user or API key", "user", name)
+			continue
+		}
+		user.Role = RoleAdmin
+	}
+
+	s.mu.Lock()
+	s.users = users
+	s.apiKeys = apiKeys
+	s.mu.Unlock()
+}
+
+// Enabled reports whether any user or API key is configured. Without them
+// the dashboard and API stay open, as in local development.
+func (s *Store) Enabled() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.users) > 0
+}
+
+// Authenticate checks a username and password against the stored bcrypt hash.
+func (s *Store) Authenticate(username, password string) (*User, bool) {
+	user, exists := s.User(username)
+	if !exists || user.PasswordHash == "" {
+		// Spend the same time as a real check so usernames can't be probed
+		bcrypt.CompareHashAndPassword([]byte(dummyHash), []byte(password))
+		return nil, false
+	}
+
+	if err := bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(password)); err != nil {
+		return nil, false
+	}
+	return user, true
+}
+
+// LookupAPIKey returns the user an API key belongs to.
+func (s *Store) LookupAPIKey(key string) (*User, bool) {
+	if key == "" {
+		return nil, false
+	}
+	hashed := hashKey(key)
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for stored, user := range s.apiKeys {
+		if subtle.ConstantTimeCompare([]byte(stored), []byte(hashed)) == 1 {
+			return user, true
+		}
+	}
+	return nil, false
+}
+
+// User returns the user with the given name.
+func (s *Store) User(username string) (*User, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	user, exists := s.users[username]
+	return user, exists
+}
+
+func hashKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// bcrypt hash of a random string, used to equalize login timing
+const dummyHash = "$2a$10$BInsQ92O7n9RfvTqidl68efYpldeBlZ2OjfzYqEnA48bMPyJrP0Qm"
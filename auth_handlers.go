@@ -0,0 +1,278 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"email-tracker/audit"
+	"email-tracker/auth"
+	"email-tracker/models"
+	"email-tracker/tenants"
+
+	"github.com/gin-gonic/gin"
+)
+
+const sessionCookie = "et_session"
+
+func (s *Server) loginPage(c *gin.Context) {
+	c.HTML(http.StatusOK, "login.html", gin.H{
+		"title": "Sign in · Email Tracker",
+		"next":  safeRedirect(c.Query("next")),
+	})
+}
+
+func (s *Server) login(c *gin.Context) {
+	next := safeRedirect(c.PostForm("next"))
+
+	user, ok := s.users.Authenticate(c.PostForm("username"), c.PostForm("password"))
+	if !ok {
+		s.recordAuditAs(c, c.PostForm("username"), audit.ActionLoginFailed, "", nil)
+		c.HTML(http.StatusUnauthorized, "login.html", gin.H{
+			"title": "Sign in · Email Tracker",
+			"next":  next,
+			"error": "Invalid username or password",
+		})
+		return
+	}
+
+	token, err := s.sessions.Create(user.Username)
+	if err != nil {
+		c.HTML(http.StatusInternalServerError, "login.html", gin.H{
+			"title": "Sign in · Email Tracker",
+			"next":  next,
+			"error": "Could not start a session, please try again",
+		})
+		return
+	}
+
+	s.setSessionCookie(c, token, int(s.sessions.TTL().Seconds()))
+	s.recordAuditAs(c, user.Username, audit.ActionLogin, "", nil)
+	c.Redirect(http.StatusSeeOther, next)
+}
+
+func (s *Server) logout(c *gin.Context) {
+	if user, ok := s.sessionUser(c); ok {
+		s.recordAuditAs(c, user.Username, audit.ActionLogout, "", nil)
+	}
+	if token, err := c.Cookie(sessionCookie); err == nil {
+		s.sessions.Delete(token)
+	}
+	s.setSessionCookie(c, "", -1)
+	c.Redirect(http.StatusSeeOther, "/login")
+}
+
+func (s *Server) setSessionCookie(c *gin.Context, token string, maxAge int) {
+	c.SetSameSite(http.SameSiteLaxMode)
+	c.SetCookie(sessionCookie, token, maxAge, "/", "", s.config.App.Env == "production", true)
+}
+
+// requireSession protects dashboard pages, redirecting to the login page
+// when there is no valid session.
+func (s *Server) requireSession() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !s.users.Enabled() {
+			c.Next()
+			return
+		}
+
+		if user, ok := s.sessionUser(c); ok {
+			if s.signIn(c, user) {
+				c.Next()
+			}
+			return
+		}
+
+		c.Redirect(http.StatusSeeOther, "/login?next="+url.QueryEscape(c.Request.URL.RequestURI()))
+		c.Abort()
+	}
+}
+
+// requireAuth protects the JSON API. Callers authenticate with an API key
+// (X-API-Key or Authorization: Bearer), configured or issued to a tenant,
+// or with a dashboard session.
+func (s *Server) requireAuth() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !s.users.Enabled() {
+			c.Next()
+			return
+		}
+
+		key := apiKeyFromRequest(c)
+		user, ok := s.users.LookupAPIKey(key)
+		if !ok {
+			if issued, found := s.tenants.LookupAPIKey(key); found {
+				user = &auth.User{Username: issued.Name, Role: issued.Role, Tenant: issued.Tenant}
+				ok = true
+			}
+		}
+		if !ok {
+			user, ok = s.sessionUser(c)
+		}
+		if ok {
+			if s.signIn(c, user) {
+				c.Next()
+			}
+			return
+		}
+
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Authentication required"})
+	}
+}
+
+// signIn makes user the request's user, unless their tenant is suspended,
+// which is answered with a 403 instead.
+func (s *Server) signIn(c *gin.Context, user *auth.User) bool {
+	if err := s.tenants.CheckActive(user.Tenant); err != nil {
+		forbidden(c, "Tenant suspended")
+		return false
+	}
+	c.Set("user", user)
+	return true
+}
+
+// requireRole runs after requireAuth or requireSession and only lets users
+// whose role includes role through. With authentication off it allows
+// everyone, except to admin routes in production.
+func (s *Server) requireRole(role string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !s.users.Enabled() {
+			if role == auth.RoleAdmin && s.config.App.Env == "production" {
+				forbidden(c, "Admin access requires authentication to be configured")
+				return
+			}
+			c.Next()
+			return
+		}
+
+		if user, ok := c.Get("user"); ok && user.(*auth.User).Can(role) {
+			c.Next()
+			return
+		}
+
+		forbidden(c, strings.ToUpper(role[:1])+role[1:]+" access required")
+	}
+}
+
+// requireAdmin only lets admins through
+func (s *Server) requireAdmin() gin.HandlerFunc {
+	return s.requireRole(auth.RoleAdmin)
+}
+
+// currentTenant returns the tenant whose data the request may see: the
+// user's, or the default tenant with authentication off.
+func currentTenant(c *gin.Context) string {
+	if user, ok := c.Get("user"); ok {
+		return models.TenantOr(user.(*auth.User).Tenant)
+	}
+	return models.DefaultTenant
+}
+
+// requireAuthConfigured refuses to register tenants or issue keys while
+// authentication is off, as their keys would be ignored and every request
+// would still run as the operator.
+func (s *Server) requireAuthConfigured() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !s.users.Enabled() {
+			c.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": "Authentication is off: configure AUTH_USERS or API_KEYS before registering tenants or issuing API keys"})
+			return
+		}
+		c.Next()
+	}
+}
+
+// warnIgnoredKeys warns when tenants have API keys that are ignored
+// because authentication is off
+func warnIgnoredKeys(users *auth.Store, tenantStore *tenants.Store) {
+	if !users.Enabled() && tenantStore.HasAPIKeys() {
+		slog.Warn("tenant API keys are ignored while no AUTH_USERS or API_KEYS are configured, every request runs as the operator")
+	}
+}
+
+// requireOperator keeps service-wide routes, like system health and the
+// audit trail, to users of the default tenant, who run the service.
+func (s *Server) requireOperator() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if currentTenant(c) != models.DefaultTenant {
+			forbidden(c, "Only the operator's tenant can see the whole service")
+			return
+		}
+		c.Next()
+	}
+}
+
+// ownEmail answers 404 for an email of another tenant, as if it didn't
+// exist, so tracking IDs can't be probed across tenants.
+func (s *Server) ownEmail() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !s.tracker.OwnedBy(c.Param("id"), currentTenant(c)) {
+			notFound(c, "Email not found")
+			return
+		}
+		c.Next()
+	}
+}
+
+// ownCampaign answers 404 for a campaign of another tenant. Campaign IDs
+// that were only given with sends have no owner to check; their stats are
+// scoped by the emails they cover.
+func (s *Server) ownCampaign() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if campaign, ok := s.campaigns.Get(c.Param("id")); ok && campaign.Tenant() != currentTenant(c) {
+			notFound(c, "Campaign not found")
+			return
+		}
+		c.Next()
+	}
+}
+
+// forbidden answers 403 as JSON to API clients and as text to browsers
+func forbidden(c *gin.Context, message string) {
+	if c.NegotiateFormat(gin.MIMEJSON, gin.MIMEHTML) == gin.MIMEHTML {
+		c.String(http.StatusForbidden, message)
+		c.Abort()
+		return
+	}
+	c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": message})
+}
+
+// notFound answers 404 as JSON to API clients and as text to browsers
+func notFound(c *gin.Context, message string) {
+	if c.NegotiateFormat(gin.MIMEJSON, gin.MIMEHTML) == gin.MIMEHTML {
+		c.String(http.StatusNotFound, message)
+		c.Abort()
+		return
+	}
+	c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": message})
+}
+
+func (s *Server) sessionUser(c *gin.Context) (*auth.User, bool) {
+	token, err := c.Cookie(sessionCookie)
+	if err != nil {
+		return nil, false
+	}
+	session, ok := s.sessions.Get(token)
+	if !ok {
+		return nil, false
+	}
+	return s.users.User(session.Username)
+}
+
+func apiKeyFromRequest(c *gin.Context) string {
+	if key := c.GetHeader("X-API-Key"); key != "" {
+		return key
+	}
+	if bearer, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer "); ok {
+		return strings.TrimSpace(bearer)
+	}
+	return ""
+}
+
+// safeRedirect only allows local paths as post-login destinations
+func safeRedirect(next string) string {
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.HasPrefix(next, "/\\") {
+		return "/dashboard"
+	}
+	return next
+}
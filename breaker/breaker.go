@@ -0,0 +1,164 @@
+// Package breaker stops calling a dependency that keeps failing, so callers
+// fail fast instead of each waiting out a timeout while it is down.
+package breaker
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// Breaker states
+const (
+	Closed   = "closed"
+	Open     = "open"
+	HalfOpen = "half_open"
+)
+
+// ErrOpen matches, via errors.Is, calls refused by an open breaker
+var ErrOpen = errors.New("circuit breaker open")
+
+// OpenError is a call refused without being made. RetryAfter is how long
+// until the breaker lets a probe through, or 0 while a probe is running.
+type OpenError struct {
+	Name       string
+	RetryAfter time.Duration
+}
+
+func (e *OpenError) Error() string {
+	if e.RetryAfter > 0 {
+		return fmt.Sprintf("%s circuit breaker open, retry after %s", e.Name, e.RetryAfter.Round(time.Second))
+	}
+	return e.Name + " circuit breaker open"
+}
+
+func (e *OpenError) Is(target error) bool {
+	return target == ErrOpen
+}
+
+// Status describes a breaker for metrics and health checks
+type Status struct {
+	Name                string     `json:"name"`
+	State               string     `json:"state"`
+	ConsecutiveFailures int        `json:"consecutive_failures"`
+	Opened              uint64     `json:"opened"`
+	Rejected            uint64     `json:"rejected"`
+	OpenedAt            *time.Time `json:"opened_at,omitempty"`
+	LastError           string     `json:"last_error,omitempty"`
+}
+
+// Breaker opens after a run of consecutive failures and refuses calls until
+// its cooldown has passed. It then lets one probe through: success closes
+// it again, failure starts another cooldown.
+type Breaker struct {
+	name      string
+	threshold int
+	cooldown  time.Duration
+
+	mu        sync.Mutex
+	state     string
+	failures  int
+	openedAt  time.Time
+	probing   bool
+	opened    uint64
+	rejected  uint64
+	lastError string
+}
+
+// New returns a closed breaker for the dependency called name. A threshold
+// of 0 or less never opens.
+func New(name string, threshold int, cooldown time.Duration) *Breaker {
+	return &Breaker{name: name, threshold: threshold, cooldown: cooldown, state: Closed}
+}
+
+// Name identifies the dependency in logs and metrics
+func (b *Breaker) Name() string { return b.name }
+
+// Do calls fn unless the breaker is open, in which case it returns an
+// *OpenError straight away. failed picks the errors that count against the
+// dependency, so callers can leave out ones that say nothing about its
+// health; nil counts every error.
+func (b *Breaker) Do(fn func() error, failed func(error) bool) error {
+	if err := b.allow(); err != nil {
+		return err
+	}
+	err := fn()
+	b.record(err, err != nil && (failed == nil || failed(err)))
+	return err
+}
+
+func (b *Breaker) allow() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case Open:
+		if wait := b.cooldown - time.Since(b.openedAt); wait > 0 {
+			b.rejected++
+			return &OpenError{Name: b.name, RetryAfter: wait}
+		}
+		b.state, b.probing = HalfOpen, true
+		slog.Info("circuit breaker half-open, probing", "dependency", b.name)
+	case HalfOpen:
+		if b.probing {
+			b.rejected++
+			return &OpenError{Name: b.name}
+		}
+		b.probing = true
+	}
+	return nil
+}
+
+func (b *Breaker) record(err error, failed bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !failed {
+		if b.state != Closed {
+			slog.Info("circuit breaker closed", "dependency", b.name)
+		}
+		b.state, b.failures, b.probing = Closed, 0, false
+		return
+	}
+
+	b.failures++
+	b.lastError = err.Error()
+	switch {
+	case b.state == HalfOpen:
+		b.probing = false
+		b.trip()
+	case b.state == Closed && b.threshold > 0 && b.failures >= b.threshold:
+		b.trip()
+	}
+}
+
+// trip opens the breaker. Must be called with b.mu held.
+func (b *Breaker) trip() {
+	b.state = Open
+	b.openedAt = time.Now()
+	b.opened++
+	slog.Warn("circuit breaker opened", "dependency", b.name,
+		"consecutive_failures", b.failures, "cooldown", b.cooldown, "error", b.lastError)
+}
+
+// Status reports the breaker's state and counts since startup.
+func (b *Breaker) Status() Status {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	status := Status{
+		Name:                b.name,
+		State:               b.state,
+		ConsecutiveFailures: b.failures,
+		Opened:              b.opened,
+		Rejected:            b.rejected,
+		LastError:           b.lastError,
+	}
+	if b.state != Closed {
+		openedAt := b.openedAt
+		status.OpenedAt = &openedAt
+	}
+	return status
+}
@@ -0,0 +1,359 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"email-tracker/analytics"
+	"email-tracker/audit"
+	"email-tracker/campaigns"
+	"email-tracker/models"
+	"email-tracker/segments"
+	"email-tracker/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+type scheduleRequest struct {
+	ScheduledAt time.Time `json:"scheduled_at" binding:"required"`
+}
+
+// campaignView is a campaign with the combined stats of every email
+// attached to it: those it sent and those sent on their own with its ID.
+type campaignView struct {
+	*models.Campaign
+	Stats *analytics.CampaignStats `json:"stats"`
+}
+
+// campaignViews rolls the tenant's emails up into its campaigns
+func (s *Server) campaignViews(tenant string, list []*models.Campaign, filtered bool) []campaignView {
+	byCampaign := make(map[string][]*models.Email)
+	for _, email := range s.tracker.TenantEmails(tenant) {
+		if email.CampaignID != "" {
+			byCampaign[email.CampaignID] = append(byCampaign[email.CampaignID], email)
+		}
+	}
+
+	views := make([]campaignView, 0, len(list))
+	for _, campaign := range list {
+		views = append(views, campaignView{
+			Campaign: campaign,
+			Stats:    analytics.Campaign(campaign.ID, byCampaign[campaign.ID], nil, filtered),
+		})
+	}
+	return views
+}
+
+// tenantCampaigns returns the tenant's campaigns, only those tagged tag
+// when it is set
+func (s *Server) tenantCampaigns(tenant, tag string) []*models.Campaign {
+	all := s.campaigns.All(tenant)
+	if tag == "" {
+		return all
+	}
+	tagged := make([]*models.Campaign, 0, len(all))
+	for _, campaign := range all {
+		if campaigns.HasTag(campaign, tag) {
+			tagged = append(tagged, campaign)
+		}
+	}
+	return tagged
+}
+
+func (s *Server) createCampaign(c *gin.Context) {
+	var req models.CampaignRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		bindError(c, err)
+		return
+	}
+
+	if err := s.checkAudience(currentTenant(c), &req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	req.TenantID = currentTenant(c)
+	campaign := s.campaigns.Create(&req, s.trackingBaseURL(c))
+	s.recordCampaignCreate(c, campaign)
+	c.JSON(http.StatusCreated, campaign)
+}
+
+// listCampaigns lists the tenant's campaigns, newest first, with their
+// combined stats. ?tag= keeps those with a tag.
+func (s *Server) listCampaigns(c *gin.Context) {
+	tenant := currentTenant(c)
+	c.JSON(http.StatusOK, s.campaignViews(tenant, s.tenantCampaigns(tenant, c.Query("tag")), isFiltered(c)))
+}
+
+func (s *Server) getCampaign(c *gin.Context) {
+	campaign, ok := s.campaigns.Get(c.Param("id"))
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Campaign not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, s.campaignViews(campaign.Tenant(), []*models.Campaign{campaign}, isFiltered(c))[0])
+}
+
+// setCampaignTags replaces a campaign's tags. Emails it sends from then on,
+// and sends attached to it, carry them.
+func (s *Server) setCampaignTags(c *gin.Context) {
+	var req models.TagsRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		bindError(c, err)
+		return
+	}
+
+	campaign, err := s.campaigns.SetTags(c.Param("id"), req.Tags)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Campaign not found"})
+		return
+	}
+	s.recordAudit(c, audit.ActionCampaignTags, campaign.ID, map[string]string{"tags": strings.Join(campaign.Tags, ",")})
+
+	c.JSON(http.StatusOK, campaign)
+}
+
+func (s *Server) scheduleCampaign(c *gin.Context) {
+	var req scheduleRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		bindError(c, err)
+		return
+	}
+
+	campaign, err := s.campaigns.Schedule(c.Param("id"), req.ScheduledAt)
+	if err != nil {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
+	s.recordAudit(c, audit.ActionCampaignSchedule, campaign.ID,
+		map[string]string{"scheduled_at": req.ScheduledAt.UTC().Format(time.RFC3339)})
+
+	c.JSON(http.StatusOK, campaign)
+}
+
+// sendCampaign starts sending a campaign right away. Sending happens in the
+// background; poll the campaign for progress.
+func (s *Server) sendCampaign(c *gin.Context) {
+	id := c.Param("id")
+	if _, ok := s.campaigns.Get(id); !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Campaign not found"})
+		return
+	}
+
+	if _, err := s.campaigns.Schedule(id, time.Now()); err != nil {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
+	s.recordAudit(c, audit.ActionCampaignSend, id, nil)
+	go s.sendCampaignNow(id)
+
+	c.JSON(http.StatusAccepted, gin.H{"message": "Campaign is being sent", "campaign_id": id})
+}
+
+func (s *Server) sendCampaignNow(id string) {
+	if err := s.campaignScheduler.Send(id); err != nil {
+		slog.Error("failed to send campaign", "campaign_id", id, "error", err)
+	}
+}
+
+// recordCampaignCreate audits a new campaign, along with its send time
+// when it was scheduled on creation.
+func (s *Server) recordCampaignCreate(c *gin.Context, campaign *models.Campaign) {
+	details := map[string]string{
+		"name":       campaign.Name,
+		"recipients": strconv.Itoa(len(campaign.Recipients)),
+	}
+	if campaign.ScheduledAt != nil {
+		details["scheduled_at"] = campaign.ScheduledAt.UTC().Format(time.RFC3339)
+	}
+	if campaign.RetentionDays > 0 {
+		details["retention_days"] = strconv.Itoa(campaign.RetentionDays)
+	}
+	if campaign.SegmentID != "" {
+		details["segment_id"] = campaign.SegmentID
+	}
+	s.recordAudit(c, audit.ActionCampaignCreate, campaign.ID, details)
+}
+
+// checkAudience checks a new campaign goes either to a list of valid
+// addresses or to one of the tenant's segments.
+func (s *Server) checkAudience(tenant string, req *models.CampaignRequest) error {
+	switch {
+	case req.SegmentID != "" && len(req.Recipients) > 0:
+		return errors.New("Give either recipients or a segment, not both")
+	case req.SegmentID != "":
+		if _, ok := s.segments.Get(tenant, req.SegmentID); !ok {
+			return errors.New("Segment not found")
+		}
+		return nil
+	case len(req.Recipients) == 0:
+		return errors.New("At least one recipient or a segment is required")
+	}
+	return validateRecipients(req.Recipients)
+}
+
+func (s *Server) campaignsPage(c *gin.Context) {
+	s.renderCampaigns(c, http.StatusOK, "")
+}
+
+func (s *Server) renderCampaigns(c *gin.Context, status int, errMsg string) {
+	tenant, tag := currentTenant(c), c.Query("tag")
+	c.HTML(status, "campaigns.html", gin.H{
+		"title":     "Campaigns",
+		"campaigns": s.campaignViews(tenant, s.tenantCampaigns(tenant, tag), false),
+		"tag":       tag,
+		"segments":  s.segments.All(tenant),
+		"error":     errMsg,
+		"user":      currentUsername(c),
+		"branding":  s.branding(c),
+	})
+}
+
+func (s *Server) createCampaignFromDashboard(c *gin.Context) {
+	req := models.CampaignRequest{
+		Name:        strings.TrimSpace(c.PostForm("name")),
+		Tags:        strings.Split(c.PostForm("tags"), ","),
+		Subject:     strings.TrimSpace(c.PostForm("subject")),
+		Body:        c.PostForm("body"),
+		Recipients:  splitRecipients(c.PostForm("recipients")),
+		SegmentID:   c.PostForm("segment_id"),
+		TrackClicks: c.PostForm("track_clicks") != "",
+	}
+
+	if req.Name == "" || req.Subject == "" || req.Body == "" {
+		s.renderCampaigns(c, http.StatusBadRequest, "Name, subject and body are required")
+		return
+	}
+	if err := s.checkAudience(currentTenant(c), &req); err != nil {
+		s.renderCampaigns(c, http.StatusBadRequest, err.Error())
+		return
+	}
+	if days := c.PostForm("retention_days"); days != "" {
+		retentionDays, err := strconv.Atoi(days)
+		if err != nil || retentionDays < 0 {
+			s.renderCampaigns(c, http.StatusBadRequest, "Invalid retention")
+			return
+		}
+		req.RetentionDays = retentionDays
+	}
+	if at := c.PostForm("scheduled_at"); at != "" {
+		scheduledAt, err := time.Parse(time.RFC3339, at)
+		if err != nil {
+			s.renderCampaigns(c, http.StatusBadRequest, "Invalid send time")
+			return
+		}
+		req.ScheduledAt = &scheduledAt
+	}
+
+	req.TenantID = currentTenant(c)
+	campaign := s.campaigns.Create(&req, s.trackingBaseURL(c))
+	s.recordCampaignCreate(c, campaign)
+	c.Redirect(http.StatusSeeOther, "/dashboard/campaigns/"+url.PathEscape(campaign.ID))
+}
+
+func (s *Server) campaignPage(c *gin.Context) {
+	campaign, ok := s.campaigns.Get(c.Param("id"))
+	if !ok {
+		c.String(http.StatusNotFound, "Campaign not found")
+		return
+	}
+
+	s.renderCampaign(c, http.StatusOK, campaign, "")
+}
+
+func (s *Server) renderCampaign(c *gin.Context, status int, campaign *models.Campaign, errMsg string) {
+	emails := s.tracker.GetCampaignEmails(campaign.Tenant(), campaign.ID)
+
+	var clicks []*models.ClickEvent
+	for _, email := range emails {
+		clicks = append(clicks, s.tracker.GetClickEvents(email.TrackingID)...)
+	}
+
+	var segment *segments.Segment
+	if seg, ok := s.segments.Get(campaign.Tenant(), campaign.SegmentID); ok {
+		segment = &seg
+	}
+
+	c.HTML(status, "campaign.html", gin.H{
+		"title":    campaign.Name,
+		"campaign": campaign,
+		"segment":  segment,
+		"preview":  utils.SanitizeHTML(campaign.Body),
+		"stats":    analytics.Campaign(campaign.ID, emails, clicks, false),
+		"filtered": analytics.Campaign(campaign.ID, emails, clicks, true),
+		"emails":   emails,
+		"error":    errMsg,
+		"user":     currentUsername(c),
+		"branding": s.branding(c),
+	})
+}
+
+func (s *Server) scheduleCampaignFromDashboard(c *gin.Context) {
+	id := c.Param("id")
+	campaign, ok := s.campaigns.Get(id)
+	if !ok {
+		c.String(http.StatusNotFound, "Campaign not found")
+		return
+	}
+
+	scheduledAt, err := time.Parse(time.RFC3339, c.PostForm("scheduled_at"))
+	if err != nil {
+		s.renderCampaign(c, http.StatusBadRequest, campaign, "Invalid send time")
+		return
+	}
+	if _, err := s.campaigns.Schedule(id, scheduledAt); err != nil {
+		s.renderCampaign(c, http.StatusConflict, campaign, err.Error())
+		return
+	}
+	s.recordAudit(c, audit.ActionCampaignSchedule, id,
+		map[string]string{"scheduled_at": scheduledAt.UTC().Format(time.RFC3339)})
+
+	c.Redirect(http.StatusSeeOther, "/dashboard/campaigns/"+url.PathEscape(id))
+}
+
+func (s *Server) sendCampaignFromDashboard(c *gin.Context) {
+	id := c.Param("id")
+	campaign, ok := s.campaigns.Get(id)
+	if !ok {
+		c.String(http.StatusNotFound, "Campaign not found")
+		return
+	}
+
+	if _, err := s.campaigns.Schedule(id, time.Now()); err != nil {
+		s.renderCampaign(c, http.StatusConflict, campaign, err.Error())
+		return
+	}
+	s.recordAudit(c, audit.ActionCampaignSend, id, nil)
+	go s.sendCampaignNow(id)
+
+	c.Redirect(http.StatusSeeOther, "/dashboard/campaigns/"+url.PathEscape(id))
+}
+
+// splitRecipients accepts one address per line or comma-separated lists
+func splitRecipients(input string) []string {
+	var recipients []string
+	for _, field := range strings.FieldsFunc(input, func(r rune) bool {
+		return r == ',' || r == ';' || r == '\n' || r == '\r'
+	}) {
+		if field = strings.TrimSpace(field); field != "" {
+			recipients = append(recipients, field)
+		}
+	}
+	return recipients
+}
+
+func validateRecipients(recipients []string) error {
+	for _, email := range recipients {
+		if !utils.ValidateEmail(email) {
+			return fmt.Errorf("Invalid email: %s", email)
+		}
+	}
+	return nil
+}
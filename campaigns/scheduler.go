@@ -0,0 +1,188 @@
+package campaigns
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+
+	"email-tracker/consent"
+	"email-tracker/logging"
+	"email-tracker/models"
+	"email-tracker/suppression"
+	"email-tracker/tenants"
+)
+
+// pollInterval is how often the scheduler looks for campaigns that are due
+const pollInterval = 30 * time.Second
+
+// sendTimeout bounds a single recipient's send
+const sendTimeout = 15 * time.Second
+
+type EmailSender interface {
+	SendTrackedEmail(ctx context.Context, req *models.EmailRequest, baseURL string) (string, error)
+}
+
+// Audience resolves a campaign's segment into the addresses of its members
+// at the time of sending
+type Audience interface {
+	Recipients(tenant, segmentID string) ([]string, error)
+}
+
+// Scheduler sends campaigns when their scheduled time comes, one tracked
+// email per recipient.
+type Scheduler struct {
+	store    *Store
+	sender   EmailSender
+	audience Audience
+
+	// mu keeps Send from starting once Close has begun waiting on sending
+	mu       sync.Mutex
+	stopped  bool
+	stopping chan struct{}
+	sending  sync.WaitGroup
+}
+
+func NewScheduler(store *Store, sender EmailSender) *Scheduler {
+	return &Scheduler{store: store, sender: sender, stopping: make(chan struct{})}
+}
+
+// SetAudience lets campaigns be sent to segments. Call it before serving
+// requests.
+func (s *Scheduler) SetAudience(audience Audience) {
+	s.audience = audience
+}
+
+// Run blocks, sending due campaigns as they come up, until Close is called.
+func (s *Scheduler) Run() {
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-s.stopping:
+			return
+		}
+		for _, id := range s.store.due(time.Now()) {
+			if err := s.Send(id); err != nil {
+				slog.Error("failed to send campaign", "campaign_id", id, "error", err)
+			}
+		}
+	}
+}
+
+// Close stops the scheduler and interrupts campaigns being sent after the
+// recipient in progress, then waits for them, or for ctx to be done. An
+// interrupted campaign is left sending with the results so far.
+func (s *Scheduler) Close(ctx context.Context) error {
+	s.mu.Lock()
+	if !s.stopped {
+		s.stopped = true
+		close(s.stopping)
+	}
+	s.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		s.sending.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Send delivers a campaign to all of its recipients. Individual failures are
+// counted on the campaign rather than aborting the send.
+func (s *Scheduler) Send(id string) error {
+	s.mu.Lock()
+	if s.stopped {
+		s.mu.Unlock()
+		return errors.New("campaign scheduler is shutting down")
+	}
+	s.sending.Add(1)
+	s.mu.Unlock()
+	defer s.sending.Done()
+
+	campaign, err := s.store.claim(id)
+	if err != nil {
+		return err
+	}
+	if campaign.SegmentID != "" {
+		if s.audience == nil {
+			err = errors.New("segments aren't available")
+		} else {
+			campaign.Recipients, err = s.audience.Recipients(campaign.Tenant(), campaign.SegmentID)
+		}
+		if err != nil {
+			// Nobody to send to, so the campaign is done with none sent
+			slog.Error("failed to resolve campaign segment", "campaign_id", campaign.ID, "segment_id", campaign.SegmentID, "error", err)
+		}
+		s.store.setRecipients(id, campaign.Recipients)
+	}
+
+	slog.Info("sending campaign", "campaign_id", campaign.ID, "name", campaign.Name, "recipients", len(campaign.Recipients))
+
+	var sent, failed, suppressed, unconfirmed int
+	for i, recipient := range campaign.Recipients {
+		select {
+		case <-s.stopping:
+			slog.Warn("shutting down, campaign send interrupted", "campaign_id", campaign.ID,
+				"delivered", sent, "failed", failed, "unsent", len(campaign.Recipients)-i)
+			return nil
+		default:
+		}
+
+		// Erased since the send started
+		if !s.store.listed(id, recipient) {
+			continue
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), sendTimeout)
+		_, err := s.sender.SendTrackedEmail(ctx, &models.EmailRequest{
+			To:          []string{recipient},
+			Subject:     campaign.Subject,
+			Body:        campaign.Body,
+			CampaignID:  campaign.ID,
+			TrackClicks: campaign.TrackClicks,
+			Tags:        campaign.Tags,
+			TenantID:    campaign.Tenant(),
+			// Campaigns are marketing, so they need consent
+			Category: models.CategoryMarketing,
+
+			RetentionDays: s.store.retentionDays(id),
+		}, campaign.BaseURL)
+		cancel()
+
+		if errors.Is(err, tenants.ErrSuspended) || errors.Is(err, tenants.ErrQuotaExceeded) {
+			// Nothing more would go out, so the rest count as failed
+			unsent := len(campaign.Recipients) - i
+			slog.Warn("campaign send stopped", "campaign_id", campaign.ID, "unsent", unsent, "error", err)
+			failed += unsent
+			s.store.progress(id, sent, failed, suppressed, unconfirmed)
+			break
+		}
+		if errors.Is(err, suppression.ErrSuppressed) {
+			suppressed++
+		} else if errors.Is(err, consent.ErrUnconfirmed) {
+			unconfirmed++
+		} else if err != nil {
+			slog.Error("failed to send campaign email", "campaign_id", campaign.ID,
+				"recipient_hash", logging.RecipientHash(recipient), "error", err)
+			failed++
+		} else {
+			sent++
+		}
+		s.store.progress(id, sent, failed, suppressed, unconfirmed)
+	}
+
+	s.store.finish(id, sent, failed, suppressed, unconfirmed)
+	slog.Info("campaign sent", "campaign_id", campaign.ID, "name", campaign.Name,
+		"delivered", sent, "failed", failed, "suppressed", suppressed, "unconfirmed", unconfirmed)
+	return nil
+}
@@ -0,0 +1,347 @@
+package campaigns
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"email-tracker/models"
+	"email-tracker/utils"
+)
+
+// Store keeps campaigns in memory. Campaigns are returned as copies so
+// callers can't race the scheduler updating them.
+type Store struct {
+	mu        sync.RWMutex
+	campaigns map[string]*models.Campaign
+}
+
+func NewStore() *Store {
+	return &Store{campaigns: make(map[string]*models.Campaign)}
+}
+
+// Create adds a campaign built from req, with its body sanitized. It is
+// scheduled when the request has a send time and a draft otherwise.
+func (s *Store) Create(req *models.CampaignRequest, baseURL string) *models.Campaign {
+	campaign := &models.Campaign{
+		ID:          utils.GenerateUUID(),
+		TenantID:    models.TenantOr(req.TenantID),
+		Name:        req.Name,
+		Tags:        NormalizeTags(req.Tags),
+		Subject:     req.Subject,
+		Body:        utils.SanitizeHTML(req.Body),
+		Recipients:  req.Recipients,
+		SegmentID:   req.SegmentID,
+		TrackClicks: req.TrackClicks,
+		Status:      models.CampaignStatusDraft,
+		CreatedAt:   time.Now(),
+		BaseURL:     baseURL,
+
+		RetentionDays: req.RetentionDays,
+	}
+	if campaign.Recipients == nil {
+		// Sent to a segment, filled in when sending
+		campaign.Recipients = []string{}
+	}
+	if req.ScheduledAt != nil {
+		campaign.Status = models.CampaignStatusScheduled
+		campaign.ScheduledAt = req.ScheduledAt
+	}
+
+	s.mu.Lock()
+	s.campaigns[campaign.ID] = campaign
+	s.mu.Unlock()
+
+	c := *campaign
+	return &c
+}
+
+func (s *Store) Get(id string) (*models.Campaign, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	campaign, ok := s.campaigns[id]
+	if !ok {
+		return nil, false
+	}
+	c := *campaign
+	return &c, true
+}
+
+// All returns every campaign of the tenant, newest first.
+func (s *Store) All(tenant string) []*models.Campaign {
+	s.mu.RLock()
+	all := make([]*models.Campaign, 0, len(s.campaigns))
+	for _, campaign := range s.campaigns {
+		if campaign.Tenant() != tenant {
+			continue
+		}
+		c := *campaign
+		all = append(all, &c)
+	}
+	s.mu.RUnlock()
+
+	sort.Slice(all, func(i, j int) bool { return all[i].CreatedAt.After(all[j].CreatedAt) })
+	return all
+}
+
+// Schedule sets the send time of a campaign that hasn't been sent yet.
+func (s *Store) Schedule(id string, at time.Time) (*models.Campaign, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	campaign, ok := s.campaigns[id]
+	if !ok {
+		return nil, fmt.Errorf("campaign not found")
+	}
+	if campaign.Status != models.CampaignStatusDraft && campaign.Status != models.CampaignStatusScheduled {
+		return nil, fmt.Errorf("campaign is already %s", campaign.Status)
+	}
+
+	campaign.Status = models.CampaignStatusScheduled
+	campaign.ScheduledAt = &at
+
+	c := *campaign
+	return &c, nil
+}
+
+// SetTags replaces the campaign's tags.
+func (s *Store) SetTags(id string, tags []string) (*models.Campaign, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	campaign, ok := s.campaigns[id]
+	if !ok {
+		return nil, fmt.Errorf("campaign not found")
+	}
+	campaign.Tags = NormalizeTags(tags)
+
+	c := *campaign
+	return &c, nil
+}
+
+// SetRetention changes how long the campaign's emails are kept, sent or
+// not; 0 goes back to the configured retention.
+func (s *Store) SetRetention(id string, days int) (*models.Campaign, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	campaign, ok := s.campaigns[id]
+	if !ok {
+		return nil, fmt.Errorf("campaign not found")
+	}
+	campaign.RetentionDays = days
+
+	c := *campaign
+	return &c, nil
+}
+
+// claim moves an unsent campaign to sending, so it is sent exactly once even
+// if the scheduler and a manual send race.
+func (s *Store) claim(id string) (*models.Campaign, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	campaign, ok := s.campaigns[id]
+	if !ok {
+		return nil, fmt.Errorf("campaign not found")
+	}
+	if campaign.Status != models.CampaignStatusDraft && campaign.Status != models.CampaignStatusScheduled {
+		return nil, fmt.Errorf("campaign is already %s", campaign.Status)
+	}
+
+	campaign.Status = models.CampaignStatusSending
+
+	c := *campaign
+	return &c, nil
+}
+
+// DeleteRecipient takes address off the recipient list of every campaign
+// of the tenant, sent or not, and reports how many campaigns listed it. A
+// campaign that is sending skips it from then on.
+func (s *Store) DeleteRecipient(tenant, address string) int {
+	address = utils.NormalizeAddress(address)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	updated := 0
+	for _, campaign := range s.campaigns {
+		if campaign.Tenant() != tenant {
+			continue
+		}
+		// A new slice, as copies handed out share the old one
+		kept := make([]string, 0, len(campaign.Recipients))
+		for _, recipient := range campaign.Recipients {
+			if utils.NormalizeAddress(recipient) != address {
+				kept = append(kept, recipient)
+			}
+		}
+		if len(kept) < len(campaign.Recipients) {
+			campaign.Recipients = kept
+			updated++
+		}
+	}
+	return updated
+}
+
+// setRecipients fills in the recipients of a campaign sent to a segment,
+// once its members are known
+func (s *Store) setRecipients(id string, recipients []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if campaign, ok := s.campaigns[id]; ok {
+		campaign.Recipients = recipients
+	}
+}
+
+// UsingSegment returns the IDs of the tenant's campaigns that are still to
+// be sent to the segment.
+func (s *Store) UsingSegment(tenant, segmentID string) []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var ids []string
+	for _, campaign := range s.campaigns {
+		if campaign.Tenant() == tenant && campaign.SegmentID == segmentID &&
+			(campaign.Status == models.CampaignStatusDraft || campaign.Status == models.CampaignStatusScheduled) {
+			ids = append(ids, campaign.ID)
+		}
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// listed reports whether recipient is still on the campaign's recipient
+// list
+func (s *Store) listed(id, recipient string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	campaign, ok := s.campaigns[id]
+	return ok && slices.Contains(campaign.Recipients, recipient)
+}
+
+// retentionDays returns the campaign's current retention, which may have
+// changed since its send started
+func (s *Store) retentionDays(id string) int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if campaign, ok := s.campaigns[id]; ok {
+		return campaign.RetentionDays
+	}
+	return 0
+}
+
+// progress records the send results so far while a campaign is sending
+func (s *Store) progress(id string, sent, failed, suppressed, unconfirmed int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if campaign, ok := s.campaigns[id]; ok {
+		campaign.Sent = sent
+		campaign.Failed = failed
+		campaign.Suppressed = suppressed
+		campaign.Unconfirmed = unconfirmed
+	}
+}
+
+func (s *Store) finish(id string, sent, failed, suppressed, unconfirmed int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if campaign, ok := s.campaigns[id]; ok {
+		now := time.Now()
+		campaign.Status = models.CampaignStatusSent
+		campaign.SentAt = &now
+		campaign.Sent = sent
+		campaign.Failed = failed
+		campaign.Suppressed = suppressed
+		campaign.Unconfirmed = unconfirmed
+	}
+}
+
+// QueueStats describes campaign sends that haven't gone out yet.
+type QueueStats struct {
+	ScheduledCampaigns int `json:"scheduled_campaigns"`
+	SendingCampaigns   int `json:"sending_campaigns"`
+	PendingRecipients  int `json:"pending_recipients"`
+}
+
+// Queue reports how many campaign emails are still waiting to be sent.
+func (s *Store) Queue() QueueStats {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var stats QueueStats
+	for _, campaign := range s.campaigns {
+		switch campaign.Status {
+		case models.CampaignStatusScheduled:
+			stats.ScheduledCampaigns++
+		case models.CampaignStatusSending:
+			stats.SendingCampaigns++
+		default:
+			continue
+		}
+		// Erased recipients may already have been sent to
+		stats.PendingRecipients += max(0, len(campaign.Recipients)-campaign.Sent-campaign.Failed-campaign.Suppressed-campaign.Unconfirmed)
+	}
+	return stats
+}
+
+// due returns the IDs of scheduled campaigns whose send time has passed.
+func (s *Store) due(now time.Time) []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var ids []string
+	for id, campaign := range s.campaigns {
+		if campaign.Status == models.CampaignStatusScheduled && !campaign.ScheduledAt.After(now) {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// Attach fills in what a send attached to campaign leaves out: the
+// campaign's subject and body, its retention, and its click tracking. The
+// send gets the campaign's tags along with its own.
+func Attach(req *models.EmailRequest, campaign *models.Campaign) {
+	if req.Subject == "" {
+		req.Subject = campaign.Subject
+	}
+	if req.Body == "" {
+		req.Body = campaign.Body
+	}
+	if req.RetentionDays == 0 {
+		req.RetentionDays = campaign.RetentionDays
+	}
+	req.TrackClicks = req.TrackClicks || campaign.TrackClicks
+	req.Tags = NormalizeTags(slices.Concat(campaign.Tags, req.Tags))
+}
+
+// NormalizeTags trims tags and drops empty ones and repeats, which tags
+// match regardless of case.
+func NormalizeTags(tags []string) []string {
+	normalized := []string{}
+	seen := make(map[string]bool, len(tags))
+	for _, tag := range tags {
+		tag = strings.TrimSpace(tag)
+		if tag == "" || seen[strings.ToLower(tag)] {
+			continue
+		}
+		seen[strings.ToLower(tag)] = true
+		normalized = append(normalized, tag)
+	}
+	return normalized
+}
+
+// HasTag reports whether the campaign has tag, regardless of case.
+func HasTag(campaign *models.Campaign, tag string) bool {
+	return slices.ContainsFunc(campaign.Tags, func(t string) bool { return strings.EqualFold(t, tag) })
+}
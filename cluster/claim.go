@@ -0,0 +1,52 @@
+// Package cluster lets several instances share tracking state through Redis
+// and makes sure periodic jobs run on only one of them.
+package cluster
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"email-tracker/config"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const keyPrefix = "email-tracker:cluster"
+
+// Claimer decides which instance runs a periodic job
+type Claimer interface {
+	// Claim reports whether this instance gets to run the job called name.
+	// Once claimed, nobody else gets it until ttl has passed.
+	Claim(ctx context.Context, name string, ttl time.Duration) (bool, error)
+}
+
+// Local is the Claimer for a single instance: every job is its own.
+type Local struct{}
+
+func (Local) Claim(context.Context, string, time.Duration) (bool, error) { return true, nil }
+
+// RedisClaimer hands each job to the first instance that asks for it.
+type RedisClaimer struct {
+	client     *redis.Client
+	instanceID string
+}
+
+func NewRedisClaimer(cfg *config.Config) *RedisClaimer {
+	return &RedisClaimer{client: newClient(cfg), instanceID: cfg.Cluster.InstanceID}
+}
+
+// Claim takes a lock that is never released, only left to expire, so a
+// job claimed for a period runs once in it even when instances' clocks and
+// timers are slightly apart.
+func (c *RedisClaimer) Claim(ctx context.Context, name string, ttl time.Duration) (bool, error) {
+	return c.client.SetNX(ctx, keyPrefix+":claim:"+name, c.instanceID, ttl).Result()
+}
+
+func newClient(cfg *config.Config) *redis.Client {
+	return redis.NewClient(&redis.Options{
+		Addr:     fmt.Sprintf("%s:%d", cfg.Redis.Host, cfg.Redis.Port),
+		Password: cfg.Redis.Password,
+		DB:       cfg.Redis.DB,
+	})
+}
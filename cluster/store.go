@@ -0,0 +1,343 @@
+package cluster
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"email-tracker/config"
+	"email-tracker/models"
+	"email-tracker/utils"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	// changesChannel tells every instance about changes made by the others
+	changesChannel = keyPrefix + ":changes"
+	// idsKey holds every shared tracking ID, scored by send time
+	idsKey = keyPrefix + ":ids"
+
+	// writeQueueSize bounds the changes waiting to be written
+	writeQueueSize = 10000
+	writeTimeout   = 2 * time.Second
+)
+
+// Operations carried by a change
+const (
+	opEmail  = "email"
+	opOpen   = "open"
+	opClick  = "click"
+	opDelete = "delete"
+)
+
+// change is one update to the shared state, as stored and broadcast
+type change struct {
+	Origin     string                `json:"origin"`
+	Op         string                `json:"op"`
+	TrackingID string                `json:"tracking_id"`
+	Email      *models.Email         `json:"email,omitempty"`
+	Open       *models.TrackingEvent `json:"open,omitempty"`
+	Click      *models.ClickEvent    `json:"click,omitempty"`
+}
+
+// Replica is the local copy of the shared state that changes are applied to
+type Replica interface {
+	ApplySharedEmail(email *models.Email)
+	ApplySharedOpen(event *models.TrackingEvent)
+	ApplySharedClick(event *models.ClickEvent)
+	ApplySharedDelete(trackingID string)
+}
+
+// Store keeps emails, opens and clicks in Redis for every instance to load
+// at startup, and broadcasts each change so the others can apply it to
+// their in-memory copy. Writes happen in order on a single goroutine, off
+// the request path.
+type Store struct {
+	client        *redis.Client
+	instanceID    string
+	writeFailures utils.LossCounter
+
+	// mu keeps queue from sending on writes once Close has closed it
+	mu      sync.RWMutex
+	closed  bool
+	writes  chan change
+	written chan struct{}
+}
+
+func NewStore(cfg *config.Config) *Store {
+	s := &Store{
+		client:     newClient(cfg),
+		instanceID: cfg.Cluster.InstanceID,
+		writes:     make(chan change, writeQueueSize),
+		written:    make(chan struct{}),
+	}
+	go s.write()
+	return s
+}
+
+func emailKey(trackingID string) string  { return keyPrefix + ":email:" + trackingID }
+func opensKey(trackingID string) string  { return keyPrefix + ":opens:" + trackingID }
+func clicksKey(trackingID string) string { return keyPrefix + ":clicks:" + trackingID }
+
+func (s *Store) SaveEmail(email *models.Email) {
+	s.queue(change{Op: opEmail, TrackingID: email.TrackingID, Email: email})
+}
+
+func (s *Store) SaveOpen(event *models.TrackingEvent) {
+	s.queue(change{Op: opOpen, TrackingID: event.TrackingID, Open: event})
+}
+
+func (s *Store) SaveClick(event *models.ClickEvent) {
+	s.queue(change{Op: opClick, TrackingID: event.TrackingID, Click: event})
+}
+
+func (s *Store) DeleteEmail(trackingID string) {
+	s.queue(change{Op: opDelete, TrackingID: trackingID})
+}
+
+func (s *Store) queue(c change) {
+	c.Origin = s.instanceID
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.closed {
+		s.writeFailures.Add(1)
+		slog.Warn("shared store is closed, change not shared", "op", c.Op, "tracking_id", c.TrackingID)
+		return
+	}
+	select {
+	case s.writes <- c:
+	default:
+		s.writeFailures.Add(1)
+		slog.Warn("shared store write queue is full, change not shared", "op", c.Op, "tracking_id", c.TrackingID)
+	}
+}
+
+func (s *Store) write() {
+	defer close(s.written)
+
+	for c := range s.writes {
+		if err := s.apply(c); err != nil {
+			s.writeFailures.Add(1)
+			slog.Error("failed to write to shared store", "op", c.Op, "tracking_id", c.TrackingID, "error", err)
+		}
+	}
+}
+
+// Close stops accepting changes and waits for the queued ones to be written
+func (s *Store) Close(ctx context.Context) error {
+	s.mu.Lock()
+	if !s.closed {
+		s.closed = true
+		close(s.writes)
+	}
+	s.mu.Unlock()
+
+	select {
+	case <-s.written:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// apply stores c and broadcasts it in one transaction
+func (s *Store) apply(c change) error {
+	payload, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), writeTimeout)
+	defer cancel()
+
+	pipe := s.client.TxPipeline()
+	switch c.Op {
+	case opEmail:
+		data, err := json.Marshal(c.Email)
+		if err != nil {
+			return err
+		}
+		pipe.Set(ctx, emailKey(c.TrackingID), data, 0)
+		pipe.ZAdd(ctx, idsKey, redis.Z{Score: float64(c.Email.SentAt.Unix()), Member: c.TrackingID})
+	case opOpen:
+		data, err := json.Marshal(c.Open)
+		if err != nil {
+			return err
+		}
+		pipe.RPush(ctx, opensKey(c.TrackingID), data)
+	case opClick:
+		data, err := json.Marshal(c.Click)
+		if err != nil {
+			return err
+		}
+		pipe.RPush(ctx, clicksKey(c.TrackingID), data)
+	case opDelete:
+		pipe.Del(ctx, emailKey(c.TrackingID), opensKey(c.TrackingID), clicksKey(c.TrackingID))
+		pipe.ZRem(ctx, idsKey, c.TrackingID)
+	}
+	pipe.Publish(ctx, changesChannel, payload)
+	_, err = pipe.Exec(ctx)
+	return err
+}
+
+// Sync loads everything in the store into replica, then keeps applying the
+// changes other instances make until ctx is done. It returns once the
+// initial load is complete.
+func (s *Store) Sync(ctx context.Context, replica Replica) error {
+	// Subscribe first so nothing written during the load is missed; the
+	// replica ignores what it already has
+	sub := s.client.Subscribe(ctx, changesChannel)
+	if _, err := sub.Receive(ctx); err != nil {
+		sub.Close()
+		return fmt.Errorf("subscribe to shared store changes: %w", err)
+	}
+
+	if err := s.load(ctx, replica); err != nil {
+		sub.Close()
+		return err
+	}
+
+	go func() {
+		defer sub.Close()
+		for msg := range sub.Channel() {
+			var c change
+			if err := json.Unmarshal([]byte(msg.Payload), &c); err != nil {
+				slog.Warn("ignoring malformed shared store change", "error", err)
+				continue
+			}
+			if c.Origin != s.instanceID {
+				applyTo(replica, c)
+			}
+		}
+	}()
+	return nil
+}
+
+func applyTo(replica Replica, c change) {
+	switch {
+	case c.Op == opEmail && c.Email != nil:
+		replica.ApplySharedEmail(c.Email)
+	case c.Op == opOpen && c.Open != nil:
+		replica.ApplySharedOpen(c.Open)
+	case c.Op == opClick && c.Click != nil:
+		replica.ApplySharedClick(c.Click)
+	case c.Op == opDelete:
+		replica.ApplySharedDelete(c.TrackingID)
+	}
+}
+
+func (s *Store) load(ctx context.Context, replica Replica) error {
+	ids, err := s.client.ZRange(ctx, idsKey, 0, -1).Result()
+	if err != nil {
+		return fmt.Errorf("load shared tracking IDs: %w", err)
+	}
+
+	for _, id := range ids {
+		pipe := s.client.Pipeline()
+		emailCmd := pipe.Get(ctx, emailKey(id))
+		opensCmd := pipe.LRange(ctx, opensKey(id), 0, -1)
+		clicksCmd := pipe.LRange(ctx, clicksKey(id), 0, -1)
+		if _, err := pipe.Exec(ctx); err != nil && !errors.Is(err, redis.Nil) {
+			return fmt.Errorf("load shared email %s: %w", id, err)
+		}
+
+		var email models.Email
+		if err := json.Unmarshal([]byte(emailCmd.Val()), &email); err != nil {
+			slog.Warn("skipping unreadable shared email", "tracking_id", id, "error", err)
+			continue
+		}
+		replica.ApplySharedEmail(&email)
+		for _, data := range opensCmd.Val() {
+			var event models.TrackingEvent
+			if json.Unmarshal([]byte(data), &event) == nil {
+				replica.ApplySharedOpen(&event)
+			}
+		}
+		for _, data := range clicksCmd.Val() {
+			var event models.ClickEvent
+			if json.Unmarshal([]byte(data), &event) == nil {
+				replica.ApplySharedClick(&event)
+			}
+		}
+	}
+
+	slog.Info("loaded shared tracking state", "emails", len(ids))
+	return nil
+}
+
+// Cleanup removes emails sent more than emailMaxAge before now from the
+// store, and the opens and clicks of the rest older than eventMaxAge.
+// Emails with a retention of their own are kept that long instead. Every
+// instance cleans its own memory; this should run on one of them.
+func (s *Store) Cleanup(ctx context.Context, now time.Time, emailMaxAge, eventMaxAge time.Duration) error {
+	ids, err := s.client.ZRangeWithScores(ctx, idsKey, 0, -1).Result()
+	if err != nil {
+		return err
+	}
+	for _, z := range ids {
+		id := z.Member.(string)
+		data, err := s.client.Get(ctx, emailKey(id)).Bytes()
+		if err != nil && !errors.Is(err, redis.Nil) {
+			return err
+		}
+		// An unreadable email gets the configured retention
+		var email models.Email
+		json.Unmarshal(data, &email)
+		emailAge, eventAge := email.Retention(emailMaxAge, eventMaxAge)
+
+		sentAt := time.Unix(int64(z.Score), 0)
+		if sentAt.Before(now.Add(-emailAge)) {
+			if err := s.client.Del(ctx, emailKey(id), opensKey(id), clicksKey(id)).Err(); err != nil {
+				return err
+			}
+			if err := s.client.ZRem(ctx, idsKey, id).Err(); err != nil {
+				return err
+			}
+			continue
+		}
+
+		eventCutoff := now.Add(-eventAge)
+		if err := trimList(ctx, s.client, opensKey(id), func(data []byte) bool {
+			var event models.TrackingEvent
+			return json.Unmarshal(data, &event) == nil && event.OpenedAt.After(eventCutoff)
+		}); err != nil {
+			return err
+		}
+		if err := trimList(ctx, s.client, clicksKey(id), func(data []byte) bool {
+			var event models.ClickEvent
+			return json.Unmarshal(data, &event) == nil && event.ClickedAt.After(eventCutoff)
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// trimList drops the leading entries of a list that keep rejects. Events
+// are appended in time order, so everything after the first kept entry
+// stays.
+func trimList(ctx context.Context, client *redis.Client, key string, keep func([]byte) bool) error {
+	entries, err := client.LRange(ctx, key, 0, -1).Result()
+	if err != nil {
+		return err
+	}
+	drop := 0
+	for drop < len(entries) && !keep([]byte(entries[drop])) {
+		drop++
+	}
+	if drop == 0 {
+		return nil
+	}
+	return client.LTrim(ctx, key, int64(drop), -1).Err()
+}
+
+// WriteFailures counts changes that never reached the shared store.
+func (s *Store) WriteFailures() utils.LossCount {
+	return s.writeFailures.Snapshot()
+}
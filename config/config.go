@@ -1,18 +1,37 @@
 package config
 
 import (
-	"log"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"net"
 	"os"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/joho/godotenv"
 )
 
 type Config struct {
 	Server struct {
-		Port string
-		Host string
+		Port           string
+		Host           string
+		TrustedProxies []string
+	}
+	TLS struct {
+		// CertFile and KeyFile serve HTTPS with a certificate of your own
+		CertFile string
+		KeyFile  string
+		// AutocertDomains gets certificates for these hosts from Let's
+		// Encrypt instead, cached in AutocertCacheDir
+		AutocertDomains  []string
+		AutocertEmail    string
+		AutocertCacheDir string
+		// HTTPPort also listens for plain HTTP, to answer ACME challenges
+		// and redirect everything else to HTTPS
+		HTTPPort string
 	}
 	SMTP struct {
 		Host     string
@@ -20,81 +39,669 @@ type Config struct {
 		Username string
 		Password string
 		From     string
+		// MaxRetries is how often a send is retried after a transient
+		// failure, within SMTP_TIMEOUT
+		MaxRetries int
+		// Workers bounds concurrent SMTP transactions; QueueSize bounds the
+		// sends waiting for one
+		Workers   int
+		QueueSize int
 	}
 	Redis struct {
+		Enabled  bool
 		Host     string
 		Port     int
 		Password string
 		DB       int
 	}
+	Cluster struct {
+		// Enabled shares tracking state through Redis so several instances
+		// can run behind one load balancer
+		Enabled    bool
+		InstanceID string
+	}
+	HTTPClient struct {
+		// Timeout caps a whole outbound request; callers may set tighter
+		// deadlines of their own
+		Timeout        time.Duration
+		MaxIdlePerHost int
+		IdleTimeout    time.Duration
+	}
+	Breakers struct {
+		// Threshold is how many failures in a row open a breaker; 0 leaves
+		// breakers off. Cooldown is how long an open breaker waits before
+		// letting a probe through.
+		Threshold int
+		Cooldown  time.Duration
+	}
 	GeoAPI struct {
 		Provider string
-		APIKey   string
-		URL      string
+		// Providers are tried in order; defaults to just Provider
+		Providers []string
+		// APIKey and URL apply to the selected provider unless it has its
+		// own below
+		APIKey         string
+		URL            string
+		IPAPI          GeoEndpoint
+		IPInfo         GeoEndpoint
+		IPStack        GeoEndpoint
+		MaxMindDB      string
+		ReloadInterval time.Duration
+		CacheSize      int
+		CacheTTL       time.Duration
+		// QueueSize bounds the opens waiting for rate-limited lookups
+		QueueSize int
+		// NetworkLookup adds reverse DNS and ASN details to locations,
+		// from ASNDB if set or Team Cymru's DNS service otherwise
+		NetworkLookup bool
+		ASNDB         string
 	}
 	App struct {
 		Env        string
 		BaseURL    string
 		TrackingID string
+		AssetsDir  string
 	}
 	ExternalAPI struct {
 		Resend string
 	}
+	Auth struct {
+		Users   []string
+		APIKeys []string
+		Admins  []string
+		// Roles are name:role entries; users not listed get DefaultRole
+		Roles       []string
+		DefaultRole string
+		// Tenants are name:tenant entries assigning users and API keys to
+		// a tenant; everyone else is in the default tenant
+		Tenants    []string
+		SessionTTL time.Duration
+	}
+	Reports struct {
+		Frequency  string
+		Recipients []string
+	}
+	Security struct {
+		ScanAlertEmail     string
+		ScanAlertThreshold int
+		ScanAlertWindow    time.Duration
+		// ScanRateLimit caps /track and /click requests per client IP
+		// and minute; 0 turns it off. Clients crossing the alert
+		// threshold are banned for ScanBanDuration, unless in
+		// ScanExemptIPs.
+		ScanRateLimit   int
+		ScanBanDuration time.Duration
+		ScanExemptIPs   []string
+		// HSTSMaxAge is sent as Strict-Transport-Security on HTTPS
+		// requests; 0 leaves the header out
+		HSTSMaxAge     time.Duration
+		FrameOptions   string
+		ReferrerPolicy string
+		// MaxBodySize caps API request bodies, in bytes
+		MaxBodySize int
+		// AllowedMethods are the only HTTP methods served
+		AllowedMethods []string
+	}
+	Secrets struct {
+		RefreshInterval time.Duration
+	}
+	Tracking struct {
+		PixelPath       string
+		DedupWindow     time.Duration
+		BotFiltering    bool
+		SignatureSecret string
+		// IPMode is how client IPs are stored: full, truncate or hash
+		IPMode         string
+		HashSalt       string
+		StoreUserAgent bool
+		// MaxEntries caps the tracking IDs held in memory, evicting the
+		// least recently used; 0 means no limit
+		MaxEntries int
+		// StoreUnknownOpens keeps opens for unknown tracking IDs instead of
+		// only counting them
+		StoreUnknownOpens bool
+	}
+	Retention struct {
+		Interval    time.Duration
+		EmailMaxAge time.Duration
+		EventMaxAge time.Duration
+	}
+	Timeouts struct {
+		SMTP         time.Duration
+		Geo          time.Duration
+		Notification time.Duration
+		HTTPRead     time.Duration
+		HTTPWrite    time.Duration
+		HTTPIdle     time.Duration
+		Shutdown     time.Duration
+		// ShutdownDrain is how long /ready reports not ready before the
+		// listener stops, so load balancers can move traffic away
+		ShutdownDrain time.Duration
+	}
+	Log struct {
+		// Level is debug, info, warn or error
+		Level string
+		// Format is json or text
+		Format string
+	}
+	AccessLog struct {
+		// Format is json, apache or off
+		Format string
+		// SampleRate is the share of successful requests logged, 0 to 1.
+		// Errors are always logged.
+		SampleRate float64
+		SkipPaths  []string
+	}
+	Storage struct {
+		// EventsFile is where opens are persisted; without one they only
+		// live in memory
+		EventsFile    string
+		BatchSize     int
+		FlushInterval time.Duration
+		// QueueSize bounds the opens waiting to be written
+		QueueSize int
+	}
+	Notifications struct {
+		// QueueSize bounds the open notifications waiting to be sent
+		QueueSize int
+		Workers   int
+	}
+	Sends struct {
+		// MaxInFlight bounds the API sends handled at once; up to MaxQueued
+		// more wait as long as QueueTimeout for a slot
+		MaxInFlight  int
+		MaxQueued    int
+		QueueTimeout time.Duration
+	}
+	StatsCache struct {
+		// TTL is how long a per-email or per-campaign stats response is
+		// reused, unless the email changes first; 0 turns the cache off
+		TTL        time.Duration
+		MaxEntries int
+	}
+	Audit struct {
+		// File is appended to; without one the trail only lives in memory
+		File       string
+		MaxEntries int
+		// SigningKey signs exports; DataAccess records reads of
+		// recipient data
+		SigningKey string
+		DataAccess bool
+	}
+	Suppression struct {
+		// File is appended to; without one the list only lives in memory
+		File string
+	}
+	Webhooks struct {
+		// URLs are name=url entries and Secrets name:secret ones; each
+		// endpoint signs its deliveries with the secret of the same name
+		URLs    []string
+		Secrets []string
+		// Tenants are name:tenant entries; an endpoint not listed gets the
+		// default tenant's events
+		Tenants []string
+		Timeout time.Duration
+		// AllowPrivate lets tenants' own webhooks reach private and
+		// loopback addresses, which they are kept from by default
+		AllowPrivate bool
+	}
+	Deliverability struct {
+		// Guard checks the From domain's SPF, DKIM and DMARC before sends:
+		// off, warn or strict
+		Guard         string
+		DKIMSelectors []string
+		// SendingIPs are the addresses the SMTP provider delivers from, to
+		// check SPF against instead of the SMTP host's
+		SendingIPs []string
+		CacheTTL   time.Duration
+	}
+	Consent struct {
+		// File is appended to; without one consent only lives in memory
+		File string
+		// Mode is what marketing sends to contacts who haven't confirmed
+		// do: off, warn or strict
+		Mode       string
+		ConfirmTTL time.Duration
+		Subject    string
+	}
+	Contacts struct {
+		// File holds the tenants' contacts; without one they only live in
+		// memory
+		File string
+	}
+	Segments struct {
+		// File holds the tenants' segments; without one they only live in
+		// memory
+		File string
+	}
+	Tenants struct {
+		// File holds the tenants' own sending settings; without one they
+		// only live in memory
+		File string
+		// SecretKey is the age identity (AGE-SECRET-KEY-1...) the tenants'
+		// SMTP passwords and DKIM keys are encrypted with
+		SecretKey string
+	}
+	Usage struct {
+		// File keeps each tenant's monthly usage when Redis isn't enabled;
+		// without one it only lives in memory
+		File string
+		// StripeAPIKey turns on reporting usage to the Stripe billing
+		// meter whose event name is StripeMeterEvent, counting
+		// StripeMetric, every StripeInterval
+		StripeAPIKey     string
+		StripeMeterEvent string
+		StripeMetric     string
+		StripeInterval   time.Duration
+		StripeAPIURL     string
+	}
+}
+
+// GeoEndpoint is where an HTTP geo provider is reached and the key it takes.
+// Either may be empty to use the provider's defaults. RateLimit caps lookups
+// per minute; 0 means unlimited.
+type GeoEndpoint struct {
+	URL       string
+	APIKey    string
+	RateLimit int
 }
 
-// LoadConfig reads config directly from environment variables
-func LoadConfig() *Config {
+// LoadConfig builds the config from, lowest precedence first: built-in
+// defaults, the config file (YAML, JSON or TOML) and its overlay for the
+// current environment, environment variables including those set by .env,
+// and command-line flags.
+func LoadConfig(opts Options) (*Config, error) {
 	// Load environment variables (optional in production)
 	if err := godotenv.Load(); err != nil {
-		log.Println("Warning: .env file not found!!! 🙃")
+		slog.Info(".env file not found, using the environment only")
 	}
 
+	return load(opts)
+}
+
+// Reload re-reads the .env file, letting its values replace the ones loaded
+// at startup, and the config file, and builds a fresh config. Used for
+// SIGHUP reloads.
+func Reload(opts Options) (*Config, error) {
+	if err := godotenv.Overload(); err != nil {
+		slog.Info(".env file not found, reloading from the environment only")
+	}
+
+	return load(opts)
+}
+
+func load(opts Options) (*Config, error) {
+	src := source{flags: opts.Overrides}
+
+	path := opts.File
+	if path == "" {
+		path = os.Getenv("CONFIG_FILE")
+	}
+	if path != "" {
+		values, err := readFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("config file: %w", err)
+		}
+		src.file = values
+
+		// Layer config.<env>.yaml over config.yaml when it exists
+		env, _ := src.lookup("APP_ENV")
+		if env == "" {
+			env = "development"
+		}
+		overlay := overlayPath(path, env)
+		if _, err := os.Stat(overlay); err == nil {
+			values, err := readFile(overlay)
+			if err != nil {
+				return nil, fmt.Errorf("config file: %w", err)
+			}
+			for key, val := range values {
+				src.file[key] = val
+			}
+		} else if !errors.Is(err, fs.ErrNotExist) {
+			return nil, fmt.Errorf("config file: %w", err)
+		}
+	}
+	return fromEnv(src), nil
+}
+
+// source looks settings up in command-line flags, then the environment,
+// then the config file.
+type source struct {
+	flags map[string]string
+	file  map[string]string
+}
+
+func (s source) lookup(key string) (string, bool) {
+	if val, exists := s.flags[key]; exists {
+		return val, true
+	}
+	if val, exists := os.LookupEnv(key); exists {
+		return val, true
+	}
+	val, exists := s.file[key]
+	return val, exists
+}
+
+func fromEnv(src source) *Config {
 	cfg := &Config{}
 
 	// Server
-	cfg.Server.Port = getEnv("PORT", "8080")
-	cfg.Server.Host = getEnv("HOST", "0.0.0.0")
+	cfg.Server.Port = src.getEnv("PORT", "8080")
+	cfg.Server.Host = src.getEnv("HOST", "0.0.0.0")
+	cfg.Server.TrustedProxies = validNetworks("TRUSTED_PROXIES", src.getEnvAsSlice("TRUSTED_PROXIES", nil))
+
+	// HTTPS, with a certificate from files or Let's Encrypt
+	cfg.TLS.CertFile = src.getEnv("TLS_CERT_FILE", "")
+	cfg.TLS.KeyFile = src.getEnv("TLS_KEY_FILE", "")
+	cfg.TLS.AutocertDomains = src.getEnvAsSlice("TLS_AUTOCERT_DOMAINS", nil)
+	cfg.TLS.AutocertEmail = src.getEnv("TLS_AUTOCERT_EMAIL", "")
+	cfg.TLS.AutocertCacheDir = src.getEnv("TLS_AUTOCERT_CACHE_DIR", "autocert-cache")
+	cfg.TLS.HTTPPort = src.getEnv("TLS_HTTP_PORT", "")
 
 	// App
-	cfg.App.Env = getEnv("APP_ENV", "development")
-	cfg.App.BaseURL = getEnv("BASE_URL", "")
-	cfg.App.TrackingID = getEnv("TRACKING_ID", "dev_track_001")
+	cfg.App.Env = src.getEnv("APP_ENV", "development")
+	cfg.App.BaseURL = src.getEnv("BASE_URL", "")
+	cfg.App.TrackingID = src.getEnv("TRACKING_ID", "dev_track_001")
+	cfg.App.AssetsDir = src.getEnv("ASSETS_DIR", "")
 
 	// SMTP
-	cfg.SMTP.Host = getEnv("SMTP_HOST", "smtp.gmail.com")
-	cfg.SMTP.Port = getEnvAsInt("SMTP_PORT", 587)
-	cfg.SMTP.Username = getEnv("SMTP_USER", "")
-	cfg.SMTP.Password = getEnv("SMTP_PASSWORD", "")
-	cfg.SMTP.From = getEnv("SMTP_FROM", "")
+	cfg.SMTP.Host = src.getEnv("SMTP_HOST", "smtp.gmail.com")
+	cfg.SMTP.Port = src.getEnvAsInt("SMTP_PORT", 587)
+	cfg.SMTP.Username = src.getEnv("SMTP_USER", "")
+	cfg.SMTP.Password = src.getEnv("SMTP_PASSWORD", "")
+	cfg.SMTP.From = src.getEnv("SMTP_FROM", "")
+	cfg.SMTP.MaxRetries = src.getEnvAsInt("SMTP_MAX_RETRIES", 2)
+	cfg.SMTP.Workers = src.getEnvAsInt("SMTP_WORKERS", 4)
+	cfg.SMTP.QueueSize = src.getEnvAsInt("SMTP_QUEUE_SIZE", 100)
 
 	// Redis
-	cfg.Redis.Host = getEnv("REDIS_HOST", "localhost")
-	cfg.Redis.Port = getEnvAsInt("REDIS_PORT", 6379)
-	cfg.Redis.Password = getEnv("REDIS_PASSWORD", "")
-	cfg.Redis.DB = getEnvAsInt("REDIS_DB", 0)
+	cfg.Redis.Enabled = src.getEnvAsBool("REDIS_ENABLED", false)
+	cfg.Redis.Host = src.getEnv("REDIS_HOST", "localhost")
+	cfg.Redis.Port = src.getEnvAsInt("REDIS_PORT", 6379)
+	cfg.Redis.Password = src.getEnv("REDIS_PASSWORD", "")
+	cfg.Redis.DB = src.getEnvAsInt("REDIS_DB", 0)
+
+	// Multi-instance mode
+	cfg.Cluster.Enabled = src.getEnvAsBool("CLUSTER_ENABLED", false)
+	cfg.Cluster.InstanceID = src.getEnv("CLUSTER_INSTANCE_ID", defaultInstanceID())
+
+	// Outbound HTTP, shared by geo providers
+	cfg.HTTPClient.Timeout = src.getEnvAsPositiveDuration("HTTP_CLIENT_TIMEOUT", 30*time.Second)
+	cfg.HTTPClient.MaxIdlePerHost = src.getEnvAsInt("HTTP_CLIENT_MAX_IDLE_PER_HOST", 10)
+	cfg.HTTPClient.IdleTimeout = src.getEnvAsPositiveDuration("HTTP_CLIENT_IDLE_TIMEOUT", 90*time.Second)
+
+	// Circuit breakers around SMTP and the geo providers
+	cfg.Breakers.Threshold = src.getEnvAsInt("BREAKER_FAILURE_THRESHOLD", 5)
+	cfg.Breakers.Cooldown = src.getEnvAsPositiveDuration("BREAKER_COOLDOWN", 30*time.Second)
 
 	// Geo API
-	cfg.GeoAPI.Provider = getEnv("GEO_PROVIDER", "ip-api")
-	cfg.GeoAPI.APIKey = getEnv("GEO_API_KEY", "")
-	cfg.GeoAPI.URL = getEnv("GEO_URL", "http://ip-api.com/json/")
+	cfg.GeoAPI.Provider = src.getEnv("GEO_PROVIDER", "ip-api")
+	cfg.GeoAPI.APIKey = src.getEnv("GEO_API_KEY", "")
+	cfg.GeoAPI.Providers = src.getEnvAsSlice("GEO_PROVIDERS", []string{cfg.GeoAPI.Provider})
+	cfg.GeoAPI.URL = src.getEnv("GEO_URL", "")
+	// ip-api's free endpoint allows 45 requests a minute
+	cfg.GeoAPI.IPAPI = src.getGeoEndpoint("IPAPI", 45)
+	cfg.GeoAPI.IPInfo = src.getGeoEndpoint("IPINFO", 0)
+	cfg.GeoAPI.IPStack = src.getGeoEndpoint("IPSTACK", 0)
+	cfg.GeoAPI.MaxMindDB = src.getEnv("GEO_MAXMIND_DB", "")
+	cfg.GeoAPI.ReloadInterval = src.getEnvAsPositiveDuration("GEO_MAXMIND_RELOAD_INTERVAL", 24*time.Hour)
+	cfg.GeoAPI.CacheSize = src.getEnvAsInt("GEO_CACHE_SIZE", 10000)
+	cfg.GeoAPI.CacheTTL = src.getEnvAsPositiveDuration("GEO_CACHE_TTL", 24*time.Hour)
+	cfg.GeoAPI.QueueSize = src.getEnvAsInt("GEO_QUEUE_SIZE", 1000)
+	cfg.GeoAPI.NetworkLookup = src.getEnvAsBool("GEO_NETWORK_LOOKUP", false)
+	cfg.GeoAPI.ASNDB = src.getEnv("GEO_ASN_DB", "")
 
 	// External API
-	cfg.ExternalAPI.Resend = getEnv("RESEND_API", "")
+	cfg.ExternalAPI.Resend = src.getEnv("RESEND_API", "")
+
+	// Auth
+	cfg.Auth.Users = src.getEnvAsSlice("AUTH_USERS", nil)
+	cfg.Auth.APIKeys = src.getEnvAsSlice("API_KEYS", nil)
+	cfg.Auth.Admins = src.getEnvAsSlice("AUTH_ADMINS", nil)
+	cfg.Auth.Roles = src.getEnvAsSlice("AUTH_ROLES", nil)
+	cfg.Auth.Tenants = src.getEnvAsSlice("AUTH_TENANTS", nil)
+	cfg.Auth.DefaultRole = strings.ToLower(src.getEnv("AUTH_DEFAULT_ROLE", "sender"))
+	switch cfg.Auth.DefaultRole {
+	case "viewer", "sender", "admin":
+	default:
+		slog.Warn("unknown AUTH_DEFAULT_ROLE, using viewer", "value", cfg.Auth.DefaultRole)
+		cfg.Auth.DefaultRole = "viewer"
+	}
+	cfg.Auth.SessionTTL = src.getEnvAsDuration("SESSION_TTL", 12*time.Hour)
+
+	// Reports
+	cfg.Reports.Frequency = src.getEnv("REPORT_FREQUENCY", "")
+	cfg.Reports.Recipients = src.getEnvAsSlice("REPORT_RECIPIENTS", nil)
+	if f := cfg.Reports.Frequency; f != "" && f != "weekly" && f != "monthly" {
+		slog.Warn("unsupported REPORT_FREQUENCY, reports disabled", "value", f)
+		cfg.Reports.Frequency = ""
+	}
+
+	// Security
+	cfg.Security.ScanAlertEmail = src.getEnv("SCAN_ALERT_EMAIL", "")
+	cfg.Security.ScanAlertThreshold = src.getEnvAsInt("SCAN_ALERT_THRESHOLD", 20)
+	cfg.Security.ScanAlertWindow = src.getEnvAsDuration("SCAN_ALERT_WINDOW", 10*time.Minute)
+	cfg.Security.ScanRateLimit = src.getEnvAsInt("SCAN_RATE_LIMIT", 600)
+	cfg.Security.ScanBanDuration = src.getEnvAsDuration("SCAN_BAN_DURATION", time.Hour)
+	cfg.Security.ScanExemptIPs = validNetworks("SCAN_EXEMPT_IPS", src.getEnvAsSlice("SCAN_EXEMPT_IPS", nil))
+
+	// Response headers and request limits; HSTS is only on by default in
+	// production, so a development instance tried over HTTPS doesn't pin
+	// localhost to it
+	hsts := time.Duration(0)
+	if cfg.App.Env == "production" {
+		hsts = 365 * 24 * time.Hour
+	}
+	cfg.Security.HSTSMaxAge = src.getEnvAsDuration("SECURITY_HSTS_MAX_AGE", hsts)
+	cfg.Security.FrameOptions = strings.ToUpper(src.getEnv("SECURITY_FRAME_OPTIONS", "DENY"))
+	cfg.Security.ReferrerPolicy = strings.ToLower(src.getEnv("SECURITY_REFERRER_POLICY", "same-origin"))
+	cfg.Security.MaxBodySize = src.getEnvAsInt("SECURITY_MAX_BODY_SIZE", 1<<20)
+	cfg.Security.AllowedMethods = src.getEnvAsSlice("SECURITY_ALLOWED_METHODS", []string{"GET", "HEAD", "POST", "PUT", "DELETE"})
+	for i, method := range cfg.Security.AllowedMethods {
+		cfg.Security.AllowedMethods[i] = strings.ToUpper(method)
+	}
+
+	// Secrets manager references are re-resolved this often (0 disables)
+	cfg.Secrets.RefreshInterval = src.getEnvAsDuration("SECRETS_REFRESH_INTERVAL", 15*time.Minute)
+
+	// Tracking
+	cfg.Tracking.PixelPath = pixelPath(src.getEnv("TRACKING_PIXEL_PATH", DefaultPixelPath))
+	cfg.Tracking.DedupWindow = src.getEnvAsDuration("TRACKING_DEDUP_WINDOW", 0)
+	cfg.Tracking.BotFiltering = src.getEnvAsBool("TRACKING_BOT_FILTERING", true)
+	cfg.Tracking.SignatureSecret = src.getEnv("TRACKING_SIGNATURE_SECRET", "")
+	// TRACKING_STORE_IP=false is shorthand for TRACKING_IP_MODE=hash
+	ipMode := IPModeFull
+	if !src.getEnvAsBool("TRACKING_STORE_IP", true) {
+		ipMode = IPModeHash
+	}
+	cfg.Tracking.IPMode = src.getEnv("TRACKING_IP_MODE", ipMode)
+	cfg.Tracking.HashSalt = src.getEnv("TRACKING_HASH_SALT", "")
+	switch cfg.Tracking.IPMode {
+	case IPModeFull, IPModeTruncate, IPModeHash:
+	default:
+		// Err on the side of storing less
+		slog.Warn("unknown TRACKING_IP_MODE, hashing IPs", "value", cfg.Tracking.IPMode)
+		cfg.Tracking.IPMode = IPModeHash
+	}
+	cfg.Tracking.StoreUserAgent = src.getEnvAsBool("TRACKING_STORE_USER_AGENT", true)
+	cfg.Tracking.MaxEntries = src.getEnvAsInt("TRACKING_MAX_ENTRIES", 100000)
+	cfg.Tracking.StoreUnknownOpens = src.getEnvAsBool("TRACKING_STORE_UNKNOWN_OPENS", false)
+	if cfg.Tracking.DedupWindow < 0 {
+		slog.Warn("negative TRACKING_DEDUP_WINDOW, open deduplication disabled")
+		cfg.Tracking.DedupWindow = 0
+	}
+
+	// Retention: emails and their opens/clicks are dropped once older than
+	// their max age, which both default to RETENTION_MAX_AGE
+	maxAge := src.getEnvAsPositiveDuration("RETENTION_MAX_AGE", 30*24*time.Hour)
+	cfg.Retention.Interval = src.getEnvAsPositiveDuration("RETENTION_INTERVAL", time.Hour)
+	cfg.Retention.EmailMaxAge = src.getEnvAsPositiveDuration("RETENTION_EMAIL_MAX_AGE", maxAge)
+	cfg.Retention.EventMaxAge = src.getEnvAsPositiveDuration("RETENTION_EVENT_MAX_AGE", maxAge)
+
+	// Timeouts
+	cfg.Timeouts.SMTP = src.getEnvAsPositiveDuration("SMTP_TIMEOUT", 10*time.Second)
+	cfg.Timeouts.Geo = src.getEnvAsPositiveDuration("GEO_TIMEOUT", 5*time.Second)
+	cfg.Timeouts.Notification = src.getEnvAsPositiveDuration("NOTIFICATION_TIMEOUT", 10*time.Second)
+	cfg.Timeouts.HTTPRead = src.getEnvAsPositiveDuration("HTTP_READ_TIMEOUT", 10*time.Second)
+	cfg.Timeouts.HTTPWrite = src.getEnvAsPositiveDuration("HTTP_WRITE_TIMEOUT", 10*time.Second)
+	cfg.Timeouts.HTTPIdle = src.getEnvAsPositiveDuration("HTTP_IDLE_TIMEOUT", 60*time.Second)
+	cfg.Timeouts.Shutdown = src.getEnvAsPositiveDuration("SHUTDOWN_TIMEOUT", 5*time.Second)
+	drain := time.Duration(0)
+	if cfg.App.Env == "production" {
+		drain = 5 * time.Second
+	}
+	cfg.Timeouts.ShutdownDrain = src.getEnvAsDuration("SHUTDOWN_DRAIN_DELAY", drain)
+
+	// Logging: readable and verbose in development, JSON in production
+	level, format := "debug", "text"
+	if cfg.App.Env == "production" {
+		level, format = "info", "json"
+	}
+	cfg.Log.Level = strings.ToLower(src.getEnv("LOG_LEVEL", level))
+	cfg.Log.Format = strings.ToLower(src.getEnv("LOG_FORMAT", format))
+
+	// HTTP access log
+	cfg.AccessLog.Format = strings.ToLower(src.getEnv("ACCESS_LOG_FORMAT", "json"))
+	cfg.AccessLog.SampleRate = src.getEnvAsFloat("ACCESS_LOG_SAMPLE_RATE", 1)
+	cfg.AccessLog.SkipPaths = src.getEnvAsSlice("ACCESS_LOG_SKIP_PATHS", nil)
+
+	// Event persistence
+	cfg.Storage.EventsFile = src.getEnv("EVENT_STORE_FILE", "")
+	cfg.Storage.BatchSize = src.getEnvAsInt("EVENT_BATCH_SIZE", 100)
+	cfg.Storage.FlushInterval = src.getEnvAsPositiveDuration("EVENT_FLUSH_INTERVAL", 500*time.Millisecond)
+	cfg.Storage.QueueSize = src.getEnvAsInt("EVENT_QUEUE_SIZE", 10000)
+
+	// Open notifications
+	cfg.Notifications.QueueSize = src.getEnvAsInt("NOTIFICATION_QUEUE_SIZE", 1000)
+	cfg.Notifications.Workers = src.getEnvAsInt("NOTIFICATION_WORKERS", 2)
+
+	// Send admission
+	cfg.Sends.MaxInFlight = src.getEnvAsInt("SEND_MAX_IN_FLIGHT", 20)
+	cfg.Sends.MaxQueued = src.getEnvAsInt("SEND_MAX_QUEUED", 100)
+	cfg.Sends.QueueTimeout = src.getEnvAsPositiveDuration("SEND_QUEUE_TIMEOUT", 5*time.Second)
+
+	// Stats response cache
+	cfg.StatsCache.TTL = src.getEnvAsDuration("STATS_CACHE_TTL", 5*time.Second)
+	cfg.StatsCache.MaxEntries = src.getEnvAsInt("STATS_CACHE_MAX_ENTRIES", 10000)
+
+	// Audit trail
+	cfg.Audit.File = src.getEnv("AUDIT_LOG_FILE", "")
+	cfg.Audit.MaxEntries = src.getEnvAsInt("AUDIT_MAX_ENTRIES", 10000)
+	cfg.Audit.SigningKey = src.getEnv("AUDIT_SIGNING_KEY", "")
+	cfg.Audit.DataAccess = src.getEnvAsBool("AUDIT_DATA_ACCESS", true)
+
+	// Suppression list
+	cfg.Suppression.File = src.getEnv("SUPPRESSION_FILE", "")
+
+	// Outbound webhooks for opens and clicks
+	cfg.Webhooks.URLs = src.getEnvAsSlice("WEBHOOK_URLS", nil)
+	cfg.Webhooks.Secrets = src.getEnvAsSlice("WEBHOOK_SECRETS", nil)
+	cfg.Webhooks.Tenants = src.getEnvAsSlice("WEBHOOK_TENANTS", nil)
+	cfg.Webhooks.Timeout = src.getEnvAsPositiveDuration("WEBHOOK_TIMEOUT", 5*time.Second)
+	cfg.Webhooks.AllowPrivate = src.getEnvAsBool("WEBHOOK_ALLOW_PRIVATE_NETWORKS", false)
+
+	// Sender domain authentication checks
+	cfg.Deliverability.Guard = strings.ToLower(src.getEnv("DELIVERABILITY_GUARD", "off"))
+	switch cfg.Deliverability.Guard {
+	case "off", "warn", "strict":
+	default:
+		slog.Warn("unknown DELIVERABILITY_GUARD, only warning", "value", cfg.Deliverability.Guard)
+		cfg.Deliverability.Guard = "warn"
+	}
+	cfg.Deliverability.DKIMSelectors = src.getEnvAsSlice("DELIVERABILITY_DKIM_SELECTORS", nil)
+	cfg.Deliverability.SendingIPs = src.getEnvAsSlice("DELIVERABILITY_SENDING_IPS", nil)
+	cfg.Deliverability.CacheTTL = src.getEnvAsPositiveDuration("DELIVERABILITY_CACHE_TTL", 10*time.Minute)
+
+	// Double opt-in consent
+	cfg.Consent.File = src.getEnv("CONSENT_FILE", "")
+	cfg.Consent.Mode = strings.ToLower(src.getEnv("CONSENT_MODE", "off"))
+	switch cfg.Consent.Mode {
+	case "off", "warn", "strict":
+	default:
+		slog.Warn("unknown CONSENT_MODE, only warning", "value", cfg.Consent.Mode)
+		cfg.Consent.Mode = "warn"
+	}
+	cfg.Consent.ConfirmTTL = src.getEnvAsPositiveDuration("CONSENT_CONFIRM_TTL", 7*24*time.Hour)
+	cfg.Consent.Subject = src.getEnv("CONSENT_SUBJECT", "Please confirm your subscription")
+
+	// Tenants' contacts
+	cfg.Contacts.File = src.getEnv("CONTACTS_FILE", "")
+
+	// Tenants' segments of their contacts
+	cfg.Segments.File = src.getEnv("SEGMENTS_FILE", "")
+
+	// Tenants' own sending settings
+	cfg.Tenants.File = src.getEnv("TENANTS_FILE", "")
+	cfg.Tenants.SecretKey = src.getEnv("TENANTS_SECRET_KEY", "")
+
+	// Usage metering for billing
+	cfg.Usage.File = src.getEnv("USAGE_FILE", "")
+	cfg.Usage.StripeAPIKey = src.getEnv("STRIPE_API_KEY", "")
+	cfg.Usage.StripeMeterEvent = src.getEnv("STRIPE_METER_EVENT", "")
+	cfg.Usage.StripeMetric = src.getEnv("STRIPE_METER_METRIC", "recipients")
+	cfg.Usage.StripeInterval = src.getEnvAsPositiveDuration("STRIPE_REPORT_INTERVAL", time.Hour)
+	cfg.Usage.StripeAPIURL = src.getEnv("STRIPE_API_URL", "https://api.stripe.com")
 
 	return cfg
 }
 
+// SecretFields returns the settings that may hold a secrets manager
+// reference instead of a literal value. API keys and webhook secrets are
+// handled separately since only the part after the name is secret.
+func (c *Config) SecretFields() map[string]*string {
+	return map[string]*string{
+		"SMTP_PASSWORD":  &c.SMTP.Password,
+		"SMTP_USERNAME":  &c.SMTP.Username,
+		"REDIS_PASSWORD": &c.Redis.Password,
+		"GEO_API_KEY":    &c.GeoAPI.APIKey,
+		"RESEND_API":     &c.ExternalAPI.Resend,
+
+		"TRACKING_SIGNATURE_SECRET": &c.Tracking.SignatureSecret,
+		"TRACKING_HASH_SALT":        &c.Tracking.HashSalt,
+		"GEO_IPAPI_API_KEY":         &c.GeoAPI.IPAPI.APIKey,
+		"GEO_IPINFO_API_KEY":        &c.GeoAPI.IPInfo.APIKey,
+		"GEO_IPSTACK_API_KEY":       &c.GeoAPI.IPStack.APIKey,
+		"AUDIT_SIGNING_KEY":         &c.Audit.SigningKey,
+		"TENANTS_SECRET_KEY":        &c.Tenants.SecretKey,
+		"STRIPE_API_KEY":            &c.Usage.StripeAPIKey,
+	}
+}
+
+// Clone returns a copy of the config that shares no slices with c.
+func (c *Config) Clone() *Config {
+	clone := *c
+	clone.Server.TrustedProxies = append([]string(nil), c.Server.TrustedProxies...)
+	clone.TLS.AutocertDomains = append([]string(nil), c.TLS.AutocertDomains...)
+	clone.Security.AllowedMethods = append([]string(nil), c.Security.AllowedMethods...)
+	clone.Security.ScanExemptIPs = append([]string(nil), c.Security.ScanExemptIPs...)
+	clone.Deliverability.DKIMSelectors = append([]string(nil), c.Deliverability.DKIMSelectors...)
+	clone.Deliverability.SendingIPs = append([]string(nil), c.Deliverability.SendingIPs...)
+	clone.GeoAPI.Providers = append([]string(nil), c.GeoAPI.Providers...)
+	clone.Auth.Users = append([]string(nil), c.Auth.Users...)
+	clone.Auth.APIKeys = append([]string(nil), c.Auth.APIKeys...)
+	clone.Auth.Admins = append([]string(nil), c.Auth.Admins...)
+	clone.Auth.Roles = append([]string(nil), c.Auth.Roles...)
+	clone.Auth.Tenants = append([]string(nil), c.Auth.Tenants...)
+	clone.AccessLog.SkipPaths = append([]string(nil), c.AccessLog.SkipPaths...)
+	clone.Reports.Recipients = append([]string(nil), c.Reports.Recipients...)
+	clone.Webhooks.URLs = append([]string(nil), c.Webhooks.URLs...)
+	clone.Webhooks.Secrets = append([]string(nil), c.Webhooks.Secrets...)
+	clone.Webhooks.Tenants = append([]string(nil), c.Webhooks.Tenants...)
+	return &clone
+}
+
 // Helper: string env
-func getEnv(key, defaultVal string) string {
-	if val, exists := os.LookupEnv(key); exists {
+func (s source) getEnv(key, defaultVal string) string {
+	if val, exists := s.lookup(key); exists {
 		return val
 	}
 	return defaultVal
 }
 
 // Helper: int env
-func getEnvAsInt(key string, defaultVal int) int {
-	if valStr, exists := os.LookupEnv(key); exists {
+func (s source) getEnvAsInt(key string, defaultVal int) int {
+	if valStr, exists := s.lookup(key); exists {
 		if val, err := strconv.Atoi(valStr); err == nil {
 			return val
 		}
@@ -102,6 +709,123 @@ func getEnvAsInt(key string, defaultVal int) int {
 	return defaultVal
 }
 
+// Helper: float env
+func (s source) getEnvAsFloat(key string, defaultVal float64) float64 {
+	if valStr, exists := s.lookup(key); exists {
+		if val, err := strconv.ParseFloat(valStr, 64); err == nil {
+			return val
+		}
+	}
+	return defaultVal
+}
+
+// Helper: bool env
+func (s source) getEnvAsBool(key string, defaultVal bool) bool {
+	if valStr, exists := s.lookup(key); exists {
+		if val, err := strconv.ParseBool(valStr); err == nil {
+			return val
+		}
+	}
+	return defaultVal
+}
+
+// Helper: duration env (e.g. "90s", "10m")
+func (s source) getEnvAsDuration(key string, defaultVal time.Duration) time.Duration {
+	if valStr, exists := s.lookup(key); exists {
+		if val, err := time.ParseDuration(valStr); err == nil {
+			return val
+		}
+	}
+	return defaultVal
+}
+
+// DefaultPixelPath is where tracking pixels are served unless configured
+// otherwise. It stays routed after a change so pixels in emails already sent
+// keep working.
+const DefaultPixelPath = "/track"
+
+// Ways client IPs can be stored. Truncated IPs keep the network, enough to
+// locate a client roughly; hashed ones only tell clients apart.
+const (
+	IPModeFull     = "full"
+	IPModeTruncate = "truncate"
+	IPModeHash     = "hash"
+)
+
+// reservedPaths are routed by the server itself and can't host the pixel
+var reservedPaths = []string{"/api", "/dashboard", "/static", "/login", "/logout", "/click", "/unsubscribe", "/confirm", "/health"}
+
+// pixelPath normalizes TRACKING_PIXEL_PATH, falling back to the default when
+// it would clash with another route.
+func pixelPath(path string) string {
+	path = "/" + strings.Trim(path, "/")
+	if path == "/" || strings.ContainsAny(path, ":*?#") {
+		slog.Warn("invalid TRACKING_PIXEL_PATH, using the default", "value", path, "default", DefaultPixelPath)
+		return DefaultPixelPath
+	}
+	for _, reserved := range reservedPaths {
+		if path == reserved || strings.HasPrefix(path, reserved+"/") {
+			slog.Warn("TRACKING_PIXEL_PATH clashes with another route, using the default", "value", path, "route", reserved, "default", DefaultPixelPath)
+			return DefaultPixelPath
+		}
+	}
+	return path
+}
+
+// validNetworks drops entries of an IP list such as TRUSTED_PROXIES that
+// are neither an IP nor a CIDR, so a typo can't make the server trust
+// everyone or fail to start.
+func validNetworks(key string, entries []string) []string {
+	var valid []string
+	for _, entry := range entries {
+		if _, _, err := net.ParseCIDR(entry); err != nil && net.ParseIP(entry) == nil {
+			slog.Warn("ignoring invalid IP or CIDR", "key", key, "value", entry)
+			continue
+		}
+		valid = append(valid, entry)
+	}
+	return valid
+}
+
+// Helper: duration env that must be positive, such as a timeout
+func (s source) getEnvAsPositiveDuration(key string, defaultVal time.Duration) time.Duration {
+	valStr, exists := s.lookup(key)
+	if !exists {
+		return defaultVal
+	}
+	val, err := time.ParseDuration(valStr)
+	if err != nil || val <= 0 {
+		slog.Warn("invalid duration, using the default", "key", key, "value", valStr, "default", defaultVal)
+		return defaultVal
+	}
+	return val
+}
+
+// Helper: GEO_<name>_URL and GEO_<name>_API_KEY
+func (s source) getGeoEndpoint(name string, rateLimit int) GeoEndpoint {
+	return GeoEndpoint{
+		URL:       s.getEnv("GEO_"+name+"_URL", ""),
+		APIKey:    s.getEnv("GEO_"+name+"_API_KEY", ""),
+		RateLimit: s.getEnvAsInt("GEO_"+name+"_RATE_LIMIT", rateLimit),
+	}
+}
+
+// Helper: comma-separated list env
+func (s source) getEnvAsSlice(key string, defaultVal []string) []string {
+	valStr, exists := s.lookup(key)
+	if !exists {
+		return defaultVal
+	}
+
+	var vals []string
+	for _, v := range strings.Split(valStr, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			vals = append(vals, v)
+		}
+	}
+	return vals
+}
+
 // GetBaseURL returns correct base URL for email tracking
 func (c *Config) GetBaseURL(requestHost string) string {
 	if c.App.BaseURL != "" {
@@ -115,14 +839,35 @@ func (c *Config) GetBaseURL(requestHost string) string {
 		return c.Server.Host
 	}
 
+	if c.TLSEnabled() {
+		return "https://localhost:" + c.Server.Port
+	}
 	return "http://localhost:" + c.Server.Port
 }
 
+// TLSEnabled reports whether the server serves HTTPS itself
+func (c *Config) TLSEnabled() bool {
+	return c.TLS.CertFile != "" || len(c.TLS.AutocertDomains) > 0
+}
+
 // MustLoadConfig helper
-func MustLoadConfig() *Config {
-	cfg := LoadConfig()
+func MustLoadConfig(opts Options) *Config {
+	cfg, err := LoadConfig(opts)
+	if err != nil {
+		slog.Error("failed to load configuration", "error", err)
+		os.Exit(1)
+	}
 	if cfg.SMTP.Username == "" || cfg.SMTP.Password == "" {
-		log.Println("WARNING: SMTP credentials are missing")
+		slog.Warn("SMTP credentials are missing")
 	}
 	return cfg
 }
+
+// defaultInstanceID names this process among the instances of a cluster
+func defaultInstanceID() string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+	return fmt.Sprintf("%s-%d", host, os.Getpid())
+}
@@ -0,0 +1,59 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"filippo.io/age"
+	"filippo.io/age/armor"
+)
+
+// Encrypted config files are age-encrypted (binary or ASCII-armored) to one
+// or more recipients. The matching identity comes from CONFIG_AGE_KEY, an
+// AGE-SECRET-KEY-1... string, or CONFIG_AGE_KEY_FILE, a file of identities
+// as written by age-keygen. These are read from the environment only, never
+// from the config file they unlock.
+
+func isEncrypted(path string) bool {
+	return strings.EqualFold(filepath.Ext(path), ".age")
+}
+
+func decrypt(data []byte) ([]byte, error) {
+	identities, err := ageIdentities()
+	if err != nil {
+		return nil, err
+	}
+
+	var src io.Reader = bytes.NewReader(data)
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte(armor.Header)) {
+		src = armor.NewReader(bytes.NewReader(bytes.TrimSpace(data)))
+	}
+
+	r, err := age.Decrypt(src, identities...)
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(r)
+}
+
+func ageIdentities() ([]age.Identity, error) {
+	if key := os.Getenv("CONFIG_AGE_KEY"); key != "" {
+		return age.ParseIdentities(strings.NewReader(key))
+	}
+
+	path := os.Getenv("CONFIG_AGE_KEY_FILE")
+	if path == "" {
+		return nil, errors.New("encrypted config needs CONFIG_AGE_KEY or CONFIG_AGE_KEY_FILE")
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("open age key file: %w", err)
+	}
+	defer f.Close()
+	return age.ParseIdentities(f)
+}
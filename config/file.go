@@ -0,0 +1,317 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/goccy/go-yaml"
+	"github.com/pelletier/go-toml/v2"
+)
+
+// fileKeys maps each setting's dotted path in a config file to the
+// environment variable it stands in for.
+var fileKeys = map[string]string{
+	"server.port":            "PORT",
+	"server.host":            "HOST",
+	"server.trusted_proxies": "TRUSTED_PROXIES",
+
+	"tls.cert_file":          "TLS_CERT_FILE",
+	"tls.key_file":           "TLS_KEY_FILE",
+	"tls.autocert_domains":   "TLS_AUTOCERT_DOMAINS",
+	"tls.autocert_email":     "TLS_AUTOCERT_EMAIL",
+	"tls.autocert_cache_dir": "TLS_AUTOCERT_CACHE_DIR",
+	"tls.http_port":          "TLS_HTTP_PORT",
+
+	"app.env":         "APP_ENV",
+	"app.base_url":    "BASE_URL",
+	"app.tracking_id": "TRACKING_ID",
+	"app.assets_dir":  "ASSETS_DIR",
+
+	"smtp.host":        "SMTP_HOST",
+	"smtp.port":        "SMTP_PORT",
+	"smtp.username":    "SMTP_USER",
+	"smtp.password":    "SMTP_PASSWORD",
+	"smtp.from":        "SMTP_FROM",
+	"smtp.max_retries": "SMTP_MAX_RETRIES",
+	"smtp.workers":     "SMTP_WORKERS",
+	"smtp.queue_size":  "SMTP_QUEUE_SIZE",
+
+	"redis.enabled":  "REDIS_ENABLED",
+	"redis.host":     "REDIS_HOST",
+	"redis.port":     "REDIS_PORT",
+	"redis.password": "REDIS_PASSWORD",
+	"redis.db":       "REDIS_DB",
+
+	"cluster.enabled":     "CLUSTER_ENABLED",
+	"cluster.instance_id": "CLUSTER_INSTANCE_ID",
+
+	"http_client.timeout":           "HTTP_CLIENT_TIMEOUT",
+	"http_client.max_idle_per_host": "HTTP_CLIENT_MAX_IDLE_PER_HOST",
+	"http_client.idle_timeout":      "HTTP_CLIENT_IDLE_TIMEOUT",
+
+	"breakers.failure_threshold": "BREAKER_FAILURE_THRESHOLD",
+	"breakers.cooldown":          "BREAKER_COOLDOWN",
+
+	"geo_api.provider":           "GEO_PROVIDER",
+	"geo_api.providers":          "GEO_PROVIDERS",
+	"geo_api.api_key":            "GEO_API_KEY",
+	"geo_api.url":                "GEO_URL",
+	"geo_api.ipapi.url":          "GEO_IPAPI_URL",
+	"geo_api.ipapi.api_key":      "GEO_IPAPI_API_KEY",
+	"geo_api.ipapi.rate_limit":   "GEO_IPAPI_RATE_LIMIT",
+	"geo_api.ipinfo.url":         "GEO_IPINFO_URL",
+	"geo_api.ipinfo.api_key":     "GEO_IPINFO_API_KEY",
+	"geo_api.ipinfo.rate_limit":  "GEO_IPINFO_RATE_LIMIT",
+	"geo_api.ipstack.url":        "GEO_IPSTACK_URL",
+	"geo_api.ipstack.api_key":    "GEO_IPSTACK_API_KEY",
+	"geo_api.ipstack.rate_limit": "GEO_IPSTACK_RATE_LIMIT",
+	"geo_api.maxmind_db":         "GEO_MAXMIND_DB",
+	"geo_api.reload_interval":    "GEO_MAXMIND_RELOAD_INTERVAL",
+	"geo_api.cache_size":         "GEO_CACHE_SIZE",
+	"geo_api.cache_ttl":          "GEO_CACHE_TTL",
+	"geo_api.network_lookup":     "GEO_NETWORK_LOOKUP",
+	"geo_api.asn_db":             "GEO_ASN_DB",
+	"geo_api.queue_size":         "GEO_QUEUE_SIZE",
+
+	"external_api.resend": "RESEND_API",
+
+	"auth.users":        "AUTH_USERS",
+	"auth.api_keys":     "API_KEYS",
+	"auth.admins":       "AUTH_ADMINS",
+	"auth.roles":        "AUTH_ROLES",
+	"auth.tenants":      "AUTH_TENANTS",
+	"auth.default_role": "AUTH_DEFAULT_ROLE",
+	"auth.session_ttl":  "SESSION_TTL",
+
+	"reports.frequency":  "REPORT_FREQUENCY",
+	"reports.recipients": "REPORT_RECIPIENTS",
+
+	"security.scan_alert_email":     "SCAN_ALERT_EMAIL",
+	"security.scan_alert_threshold": "SCAN_ALERT_THRESHOLD",
+	"security.scan_alert_window":    "SCAN_ALERT_WINDOW",
+	"security.scan_rate_limit":      "SCAN_RATE_LIMIT",
+	"security.scan_ban_duration":    "SCAN_BAN_DURATION",
+	"security.scan_exempt_ips":      "SCAN_EXEMPT_IPS",
+	"security.hsts_max_age":         "SECURITY_HSTS_MAX_AGE",
+	"security.frame_options":        "SECURITY_FRAME_OPTIONS",
+	"security.referrer_policy":      "SECURITY_REFERRER_POLICY",
+	"security.max_body_size":        "SECURITY_MAX_BODY_SIZE",
+	"security.allowed_methods":      "SECURITY_ALLOWED_METHODS",
+
+	"secrets.refresh_interval": "SECRETS_REFRESH_INTERVAL",
+
+	"tracking.pixel_path":          "TRACKING_PIXEL_PATH",
+	"tracking.dedup_window":        "TRACKING_DEDUP_WINDOW",
+	"tracking.bot_filtering":       "TRACKING_BOT_FILTERING",
+	"tracking.signature_secret":    "TRACKING_SIGNATURE_SECRET",
+	"tracking.store_ip":            "TRACKING_STORE_IP",
+	"tracking.ip_mode":             "TRACKING_IP_MODE",
+	"tracking.hash_salt":           "TRACKING_HASH_SALT",
+	"tracking.store_user_agent":    "TRACKING_STORE_USER_AGENT",
+	"tracking.max_entries":         "TRACKING_MAX_ENTRIES",
+	"tracking.store_unknown_opens": "TRACKING_STORE_UNKNOWN_OPENS",
+
+	"retention.max_age":       "RETENTION_MAX_AGE",
+	"retention.interval":      "RETENTION_INTERVAL",
+	"retention.email_max_age": "RETENTION_EMAIL_MAX_AGE",
+	"retention.event_max_age": "RETENTION_EVENT_MAX_AGE",
+
+	"timeouts.smtp":           "SMTP_TIMEOUT",
+	"timeouts.geo":            "GEO_TIMEOUT",
+	"timeouts.notification":   "NOTIFICATION_TIMEOUT",
+	"timeouts.http_read":      "HTTP_READ_TIMEOUT",
+	"timeouts.http_write":     "HTTP_WRITE_TIMEOUT",
+	"timeouts.http_idle":      "HTTP_IDLE_TIMEOUT",
+	"timeouts.shutdown":       "SHUTDOWN_TIMEOUT",
+	"timeouts.shutdown_drain": "SHUTDOWN_DRAIN_DELAY",
+
+	"log.level":  "LOG_LEVEL",
+	"log.format": "LOG_FORMAT",
+
+	"access_log.format":      "ACCESS_LOG_FORMAT",
+	"access_log.sample_rate": "ACCESS_LOG_SAMPLE_RATE",
+	"access_log.skip_paths":  "ACCESS_LOG_SKIP_PATHS",
+
+	"storage.events_file":    "EVENT_STORE_FILE",
+	"storage.batch_size":     "EVENT_BATCH_SIZE",
+	"storage.flush_interval": "EVENT_FLUSH_INTERVAL",
+	"storage.queue_size":     "EVENT_QUEUE_SIZE",
+
+	"notifications.queue_size": "NOTIFICATION_QUEUE_SIZE",
+	"notifications.workers":    "NOTIFICATION_WORKERS",
+
+	"sends.max_in_flight": "SEND_MAX_IN_FLIGHT",
+	"sends.max_queued":    "SEND_MAX_QUEUED",
+	"sends.queue_timeout": "SEND_QUEUE_TIMEOUT",
+
+	"stats_cache.ttl":         "STATS_CACHE_TTL",
+	"stats_cache.max_entries": "STATS_CACHE_MAX_ENTRIES",
+
+	"audit.file":        "AUDIT_LOG_FILE",
+	"audit.max_entries": "AUDIT_MAX_ENTRIES",
+	"audit.signing_key": "AUDIT_SIGNING_KEY",
+	"audit.data_access": "AUDIT_DATA_ACCESS",
+
+	"suppression.file": "SUPPRESSION_FILE",
+
+	"webhooks.urls":                   "WEBHOOK_URLS",
+	"webhooks.secrets":                "WEBHOOK_SECRETS",
+	"webhooks.tenants":                "WEBHOOK_TENANTS",
+	"webhooks.timeout":                "WEBHOOK_TIMEOUT",
+	"webhooks.allow_private_networks": "WEBHOOK_ALLOW_PRIVATE_NETWORKS",
+
+	"deliverability.guard":          "DELIVERABILITY_GUARD",
+	"deliverability.dkim_selectors": "DELIVERABILITY_DKIM_SELECTORS",
+	"deliverability.sending_ips":    "DELIVERABILITY_SENDING_IPS",
+	"deliverability.cache_ttl":      "DELIVERABILITY_CACHE_TTL",
+
+	"usage.file":                   "USAGE_FILE",
+	"usage.stripe_api_key":         "STRIPE_API_KEY",
+	"usage.stripe_meter_event":     "STRIPE_METER_EVENT",
+	"usage.stripe_meter_metric":    "STRIPE_METER_METRIC",
+	"usage.stripe_report_interval": "STRIPE_REPORT_INTERVAL",
+	"usage.stripe_api_url":         "STRIPE_API_URL",
+
+	"consent.file":        "CONSENT_FILE",
+	"consent.mode":        "CONSENT_MODE",
+	"consent.confirm_ttl": "CONSENT_CONFIRM_TTL",
+	"consent.subject":     "CONSENT_SUBJECT",
+
+	"contacts.file": "CONTACTS_FILE",
+
+	"segments.file": "SEGMENTS_FILE",
+
+	"tenants.file":       "TENANTS_FILE",
+	"tenants.secret_key": "TENANTS_SECRET_KEY",
+}
+
+// readFile parses a YAML, JSON or TOML config file, picked by its extension,
+// and returns its settings keyed by environment variable name. Files ending
+// in .age are decrypted first, e.g. config.yaml.age.
+func readFile(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	name := path
+	if isEncrypted(path) {
+		if data, err = decrypt(data); err != nil {
+			return nil, fmt.Errorf("decrypt %s: %w", path, err)
+		}
+		name = strings.TrimSuffix(path, filepath.Ext(path))
+	}
+
+	var doc map[string]interface{}
+	switch ext := strings.ToLower(filepath.Ext(name)); ext {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &doc)
+	case ".json":
+		err = json.Unmarshal(data, &doc)
+	case ".toml":
+		err = toml.Unmarshal(data, &doc)
+	default:
+		return nil, fmt.Errorf("unsupported config file extension %q (use .yaml, .yml, .json or .toml)", ext)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+
+	flat := make(map[string]string)
+	if err := flatten("", doc, flat); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	values := make(map[string]string, len(flat))
+	var unknown []string
+	for key, val := range flat {
+		env, ok := fileKeys[key]
+		if !ok {
+			unknown = append(unknown, key)
+			continue
+		}
+		values[env] = val
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return nil, fmt.Errorf("%s: unknown settings: %s", path, strings.Join(unknown, ", "))
+	}
+	return values, nil
+}
+
+// overlayPath names the environment-specific file layered over path, e.g.
+// config.production.yaml for config.yaml and config.production.yaml.age for
+// config.yaml.age.
+func overlayPath(path, env string) string {
+	suffix := ""
+	if isEncrypted(path) {
+		suffix = filepath.Ext(path)
+		path = strings.TrimSuffix(path, suffix)
+	}
+	ext := filepath.Ext(path)
+	return strings.TrimSuffix(path, ext) + "." + env + ext + suffix
+}
+
+// flatten turns nested sections into dotted keys and scalar values into the
+// strings the env helpers parse. Lists become comma-separated.
+func flatten(prefix string, node map[string]interface{}, out map[string]string) error {
+	for key, val := range node {
+		path := strings.ToLower(key)
+		if prefix != "" {
+			path = prefix + "." + path
+		}
+
+		if section, ok := val.(map[string]interface{}); ok {
+			if err := flatten(path, section, out); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if list, ok := val.([]interface{}); ok {
+			items := make([]string, 0, len(list))
+			for _, item := range list {
+				s, err := scalar(path, item)
+				if err != nil {
+					return err
+				}
+				items = append(items, s)
+			}
+			out[path] = strings.Join(items, ",")
+			continue
+		}
+
+		s, err := scalar(path, val)
+		if err != nil {
+			return err
+		}
+		out[path] = s
+	}
+	return nil
+}
+
+func scalar(path string, val interface{}) (string, error) {
+	switch v := val.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return v, nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	case int:
+		return strconv.Itoa(v), nil
+	case int64:
+		return strconv.FormatInt(v, 10), nil
+	case uint64:
+		return strconv.FormatUint(v, 10), nil
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	default:
+		return "", fmt.Errorf("%s: unsupported value %v", path, val)
+	}
+}
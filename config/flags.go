@@ -0,0 +1,60 @@
+package config
+
+import (
+	"flag"
+	"fmt"
+	"os"
+)
+
+// Options says where LoadConfig reads from beyond the environment.
+type Options struct {
+	// File is the config file path. CONFIG_FILE is used when empty.
+	File string
+	// Overrides holds values given on the command line, keyed by env var
+	// name. They take precedence over everything else.
+	Overrides map[string]string
+}
+
+// flagKeys maps each command-line flag to the env var it overrides.
+var flagKeys = []struct {
+	name, env, usage string
+}{
+	{"port", "PORT", "port to listen on"},
+	{"host", "HOST", "host to listen on"},
+	{"env", "APP_ENV", "environment (development or production)"},
+	{"base-url", "BASE_URL", "public URL used in tracking links"},
+	{"assets-dir", "ASSETS_DIR", "directory overriding the embedded templates and static files"},
+	{"smtp-host", "SMTP_HOST", "SMTP server host"},
+	{"smtp-port", "SMTP_PORT", "SMTP server port"},
+	{"redis", "REDIS_ENABLED", "enable Redis-backed counters (true or false)"},
+}
+
+// ParseFlags reads --config and the per-setting override flags from args
+// (without the program name). Only flags actually given become overrides,
+// so unset flags never mask the file or environment.
+func ParseFlags(args []string) (Options, error) {
+	fs := flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	file := fs.String("config", "", "config file (YAML, JSON or TOML); defaults to $CONFIG_FILE")
+
+	values := make(map[string]*string, len(flagKeys))
+	for _, f := range flagKeys {
+		values[f.name] = fs.String(f.name, "", fmt.Sprintf("%s (overrides %s)", f.usage, f.env))
+	}
+
+	if err := fs.Parse(args); err != nil {
+		return Options{}, err
+	}
+	if fs.NArg() > 0 {
+		return Options{}, fmt.Errorf("unexpected arguments: %v", fs.Args())
+	}
+
+	opts := Options{File: *file, Overrides: make(map[string]string)}
+	fs.Visit(func(f *flag.Flag) {
+		for _, key := range flagKeys {
+			if key.name == f.Name {
+				opts.Overrides[key.env] = *values[f.Name]
+			}
+		}
+	})
+	return opts, nil
+}
@@ -0,0 +1,249 @@
+package config
+
+import (
+	"strings"
+	"time"
+
+	"github.com/goccy/go-yaml"
+)
+
+// redacted replaces secret values in printed configs
+const redacted = "[redacted]"
+
+// secretKeys are the settings whose values are never printed
+var secretKeys = map[string]bool{
+	"SMTP_PASSWORD":             true,
+	"REDIS_PASSWORD":            true,
+	"GEO_API_KEY":               true,
+	"RESEND_API":                true,
+	"TRACKING_SIGNATURE_SECRET": true,
+	"TRACKING_HASH_SALT":        true,
+	"GEO_IPAPI_API_KEY":         true,
+	"GEO_IPINFO_API_KEY":        true,
+	"GEO_IPSTACK_API_KEY":       true,
+	"AUDIT_SIGNING_KEY":         true,
+	"TENANTS_SECRET_KEY":        true,
+	"STRIPE_API_KEY":            true,
+}
+
+// values returns the config's settings keyed by env var name. Shorthands
+// like RETENTION_MAX_AGE are left out in favor of what they expand to.
+func (c *Config) values() map[string]interface{} {
+	d := func(v time.Duration) string { return v.String() }
+	return map[string]interface{}{
+		"PORT":            c.Server.Port,
+		"HOST":            c.Server.Host,
+		"TRUSTED_PROXIES": c.Server.TrustedProxies,
+
+		"TLS_CERT_FILE":          c.TLS.CertFile,
+		"TLS_KEY_FILE":           c.TLS.KeyFile,
+		"TLS_AUTOCERT_DOMAINS":   c.TLS.AutocertDomains,
+		"TLS_AUTOCERT_EMAIL":     c.TLS.AutocertEmail,
+		"TLS_AUTOCERT_CACHE_DIR": c.TLS.AutocertCacheDir,
+		"TLS_HTTP_PORT":          c.TLS.HTTPPort,
+
+		"APP_ENV":     c.App.Env,
+		"BASE_URL":    c.App.BaseURL,
+		"TRACKING_ID": c.App.TrackingID,
+		"ASSETS_DIR":  c.App.AssetsDir,
+
+		"SMTP_HOST":        c.SMTP.Host,
+		"SMTP_PORT":        c.SMTP.Port,
+		"SMTP_USER":        c.SMTP.Username,
+		"SMTP_PASSWORD":    c.SMTP.Password,
+		"SMTP_FROM":        c.SMTP.From,
+		"SMTP_MAX_RETRIES": c.SMTP.MaxRetries,
+		"SMTP_WORKERS":     c.SMTP.Workers,
+		"SMTP_QUEUE_SIZE":  c.SMTP.QueueSize,
+
+		"REDIS_ENABLED":  c.Redis.Enabled,
+		"REDIS_HOST":     c.Redis.Host,
+		"REDIS_PORT":     c.Redis.Port,
+		"REDIS_PASSWORD": c.Redis.Password,
+		"REDIS_DB":       c.Redis.DB,
+
+		"CLUSTER_ENABLED":     c.Cluster.Enabled,
+		"CLUSTER_INSTANCE_ID": c.Cluster.InstanceID,
+
+		"HTTP_CLIENT_TIMEOUT":           d(c.HTTPClient.Timeout),
+		"HTTP_CLIENT_MAX_IDLE_PER_HOST": c.HTTPClient.MaxIdlePerHost,
+		"HTTP_CLIENT_IDLE_TIMEOUT":      d(c.HTTPClient.IdleTimeout),
+
+		"BREAKER_FAILURE_THRESHOLD": c.Breakers.Threshold,
+		"BREAKER_COOLDOWN":          d(c.Breakers.Cooldown),
+
+		"GEO_PROVIDER":  c.GeoAPI.Provider,
+		"GEO_PROVIDERS": c.GeoAPI.Providers,
+		"GEO_API_KEY":   c.GeoAPI.APIKey,
+		"GEO_URL":       c.GeoAPI.URL,
+
+		"GEO_IPAPI_URL":          c.GeoAPI.IPAPI.URL,
+		"GEO_IPAPI_API_KEY":      c.GeoAPI.IPAPI.APIKey,
+		"GEO_IPAPI_RATE_LIMIT":   c.GeoAPI.IPAPI.RateLimit,
+		"GEO_IPINFO_URL":         c.GeoAPI.IPInfo.URL,
+		"GEO_IPINFO_API_KEY":     c.GeoAPI.IPInfo.APIKey,
+		"GEO_IPINFO_RATE_LIMIT":  c.GeoAPI.IPInfo.RateLimit,
+		"GEO_IPSTACK_URL":        c.GeoAPI.IPStack.URL,
+		"GEO_IPSTACK_API_KEY":    c.GeoAPI.IPStack.APIKey,
+		"GEO_IPSTACK_RATE_LIMIT": c.GeoAPI.IPStack.RateLimit,
+
+		"GEO_MAXMIND_DB":              c.GeoAPI.MaxMindDB,
+		"GEO_MAXMIND_RELOAD_INTERVAL": d(c.GeoAPI.ReloadInterval),
+		"GEO_CACHE_SIZE":              c.GeoAPI.CacheSize,
+		"GEO_CACHE_TTL":               d(c.GeoAPI.CacheTTL),
+		"GEO_NETWORK_LOOKUP":          c.GeoAPI.NetworkLookup,
+		"GEO_ASN_DB":                  c.GeoAPI.ASNDB,
+		"GEO_QUEUE_SIZE":              c.GeoAPI.QueueSize,
+
+		"RESEND_API": c.ExternalAPI.Resend,
+
+		"AUTH_USERS":        redactEntries(c.Auth.Users),
+		"API_KEYS":          redactEntries(c.Auth.APIKeys),
+		"AUTH_ADMINS":       c.Auth.Admins,
+		"AUTH_ROLES":        c.Auth.Roles,
+		"AUTH_TENANTS":      c.Auth.Tenants,
+		"AUTH_DEFAULT_ROLE": c.Auth.DefaultRole,
+		"SESSION_TTL":       d(c.Auth.SessionTTL),
+
+		"REPORT_FREQUENCY":  c.Reports.Frequency,
+		"REPORT_RECIPIENTS": c.Reports.Recipients,
+
+		"SCAN_ALERT_EMAIL":     c.Security.ScanAlertEmail,
+		"SCAN_ALERT_THRESHOLD": c.Security.ScanAlertThreshold,
+		"SCAN_ALERT_WINDOW":    d(c.Security.ScanAlertWindow),
+		"SCAN_RATE_LIMIT":      c.Security.ScanRateLimit,
+		"SCAN_BAN_DURATION":    d(c.Security.ScanBanDuration),
+		"SCAN_EXEMPT_IPS":      c.Security.ScanExemptIPs,
+
+		"SECURITY_HSTS_MAX_AGE":    d(c.Security.HSTSMaxAge),
+		"SECURITY_FRAME_OPTIONS":   c.Security.FrameOptions,
+		"SECURITY_REFERRER_POLICY": c.Security.ReferrerPolicy,
+		"SECURITY_MAX_BODY_SIZE":   c.Security.MaxBodySize,
+		"SECURITY_ALLOWED_METHODS": c.Security.AllowedMethods,
+
+		"SECRETS_REFRESH_INTERVAL": d(c.Secrets.RefreshInterval),
+
+		"TRACKING_PIXEL_PATH":          c.Tracking.PixelPath,
+		"TRACKING_DEDUP_WINDOW":        d(c.Tracking.DedupWindow),
+		"TRACKING_BOT_FILTERING":       c.Tracking.BotFiltering,
+		"TRACKING_SIGNATURE_SECRET":    c.Tracking.SignatureSecret,
+		"TRACKING_IP_MODE":             c.Tracking.IPMode,
+		"TRACKING_HASH_SALT":           c.Tracking.HashSalt,
+		"TRACKING_STORE_USER_AGENT":    c.Tracking.StoreUserAgent,
+		"TRACKING_MAX_ENTRIES":         c.Tracking.MaxEntries,
+		"TRACKING_STORE_UNKNOWN_OPENS": c.Tracking.StoreUnknownOpens,
+
+		"RETENTION_INTERVAL":      d(c.Retention.Interval),
+		"RETENTION_EMAIL_MAX_AGE": d(c.Retention.EmailMaxAge),
+		"RETENTION_EVENT_MAX_AGE": d(c.Retention.EventMaxAge),
+
+		"SMTP_TIMEOUT":         d(c.Timeouts.SMTP),
+		"GEO_TIMEOUT":          d(c.Timeouts.Geo),
+		"NOTIFICATION_TIMEOUT": d(c.Timeouts.Notification),
+		"HTTP_READ_TIMEOUT":    d(c.Timeouts.HTTPRead),
+		"HTTP_WRITE_TIMEOUT":   d(c.Timeouts.HTTPWrite),
+		"HTTP_IDLE_TIMEOUT":    d(c.Timeouts.HTTPIdle),
+		"SHUTDOWN_TIMEOUT":     d(c.Timeouts.Shutdown),
+		"SHUTDOWN_DRAIN_DELAY": d(c.Timeouts.ShutdownDrain),
+
+		"LOG_LEVEL":  c.Log.Level,
+		"LOG_FORMAT": c.Log.Format,
+
+		"ACCESS_LOG_FORMAT":      c.AccessLog.Format,
+		"ACCESS_LOG_SAMPLE_RATE": c.AccessLog.SampleRate,
+		"ACCESS_LOG_SKIP_PATHS":  c.AccessLog.SkipPaths,
+
+		"EVENT_STORE_FILE":     c.Storage.EventsFile,
+		"EVENT_BATCH_SIZE":     c.Storage.BatchSize,
+		"EVENT_FLUSH_INTERVAL": d(c.Storage.FlushInterval),
+		"EVENT_QUEUE_SIZE":     c.Storage.QueueSize,
+
+		"NOTIFICATION_QUEUE_SIZE": c.Notifications.QueueSize,
+		"NOTIFICATION_WORKERS":    c.Notifications.Workers,
+
+		"SEND_MAX_IN_FLIGHT": c.Sends.MaxInFlight,
+		"SEND_MAX_QUEUED":    c.Sends.MaxQueued,
+		"SEND_QUEUE_TIMEOUT": d(c.Sends.QueueTimeout),
+
+		"STATS_CACHE_TTL":         d(c.StatsCache.TTL),
+		"STATS_CACHE_MAX_ENTRIES": c.StatsCache.MaxEntries,
+
+		"AUDIT_LOG_FILE":    c.Audit.File,
+		"AUDIT_MAX_ENTRIES": c.Audit.MaxEntries,
+		"AUDIT_SIGNING_KEY": c.Audit.SigningKey,
+		"AUDIT_DATA_ACCESS": c.Audit.DataAccess,
+
+		"SUPPRESSION_FILE": c.Suppression.File,
+
+		"WEBHOOK_URLS":                   c.Webhooks.URLs,
+		"WEBHOOK_SECRETS":                redactEntries(c.Webhooks.Secrets),
+		"WEBHOOK_TENANTS":                c.Webhooks.Tenants,
+		"WEBHOOK_TIMEOUT":                d(c.Webhooks.Timeout),
+		"WEBHOOK_ALLOW_PRIVATE_NETWORKS": c.Webhooks.AllowPrivate,
+
+		"DELIVERABILITY_GUARD":          c.Deliverability.Guard,
+		"DELIVERABILITY_DKIM_SELECTORS": c.Deliverability.DKIMSelectors,
+		"DELIVERABILITY_SENDING_IPS":    c.Deliverability.SendingIPs,
+		"DELIVERABILITY_CACHE_TTL":      d(c.Deliverability.CacheTTL),
+
+		"CONSENT_FILE":        c.Consent.File,
+		"CONSENT_MODE":        c.Consent.Mode,
+		"CONSENT_CONFIRM_TTL": d(c.Consent.ConfirmTTL),
+		"CONSENT_SUBJECT":     c.Consent.Subject,
+
+		"CONTACTS_FILE": c.Contacts.File,
+
+		"SEGMENTS_FILE": c.Segments.File,
+
+		"TENANTS_FILE":       c.Tenants.File,
+		"TENANTS_SECRET_KEY": c.Tenants.SecretKey,
+
+		"USAGE_FILE":             c.Usage.File,
+		"STRIPE_API_KEY":         c.Usage.StripeAPIKey,
+		"STRIPE_METER_EVENT":     c.Usage.StripeMeterEvent,
+		"STRIPE_METER_METRIC":    c.Usage.StripeMetric,
+		"STRIPE_REPORT_INTERVAL": d(c.Usage.StripeInterval),
+		"STRIPE_API_URL":         c.Usage.StripeAPIURL,
+	}
+}
+
+// redactEntries hides the secret half of name:secret entries
+func redactEntries(entries []string) []string {
+	out := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		name, _, _ := strings.Cut(entry, ":")
+		out = append(out, name+":"+redacted)
+	}
+	return out
+}
+
+// Redacted renders the effective config as a YAML config file with secrets
+// replaced, e.g. for "config print".
+func (c *Config) Redacted() ([]byte, error) {
+	values := c.values()
+
+	doc := make(map[string]interface{})
+	for fileKey, env := range fileKeys {
+		val, ok := values[env]
+		if !ok {
+			continue
+		}
+		if s, ok := val.(string); ok && s != "" && secretKeys[env] {
+			val = redacted
+		}
+
+		// Rebuild the sections, e.g. geo_api.ipinfo.url
+		parts := strings.Split(fileKey, ".")
+		section := doc
+		for _, part := range parts[:len(parts)-1] {
+			next, ok := section[part].(map[string]interface{})
+			if !ok {
+				next = make(map[string]interface{})
+				section[part] = next
+			}
+			section = next
+		}
+		section[parts[len(parts)-1]] = val
+	}
+	return yaml.Marshal(doc)
+}
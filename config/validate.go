@@ -0,0 +1,287 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+
+	"email-tracker/audit"
+	"email-tracker/models"
+
+	"filippo.io/age"
+)
+
+// Validate reports every setting that is missing or malformed, so a deploy
+// can be stopped before the server starts with a broken config.
+func (c *Config) Validate() error {
+	var errs []error
+	fail := func(format string, args ...interface{}) {
+		errs = append(errs, fmt.Errorf(format, args...))
+	}
+
+	if port, err := strconv.Atoi(c.Server.Port); err != nil || port < 1 || port > 65535 {
+		fail("PORT %q is not a valid port", c.Server.Port)
+	}
+	if (c.TLS.CertFile == "") != (c.TLS.KeyFile == "") {
+		fail("TLS_CERT_FILE and TLS_KEY_FILE must be set together")
+	}
+	if c.TLS.CertFile != "" && len(c.TLS.AutocertDomains) > 0 {
+		fail("TLS_CERT_FILE and TLS_AUTOCERT_DOMAINS can't both be set")
+	}
+	if len(c.TLS.AutocertDomains) > 0 && c.TLS.AutocertCacheDir == "" {
+		fail("TLS_AUTOCERT_CACHE_DIR is required with TLS_AUTOCERT_DOMAINS, or every restart requests new certificates")
+	}
+	if c.TLS.HTTPPort != "" {
+		if port, err := strconv.Atoi(c.TLS.HTTPPort); err != nil || port < 1 || port > 65535 {
+			fail("TLS_HTTP_PORT %q is not a valid port", c.TLS.HTTPPort)
+		} else if c.TLS.HTTPPort == c.Server.Port {
+			fail("TLS_HTTP_PORT must differ from PORT")
+		}
+		if !c.TLSEnabled() {
+			fail("TLS_HTTP_PORT needs TLS_CERT_FILE or TLS_AUTOCERT_DOMAINS")
+		}
+	}
+	if c.App.Env != "development" && c.App.Env != "production" {
+		fail("APP_ENV %q must be development or production", c.App.Env)
+	}
+	switch c.Log.Level {
+	case "debug", "info", "warn", "error":
+	default:
+		fail("LOG_LEVEL %q must be debug, info, warn or error", c.Log.Level)
+	}
+	if c.Log.Format != "json" && c.Log.Format != "text" {
+		fail("LOG_FORMAT %q must be json or text", c.Log.Format)
+	}
+	switch c.AccessLog.Format {
+	case "json", "apache", "off":
+	default:
+		fail("ACCESS_LOG_FORMAT %q must be json, apache or off", c.AccessLog.Format)
+	}
+	if c.AccessLog.SampleRate < 0 || c.AccessLog.SampleRate > 1 {
+		fail("ACCESS_LOG_SAMPLE_RATE must be between 0 and 1")
+	}
+	if c.Tracking.MaxEntries < 0 {
+		fail("TRACKING_MAX_ENTRIES must not be negative")
+	}
+	if c.Storage.BatchSize < 1 {
+		fail("EVENT_BATCH_SIZE must be at least 1")
+	}
+	if c.Storage.QueueSize < 1 {
+		fail("EVENT_QUEUE_SIZE must be at least 1")
+	}
+	if c.Notifications.QueueSize < 1 {
+		fail("NOTIFICATION_QUEUE_SIZE must be at least 1")
+	}
+	if c.Notifications.Workers < 1 {
+		fail("NOTIFICATION_WORKERS must be at least 1")
+	}
+	if c.Sends.MaxInFlight < 1 {
+		fail("SEND_MAX_IN_FLIGHT must be at least 1")
+	}
+	if c.Sends.MaxQueued < 0 {
+		fail("SEND_MAX_QUEUED must not be negative")
+	}
+	if c.StatsCache.TTL < 0 {
+		fail("STATS_CACHE_TTL must not be negative")
+	}
+	if c.StatsCache.MaxEntries < 1 {
+		fail("STATS_CACHE_MAX_ENTRIES must be at least 1")
+	}
+	if c.Audit.MaxEntries < 0 {
+		fail("AUDIT_MAX_ENTRIES must not be negative")
+	}
+	if c.Audit.SigningKey != "" {
+		if _, err := audit.ParseSigningKey(c.Audit.SigningKey); err != nil {
+			fail("AUDIT_SIGNING_KEY: %v", err)
+		}
+	}
+	if c.App.BaseURL != "" {
+		if u, err := url.Parse(c.App.BaseURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			fail("BASE_URL %q must be an absolute http(s) URL", c.App.BaseURL)
+		}
+	} else if c.App.Env == "production" {
+		fail("BASE_URL must be set in production so tracking links point at the public host")
+	}
+
+	if c.SMTP.Host == "" {
+		fail("SMTP_HOST is required")
+	}
+	if c.SMTP.Port < 1 || c.SMTP.Port > 65535 {
+		fail("SMTP_PORT %d is not a valid port", c.SMTP.Port)
+	}
+	if _, err := mail.ParseAddress(c.SMTP.From); err != nil {
+		fail("SMTP_FROM %q is not a valid address", c.SMTP.From)
+	}
+	if (c.SMTP.Username == "") != (c.SMTP.Password == "") {
+		fail("SMTP_USER and SMTP_PASSWORD must be set together")
+	}
+
+	if len(c.GeoAPI.Providers) == 0 {
+		fail("GEO_PROVIDERS must list at least one provider")
+	}
+	for _, provider := range c.GeoAPI.Providers {
+		switch provider {
+		case "ip-api", "ipinfo":
+		case "ipstack":
+			if c.GeoAPI.IPStack.APIKey == "" && (c.GeoAPI.APIKey == "" || c.GeoAPI.Provider != "ipstack") {
+				fail("GEO_IPSTACK_API_KEY is required to use ipstack (GEO_API_KEY only counts when GEO_PROVIDER is ipstack)")
+			}
+		case "maxmind":
+			if c.GeoAPI.MaxMindDB == "" {
+				fail("GEO_MAXMIND_DB is required to use maxmind")
+			}
+		default:
+			fail("geo provider %q must be ip-api, ipinfo, ipstack or maxmind", provider)
+		}
+	}
+
+	if c.Timeouts.ShutdownDrain < 0 {
+		fail("SHUTDOWN_DRAIN_DELAY must not be negative")
+	}
+	if c.SMTP.MaxRetries < 0 {
+		fail("SMTP_MAX_RETRIES must not be negative")
+	}
+	if c.SMTP.Workers < 1 {
+		fail("SMTP_WORKERS must be at least 1")
+	}
+	if c.SMTP.QueueSize < 0 {
+		fail("SMTP_QUEUE_SIZE must not be negative")
+	}
+
+	if c.Redis.Enabled && (c.Redis.Port < 1 || c.Redis.Port > 65535) {
+		fail("REDIS_PORT %d is not a valid port", c.Redis.Port)
+	}
+	if c.HTTPClient.MaxIdlePerHost < 0 {
+		fail("HTTP_CLIENT_MAX_IDLE_PER_HOST must not be negative")
+	}
+	if c.Breakers.Threshold < 0 {
+		fail("BREAKER_FAILURE_THRESHOLD must not be negative")
+	}
+	if c.Cluster.Enabled && !c.Redis.Enabled {
+		fail("CLUSTER_ENABLED needs REDIS_ENABLED, instances share state through Redis")
+	}
+
+	for _, entry := range c.Auth.Users {
+		if name, hash, ok := strings.Cut(entry, ":"); !ok || name == "" || hash == "" {
+			fail("AUTH_USERS entry for %q must be name:bcrypt-hash", name)
+		}
+	}
+	for _, entry := range c.Auth.APIKeys {
+		if name, key, ok := strings.Cut(entry, ":"); !ok || name == "" || key == "" {
+			fail("API_KEYS entry for %q must be name:key", name)
+		}
+	}
+
+	for _, entry := range c.Auth.Roles {
+		name, role, ok := strings.Cut(entry, ":")
+		if !ok || name == "" || (role != "viewer" && role != "sender" && role != "admin") {
+			fail("AUTH_ROLES entry for %q must be name:viewer, name:sender or name:admin", name)
+		}
+	}
+	for _, entry := range c.Auth.Tenants {
+		if name, tenant, ok := strings.Cut(entry, ":"); !ok || name == "" || !models.ValidTenantID(tenant) {
+			fail("AUTH_TENANTS entry for %q must be name:tenant, the tenant in lowercase letters, digits, - and _", name)
+		}
+	}
+
+	webhookSecrets := make(map[string]bool)
+	for _, entry := range c.Webhooks.Secrets {
+		name, secret, ok := strings.Cut(entry, ":")
+		if !ok || name == "" || secret == "" {
+			fail("WEBHOOK_SECRETS entry for %q must be name:secret", name)
+		}
+		webhookSecrets[name] = true
+	}
+	for _, entry := range c.Webhooks.URLs {
+		name, rawURL, ok := strings.Cut(entry, "=")
+		if u, err := url.Parse(rawURL); !ok || name == "" || err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			fail("WEBHOOK_URLS entry for %q must be name=http(s) URL", name)
+			continue
+		}
+		if !webhookSecrets[name] {
+			fail("webhook %q has no secret in WEBHOOK_SECRETS", name)
+		}
+	}
+	for _, entry := range c.Webhooks.Tenants {
+		if name, tenant, ok := strings.Cut(entry, ":"); !ok || name == "" || !models.ValidTenantID(tenant) {
+			fail("WEBHOOK_TENANTS entry for %q must be name:tenant, the tenant in lowercase letters, digits, - and _", name)
+		}
+	}
+
+	for _, ip := range c.Deliverability.SendingIPs {
+		if net.ParseIP(ip) == nil {
+			fail("DELIVERABILITY_SENDING_IPS entry %q is not an IP address", ip)
+		}
+	}
+	if c.Deliverability.Guard == "strict" && len(c.Deliverability.DKIMSelectors) == 0 {
+		fail("DELIVERABILITY_GUARD=strict needs DELIVERABILITY_DKIM_SELECTORS, or DKIM can't be checked")
+	}
+	if strings.TrimSpace(c.Consent.Subject) == "" {
+		fail("CONSENT_SUBJECT must not be empty")
+	}
+	if c.Tenants.SecretKey != "" {
+		if _, err := age.ParseX25519Identity(c.Tenants.SecretKey); err != nil {
+			fail("TENANTS_SECRET_KEY must be an age identity from age-keygen: %v", err)
+		}
+	}
+	switch c.Usage.StripeMetric {
+	case "emails", "recipients", "opens", "clicks":
+	default:
+		fail("STRIPE_METER_METRIC %q must be emails, recipients, opens or clicks", c.Usage.StripeMetric)
+	}
+	if c.Usage.StripeAPIKey != "" && c.Usage.StripeMeterEvent == "" {
+		fail("STRIPE_API_KEY is set but STRIPE_METER_EVENT is empty")
+	}
+	if u, err := url.Parse(c.Usage.StripeAPIURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		fail("STRIPE_API_URL %q must be an http(s) URL", c.Usage.StripeAPIURL)
+	}
+
+	if c.Reports.Frequency != "" && len(c.Reports.Recipients) == 0 {
+		fail("REPORT_FREQUENCY is set but REPORT_RECIPIENTS is empty")
+	}
+	for _, recipient := range c.Reports.Recipients {
+		if _, err := mail.ParseAddress(recipient); err != nil {
+			fail("REPORT_RECIPIENTS entry %q is not a valid address", recipient)
+		}
+	}
+	if c.Security.ScanAlertEmail != "" {
+		if _, err := mail.ParseAddress(c.Security.ScanAlertEmail); err != nil {
+			fail("SCAN_ALERT_EMAIL %q is not a valid address", c.Security.ScanAlertEmail)
+		}
+	}
+	if c.Security.ScanAlertThreshold < 1 {
+		fail("SCAN_ALERT_THRESHOLD must be at least 1")
+	}
+	if c.Security.ScanRateLimit < 0 {
+		fail("SCAN_RATE_LIMIT must not be negative")
+	}
+	if c.Security.ScanBanDuration < 0 {
+		fail("SCAN_BAN_DURATION must not be negative")
+	}
+	if c.Security.HSTSMaxAge < 0 {
+		fail("SECURITY_HSTS_MAX_AGE must not be negative")
+	}
+	if f := c.Security.FrameOptions; f != "" && f != "DENY" && f != "SAMEORIGIN" {
+		fail("SECURITY_FRAME_OPTIONS must be DENY, SAMEORIGIN or empty, got %q", f)
+	}
+	switch c.Security.ReferrerPolicy {
+	case "", "no-referrer", "no-referrer-when-downgrade", "origin", "origin-when-cross-origin",
+		"same-origin", "strict-origin", "strict-origin-when-cross-origin", "unsafe-url":
+	default:
+		fail("SECURITY_REFERRER_POLICY %q is not a referrer policy", c.Security.ReferrerPolicy)
+	}
+	if c.Security.MaxBodySize < 1 {
+		fail("SECURITY_MAX_BODY_SIZE must be at least 1")
+	}
+	if !slices.Contains(c.Security.AllowedMethods, http.MethodGet) || !slices.Contains(c.Security.AllowedMethods, http.MethodPost) {
+		fail("SECURITY_ALLOWED_METHODS must include GET and POST, which pixels, links and the API need")
+	}
+
+	return errors.Join(errs...)
+}
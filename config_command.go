@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"email-tracker/config"
+	"email-tracker/geo"
+	"email-tracker/httpclient"
+	"email-tracker/notification"
+	"email-tracker/secrets"
+	"email-tracker/web"
+)
+
+// geoCheckIP is looked up to see whether the geo provider answers
+const geoCheckIP = "8.8.8.8"
+
+// runConfigCommand handles "config check" and "config print" and returns the
+// process exit code.
+func runConfigCommand(args []string) int {
+	if len(args) == 0 || (args[0] != "check" && args[0] != "print") {
+		fmt.Fprintln(os.Stderr, "usage: email-tracker config check|print [flags]")
+		return 2
+	}
+
+	opts, err := config.ParseFlags(args[1:])
+	if err != nil {
+		return 2
+	}
+
+	if args[0] == "print" {
+		return printConfig(opts)
+	}
+	return checkConfig(opts)
+}
+
+// printConfig dumps the effective config, after merging the file, env vars
+// and flags, with secrets redacted.
+func printConfig(opts config.Options) int {
+	cfg, err := config.LoadConfig(opts)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to load configuration: %v\n", err)
+		return 1
+	}
+
+	out, err := cfg.Redacted()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to render configuration: %v\n", err)
+		return 1
+	}
+	os.Stdout.Write(out)
+	return 0
+}
+
+// checkConfig loads and validates the config, then tries SMTP and the geo
+// provider. It prints one line per check and fails if any check fails.
+func checkConfig(opts config.Options) int {
+	failed := false
+	report := func(name string, err error) {
+		if err != nil {
+			failed = true
+			fmt.Printf("✗ %s: %v\n", name, err)
+			return
+		}
+		fmt.Printf("✓ %s\n", name)
+	}
+
+	raw, err := config.LoadConfig(opts)
+	report("load configuration", err)
+	if err != nil {
+		return 1
+	}
+
+	cfg, err := resolveSecrets(secrets.NewResolver(), raw)
+	report("resolve secrets", err)
+	if err != nil {
+		return 1
+	}
+
+	report("validate settings", cfg.Validate())
+
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.Timeouts.SMTP)
+	defer cancel()
+	templates, err := web.Templates(cfg.App.AssetsDir)
+	report("load templates", err)
+
+	report(fmt.Sprintf("SMTP %s:%d", cfg.SMTP.Host, cfg.SMTP.Port), notification.NewSender(cfg, templates).Check(ctx))
+
+	for _, name := range cfg.GeoAPI.Providers {
+		report("geo provider "+name, checkGeo(cfg, name))
+	}
+
+	if failed {
+		return 1
+	}
+	return 0
+}
+
+func checkGeo(cfg *config.Config, name string) error {
+	provider, err := geo.NewNamedProvider(cfg, httpclient.New(cfg), name)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.Timeouts.Geo)
+	defer cancel()
+
+	_, err = provider.Lookup(ctx, geoCheckIP)
+	return err
+}
@@ -0,0 +1,430 @@
+// Package consent keeps double opt-in records: who was asked to confirm a
+// subscription, and when and from where they confirmed it. Each tenant
+// keeps records of its own.
+package consent
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"email-tracker/config"
+	"email-tracker/logging"
+	"email-tracker/models"
+	"email-tracker/utils"
+)
+
+// Consent statuses
+const (
+	StatusPending   = "pending"
+	StatusConfirmed = "confirmed"
+	StatusWithdrawn = "withdrawn"
+)
+
+// Modes for marketing sends to contacts who haven't confirmed
+const (
+	ModeOff    = "off"
+	ModeWarn   = "warn"
+	ModeStrict = "strict"
+)
+
+var (
+	// ErrUnconfirmed matches, via errors.Is, marketing sends refused
+	// because a recipient hasn't confirmed
+	ErrUnconfirmed = errors.New("recipient has not confirmed consent")
+	// ErrInvalidToken is a confirm link that is unknown, used or expired
+	ErrInvalidToken = errors.New("confirmation link is invalid or has expired")
+)
+
+// Error is a marketing send refused for recipients without consent
+type Error struct {
+	Addresses []string
+}
+
+func (e *Error) Error() string {
+	return "recipients have not confirmed consent: " + strings.Join(e.Addresses, ", ")
+}
+
+func (e *Error) Is(target error) bool {
+	return target == ErrUnconfirmed
+}
+
+// Entry is the consent held for one address. A pending entry waits for
+// its confirm link to be followed until ExpiresAt.
+type Entry struct {
+	Tenant  string `json:"tenant"`
+	Address string `json:"email"`
+	Status  string `json:"status"`
+	// Source says where the address was collected, e.g. a signup form
+	Source           string     `json:"source,omitempty"`
+	RequestedAt      time.Time  `json:"requested_at"`
+	RequestIP        string     `json:"request_ip,omitempty"`
+	ExpiresAt        *time.Time `json:"expires_at,omitempty"`
+	ConfirmedAt      *time.Time `json:"confirmed_at,omitempty"`
+	ConfirmIP        string     `json:"confirm_ip,omitempty"`
+	ConfirmUserAgent string     `json:"confirm_user_agent,omitempty"`
+	WithdrawnAt      *time.Time `json:"withdrawn_at,omitempty"`
+}
+
+// record is a line of the consent file: an entry as it stands after a
+// change, with the hash of its pending confirm token, if any
+type record struct {
+	Entry
+	TokenHash string `json:"token_hash,omitempty"`
+}
+
+// key identifies an address among a tenant's records
+type key struct {
+	tenant, address string
+}
+
+func keyOf(tenant, address string) key {
+	return key{models.TenantOr(tenant), utils.NormalizeAddress(address)}
+}
+
+// settings are the ones that change on reload
+type settings struct {
+	mode       string
+	confirmTTL time.Duration
+	subject    string
+}
+
+// Store holds consent in memory and, when a file is configured, appends
+// every change to it as JSON Lines so it survives restarts. The last line
+// for an address wins.
+type Store struct {
+	mu       sync.RWMutex
+	records  map[key]*record
+	tokens   map[string]key
+	path     string
+	file     *os.File
+	settings atomic.Pointer[settings]
+}
+
+// Open loads consent from cfg's CONSENT_FILE and appends changes to it.
+// Without a file consent is only kept in memory.
+func Open(cfg *config.Config) (*Store, error) {
+	s := &Store{records: make(map[key]*record), tokens: make(map[string]key)}
+	s.ApplyConfig(cfg)
+	path := cfg.Consent.File
+	if path == "" {
+		return s, nil
+	}
+
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("open consent file: %w", err)
+	}
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var r record
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			file.Close()
+			return nil, fmt.Errorf("read consent file %s: %w", path, err)
+		}
+		s.apply(&r)
+	}
+	if err := scanner.Err(); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("read consent file %s: %w", path, err)
+	}
+
+	s.path = path
+	s.file = file
+	return s, nil
+}
+
+// ApplyConfig switches to new settings. Confirm links already sent keep
+// their expiry.
+func (s *Store) ApplyConfig(cfg *config.Config) {
+	s.settings.Store(&settings{mode: cfg.Consent.Mode, confirmTTL: cfg.Consent.ConfirmTTL, subject: cfg.Consent.Subject})
+}
+
+// Subject returns the subject of confirmation emails.
+func (s *Store) Subject() string {
+	return s.settings.Load().subject
+}
+
+// apply makes r the address's current record. Must be called with s.mu
+// held, or before the store is shared.
+func (s *Store) apply(r *record) {
+	// Records written before tenants belong to the default tenant
+	r.Tenant = models.TenantOr(r.Tenant)
+	k := keyOf(r.Tenant, r.Address)
+	if old, ok := s.records[k]; ok && old.TokenHash != "" {
+		delete(s.tokens, old.TokenHash)
+	}
+	s.records[k] = r
+	if r.TokenHash != "" {
+		s.tokens[r.TokenHash] = k
+	}
+}
+
+// write appends r to the file. Must be called with s.mu held.
+func (s *Store) write(r *record) error {
+	if s.file == nil {
+		return nil
+	}
+	line, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	if _, err := s.file.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("write consent file: %w", err)
+	}
+	return nil
+}
+
+// Request starts double opt-in for address with the tenant and returns the
+// token for its confirm link. A new request replaces the link sent before.
+// An address that already confirmed keeps its entry, which is returned
+// with an empty token.
+func (s *Store) Request(tenant, address, source, ip string) (Entry, string, error) {
+	k := keyOf(tenant, address)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if existing, ok := s.records[k]; ok && existing.Status == StatusConfirmed {
+		return existing.Entry, "", nil
+	}
+
+	token, err := newToken()
+	if err != nil {
+		return Entry{}, "", err
+	}
+	now := time.Now().UTC()
+	expires := now.Add(s.settings.Load().confirmTTL)
+	r := &record{
+		Entry: Entry{
+			Tenant:      k.tenant,
+			Address:     k.address,
+			Status:      StatusPending,
+			Source:      source,
+			RequestedAt: now,
+			RequestIP:   ip,
+			ExpiresAt:   &expires,
+		},
+		TokenHash: hashToken(token),
+	}
+	s.apply(r)
+	return r.Entry, token, s.write(r)
+}
+
+// Confirm records consent for the address token was sent to, with the IP
+// and user agent of whoever followed the link. Each token works once.
+func (s *Store) Confirm(token, ip, userAgent string) (Entry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	k, ok := s.tokens[hashToken(token)]
+	if !ok {
+		return Entry{}, ErrInvalidToken
+	}
+	now := time.Now().UTC()
+	pending := s.records[k]
+	if pending.ExpiresAt != nil && now.After(*pending.ExpiresAt) {
+		return Entry{}, ErrInvalidToken
+	}
+
+	r := &record{Entry: pending.Entry}
+	r.Status = StatusConfirmed
+	r.ExpiresAt = nil
+	r.ConfirmedAt = &now
+	r.ConfirmIP = ip
+	r.ConfirmUserAgent = userAgent
+	r.WithdrawnAt = nil
+	s.apply(r)
+	return r.Entry, s.write(r)
+}
+
+// Pending reports whether token is a live confirm link, so the page can
+// say so before anyone confirms
+func (s *Store) Pending(token string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	k, ok := s.tokens[hashToken(token)]
+	if !ok {
+		return false
+	}
+	expires := s.records[k].ExpiresAt
+	return expires == nil || time.Now().Before(*expires)
+}
+
+// Withdraw records that address took back its consent with the tenant,
+// reporting whether there was an entry.
+func (s *Store) Withdraw(tenant, address string) (Entry, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	existing, ok := s.records[keyOf(tenant, address)]
+	if !ok {
+		return Entry{}, false, nil
+	}
+	now := time.Now().UTC()
+	r := &record{Entry: existing.Entry}
+	r.Status = StatusWithdrawn
+	r.ExpiresAt = nil
+	r.WithdrawnAt = &now
+	s.apply(r)
+	return r.Entry, true, s.write(r)
+}
+
+// Get returns the tenant's entry for address, if there is one.
+func (s *Store) Get(tenant, address string) (Entry, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	r, ok := s.records[keyOf(tenant, address)]
+	if !ok {
+		return Entry{}, false
+	}
+	return r.Entry, true
+}
+
+// List returns the tenant's entries with the given status, or all of them
+// when status is empty, most recently requested first.
+func (s *Store) List(tenant, status string) []Entry {
+	tenant = models.TenantOr(tenant)
+
+	s.mu.RLock()
+	list := make([]Entry, 0)
+	for k, r := range s.records {
+		if k.tenant == tenant && (status == "" || r.Status == status) {
+			list = append(list, r.Entry)
+		}
+	}
+	s.mu.RUnlock()
+
+	sort.Slice(list, func(i, j int) bool { return list[i].RequestedAt.After(list[j].RequestedAt) })
+	return list
+}
+
+// Guard checks the recipients of a tenant's marketing send against the
+// tenant's records. Off, it does nothing;
+// in warn mode recipients who haven't confirmed are logged; in strict mode
+// the send is refused with an *Error listing them.
+func (s *Store) Guard(tenant string, addresses []string) error {
+	mode := s.settings.Load().mode
+	if mode == ModeOff || mode == "" {
+		return nil
+	}
+
+	var unconfirmed []string
+	s.mu.RLock()
+	for _, address := range addresses {
+		if r, ok := s.records[keyOf(tenant, address)]; !ok || r.Status != StatusConfirmed {
+			unconfirmed = append(unconfirmed, address)
+		}
+	}
+	s.mu.RUnlock()
+
+	if len(unconfirmed) == 0 {
+		return nil
+	}
+	if mode == ModeStrict {
+		return &Error{Addresses: unconfirmed}
+	}
+	slog.Warn("marketing send to recipients without confirmed consent",
+		"recipient_hash", logging.RecipientHash(strings.Join(unconfirmed, ",")))
+	return nil
+}
+
+// Erase forgets the tenant's record of address, rewriting the file without it so its IPs and
+// timestamps don't linger, and reports whether there was an entry. The
+// file is rewritten alongside and renamed over the old one.
+func (s *Store) Erase(tenant, address string) (bool, error) {
+	k := keyOf(tenant, address)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r, ok := s.records[k]
+	if !ok {
+		return false, nil
+	}
+	delete(s.records, k)
+	if r.TokenHash != "" {
+		delete(s.tokens, r.TokenHash)
+	}
+	if s.file == nil {
+		return true, nil
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".*")
+	if err != nil {
+		return true, fmt.Errorf("rewrite consent file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	out := bufio.NewWriter(tmp)
+	for _, r := range s.records {
+		line, err := json.Marshal(r)
+		if err != nil {
+			return true, err
+		}
+		out.Write(append(line, '\n'))
+	}
+	if err := out.Flush(); err != nil {
+		return true, fmt.Errorf("rewrite consent file: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		return true, fmt.Errorf("rewrite consent file: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), s.path); err != nil {
+		return true, fmt.Errorf("rewrite consent file: %w", err)
+	}
+
+	// Appends have to go to the new file from now on
+	file, err := os.OpenFile(s.path, os.O_RDWR|os.O_APPEND, 0o600)
+	if err != nil {
+		return true, fmt.Errorf("reopen consent file: %w", err)
+	}
+	s.file.Close()
+	s.file = file
+	return true, nil
+}
+
+// Close closes the file.
+func (s *Store) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.file == nil {
+		return nil
+	}
+	err := s.file.Close()
+	s.file = nil
+	return err
+}
+
+// newToken returns a random confirm token for a URL
+func newToken() (string, error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("generate confirm token: %w", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// hashToken is how tokens are kept, so the file doesn't hold live links
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
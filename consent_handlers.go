@@ -0,0 +1,143 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"email-tracker/audit"
+	"email-tracker/consent"
+	"email-tracker/logging"
+	"email-tracker/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+type consentRequest struct {
+	Email string `json:"email" binding:"required"`
+	// Source says where the address was collected, e.g. a signup form
+	Source string `json:"source"`
+}
+
+// requestConsent starts double opt-in for an address: it is recorded as
+// pending and sent a confirmation email with a signed confirm link. An
+// address that already confirmed isn't mailed again and is answered with
+// 200 instead of 202. Suppressed addresses are refused with 422.
+func (s *Server) requestConsent(c *gin.Context) {
+	var req consentRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		bindError(c, err)
+		return
+	}
+	if !utils.ValidateEmail(req.Email) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid email address"})
+		return
+	}
+	tenant := currentTenant(c)
+	if err := s.suppressions.Check(tenant, []string{req.Email}); err != nil {
+		s.sendFailed(c, err)
+		return
+	}
+
+	entry, token, err := s.consent.Request(tenant, req.Email, req.Source, c.ClientIP())
+	if err != nil {
+		s.serverError(c, http.StatusInternalServerError, "failed to save the consent record", err)
+		return
+	}
+	if token == "" {
+		c.JSON(http.StatusOK, entry)
+		return
+	}
+
+	err = s.notifier.SendConsentRequest(c.Request.Context(), s.tenants.Account(tenant), []string{entry.Address}, s.consent.Subject(), map[string]interface{}{
+		"Subject":    s.consent.Subject(),
+		"Recipient":  entry.Address,
+		"ConfirmURL": s.tracker.ConfirmURL(token, s.trackingBaseURL(c)),
+		"ExpiresAt":  entry.ExpiresAt.Format(time.RFC1123),
+		"Year":       time.Now().Year(),
+	})
+	if err != nil {
+		s.sendFailed(c, err)
+		return
+	}
+	s.recordAudit(c, audit.ActionConsentRequest, logging.RecipientHash(entry.Address),
+		map[string]string{"address": entry.Address, "source": entry.Source})
+	c.JSON(http.StatusAccepted, entry)
+}
+
+// listConsent returns the consent records, most recently requested first,
+// optionally narrowed down to one ?status=.
+func (s *Server) listConsent(c *gin.Context) {
+	status := c.Query("status")
+	switch status {
+	case "", consent.StatusPending, consent.StatusConfirmed, consent.StatusWithdrawn:
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "status must be pending, confirmed or withdrawn"})
+		return
+	}
+	entries := s.consent.List(currentTenant(c), status)
+	c.JSON(http.StatusOK, gin.H{"consent": entries, "total": len(entries)})
+}
+
+// getConsent returns an address's consent record, with when and from where
+// it was confirmed.
+func (s *Server) getConsent(c *gin.Context) {
+	entry, ok := s.consent.Get(currentTenant(c), c.Param("email"))
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "No consent record for this address"})
+		return
+	}
+	c.JSON(http.StatusOK, entry)
+}
+
+// withdrawConsent records that an address took back its consent, so
+// marketing sends to it are refused again in strict mode.
+func (s *Server) withdrawConsent(c *gin.Context) {
+	entry, ok, err := s.consent.Withdraw(currentTenant(c), c.Param("email"))
+	if err != nil {
+		s.serverError(c, http.StatusInternalServerError, "failed to save the consent record", err)
+		return
+	}
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "No consent record for this address"})
+		return
+	}
+	s.recordAudit(c, audit.ActionConsentWithdraw, logging.RecipientHash(entry.Address), map[string]string{"address": entry.Address})
+	c.JSON(http.StatusOK, entry)
+}
+
+// confirmConsent serves the link in confirmation emails. As with
+// unsubscribe links, GET only asks, so link scanners following it don't
+// confirm anyone; POST records the consent with the IP and user agent of
+// whoever confirmed.
+func (s *Server) confirmConsent(c *gin.Context) {
+	token := c.Param("token")
+	if !s.tracker.VerifyConfirm(token, c.Query("sig")) {
+		c.String(http.StatusNotFound, "404 page not found")
+		return
+	}
+	c.Header("Cache-Control", "no-store")
+
+	if !s.consent.Pending(token) {
+		c.HTML(http.StatusNotFound, "consent.html", gin.H{"title": "Confirm subscription", "expired": true})
+		return
+	}
+	if c.Request.Method != http.MethodPost {
+		c.HTML(http.StatusOK, "consent.html", gin.H{"title": "Confirm subscription"})
+		return
+	}
+
+	entry, err := s.consent.Confirm(token, c.ClientIP(), c.Request.UserAgent())
+	if errors.Is(err, consent.ErrInvalidToken) {
+		c.HTML(http.StatusNotFound, "consent.html", gin.H{"title": "Confirm subscription", "expired": true})
+		return
+	}
+	if err != nil {
+		// Confirmed in memory all the same
+		slog.Error("failed to write consent file", "recipient_hash", logging.RecipientHash(entry.Address), "error", err)
+	}
+	s.recordAuditAs(c, actorRecipient, audit.ActionConsentConfirm, logging.RecipientHash(entry.Address), map[string]string{"address": entry.Address})
+	slog.Info("recipient confirmed consent", "recipient_hash", logging.RecipientHash(entry.Address))
+	c.HTML(http.StatusOK, "consent.html", gin.H{"title": "Subscription confirmed", "done": true})
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"email-tracker/audit"
+	"email-tracker/contacts"
+	"email-tracker/logging"
+
+	"github.com/gin-gonic/gin"
+)
+
+// contactRequest creates or updates a contact. Attributes are replaced as a
+// whole.
+type contactRequest struct {
+	Email      string            `json:"email"`
+	Name       string            `json:"name"`
+	Company    string            `json:"company"`
+	Attributes map[string]string `json:"attributes"`
+}
+
+// listContacts returns a page of the tenant's contacts by address, those
+// whose address, name or company contains ?q= when it is set.
+func (s *Server) listContacts(c *gin.Context) {
+	page, perPage, err := pagination(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	list, total := s.contacts.Search(currentTenant(c), c.Query("q"), page, perPage)
+	c.JSON(http.StatusOK, gin.H{
+		"contacts": list,
+		"total":    total,
+		"page":     page,
+		"per_page": perPage,
+	})
+}
+
+func (s *Server) getContact(c *gin.Context) {
+	contact, ok := s.contacts.Get(currentTenant(c), c.Param("email"))
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Contact not found"})
+		return
+	}
+	c.JSON(http.StatusOK, contact)
+}
+
+func (s *Server) createContact(c *gin.Context) {
+	var req contactRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		bindError(c, err)
+		return
+	}
+
+	contact, err := s.contacts.Create(currentTenant(c), contacts.Contact{
+		Email:      req.Email,
+		Name:       req.Name,
+		Company:    req.Company,
+		Attributes: req.Attributes,
+	})
+	if !s.contactSaved(c, err) {
+		return
+	}
+	s.recordAudit(c, audit.ActionContactCreate, logging.RecipientHash(contact.Email),
+		map[string]string{"address": contact.Email, "attributes": strconv.Itoa(len(contact.Attributes))})
+	c.JSON(http.StatusCreated, contact)
+}
+
+// updateContact replaces a contact's name, company and attributes. Its
+// engagement stays as it is.
+func (s *Server) updateContact(c *gin.Context) {
+	var req contactRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		bindError(c, err)
+		return
+	}
+
+	contact, err := s.contacts.Update(currentTenant(c), c.Param("email"), contacts.Contact{
+		Name:       req.Name,
+		Company:    req.Company,
+		Attributes: req.Attributes,
+	})
+	if !s.contactSaved(c, err) {
+		return
+	}
+	s.recordAudit(c, audit.ActionContactUpdate, logging.RecipientHash(contact.Email),
+		map[string]string{"address": contact.Email, "attributes": strconv.Itoa(len(contact.Attributes))})
+	c.JSON(http.StatusOK, contact)
+}
+
+// importContacts adds the contacts in an uploaded CSV file, the multipart
+// field "file". The optional fields "mapping", a JSON object of column
+// headers to fields, "on_duplicate" and "check_mx" say how. It answers
+// with the import's report, rows rejected included.
+func (s *Server) importContacts(c *gin.Context) {
+	file, err := c.FormFile("file")
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			bindError(c, err)
+			return
+		}
+		c.JSON(http.StatusBadRequest, gin.H{"error": "upload the CSV file as the multipart field \"file\""})
+		return
+	}
+
+	opts := contacts.ImportOptions{
+		OnDuplicate: c.PostForm("on_duplicate"),
+		CheckMX:     true,
+	}
+	if mapping := c.PostForm("mapping"); mapping != "" {
+		if err := json.Unmarshal([]byte(mapping), &opts.Mapping); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "mapping must be a JSON object of column headers to fields"})
+			return
+		}
+	}
+	if checkMX := c.PostForm("check_mx"); checkMX != "" {
+		if opts.CheckMX, err = strconv.ParseBool(checkMX); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "check_mx must be true or false"})
+			return
+		}
+	}
+
+	f, err := file.Open()
+	if err != nil {
+		s.serverError(c, http.StatusInternalServerError, "failed to read the upload", err)
+		return
+	}
+	defer f.Close()
+
+	report, err := s.contacts.Import(c.Request.Context(), currentTenant(c), f, opts)
+	if !s.contactSaved(c, err) {
+		return
+	}
+	s.recordAudit(c, audit.ActionContactImport, file.Filename, map[string]string{
+		"created":  strconv.Itoa(report.Created),
+		"updated":  strconv.Itoa(report.Updated),
+		"rejected": strconv.Itoa(report.Rejected),
+	})
+	c.JSON(http.StatusOK, report)
+}
+
+func (s *Server) deleteContact(c *gin.Context) {
+	address := c.Param("email")
+	ok, err := s.contacts.Delete(currentTenant(c), address)
+	if err != nil {
+		s.serverError(c, http.StatusInternalServerError, "failed to save the contacts file", err)
+		return
+	}
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Contact not found"})
+		return
+	}
+	// Only the hash, so the deleted contact's address isn't kept here
+	s.recordAudit(c, audit.ActionContactDelete, logging.RecipientHash(address), nil)
+	c.Status(http.StatusNoContent)
+}
+
+// contactSaved answers for a contact that couldn't be saved, reporting
+// whether it was.
+func (s *Server) contactSaved(c *gin.Context, err error) bool {
+	switch {
+	case err == nil:
+		return true
+	case errors.Is(err, contacts.ErrInvalid):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	case errors.Is(err, contacts.ErrExists):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	case errors.Is(err, contacts.ErrNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Contact not found"})
+	default:
+		s.serverError(c, http.StatusInternalServerError, "failed to save the contacts file", err)
+	}
+	return false
+}
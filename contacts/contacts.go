@@ -0,0 +1,417 @@
+// Package contacts keeps each tenant's recipients as contacts: a name, a
+// company and custom attributes, usable as merge variables in the emails
+// sent to them, along with when they last opened and clicked.
+package contacts
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"email-tracker/config"
+	"email-tracker/models"
+	"email-tracker/utils"
+)
+
+var (
+	// ErrInvalid matches, via errors.Is, contacts refused as malformed
+	ErrInvalid = errors.New("invalid contact")
+	// ErrExists is returned when creating a contact the tenant already has
+	ErrExists = errors.New("contact already exists")
+	// ErrNotFound is returned when updating a contact the tenant doesn't
+	// have
+	ErrNotFound = errors.New("contact not found")
+)
+
+const (
+	maxAttributes = 50
+	maxFieldLen   = 200
+	maxValueLen   = 1000
+
+	// flushInterval is how often engagement is written to the file
+	flushInterval = time.Minute
+)
+
+var attributePattern = regexp.MustCompile(`^[a-z][a-z0-9_]{0,63}$`)
+
+// standardFields are merge variables of every contact, so attributes can't
+// be named after them
+var standardFields = []string{"email", "name", "company"}
+
+// ValidAttribute reports whether name can name a custom attribute.
+func ValidAttribute(name string) bool {
+	return attributePattern.MatchString(name) && !slices.Contains(standardFields, name)
+}
+
+// Contact is one of a tenant's recipients. Its engagement is kept up to
+// date from the opens and clicks of the emails sent to it, bots aside.
+type Contact struct {
+	Tenant     string            `json:"tenant"`
+	Email      string            `json:"email"`
+	Name       string            `json:"name,omitempty"`
+	Company    string            `json:"company,omitempty"`
+	Attributes map[string]string `json:"attributes"`
+	CreatedAt  time.Time         `json:"created_at"`
+	UpdatedAt  time.Time         `json:"updated_at"`
+
+	LastOpenAt  *time.Time `json:"last_open_at,omitempty"`
+	LastClickAt *time.Time `json:"last_click_at,omitempty"`
+	Opens       int        `json:"opens"`
+	Clicks      int        `json:"clicks"`
+}
+
+// Value returns a standard field or attribute by its merge variable name,
+// empty when the contact doesn't have it.
+func (c *Contact) Value(field string) string {
+	switch field {
+	case "email":
+		return c.Email
+	case "name":
+		return c.Name
+	case "company":
+		return c.Company
+	}
+	return c.Attributes[field]
+}
+
+// clone returns a copy of c that shares nothing with it
+func (c *Contact) clone() Contact {
+	copied := *c
+	copied.Attributes = maps.Clone(c.Attributes)
+	if copied.Attributes == nil {
+		copied.Attributes = map[string]string{}
+	}
+	return copied
+}
+
+// key identifies an address among a tenant's contacts
+type key struct {
+	tenant, address string
+}
+
+func keyOf(tenant, address string) key {
+	return key{models.TenantOr(tenant), utils.NormalizeAddress(address)}
+}
+
+// Store holds contacts in memory and, when a file is configured, keeps
+// them in it as JSON Lines, one contact per line. Changes made through the
+// API are written right away; engagement every minute and when closed.
+type Store struct {
+	mu       sync.RWMutex
+	contacts map[key]*Contact
+	path     string
+	dirty    bool
+	resolver Resolver
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// Open loads the contacts kept in cfg's CONTACTS_FILE, if any, and starts
+// writing to it. Without a file contacts only live in memory.
+func Open(cfg *config.Config) (*Store, error) {
+	s := &Store{
+		contacts: make(map[key]*Contact),
+		path:     cfg.Contacts.File,
+		resolver: net.DefaultResolver,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	if s.path == "" {
+		close(s.done)
+		return s, nil
+	}
+
+	file, err := os.Open(s.path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("open contacts file: %w", err)
+	}
+	if err == nil {
+		defer file.Close()
+		scanner := bufio.NewScanner(file)
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+		for line := 1; scanner.Scan(); line++ {
+			var c Contact
+			if err := json.Unmarshal(scanner.Bytes(), &c); err != nil {
+				return nil, fmt.Errorf("contacts file line %d: %w", line, err)
+			}
+			s.contacts[keyOf(c.Tenant, c.Email)] = &c
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, fmt.Errorf("read contacts file: %w", err)
+		}
+	}
+
+	go s.run()
+	return s, nil
+}
+
+// Get returns the tenant's contact for address.
+func (s *Store) Get(tenant, address string) (Contact, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	c, ok := s.contacts[keyOf(tenant, address)]
+	if !ok {
+		return Contact{}, false
+	}
+	return c.clone(), true
+}
+
+// All returns every contact of the tenant, by address.
+func (s *Store) All(tenant string) []Contact {
+	tenant = models.TenantOr(tenant)
+
+	s.mu.RLock()
+	all := []Contact{}
+	for k, c := range s.contacts {
+		if k.tenant == tenant {
+			all = append(all, c.clone())
+		}
+	}
+	s.mu.RUnlock()
+
+	sort.Slice(all, func(i, j int) bool { return all[i].Email < all[j].Email })
+	return all
+}
+
+// Search returns a page of the tenant's contacts whose address, name or
+// company contains query, regardless of case, and how many match in all.
+func (s *Store) Search(tenant, query string, page, perPage int) ([]Contact, int) {
+	query = strings.ToLower(strings.TrimSpace(query))
+	var matches []Contact
+	for _, c := range s.All(tenant) {
+		if query == "" || strings.Contains(strings.ToLower(c.Email), query) ||
+			strings.Contains(strings.ToLower(c.Name), query) || strings.Contains(strings.ToLower(c.Company), query) {
+			matches = append(matches, c)
+		}
+	}
+
+	total := len(matches)
+	start := (page - 1) * perPage
+	if page < 1 || perPage < 1 || start >= total {
+		return []Contact{}, total
+	}
+	return matches[start:min(start+perPage, total)], total
+}
+
+// Create adds a contact to the tenant with c's address, name, company and
+// attributes.
+func (s *Store) Create(tenant string, c Contact) (Contact, error) {
+	c, err := normalize(tenant, c)
+	if err != nil {
+		return Contact{}, err
+	}
+	k := keyOf(c.Tenant, c.Email)
+
+	s.mu.Lock()
+	if _, ok := s.contacts[k]; ok {
+		s.mu.Unlock()
+		return Contact{}, ErrExists
+	}
+	c.CreatedAt = time.Now().UTC()
+	c.UpdatedAt = c.CreatedAt
+	s.contacts[k] = &c
+	s.dirty = true
+	created := c.clone()
+	s.mu.Unlock()
+
+	return created, s.flush()
+}
+
+// Update replaces the name, company and attributes of the tenant's contact
+// for address, keeping its engagement.
+func (s *Store) Update(tenant, address string, c Contact) (Contact, error) {
+	c.Email = address
+	c, err := normalize(tenant, c)
+	if err != nil {
+		return Contact{}, err
+	}
+
+	s.mu.Lock()
+	existing, ok := s.contacts[keyOf(c.Tenant, c.Email)]
+	if !ok {
+		s.mu.Unlock()
+		return Contact{}, ErrNotFound
+	}
+	existing.Name, existing.Company, existing.Attributes = c.Name, c.Company, c.Attributes
+	existing.UpdatedAt = time.Now().UTC()
+	s.dirty = true
+	updated := existing.clone()
+	s.mu.Unlock()
+
+	return updated, s.flush()
+}
+
+// Delete removes the tenant's contact for address, reporting whether it
+// had one.
+func (s *Store) Delete(tenant, address string) (bool, error) {
+	k := keyOf(tenant, address)
+
+	s.mu.Lock()
+	if _, ok := s.contacts[k]; !ok {
+		s.mu.Unlock()
+		return false, nil
+	}
+	delete(s.contacts, k)
+	s.dirty = true
+	s.mu.Unlock()
+
+	return true, s.flush()
+}
+
+// RecordOpen notes that an email to recipients was opened at at. Only the
+// tenant's contacts among them are updated.
+func (s *Store) RecordOpen(tenant string, recipients []string, at time.Time) {
+	s.engage(tenant, recipients, func(c *Contact) {
+		c.Opens++
+		if c.LastOpenAt == nil || at.After(*c.LastOpenAt) {
+			at := at.UTC()
+			c.LastOpenAt = &at
+		}
+	})
+}
+
+// RecordClick notes that a link in an email to recipients was clicked at
+// at. Only the tenant's contacts among them are updated.
+func (s *Store) RecordClick(tenant string, recipients []string, at time.Time) {
+	s.engage(tenant, recipients, func(c *Contact) {
+		c.Clicks++
+		if c.LastClickAt == nil || at.After(*c.LastClickAt) {
+			at := at.UTC()
+			c.LastClickAt = &at
+		}
+	})
+}
+
+func (s *Store) engage(tenant string, recipients []string, update func(*Contact)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, recipient := range recipients {
+		if c, ok := s.contacts[keyOf(tenant, recipient)]; ok {
+			update(c)
+			s.dirty = true
+		}
+	}
+}
+
+// normalize checks c and returns it as stored for tenant
+func normalize(tenant string, c Contact) (Contact, error) {
+	if !utils.ValidateEmail(c.Email) {
+		return Contact{}, fmt.Errorf("%w: %q is not an email address", ErrInvalid, c.Email)
+	}
+	c.Tenant = models.TenantOr(tenant)
+	c.Email = utils.NormalizeAddress(c.Email)
+	c.Name = strings.TrimSpace(c.Name)
+	c.Company = strings.TrimSpace(c.Company)
+	for field, value := range map[string]string{"name": c.Name, "company": c.Company} {
+		if utf8.RuneCountInString(value) > maxFieldLen {
+			return Contact{}, fmt.Errorf("%w: %s can be up to %d characters", ErrInvalid, field, maxFieldLen)
+		}
+	}
+
+	if len(c.Attributes) > maxAttributes {
+		return Contact{}, fmt.Errorf("%w: a contact can have up to %d attributes", ErrInvalid, maxAttributes)
+	}
+	attributes := make(map[string]string, len(c.Attributes))
+	for name, value := range c.Attributes {
+		if !ValidAttribute(name) {
+			return Contact{}, fmt.Errorf("%w: attribute %q must be lowercase letters, digits and _, starting with a letter, and not %s",
+				ErrInvalid, name, strings.Join(standardFields, ", "))
+		}
+		if utf8.RuneCountInString(value) > maxValueLen {
+			return Contact{}, fmt.Errorf("%w: attribute %q can be up to %d characters", ErrInvalid, name, maxValueLen)
+		}
+		attributes[name] = value
+	}
+	c.Attributes = attributes
+
+	// Engagement only comes from the tracker
+	c.LastOpenAt, c.LastClickAt, c.Opens, c.Clicks = nil, nil, 0, 0
+	return c, nil
+}
+
+// run writes engagement every flushInterval until the store is closed
+func (s *Store) run() {
+	defer close(s.done)
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := s.flush(); err != nil {
+				slog.Error("failed to write contacts file", "error", err)
+			}
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+// flush rewrites the file when anything changed. The new file is written
+// alongside and renamed over the old one, so a failure leaves the old one
+// intact.
+func (s *Store) flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.path == "" || !s.dirty {
+		return nil
+	}
+
+	var lines []byte
+	for _, c := range s.contacts {
+		line, err := json.Marshal(c)
+		if err != nil {
+			return err
+		}
+		lines = append(append(lines, line...), '\n')
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".*")
+	if err != nil {
+		return fmt.Errorf("rewrite contacts file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	if err := tmp.Chmod(0o600); err != nil {
+		return fmt.Errorf("rewrite contacts file: %w", err)
+	}
+	if _, err := tmp.Write(lines); err != nil {
+		return fmt.Errorf("rewrite contacts file: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		return fmt.Errorf("rewrite contacts file: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), s.path); err != nil {
+		return fmt.Errorf("rewrite contacts file: %w", err)
+	}
+	s.dirty = false
+	return nil
+}
+
+// Close stops the periodic writes and writes the contacts one last time.
+func (s *Store) Close() error {
+	select {
+	case <-s.stop:
+		return nil
+	default:
+		close(s.stop)
+	}
+	<-s.done
+	return s.flush()
+}
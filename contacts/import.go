@@ -0,0 +1,389 @@
+package contacts
+
+import (
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"email-tracker/utils"
+)
+
+// How an import treats rows for addresses the tenant already has contacts
+// for
+const (
+	// DuplicateSkip leaves the existing contact as it is
+	DuplicateSkip = "skip"
+	// DuplicateUpdate sets the existing contact's fields to the row's
+	// non-empty cells
+	DuplicateUpdate = "update"
+)
+
+const (
+	// mxLookupTimeout bounds each domain's lookups
+	mxLookupTimeout = 5 * time.Second
+	// mxLookupWorkers is how many domains are looked up at once
+	mxLookupWorkers = 8
+)
+
+// columnAliases are headers spreadsheets commonly use for the standard
+// fields, as mapColumns normalizes them
+var columnAliases = map[string]string{
+	"e_mail":        "email",
+	"email_address": "email",
+	"full_name":     "name",
+	"organization":  "company",
+	"organisation":  "company",
+}
+
+// Resolver is the DNS lookups the MX check needs; *net.Resolver has them
+type Resolver interface {
+	LookupMX(ctx context.Context, name string) ([]*net.MX, error)
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+}
+
+// ImportOptions is how a CSV file's rows become contacts.
+type ImportOptions struct {
+	// Mapping maps column headers to the field they fill: email, name,
+	// company or an attribute name. Columns mapped to "" and, when Mapping
+	// is set, columns left out of it are ignored. Without it each column
+	// fills the field its header names, lowercased with spaces and dashes
+	// as _, or the standard field it's a common name for, such as Full Name.
+	Mapping map[string]string
+	// OnDuplicate is DuplicateSkip, the default, or DuplicateUpdate
+	OnDuplicate string
+	// CheckMX rejects addresses whose domain has no mail server
+	CheckMX bool
+}
+
+// RowIssue is why a row was rejected, or something worth knowing about it.
+// Row is its line in the file, the header being line 1.
+type RowIssue struct {
+	Row    int    `json:"row"`
+	Email  string `json:"email,omitempty"`
+	Reason string `json:"reason"`
+}
+
+// ImportReport is what an import did with each row.
+type ImportReport struct {
+	Rows     int `json:"rows"`
+	Accepted int `json:"accepted"`
+	Created  int `json:"created"`
+	Updated  int `json:"updated"`
+	// Skipped is rows for existing contacts that were left as they were
+	Skipped  int `json:"skipped"`
+	Rejected int `json:"rejected"`
+	// Columns is the field each column filled, by header
+	Columns        map[string]string `json:"columns"`
+	IgnoredColumns []string          `json:"ignored_columns"`
+	Rejections     []RowIssue        `json:"rejections"`
+	Warnings       []RowIssue        `json:"warnings"`
+}
+
+// importRow is a row that passed validation, waiting to be saved
+type importRow struct {
+	line    int
+	contact Contact
+	// set are the attributes with a non-empty cell
+	set map[string]bool
+}
+
+// Import adds the contacts in a CSV file with a header row to the tenant.
+// Rows are checked and rejected one by one: a bad address, a second row
+// for the same address or an invalid value only costs that row. The file
+// as a whole is refused, with ErrInvalid, when it can't be read as CSV up
+// to its header or has no email column.
+func (s *Store) Import(ctx context.Context, tenant string, r io.Reader, opts ImportOptions) (ImportReport, error) {
+	if opts.OnDuplicate == "" {
+		opts.OnDuplicate = DuplicateSkip
+	}
+	if opts.OnDuplicate != DuplicateSkip && opts.OnDuplicate != DuplicateUpdate {
+		return ImportReport{}, fmt.Errorf("%w: on_duplicate must be %s or %s", ErrInvalid, DuplicateSkip, DuplicateUpdate)
+	}
+
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+	header, err := reader.Read()
+	if err != nil {
+		return ImportReport{}, fmt.Errorf("%w: the file has no CSV header row", ErrInvalid)
+	}
+	// Spreadsheets often save CSV with a byte order mark
+	header[0] = strings.TrimPrefix(header[0], "\ufeff")
+
+	report := ImportReport{
+		Columns:        map[string]string{},
+		IgnoredColumns: []string{},
+		Rejections:     []RowIssue{},
+		Warnings:       []RowIssue{},
+	}
+	fields, err := mapColumns(header, opts.Mapping, &report)
+	if err != nil {
+		return ImportReport{}, err
+	}
+
+	var rows []importRow
+	seen := map[string]int{}
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		var parseErr *csv.ParseError
+		if errors.As(err, &parseErr) {
+			report.Rows++
+			report.reject(parseErr.StartLine, "", "not valid CSV: "+parseErr.Err.Error())
+			continue
+		}
+		if err != nil {
+			return ImportReport{}, fmt.Errorf("read CSV file: %w", err)
+		}
+		report.Rows++
+		line, _ := reader.FieldPos(0)
+
+		var row importRow
+		row.line = line
+		row.set = map[string]bool{}
+		row.contact.Attributes = map[string]string{}
+		for i, field := range fields {
+			if field == "" || i >= len(record) {
+				continue
+			}
+			value := strings.TrimSpace(record[i])
+			switch field {
+			case "email":
+				row.contact.Email = value
+			case "name":
+				row.contact.Name = value
+			case "company":
+				row.contact.Company = value
+			default:
+				if value != "" {
+					row.contact.Attributes[field] = value
+					row.set[field] = true
+				}
+			}
+		}
+
+		address := row.contact.Email
+		if address == "" {
+			report.reject(line, "", "no email address")
+			continue
+		}
+		if !utils.ValidateEmail(address) {
+			report.reject(line, address, "not a valid email address")
+			continue
+		}
+		normalized := utils.NormalizeAddress(address)
+		if first, ok := seen[normalized]; ok {
+			report.reject(line, address, fmt.Sprintf("same address as row %d", first))
+			continue
+		}
+		seen[normalized] = line
+
+		contact, err := normalize(tenant, row.contact)
+		if err != nil {
+			report.reject(line, address, strings.TrimPrefix(err.Error(), ErrInvalid.Error()+": "))
+			continue
+		}
+		row.contact = contact
+		rows = append(rows, row)
+	}
+
+	if opts.CheckMX {
+		rows = s.checkMX(ctx, rows, &report)
+	}
+	if err := s.save(tenant, rows, opts.OnDuplicate, &report); err != nil {
+		return ImportReport{}, err
+	}
+	report.Accepted = report.Created + report.Updated
+	slices.SortFunc(report.Rejections, func(a, b RowIssue) int { return a.Row - b.Row })
+	return report, nil
+}
+
+func (r *ImportReport) reject(line int, address, reason string) {
+	r.Rejected++
+	r.Rejections = append(r.Rejections, RowIssue{Row: line, Email: address, Reason: reason})
+}
+
+// mapColumns returns the field each column fills, "" for those ignored
+func mapColumns(header []string, mapping map[string]string, report *ImportReport) ([]string, error) {
+	fields := make([]string, len(header))
+	used := map[string]string{}
+	for i, column := range header {
+		column = strings.TrimSpace(column)
+		var field string
+		if mapping != nil {
+			field = strings.TrimSpace(mapping[column])
+		} else {
+			field = strings.NewReplacer(" ", "_", "-", "_").Replace(strings.ToLower(column))
+			if alias, ok := columnAliases[field]; ok {
+				field = alias
+			}
+		}
+
+		valid := slices.Contains(standardFields, field) || attributePattern.MatchString(field)
+		if field == "" || (mapping == nil && !valid) {
+			report.IgnoredColumns = append(report.IgnoredColumns, column)
+			continue
+		}
+		if !valid {
+			return nil, fmt.Errorf("%w: column %q can't be mapped to %q, which isn't email, name, company or an attribute name", ErrInvalid, column, field)
+		}
+		if other, ok := used[field]; ok {
+			return nil, fmt.Errorf("%w: columns %q and %q both fill %s", ErrInvalid, other, column, field)
+		}
+		used[field] = column
+		fields[i] = field
+		report.Columns[column] = field
+	}
+	if _, ok := used["email"]; !ok {
+		return nil, fmt.Errorf("%w: the file has no email column", ErrInvalid)
+	}
+	return fields, nil
+}
+
+// checkMX looks up each domain among rows once, and returns the rows
+// whose domain can receive mail. A domain without MX records still can
+// if it has an address. Lookups that fail for other reasons than the
+// domain not existing leave its rows in, with a warning.
+func (s *Store) checkMX(ctx context.Context, rows []importRow, report *ImportReport) []importRow {
+	results := map[string]error{}
+	var domains []string
+	for _, row := range rows {
+		domain := utils.ExtractDomain(row.contact.Email)
+		if _, ok := results[domain]; !ok {
+			results[domain] = nil
+			domains = append(domains, domain)
+		}
+	}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	work := make(chan string)
+	for range min(mxLookupWorkers, len(domains)) {
+		wg.Go(func() {
+			for domain := range work {
+				err := s.lookupMailServer(ctx, domain)
+				mu.Lock()
+				results[domain] = err
+				mu.Unlock()
+			}
+		})
+	}
+	for _, domain := range domains {
+		work <- domain
+	}
+	close(work)
+	wg.Wait()
+
+	kept := rows[:0]
+	for _, row := range rows {
+		err := results[utils.ExtractDomain(row.contact.Email)]
+		var unchecked *uncheckedError
+		switch {
+		case err == nil:
+			kept = append(kept, row)
+		case errors.As(err, &unchecked):
+			report.Warnings = append(report.Warnings, RowIssue{Row: row.line, Email: row.contact.Email, Reason: err.Error()})
+			kept = append(kept, row)
+		default:
+			report.reject(row.line, row.contact.Email, err.Error())
+		}
+	}
+	return kept
+}
+
+// uncheckedError is a domain whose mail servers couldn't be looked up
+type uncheckedError struct {
+	domain string
+	err    error
+}
+
+func (e *uncheckedError) Error() string {
+	return "couldn't check the mail servers of " + e.domain + ": " + e.err.Error()
+}
+
+// lookupMailServer returns nil when domain can receive mail, and why not
+// otherwise
+func (s *Store) lookupMailServer(ctx context.Context, domain string) error {
+	ctx, cancel := context.WithTimeout(ctx, mxLookupTimeout)
+	defer cancel()
+
+	mxs, err := s.resolver.LookupMX(ctx, domain)
+	if err == nil && len(mxs) > 0 {
+		// A single "." is a null MX: the domain takes no mail
+		if len(mxs) == 1 && strings.TrimSuffix(mxs[0].Host, ".") == "" {
+			return fmt.Errorf("%s accepts no mail", domain)
+		}
+		return nil
+	}
+	if !isNotFound(err) {
+		return &uncheckedError{domain, err}
+	}
+
+	addrs, err := s.resolver.LookupIPAddr(ctx, domain)
+	if err == nil && len(addrs) > 0 {
+		return nil
+	}
+	if !isNotFound(err) {
+		return &uncheckedError{domain, err}
+	}
+	return fmt.Errorf("%s has no mail server", domain)
+}
+
+// isNotFound reports whether a lookup found nothing, as opposed to failing
+func isNotFound(err error) bool {
+	var dnsErr *net.DNSError
+	return err == nil || (errors.As(err, &dnsErr) && dnsErr.IsNotFound)
+}
+
+// save creates or updates the tenant's contacts from rows, and writes the
+// file once for them all
+func (s *Store) save(tenant string, rows []importRow, onDuplicate string, report *ImportReport) error {
+	now := time.Now().UTC()
+
+	s.mu.Lock()
+	for _, row := range rows {
+		c := row.contact
+		k := keyOf(c.Tenant, c.Email)
+		existing, ok := s.contacts[k]
+		switch {
+		case !ok:
+			c.CreatedAt, c.UpdatedAt = now, now
+			s.contacts[k] = &c
+			report.Created++
+		case onDuplicate == DuplicateSkip:
+			report.Skipped++
+			continue
+		default:
+			attributes := existing.clone().Attributes
+			for name := range row.set {
+				attributes[name] = c.Attributes[name]
+			}
+			if len(attributes) > maxAttributes {
+				report.reject(row.line, c.Email, fmt.Sprintf("a contact can have up to %d attributes", maxAttributes))
+				continue
+			}
+			if c.Name != "" {
+				existing.Name = c.Name
+			}
+			if c.Company != "" {
+				existing.Company = c.Company
+			}
+			existing.Attributes = attributes
+			existing.UpdatedAt = now
+			report.Updated++
+		}
+		s.dirty = true
+	}
+	s.mu.Unlock()
+
+	return s.flush()
+}
@@ -0,0 +1,33 @@
+package contacts
+
+import (
+	"html"
+	"regexp"
+	"strings"
+)
+
+// mergePattern matches a merge variable, {{contact.name}}, optionally with
+// a fallback, {{contact.name|there}}
+var mergePattern = regexp.MustCompile(`\{\{\s*contact\.([a-z][a-z0-9_]*)\s*(?:\|([^{}]*))?\}\}`)
+
+// Merge replaces the merge variables in text with contact's values. A
+// variable the contact has no value for, or any without a contact, takes
+// its fallback, or nothing. With escape set values are escaped for an HTML
+// body; fallbacks are taken as they are written.
+func Merge(text string, contact *Contact, escape bool) string {
+	if !strings.Contains(text, "{{") {
+		return text
+	}
+	return mergePattern.ReplaceAllStringFunc(text, func(variable string) string {
+		match := mergePattern.FindStringSubmatch(variable)
+		if contact != nil {
+			if value := contact.Value(match[1]); value != "" {
+				if escape {
+					return html.EscapeString(value)
+				}
+				return value
+			}
+		}
+		return strings.TrimSpace(match[2])
+	})
+}
@@ -0,0 +1,73 @@
+package counters
+
+import (
+	"context"
+	"time"
+
+	"email-tracker/config"
+	"email-tracker/models"
+)
+
+// Metric names kept per tracking ID, campaign and day. The human_ variants
+// leave out opens and clicks flagged as bots.
+const (
+	MetricOpens       = "opens"
+	MetricHumanOpens  = "human_opens"
+	MetricClicks      = "clicks"
+	MetricHumanClicks = "human_clicks"
+)
+
+var metrics = []string{MetricOpens, MetricHumanOpens, MetricClicks, MetricHumanClicks}
+
+// Counters keeps real-time open and click counts separate from event storage
+// so dashboards can read totals without scanning events.
+type Counters interface {
+	// RecordOpen and RecordClick count an event of one of tenant's emails.
+	// Campaign counts are kept per tenant, as campaign IDs given to sends
+	// are free-form and can be shared between tenants.
+	RecordOpen(event *models.TrackingEvent, tenant, campaignID string)
+	RecordClick(event *models.ClickEvent, tenant, campaignID string)
+	TrackingCounts(ctx context.Context, trackingID string) (map[string]int64, error)
+	CampaignCounts(ctx context.Context, tenant, campaignID string) (map[string]int64, error)
+	DayCounts(ctx context.Context, day time.Time) (map[string]int64, error)
+	// DeleteTracking drops the counts of the given tracking IDs. Campaign
+	// and day totals are left as they are.
+	DeleteTracking(ctx context.Context, trackingIDs ...string) error
+}
+
+// New returns Redis-backed counters when Redis is enabled in config and a
+// no-op implementation otherwise.
+func New(cfg *config.Config) Counters {
+	if !cfg.Redis.Enabled {
+		return Noop{}
+	}
+	return NewRedisCounters(cfg)
+}
+
+// Noop discards all increments and reports zero counts.
+type Noop struct{}
+
+func (Noop) RecordOpen(*models.TrackingEvent, string, string) {}
+func (Noop) RecordClick(*models.ClickEvent, string, string)   {}
+
+func (Noop) TrackingCounts(context.Context, string) (map[string]int64, error) {
+	return emptyCounts(), nil
+}
+
+func (Noop) CampaignCounts(context.Context, string, string) (map[string]int64, error) {
+	return emptyCounts(), nil
+}
+
+func (Noop) DayCounts(context.Context, time.Time) (map[string]int64, error) {
+	return emptyCounts(), nil
+}
+
+func (Noop) DeleteTracking(context.Context, ...string) error { return nil }
+
+func emptyCounts() map[string]int64 {
+	counts := make(map[string]int64, len(metrics))
+	for _, metric := range metrics {
+		counts[metric] = 0
+	}
+	return counts
+}
@@ -0,0 +1,144 @@
+package counters
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"email-tracker/config"
+	"email-tracker/models"
+	"email-tracker/utils"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	keyPrefix = "email-tracker:counters"
+
+	// Per-day counters are kept for this long
+	dayKeyTTL = 90 * 24 * time.Hour
+
+	// Increments run off the request path but shouldn't pile up if Redis
+	// is slow
+	writeTimeout = 500 * time.Millisecond
+)
+
+type RedisCounters struct {
+	client        *redis.Client
+	writeFailures utils.LossCounter
+}
+
+func NewRedisCounters(cfg *config.Config) *RedisCounters {
+	return &RedisCounters{
+		client: redis.NewClient(&redis.Options{
+			Addr:     fmt.Sprintf("%s:%d", cfg.Redis.Host, cfg.Redis.Port),
+			Password: cfg.Redis.Password,
+			DB:       cfg.Redis.DB,
+		}),
+	}
+}
+
+func (r *RedisCounters) RecordOpen(event *models.TrackingEvent, tenant, campaignID string) {
+	metrics := []string{MetricOpens}
+	if !event.IsBot {
+		metrics = append(metrics, MetricHumanOpens)
+	}
+	go r.incr(event.TrackingID, tenant, campaignID, event.OpenedAt, metrics)
+}
+
+func (r *RedisCounters) RecordClick(event *models.ClickEvent, tenant, campaignID string) {
+	metrics := []string{MetricClicks}
+	if !event.IsBot {
+		metrics = append(metrics, MetricHumanClicks)
+	}
+	go r.incr(event.TrackingID, tenant, campaignID, event.ClickedAt, metrics)
+}
+
+func (r *RedisCounters) incr(trackingID, tenant, campaignID string, at time.Time, metrics []string) {
+	ctx, cancel := context.WithTimeout(context.Background(), writeTimeout)
+	defer cancel()
+
+	pipe := r.client.Pipeline()
+	for _, metric := range metrics {
+		pipe.HIncrBy(ctx, trackingKey(trackingID), metric, 1)
+		if campaignID != "" {
+			pipe.HIncrBy(ctx, campaignKey(tenant, campaignID), metric, 1)
+		}
+		pipe.HIncrBy(ctx, dayKey(at), metric, 1)
+	}
+	pipe.Expire(ctx, dayKey(at), dayKeyTTL)
+
+	if _, err := pipe.Exec(ctx); err != nil {
+		r.writeFailures.Add(1)
+		slog.Error("failed to update Redis counters", "tracking_id", trackingID, "error", err)
+	}
+}
+
+func (r *RedisCounters) TrackingCounts(ctx context.Context, trackingID string) (map[string]int64, error) {
+	return r.read(ctx, trackingKey(trackingID))
+}
+
+func (r *RedisCounters) CampaignCounts(ctx context.Context, tenant, campaignID string) (map[string]int64, error) {
+	return r.read(ctx, campaignKey(tenant, campaignID))
+}
+
+func (r *RedisCounters) DayCounts(ctx context.Context, day time.Time) (map[string]int64, error) {
+	return r.read(ctx, dayKey(day))
+}
+
+func (r *RedisCounters) DeleteTracking(ctx context.Context, trackingIDs ...string) error {
+	if len(trackingIDs) == 0 {
+		return nil
+	}
+	keys := make([]string, len(trackingIDs))
+	for i, trackingID := range trackingIDs {
+		keys[i] = trackingKey(trackingID)
+	}
+	return r.client.Del(ctx, keys...).Err()
+}
+
+func (r *RedisCounters) read(ctx context.Context, key string) (map[string]int64, error) {
+	values, err := r.client.HMGet(ctx, key, metrics...).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	counts := emptyCounts()
+	for i, v := range values {
+		if s, ok := v.(string); ok {
+			var n int64
+			fmt.Sscan(s, &n)
+			counts[metrics[i]] = n
+		}
+	}
+	return counts, nil
+}
+
+// WriteFailures counts increments lost because Redis didn't take them.
+func (r *RedisCounters) WriteFailures() utils.LossCount {
+	return r.writeFailures.Snapshot()
+}
+
+// Ping checks the Redis connection.
+func (r *RedisCounters) Ping(ctx context.Context) error {
+	return r.client.Ping(ctx).Err()
+}
+
+func trackingKey(trackingID string) string {
+	return keyPrefix + ":tracking:" + trackingID
+}
+
+// campaignKey keeps the default tenant's campaigns under the keys they had
+// before there were tenants, so their counts carry on
+func campaignKey(tenant, campaignID string) string {
+	tenant = models.TenantOr(tenant)
+	if tenant == models.DefaultTenant {
+		return keyPrefix + ":campaign:" + campaignID
+	}
+	return keyPrefix + ":tenant:" + tenant + ":campaign:" + campaignID
+}
+
+func dayKey(day time.Time) string {
+	return keyPrefix + ":day:" + day.UTC().Format("2006-01-02")
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"email-tracker/analytics"
+	"email-tracker/audit"
+	"email-tracker/auth"
+	"email-tracker/logging"
+	"email-tracker/models"
+	"email-tracker/tracker"
+	"email-tracker/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	dashboardEmailLimit = 50
+	dashboardEventLimit = 20
+
+	// streamKeepAlive keeps idle event streams from being closed by proxies
+	streamKeepAlive = 20 * time.Second
+)
+
+func (s *Server) dashboard(c *gin.Context) {
+	// Get BaseURL from context
+	baseURL, _ := c.Get("baseURL")
+
+	tenant := currentTenant(c)
+	emails := s.tracker.TenantEmails(tenant)
+	sort.Slice(emails, func(i, j int) bool { return emails[i].SentAt.After(emails[j].SentAt) })
+
+	campaigns := campaignIDs(emails)
+
+	summary := analytics.Summarize(emails, time.Time{}, time.Now().Add(time.Second), false)
+	filtered := analytics.Summarize(emails, time.Time{}, time.Now().Add(time.Second), true)
+
+	// The chart and map pickers offer the most recent emails
+	recent := emails
+	if len(recent) > dashboardEmailLimit {
+		recent = recent[:dashboardEmailLimit]
+	}
+
+	query, err := emailQuery(c)
+	if err != nil {
+		query = tracker.EmailQuery{Tenant: tenant, Page: 1, PerPage: defaultEmailsPerPage}
+	}
+	page, total := s.tracker.SearchEmails(query)
+	pages := (total + query.PerPage - 1) / query.PerPage
+
+	events := s.tracker.AllTrackingEvents(tenant)
+	sort.Slice(events, func(i, j int) bool { return events[i].OpenedAt.After(events[j].OpenedAt) })
+	if len(events) > dashboardEventLimit {
+		events = events[:dashboardEventLimit]
+	}
+
+	// The health of the service as a whole is the operator's business
+	var system *systemHealth
+	if tenant == models.DefaultTenant {
+		system = s.systemHealth(c.Request.Context())
+	}
+
+	// Serve dashboard HTML with BaseURL injected
+	c.HTML(http.StatusOK, "dashboard.html", gin.H{
+		"title":       "Email Tracker Dashboard",
+		"baseURL":     baseURL,
+		"environment": s.config.App.Env,
+		"summary":     summary,
+		"filtered":    filtered,
+		"emails":      page,
+		"recent":      recent,
+		"query":       query,
+		"total":       total,
+		"pages":       pages,
+		"prevURL":     pageURL(c, query.Page-1, pages),
+		"nextURL":     pageURL(c, query.Page+1, pages),
+		"campaigns":   campaigns,
+		"system":      system,
+		"events":      events,
+		"subjects":    s.subjectsFor(events),
+		"feedLimit":   dashboardEventLimit,
+		"generatedAt": time.Now().Format("2006-01-02 15:04:05"),
+		"user":        currentUsername(c),
+		"branding":    s.branding(c),
+	})
+}
+
+// branding returns the current tenant's branding for the dashboard pages,
+// nil when it keeps the service's own look.
+func (s *Server) branding(c *gin.Context) *models.Branding {
+	branding, ok := s.tenants.Branding(currentTenant(c))
+	if !ok {
+		return nil
+	}
+	return &branding
+}
+
+// streamEvents pushes the tenant's opens and clicks to the client as
+// server-sent events until it disconnects.
+func (s *Server) streamEvents(c *gin.Context) {
+	tenant := currentTenant(c)
+	events, unsubscribe := s.events.Subscribe()
+	defer unsubscribe()
+
+	// The stream outlives the server's write timeout
+	if err := http.NewResponseController(c.Writer).SetWriteDeadline(time.Time{}); err != nil {
+		logging.FromContext(c.Request.Context()).Warn("failed to clear write deadline for event stream", "error", err)
+	}
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(http.StatusOK)
+	c.Writer.Flush()
+
+	keepAlive := time.NewTicker(streamKeepAlive)
+	defer keepAlive.Stop()
+
+	c.Stream(func(w io.Writer) bool {
+		select {
+		case event, ok := <-events:
+			if !ok {
+				return false
+			}
+			if models.TenantOr(event.Tenant) != tenant {
+				return true
+			}
+			c.SSEvent(event.Type, event)
+			return true
+		case <-keepAlive.C:
+			_, err := io.WriteString(w, ": keep-alive\n\n")
+			return err == nil
+		case <-c.Request.Context().Done():
+			return false
+		}
+	})
+}
+
+// subjectsFor lets the activity feed show which email each event belongs to
+func (s *Server) subjectsFor(events []*models.TrackingEvent) map[string]string {
+	subjects := make(map[string]string, len(events))
+	for _, event := range events {
+		if email := s.tracker.GetEmail(event.TrackingID); email != nil {
+			subjects[event.TrackingID] = email.Subject
+		}
+	}
+	return subjects
+}
+
+// pageURL links to another page of the email list, keeping the current
+// search and filters. It is empty when the page doesn't exist.
+func pageURL(c *gin.Context, page, pages int) string {
+	if page < 1 || page > pages {
+		return ""
+	}
+	values := c.Request.URL.Query()
+	values.Set("page", strconv.Itoa(page))
+	return "?" + values.Encode()
+}
+
+// campaignIDs lists the distinct campaigns the emails were sent under
+func campaignIDs(emails []*models.Email) []string {
+	seen := make(map[string]struct{})
+	var ids []string
+	for _, email := range emails {
+		if email.CampaignID == "" {
+			continue
+		}
+		if _, ok := seen[email.CampaignID]; !ok {
+			seen[email.CampaignID] = struct{}{}
+			ids = append(ids, email.CampaignID)
+		}
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// currentUsername returns the signed-in user's name, if any
+func currentUsername(c *gin.Context) string {
+	if user, ok := c.Get("user"); ok {
+		return user.(*auth.User).Username
+	}
+	return ""
+}
+
+// timelineEntry is one open or click on the email detail page
+type timelineEntry struct {
+	At         time.Time
+	Kind       string
+	IPAddress  string
+	Location   string
+	DeviceType string
+	Browser    string
+	Client     string
+	OS         string
+	URL        string
+	IsBot      bool
+}
+
+func (s *Server) emailDetail(c *gin.Context) {
+	email := s.tracker.GetEmail(c.Param("id"))
+	if email == nil {
+		c.String(http.StatusNotFound, "Email not found")
+		return
+	}
+
+	s.renderEmailDetail(c, http.StatusOK, email, "")
+}
+
+func (s *Server) renderEmailDetail(c *gin.Context, status int, email *models.Email, errMsg string) {
+	var timeline []timelineEntry
+	for _, event := range s.tracker.GetAllTrackingEvents(email.TrackingID) {
+		timeline = append(timeline, timelineEntry{
+			At:         event.OpenedAt,
+			Kind:       "open",
+			IPAddress:  event.IPAddress,
+			Location:   strings.Trim(event.City+", "+event.Country, ", "),
+			DeviceType: event.DeviceType,
+			Browser:    event.Browser,
+			Client:     event.EmailClient,
+			OS:         event.OS,
+			IsBot:      event.IsBot,
+		})
+	}
+	for _, click := range s.tracker.GetClickEvents(email.TrackingID) {
+		device := utils.ParseUserAgent(click.UserAgent)
+		timeline = append(timeline, timelineEntry{
+			At:         click.ClickedAt,
+			Kind:       "click",
+			IPAddress:  click.IPAddress,
+			DeviceType: device.DeviceType,
+			Browser:    device.Browser,
+			Client:     device.EmailClient,
+			OS:         device.OS,
+			URL:        click.URL,
+			IsBot:      click.IsBot,
+		})
+	}
+	sort.Slice(timeline, func(i, j int) bool { return timeline[i].At.Before(timeline[j].At) })
+
+	c.HTML(status, "email.html", gin.H{
+		"title":    email.Subject,
+		"email":    email,
+		"preview":  utils.SanitizeHTML(email.Body),
+		"timeline": timeline,
+		"error":    errMsg,
+		"user":     currentUsername(c),
+		"branding": s.branding(c),
+	})
+}
+
+func (s *Server) resendEmailFromDashboard(c *gin.Context) {
+	email := s.tracker.GetEmail(c.Param("id"))
+	if email == nil {
+		c.String(http.StatusNotFound, "Email not found")
+		return
+	}
+
+	trackingID, err := s.emailService.Resend(c.Request.Context(), email, s.trackingBaseURL(c))
+	if err != nil {
+		logging.FromContext(c.Request.Context()).Error("failed to resend email", "tracking_id", email.TrackingID, "error", err)
+		s.renderEmailDetail(c, http.StatusBadGateway, email, sendErrorMessage(err))
+		return
+	}
+	s.recordAudit(c, audit.ActionEmailResend, trackingID, map[string]string{"original": email.TrackingID})
+
+	c.Redirect(http.StatusSeeOther, "/dashboard/emails/"+url.PathEscape(trackingID))
+}
+
+func (s *Server) deleteEmailFromDashboard(c *gin.Context) {
+	if s.tracker.DeleteEmail(c.Param("id")) {
+		s.recordAudit(c, audit.ActionEmailDelete, c.Param("id"), nil)
+	}
+	c.Redirect(http.StatusSeeOther, "/dashboard")
+}
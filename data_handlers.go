@@ -0,0 +1,154 @@
+package main
+
+import (
+	"net/http"
+	"net/mail"
+	"strconv"
+	"time"
+
+	"email-tracker/audit"
+	"email-tracker/logging"
+	"email-tracker/models"
+	"email-tracker/tracker"
+
+	"github.com/gin-gonic/gin"
+)
+
+// erasedAddress replaces an erased recipient's address in the audit trail
+const erasedAddress = "[erased]"
+
+// recipientErasure reports what an erasure request removed. The address
+// itself isn't echoed back, only its hash as used in logs.
+type recipientErasure struct {
+	RecipientHash string `json:"recipient_hash"`
+	tracker.RecipientDeletion
+	CampaignsUpdated   int       `json:"campaigns_updated"`
+	AuditEntriesErased int       `json:"audit_entries_erased"`
+	ConsentErased      bool      `json:"consent_erased"`
+	ContactErased      bool      `json:"contact_erased"`
+	CompletedAt        time.Time `json:"completed_at"`
+	Errors             []string  `json:"errors,omitempty"`
+}
+
+// deleteRecipientData honors an erasure request for the address in :email:
+// every email sent to it is deleted with its opens and clicks, it is taken
+// off campaign recipient lists, its consent record and contact are
+// dropped, and it is blanked out of the audit trail. Only the tenant's own
+// emails, campaigns, consent record and contact are touched.
+// Answers 500 with the partial report if a store failed; the request can
+// be repeated.
+func (s *Server) deleteRecipientData(c *gin.Context) {
+	addr, err := mail.ParseAddress(c.Param("email"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid email address"})
+		return
+	}
+	address := addr.Address
+
+	tenant := currentTenant(c)
+	report := recipientErasure{RecipientHash: logging.RecipientHash(address)}
+	logger := logging.FromContext(c.Request.Context()).With("recipient_hash", report.RecipientHash)
+	report.RecipientDeletion, err = s.tracker.DeleteRecipient(c.Request.Context(), tenant, address)
+	if err != nil {
+		logger.Error("failed to erase tracking data", "error", err)
+		report.Errors = append(report.Errors, "failed to erase tracking data")
+	}
+	report.CampaignsUpdated = s.campaigns.DeleteRecipient(tenant, address)
+	report.ConsentErased, err = s.consent.Erase(tenant, address)
+	if err != nil {
+		logger.Error("failed to erase consent record", "error", err)
+		report.Errors = append(report.Errors, "failed to erase consent record")
+	}
+	report.ContactErased, err = s.contacts.Delete(tenant, address)
+	if err != nil {
+		logger.Error("failed to erase contact", "error", err)
+		report.Errors = append(report.Errors, "failed to erase contact")
+	}
+	report.AuditEntriesErased, err = s.audit.Erase(tenant, address, erasedAddress)
+	if err != nil {
+		logger.Error("failed to erase audit entries", "error", err)
+		report.Errors = append(report.Errors, "failed to erase audit entries")
+	}
+	report.CompletedAt = time.Now()
+
+	s.recordAudit(c, audit.ActionRecipientErase, report.RecipientHash, map[string]string{
+		"emails":    strconv.Itoa(report.Emails),
+		"campaigns": strconv.Itoa(report.CampaignsUpdated),
+	})
+
+	status := http.StatusOK
+	if len(report.Errors) > 0 {
+		status = http.StatusInternalServerError
+	}
+	c.JSON(status, report)
+}
+
+// retentionPolicies shows how long what is tracked is kept: the configured
+// retention, the tenant's own set by the operator, and the tenant's
+// campaigns and emails that override it
+type retentionPolicies struct {
+	Interval    string `json:"interval"`
+	EmailMaxAge string `json:"email_max_age"`
+	EventMaxAge string `json:"event_max_age"`
+	// TenantRetentionDays applies to the tenant's emails without a
+	// retention of their own, when set
+	TenantRetentionDays int                 `json:"tenant_retention_days,omitempty"`
+	Campaigns           []campaignRetention `json:"campaigns"`
+	// EmailsByDays counts the emails held with a retention of their own,
+	// by that retention in days
+	EmailsByDays map[int]int `json:"emails_by_retention_days"`
+}
+
+type campaignRetention struct {
+	CampaignID    string `json:"campaign_id"`
+	Name          string `json:"name"`
+	RetentionDays int    `json:"retention_days"`
+}
+
+func (s *Server) getRetention(c *gin.Context) {
+	tenant := currentTenant(c)
+	policy := s.tracker.Retention()
+	_, tenantDays := s.tenants.Limits(tenant)
+	report := retentionPolicies{
+		TenantRetentionDays: tenantDays,
+		Interval:            policy.Interval.String(),
+		EmailMaxAge:         policy.EmailMaxAge.String(),
+		EventMaxAge:         policy.EventMaxAge.String(),
+		Campaigns:           []campaignRetention{},
+		EmailsByDays:        s.tracker.RetentionOverrides(tenant),
+	}
+	for _, campaign := range s.campaigns.All(tenant) {
+		if campaign.RetentionDays > 0 {
+			report.Campaigns = append(report.Campaigns, campaignRetention{
+				CampaignID:    campaign.ID,
+				Name:          campaign.Name,
+				RetentionDays: campaign.RetentionDays,
+			})
+		}
+	}
+	c.JSON(http.StatusOK, report)
+}
+
+// setCampaignRetention changes how long a campaign's emails are kept,
+// including the ones already sent. 0 goes back to the configured
+// retention.
+func (s *Server) setCampaignRetention(c *gin.Context) {
+	var req models.RetentionRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		bindError(c, err)
+		return
+	}
+
+	campaign, err := s.campaigns.SetRetention(c.Param("id"), *req.RetentionDays)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Campaign not found"})
+		return
+	}
+	updated := s.tracker.SetCampaignRetention(campaign.Tenant(), campaign.ID, campaign.RetentionDays)
+	s.recordAudit(c, audit.ActionCampaignRetention, campaign.ID, map[string]string{
+		"retention_days": strconv.Itoa(campaign.RetentionDays),
+		"emails":         strconv.Itoa(updated),
+	})
+
+	c.JSON(http.StatusOK, gin.H{"campaign": campaign, "emails_updated": updated})
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"expvar"
+	"net/http/pprof"
+	"runtime"
+	"strings"
+
+	"email-tracker/audit"
+
+	"github.com/gin-gonic/gin"
+)
+
+// setupDebugRoutes serves net/http/pprof under /debug/pprof and expvar
+// under /debug/vars. Besides the runtime's memstats and cmdline, the vars
+// include the tracker's in-memory sizes, the SMTP worker pool and the
+// goroutine count, to tell growing maps from leaking goroutines.
+func (s *Server) setupDebugRoutes(debug *gin.RouterGroup) {
+	expvar.Publish("tracker", expvar.Func(func() any { return s.tracker.StorageStats() }))
+	expvar.Publish("geo_queue", expvar.Func(func() any { return s.tracker.GeoQueue() }))
+	expvar.Publish("smtp_pool", expvar.Func(func() any { return s.notifier.PoolStats() }))
+	expvar.Publish("send_admission", expvar.Func(func() any { return s.sends.stats() }))
+	expvar.Publish("stats_cache", expvar.Func(func() any { return s.statsCache.stats() }))
+	expvar.Publish("circuit_breakers", expvar.Func(func() any { return s.circuitBreakers() }))
+	expvar.Publish("webhooks", expvar.Func(func() any { return s.webhooks.Stats() }))
+	expvar.Publish("data_loss", expvar.Func(func() any { return s.lossStats() }))
+	expvar.Publish("goroutines", expvar.Func(func() any { return runtime.NumGoroutine() }))
+
+	debug.Use(func(c *gin.Context) {
+		s.recordAudit(c, audit.ActionDebugAccess, c.Request.URL.Path, nil)
+	})
+
+	debug.GET("/vars", gin.WrapH(expvar.Handler()))
+	debug.GET("/pprof/*profile", servePprof)
+	debug.POST("/pprof/symbol", gin.WrapF(pprof.Symbol))
+}
+
+// servePprof dispatches to pprof's handlers; named profiles such as heap
+// and goroutine are served by pprof.Index.
+func servePprof(c *gin.Context) {
+	switch strings.TrimPrefix(c.Param("profile"), "/") {
+	case "cmdline":
+		pprof.Cmdline(c.Writer, c.Request)
+	case "profile":
+		pprof.Profile(c.Writer, c.Request)
+	case "symbol":
+		pprof.Symbol(c.Writer, c.Request)
+	case "trace":
+		pprof.Trace(c.Writer, c.Request)
+	default:
+		pprof.Index(c.Writer, c.Request)
+	}
+}
@@ -0,0 +1,427 @@
+// Package deliverability checks that mail from a domain is likely to pass
+// authentication at the receiver: its SPF record allows the SMTP server,
+// its DKIM keys are published and its DMARC policy won't reject the mail.
+package deliverability
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"email-tracker/config"
+	"email-tracker/utils"
+)
+
+// Guard modes for sends
+const (
+	GuardOff    = "off"
+	GuardWarn   = "warn"
+	GuardStrict = "strict"
+)
+
+// Issue severities. Errors mean mail will likely fail authentication and
+// block sends in strict mode; warnings are worth fixing but don't.
+const (
+	SeverityError   = "error"
+	SeverityWarning = "warning"
+)
+
+// ErrUnauthenticated matches, via errors.Is, sends refused by the strict
+// guard
+var ErrUnauthenticated = errors.New("mail from this domain would likely fail authentication")
+
+// Error is a send refused by the strict guard
+type Error struct {
+	Domain string
+	Issues []Issue
+}
+
+func (e *Error) Error() string {
+	messages := make([]string, 0, len(e.Issues))
+	for _, issue := range e.Issues {
+		if issue.Severity == SeverityError {
+			messages = append(messages, issue.Message)
+		}
+	}
+	return "mail from " + e.Domain + " would likely fail authentication: " + strings.Join(messages, "; ")
+}
+
+func (e *Error) Is(target error) bool {
+	return target == ErrUnauthenticated
+}
+
+// Resolver is the DNS lookups the checks need; *net.Resolver has them
+type Resolver interface {
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+	LookupMX(ctx context.Context, name string) ([]*net.MX, error)
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+}
+
+// Issue is one problem found with a domain's setup
+type Issue struct {
+	Severity string `json:"severity"`
+	// Check is spf, dkim, dmarc or smtp
+	Check   string `json:"check"`
+	Message string `json:"message"`
+}
+
+// SPFReport is the domain's SPF record and its result for each address
+// mail is sent from
+type SPFReport struct {
+	Record  string            `json:"record,omitempty"`
+	Results map[string]string `json:"results"`
+}
+
+// DKIMReport is whether a selector's public key is published
+type DKIMReport struct {
+	Selector  string `json:"selector"`
+	Published bool   `json:"published"`
+	Record    string `json:"record,omitempty"`
+}
+
+// DMARCReport is the DMARC policy that applies to the domain, found on the
+// domain itself or its organizational domain
+type DMARCReport struct {
+	Domain string `json:"domain,omitempty"`
+	Record string `json:"record,omitempty"`
+	Policy string `json:"policy,omitempty"`
+}
+
+// Report is the outcome of checking a domain. Pass is false when any issue
+// is an error.
+type Report struct {
+	Domain    string       `json:"domain"`
+	Pass      bool         `json:"pass"`
+	SPF       SPFReport    `json:"spf"`
+	DKIM      []DKIMReport `json:"dkim"`
+	DMARC     DMARCReport  `json:"dmarc"`
+	Issues    []Issue      `json:"issues"`
+	CheckedAt time.Time    `json:"checked_at"`
+}
+
+func (r *Report) add(severity, check, message string) {
+	r.Issues = append(r.Issues, Issue{Severity: severity, Check: check, Message: message})
+	if severity == SeverityError {
+		r.Pass = false
+	}
+}
+
+// settings are the checker's configuration, swapped as a whole on reload
+type settings struct {
+	guard      string
+	selectors  []string
+	sendingIPs []string
+	smtpHost   string
+	username   string
+	timeout    time.Duration
+	cacheTTL   time.Duration
+}
+
+// Via is what mail goes out through when not the configured SMTP server
+// and DKIM selectors, as for a tenant with its own. Empty fields keep the
+// configured ones.
+type Via struct {
+	SMTPHost      string
+	Username      string
+	DKIMSelectors []string
+}
+
+// through returns the settings for mail sent through via. The configured
+// sending IPs belong to the configured server, so another one goes by its
+// own addresses.
+func (s *settings) through(via *Via) *settings {
+	if via == nil {
+		return s
+	}
+	through := *s
+	if via.SMTPHost != "" {
+		through.smtpHost, through.username, through.sendingIPs = via.SMTPHost, via.Username, nil
+	}
+	if len(via.DKIMSelectors) > 0 {
+		through.selectors = via.DKIMSelectors
+	}
+	return &through
+}
+
+// cacheKey tells apart reports on the same domain made for different
+// servers and selectors
+func (s *settings) cacheKey(domain string) string {
+	return domain + " " + s.smtpHost + " " + strings.Join(s.selectors, ",")
+}
+
+// Checker runs the checks, caching the guard's reports per domain so sends
+// don't wait on DNS.
+type Checker struct {
+	resolver Resolver
+	settings atomic.Pointer[settings]
+
+	mu    sync.Mutex
+	cache map[string]*Report
+}
+
+// New returns a checker configured from cfg, resolving with r.
+func New(cfg *config.Config, r Resolver) *Checker {
+	c := &Checker{resolver: r, cache: make(map[string]*Report)}
+	c.ApplyConfig(cfg)
+	return c
+}
+
+// ApplyConfig switches to new settings and forgets cached reports, which
+// may have been made for another SMTP server.
+func (c *Checker) ApplyConfig(cfg *config.Config) {
+	c.settings.Store(&settings{
+		guard:      cfg.Deliverability.Guard,
+		selectors:  append([]string(nil), cfg.Deliverability.DKIMSelectors...),
+		sendingIPs: append([]string(nil), cfg.Deliverability.SendingIPs...),
+		smtpHost:   cfg.SMTP.Host,
+		username:   cfg.SMTP.Username,
+		timeout:    cfg.Timeouts.SMTP,
+		cacheTTL:   cfg.Deliverability.CacheTTL,
+	})
+	c.mu.Lock()
+	c.cache = make(map[string]*Report)
+	c.mu.Unlock()
+}
+
+// Guard checks the domain of from before a send. Off, it does nothing;
+// in warn mode problems are logged, once per check; in strict mode a
+// domain with errors is refused with an *Error.
+func (c *Checker) Guard(ctx context.Context, from string) error {
+	return c.GuardVia(ctx, from, nil)
+}
+
+// GuardVia is Guard for mail sent through via.
+func (c *Checker) GuardVia(ctx context.Context, from string, via *Via) error {
+	s := c.settings.Load().through(via)
+	if s.guard == GuardOff || s.guard == "" {
+		return nil
+	}
+	domain := utils.ExtractDomain(utils.NormalizeAddress(from))
+	key := s.cacheKey(domain)
+
+	c.mu.Lock()
+	report, ok := c.cache[key]
+	c.mu.Unlock()
+	if !ok || time.Since(report.CheckedAt) > s.cacheTTL {
+		report = c.check(ctx, s, domain)
+		c.mu.Lock()
+		c.cache[key] = report
+		c.mu.Unlock()
+		for _, issue := range report.Issues {
+			slog.Warn("sender domain authentication issue", "domain", domain, "severity", issue.Severity,
+				"check", issue.Check, "issue", issue.Message)
+		}
+	}
+
+	if !report.Pass && s.guard == GuardStrict {
+		return &Error{Domain: domain, Issues: report.Issues}
+	}
+	return nil
+}
+
+// Check resolves domain's SPF, DKIM and DMARC records and reports whether
+// mail from it through the configured SMTP server would pass.
+func (c *Checker) Check(ctx context.Context, domain string) *Report {
+	return c.CheckVia(ctx, domain, nil)
+}
+
+// CheckVia is Check for mail sent through via.
+func (c *Checker) CheckVia(ctx context.Context, domain string, via *Via) *Report {
+	return c.check(ctx, c.settings.Load().through(via), domain)
+}
+
+func (c *Checker) check(ctx context.Context, s *settings, domain string) *Report {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+
+	report := &Report{
+		Domain:    strings.ToLower(domain),
+		Pass:      true,
+		SPF:       SPFReport{Results: map[string]string{}},
+		DKIM:      []DKIMReport{},
+		CheckedAt: time.Now(),
+	}
+	spfPass := c.checkSPF(ctx, s, report)
+	dkimPass := c.checkDKIM(ctx, s, report)
+	c.checkDMARC(ctx, report, spfPass, dkimPass)
+	checkSMTPAlignment(s, report)
+	return report
+}
+
+// checkSPF evaluates the SPF policy for every address mail leaves from:
+// DELIVERABILITY_SENDING_IPS when set, the SMTP server's addresses
+// otherwise. Returns whether they all pass.
+func (c *Checker) checkSPF(ctx context.Context, s *settings, report *Report) bool {
+	record, result := spfRecord(ctx, c.resolver, report.Domain)
+	report.SPF.Record = record
+	switch result {
+	case SPFNone:
+		report.add(SeverityError, "spf", "no SPF record; publish one authorizing your SMTP provider")
+		return false
+	case SPFTempError:
+		report.add(SeverityWarning, "spf", "SPF record could not be looked up, try again later")
+		return false
+	case SPFPermError:
+		report.add(SeverityError, "spf", "more than one SPF record; receivers treat that as a permanent error")
+		return false
+	}
+	if strings.Contains(strings.ToLower(record), "+all") {
+		report.add(SeverityWarning, "spf", "SPF record ends in +all, which lets anyone send as the domain")
+	}
+
+	ips, err := c.sendingIPs(ctx, s)
+	if err != nil || len(ips) == 0 {
+		report.add(SeverityWarning, "spf", "could not resolve the SMTP host to check SPF against it")
+		return false
+	}
+	pass := true
+	for _, ip := range ips {
+		evaluator := &spfEvaluator{resolver: c.resolver, ip: ip}
+		result := evaluator.check(ctx, report.Domain)
+		report.SPF.Results[ip.String()] = result
+		switch result {
+		case SPFPass:
+			continue
+		case SPFFail, SPFPermError:
+			report.add(SeverityError, "spf", "SPF "+result+" for "+ip.String())
+		default:
+			report.add(SeverityWarning, "spf", "SPF "+result+" for "+ip.String())
+		}
+		pass = false
+	}
+	return pass
+}
+
+func (c *Checker) sendingIPs(ctx context.Context, s *settings) ([]net.IP, error) {
+	var ips []net.IP
+	for _, raw := range s.sendingIPs {
+		if ip := net.ParseIP(raw); ip != nil {
+			ips = append(ips, ip)
+		}
+	}
+	if len(s.sendingIPs) > 0 {
+		return ips, nil
+	}
+	if ip := net.ParseIP(s.smtpHost); ip != nil {
+		return []net.IP{ip}, nil
+	}
+	addrs, err := c.resolver.LookupIPAddr(ctx, s.smtpHost)
+	for _, addr := range addrs {
+		ips = append(ips, addr.IP)
+	}
+	return ips, err
+}
+
+// checkDKIM looks up each configured selector's key. Returns whether at
+// least one is published.
+func (c *Checker) checkDKIM(ctx context.Context, s *settings, report *Report) bool {
+	if len(s.selectors) == 0 {
+		report.add(SeverityWarning, "dkim", "DKIM not checked; list your provider's selectors in DELIVERABILITY_DKIM_SELECTORS")
+		return false
+	}
+	published := false
+	for _, selector := range s.selectors {
+		result := DKIMReport{Selector: selector}
+		txts, err := c.resolver.LookupTXT(ctx, selector+"._domainkey."+report.Domain)
+		if err != nil && !notFound(err) {
+			report.add(SeverityWarning, "dkim", "DKIM selector "+selector+" could not be looked up, try again later")
+		}
+		for _, txt := range txts {
+			if key := dkimKey(txt); key != "" {
+				result.Published, result.Record = true, txt
+			}
+		}
+		if !result.Published && (err == nil || notFound(err)) {
+			report.add(SeverityError, "dkim", "no DKIM key published for selector "+selector)
+		}
+		published = published || result.Published
+		report.DKIM = append(report.DKIM, result)
+	}
+	return published
+}
+
+// dkimKey returns the p= tag of a DKIM key record; empty means revoked
+func dkimKey(record string) string {
+	for _, tag := range strings.Split(record, ";") {
+		if name, value, ok := strings.Cut(strings.TrimSpace(tag), "="); ok && strings.TrimSpace(name) == "p" {
+			return strings.TrimSpace(value)
+		}
+	}
+	return ""
+}
+
+// checkDMARC finds the DMARC policy and whether mail passing neither SPF
+// nor DKIM would be rejected by it. The envelope sender is the From
+// address, so SPF aligns whenever it passes, and DKIM keys are looked up
+// under the From domain, so they align too.
+func (c *Checker) checkDMARC(ctx context.Context, report *Report, spfPass, dkimPass bool) {
+	for _, domain := range []string{report.Domain, organizationalDomain(report.Domain)} {
+		txts, err := c.resolver.LookupTXT(ctx, "_dmarc."+domain)
+		if err != nil && !notFound(err) {
+			report.add(SeverityWarning, "dmarc", "DMARC record could not be looked up, try again later")
+			return
+		}
+		for _, txt := range txts {
+			if strings.HasPrefix(strings.ToLower(strings.TrimSpace(txt)), "v=dmarc1") {
+				report.DMARC = DMARCReport{Domain: domain, Record: txt, Policy: dmarcPolicy(txt)}
+				break
+			}
+		}
+		if report.DMARC.Record != "" || domain == organizationalDomain(report.Domain) {
+			break
+		}
+	}
+
+	if report.DMARC.Record == "" {
+		report.add(SeverityWarning, "dmarc", "no DMARC record; major mailbox providers expect one from bulk senders")
+		return
+	}
+	if spfPass || dkimPass {
+		return
+	}
+	switch report.DMARC.Policy {
+	case "reject", "quarantine":
+		report.add(SeverityError, "dmarc", "DMARC policy is "+report.DMARC.Policy+" and mail would pass neither SPF nor DKIM")
+	default:
+		report.add(SeverityWarning, "dmarc", "mail would fail DMARC, though the policy only monitors it")
+	}
+}
+
+func dmarcPolicy(record string) string {
+	for _, tag := range strings.Split(record, ";") {
+		if name, value, ok := strings.Cut(strings.TrimSpace(tag), "="); ok && strings.TrimSpace(name) == "p" {
+			return strings.ToLower(strings.TrimSpace(value))
+		}
+	}
+	return ""
+}
+
+// organizationalDomain is the registered domain, taken as the last two
+// labels. Public suffixes like co.uk aren't known, so such domains are
+// only checked at their own level.
+func organizationalDomain(domain string) string {
+	labels := strings.Split(domain, ".")
+	if len(labels) <= 2 {
+		return domain
+	}
+	return strings.Join(labels[len(labels)-2:], ".")
+}
+
+// checkSMTPAlignment warns when the SMTP login belongs to another domain
+// than the one mail is sent from. Providers then sign with their own
+// domain, which doesn't align with From.
+func checkSMTPAlignment(s *settings, report *Report) {
+	if !strings.Contains(s.username, "@") {
+		return
+	}
+	login := organizationalDomain(utils.ExtractDomain(strings.ToLower(s.username)))
+	if login != "" && login != organizationalDomain(report.Domain) {
+		report.add(SeverityWarning, "smtp", "SMTP login is at "+login+"; unless the provider signs for "+
+			report.Domain+", its DKIM signature won't align with From")
+	}
+}
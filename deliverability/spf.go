@@ -0,0 +1,206 @@
+package deliverability
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+)
+
+// SPF results, as in RFC 7208
+const (
+	SPFPass      = "pass"
+	SPFFail      = "fail"
+	SPFSoftFail  = "softfail"
+	SPFNeutral   = "neutral"
+	SPFNone      = "none"
+	SPFPermError = "permerror"
+	SPFTempError = "temperror"
+)
+
+// maxSPFLookups is the DNS lookup limit a receiver enforces, past which
+// the record is a permerror
+const maxSPFLookups = 10
+
+var qualifiers = map[byte]string{'+': SPFPass, '-': SPFFail, '~': SPFSoftFail, '?': SPFNeutral}
+
+// spfRecord returns domain's SPF record. More than one is a permerror.
+func spfRecord(ctx context.Context, r Resolver, domain string) (string, string) {
+	txts, err := r.LookupTXT(ctx, domain)
+	if err != nil {
+		if notFound(err) {
+			return "", SPFNone
+		}
+		return "", SPFTempError
+	}
+	var records []string
+	for _, txt := range txts {
+		if lower := strings.ToLower(txt); lower == "v=spf1" || strings.HasPrefix(lower, "v=spf1 ") {
+			records = append(records, txt)
+		}
+	}
+	switch len(records) {
+	case 0:
+		return "", SPFNone
+	case 1:
+		return records[0], ""
+	default:
+		return strings.Join(records, " | "), SPFPermError
+	}
+}
+
+// spfEvaluator checks one IP against a domain's SPF policy, following
+// include and redirect. exists and ptr are never matched, as they are
+// rare and can't be evaluated without the message.
+type spfEvaluator struct {
+	resolver Resolver
+	ip       net.IP
+	lookups  int
+}
+
+func (e *spfEvaluator) check(ctx context.Context, domain string) string {
+	record, result := spfRecord(ctx, e.resolver, domain)
+	if result != "" {
+		return result
+	}
+
+	var redirect string
+	for _, term := range strings.Fields(record)[1:] {
+		lower := strings.ToLower(term)
+		if name, value, ok := strings.Cut(lower, "="); ok && !strings.ContainsAny(name, ":/") {
+			if name == "redirect" {
+				redirect = value
+			}
+			continue
+		}
+
+		qualifier := SPFPass
+		if q, ok := qualifiers[lower[0]]; ok {
+			qualifier = q
+			lower = lower[1:]
+		}
+		matched, err := e.match(ctx, domain, lower)
+		if err != "" {
+			return err
+		}
+		if matched {
+			return qualifier
+		}
+	}
+
+	if redirect != "" {
+		if e.lookups++; e.lookups > maxSPFLookups {
+			return SPFPermError
+		}
+		result := e.check(ctx, redirect)
+		if result == SPFNone {
+			return SPFPermError
+		}
+		return result
+	}
+	return SPFNeutral
+}
+
+// match reports whether mechanism covers the IP, or the error result that
+// ends the evaluation.
+func (e *spfEvaluator) match(ctx context.Context, domain, mechanism string) (bool, string) {
+	name, arg, _ := strings.Cut(mechanism, ":")
+	if name != mechanism && arg == "" {
+		return false, SPFPermError
+	}
+	name, cidr, _ := strings.Cut(name, "/")
+	if arg != "" {
+		arg, cidr, _ = strings.Cut(arg, "/")
+	}
+
+	switch name {
+	case "all":
+		return true, ""
+	case "ip4", "ip6":
+		if !strings.Contains(arg, "/") && cidr != "" {
+			arg += "/" + cidr
+		}
+		return containsIP(arg, e.ip), ""
+	case "include":
+		if e.lookups++; e.lookups > maxSPFLookups {
+			return false, SPFPermError
+		}
+		switch result := e.check(ctx, arg); result {
+		case SPFPass:
+			return true, ""
+		case SPFTempError:
+			return false, SPFTempError
+		case SPFPermError, SPFNone:
+			return false, SPFPermError
+		}
+		return false, ""
+	case "a", "mx":
+		if e.lookups++; e.lookups > maxSPFLookups {
+			return false, SPFPermError
+		}
+		target := domain
+		if arg != "" {
+			target = arg
+		}
+		hosts := []string{target}
+		if name == "mx" {
+			mxs, err := e.resolver.LookupMX(ctx, target)
+			if err != nil && !notFound(err) {
+				return false, SPFTempError
+			}
+			hosts = hosts[:0]
+			for _, mx := range mxs {
+				hosts = append(hosts, mx.Host)
+			}
+		}
+		for _, host := range hosts {
+			addrs, err := e.resolver.LookupIPAddr(ctx, host)
+			if err != nil && !notFound(err) {
+				return false, SPFTempError
+			}
+			for _, addr := range addrs {
+				if containsIP(prefix(addr.IP, cidr), e.ip) {
+					return true, ""
+				}
+			}
+		}
+		return false, ""
+	case "exists", "ptr":
+		e.lookups++
+		return false, ""
+	}
+	return false, SPFPermError
+}
+
+// prefix returns ip as a network with the a/mx mechanism's prefix length,
+// "24" or "24//64" style, applied
+func prefix(ip net.IP, cidr string) string {
+	v4, v6 := "32", "128"
+	if cidr != "" {
+		four, six, _ := strings.Cut(cidr, "//")
+		if four != "" {
+			v4 = four
+		}
+		if six != "" {
+			v6 = six
+		}
+	}
+	if ip.To4() != nil {
+		return ip.String() + "/" + v4
+	}
+	return ip.String() + "/" + v6
+}
+
+func containsIP(network string, ip net.IP) bool {
+	if !strings.Contains(network, "/") {
+		parsed := net.ParseIP(network)
+		return parsed != nil && parsed.Equal(ip)
+	}
+	_, ipNet, err := net.ParseCIDR(network)
+	return err == nil && ipNet.Contains(ip)
+}
+
+func notFound(err error) bool {
+	var dnsErr *net.DNSError
+	return errors.As(err, &dnsErr) && dnsErr.IsNotFound
+}
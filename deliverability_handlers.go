@@ -0,0 +1,31 @@
+package main
+
+import (
+	"net/http"
+	"regexp"
+	"strings"
+
+	"email-tracker/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+var domainPattern = regexp.MustCompile(`^([a-z0-9]([a-z0-9-]*[a-z0-9])?\.)+[a-z]{2,}$`)
+
+// checkDeliverability reports whether mail from ?domain=, by default the
+// tenant's From domain, would pass SPF, DKIM and DMARC through the
+// tenant's SMTP server and DKIM selector, or the configured ones. Always
+// looks the records up afresh.
+func (s *Server) checkDeliverability(c *gin.Context) {
+	tenant := currentTenant(c)
+	domain := strings.ToLower(strings.TrimSpace(c.Query("domain")))
+	if domain == "" {
+		domain = utils.ExtractDomain(utils.NormalizeAddress(s.notifier.FromFor(s.tenants.Account(tenant))))
+	}
+	if !domainPattern.MatchString(domain) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid domain"})
+		return
+	}
+
+	c.JSON(http.StatusOK, s.deliverability.CheckVia(c.Request.Context(), domain, s.tenants.Via(tenant)))
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+
+	"email-tracker/breaker"
+	"email-tracker/consent"
+	"email-tracker/deliverability"
+	"email-tracker/logging"
+	"email-tracker/notification"
+	"email-tracker/suppression"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	"github.com/go-playground/validator/v10"
+)
+
+// serverError answers a failure whose details are for operators only.
+// The caller gets message, which must be safe to show, and the request
+// ID; err is logged under that ID.
+func (s *Server) serverError(c *gin.Context, status int, message string, err error) {
+	logging.FromContext(c.Request.Context()).Error(message, "path", c.FullPath(), "error", err)
+	c.JSON(status, gin.H{"error": message, "request_id": c.Writer.Header().Get("X-Request-ID")})
+}
+
+// sendErrorMessage is what callers are told about a failed send. Refusals
+// of our own, like a suppressed recipient or an open circuit, are
+// explained; anything the mail server said stays in the logs.
+func sendErrorMessage(err error) string {
+	if errors.Is(err, suppression.ErrSuppressed) || errors.Is(err, consent.ErrUnconfirmed) || errors.Is(err, deliverability.ErrUnauthenticated) || errors.Is(err, breaker.ErrOpen) ||
+		errors.Is(err, notification.ErrQueueFull) || errors.Is(err, notification.ErrClosed) {
+		return err.Error()
+	}
+	return "failed to send email"
+}
+
+// bindError answers a JSON body that didn't bind. Validation failures are
+// described by the JSON field names rather than the Go types behind them,
+// and decoding errors don't echo the input.
+func bindError(c *gin.Context, err error) {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": fmt.Sprintf("request body larger than %d bytes", tooLarge.Limit)})
+		return
+	}
+	c.JSON(http.StatusBadRequest, gin.H{"error": bindErrorMessage(err)})
+}
+
+func bindErrorMessage(err error) string {
+	var invalid validator.ValidationErrors
+	if errors.As(err, &invalid) {
+		messages := make([]string, 0, len(invalid))
+		for _, field := range invalid {
+			messages = append(messages, fieldErrorMessage(field))
+		}
+		return strings.Join(messages, "; ")
+	}
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &typeErr) && typeErr.Field != "" {
+		return typeErr.Field + " has the wrong type"
+	}
+	return "invalid JSON body"
+}
+
+func fieldErrorMessage(field validator.FieldError) string {
+	switch field.Tag() {
+	case "required":
+		return field.Field() + " is required"
+	case "min":
+		return field.Field() + " must be at least " + field.Param()
+	case "max":
+		return field.Field() + " must be at most " + field.Param()
+	case "email":
+		return field.Field() + " must be an email address"
+	case "oneof":
+		return field.Field() + " must be one of " + field.Param()
+	}
+	return field.Field() + " is invalid"
+}
+
+// useJSONFieldNames makes validation errors name fields as clients send
+// them.
+func useJSONFieldNames() {
+	v, ok := binding.Validator.Engine().(*validator.Validate)
+	if !ok {
+		return
+	}
+	v.RegisterTagNameFunc(func(field reflect.StructField) string {
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if name == "" || name == "-" {
+			return field.Name
+		}
+		return name
+	})
+}
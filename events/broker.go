@@ -0,0 +1,91 @@
+package events
+
+import (
+	"sync"
+	"time"
+
+	"email-tracker/utils"
+)
+
+// Event types published by the tracker
+const (
+	TypeOpen  = "open"
+	TypeClick = "click"
+)
+
+// Event is a tracking activity pushed to live subscribers such as the
+// dashboard. Subscribers only pass on the events of their own Tenant.
+type Event struct {
+	Type        string    `json:"type"`
+	Tenant      string    `json:"-"`
+	TrackingID  string    `json:"tracking_id"`
+	CampaignID  string    `json:"campaign_id,omitempty"`
+	Subject     string    `json:"subject"`
+	Recipient   string    `json:"recipient"`
+	City        string    `json:"city,omitempty"`
+	Country     string    `json:"country,omitempty"`
+	DeviceType  string    `json:"device_type,omitempty"`
+	Browser     string    `json:"browser,omitempty"`
+	EmailClient string    `json:"email_client,omitempty"`
+	OS          string    `json:"os,omitempty"`
+	URL         string    `json:"url,omitempty"`
+	IsBot       bool      `json:"is_bot"`
+	TotalOpens  int       `json:"total_opens"`
+	UniqueOpens int       `json:"unique_opens"`
+	TotalClicks int       `json:"total_clicks"`
+	At          time.Time `json:"at"`
+}
+
+// subscriberBuffer is how many events a subscriber may fall behind before
+// further events are dropped for it.
+const subscriberBuffer = 32
+
+// Broker fans tracking events out to every subscriber. Publishing never
+// blocks, so a slow client can't hold up the tracking pixel.
+type Broker struct {
+	mu          sync.Mutex
+	subscribers map[chan Event]struct{}
+	dropped     utils.LossCounter
+}
+
+func NewBroker() *Broker {
+	return &Broker{subscribers: make(map[chan Event]struct{})}
+}
+
+// Subscribe returns a channel receiving every published event and a function
+// that must be called to stop receiving them.
+func (b *Broker) Subscribe() (<-chan Event, func()) {
+	ch := make(chan Event, subscriberBuffer)
+
+	b.mu.Lock()
+	b.subscribers[ch] = struct{}{}
+	b.mu.Unlock()
+
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			b.mu.Lock()
+			delete(b.subscribers, ch)
+			b.mu.Unlock()
+			close(ch)
+		})
+	}
+}
+
+func (b *Broker) Publish(event Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for ch := range b.subscribers {
+		select {
+		case ch <- event:
+		default:
+			b.dropped.Add(1)
+		}
+	}
+}
+
+// Dropped counts events a subscriber missed because it fell too far behind.
+func (b *Broker) Dropped() utils.LossCount {
+	return b.dropped.Snapshot()
+}
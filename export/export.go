@@ -0,0 +1,183 @@
+package export
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"email-tracker/analytics"
+	"email-tracker/models"
+
+	"github.com/xuri/excelize/v2"
+)
+
+const (
+	sheetSummary    = "Summary"
+	sheetRecipients = "Recipients"
+	sheetTimeSeries = "Time Series"
+	sheetGeo        = "Geo"
+)
+
+// Data is the analytics scope being exported: emails sent within the range
+// and the open events that belong to them. With Filtered set, email
+// aggregates exclude bots; Events are expected to be filtered already.
+type Data struct {
+	Title    string
+	From     time.Time
+	To       time.Time
+	Filtered bool
+	Emails   []*models.Email
+	Events   []*models.TrackingEvent
+}
+
+var recipientHeader = []string{
+	"Tracking ID", "Recipient", "Subject", "Campaign", "Sent At", "Delivery Status",
+	"Total Opens", "Unique Opens", "First Open", "Last Open", "Clicks", "Countries", "Devices",
+}
+
+// Workbook builds an .xlsx workbook with summary, per-recipient, daily
+// time-series and geo sheets.
+func Workbook(data *Data) (*excelize.File, error) {
+	f := excelize.NewFile()
+
+	if err := f.SetSheetName("Sheet1", sheetSummary); err != nil {
+		return nil, err
+	}
+	for _, name := range []string{sheetRecipients, sheetTimeSeries, sheetGeo} {
+		if _, err := f.NewSheet(name); err != nil {
+			return nil, err
+		}
+	}
+
+	writers := []func(*excelize.File, *Data) error{
+		writeSummary, writeRecipients, writeTimeSeries, writeGeo,
+	}
+	for _, write := range writers {
+		if err := write(f, data); err != nil {
+			return nil, err
+		}
+	}
+
+	return f, nil
+}
+
+// RecipientsCSV writes the per-recipient detail as CSV, for tools that can't
+// read workbooks.
+func RecipientsCSV(w io.Writer, data *Data) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write(recipientHeader); err != nil {
+		return err
+	}
+	for _, email := range data.Emails {
+		row := recipientRow(email, data.Filtered)
+		record := make([]string, len(row))
+		for i, v := range row {
+			record[i] = fmt.Sprint(v)
+		}
+		if err := cw.Write(record); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+func writeSummary(f *excelize.File, data *Data) error {
+	s := analytics.Summarize(data.Emails, data.From, data.To, data.Filtered)
+
+	rows := [][]interface{}{
+		{"Report", data.Title},
+		{"From", data.From.Format(time.RFC3339)},
+		{"To", data.To.Format(time.RFC3339)},
+		{"Bots filtered", data.Filtered},
+		{},
+		{"Emails sent", s.EmailsSent},
+		{"Delivered", s.Delivered},
+		{"Bounced", s.Bounced},
+		{"Opened emails", s.OpenedEmails},
+		{"Clicked emails", s.ClickedEmails},
+		{"Open rate (%)", s.OpenRate},
+		{"Click rate (%)", s.ClickRate},
+		{"Total opens", s.TotalOpens},
+		{"Total clicks", s.TotalClicks},
+	}
+	return writeRows(f, sheetSummary, rows)
+}
+
+func writeRecipients(f *excelize.File, data *Data) error {
+	rows := [][]interface{}{toRow(recipientHeader)}
+	for _, email := range data.Emails {
+		rows = append(rows, recipientRow(email, data.Filtered))
+	}
+	return writeRows(f, sheetRecipients, rows)
+}
+
+func writeTimeSeries(f *excelize.File, data *Data) error {
+	rows := [][]interface{}{{"Day", "Opens"}}
+
+	points, err := analytics.TimeSeries(data.Events, 24*time.Hour, data.From, data.To)
+	if err != nil {
+		return fmt.Errorf("time series: %w", err)
+	}
+	for _, p := range points {
+		rows = append(rows, []interface{}{p.Start.Format("2006-01-02"), p.Opens})
+	}
+	return writeRows(f, sheetTimeSeries, rows)
+}
+
+func writeGeo(f *excelize.File, data *Data) error {
+	rows := [][]interface{}{{"Country", "Region", "City", "Opens", "Percentage"}}
+	for _, share := range analytics.Geo(data.Events).Cities {
+		rows = append(rows, []interface{}{share.Country, share.Region, share.City, share.Opens, share.Percentage})
+	}
+	return writeRows(f, sheetGeo, rows)
+}
+
+func recipientRow(email *models.Email, filtered bool) []interface{} {
+	stats := email.OpenStats(filtered)
+	return []interface{}{
+		email.TrackingID,
+		email.To,
+		email.Subject,
+		email.CampaignID,
+		email.SentAt.Format(time.RFC3339),
+		email.DeliveryStatus,
+		stats.TotalOpens,
+		stats.UniqueOpens,
+		formatOptionalTime(stats.FirstOpenAt),
+		formatOptionalTime(stats.LastOpenAt),
+		stats.TotalClicks,
+		strings.Join(stats.Countries, ", "),
+		strings.Join(stats.Devices, ", "),
+	}
+}
+
+func writeRows(f *excelize.File, sheet string, rows [][]interface{}) error {
+	for i, row := range rows {
+		if len(row) == 0 {
+			continue
+		}
+		if err := f.SetSheetRow(sheet, "A"+strconv.Itoa(i+1), &row); err != nil {
+			return fmt.Errorf("%s sheet: %w", sheet, err)
+		}
+	}
+	return nil
+}
+
+func toRow(values []string) []interface{} {
+	row := make([]interface{}, len(values))
+	for i, v := range values {
+		row[i] = v
+	}
+	return row
+}
+
+func formatOptionalTime(t *time.Time) string {
+	if t == nil {
+		return ""
+	}
+	return t.Format(time.RFC3339)
+}
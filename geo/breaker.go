@@ -0,0 +1,57 @@
+package geo
+
+import (
+	"context"
+	"errors"
+
+	"email-tracker/breaker"
+	"email-tracker/config"
+	"email-tracker/models"
+)
+
+// Guarded stops sending lookups to a provider that keeps failing. While its
+// breaker is open, lookups are refused with a throttled QuotaError, so the
+// chain moves on to the next provider and opens nobody could locate wait in
+// the backfill queue until the breaker lets a probe through.
+type Guarded struct {
+	provider Provider
+	breaker  *breaker.Breaker
+}
+
+// NewGuarded wraps provider in a circuit breaker configured by
+// BREAKER_FAILURE_THRESHOLD and BREAKER_COOLDOWN.
+func NewGuarded(cfg *config.Config, provider Provider) *Guarded {
+	return &Guarded{
+		provider: provider,
+		breaker:  breaker.New("geo:"+provider.Name(), cfg.Breakers.Threshold, cfg.Breakers.Cooldown),
+	}
+}
+
+func (g *Guarded) Name() string { return g.provider.Name() }
+
+func (g *Guarded) Lookup(ctx context.Context, ip string) (*models.GeoLocation, error) {
+	var location *models.GeoLocation
+	err := g.breaker.Do(func() (err error) {
+		location, err = g.provider.Lookup(ctx, ip)
+		return err
+	}, unavailable)
+
+	var openErr *breaker.OpenError
+	if errors.As(err, &openErr) {
+		return nil, &QuotaError{Provider: g.Name(), RetryAfter: openErr.RetryAfter, Throttled: true, Err: err}
+	}
+	return location, err
+}
+
+// Breaker reports the state of the provider's circuit breaker.
+func (g *Guarded) Breaker() breaker.Status {
+	return g.breaker.Status()
+}
+
+// unavailable reports whether a lookup error says the provider is down or
+// unreachable. Quota and API key refusals come back quickly and are handled
+// on their own, and a caller giving up says nothing about the provider.
+func unavailable(err error) bool {
+	return !errors.Is(err, ErrQuotaExceeded) && !errors.Is(err, ErrUnauthorized) &&
+		!errors.Is(err, context.Canceled)
+}
@@ -0,0 +1,170 @@
+package geo
+
+import (
+	"container/list"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"email-tracker/config"
+	"email-tracker/models"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	cacheKeyPrefix = "email-tracker:geo:"
+
+	// Redis is a shortcut, not a dependency: give up quickly and ask the
+	// provider instead
+	redisTimeout = 200 * time.Millisecond
+)
+
+// Cache remembers successful lookups so repeated opens from one address,
+// such as Gmail's image proxy, don't spend provider quota or add latency.
+// Results are kept in an in-memory LRU and, when Redis is enabled, in Redis
+// as well so they survive restarts and are shared between instances.
+type Cache struct {
+	provider Provider
+	ttl      time.Duration
+	size     int
+	redis    *redis.Client
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	order   *list.List // front is most recently used
+}
+
+type cacheEntry struct {
+	ip        string
+	location  *models.GeoLocation
+	expiresAt time.Time
+}
+
+// NewCache wraps provider with a cache of GEO_CACHE_SIZE entries kept for
+// GEO_CACHE_TTL. A size of 0 disables caching.
+func NewCache(cfg *config.Config, provider Provider) Provider {
+	if cfg.GeoAPI.CacheSize <= 0 {
+		return provider
+	}
+
+	c := &Cache{
+		provider: provider,
+		ttl:      cfg.GeoAPI.CacheTTL,
+		size:     cfg.GeoAPI.CacheSize,
+		entries:  make(map[string]*list.Element),
+		order:    list.New(),
+	}
+	if cfg.Redis.Enabled {
+		c.redis = redis.NewClient(&redis.Options{
+			Addr:     fmt.Sprintf("%s:%d", cfg.Redis.Host, cfg.Redis.Port),
+			Password: cfg.Redis.Password,
+			DB:       cfg.Redis.DB,
+		})
+	}
+	return c
+}
+
+func (c *Cache) Name() string { return c.provider.Name() }
+
+func (c *Cache) Lookup(ctx context.Context, ip string) (*models.GeoLocation, error) {
+	if location, ok := c.get(ip); ok {
+		return location, nil
+	}
+	if location, ok := c.getRedis(ctx, ip); ok {
+		c.put(ip, location)
+		return location, nil
+	}
+
+	location, err := c.provider.Lookup(ctx, ip)
+	if err != nil {
+		return nil, err
+	}
+	c.put(ip, location)
+	go c.putRedis(ip, location)
+	return location, nil
+}
+
+func (c *Cache) get(ip string) (*models.GeoLocation, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[ip]
+	if !ok {
+		return nil, false
+	}
+	entry := elem.Value.(*cacheEntry)
+	if time.Now().After(entry.expiresAt) {
+		c.order.Remove(elem)
+		delete(c.entries, ip)
+		return nil, false
+	}
+	c.order.MoveToFront(elem)
+
+	location := *entry.location
+	return &location, true
+}
+
+func (c *Cache) put(ip string, location *models.GeoLocation) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	stored := *location
+	entry := &cacheEntry{ip: ip, location: &stored, expiresAt: time.Now().Add(c.ttl)}
+	if elem, ok := c.entries[ip]; ok {
+		elem.Value = entry
+		c.order.MoveToFront(elem)
+		return
+	}
+
+	c.entries[ip] = c.order.PushFront(entry)
+	if c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).ip)
+	}
+}
+
+func (c *Cache) getRedis(ctx context.Context, ip string) (*models.GeoLocation, bool) {
+	if c.redis == nil {
+		return nil, false
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, redisTimeout)
+	defer cancel()
+
+	data, err := c.redis.Get(ctx, cacheKeyPrefix+ip).Bytes()
+	if err != nil {
+		if err != redis.Nil {
+			slog.Warn("failed to read geo cache from Redis", "error", err)
+		}
+		return nil, false
+	}
+
+	var location models.GeoLocation
+	if err := json.Unmarshal(data, &location); err != nil {
+		return nil, false
+	}
+	return &location, true
+}
+
+func (c *Cache) putRedis(ip string, location *models.GeoLocation) {
+	if c.redis == nil {
+		return
+	}
+
+	data, err := json.Marshal(location)
+	if err != nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+
+	if err := c.redis.Set(ctx, cacheKeyPrefix+ip, data, c.ttl).Err(); err != nil {
+		slog.Warn("failed to write geo cache to Redis", "error", err)
+	}
+}
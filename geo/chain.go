@@ -0,0 +1,183 @@
+package geo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"email-tracker/breaker"
+	"email-tracker/config"
+	"email-tracker/models"
+)
+
+// ErrUnknownLocation is returned when no provider in the chain could locate
+// an address
+var ErrUnknownLocation = errors.New("could not determine location")
+
+// Chain asks its providers in order and returns the first answer, so a
+// provider that errors or runs out of quota falls back to the next one.
+type Chain struct {
+	providers []Provider
+
+	mu    sync.Mutex
+	stats []ProviderStats
+}
+
+// ProviderStats counts how a provider in the chain has been doing
+type ProviderStats struct {
+	Name          string     `json:"name"`
+	Successes     uint64     `json:"successes"`
+	Failures      uint64     `json:"failures"`
+	QuotaExceeded uint64     `json:"quota_exceeded"`
+	Throttled     uint64     `json:"throttled"`
+	FailureRate   float64    `json:"failure_rate"`
+	LastError     string     `json:"last_error,omitempty"`
+	LastFailureAt *time.Time `json:"last_failure_at,omitempty"`
+}
+
+// NewChain builds the providers listed in GEO_PROVIDERS. Providers that
+// can't be set up, such as MaxMind without its database, are left out and
+// reported in the error; if none are left, ip-api is used. HTTP providers
+// share client.
+func NewChain(cfg *config.Config, client *http.Client) (*Chain, error) {
+	c := &Chain{}
+
+	var errs []error
+	for _, name := range cfg.GeoAPI.Providers {
+		provider, err := NewNamedProvider(cfg, client, name)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("geo provider %s: %w", name, err))
+			continue
+		}
+		c.providers = append(c.providers, provider)
+	}
+	if len(c.providers) == 0 {
+		c.providers = append(c.providers, NewGuarded(cfg, NewIPAPI(client, "", "")))
+	}
+
+	c.stats = make([]ProviderStats, len(c.providers))
+	for i, provider := range c.providers {
+		c.stats[i].Name = provider.Name()
+	}
+	return c, errors.Join(errs...)
+}
+
+// Name lists the providers, e.g. "maxmind>ip-api"
+func (c *Chain) Name() string {
+	name := ""
+	for i, provider := range c.providers {
+		if i > 0 {
+			name += ">"
+		}
+		name += provider.Name()
+	}
+	return name
+}
+
+// Lookup returns the first provider's answer. If every provider was out of
+// quota the error is a QuotaError, with the soonest RetryAfter, so the
+// lookup can be retried later.
+func (c *Chain) Lookup(ctx context.Context, ip string) (*models.GeoLocation, error) {
+	var failures []string
+	quota := &QuotaError{Provider: c.Name()}
+	for i, provider := range c.providers {
+		location, err := provider.Lookup(ctx, ip)
+		c.record(i, err)
+		if err == nil {
+			return location, nil
+		}
+		failures = append(failures, provider.Name()+": "+err.Error())
+
+		var quotaErr *QuotaError
+		if quota != nil && errors.As(err, &quotaErr) {
+			if quota.RetryAfter == 0 || (quotaErr.RetryAfter > 0 && quotaErr.RetryAfter < quota.RetryAfter) {
+				quota.RetryAfter = quotaErr.RetryAfter
+			}
+		} else {
+			quota = nil
+		}
+
+		// Everyone shares the deadline; don't start lookups bound to fail
+		if ctx.Err() != nil {
+			quota = nil
+			break
+		}
+	}
+	if quota != nil {
+		return nil, fmt.Errorf("%w: %w: %s", ErrUnknownLocation, quota, strings.Join(failures, "; "))
+	}
+	return nil, fmt.Errorf("%w: %s", ErrUnknownLocation, strings.Join(failures, "; "))
+}
+
+func (c *Chain) record(i int, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	stats := &c.stats[i]
+	if err == nil {
+		stats.Successes++
+		return
+	}
+
+	// Held back by our own limiter: the provider itself is fine
+	var quotaErr *QuotaError
+	if errors.As(err, &quotaErr) && quotaErr.Throttled {
+		stats.Throttled++
+		return
+	}
+
+	now := time.Now()
+	stats.Failures++
+	if errors.Is(err, ErrQuotaExceeded) {
+		stats.QuotaExceeded++
+	}
+	stats.LastError = err.Error()
+	stats.LastFailureAt = &now
+}
+
+// Stats returns each provider's counts, in chain order.
+func (c *Chain) Stats() []ProviderStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	stats := append([]ProviderStats(nil), c.stats...)
+	for i := range stats {
+		if total := stats[i].Successes + stats[i].Failures; total > 0 {
+			stats[i].FailureRate = float64(stats[i].Failures) / float64(total) * 100
+		}
+	}
+	return stats
+}
+
+// Breakers reports the circuit breaker of every provider that has one, in
+// chain order.
+func (c *Chain) Breakers() []breaker.Status {
+	var statuses []breaker.Status
+	for _, provider := range c.providers {
+		if guarded, ok := provider.(*Guarded); ok {
+			statuses = append(statuses, guarded.Breaker())
+		}
+	}
+	return statuses
+}
+
+// Check looks ip up with every provider, bypassing the stats, and returns
+// each provider's error by name. Lookups held back by the rate limiter
+// aren't sent, so they count as reachable; ones refused by an open circuit
+// breaker don't.
+func (c *Chain) Check(ctx context.Context, ip string) map[string]error {
+	results := make(map[string]error, len(c.providers))
+	for _, provider := range c.providers {
+		_, err := provider.Lookup(ctx, ip)
+		var quotaErr *QuotaError
+		if errors.As(err, &quotaErr) && quotaErr.Throttled && !errors.Is(err, breaker.ErrOpen) {
+			err = nil
+		}
+		results[provider.Name()] = err
+	}
+	return results
+}
@@ -0,0 +1,55 @@
+package geo
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+var (
+	// ErrQuotaExceeded matches, via errors.Is, lookups refused because the
+	// provider's rate limit or plan quota is used up
+	ErrQuotaExceeded = errors.New("geo quota exceeded")
+
+	// ErrUnauthorized is returned when the provider rejects the API key
+	ErrUnauthorized = errors.New("geo provider rejected the API key")
+)
+
+// QuotaError is a lookup refused for quota reasons. RetryAfter is how long
+// the provider asked us to wait, or 0 if it didn't say. Throttled is set
+// when we held the lookup back ourselves before it was sent, because of our
+// rate limiter or, with Err set to the reason, an open circuit breaker.
+type QuotaError struct {
+	Provider   string
+	RetryAfter time.Duration
+	Throttled  bool
+	Err        error
+}
+
+func (e *QuotaError) Error() string {
+	if e.Err != nil {
+		return e.Err.Error()
+	}
+	if e.RetryAfter > 0 {
+		return fmt.Sprintf("quota exceeded, retry after %s", e.RetryAfter)
+	}
+	return "quota exceeded"
+}
+
+func (e *QuotaError) Is(target error) bool {
+	return target == ErrQuotaExceeded
+}
+
+func (e *QuotaError) Unwrap() error { return e.Err }
+
+// retryAfter reads Retry-After, or ip-api's X-Ttl, in seconds
+func retryAfter(h http.Header) time.Duration {
+	for _, name := range []string{"Retry-After", "X-Ttl"} {
+		if secs, err := strconv.Atoi(h.Get(name)); err == nil && secs > 0 {
+			return time.Duration(secs) * time.Second
+		}
+	}
+	return 0
+}
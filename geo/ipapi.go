@@ -0,0 +1,76 @@
+package geo
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"email-tracker/models"
+)
+
+const (
+	defaultIPAPIURL = "http://ip-api.com/json/"
+
+	// The paid tier is served over HTTPS from its own host
+	defaultIPAPIProURL = "https://pro.ip-api.com/json/"
+)
+
+// IPAPI looks locations up with ip-api.com. The free tier is plain HTTP and
+// limited to 45 requests a minute; with a key the pro HTTPS endpoint is used.
+type IPAPI struct {
+	client  *http.Client
+	baseURL string
+	key     string
+}
+
+func NewIPAPI(client *http.Client, baseURL, key string) *IPAPI {
+	if baseURL == "" {
+		baseURL = defaultIPAPIURL
+		if key != "" {
+			baseURL = defaultIPAPIProURL
+		}
+	}
+	return &IPAPI{client: client, baseURL: strings.TrimSuffix(baseURL, "/") + "/", key: key}
+}
+
+func (p *IPAPI) Name() string { return "ip-api" }
+
+func (p *IPAPI) Lookup(ctx context.Context, ip string) (*models.GeoLocation, error) {
+	var data struct {
+		Status   string  `json:"status"`
+		Message  string  `json:"message"`
+		Country  string  `json:"country"`
+		Region   string  `json:"regionName"`
+		City     string  `json:"city"`
+		ISP      string  `json:"isp"`
+		Timezone string  `json:"timezone"`
+		Lat      float64 `json:"lat"`
+		Lon      float64 `json:"lon"`
+		AS       string  `json:"as"`
+	}
+	endpoint := p.baseURL + url.PathEscape(ip)
+	if p.key != "" {
+		endpoint += "?key=" + url.QueryEscape(p.key)
+	}
+	if err := getJSON(ctx, p.client, p.Name(), endpoint, &data); err != nil {
+		return nil, err
+	}
+	if data.Status != "success" {
+		return nil, fmt.Errorf("status %q: %s", data.Status, data.Message)
+	}
+
+	location := &models.GeoLocation{
+		IP:       ip,
+		Country:  data.Country,
+		City:     data.City,
+		Region:   data.Region,
+		ISP:      data.ISP,
+		Timezone: data.Timezone,
+		Lat:      formatCoord(data.Lat),
+		Lon:      formatCoord(data.Lon),
+	}
+	location.ASN, location.ASOrg = parseAS(data.AS)
+	return location, nil
+}
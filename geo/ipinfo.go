@@ -0,0 +1,63 @@
+package geo
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"email-tracker/models"
+)
+
+const defaultIPInfoURL = "https://ipinfo.io/"
+
+// IPInfo looks locations up with ipinfo.io. A token raises the free quota
+// and is required for the paid fields.
+type IPInfo struct {
+	client  *http.Client
+	baseURL string
+	token   string
+}
+
+func NewIPInfo(client *http.Client, baseURL, token string) *IPInfo {
+	if baseURL == "" {
+		baseURL = defaultIPInfoURL
+	}
+	return &IPInfo{client: client, baseURL: strings.TrimSuffix(baseURL, "/") + "/", token: token}
+}
+
+func (p *IPInfo) Name() string { return "ipinfo" }
+
+func (p *IPInfo) Lookup(ctx context.Context, ip string) (*models.GeoLocation, error) {
+	endpoint := p.baseURL + url.PathEscape(ip) + "/json"
+	if p.token != "" {
+		endpoint += "?token=" + url.QueryEscape(p.token)
+	}
+
+	var data struct {
+		City     string `json:"city"`
+		Region   string `json:"region"`
+		Country  string `json:"country"`
+		Loc      string `json:"loc"`
+		Org      string `json:"org"`
+		Timezone string `json:"timezone"`
+	}
+	if err := getJSON(ctx, p.client, p.Name(), endpoint, &data); err != nil {
+		return nil, err
+	}
+
+	// loc is "lat,lon"
+	lat, lon, _ := strings.Cut(data.Loc, ",")
+	location := &models.GeoLocation{
+		IP:       ip,
+		Country:  data.Country,
+		City:     data.City,
+		Region:   data.Region,
+		ISP:      data.Org,
+		Timezone: data.Timezone,
+		Lat:      lat,
+		Lon:      lon,
+	}
+	location.ASN, location.ASOrg = parseAS(data.Org)
+	return location, nil
+}
@@ -0,0 +1,90 @@
+package geo
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"email-tracker/models"
+)
+
+// defaultIPStackURL is plain HTTP because the free plan has no HTTPS; set
+// GEO_IPSTACK_URL to https://api.ipstack.com/ on a paid plan.
+const defaultIPStackURL = "http://api.ipstack.com/"
+
+// ipstack error codes
+const (
+	ipstackInvalidAccessKey  = 101
+	ipstackInactiveUser      = 102
+	ipstackUsageLimitReached = 104
+)
+
+// IPStack looks locations up with ipstack.com, which always needs an access
+// key.
+type IPStack struct {
+	client    *http.Client
+	baseURL   string
+	accessKey string
+}
+
+func NewIPStack(client *http.Client, baseURL, accessKey string) *IPStack {
+	if baseURL == "" {
+		baseURL = defaultIPStackURL
+	}
+	return &IPStack{client: client, baseURL: strings.TrimSuffix(baseURL, "/") + "/", accessKey: accessKey}
+}
+
+func (p *IPStack) Name() string { return "ipstack" }
+
+func (p *IPStack) Lookup(ctx context.Context, ip string) (*models.GeoLocation, error) {
+	endpoint := p.baseURL + url.PathEscape(ip) + "?access_key=" + url.QueryEscape(p.accessKey)
+
+	var data struct {
+		Success *bool `json:"success"`
+		Error   struct {
+			Code int    `json:"code"`
+			Type string `json:"type"`
+			Info string `json:"info"`
+		} `json:"error"`
+		CountryName string  `json:"country_name"`
+		RegionName  string  `json:"region_name"`
+		City        string  `json:"city"`
+		Latitude    float64 `json:"latitude"`
+		Longitude   float64 `json:"longitude"`
+		TimeZone    struct {
+			ID string `json:"id"`
+		} `json:"time_zone"`
+		Connection struct {
+			ASN int    `json:"asn"`
+			ISP string `json:"isp"`
+		} `json:"connection"`
+	}
+	if err := getJSON(ctx, p.client, p.Name(), endpoint, &data); err != nil {
+		return nil, err
+	}
+	// Errors come back as 200 with success: false
+	if data.Success != nil && !*data.Success {
+		switch data.Error.Code {
+		case ipstackUsageLimitReached:
+			return nil, &QuotaError{Provider: p.Name()}
+		case ipstackInvalidAccessKey, ipstackInactiveUser:
+			return nil, ErrUnauthorized
+		}
+		return nil, fmt.Errorf("error %d (%s): %s", data.Error.Code, data.Error.Type, data.Error.Info)
+	}
+
+	return &models.GeoLocation{
+		IP:       ip,
+		Country:  data.CountryName,
+		City:     data.City,
+		Region:   data.RegionName,
+		ISP:      data.Connection.ISP,
+		Timezone: data.TimeZone.ID,
+		Lat:      formatCoord(data.Latitude),
+		Lon:      formatCoord(data.Longitude),
+		ASN:      data.Connection.ASN,
+		ASOrg:    data.Connection.ISP,
+	}, nil
+}
@@ -0,0 +1,41 @@
+package geo
+
+import (
+	"context"
+	"time"
+
+	"email-tracker/models"
+
+	"golang.org/x/time/rate"
+)
+
+// Limited keeps a provider within its per-minute quota. Lookups over the
+// budget are refused with a QuotaError straight away, without a request, so
+// the caller can try another provider or retry once RetryAfter has passed.
+type Limited struct {
+	provider Provider
+	limiter  *rate.Limiter
+}
+
+// NewLimited allows perMinute lookups a minute through provider, evenly
+// spaced so no sliding minute goes over. 0 or less leaves it unlimited.
+func NewLimited(provider Provider, perMinute int) Provider {
+	if perMinute <= 0 {
+		return provider
+	}
+	return &Limited{
+		provider: provider,
+		limiter:  rate.NewLimiter(rate.Every(time.Minute/time.Duration(perMinute)), 1),
+	}
+}
+
+func (l *Limited) Name() string { return l.provider.Name() }
+
+func (l *Limited) Lookup(ctx context.Context, ip string) (*models.GeoLocation, error) {
+	reservation := l.limiter.Reserve()
+	if delay := reservation.Delay(); delay > 0 {
+		reservation.Cancel()
+		return nil, &QuotaError{Provider: l.Name(), RetryAfter: delay, Throttled: true}
+	}
+	return l.provider.Lookup(ctx, ip)
+}
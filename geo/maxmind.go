@@ -0,0 +1,132 @@
+package geo
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"email-tracker/models"
+
+	"github.com/oschwald/geoip2-golang"
+)
+
+// MaxMind looks locations up in a local GeoLite2 or GeoIP2 City database,
+// so lookups are fast, unmetered and recipient IPs never leave the server.
+// The file is reopened when it changes on disk, e.g. after geoipupdate runs.
+type MaxMind struct {
+	path string
+
+	mu      sync.RWMutex
+	db      *geoip2.Reader
+	modTime time.Time
+}
+
+// OpenMaxMind opens the .mmdb database at path.
+func OpenMaxMind(path string) (*MaxMind, error) {
+	m := &MaxMind{path: path}
+	if err := m.Reload(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Reload reopens the database if the file has changed since it was last
+// opened.
+func (m *MaxMind) Reload() error {
+	info, err := os.Stat(m.path)
+	if err != nil {
+		return fmt.Errorf("maxmind database: %w", err)
+	}
+
+	m.mu.RLock()
+	unchanged := m.db != nil && info.ModTime().Equal(m.modTime)
+	m.mu.RUnlock()
+	if unchanged {
+		return nil
+	}
+
+	db, err := geoip2.Open(m.path)
+	if err != nil {
+		return fmt.Errorf("maxmind database: %w", err)
+	}
+
+	m.mu.Lock()
+	old := m.db
+	m.db = db
+	m.modTime = info.ModTime()
+	m.mu.Unlock()
+
+	if old != nil {
+		old.Close()
+	}
+	slog.Info("loaded MaxMind database", "path", m.path,
+		"built", time.Unix(int64(db.Metadata().BuildEpoch), 0).Format("2006-01-02"))
+	return nil
+}
+
+// Run checks for a new database file every interval.
+func (m *MaxMind) Run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if err := m.Reload(); err != nil {
+			slog.Error("failed to reload MaxMind database", "path", m.path, "error", err)
+		}
+	}
+}
+
+func (m *MaxMind) Name() string { return "maxmind" }
+
+// Lookup returns the location of ip from the local database.
+func (m *MaxMind) Lookup(ctx context.Context, ip string) (*models.GeoLocation, error) {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return nil, fmt.Errorf("invalid IP %q", ip)
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	record, err := m.db.City(parsed)
+	if err != nil {
+		return nil, err
+	}
+	if record.Country.IsoCode == "" && record.City.GeoNameID == 0 {
+		return nil, fmt.Errorf("%s is not in the MaxMind database", ip)
+	}
+
+	location := &models.GeoLocation{IP: ip}
+
+	location.Country = record.Country.Names["en"]
+	location.City = record.City.Names["en"]
+	if len(record.Subdivisions) > 0 {
+		location.Region = record.Subdivisions[0].Names["en"]
+	}
+	location.Timezone = record.Location.TimeZone
+	location.Lat = formatCoord(record.Location.Latitude)
+	location.Lon = formatCoord(record.Location.Longitude)
+	return location, nil
+}
+
+// ASN returns the autonomous system of ip from a GeoLite2 or GeoIP2 ASN
+// database.
+func (m *MaxMind) ASN(ip string) (int, string, error) {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return 0, "", fmt.Errorf("invalid IP %q", ip)
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	record, err := m.db.ASN(parsed)
+	if err != nil {
+		return 0, "", err
+	}
+	return int(record.AutonomousSystemNumber), record.AutonomousSystemOrganization, nil
+}
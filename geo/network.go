@@ -0,0 +1,211 @@
+package geo
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+
+	"email-tracker/config"
+	"email-tracker/models"
+)
+
+// Network types an open can come from
+const (
+	NetworkCloud       = "cloud"
+	NetworkMobile      = "mobile"
+	NetworkResidential = "residential"
+	NetworkCorporate   = "corporate"
+)
+
+// cloudSignatures are lowercase fragments of hosting providers' AS names and
+// reverse DNS domains. Opens from them are usually scanners and proxies.
+var cloudSignatures = []string{
+	"amazon", "google-cloud", "googleusercontent", "azure", "cloudapp.net",
+	"microsoft-corp", "digitalocean", "linode", "akamai", "vultr", "choopa", "ovh", "hetzner",
+	"your-server.de", "contabo", "scaleway", "leaseweb", "oracle", "alibaba", "tencent",
+	"cloudflare", "fastly", "hosting", "datacenter", "data center", "colocation", "vps", "server",
+}
+
+// mobileSignatures mark cellular carriers and mobile gateways
+var mobileSignatures = []string{
+	"mobile", "cellular", "wireless", "gprs", "umts",
+}
+
+// residentialSignatures appear in the reverse DNS of home connections and in
+// the AS names of consumer ISPs
+var residentialSignatures = []string{
+	"dsl", "cable", "dyn", "dhcp", "pool", "ppp", "broadband", "fiber", "fibre", "ftth",
+	"cpe", "customer", "cust", "home", "residential", "client", "telecom", "telekom",
+	"comcast", "charter", "spectrum", "verizon", "at&t", "virgin", "orange", "vodafone",
+}
+
+// Network adds reverse DNS and autonomous system details to the locations
+// another provider finds, so opens from corporate networks, home broadband
+// and cloud hosts can be told apart. AS numbers come from a local MaxMind
+// ASN database when one is configured and from Team Cymru's DNS service
+// otherwise. Either lookup failing leaves its fields empty.
+type Network struct {
+	provider Provider
+	asnDB    *MaxMind
+	resolver *net.Resolver
+}
+
+// NewNetwork wraps provider with network lookups when GEO_NETWORK_LOOKUP is
+// on. An ASN database that can't be opened falls back to DNS.
+func NewNetwork(cfg *config.Config, provider Provider) (Provider, error) {
+	if !cfg.GeoAPI.NetworkLookup {
+		return provider, nil
+	}
+
+	n := &Network{provider: provider, resolver: net.DefaultResolver}
+	if cfg.GeoAPI.ASNDB == "" {
+		return n, nil
+	}
+
+	db, err := OpenMaxMind(cfg.GeoAPI.ASNDB)
+	if err != nil {
+		return n, fmt.Errorf("asn database: %w", err)
+	}
+	go db.Run(cfg.GeoAPI.ReloadInterval)
+	n.asnDB = db
+	return n, nil
+}
+
+func (n *Network) Name() string { return n.provider.Name() }
+
+func (n *Network) Lookup(ctx context.Context, ip string) (*models.GeoLocation, error) {
+	location, err := n.provider.Lookup(ctx, ip)
+	if err != nil {
+		return nil, err
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		if names, err := n.resolver.LookupAddr(ctx, ip); err == nil && len(names) > 0 {
+			location.ReverseDNS = strings.TrimSuffix(names[0], ".")
+		}
+	}()
+	if location.ASN == 0 {
+		location.ASN, location.ASOrg = n.asn(ctx, ip)
+	}
+	wg.Wait()
+
+	location.NetworkType = classifyNetwork(location.ASOrg, location.ReverseDNS)
+	return location, nil
+}
+
+func (n *Network) asn(ctx context.Context, ip string) (int, string) {
+	if n.asnDB != nil {
+		asn, org, err := n.asnDB.ASN(ip)
+		if err != nil {
+			return 0, ""
+		}
+		return asn, org
+	}
+	return n.cymruASN(ctx, ip)
+}
+
+// cymruASN asks Team Cymru's IP-to-ASN DNS service. The origin record reads
+// "15169 | 8.8.8.0/24 | US | arin | 2023-12-28" and the AS record ends with
+// the AS name, e.g. "... | GOOGLE, US".
+func (n *Network) cymruASN(ctx context.Context, ip string) (int, string) {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return 0, ""
+	}
+
+	origin, err := n.txtFields(ctx, reverseName(addr))
+	if err != nil || len(origin) == 0 {
+		return 0, ""
+	}
+	// Addresses announced by several ASes list them all; take the first
+	asn, err := strconv.Atoi(strings.Fields(origin[0])[0])
+	if err != nil {
+		return 0, ""
+	}
+
+	info, err := n.txtFields(ctx, fmt.Sprintf("AS%d.asn.cymru.com", asn))
+	if err != nil || len(info) < 5 {
+		return asn, ""
+	}
+	return asn, info[4]
+}
+
+func (n *Network) txtFields(ctx context.Context, name string) ([]string, error) {
+	records, err := n.resolver.LookupTXT(ctx, name)
+	if err != nil || len(records) == 0 {
+		return nil, err
+	}
+	fields := strings.Split(records[0], "|")
+	for i := range fields {
+		fields[i] = strings.TrimSpace(fields[i])
+	}
+	return fields, nil
+}
+
+// reverseName is the Team Cymru origin query for addr: reversed octets under
+// origin.asn.cymru.com for IPv4, reversed nibbles under origin6 for IPv6.
+func reverseName(addr netip.Addr) string {
+	addr = addr.Unmap()
+	b := addr.AsSlice()
+
+	var labels []string
+	if addr.Is4() {
+		for i := len(b) - 1; i >= 0; i-- {
+			labels = append(labels, strconv.Itoa(int(b[i])))
+		}
+		return strings.Join(labels, ".") + ".origin.asn.cymru.com"
+	}
+	for i := len(b) - 1; i >= 0; i-- {
+		labels = append(labels, strconv.FormatInt(int64(b[i]&0xf), 16), strconv.FormatInt(int64(b[i]>>4), 16))
+	}
+	return strings.Join(labels, ".") + ".origin6.asn.cymru.com"
+}
+
+// classifyNetwork guesses what kind of network an address belongs to from
+// its AS name and reverse DNS. Cloud wins over the rest since scanners on
+// rented servers matter most; an AS that looks like none of the others is
+// taken to be an organization's own network.
+func classifyNetwork(asOrg, reverseDNS string) string {
+	org := strings.ToLower(asOrg)
+	host := strings.ToLower(reverseDNS)
+	matches := func(signatures []string) bool {
+		for _, signature := range signatures {
+			if strings.Contains(org, signature) || strings.Contains(host, signature) {
+				return true
+			}
+		}
+		return false
+	}
+
+	switch {
+	case org == "" && host == "":
+		return ""
+	case matches(cloudSignatures):
+		return NetworkCloud
+	case matches(mobileSignatures):
+		return NetworkMobile
+	case matches(residentialSignatures):
+		return NetworkResidential
+	case org != "":
+		return NetworkCorporate
+	}
+	return ""
+}
+
+// parseAS splits AS descriptions such as "AS15169 Google LLC", as ip-api
+// and ipinfo return them, into number and name.
+func parseAS(as string) (int, string) {
+	number, org, _ := strings.Cut(as, " ")
+	asn, err := strconv.Atoi(strings.TrimPrefix(number, "AS"))
+	if err != nil {
+		return 0, ""
+	}
+	return asn, org
+}
@@ -0,0 +1,100 @@
+package geo
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+
+	"email-tracker/config"
+	"email-tracker/models"
+	"email-tracker/utils"
+)
+
+// Provider looks up where an IP address is.
+type Provider interface {
+	// Name identifies the provider in logs and metrics
+	Name() string
+	Lookup(ctx context.Context, ip string) (*models.GeoLocation, error)
+}
+
+// NewNamedProvider returns the provider called name, configured from the
+// geo settings. HTTP providers make their requests with client, behind a
+// circuit breaker. A MaxMind database is watched for updates in the
+// background.
+func NewNamedProvider(cfg *config.Config, client *http.Client, name string) (Provider, error) {
+	switch name {
+	case "", "ip-api":
+		ep := endpoint(cfg, "ip-api", cfg.GeoAPI.IPAPI)
+		return NewGuarded(cfg, NewLimited(NewIPAPI(client, ep.URL, ep.APIKey), ep.RateLimit)), nil
+	case "ipinfo":
+		ep := endpoint(cfg, name, cfg.GeoAPI.IPInfo)
+		return NewGuarded(cfg, NewLimited(NewIPInfo(client, ep.URL, ep.APIKey), ep.RateLimit)), nil
+	case "ipstack":
+		ep := endpoint(cfg, name, cfg.GeoAPI.IPStack)
+		if ep.APIKey == "" {
+			return nil, fmt.Errorf("ipstack needs GEO_IPSTACK_API_KEY")
+		}
+		return NewGuarded(cfg, NewLimited(NewIPStack(client, ep.URL, ep.APIKey), ep.RateLimit)), nil
+	case "maxmind":
+		db, err := OpenMaxMind(cfg.GeoAPI.MaxMindDB)
+		if err != nil {
+			return nil, err
+		}
+		go db.Run(cfg.GeoAPI.ReloadInterval)
+		return db, nil
+	default:
+		return nil, fmt.Errorf("unknown geo provider %q", name)
+	}
+}
+
+// endpoint returns a provider's own URL and key, falling back to GEO_URL and
+// GEO_API_KEY for the selected provider.
+func endpoint(cfg *config.Config, name string, own config.GeoEndpoint) config.GeoEndpoint {
+	selected := cfg.GeoAPI.Provider == name || (name == "ip-api" && cfg.GeoAPI.Provider == "")
+	if own.URL == "" && selected {
+		own.URL = cfg.GeoAPI.URL
+	}
+	if own.APIKey == "" && selected {
+		own.APIKey = cfg.GeoAPI.APIKey
+	}
+	return own
+}
+
+// getJSON fetches url and decodes the JSON response into out. Rate limit
+// and authentication failures are reported as QuotaError and
+// ErrUnauthorized. Errors never contain the URL's query, which holds the
+// API key.
+func getJSON(ctx context.Context, client *http.Client, provider, url string, out interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return fmt.Errorf("invalid %s URL %s", provider, utils.RedactURL(url))
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return utils.RedactURLError(err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusTooManyRequests:
+		return &QuotaError{Provider: provider, RetryAfter: retryAfter(resp.Header)}
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return ErrUnauthorized
+	default:
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return json.Unmarshal(body, out)
+}
+
+func formatCoord(v float64) string {
+	return fmt.Sprintf("%f", v)
+}
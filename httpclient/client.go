@@ -0,0 +1,79 @@
+// Package httpclient builds the HTTP client shared by outbound
+// integrations, so they reuse connections instead of dialing per call.
+package httpclient
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"syscall"
+	"time"
+
+	"email-tracker/config"
+	"email-tracker/utils"
+)
+
+// New returns a client that keeps up to cfg.HTTPClient.MaxIdlePerHost
+// connections open per host and goes through the proxy set in HTTP_PROXY,
+// HTTPS_PROXY and NO_PROXY. cfg.HTTPClient.Timeout caps a whole request,
+// on top of the caller's context.
+func New(cfg *config.Config) *http.Client {
+	transport := &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   10 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          100,
+		MaxIdleConnsPerHost:   cfg.HTTPClient.MaxIdlePerHost,
+		IdleConnTimeout:       cfg.HTTPClient.IdleTimeout,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: time.Second,
+	}
+	return &http.Client{Transport: transport, Timeout: cfg.HTTPClient.Timeout}
+}
+
+// ErrPrivateAddress is returned when NewPublic's client is pointed at an
+// address that isn't on the internet
+var ErrPrivateAddress = errors.New("address is not public")
+
+// NewPublic returns a client for URLs tenants give, like their webhooks,
+// that only connects to public addresses, whatever the host resolves to,
+// so it can't be used to reach the tracker's own network. It never goes
+// through a proxy, which would do the resolving instead.
+// cfg.Webhooks.AllowPrivate lifts the restriction, for testing.
+func NewPublic(cfg *config.Config) *http.Client {
+	dialer := &net.Dialer{
+		Timeout:   10 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}
+	if !cfg.Webhooks.AllowPrivate {
+		dialer.Control = func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if !utils.IsPublicIP(host) {
+				return fmt.Errorf("%w: %s", ErrPrivateAddress, host)
+			}
+			return nil
+		}
+	}
+	transport := &http.Transport{
+		DialContext:           dialer.DialContext,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          100,
+		MaxIdleConnsPerHost:   cfg.HTTPClient.MaxIdlePerHost,
+		IdleConnTimeout:       cfg.HTTPClient.IdleTimeout,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: time.Second,
+	}
+	return &http.Client{
+		Transport: transport,
+		Timeout:   cfg.HTTPClient.Timeout,
+		// A tenant's endpoint answers where it was asked
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+	}
+}
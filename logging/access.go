@@ -0,0 +1,136 @@
+package logging
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"email-tracker/config"
+)
+
+// AccessEntry describes one handled HTTP request
+type AccessEntry struct {
+	Time      time.Time
+	Method    string
+	Path      string
+	Proto     string
+	Status    int
+	Bytes     int
+	Duration  time.Duration
+	ClientIP  string
+	User      string
+	UserAgent string
+	Referer   string
+	RequestID string
+}
+
+type accessSettings struct {
+	format     string
+	sampleRate float64
+	skipPaths  []string
+}
+
+// AccessLog writes one line per request to stdout, apart from the
+// application log, as JSON or in Apache's combined format.
+type AccessLog struct {
+	settings atomic.Pointer[accessSettings]
+
+	mu   sync.Mutex
+	out  io.Writer
+	json *slog.Logger
+}
+
+func NewAccessLog(cfg *config.Config) *AccessLog {
+	l := &AccessLog{out: os.Stdout}
+	l.json = slog.New(slog.NewJSONHandler(l.out, nil))
+	l.ApplyConfig(cfg)
+	return l
+}
+
+// ApplyConfig switches to new format, sampling and skip path settings.
+func (l *AccessLog) ApplyConfig(cfg *config.Config) {
+	l.settings.Store(&accessSettings{
+		format:     cfg.AccessLog.Format,
+		sampleRate: cfg.AccessLog.SampleRate,
+		skipPaths:  append([]string(nil), cfg.AccessLog.SkipPaths...),
+	})
+}
+
+// Log writes e unless logging is off, its path is skipped or it isn't
+// sampled. Failed requests, with a 4xx or 5xx status, are always written.
+func (l *AccessLog) Log(e AccessEntry) {
+	settings := l.settings.Load()
+	if settings.format == "off" {
+		return
+	}
+	if e.Status < 400 {
+		if skipped(e.Path, settings.skipPaths) {
+			return
+		}
+		if settings.sampleRate < 1 && rand.Float64() >= settings.sampleRate {
+			return
+		}
+	}
+
+	if settings.format == "apache" {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		fmt.Fprintln(l.out, apacheLine(e))
+		return
+	}
+
+	l.json.LogAttrs(context.Background(), slog.LevelInfo, "request",
+		slog.String("method", e.Method),
+		slog.String("path", e.Path),
+		slog.Int("status", e.Status),
+		slog.Int("bytes", e.Bytes),
+		slog.Float64("latency_ms", float64(e.Duration.Microseconds())/1000),
+		slog.String("client_ip", e.ClientIP),
+		slog.String("user", e.User),
+		slog.String("user_agent", e.UserAgent),
+		slog.String("referer", e.Referer),
+		slog.String("request_id", e.RequestID),
+	)
+}
+
+// skipped reports whether path is one of prefixes or below one of them
+func skipped(path string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		prefix = strings.TrimSuffix(prefix, "/")
+		if path == prefix || strings.HasPrefix(path, prefix+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// apacheLine renders e in the combined log format, followed by the time
+// taken in microseconds (%D) and the request ID.
+func apacheLine(e AccessEntry) string {
+	user := e.User
+	if user == "" {
+		user = "-"
+	}
+	size := "-"
+	if e.Bytes > 0 {
+		size = fmt.Sprint(e.Bytes)
+	}
+	return fmt.Sprintf("%s - %s [%s] \"%s %s %s\" %d %s %q %q %d %s",
+		e.ClientIP, user, e.Time.Format("02/Jan/2006:15:04:05 -0700"),
+		e.Method, e.Path, e.Proto, e.Status, size,
+		orDash(e.Referer), orDash(e.UserAgent), e.Duration.Microseconds(), orDash(e.RequestID))
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
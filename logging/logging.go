@@ -0,0 +1,91 @@
+// Package logging sets up the structured logger every component writes to.
+// Log lines share field names so they can be joined up: tracking_id,
+// request_id and recipient_hash, which stands in for the address itself.
+package logging
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"log/slog"
+	"os"
+	"strings"
+
+	"email-tracker/config"
+)
+
+// level is shared by the installed handler so reloads can change it
+var level = new(slog.LevelVar)
+
+// sensitiveKeys are attributes whose values are never written, in case a
+// secret is ever handed to a logger by mistake
+var sensitiveKeys = map[string]bool{
+	"password":      true,
+	"secret":        true,
+	"token":         true,
+	"api_key":       true,
+	"authorization": true,
+}
+
+// Setup makes a JSON or text logger at the configured level the default for
+// slog and the standard log package. The format is fixed from then on; the
+// level follows ApplyConfig.
+func Setup(cfg *config.Config) {
+	level.Set(parseLevel(cfg.Log.Level))
+
+	opts := &slog.HandlerOptions{Level: level, ReplaceAttr: redactAttr}
+	var handler slog.Handler = slog.NewTextHandler(os.Stderr, opts)
+	if cfg.Log.Format == "json" {
+		handler = slog.NewJSONHandler(os.Stderr, opts)
+	}
+	slog.SetDefault(slog.New(handler))
+}
+
+// ApplyConfig switches to a newly configured log level.
+func ApplyConfig(cfg *config.Config) {
+	level.Set(parseLevel(cfg.Log.Level))
+}
+
+func redactAttr(_ []string, a slog.Attr) slog.Attr {
+	if sensitiveKeys[strings.ToLower(a.Key)] {
+		return slog.String(a.Key, "[redacted]")
+	}
+	return a
+}
+
+func parseLevel(name string) slog.Level {
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(name)); err != nil {
+		return slog.LevelInfo
+	}
+	return l
+}
+
+// Fatal logs msg at error level and exits.
+func Fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
+type requestIDKey struct{}
+
+// WithRequestID returns ctx carrying the ID of the request it belongs to.
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// FromContext returns the default logger, tagged with the request ID when
+// ctx belongs to a request.
+func FromContext(ctx context.Context) *slog.Logger {
+	if id, ok := ctx.Value(requestIDKey{}).(string); ok && id != "" {
+		return slog.Default().With("request_id", id)
+	}
+	return slog.Default()
+}
+
+// RecipientHash identifies an email address in logs without revealing it:
+// the first 12 hex digits of the SHA-256 of the lowercased address.
+func RecipientHash(address string) string {
+	sum := sha256.Sum256([]byte(strings.ToLower(strings.TrimSpace(address))))
+	return hex.EncodeToString(sum[:6])
+}
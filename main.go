@@ -2,31 +2,88 @@ package main
 
 import (
 	"context"
+	"errors"
+	"flag"
 	"fmt"
-	"log"
+	"log/slog"
+	"math"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"syscall"
 	"time"
 
+	"email-tracker/analytics"
+	"email-tracker/audit"
+	"email-tracker/auth"
+	"email-tracker/breaker"
+	"email-tracker/campaigns"
+	"email-tracker/cluster"
 	"email-tracker/config"
+	"email-tracker/consent"
+	"email-tracker/contacts"
+	"email-tracker/counters"
+	"email-tracker/deliverability"
+	"email-tracker/events"
+	"email-tracker/httpclient"
+	"email-tracker/logging"
 	"email-tracker/models"
 	"email-tracker/notification"
+	"email-tracker/reports"
+	"email-tracker/secrets"
+	"email-tracker/segments"
 	"email-tracker/service"
+	"email-tracker/storage"
+	"email-tracker/suppression"
+	"email-tracker/tenants"
 	"email-tracker/tracker"
+	"email-tracker/usage"
 	"email-tracker/utils"
+	"email-tracker/web"
+	"email-tracker/webhook"
 
 	"github.com/gin-gonic/gin"
 )
 
 type Server struct {
-	router       *gin.Engine
-	config       *config.Config
-	tracker      *tracker.Tracker
-	notifier     *notification.Sender
-	emailService *service.EmailService
-	server       *http.Server
+	router            *gin.Engine
+	config            *config.Config
+	tracker           *tracker.Tracker
+	counters          counters.Counters
+	events            *events.Broker
+	notifier          *notification.Sender
+	emailService      *service.EmailService
+	deliverability    *deliverability.Checker
+	campaigns         *campaigns.Store
+	campaignScheduler *campaigns.Scheduler
+	reports           *reports.Scheduler
+	users             *auth.Store
+	sessions          *auth.SessionStore
+	server            *http.Server
+	httpServer        *http.Server
+	certificate       *certificate
+	ready             readinessProbe
+	draining          atomic.Bool
+	audit             *audit.Log
+	suppressions      *suppression.Store
+	consent           *consent.Store
+	contacts          *contacts.Store
+	segments          *segments.Store
+	tenants           *tenants.Store
+	webhooks          *webhook.Dispatcher
+	usage             usage.Meter
+	auditFailures     utils.LossCounter
+	auditSettings     atomic.Pointer[auditSettings]
+	accessLog         *logging.AccessLog
+	sends             *admission
+	statsCache        *statsCache
+	trustedProxies    []*net.IPNet
 }
 
 func NewServer(cfg *config.Config) *Server {
@@ -37,64 +94,432 @@ func NewServer(cfg *config.Config) *Server {
 		gin.SetMode(gin.DebugMode)
 	}
 
-	router := gin.Default()
+	// Requests are logged to the access log by requestLogger
+	router := gin.New()
+	router.Use(gin.Recovery())
+	// Wrong methods on known paths get 405 with Allow, not 404
+	router.HandleMethodNotAllowed = true
+	useJSONFieldNames()
+
+	// Only believe forwarding headers from our own proxies
+	if err := router.SetTrustedProxies(cfg.Server.TrustedProxies); err != nil {
+		logging.Fatal("invalid trusted proxies", "error", err)
+	}
+	trustedProxies, _ := utils.ParseTrustedProxies(cfg.Server.TrustedProxies)
+
+	// Parse every template once, for the dashboard, emails and pixel
+	templates, err := web.Templates(cfg.App.AssetsDir)
+	if err != nil {
+		logging.Fatal("failed to load templates", "error", err)
+	}
+	router.SetHTMLTemplate(templates)
 
 	// Initialize notification sender
-	notifier := notification.NewSender(cfg)
+	notifier := notification.NewSender(cfg, templates)
+
+	// Initialize real-time counters (Redis when enabled)
+	realtimeCounters := counters.New(cfg)
+
+	// Live activity stream for the dashboard and webhooks
+	broker := events.NewBroker()
+	webhooks := webhook.New(cfg, httpclient.New(cfg), httpclient.NewPublic(cfg), broker)
+	webhooks.Start()
 
 	// Initialize tracker
-	emailTracker := tracker.NewTracker(notifier)
+	emailTracker := tracker.NewTracker(cfg, templates, httpclient.New(cfg), notifier, realtimeCounters, broker)
+
+	// Per-email and per-campaign stats are reused until the email changes
+	statsCache := newStatsCache(cfg)
+	if cfg.StatsCache.TTL > 0 {
+		emailTracker.OnChange(statsCache.invalidateEmail)
+	}
+
+	// Share tracking state with the other instances and let one of them
+	// run each periodic job
+	var claimer cluster.Claimer = cluster.Local{}
+	if cfg.Cluster.Enabled {
+		sharedStore := cluster.NewStore(cfg)
+		claimer = cluster.NewRedisClaimer(cfg)
+		if err := sharedStore.Sync(context.Background(), emailTracker); err != nil {
+			logging.Fatal("failed to load shared tracking state", "error", err)
+		}
+		emailTracker.Share(sharedStore, claimer)
+		slog.Info("running in cluster mode", "instance_id", cfg.Cluster.InstanceID)
+	}
+
+	// Addresses that must not be mailed again
+	suppressions, err := suppression.Open(cfg.Suppression.File)
+	if err != nil {
+		logging.Fatal("failed to open suppression list", "error", err)
+	}
+
+	// Double opt-in records, needed for marketing sends in strict mode
+	consents, err := consent.Open(cfg)
+	if err != nil {
+		logging.Fatal("failed to open consent file", "error", err)
+	}
+
+	// Tenants' contacts, for merge variables, kept up to date with their
+	// opens and clicks
+	contactStore, err := contacts.Open(cfg)
+	if err != nil {
+		logging.Fatal("failed to open contacts file", "error", err)
+	}
+	emailTracker.SetEngagement(contactStore)
+
+	// Rule-based segments of those contacts, usable as campaign audiences
+	segmentStore, err := segments.Open(cfg, contactStore)
+	if err != nil {
+		logging.Fatal("failed to open segments file", "error", err)
+	}
+
+	// Tenants' own SMTP servers, From addresses and DKIM keys
+	tenantStore, err := tenants.Open(cfg)
+	if err != nil {
+		logging.Fatal("failed to open tenants file", "error", err)
+	}
+
+	// Tenants' own webhooks and notification addresses
+	for tenant, endpoints := range tenantStore.AllWebhooks() {
+		for _, w := range endpoints {
+			webhooks.Add(tenant, w.Name, w.URL, w.Secret, w.Events)
+		}
+	}
+	emailTracker.SetNotificationChannels(tenantStore)
+
+	// Each tenant's monthly usage, for billing, and the storage it takes
+	// up, measured every hour
+	usageMeter, err := usage.New(cfg)
+	if err != nil {
+		logging.Fatal("failed to open usage file", "error", err)
+	}
+	emailTracker.SetUsageMeter(usageMeter)
+	go func() {
+		ticker := time.NewTicker(time.Hour)
+		defer ticker.Stop()
+
+		for {
+			now := time.Now()
+			for tenant, bytes := range emailTracker.TenantStorage() {
+				usageMeter.Add(tenant, now, usage.Counts{StorageBytes: bytes})
+			}
+			<-ticker.C
+		}
+	}()
 
 	// Initialize email service with config
-	emailService := service.NewEmailService(cfg, emailTracker, notifier)
+	// SPF, DKIM and DMARC checks for the sender's domain
+	senders := deliverability.New(cfg, net.DefaultResolver)
+
+	emailService := service.NewEmailService(cfg, emailTracker, notifier, suppressions, senders, consents, tenantStore, contactStore)
 
 	// Clean up old entries periodically
+	go emailTracker.RunCleanup()
+	go emailTracker.RunGeoBackfill()
+	go emailTracker.RunNotifications()
+
+	// Durable copy of every open, written in batches
+	if cfg.Storage.EventsFile != "" {
+		eventFile, err := storage.OpenEventFile(cfg.Storage.EventsFile)
+		if err != nil {
+			logging.Fatal("failed to open event store", "error", err)
+		}
+		emailTracker.PersistEvents(eventFile, cfg)
+	}
+
+	// Flag suspicious open patterns in the background
 	go func() {
-		ticker := time.NewTicker(1 * time.Hour)
+		ticker := time.NewTicker(5 * time.Minute)
 		defer ticker.Stop()
 
 		for range ticker.C {
-			emailTracker.CleanupOldEntries(30 * 24 * time.Hour) // 30 days
+			emailTracker.DetectAnomalies()
 		}
 	}()
 
-	// Log environment info
-	log.Printf("Starting server in %s mode", cfg.App.Env)
-	if cfg.App.BaseURL != "" {
-		log.Printf("BaseURL configured: %s", cfg.App.BaseURL)
-	} else {
-		log.Printf("BaseURL will be determined dynamically from requests")
+	// Email summary reports to stakeholders
+	reportScheduler := reports.NewScheduler(cfg, emailTracker, notifier)
+	reportScheduler.SetClaimer(claimer)
+	reportScheduler.SetDigests(tenantStore)
+	if reporter := usage.NewStripeReporter(cfg, httpclient.New(cfg), usageMeter, tenantStore); reporter != nil {
+		reporter.SetClaimer(claimer)
+		slog.Info("reporting usage to Stripe", "meter_event", cfg.Usage.StripeMeterEvent, "metric", cfg.Usage.StripeMetric)
+		go reporter.Run()
+	}
+	if reportScheduler.Enabled() {
+		slog.Info("sending reports", "frequency", cfg.Reports.Frequency, "recipients", len(cfg.Reports.Recipients))
+	}
+	go reportScheduler.Run()
+	go reportScheduler.RunDigests()
+
+	// Campaigns are sent by the scheduler when their time comes
+	campaignStore := campaigns.NewStore()
+	campaignScheduler := campaigns.NewScheduler(campaignStore, emailService)
+	campaignScheduler.SetAudience(segmentStore)
+	go campaignScheduler.Run()
+
+	// Trail of sends, deletions and admin actions
+	auditLog, err := audit.Open(cfg.Audit.File, cfg.Audit.MaxEntries)
+	if err != nil {
+		logging.Fatal("failed to open audit log", "error", err)
+	}
+
+	// Dashboard and API authentication
+	users := auth.NewStore(cfg)
+	if !users.Enabled() {
+		slog.Warn("no AUTH_USERS or API_KEYS configured, dashboard and API are unauthenticated")
 	}
+	warnIgnoredKeys(users, tenantStore)
 
-	return &Server{
-		router:       router,
-		config:       cfg,
-		tracker:      emailTracker,
-		notifier:     notifier,
-		emailService: emailService,
+	s := &Server{
+		router:            router,
+		config:            cfg,
+		tracker:           emailTracker,
+		counters:          realtimeCounters,
+		events:            broker,
+		notifier:          notifier,
+		emailService:      emailService,
+		deliverability:    senders,
+		campaigns:         campaignStore,
+		campaignScheduler: campaignScheduler,
+		reports:           reportScheduler,
+		users:             users,
+		sessions:          auth.NewSessionStore(cfg.Auth.SessionTTL),
+		audit:             auditLog,
+		suppressions:      suppressions,
+		consent:           consents,
+		contacts:          contactStore,
+		segments:          segmentStore,
+		tenants:           tenantStore,
+		webhooks:          webhooks,
+		usage:             usageMeter,
+		accessLog:         logging.NewAccessLog(cfg),
+		sends:             newAdmission(cfg),
+		statsCache:        statsCache,
+		trustedProxies:    trustedProxies,
 	}
+	s.storeAuditSettings(cfg)
+	return s
 }
 
 func (s *Server) setupRoutes() {
 
 	s.router.GET("/", s.entryPoint)
-	// Health check
+	// Health check: /live and /health are cheap liveness probes, /ready
+	// checks dependencies and fails while shutting down
 	s.router.GET("/health", s.healthCheck)
+	s.router.GET("/live", s.livenessCheck)
+	s.router.GET("/ready", s.readinessCheck)
+
+	// Track email opens, keeping tracking ID scanners out
+	guard := s.guardTracking()
+	s.router.GET(s.config.Tracking.PixelPath+"/:id", guard, s.trackEmailOpen)
+	if s.config.Tracking.PixelPath != config.DefaultPixelPath {
+		// Pixels in emails sent before the path changed
+		s.router.GET(config.DefaultPixelPath+"/:id", guard, s.trackEmailOpen)
+	}
+
+	// Track link clicks
+	s.router.GET("/click/:id/:link", guard, s.trackLinkClick)
+
+	// Pages people open in a browser can't be framed by other sites
+	pages := s.router.Group("", s.pageHeaders())
+
+	// Unsubscribe links
+	pages.GET("/unsubscribe/:id", s.unsubscribe)
+	pages.POST("/unsubscribe/:id", s.unsubscribe)
+
+	// Double opt-in confirm links
+	pages.GET("/confirm/:token", s.confirmConsent)
+	pages.POST("/confirm/:token", s.confirmConsent)
+
+	// Dashboard login
+	pages.GET("/login", s.loginPage)
+	pages.POST("/login", s.login)
+	pages.POST("/logout", s.logout)
+
+	// API requires a session or an API key, and bodies are size-limited
+	api := s.router.Group("/api", s.limitBody(), s.requireAuth())
+
+	// Every user may read; sending and purging need the sender and admin
+	// roles
+	sender, admin := s.requireRole(auth.RoleSender), s.requireAdmin()
+
+	// Reads of recipient data go in the audit trail
+	access := s.auditAccess()
 
-	// Track email opens
-	s.router.GET("/track/:id", s.trackEmailOpen)
+	// Each tenant only reaches its own emails and campaigns, and only the
+	// operator's tenant the service as a whole
+	ownEmail, ownCampaign, operator := s.ownEmail(), s.ownCampaign(), s.requireOperator()
 
 	// Send email with tracking
-	s.router.POST("/api/send-email", s.sendEmail)
+	api.POST("/send-email", sender, s.admitSend(), s.sendEmail)
 
 	// Get tracking statistics
-	s.router.GET("/api/tracking/:id", s.getTrackingInfo)
+	api.GET("/tracking/:id", ownEmail, access, s.cacheStats("tracking"), s.getTrackingInfo)
+	api.GET("/tracking/:id/timeseries", ownEmail, s.cacheStats("tracking"), s.getTrackingTimeSeries)
+	api.GET("/tracking/:id/geo", ownEmail, access, s.cacheStats("tracking"), s.getTrackingGeo)
+	api.GET("/tracking/:id/geojson", ownEmail, access, s.cacheStats("tracking"), s.getTrackingGeoJSON)
+	api.GET("/tracking/:id/funnel", ownEmail, s.cacheStats("tracking"), s.getTrackingFunnel)
+	api.GET("/tracking/:id/links", ownEmail, s.cacheStats("tracking"), s.getTrackingLinks)
+
+	// Analytics across all of the tenant's emails
+	api.GET("/analytics/geo", s.getServiceGeo)
+	api.GET("/analytics/devices", s.getDeviceBreakdown)
+	api.GET("/analytics/send-time", s.getSendTimeRecommendation)
+	api.GET("/analytics/heatmap", s.getOpenHeatmap)
+	api.GET("/analytics/map", s.getOpenMap)
+	api.GET("/analytics/domains", s.getDomainDeliverability)
+	api.GET("/analytics/export", access, s.exportAnalytics)
+	api.GET("/analytics/counters", s.getRealtimeCounters)
+
+	// Campaign management
+	api.GET("/campaigns", s.listCampaigns)
+	api.POST("/campaigns", sender, s.createCampaign)
+	api.GET("/campaigns/:id", ownCampaign, access, s.getCampaign)
+	api.POST("/campaigns/:id/schedule", sender, ownCampaign, s.scheduleCampaign)
+	api.POST("/campaigns/:id/send", sender, ownCampaign, s.sendCampaign)
+	api.PUT("/campaigns/:id/retention", admin, ownCampaign, s.setCampaignRetention)
+	api.PUT("/campaigns/:id/tags", sender, ownCampaign, s.setCampaignTags)
+
+	// Campaign analytics
+	api.GET("/campaigns/:id/stats", ownCampaign, s.cacheStats("campaign"), s.getCampaignStats)
+	api.GET("/campaigns/:id/timeseries", ownCampaign, s.cacheStats("campaign"), s.getCampaignTimeSeries)
+	api.GET("/campaigns/:id/funnel", ownCampaign, s.cacheStats("campaign"), s.getCampaignFunnel)
+	api.GET("/campaigns/:id/cohorts", ownCampaign, s.cacheStats("campaign"), s.getCampaignCohorts)
+	api.GET("/campaigns/:id/links", ownCampaign, s.cacheStats("campaign"), s.getCampaignLinks)
+
+	// A/B test comparison
+	api.GET("/ab-tests/:id", s.getABTestResult)
+
+	// Queue, SMTP and storage health for operators
+	api.GET("/system", operator, s.getSystemHealth)
+
+	// Data dropped under backpressure
+	api.GET("/stats", operator, s.getStats)
+
+	// SMTP delivery by server and recipient domain
+	api.GET("/stats/delivery", operator, s.getDeliveryStats)
+
+	// Live stream of opens and clicks
+	api.GET("/events", access, s.streamEvents)
+
+	// Search sent emails and get a single email record with open aggregates
+	api.GET("/emails", access, s.listEmails)
+	api.GET("/emails/:id", ownEmail, access, s.cacheStats("tracking"), s.getEmail)
+
+	// Erase everything held about a recipient
+	api.DELETE("/data/recipient/:email", admin, s.deleteRecipientData)
+
+	// Retention policies in effect for the tenant, for admins
+	api.GET("/data/retention", admin, s.getRetention)
+
+	// Report a bounce or spam complaint for a sent email
+	api.POST("/emails/:id/bounce", sender, ownEmail, s.reportBounce)
+	api.POST("/emails/:id/complaint", sender, ownEmail, s.reportComplaint)
+
+	// Whether mail from a domain would pass SPF, DKIM and DMARC
+	api.GET("/deliverability", s.checkDeliverability)
+
+	// Addresses that are never mailed; only admins change the list by hand
+	api.GET("/suppressions", access, s.listSuppressions)
+	api.POST("/suppressions", admin, s.addSuppression)
+	api.DELETE("/suppressions/:email", admin, s.deleteSuppression)
+
+	// Double opt-in: ask an address to confirm, see who did, withdraw
+	api.POST("/consent", sender, s.admitSend(), s.requestConsent)
+	api.GET("/consent", access, s.listConsent)
+	api.GET("/consent/:email", access, s.getConsent)
+	api.DELETE("/consent/:email", sender, s.withdrawConsent)
+
+	// The tenant's contacts, whose fields and attributes are merge
+	// variables in the emails sent to them
+	api.GET("/contacts", access, s.listContacts)
+	api.POST("/contacts", sender, s.createContact)
+	api.POST("/contacts/import", sender, s.importContacts)
+	api.GET("/contacts/:email", access, s.getContact)
+	api.PUT("/contacts/:email", sender, s.updateContact)
+	api.DELETE("/contacts/:email", admin, s.deleteContact)
+
+	// Segments: rules over contacts, evaluated when asked for, which
+	// campaigns can be sent to
+	api.GET("/segments", s.listSegments)
+	api.POST("/segments", sender, s.createSegment)
+	api.GET("/segments/:id", s.getSegment)
+	api.GET("/segments/:id/contacts", access, s.segmentContacts)
+	api.PUT("/segments/:id", sender, s.updateSegment)
+	api.DELETE("/segments/:id", sender, s.deleteSegment)
+
+	// The tenant's own SMTP server, From address and DKIM key, for admins
+	api.GET("/tenant/sending", admin, s.getSending)
+	api.PUT("/tenant/sending", admin, s.setSending)
+	api.DELETE("/tenant/sending", admin, s.deleteSending)
+
+	// The tenant's own tracking domains, verified through DNS, for admins
+	api.GET("/tenant/domains", admin, s.listDomains)
+	api.POST("/tenant/domains", admin, s.addDomain)
+	api.POST("/tenant/domains/:domain/verify", admin, s.verifyDomain)
+	api.DELETE("/tenant/domains/:domain", admin, s.deleteDomain)
+
+	// The tenant's own webhooks, open notification addresses and digests,
+	// for admins
+	api.GET("/tenant/webhooks", admin, s.listWebhooks)
+	api.POST("/tenant/webhooks", admin, s.addWebhook)
+	api.DELETE("/tenant/webhooks/:name", admin, s.deleteWebhook)
+	api.GET("/tenant/notifications", admin, s.getNotifications)
+	api.PUT("/tenant/notifications", admin, s.setNotifications)
+	api.DELETE("/tenant/notifications", admin, s.deleteNotifications)
+
+	// The tenant's own name, logo and colors on its dashboard and
+	// notifications, for admins
+	api.GET("/tenant/branding", admin, s.getBranding)
+	api.PUT("/tenant/branding", admin, s.setBranding)
+	api.DELETE("/tenant/branding", admin, s.deleteBranding)
+
+	// Tenant administration for the operator's admins: registering and
+	// suspending tenants, their API keys, quotas, retention and health
+	api.GET("/tenants", admin, operator, s.listTenants)
+	api.POST("/tenants", admin, operator, s.requireAuthConfigured(), s.createTenant)
+	api.GET("/tenants/:tenant", admin, operator, s.getTenant)
+	api.PUT("/tenants/:tenant", admin, operator, s.updateTenant)
+	api.POST("/tenants/:tenant/suspend", admin, operator, s.suspendTenant)
+	api.POST("/tenants/:tenant/resume", admin, operator, s.resumeTenant)
+	api.POST("/tenants/:tenant/keys", admin, operator, s.requireAuthConfigured(), s.issueKey)
+	api.POST("/tenants/:tenant/keys/rotate", admin, operator, s.requireAuthConfigured(), s.rotateKeys)
+	api.DELETE("/tenants/:tenant/keys/:key", admin, operator, s.revokeKey)
+
+	// Every tenant's usage in a month, for billing, as JSON or CSV
+	api.GET("/usage", admin, operator, s.exportUsage)
+
+	// Resend or delete an email
+	api.POST("/emails/:id/resend", sender, ownEmail, s.admitSend(), s.resendEmail)
+	api.DELETE("/emails/:id", admin, ownEmail, s.deleteEmail)
+
+	// Audit trail, for the operator's admins, and its signed export for compliance reviews
+	api.GET("/audit", admin, operator, s.getAuditLog)
+	api.GET("/audit/export", admin, operator, s.exportAuditLog)
+
+	// Clients suspected of scanning for tracking IDs, and lifting their bans
+	api.GET("/scanners", admin, operator, s.listScanners)
+	api.DELETE("/scanners/:ip", admin, operator, s.unbanScanner)
+
+	// Profiling and runtime variables for the operator's admins
+	s.setupDebugRoutes(s.router.Group("/debug", s.requireAuth(), admin, operator))
 
 	// Dashboard
-	s.router.GET("/dashboard", s.dashboard)
+	dashboard := pages.Group("/dashboard", s.requireSession())
+	dashboard.GET("", access, s.dashboard)
+	dashboard.GET("/emails/:id", ownEmail, access, s.emailDetail)
+	dashboard.POST("/emails/:id/resend", sender, ownEmail, s.resendEmailFromDashboard)
+	dashboard.POST("/emails/:id/delete", admin, ownEmail, s.deleteEmailFromDashboard)
+	dashboard.GET("/campaigns", s.campaignsPage)
+	dashboard.POST("/campaigns", sender, s.createCampaignFromDashboard)
+	dashboard.GET("/campaigns/:id", ownCampaign, access, s.campaignPage)
+	dashboard.POST("/campaigns/:id/schedule", sender, ownCampaign, s.scheduleCampaignFromDashboard)
+	dashboard.POST("/campaigns/:id/send", sender, ownCampaign, s.sendCampaignFromDashboard)
 
 	// Static files
-	s.router.Static("/static", "./static")
+	s.router.StaticFS("/static", http.FS(web.Static(s.config.App.AssetsDir)))
 
 	// Add middleware for dynamic BaseURL
 	s.router.Use(s.baseURLMiddleware())
@@ -113,6 +538,53 @@ func (s *Server) baseURLMiddleware() gin.HandlerFunc {
 	}
 }
 
+// requestLogger tags each request with an ID, taken from X-Request-ID when
+// the caller sends a usable one, and writes it to the access log once it
+// has been handled. The client IP is resolved as for tracking events.
+func (s *Server) requestLogger() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+
+		requestID := c.GetHeader("X-Request-ID")
+		if !validRequestID(requestID) {
+			requestID = utils.GenerateUUID()
+		}
+		c.Header("X-Request-ID", requestID)
+		c.Request = c.Request.WithContext(logging.WithRequestID(c.Request.Context(), requestID))
+
+		c.Next()
+
+		s.accessLog.Log(logging.AccessEntry{
+			Time:      start,
+			Method:    c.Request.Method,
+			Path:      c.Request.URL.EscapedPath(),
+			Proto:     c.Request.Proto,
+			Status:    c.Writer.Status(),
+			Bytes:     max(c.Writer.Size(), 0),
+			Duration:  time.Since(start),
+			ClientIP:  utils.GetClientIP(c.Request, s.trustedProxies),
+			User:      currentUsername(c),
+			UserAgent: c.Request.UserAgent(),
+			Referer:   utils.RedactURL(c.Request.Referer()),
+			RequestID: requestID,
+		})
+	}
+}
+
+// validRequestID accepts short IDs of letters, digits, dashes and underscores
+// so callers can't inject arbitrary text into logs.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 64 {
+		return false
+	}
+	for _, r := range id {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_') {
+			return false
+		}
+	}
+	return true
+}
+
 func (s *Server) entryPoint(c *gin.Context) {
 	// Get BaseURL from context
 	baseURL, _ := c.Get("baseURL")
@@ -123,7 +595,6 @@ func (s *Server) entryPoint(c *gin.Context) {
 		"version":     "1.0.0",
 		"environment": s.config.App.Env,
 		"base_url":    baseURL,
-		"tracking_id": s.config.App.TrackingID,
 	})
 }
 func (s *Server) healthCheck(c *gin.Context) {
@@ -136,7 +607,6 @@ func (s *Server) healthCheck(c *gin.Context) {
 		"version":     "1.0.0",
 		"environment": s.config.App.Env,
 		"base_url":    baseURL,
-		"tracking_id": s.config.App.TrackingID,
 	})
 }
 func (s *Server) trackEmailOpen(c *gin.Context) {
@@ -149,10 +619,34 @@ func (s *Server) trackEmailOpen(c *gin.Context) {
 	s.tracker.TrackEmailOpen(c.Writer, c.Request, trackingID, baseURL.(string))
 }
 
+func (s *Server) trackLinkClick(c *gin.Context) {
+	s.tracker.TrackClick(c.Writer, c.Request, c.Param("id"), c.Param("link"))
+}
+
 func (s *Server) sendEmail(c *gin.Context) {
 	var req models.EmailRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		bindError(c, err)
+		return
+	}
+
+	if (req.ABTestID == "") != (req.Variant == "") {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "ab_test_id and variant must be set together"})
+		return
+	}
+
+	// A send attached to one of the tenant's campaigns falls back on it
+	if req.CampaignID != "" {
+		if campaign, ok := s.campaigns.Get(req.CampaignID); ok {
+			if campaign.Tenant() != currentTenant(c) {
+				c.JSON(http.StatusNotFound, gin.H{"error": "Campaign not found"})
+				return
+			}
+			campaigns.Attach(&req, campaign)
+		}
+	}
+	if req.Subject == "" || req.Body == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "subject and body are required, unless campaign_id names a campaign"})
 		return
 	}
 
@@ -164,15 +658,21 @@ func (s *Server) sendEmail(c *gin.Context) {
 		}
 	}
 
-	// Get BaseURL from context to use in tracking pixel
-	baseURL, _ := c.Get("baseURL")
+	// The email belongs to the sender's tenant, and its tracking links
+	// use the tenant's domain
+	req.TenantID = currentTenant(c)
+	baseURL := s.trackingBaseURL(c)
 
 	// Send email using service with BaseURL
-	trackingID, err := s.emailService.SendTrackedEmail(c.Request.Context(), &req, baseURL.(string))
+	trackingID, err := s.emailService.SendTrackedEmail(c.Request.Context(), &req, baseURL)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		s.sendFailed(c, err)
 		return
 	}
+	s.recordAudit(c, audit.ActionEmailSend, trackingID, map[string]string{
+		"to":      strings.Join(req.To, ","),
+		"subject": req.Subject,
+	})
 
 	c.JSON(http.StatusOK, gin.H{
 		"message":     "Email sent successfully",
@@ -186,6 +686,14 @@ func (s *Server) getTrackingInfo(c *gin.Context) {
 	trackingID := c.Param("id")
 	stats := s.tracker.GetTrackingStats(trackingID)
 
+	// Latest human open when bot-filtered metrics are requested
+	if isFiltered(c) {
+		stats = nil
+		if events := analytics.HumanEvents(s.tracker.GetAllTrackingEvents(trackingID)); len(events) > 0 {
+			stats = events[len(events)-1]
+		}
+	}
+
 	if stats == nil {
 		c.JSON(http.StatusNotFound, gin.H{"error": "Tracking data not found"})
 		return
@@ -194,19 +702,182 @@ func (s *Server) getTrackingInfo(c *gin.Context) {
 	c.JSON(http.StatusOK, stats)
 }
 
-func (s *Server) dashboard(c *gin.Context) {
-	// Get BaseURL from context
-	baseURL, _ := c.Get("baseURL")
+const (
+	defaultEmailsPerPage = 25
+	maxEmailsPerPage     = 200
+)
 
-	// Serve dashboard HTML with BaseURL injected
-	c.HTML(http.StatusOK, "./templates/dashboard.html", gin.H{
-		"title":       "Email Tracker Dashboard",
-		"baseURL":     baseURL,
-		"environment": s.config.App.Env,
-		"trackingID":  s.config.App.TrackingID,
+// listEmails searches emails by ?q= (recipient or subject), ?tag= and
+// ?status= (opened, unopened, bounced, failed), one page at a time.
+func (s *Server) listEmails(c *gin.Context) {
+	query, err := emailQuery(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	emails, total := s.tracker.SearchEmails(query)
+	if emails == nil {
+		emails = []*models.Email{}
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"emails":   emails,
+		"total":    total,
+		"page":     query.Page,
+		"per_page": query.PerPage,
 	})
 }
 
+// emailQuery reads email search parameters from the query string
+func emailQuery(c *gin.Context) (tracker.EmailQuery, error) {
+	query := tracker.EmailQuery{
+		Tenant:   currentTenant(c),
+		Search:   c.Query("q"),
+		Tag:      c.Query("tag"),
+		Status:   c.Query("status"),
+		Filtered: isFiltered(c),
+		Page:     1,
+		PerPage:  defaultEmailsPerPage,
+	}
+
+	switch query.Status {
+	case "", tracker.StatusOpened, tracker.StatusUnopened, tracker.StatusBounced, tracker.StatusFailed:
+	default:
+		return query, fmt.Errorf("unsupported status %q, use opened, unopened, bounced or failed", query.Status)
+	}
+
+	var err error
+	query.Page, query.PerPage, err = pagination(c)
+	return query, err
+}
+
+// pagination reads ?page= and ?per_page=, defaulting to the first page of
+// defaultEmailsPerPage
+func pagination(c *gin.Context) (page, perPage int, err error) {
+	page, perPage = 1, defaultEmailsPerPage
+	if v := c.Query("page"); v != "" {
+		page, err = strconv.Atoi(v)
+		if err != nil || page < 1 {
+			return 1, perPage, fmt.Errorf("page must be a positive integer")
+		}
+	}
+	if v := c.Query("per_page"); v != "" {
+		perPage, err = strconv.Atoi(v)
+		if err != nil || perPage < 1 || perPage > maxEmailsPerPage {
+			return page, defaultEmailsPerPage, fmt.Errorf("per_page must be between 1 and %d", maxEmailsPerPage)
+		}
+	}
+	return page, perPage, nil
+}
+
+func (s *Server) getEmail(c *gin.Context) {
+	email := s.tracker.GetEmail(c.Param("id"))
+
+	if email == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Email not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, email)
+}
+
+func (s *Server) reportBounce(c *gin.Context) {
+	var req models.BounceRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		bindError(c, err)
+		return
+	}
+
+	email, err := s.tracker.MarkBounced(c.Param("id"), req.Type, req.Reason)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Email not found"})
+		return
+	}
+	s.recordAudit(c, audit.ActionEmailBounce, email.TrackingID, map[string]string{"type": req.Type})
+	// Soft bounces are temporary, so only hard ones stop further sends
+	if req.Type == "hard" {
+		s.suppressRecipients(c, auditActor(c), email, suppression.ReasonHardBounce, req.Reason)
+	}
+
+	c.JSON(http.StatusOK, email)
+}
+
+func (s *Server) resendEmail(c *gin.Context) {
+	email := s.tracker.GetEmail(c.Param("id"))
+	if email == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Email not found"})
+		return
+	}
+
+	trackingID, err := s.emailService.Resend(c.Request.Context(), email, s.trackingBaseURL(c))
+	if err != nil {
+		s.sendFailed(c, err)
+		return
+	}
+	s.recordAudit(c, audit.ActionEmailResend, trackingID, map[string]string{"original": email.TrackingID})
+
+	c.JSON(http.StatusOK, gin.H{
+		"message":     "Email resent successfully",
+		"tracking_id": trackingID,
+	})
+}
+
+func (s *Server) deleteEmail(c *gin.Context) {
+	if !s.tracker.DeleteEmail(c.Param("id")) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Email not found"})
+		return
+	}
+	s.recordAudit(c, audit.ActionEmailDelete, c.Param("id"), nil)
+
+	c.Status(http.StatusNoContent)
+}
+
+// sendFailed responds 422 when a recipient is suppressed or a strict guard
+// refuses the send, 503 with Retry-After when the SMTP workers are
+// saturated or shutting down, or the SMTP circuit breaker is open, so
+// clients know to retry, and 500 for any other failed send, without what
+// the mail server said
+func (s *Server) sendFailed(c *gin.Context, err error) {
+	var suppressed *suppression.Error
+	if errors.As(err, &suppressed) {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error(), "suppressed": suppressed.Addresses})
+		return
+	}
+	var unconfirmed *consent.Error
+	if errors.As(err, &unconfirmed) {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error(), "unconfirmed": unconfirmed.Addresses})
+		return
+	}
+	var unauthenticated *deliverability.Error
+	if errors.As(err, &unauthenticated) {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error(), "issues": unauthenticated.Issues})
+		return
+	}
+	var openErr *breaker.OpenError
+	if errors.As(err, &openErr) && openErr.RetryAfter > 0 {
+		c.Header("Retry-After", strconv.Itoa(int(math.Ceil(openErr.RetryAfter.Seconds()))))
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+		return
+	}
+	if errors.Is(err, tenants.ErrSuspended) {
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+		return
+	}
+	var overQuota *tenants.QuotaError
+	if errors.As(err, &overQuota) {
+		c.Header("Retry-After", strconv.Itoa(max(1, int(math.Ceil(time.Until(overQuota.ResetAt).Seconds())))))
+		c.JSON(http.StatusTooManyRequests, gin.H{"error": err.Error(), "quota": overQuota.Period, "limit": overQuota.Limit})
+		return
+	}
+	if errors.Is(err, notification.ErrQueueFull) || errors.Is(err, notification.ErrClosed) || errors.Is(err, breaker.ErrOpen) {
+		c.Header("Retry-After", s.sends.retryAfter())
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+		return
+	}
+	s.serverError(c, http.StatusInternalServerError, sendErrorMessage(err), err)
+}
+
 // Helper function to get dynamic BaseURL for templates
 func (s *Server) getDynamicBaseURL(c *gin.Context) string {
 	baseURL, exists := c.Get("baseURL")
@@ -217,9 +888,31 @@ func (s *Server) getDynamicBaseURL(c *gin.Context) string {
 	return s.config.GetBaseURL(c.Request.Host)
 }
 
+// trackingBaseURL is the base URL for the links in the tenant's mail: its
+// verified tracking domain, with the scheme and port of the configured
+// base URL, or that base URL when it has none
+func (s *Server) trackingBaseURL(c *gin.Context) string {
+	baseURL := s.getDynamicBaseURL(c)
+	domain := s.tenants.TrackingDomain(currentTenant(c))
+	if domain == "" {
+		return baseURL
+	}
+	u, err := url.Parse(baseURL)
+	if err != nil || u.Host == "" {
+		return "https://" + domain
+	}
+	if port := u.Port(); port != "" {
+		domain = net.JoinHostPort(domain, port)
+	}
+	return u.Scheme + "://" + domain
+}
+
 func (s *Server) Start() error {
 
-	// Add middleware for dynamic BaseURL FIRST
+	// Tag requests with an ID and log them, turn away unexpected methods
+	// and set security headers, then add dynamic BaseURL
+	s.router.Use(s.requestLogger())
+	s.router.Use(s.restrictMethods(), s.securityHeaders())
 	s.router.Use(s.baseURLMiddleware())
 	s.setupRoutes()
 
@@ -227,65 +920,276 @@ func (s *Server) Start() error {
 	s.server = &http.Server{
 		Addr:         addr,
 		Handler:      s.router,
-		ReadTimeout:  10 * time.Second,
-		WriteTimeout: 10 * time.Second,
-		IdleTimeout:  60 * time.Second,
+		ReadTimeout:  s.config.Timeouts.HTTPRead,
+		WriteTimeout: s.config.Timeouts.HTTPWrite,
+		IdleTimeout:  s.config.Timeouts.HTTPIdle,
 	}
 
-	log.Printf("Server starting on %s", addr)
-	log.Printf("Environment: %s", s.config.App.Env)
-	log.Printf("Tracking ID: %s", s.config.App.TrackingID)
+	var httpHandler http.Handler
+	if s.config.TLSEnabled() {
+		tlsConfig, handler, err := s.setupTLS(s.config)
+		if err != nil {
+			return err
+		}
+		s.server.TLSConfig = tlsConfig
+		httpHandler = handler
+	}
 
-	if s.config.App.BaseURL != "" {
-		log.Printf("Static BaseURL: %s", s.config.App.BaseURL)
-	} else {
-		log.Printf("Using dynamic BaseURL from requests")
+	baseURL := s.config.App.BaseURL
+	if baseURL == "" {
+		baseURL = "dynamic"
 	}
+	slog.Info("server starting", "addr", addr, "env", s.config.App.Env, "tls", s.config.TLSEnabled(),
+		"base_url", baseURL)
 
 	// Graceful shutdown
 	go func() {
-		if err := s.server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-			log.Fatalf("Failed to start server: %v", err)
+		var err error
+		if s.server.TLSConfig != nil {
+			err = s.server.ListenAndServeTLS("", "")
+		} else {
+			err = s.server.ListenAndServe()
+		}
+		if err != nil && err != http.ErrServerClosed {
+			logging.Fatal("failed to start server", "error", err)
 		}
 	}()
 
+	if httpHandler != nil {
+		httpAddr := fmt.Sprintf("%s:%s", s.config.Server.Host, s.config.TLS.HTTPPort)
+		s.httpServer = &http.Server{
+			Addr:         httpAddr,
+			Handler:      httpHandler,
+			ReadTimeout:  s.config.Timeouts.HTTPRead,
+			WriteTimeout: s.config.Timeouts.HTTPWrite,
+			IdleTimeout:  s.config.Timeouts.HTTPIdle,
+		}
+		slog.Info("redirecting HTTP to HTTPS", "addr", httpAddr)
+		go func() {
+			if err := s.httpServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				logging.Fatal("failed to start HTTP listener", "error", err)
+			}
+		}()
+	}
+
 	return nil
 }
 
+// Reload applies a freshly loaded config to everything that can change at
+// runtime: SMTP settings, scan alerts, reports, users, API keys, session
+// lifetime and the TLS certificate files' contents. In-memory tracking
+// data is kept. Settings the server was started with, like the listen
+// address or Redis, still need a restart.
+func (s *Server) Reload(cfg *config.Config) {
+	s.notifier.ApplyConfig(cfg)
+	s.tracker.ApplyConfig(cfg)
+	s.reports.ApplyConfig(cfg)
+	s.users.Reload(cfg)
+	warnIgnoredKeys(s.users, s.tenants)
+	s.sessions.SetTTL(cfg.Auth.SessionTTL)
+	logging.ApplyConfig(cfg)
+	s.accessLog.ApplyConfig(cfg)
+	s.reloadCertificate(cfg)
+	s.deliverability.ApplyConfig(cfg)
+	s.storeAuditSettings(cfg)
+	s.consent.ApplyConfig(cfg)
+
+	if changed := needsRestart(s.config, cfg); len(changed) > 0 {
+		slog.Warn("config changes need a restart to take effect", "sections", changed)
+	}
+
+	slog.Info("configuration reloaded")
+}
+
+// needsRestart lists the settings changed from old to cfg that only take
+// effect on a restart
+func needsRestart(old, cfg *config.Config) []string {
+	var changed []string
+	check := func(section string, differs bool) {
+		if differs {
+			changed = append(changed, section)
+		}
+	}
+	check("server", cfg.Server.Port != old.Server.Port || cfg.Server.Host != old.Server.Host ||
+		!slices.Equal(cfg.Server.TrustedProxies, old.Server.TrustedProxies))
+	check("TLS", cfg.TLS.CertFile != old.TLS.CertFile || cfg.TLS.KeyFile != old.TLS.KeyFile ||
+		!slices.Equal(cfg.TLS.AutocertDomains, old.TLS.AutocertDomains) || cfg.TLS.AutocertEmail != old.TLS.AutocertEmail ||
+		cfg.TLS.AutocertCacheDir != old.TLS.AutocertCacheDir || cfg.TLS.HTTPPort != old.TLS.HTTPPort)
+	check("security headers", cfg.Security.HSTSMaxAge != old.Security.HSTSMaxAge ||
+		cfg.Security.FrameOptions != old.Security.FrameOptions || cfg.Security.ReferrerPolicy != old.Security.ReferrerPolicy)
+	check("request limits", cfg.Security.MaxBodySize != old.Security.MaxBodySize ||
+		!slices.Equal(cfg.Security.AllowedMethods, old.Security.AllowedMethods))
+	check("Redis", cfg.Redis != old.Redis)
+	check("cluster", cfg.Cluster != old.Cluster)
+	check("app environment", cfg.App.Env != old.App.Env)
+	check("assets dir", cfg.App.AssetsDir != old.App.AssetsDir)
+	check("pixel path", cfg.Tracking.PixelPath != old.Tracking.PixelPath)
+	check("geo queue", cfg.GeoAPI.QueueSize != old.GeoAPI.QueueSize)
+	check("log format", cfg.Log.Format != old.Log.Format)
+	check("SMTP pool", cfg.SMTP.Workers != old.SMTP.Workers || cfg.SMTP.QueueSize != old.SMTP.QueueSize)
+	check("notification pool", cfg.Notifications.Workers != old.Notifications.Workers ||
+		cfg.Notifications.QueueSize != old.Notifications.QueueSize)
+	check("send admission", cfg.Sends != old.Sends)
+	check("outbound HTTP client", cfg.HTTPClient != old.HTTPClient)
+	check("circuit breakers", cfg.Breakers != old.Breakers)
+	check("stats cache", cfg.StatsCache != old.StatsCache)
+	check("suppression list", cfg.Suppression != old.Suppression)
+	check("consent file", cfg.Consent.File != old.Consent.File)
+	check("contacts file", cfg.Contacts != old.Contacts)
+	check("segments file", cfg.Segments != old.Segments)
+	check("tenants file", cfg.Tenants != old.Tenants)
+	check("usage metering", cfg.Usage != old.Usage)
+	check("webhooks", !slices.Equal(cfg.Webhooks.URLs, old.Webhooks.URLs) ||
+		!slices.Equal(cfg.Webhooks.Secrets, old.Webhooks.Secrets) || !slices.Equal(cfg.Webhooks.Tenants, old.Webhooks.Tenants) ||
+		cfg.Webhooks.Timeout != old.Webhooks.Timeout || cfg.Webhooks.AllowPrivate != old.Webhooks.AllowPrivate)
+	check("event store", cfg.Storage != old.Storage)
+	return changed
+}
+
+// Shutdown fails readiness checks for the drain delay, so load balancers
+// stop sending traffic, then stops the listener and waits for requests in
+// flight to finish. Background work is drained after them: campaign sends
+// stop after the current recipient, queued opens are geolocated, notified
+// and persisted, and the SMTP queue is emptied. Whatever is left when ctx
+// is done is abandoned.
 func (s *Server) Shutdown(ctx context.Context) error {
-	return s.server.Shutdown(ctx)
+	s.draining.Store(true)
+	s.server.SetKeepAlivesEnabled(false)
+	if delay := s.config.Timeouts.ShutdownDrain; delay > 0 {
+		slog.Info("draining before shutdown", "delay", delay)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+		}
+	}
+
+	err := s.server.Shutdown(ctx)
+	if s.httpServer != nil {
+		s.httpServer.Shutdown(ctx)
+	}
+	if err := s.campaignScheduler.Close(ctx); err != nil {
+		slog.Error("gave up waiting for campaign sends", "error", err)
+	}
+	if err := s.tracker.Close(ctx); err != nil {
+		slog.Error("failed to drain tracking work", "error", err)
+	}
+	if err := s.webhooks.Close(ctx); err != nil {
+		slog.Error("gave up waiting for webhook deliveries", "error", err)
+	}
+	if err := s.notifier.Close(ctx); err != nil {
+		slog.Error("gave up waiting for queued emails", "error", err, "queued", s.notifier.PoolStats().Queued)
+	}
+	s.audit.Close()
+	s.suppressions.Close()
+	s.consent.Close()
+	s.tenants.Close()
+	if err := s.contacts.Close(); err != nil {
+		slog.Error("failed to write contacts file", "error", err)
+	}
+	if err := s.usage.Close(); err != nil {
+		slog.Error("failed to write usage file", "error", err)
+	}
+	return err
+}
+
+// resolveSecrets replaces secrets manager references in the config with the
+// secrets themselves.
+func resolveSecrets(resolver *secrets.Resolver, raw *config.Config) (*config.Config, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	return resolver.Resolve(ctx, raw)
 }
 
 func main() {
-	// Load configuration
-	cfg := config.MustLoadConfig()
+	if len(os.Args) > 1 && os.Args[1] == "config" {
+		os.Exit(runConfigCommand(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "audit" {
+		os.Exit(runAuditCommand(os.Args[2:]))
+	}
 
-	// Log config status
-	log.Printf("Configuration loaded successfully")
-	log.Printf("Environment: %s", cfg.App.Env)
+	opts, err := config.ParseFlags(os.Args[1:])
+	if err == flag.ErrHelp {
+		return
+	}
+	if err != nil {
+		logging.Fatal("invalid arguments", "error", err)
+	}
+
+	// Load configuration and fetch secrets referenced from it
+	raw := config.MustLoadConfig(opts)
+	resolver := secrets.NewResolver()
+	cfg, err := resolveSecrets(resolver, raw)
+	if err != nil {
+		logging.Fatal("failed to resolve secrets", "error", err)
+	}
+
+	logging.Setup(cfg)
+	slog.Info("configuration loaded", "env", cfg.App.Env)
 
 	// Create server
 	server := NewServer(cfg)
 
 	// Start server
 	if err := server.Start(); err != nil {
-		log.Fatalf("Failed to start server: %v", err)
+		logging.Fatal("failed to start server", "error", err)
 	}
 
+	// Reload configuration on SIGHUP and refresh secrets periodically
+	reload := make(chan os.Signal, 1)
+	signal.Notify(reload, syscall.SIGHUP)
+	go func() {
+		var refresh <-chan time.Time
+		if raw.Secrets.RefreshInterval > 0 {
+			ticker := time.NewTicker(raw.Secrets.RefreshInterval)
+			defer ticker.Stop()
+			refresh = ticker.C
+		}
+
+		for {
+			select {
+			case <-reload:
+				slog.Info("reloading configuration")
+				reloaded, err := config.Reload(opts)
+				if err != nil {
+					slog.Error("failed to reload configuration, keeping current one", "error", err)
+					server.audit.Record(audit.Entry{Actor: audit.ActorSystem, Action: audit.ActionConfigReload,
+						Details: map[string]string{"result": "failed", "error": err.Error()}})
+					continue
+				}
+				raw = reloaded
+				server.audit.Record(audit.Entry{Actor: audit.ActorSystem, Action: audit.ActionConfigReload,
+					Details: map[string]string{"result": "applied"}})
+			case <-refresh:
+				if !secrets.HasReferences(raw) {
+					continue
+				}
+			}
+
+			cfg, err := resolveSecrets(resolver, raw)
+			if err != nil {
+				slog.Error("failed to resolve secrets, keeping current configuration", "error", err)
+				continue
+			}
+			server.Reload(cfg)
+		}
+	}()
+
 	// Wait for interrupt signal
 	quit := make(chan os.Signal, 1)
 	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
 	<-quit
 
-	log.Println("Shutting down server...")
+	slog.Info("shutting down server")
 
-	// Create shutdown context with timeout
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	// Create shutdown context with timeout, on top of the drain delay
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.Timeouts.ShutdownDrain+cfg.Timeouts.Shutdown)
 	defer cancel()
 
 	if err := server.Shutdown(ctx); err != nil {
-		log.Fatalf("Server forced to shutdown: %v", err)
+		logging.Fatal("server forced to shutdown", "error", err)
 	}
 
-	log.Println("Server exited properly")
+	slog.Info("server exited")
 }
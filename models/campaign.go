@@ -0,0 +1,81 @@
+package models
+
+import "time"
+
+// Campaign lifecycle. A campaign is a draft until it is scheduled or sent,
+// and moves to sent once every recipient has been attempted.
+const (
+	CampaignStatusDraft     = "draft"
+	CampaignStatusScheduled = "scheduled"
+	CampaignStatusSending   = "sending"
+	CampaignStatusSent      = "sent"
+)
+
+// Campaign is a single message sent to a list of recipients. Every recipient
+// gets an individually tracked email tagged with the campaign's ID. Sends
+// made on their own can be attached to it too, using its subject and body
+// as a template, and its stats cover them all.
+type Campaign struct {
+	ID         string   `json:"id" bson:"id"`
+	TenantID   string   `json:"tenant_id,omitempty" bson:"tenant_id,omitempty"`
+	Name       string   `json:"name" bson:"name"`
+	Tags       []string `json:"tags" bson:"tags"`
+	Subject    string   `json:"subject" bson:"subject"`
+	Body       string   `json:"body" bson:"body"`
+	Recipients []string `json:"recipients" bson:"recipients"`
+	// SegmentID names the segment whose members the campaign is sent to,
+	// instead of a list. Recipients are filled in with them when sending.
+	SegmentID   string     `json:"segment_id,omitempty" bson:"segment_id,omitempty"`
+	TrackClicks bool       `json:"track_clicks" bson:"track_clicks"`
+	Status      string     `json:"status" bson:"status"`
+	CreatedAt   time.Time  `json:"created_at" bson:"created_at"`
+	ScheduledAt *time.Time `json:"scheduled_at,omitempty" bson:"scheduled_at,omitempty"`
+	SentAt      *time.Time `json:"sent_at,omitempty" bson:"sent_at,omitempty"`
+	Sent        int        `json:"sent" bson:"sent"`
+	Failed      int        `json:"failed" bson:"failed"`
+	// Suppressed counts recipients skipped for being on the suppression
+	// list
+	Suppressed int `json:"suppressed" bson:"suppressed"`
+	// Unconfirmed counts recipients skipped for not having confirmed
+	// consent, when CONSENT_MODE is strict
+	Unconfirmed int `json:"unconfirmed" bson:"unconfirmed"`
+	// RetentionDays is how long the campaign's emails are kept; 0 keeps
+	// them as long as the configured retention
+	RetentionDays int `json:"retention_days" bson:"retention_days"`
+
+	// BaseURL the campaign was created under, used for tracking links when
+	// it is sent later by the scheduler
+	BaseURL string `json:"-" bson:"base_url"`
+}
+
+// Tenant returns the tenant the campaign belongs to.
+func (c *Campaign) Tenant() string {
+	return TenantOr(c.TenantID)
+}
+
+type CampaignRequest struct {
+	Name    string   `json:"name" form:"name" binding:"required"`
+	Tags    []string `json:"tags" form:"-"`
+	Subject string   `json:"subject" form:"subject" binding:"required"`
+	Body    string   `json:"body" form:"body" binding:"required"`
+	// Recipients or SegmentID, one of them, is who the campaign goes to
+	Recipients  []string   `json:"recipients" form:"-"`
+	SegmentID   string     `json:"segment_id" form:"segment_id"`
+	TrackClicks bool       `json:"track_clicks" form:"track_clicks"`
+	ScheduledAt *time.Time `json:"scheduled_at" form:"-"`
+	// RetentionDays overrides the configured retention for the campaign's
+	// emails
+	RetentionDays int `json:"retention_days" form:"retention_days" binding:"min=0"`
+	// TenantID is the creator's tenant, set by the server
+	TenantID string `json:"-" form:"-"`
+}
+
+// TagsRequest replaces a campaign's tags
+type TagsRequest struct {
+	Tags []string `json:"tags" binding:"required"`
+}
+
+// RetentionRequest changes how long a campaign's emails are kept
+type RetentionRequest struct {
+	RetentionDays *int `json:"retention_days" binding:"required,min=0"`
+}
@@ -2,8 +2,24 @@ package models
 
 import "time"
 
+// Delivery statuses of an email. An email is delivered once the SMTP relay
+// accepted it, and moves to bounced when a bounce is reported for it.
+const (
+	DeliveryStatusDelivered = "delivered"
+	DeliveryStatusFailed    = "failed"
+	DeliveryStatusBounced   = "bounced"
+)
+
+// Categories of an email. Marketing sends need the recipients' confirmed
+// consent when CONSENT_MODE is strict; transactional ones never do.
+const (
+	CategoryTransactional = "transactional"
+	CategoryMarketing     = "marketing"
+)
+
 type Email struct {
 	ID           string    `json:"id" bson:"id"`
+	TenantID     string    `json:"tenant_id,omitempty" bson:"tenant_id,omitempty"`
 	From         string    `json:"from" bson:"from"`
 	To           string    `json:"to" bson:"to"`
 	Subject      string    `json:"subject" bson:"subject"`
@@ -12,12 +28,182 @@ type Email struct {
 	SentAt       time.Time `json:"sent_at" bson:"sent_at"`
 	NotifyOnOpen bool      `json:"notify_on_open" bson:"notify_on_open"`
 	NotifyEmail  string    `json:"notify_email" bson:"notify_email"`
+	CampaignID   string    `json:"campaign_id,omitempty" bson:"campaign_id,omitempty"`
+	Links        []string  `json:"links,omitempty" bson:"links,omitempty"`
+	ABTestID     string    `json:"ab_test_id,omitempty" bson:"ab_test_id,omitempty"`
+	Variant      string    `json:"variant,omitempty" bson:"variant,omitempty"`
+	Tags         []string  `json:"tags,omitempty" bson:"tags,omitempty"`
+	Category     string    `json:"category,omitempty" bson:"category,omitempty"`
+	// RetentionDays keeps the email and its events this many days instead
+	// of the configured retention; 0 uses the configured retention
+	RetentionDays int `json:"retention_days,omitempty" bson:"retention_days,omitempty"`
+
+	DeliveryStatus string     `json:"delivery_status" bson:"delivery_status"`
+	BouncedAt      *time.Time `json:"bounced_at,omitempty" bson:"bounced_at,omitempty"`
+	BounceType     string     `json:"bounce_type,omitempty" bson:"bounce_type,omitempty"`
+	BounceReason   string     `json:"bounce_reason,omitempty" bson:"bounce_reason,omitempty"`
+
+	Stats         EmailStats `json:"stats" bson:"stats"`
+	FilteredStats EmailStats `json:"filtered_stats" bson:"filtered_stats"`
+}
+
+// Tenant returns the tenant the email belongs to.
+func (e *Email) Tenant() string {
+	return TenantOr(e.TenantID)
+}
+
+// OpenStats returns the bot-filtered aggregates when filtered is set and the
+// raw aggregates otherwise.
+func (e *Email) OpenStats(filtered bool) *EmailStats {
+	if filtered {
+		return &e.FilteredStats
+	}
+	return &e.Stats
+}
+
+// Retention returns how long the email and its events are kept: its own
+// retention for both when it has one, emailMaxAge and eventMaxAge
+// otherwise.
+func (e *Email) Retention(emailMaxAge, eventMaxAge time.Duration) (time.Duration, time.Duration) {
+	if e != nil && e.RetentionDays > 0 {
+		maxAge := time.Duration(e.RetentionDays) * 24 * time.Hour
+		return maxAge, maxAge
+	}
+	return emailMaxAge, eventMaxAge
+}
+
+// RecordOpen adds an open to the raw aggregates and, unless it came from a
+// bot, to the filtered ones.
+func (e *Email) RecordOpen(event *TrackingEvent) {
+	e.Stats.RecordOpen(event)
+	if !event.IsBot {
+		e.FilteredStats.RecordOpen(event)
+	}
+}
+
+// RecordLocation adds the country of an open whose location was looked up
+// after it was recorded.
+func (e *Email) RecordLocation(event *TrackingEvent) {
+	e.Stats.Countries = appendUnique(e.Stats.Countries, event.Country)
+	if !event.IsBot {
+		e.FilteredStats.Countries = appendUnique(e.FilteredStats.Countries, event.Country)
+	}
+}
+
+// RecordClick adds a click to the raw aggregates and, unless it came from a
+// bot, to the filtered ones.
+func (e *Email) RecordClick(event *ClickEvent) {
+	e.Stats.RecordClick(event)
+	if !event.IsBot {
+		e.FilteredStats.RecordClick(event)
+	}
+}
+
+type BounceRequest struct {
+	Type   string `json:"type" binding:"required,oneof=hard soft"`
+	Reason string `json:"reason"`
+}
+
+// EmailStats holds open aggregates for a single email, updated incrementally
+// as tracking events arrive.
+type EmailStats struct {
+	TotalOpens  int        `json:"total_opens" bson:"total_opens"`
+	UniqueOpens int        `json:"unique_opens" bson:"unique_opens"`
+	FirstOpenAt *time.Time `json:"first_open_at,omitempty" bson:"first_open_at,omitempty"`
+	LastOpenAt  *time.Time `json:"last_open_at,omitempty" bson:"last_open_at,omitempty"`
+	Countries   []string   `json:"countries" bson:"countries"`
+	Devices     []string   `json:"devices" bson:"devices"`
+	TotalClicks int        `json:"total_clicks" bson:"total_clicks"`
+	LastClickAt *time.Time `json:"last_click_at,omitempty" bson:"last_click_at,omitempty"`
+	Warnings    []Anomaly  `json:"warnings,omitempty" bson:"warnings,omitempty"`
+
+	openers map[string]struct{}
+}
+
+// Anomaly types flagged by background analysis of an email's opens
+const (
+	AnomalyInstantOpen      = "instant_open"
+	AnomalyISPSpike         = "isp_spike"
+	AnomalyImpossibleTravel = "impossible_travel"
+)
+
+type Anomaly struct {
+	Type    string    `json:"type" bson:"type"`
+	Message string    `json:"message" bson:"message"`
+	EventID string    `json:"event_id" bson:"event_id"`
+	At      time.Time `json:"at" bson:"at"`
+}
+
+// RecordOpen folds a tracking event into the aggregates. An open is counted as
+// unique per IP address and user agent pair.
+func (s *EmailStats) RecordOpen(event *TrackingEvent) {
+	s.TotalOpens++
+
+	if s.FirstOpenAt == nil || event.OpenedAt.Before(*s.FirstOpenAt) {
+		openedAt := event.OpenedAt
+		s.FirstOpenAt = &openedAt
+	}
+	if s.LastOpenAt == nil || event.OpenedAt.After(*s.LastOpenAt) {
+		openedAt := event.OpenedAt
+		s.LastOpenAt = &openedAt
+	}
+
+	if s.openers == nil {
+		s.openers = make(map[string]struct{})
+	}
+	key := event.IPAddress + "|" + event.UserAgent
+	if _, seen := s.openers[key]; !seen {
+		s.openers[key] = struct{}{}
+		s.UniqueOpens++
+	}
+
+	s.Countries = appendUnique(s.Countries, event.Country)
+	s.Devices = appendUnique(s.Devices, event.DeviceType)
+}
+
+// RecordClick folds a click on one of the email's tracked links into the
+// aggregates.
+func (s *EmailStats) RecordClick(event *ClickEvent) {
+	s.TotalClicks++
+
+	if s.LastClickAt == nil || event.ClickedAt.After(*s.LastClickAt) {
+		clickedAt := event.ClickedAt
+		s.LastClickAt = &clickedAt
+	}
+}
+
+func appendUnique(values []string, value string) []string {
+	if value == "" {
+		return values
+	}
+	for _, v := range values {
+		if v == value {
+			return values
+		}
+	}
+	return append(values, value)
 }
 
 type EmailRequest struct {
-	To           []string `json:"to" binding:"required"`
-	Subject      string   `json:"subject" binding:"required"`
-	Body         string   `json:"body" binding:"required"`
-	NotifyOnOpen bool     `json:"notify_on_open"`
-	NotifyEmail  string   `json:"notify_email"`
+	To []string `json:"to" binding:"required"`
+	// Subject and Body are required, unless CampaignID names a campaign
+	// whose own are used
+	Subject      string `json:"subject"`
+	Body         string `json:"body"`
+	NotifyOnOpen bool   `json:"notify_on_open"`
+	NotifyEmail  string `json:"notify_email"`
+	// CampaignID attaches the email to a campaign, which may be one
+	// created through the campaigns API or just a name to group by
+	CampaignID  string   `json:"campaign_id"`
+	TrackClicks bool     `json:"track_clicks"`
+	ABTestID    string   `json:"ab_test_id"`
+	Variant     string   `json:"variant"`
+	Tags        []string `json:"tags"`
+	// Category is transactional, the default, or marketing
+	Category string `json:"category" binding:"omitempty,oneof=transactional marketing"`
+	// RetentionDays overrides how long the email is kept; 0 keeps it as
+	// long as the configured retention
+	RetentionDays int `json:"retention_days" binding:"min=0"`
+	// TenantID is the sender's tenant, set by the server
+	TenantID string `json:"-"`
 }
@@ -0,0 +1,39 @@
+package models
+
+import (
+	"regexp"
+	"time"
+)
+
+// DefaultTenant owns the data of users and API keys not assigned to a
+// tenant, and everything recorded before tenants were configured. It is
+// the operator's own workspace.
+const DefaultTenant = "default"
+
+var tenantIDPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,62}$`)
+
+// ValidTenantID reports whether id can name a tenant: lowercase letters,
+// digits, dashes and underscores, up to 63 characters.
+func ValidTenantID(id string) bool {
+	return tenantIDPattern.MatchString(id)
+}
+
+// TenantOr returns id, or DefaultTenant when id is empty, as it is for
+// data recorded before tenants.
+func TenantOr(id string) string {
+	if id == "" {
+		return DefaultTenant
+	}
+	return id
+}
+
+// Branding is how a tenant's dashboard and open notifications look: its
+// name and logo in the header, and its colors as #rrggbb. Empty fields
+// keep the service's own.
+type Branding struct {
+	Name         string    `json:"name,omitempty"`
+	LogoURL      string    `json:"logo_url,omitempty"`
+	PrimaryColor string    `json:"primary_color,omitempty"`
+	AccentColor  string    `json:"accent_color,omitempty"`
+	UpdatedAt    time.Time `json:"updated_at"`
+}
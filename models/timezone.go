@@ -0,0 +1,73 @@
+package models
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	// Recipient timezones must resolve even where the OS has no zoneinfo,
+	// such as scratch containers
+	_ "time/tzdata"
+)
+
+// timezones caches loaded locations by name; unknown names map to nil
+var timezones sync.Map
+
+// LoadTimezone returns the IANA timezone called name, if there is one.
+func LoadTimezone(name string) (*time.Location, bool) {
+	if name == "" {
+		return nil, false
+	}
+	if loc, ok := timezones.Load(name); ok {
+		return loc.(*time.Location), loc.(*time.Location) != nil
+	}
+
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		loc = nil
+	}
+	timezones.Store(name, loc)
+	return loc, loc != nil
+}
+
+// InferTimezone estimates a timezone from longitude alone, for providers
+// that return coordinates but no zone. The result is a fixed offset such
+// as Etc/GMT-2 (UTC+2; the sign is inverted in these names), so it ignores
+// daylight saving and borders.
+func InferTimezone(lon float64) string {
+	offset := int(math.Round(lon / 15))
+	switch {
+	case offset == 0:
+		return "Etc/GMT"
+	case offset > 0:
+		return fmt.Sprintf("Etc/GMT-%d", min(offset, 12))
+	default:
+		return fmt.Sprintf("Etc/GMT+%d", min(-offset, 12))
+	}
+}
+
+// LocalOpenedAt is when the event happened on the recipient's clock, if
+// their timezone is known.
+func (e *TrackingEvent) LocalOpenedAt() (time.Time, bool) {
+	loc, ok := LoadTimezone(e.Timezone)
+	if !ok {
+		return time.Time{}, false
+	}
+	return e.OpenedAt.In(loc), true
+}
+
+// MarshalJSON adds the open time in UTC and, when the timezone is known, in
+// the recipient's local time.
+func (e TrackingEvent) MarshalJSON() ([]byte, error) {
+	type event TrackingEvent
+	out := struct {
+		event
+		OpenedAtUTC   time.Time `json:"opened_at_utc"`
+		OpenedAtLocal time.Time `json:"opened_at_local,omitzero"`
+	}{event: event(e), OpenedAtUTC: e.OpenedAt.UTC()}
+
+	out.OpenedAtLocal, _ = e.LocalOpenedAt()
+	return json.Marshal(out)
+}
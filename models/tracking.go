@@ -8,23 +8,65 @@ type TrackingEvent struct {
 	BaseURL    string    `json:"base_url" bson:"base_url"`
 	EmailID    string    `json:"email_id" bson:"email_id"`
 	IPAddress  string    `json:"ip_address" bson:"ip_address"`
+	IPFamily   string    `json:"ip_family,omitempty" bson:"ip_family,omitempty"`
 	UserAgent  string    `json:"user_agent" bson:"user_agent"`
 	Country    string    `json:"country" bson:"country"`
 	City       string    `json:"city" bson:"city"`
 	Region     string    `json:"region" bson:"region"`
 	ISP        string    `json:"isp" bson:"isp"`
+	Timezone   string    `json:"timezone,omitempty" bson:"timezone,omitempty"`
+	Lat        float64   `json:"lat" bson:"lat"`
+	Lon        float64   `json:"lon" bson:"lon"`
 	OpenedAt   time.Time `json:"opened_at" bson:"opened_at"`
 	DeviceType string    `json:"device_type" bson:"device_type"`
 	Browser    string    `json:"browser" bson:"browser"`
 	OS         string    `json:"os" bson:"os"`
+	IsBot      bool      `json:"is_bot" bson:"is_bot"`
+
+	// ClientName and ClientVersion identify the program that fetched the
+	// pixel, e.g. Edge 120.0.2210.91 or Thunderbird 115.5.0
+	ClientName    string `json:"client_name,omitempty" bson:"client_name,omitempty"`
+	ClientVersion string `json:"client_version,omitempty" bson:"client_version,omitempty"`
+	OSVersion     string `json:"os_version,omitempty" bson:"os_version,omitempty"`
+
+	// EmailClient is the mail app or webmail proxy that fetched the pixel,
+	// e.g. Gmail or Apple Mail, when it could be told from a browser
+	EmailClient string `json:"email_client,omitempty" bson:"email_client,omitempty"`
+
+	// ASN, ASOrg and ReverseDNS describe the network the open came from,
+	// and NetworkType classifies it as cloud, mobile, residential or
+	// corporate
+	ASN         int    `json:"asn,omitempty" bson:"asn,omitempty"`
+	ASOrg       string `json:"as_org,omitempty" bson:"as_org,omitempty"`
+	ReverseDNS  string `json:"reverse_dns,omitempty" bson:"reverse_dns,omitempty"`
+	NetworkType string `json:"network_type,omitempty" bson:"network_type,omitempty"`
+}
+
+type ClickEvent struct {
+	ID         string    `json:"id" bson:"id"`
+	TrackingID string    `json:"tracking_id" bson:"tracking_id"`
+	EmailID    string    `json:"email_id" bson:"email_id"`
+	URL        string    `json:"url" bson:"url"`
+	IPAddress  string    `json:"ip_address" bson:"ip_address"`
+	IPFamily   string    `json:"ip_family,omitempty" bson:"ip_family,omitempty"`
+	UserAgent  string    `json:"user_agent" bson:"user_agent"`
+	ClickedAt  time.Time `json:"clicked_at" bson:"clicked_at"`
+	IsBot      bool      `json:"is_bot" bson:"is_bot"`
 }
 
 type GeoLocation struct {
-	IP      string `json:"ip"`
-	Country string `json:"country"`
-	City    string `json:"city"`
-	Region  string `json:"region"`
-	ISP     string `json:"isp"`
-	Lat     string `json:"lat"`
-	Lon     string `json:"lon"`
+	IP       string `json:"ip"`
+	Country  string `json:"country"`
+	City     string `json:"city"`
+	Region   string `json:"region"`
+	ISP      string `json:"isp"`
+	Timezone string `json:"timezone"`
+	Lat      string `json:"lat"`
+	Lon      string `json:"lon"`
+
+	// Network details, when the provider or the network lookup found them
+	ASN         int    `json:"asn,omitempty"`
+	ASOrg       string `json:"as_org,omitempty"`
+	ReverseDNS  string `json:"reverse_dns,omitempty"`
+	NetworkType string `json:"network_type,omitempty"`
 }
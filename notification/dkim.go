@@ -0,0 +1,209 @@
+package notification
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// dkimHeaders are the headers signed when a message has them. From is
+// always among them, as DKIM requires.
+var dkimHeaders = []string{
+	"From", "To", "Cc", "Reply-To", "Subject", "Date", "Message-Id",
+	"Mime-Version", "Content-Type", "Content-Transfer-Encoding",
+}
+
+// DKIMSigner signs outgoing mail for a domain (RFC 6376), with relaxed
+// canonicalization of headers and body, and rsa-sha256 or ed25519-sha256
+// (RFC 8463) depending on the key.
+type DKIMSigner struct {
+	domain   string
+	selector string
+	key      crypto.Signer
+}
+
+// NewDKIMSigner returns a signer for domain's selector with a PEM private
+// key: PKCS #1 or PKCS #8 RSA, of at least 1024 bits, or PKCS #8 Ed25519.
+func NewDKIMSigner(domain, selector, keyPEM string) (*DKIMSigner, error) {
+	if domain == "" || selector == "" {
+		return nil, errors.New("DKIM needs a domain and a selector")
+	}
+	block, _ := pem.Decode([]byte(keyPEM))
+	if block == nil {
+		return nil, errors.New("DKIM key is not PEM")
+	}
+
+	var key any
+	var err error
+	if block.Type == "RSA PRIVATE KEY" {
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	} else {
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("parse DKIM key: %w", err)
+	}
+
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		if k.N.BitLen() < 1024 {
+			return nil, errors.New("DKIM RSA keys must have at least 1024 bits")
+		}
+		return &DKIMSigner{domain: strings.ToLower(domain), selector: selector, key: k}, nil
+	case ed25519.PrivateKey:
+		return &DKIMSigner{domain: strings.ToLower(domain), selector: selector, key: k}, nil
+	}
+	return nil, errors.New("DKIM keys must be RSA or Ed25519")
+}
+
+// RecordName is where the public key is published in DNS.
+func (d *DKIMSigner) RecordName() string {
+	return d.selector + "._domainkey." + d.domain
+}
+
+// Record is the TXT record to publish at RecordName.
+func (d *DKIMSigner) Record() string {
+	public := d.key.Public()
+	if key, ok := public.(ed25519.PublicKey); ok {
+		return "v=DKIM1; k=ed25519; p=" + base64.StdEncoding.EncodeToString(key)
+	}
+	der, _ := x509.MarshalPKIXPublicKey(public)
+	return "v=DKIM1; k=rsa; p=" + base64.StdEncoding.EncodeToString(der)
+}
+
+func (d *DKIMSigner) algorithm() string {
+	if _, ok := d.key.(ed25519.PrivateKey); ok {
+		return "ed25519-sha256"
+	}
+	return "rsa-sha256"
+}
+
+// sign returns raw, a whole message with CRLF line endings, with a
+// DKIM-Signature header in front.
+func (d *DKIMSigner) sign(raw []byte) ([]byte, error) {
+	head, body, ok := bytes.Cut(raw, []byte("\r\n\r\n"))
+	if !ok {
+		return nil, errors.New("message has no body")
+	}
+	fields := headerFields(string(head) + "\r\n")
+
+	// The last instance of a header is the one signed
+	var names []string
+	var signed strings.Builder
+	for _, name := range dkimHeaders {
+		for i := len(fields) - 1; i >= 0; i-- {
+			if fieldName(fields[i]) == strings.ToLower(name) {
+				names = append(names, strings.ToLower(name))
+				signed.WriteString(relaxedHeader(fields[i]))
+				signed.WriteString("\r\n")
+				break
+			}
+		}
+	}
+	if len(names) == 0 || names[0] != "from" {
+		return nil, errors.New("message has no From header")
+	}
+
+	bodyHash := sha256.Sum256(relaxedBody(body))
+	header := fmt.Sprintf("DKIM-Signature: v=1; a=%s; c=relaxed/relaxed; d=%s; s=%s; t=%d;\r\n\th=%s;\r\n\tbh=%s;\r\n\tb=",
+		d.algorithm(), d.domain, d.selector, time.Now().Unix(), strings.Join(names, ":"),
+		base64.StdEncoding.EncodeToString(bodyHash[:]))
+	signed.WriteString(relaxedHeader(header))
+
+	digest := sha256.Sum256([]byte(signed.String()))
+	var opts crypto.SignerOpts = crypto.SHA256
+	if _, ok := d.key.(ed25519.PrivateKey); ok {
+		// Ed25519 signs the SHA-256 hash itself as the message
+		opts = crypto.Hash(0)
+	}
+	signature, err := d.key.Sign(rand.Reader, digest[:], opts)
+	if err != nil {
+		return nil, fmt.Errorf("DKIM signing: %w", err)
+	}
+
+	signedMsg := make([]byte, 0, len(header)+512+len(raw))
+	signedMsg = append(signedMsg, header...)
+	signedMsg = append(signedMsg, base64.StdEncoding.EncodeToString(signature)...)
+	signedMsg = append(signedMsg, "\r\n"...)
+	return append(signedMsg, raw...), nil
+}
+
+// headerFields splits a header block into fields, each with its folded
+// continuation lines
+func headerFields(head string) []string {
+	var fields []string
+	for _, line := range strings.SplitAfter(head, "\r\n") {
+		if line == "" {
+			continue
+		}
+		if (line[0] == ' ' || line[0] == '\t') && len(fields) > 0 {
+			fields[len(fields)-1] += line
+			continue
+		}
+		fields = append(fields, line)
+	}
+	for i := range fields {
+		fields[i] = strings.TrimSuffix(fields[i], "\r\n")
+	}
+	return fields
+}
+
+func fieldName(field string) string {
+	name, _, _ := strings.Cut(field, ":")
+	return strings.ToLower(strings.TrimRight(name, " \t"))
+}
+
+// relaxedHeader canonicalizes a header field: lowercase name, unfolded,
+// runs of whitespace turned into one space and none around the colon or
+// at the end
+func relaxedHeader(field string) string {
+	name, value, _ := strings.Cut(field, ":")
+	value = strings.ReplaceAll(value, "\r\n", "")
+	return strings.ToLower(strings.TrimRight(name, " \t")) + ":" + strings.TrimSpace(compressSpace(value))
+}
+
+// relaxedBody canonicalizes a body: whitespace runs turned into one space,
+// none at line ends, and no empty lines at the end
+func relaxedBody(body []byte) []byte {
+	lines := strings.Split(string(body), "\r\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimRight(compressSpace(line), " ")
+	}
+	for len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	if len(lines) == 0 {
+		return nil
+	}
+	return []byte(strings.Join(lines, "\r\n") + "\r\n")
+}
+
+func compressSpace(s string) string {
+	var b strings.Builder
+	space := false
+	for _, r := range s {
+		if r == ' ' || r == '\t' {
+			space = true
+			continue
+		}
+		if space {
+			b.WriteByte(' ')
+			space = false
+		}
+		b.WriteRune(r)
+	}
+	if space {
+		b.WriteByte(' ')
+	}
+	return b.String()
+}
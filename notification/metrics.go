@@ -0,0 +1,144 @@
+package notification
+
+import (
+	"cmp"
+	"errors"
+	"maps"
+	"slices"
+	"sync"
+	"time"
+)
+
+// ProviderMetrics counts SMTP attempts against one server. Every attempt is
+// counted, so a send that succeeds on its second try adds one retry, one
+// failure and one delivery.
+type ProviderMetrics struct {
+	Provider      string            `json:"provider"`
+	Attempts      uint64            `json:"attempts"`
+	Delivered     uint64            `json:"delivered"`
+	Failed        uint64            `json:"failed"`
+	Retries       uint64            `json:"retries"`
+	Failures      map[string]uint64 `json:"failures"`
+	AvgConnectMS  float64           `json:"avg_connect_ms"`
+	MaxConnectMS  float64           `json:"max_connect_ms"`
+	LastError     string            `json:"last_error,omitempty"`
+	LastFailureAt *time.Time        `json:"last_failure_at,omitempty"`
+
+	connects     uint64
+	totalConnect time.Duration
+	maxConnect   time.Duration
+}
+
+// DomainMetrics counts outcomes by recipient domain. A refused recipient
+// counts against its own domain; other failures count against every
+// recipient's domain.
+type DomainMetrics struct {
+	Domain    string            `json:"domain"`
+	Delivered uint64            `json:"delivered"`
+	Failed    uint64            `json:"failed"`
+	Failures  map[string]uint64 `json:"failures"`
+}
+
+// DeliveryReport summarizes delivery health: recent outcomes and the
+// per-provider and per-domain breakdown since startup
+type DeliveryReport struct {
+	Recent    DeliveryStats     `json:"recent"`
+	Providers []ProviderMetrics `json:"providers"`
+	Domains   []DomainMetrics   `json:"domains"`
+}
+
+type deliveryMetrics struct {
+	mu        sync.Mutex
+	providers map[string]*ProviderMetrics
+	domains   map[string]*DomainMetrics
+}
+
+// recordAttempt counts one SMTP attempt to provider for recipients
+func (m *deliveryMetrics) recordAttempt(provider string, recipients []string, connectTime time.Duration, retry bool, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.providers == nil {
+		m.providers = make(map[string]*ProviderMetrics)
+		m.domains = make(map[string]*DomainMetrics)
+	}
+	p, ok := m.providers[provider]
+	if !ok {
+		p = &ProviderMetrics{Provider: provider, Failures: map[string]uint64{}}
+		m.providers[provider] = p
+	}
+
+	p.Attempts++
+	if retry {
+		p.Retries++
+	}
+	if connectTime > 0 {
+		p.connects++
+		p.totalConnect += connectTime
+		p.maxConnect = max(p.maxConnect, connectTime)
+	}
+
+	var class string
+	if err != nil {
+		class, _ = classify(err)
+		now := time.Now()
+		p.Failed++
+		p.Failures[class]++
+		p.LastError = err.Error()
+		p.LastFailureAt = &now
+	} else {
+		p.Delivered++
+	}
+
+	// A refused recipient is the only one to blame
+	var sendErr *smtpError
+	if errors.As(err, &sendErr) && sendErr.recipient != "" {
+		recipients = []string{sendErr.recipient}
+	}
+	for _, recipient := range recipients {
+		domain := recipientDomain(recipient)
+		d, ok := m.domains[domain]
+		if !ok {
+			d = &DomainMetrics{Domain: domain, Failures: map[string]uint64{}}
+			m.domains[domain] = d
+		}
+		if err == nil {
+			d.Delivered++
+			continue
+		}
+		d.Failed++
+		d.Failures[class]++
+	}
+}
+
+func (m *deliveryMetrics) snapshot() ([]ProviderMetrics, []DomainMetrics) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	providers := make([]ProviderMetrics, 0, len(m.providers))
+	for _, p := range m.providers {
+		copied := *p
+		copied.Failures = maps.Clone(p.Failures)
+		if p.connects > 0 {
+			copied.AvgConnectMS = durationMS(p.totalConnect / time.Duration(p.connects))
+		}
+		copied.MaxConnectMS = durationMS(p.maxConnect)
+		providers = append(providers, copied)
+	}
+	slices.SortFunc(providers, func(a, b ProviderMetrics) int { return cmp.Compare(a.Provider, b.Provider) })
+
+	domains := make([]DomainMetrics, 0, len(m.domains))
+	for _, d := range m.domains {
+		copied := *d
+		copied.Failures = maps.Clone(d.Failures)
+		domains = append(domains, copied)
+	}
+	slices.SortFunc(domains, func(a, b DomainMetrics) int {
+		return cmp.Or(cmp.Compare(b.Delivered+b.Failed, a.Delivered+a.Failed), cmp.Compare(a.Domain, b.Domain))
+	})
+	return providers, domains
+}
+
+func durationMS(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
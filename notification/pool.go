@@ -0,0 +1,143 @@
+package notification
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+)
+
+var (
+	// ErrQueueFull is returned when every SMTP worker is busy and the send
+	// queue has no room left
+	ErrQueueFull = errors.New("smtp send queue is full")
+	// ErrClosed is returned for sends made after shutdown has begun
+	ErrClosed = errors.New("smtp sender is shutting down")
+)
+
+// PoolStats describes the SMTP worker pool
+type PoolStats struct {
+	Workers   int    `json:"workers"`
+	Busy      int64  `json:"busy"`
+	Queued    int    `json:"queued"`
+	QueueSize int    `json:"queue_size"`
+	Completed uint64 `json:"completed"`
+	// Rejected sends found the queue full; Expired ones were given up on
+	// by their caller before a worker got to them
+	Rejected uint64 `json:"rejected"`
+	Expired  uint64 `json:"expired"`
+}
+
+type poolJob struct {
+	ctx  context.Context
+	run  func(context.Context) error
+	done chan error
+}
+
+// pool runs SMTP transactions on a fixed number of workers, so bursts of
+// notifications, reports and outbound email can't open unbounded
+// connections to the mail server.
+type pool struct {
+	workers int
+	working sync.WaitGroup
+
+	// mu keeps do from sending on jobs once close has closed it
+	mu     sync.RWMutex
+	closed bool
+	jobs   chan poolJob
+
+	busy      atomic.Int64
+	completed atomic.Uint64
+	rejected  atomic.Uint64
+	expired   atomic.Uint64
+}
+
+func newPool(workers, queueSize int) *pool {
+	p := &pool{jobs: make(chan poolJob, queueSize), workers: workers}
+	for range workers {
+		p.working.Go(p.work)
+	}
+	return p
+}
+
+func (p *pool) work() {
+	for job := range p.jobs {
+		if err := job.ctx.Err(); err != nil {
+			p.expired.Add(1)
+			job.done <- err
+			continue
+		}
+
+		p.busy.Add(1)
+		err := job.run(job.ctx)
+		p.busy.Add(-1)
+		p.completed.Add(1)
+		job.done <- err
+	}
+}
+
+// do queues run and waits for a worker to finish it. It fails with
+// ErrQueueFull rather than waiting for room in the queue.
+func (p *pool) do(ctx context.Context, run func(context.Context) error) error {
+	job := poolJob{ctx: ctx, run: run, done: make(chan error, 1)}
+	if err := p.enqueue(job); err != nil {
+		return err
+	}
+
+	select {
+	case err := <-job.done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (p *pool) enqueue(job poolJob) error {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	if p.closed {
+		return ErrClosed
+	}
+	select {
+	case p.jobs <- job:
+		return nil
+	default:
+		p.rejected.Add(1)
+		return ErrQueueFull
+	}
+}
+
+// close stops accepting sends and waits for the queued ones to finish
+func (p *pool) close(ctx context.Context) error {
+	p.mu.Lock()
+	if !p.closed {
+		p.closed = true
+		close(p.jobs)
+	}
+	p.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		p.working.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (p *pool) stats() PoolStats {
+	return PoolStats{
+		Workers:   p.workers,
+		Busy:      p.busy.Load(),
+		Queued:    len(p.jobs),
+		QueueSize: cap(p.jobs),
+		Completed: p.completed.Load(),
+		Rejected:  p.rejected.Load(),
+		Expired:   p.expired.Load(),
+	}
+}
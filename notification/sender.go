@@ -4,94 +4,271 @@ import (
 	"bytes"
 	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"html/template"
+	"net"
 	"net/smtp"
+	"sync/atomic"
 	"time"
 
+	"email-tracker/breaker"
 	"email-tracker/config"
 	"email-tracker/models"
 
 	"github.com/jordan-wright/email"
 )
 
+// Account stands in for the configured SMTP server, sender address and
+// DKIM signing on one tenant's mail. Without a Host the configured server
+// is used, without a From the configured address, and without DKIM mail
+// goes out unsigned.
+type Account struct {
+	Host     string
+	Port     int
+	Username string
+	Password string
+	From     string
+	DKIM     *DKIMSigner
+}
+
 type Sender struct {
-	config *config.Config
+	config    atomic.Pointer[config.Config]
+	templates *template.Template
+	stats     deliveryStats
+	metrics   deliveryMetrics
+	pool      *pool
+	breaker   *breaker.Breaker
+}
+
+// NewSender sends through cfg's SMTP server, rendering notifications and
+// reports from templates, as loaded by web.Templates.
+func NewSender(cfg *config.Config, templates *template.Template) *Sender {
+	s := &Sender{
+		templates: templates,
+		pool:      newPool(cfg.SMTP.Workers, cfg.SMTP.QueueSize),
+		breaker:   breaker.New("smtp", cfg.Breakers.Threshold, cfg.Breakers.Cooldown),
+	}
+	s.config.Store(cfg)
+	return s
+}
+
+// ApplyConfig switches to new SMTP settings. Sends already in progress keep
+// the settings they started with. The worker pool keeps its size until
+// restart.
+func (s *Sender) ApplyConfig(cfg *config.Config) {
+	s.config.Store(cfg)
+}
+
+// Close stops accepting sends and waits for the ones already queued to be
+// delivered, or for ctx to be done.
+func (s *Sender) Close(ctx context.Context) error {
+	return s.pool.close(ctx)
+}
+
+// From returns the sender address outgoing mail is sent from.
+func (s *Sender) From() string {
+	return s.config.Load().SMTP.From
 }
 
-func NewSender(cfg *config.Config) *Sender {
-	return &Sender{
-		config: cfg,
+// FromFor returns the sender address mail sent as account is sent from.
+func (s *Sender) FromFor(account *Account) string {
+	if account != nil && account.From != "" {
+		return account.From
 	}
+	return s.From()
 }
 
+// SendNotification renders the open notification template and sends it
+// as account, or as configured when account is nil.
 func (s *Sender) SendNotification(
 	ctx context.Context,
+	account *Account,
 	to []string,
 	subject string,
 	data map[string]interface{},
 ) error {
-	// 1. Load HTML template
-	// Optimization: In a production app, you should parse templates
-	// ONCE at startup and store them in the s.Sender struct.
-	tmpl, err := template.ParseFiles("templates/notification.html")
-	if err != nil {
-		return fmt.Errorf("could not find or parse template file: %w", err)
-	}
+	return s.sendTemplate(ctx, account, to, subject, "notification.html", data)
+}
+
+// SendReport renders the scheduled summary report template and sends it
+// as account, or as configured when account is nil.
+func (s *Sender) SendReport(
+	ctx context.Context,
+	account *Account,
+	to []string,
+	subject string,
+	data map[string]interface{},
+) error {
+	return s.sendTemplate(ctx, account, to, subject, "report.html", data)
+}
 
-	// 2. Execute template into a buffer
+// SendConsentRequest renders the double opt-in email, with its confirm
+// link, and sends it as account, or as configured when account is nil.
+func (s *Sender) SendConsentRequest(
+	ctx context.Context,
+	account *Account,
+	to []string,
+	subject string,
+	data map[string]interface{},
+) error {
+	return s.sendTemplate(ctx, account, to, subject, "consent_email.html", data)
+}
+
+func (s *Sender) sendTemplate(
+	ctx context.Context,
+	account *Account,
+	to []string,
+	subject string,
+	templateName string,
+	data map[string]interface{},
+) (err error) {
+	defer func() { s.stats.record(err) }()
+	cfg := s.config.Load()
+
+	// 1. Execute template into a buffer
 	var body bytes.Buffer
-	if err := tmpl.Execute(&body, data); err != nil {
+	if err := s.templates.ExecuteTemplate(&body, templateName, data); err != nil {
 		return fmt.Errorf("failed to inject data into template: %w", err)
 	}
 
-	// 3. Create email message
+	// 2. Create email message
 	e := email.NewEmail()
-	e.From = s.config.SMTP.From
+	e.From = s.FromFor(account)
 	e.To = to
 	e.Subject = subject
 	e.HTML = body.Bytes()
 
-	// 4. Setup Authentication (Ensure you use a Gmail App Password)
-	auth := smtp.PlainAuth(
-		"",
-		s.config.SMTP.Username,
-		s.config.SMTP.Password,
-		s.config.SMTP.Host,
-	)
-
-	addr := fmt.Sprintf("%s:%d", s.config.SMTP.Host, s.config.SMTP.Port)
-
-	// 5. Send with concurrency-safe timeout
-	sendErr := make(chan error, 1)
-
-	go func() {
-		// SendWithStartTLS is best for Gmail Port 587
-		sendErr <- e.SendWithStartTLS(
-			addr,
-			auth,
-			&tls.Config{
-				ServerName: s.config.SMTP.Host,
-				MinVersion: tls.VersionTLS12,
-			},
-		)
-	}()
-
-	// 6. Wait for either success, failure, or context cancellation
-	select {
-	case <-ctx.Done():
-		return fmt.Errorf("notification cancelled by context: %w", ctx.Err())
-
-	case err := <-sendErr:
-		if err != nil {
-			// This is where "Invalid Credentials" will be caught
-			return fmt.Errorf("smtp dispatch failed: %w", err)
-		}
+	// 3. Send, retrying transient failures within the timeout
+	err = s.pool.do(ctx, func(ctx context.Context) error {
+		ctx, cancel := context.WithTimeout(ctx, cfg.Timeouts.SMTP)
+		defer cancel()
+		return s.deliver(ctx, cfg, account, e)
+	})
+	if err != nil {
+		return fmt.Errorf("smtp dispatch failed: %w", err)
 	}
 
 	return nil
 }
 
+// Check connects to the SMTP server, upgrades to TLS when offered and logs
+// in, without sending anything. Used by "config check" and /ready. While the
+// circuit breaker is open it fails without connecting; once the cooldown is
+// over it serves as the probe.
+func (s *Sender) Check(ctx context.Context) error {
+	return s.breaker.Do(func() error { return s.check(ctx) }, unavailable)
+}
+
+func (s *Sender) check(ctx context.Context) error {
+	cfg := s.config.Load()
+	addr := fmt.Sprintf("%s:%d", cfg.SMTP.Host, cfg.SMTP.Port)
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return fmt.Errorf("connect to %s: %w", addr, err)
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	client, err := smtp.NewClient(conn, cfg.SMTP.Host)
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("smtp handshake: %w", err)
+	}
+	defer client.Close()
+
+	if ok, _ := client.Extension("STARTTLS"); ok {
+		if err := client.StartTLS(&tls.Config{ServerName: cfg.SMTP.Host, MinVersion: tls.VersionTLS12}); err != nil {
+			return fmt.Errorf("starttls: %w", err)
+		}
+	}
+	if cfg.SMTP.Username != "" {
+		auth := smtp.PlainAuth("", cfg.SMTP.Username, cfg.SMTP.Password, cfg.SMTP.Host)
+		if err := client.Auth(auth); err != nil {
+			return fmt.Errorf("smtp login: %w", err)
+		}
+	}
+	return client.Quit()
+}
+
+// retryDelay is the wait before the first retry; it doubles after that
+const retryDelay = time.Second
+
+// deliver sends msg, as account when given, retrying transient failures up
+// to SMTP_MAX_RETRIES times while ctx allows, and records every attempt in
+// the metrics. While the circuit breaker is open it gives up without
+// connecting. An account's own SMTP server doesn't go through the breaker:
+// it failing says nothing about the configured one.
+func (s *Sender) deliver(ctx context.Context, cfg *config.Config, account *Account, msg *email.Email) error {
+	srv := configServer(cfg)
+	var dkim *DKIMSigner
+	if account != nil {
+		if account.Host != "" {
+			srv = server{host: account.Host, port: account.Port, username: account.Username, password: account.Password}
+		}
+		dkim = account.DKIM
+	}
+
+	provider := srv.addr()
+	delay := retryDelay
+	for attempt := 0; ; attempt++ {
+		var connectTime time.Duration
+		send := func() (err error) {
+			connectTime, err = transmit(ctx, srv, msg, dkim)
+			return err
+		}
+		var err error
+		if srv.host == cfg.SMTP.Host && srv.port == cfg.SMTP.Port {
+			err = s.breaker.Do(send, unavailable)
+		} else {
+			err = send()
+		}
+		if errors.Is(err, breaker.ErrOpen) {
+			return err
+		}
+		s.metrics.recordAttempt(provider, msg.To, connectTime, attempt > 0, err)
+		if err == nil {
+			return nil
+		}
+
+		if _, transient := classify(err); !transient || attempt >= cfg.SMTP.MaxRetries {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+}
+
+// DeliveryReport breaks delivery outcomes down by SMTP server and
+// recipient domain, along with the recent failure rate.
+func (s *Sender) DeliveryReport() DeliveryReport {
+	providers, domains := s.metrics.snapshot()
+	return DeliveryReport{Recent: s.stats.snapshot(), Providers: providers, Domains: domains}
+}
+
+// Breaker reports the state of the SMTP circuit breaker.
+func (s *Sender) Breaker() breaker.Status {
+	return s.breaker.Status()
+}
+
+// PoolStats reports how busy the SMTP workers are.
+func (s *Sender) PoolStats() PoolStats {
+	return s.pool.stats()
+}
+
+// Stats reports SMTP delivery outcomes, including the failure rate over the
+// most recent sends.
+func (s *Sender) Stats() DeliveryStats {
+	return s.stats.snapshot()
+}
+
 // EmailService interface to avoid circular dependency
 type EmailService interface {
 	GenerateTrackingID() (string, error)
@@ -104,63 +281,38 @@ func (s *Sender) SendEmail(
 	to []string,
 	subject, body string,
 ) error {
+	return s.SendEmailAs(ctx, nil, to, subject, body)
+}
+
+// SendEmailAs sends like SendEmail, as account, or as configured when
+// account is nil.
+func (s *Sender) SendEmailAs(
+	ctx context.Context,
+	account *Account,
+	to []string,
+	subject, body string,
+) (err error) {
+	defer func() { s.stats.record(err) }()
+	cfg := s.config.Load()
+
 	// Build email
 	e := email.NewEmail()
-	e.From = s.config.SMTP.From
+	e.From = s.FromFor(account)
 	e.To = to
 	e.Subject = subject
 	e.HTML = []byte(body)
-	fmt.Println("e.From", e.From)
-	fmt.Println("e.To", e.To)
-	fmt.Println("e.Subject", e.Subject)
-	fmt.Println("e.HTML", e.HTML)
-	addr := fmt.Sprintf("%s:%d", s.config.SMTP.Host, s.config.SMTP.Port)
-
-	// Note: Gmail requires the host in PlainAuth to match the server address
-	auth := smtp.PlainAuth(
-		"",
-		s.config.SMTP.Username,
-		s.config.SMTP.Password,
-		s.config.SMTP.Host,
-	)
-	fmt.Println("addr", addr)
-	fmt.Println("auth", auth)
-	// Context for the entire operation
-	// timeoutCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
-	// defer cancel()
-
-	errCh := make(chan error, 1)
-
-	// Run the send operation in a goroutine so the select block
-	// can actually catch a timeout if the network hangs.
-	go func() {
-		errCh <- e.SendWithStartTLS(
-			addr,
-			auth,
-			&tls.Config{
-				ServerName: s.config.SMTP.Host,
-				// InsecureSkipVerify: true, // Only use for local testing
-			},
-		)
-	}()
-
-	// select {
-	// case <-timeoutCtx.Done():
-	// 	return fmt.Errorf("email send timed out: %w", timeoutCtx.Err())
-
-	// case err := <-errCh:
-	// 	if err != nil {
-	// 		return fmt.Errorf("smtp authentication/sending failed: %w", err)
-	// 	}
-	// }
-	select {
-	case err := <-errCh:
-		if err != nil {
+
+	return s.pool.do(ctx, func(ctx context.Context) error {
+		// Context for the entire operation, retries included
+		timeoutCtx, cancel := context.WithTimeout(ctx, cfg.Timeouts.SMTP)
+		defer cancel()
+
+		if err := s.deliver(timeoutCtx, cfg, account, e); err != nil {
+			if timeoutCtx.Err() != nil {
+				return fmt.Errorf("email send timed out: %w", err)
+			}
 			return fmt.Errorf("smtp authentication/sending failed: %w", err)
 		}
-	case <-time.After(12 * time.Second):
-		return fmt.Errorf("smtp send hung and was force-aborted")
-	}
-
-	return nil
+		return nil
+	})
 }
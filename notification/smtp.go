@@ -0,0 +1,209 @@
+package notification
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"strings"
+	"time"
+
+	"email-tracker/config"
+
+	"github.com/jordan-wright/email"
+)
+
+// Stages of an SMTP transaction, used to tell where a send failed
+const (
+	stageConnect = "connect"
+	stageTLS     = "tls"
+	stageAuth    = "auth"
+	stageMail    = "mail"
+	stageRcpt    = "rcpt"
+	stageData    = "data"
+)
+
+// smtpError is a failed SMTP transaction, with the stage it failed at and
+// the recipient that was refused, if any
+type smtpError struct {
+	stage     string
+	recipient string
+	err       error
+}
+
+func (e *smtpError) Error() string {
+	if e.recipient != "" {
+		return fmt.Sprintf("smtp %s %s: %v", e.stage, e.recipient, e.err)
+	}
+	return fmt.Sprintf("smtp %s: %v", e.stage, e.err)
+}
+
+func (e *smtpError) Unwrap() error { return e.err }
+
+// Failure classes reported in delivery metrics
+const (
+	failureConnect   = "connect"
+	failureTimeout   = "timeout"
+	failureTLS       = "tls"
+	failureAuth      = "auth"
+	failureTransient = "rejected_4xx"
+	failurePermanent = "rejected_5xx"
+	failureOther     = "other"
+)
+
+// classify sorts a send error into a failure class. Transient failures,
+// 4xx replies and dropped connections, are worth retrying.
+func classify(err error) (class string, transient bool) {
+	var protoErr *textproto.Error
+	if errors.As(err, &protoErr) {
+		switch {
+		case protoErr.Code >= 500 && isStage(err, stageAuth):
+			return failureAuth, false
+		case protoErr.Code >= 500:
+			return failurePermanent, false
+		case protoErr.Code >= 400:
+			return failureTransient, true
+		}
+	}
+
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()) {
+		return failureTimeout, true
+	}
+	switch {
+	case isStage(err, stageConnect):
+		return failureConnect, true
+	case isStage(err, stageTLS):
+		return failureTLS, false
+	case isStage(err, stageAuth):
+		return failureAuth, false
+	}
+	return failureOther, false
+}
+
+// unavailable reports whether err says the SMTP server can't be reached,
+// as opposed to it refusing a message or the caller giving up, and so
+// counts towards opening the circuit breaker.
+func unavailable(err error) bool {
+	if errors.Is(err, context.Canceled) {
+		return false
+	}
+	if class, _ := classify(err); class == failureConnect || class == failureTimeout {
+		return true
+	}
+	var opErr *net.OpError
+	return errors.As(err, &opErr)
+}
+
+func isStage(err error, stage string) bool {
+	var sendErr *smtpError
+	return errors.As(err, &sendErr) && sendErr.stage == stage
+}
+
+// server is an SMTP server and the login used with it
+type server struct {
+	host     string
+	port     int
+	username string
+	password string
+}
+
+func (s server) addr() string {
+	return fmt.Sprintf("%s:%d", s.host, s.port)
+}
+
+// configServer is the SMTP server from SMTP_HOST and the settings with it
+func configServer(cfg *config.Config) server {
+	return server{host: cfg.SMTP.Host, port: cfg.SMTP.Port, username: cfg.SMTP.Username, password: cfg.SMTP.Password}
+}
+
+// transmit runs one SMTP transaction for msg on srv, upgrading to TLS when
+// the server offers it and signing with dkim when given, and reports how
+// long connecting took.
+func transmit(ctx context.Context, srv server, msg *email.Email, dkim *DKIMSigner) (connectTime time.Duration, err error) {
+	from, err := mail.ParseAddress(msg.From)
+	if err != nil {
+		return 0, fmt.Errorf("invalid sender: %w", err)
+	}
+	recipients := make([]string, 0, len(msg.To))
+	for _, to := range msg.To {
+		addr, err := mail.ParseAddress(to)
+		if err != nil {
+			return 0, fmt.Errorf("invalid recipient %q: %w", to, err)
+		}
+		recipients = append(recipients, addr.Address)
+	}
+	raw, err := msg.Bytes()
+	if err != nil {
+		return 0, err
+	}
+	if dkim != nil {
+		if raw, err = dkim.sign(raw); err != nil {
+			return 0, err
+		}
+	}
+
+	addr := srv.addr()
+	start := time.Now()
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return 0, &smtpError{stage: stageConnect, err: err}
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	client, err := smtp.NewClient(conn, srv.host)
+	connectTime = time.Since(start)
+	if err != nil {
+		conn.Close()
+		return connectTime, &smtpError{stage: stageConnect, err: err}
+	}
+	defer client.Close()
+
+	if ok, _ := client.Extension("STARTTLS"); ok {
+		if err := client.StartTLS(&tls.Config{ServerName: srv.host, MinVersion: tls.VersionTLS12}); err != nil {
+			return connectTime, &smtpError{stage: stageTLS, err: err}
+		}
+	}
+	if ok, _ := client.Extension("AUTH"); ok && srv.username != "" {
+		auth := smtp.PlainAuth("", srv.username, srv.password, srv.host)
+		if err := client.Auth(auth); err != nil {
+			return connectTime, &smtpError{stage: stageAuth, err: err}
+		}
+	}
+
+	if err := client.Mail(from.Address); err != nil {
+		return connectTime, &smtpError{stage: stageMail, err: err}
+	}
+	for _, recipient := range recipients {
+		if err := client.Rcpt(recipient); err != nil {
+			return connectTime, &smtpError{stage: stageRcpt, recipient: recipient, err: err}
+		}
+	}
+	w, err := client.Data()
+	if err != nil {
+		return connectTime, &smtpError{stage: stageData, err: err}
+	}
+	if _, err := w.Write(raw); err != nil {
+		return connectTime, &smtpError{stage: stageData, err: err}
+	}
+	if err := w.Close(); err != nil {
+		return connectTime, &smtpError{stage: stageData, err: err}
+	}
+	return connectTime, client.Quit()
+}
+
+// recipientDomain returns the lowercased domain of an address
+func recipientDomain(address string) string {
+	if addr, err := mail.ParseAddress(address); err == nil {
+		address = addr.Address
+	}
+	_, domain, _ := strings.Cut(address, "@")
+	return strings.ToLower(domain)
+}
@@ -0,0 +1,79 @@
+package notification
+
+import (
+	"sync"
+	"time"
+)
+
+// recentWindow is how many of the latest sends the failure rate covers
+const recentWindow = 100
+
+// DeliveryStats summarizes SMTP outcomes since startup.
+type DeliveryStats struct {
+	Sent          uint64     `json:"sent"`
+	Failed        uint64     `json:"failed"`
+	RecentSends   int        `json:"recent_sends"`
+	FailureRate   float64    `json:"failure_rate"`
+	LastError     string     `json:"last_error,omitempty"`
+	LastFailureAt *time.Time `json:"last_failure_at,omitempty"`
+}
+
+// deliveryStats records the outcome of every SMTP send, keeping a ring of
+// recent outcomes for the failure rate.
+type deliveryStats struct {
+	mu            sync.Mutex
+	sent          uint64
+	failed        uint64
+	recent        [recentWindow]bool
+	recentCount   int
+	recentNext    int
+	lastError     string
+	lastFailureAt time.Time
+}
+
+func (d *deliveryStats) record(err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.recent[d.recentNext] = err != nil
+	d.recentNext = (d.recentNext + 1) % recentWindow
+	if d.recentCount < recentWindow {
+		d.recentCount++
+	}
+
+	if err == nil {
+		d.sent++
+		return
+	}
+	d.failed++
+	d.lastError = err.Error()
+	d.lastFailureAt = time.Now()
+}
+
+func (d *deliveryStats) snapshot() DeliveryStats {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	stats := DeliveryStats{
+		Sent:        d.sent,
+		Failed:      d.failed,
+		RecentSends: d.recentCount,
+		LastError:   d.lastError,
+	}
+	if !d.lastFailureAt.IsZero() {
+		at := d.lastFailureAt
+		stats.LastFailureAt = &at
+	}
+
+	var failures int
+	for i := 0; i < d.recentCount; i++ {
+		if d.recent[i] {
+			failures++
+		}
+	}
+	if d.recentCount > 0 {
+		stats.FailureRate = float64(failures) / float64(d.recentCount) * 100
+	}
+
+	return stats
+}
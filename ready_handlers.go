@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// readyCacheTTL is how long /ready reuses its last result, so frequent
+// probes don't log in to SMTP or spend geo quota on every call
+const readyCacheTTL = 15 * time.Second
+
+// Dependency states reported by /ready
+const (
+	dependencyOK       = "ok"
+	dependencyFailing  = "failing"
+	dependencyDisabled = "disabled"
+)
+
+type dependencyStatus struct {
+	Status   string `json:"status"`
+	Critical bool   `json:"critical"`
+	// Circuit is the state of the dependency's circuit breaker, if it has one
+	Circuit string `json:"circuit,omitempty"`
+}
+
+// readiness is the outcome of checking every dependency. Ready is false
+// when a critical dependency fails; a failing geo provider only degrades
+// the service, since opens are still recorded without a location.
+type readiness struct {
+	Ready        bool                        `json:"ready"`
+	Status       string                      `json:"status"`
+	Dependencies map[string]dependencyStatus `json:"dependencies"`
+	CheckedAt    time.Time                   `json:"checked_at"`
+}
+
+// readinessProbe caches the last readiness result
+type readinessProbe struct {
+	mu   sync.Mutex
+	last *readiness
+}
+
+func (s *Server) readiness(ctx context.Context) *readiness {
+	if s.draining.Load() {
+		return &readiness{Status: "shutting down", Dependencies: map[string]dependencyStatus{}, CheckedAt: time.Now()}
+	}
+
+	s.ready.mu.Lock()
+	defer s.ready.mu.Unlock()
+
+	if s.ready.last != nil && time.Since(s.ready.last.CheckedAt) < readyCacheTTL {
+		return s.ready.last
+	}
+
+	// The result is shared, so don't let one caller hanging up fail it
+	ctx = context.WithoutCancel(ctx)
+
+	result := &readiness{Dependencies: map[string]dependencyStatus{}, CheckedAt: time.Now()}
+	var mu sync.Mutex
+	set := func(name string, critical bool, err error) {
+		status := dependencyStatus{Status: dependencyOK, Critical: critical}
+		if err != nil {
+			// /ready is unauthenticated, so why is only logged
+			status.Status = dependencyFailing
+			slog.Warn("dependency check failed", "dependency", name, "error", err)
+		}
+		mu.Lock()
+		result.Dependencies[name] = status
+		mu.Unlock()
+	}
+
+	var wg sync.WaitGroup
+	wg.Go(func() {
+		ctx, cancel := context.WithTimeout(ctx, s.config.Timeouts.SMTP)
+		defer cancel()
+		set("smtp", true, s.notifier.Check(ctx))
+	})
+	wg.Go(func() {
+		pinger, ok := s.counters.(interface{ Ping(context.Context) error })
+		if !ok {
+			mu.Lock()
+			result.Dependencies["redis"] = dependencyStatus{Status: dependencyDisabled, Critical: true}
+			mu.Unlock()
+			return
+		}
+		ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+		defer cancel()
+		set("redis", true, pinger.Ping(ctx))
+	})
+	wg.Go(func() {
+		ctx, cancel := context.WithTimeout(ctx, s.config.Timeouts.Geo)
+		defer cancel()
+		for name, err := range s.tracker.CheckGeo(ctx, geoCheckIP) {
+			set("geo:"+name, false, err)
+		}
+	})
+	wg.Wait()
+
+	for _, circuit := range s.circuitBreakers() {
+		if dependency, ok := result.Dependencies[circuit.Name]; ok {
+			dependency.Circuit = circuit.State
+			result.Dependencies[circuit.Name] = dependency
+		}
+	}
+
+	result.Ready, result.Status = true, "ready"
+	for _, dependency := range result.Dependencies {
+		if dependency.Status != dependencyFailing {
+			continue
+		}
+		if dependency.Critical {
+			result.Ready, result.Status = false, "not ready"
+			break
+		}
+		result.Status = "degraded"
+	}
+
+	s.ready.last = result
+	return result
+}
+
+// readinessCheck reports whether SMTP, Redis and the geo providers are
+// reachable, answering 503 when a critical one isn't or the server is
+// shutting down. Unlike /live it does real work, so results are cached
+// briefly.
+func (s *Server) readinessCheck(c *gin.Context) {
+	result := s.readiness(c.Request.Context())
+	status := http.StatusOK
+	if !result.Ready {
+		status = http.StatusServiceUnavailable
+	}
+	c.JSON(status, result)
+}
+
+// livenessCheck answers as long as the process can serve requests, even
+// while draining for shutdown.
+func (s *Server) livenessCheck(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"status": "alive"})
+}
@@ -0,0 +1,81 @@
+package reports
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"email-tracker/analytics"
+	"email-tracker/notification"
+	"email-tracker/tenants"
+)
+
+// DigestSource has the digests tenants asked for and the account each
+// tenant's mail is sent as
+type DigestSource interface {
+	Digests() []tenants.Digest
+	Account(tenant string) *notification.Account
+}
+
+// SetDigests sends tenants' digests from source. Call it before
+// RunDigests.
+func (s *Scheduler) SetDigests(source DigestSource) {
+	s.digests = source
+}
+
+// RunDigests blocks, checking every day at the report hour for the
+// tenant digests whose period starts then.
+func (s *Scheduler) RunDigests() {
+	if s.digests == nil {
+		return
+	}
+	for {
+		now := time.Now().UTC()
+		next := time.Date(now.Year(), now.Month(), now.Day(), reportHour, 0, 0, 0, time.UTC)
+		if !next.After(now) {
+			next = next.AddDate(0, 0, 1)
+		}
+		time.Sleep(time.Until(next))
+		s.SendDigests(next)
+	}
+}
+
+// SendDigests sends every digest whose period starts at run.
+func (s *Scheduler) SendDigests(run time.Time) {
+	for _, digest := range s.digests.Digests() {
+		if !nextRun(digest.Frequency, run.Add(-time.Second)).Equal(run) {
+			continue
+		}
+		from, to := period(digest.Frequency, run)
+		if !s.claim(fmt.Sprintf("digest:%s:%s:%s", digest.Tenant, digest.Frequency, from.Format("2006-01-02"))) {
+			continue
+		}
+		if err := s.SendDigest(digest, from, to); err != nil {
+			slog.Error("failed to send digest", "tenant", digest.Tenant, "frequency", digest.Frequency, "error", err)
+		}
+	}
+}
+
+// SendDigest builds the summary of one tenant's sends for [from, to) and
+// emails it to the tenant's digest recipients, as the tenant.
+func (s *Scheduler) SendDigest(digest tenants.Digest, from, to time.Time) error {
+	emails := s.source.TenantEmails(digest.Tenant)
+	summary := analytics.Summarize(emails, from, to, false)
+	filtered := analytics.Summarize(emails, from, to, true)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	subject := fmt.Sprintf("📊 Email Tracker %s digest: %s – %s",
+		digest.Frequency, from.Format("Jan 2"), to.Add(-time.Second).Format("Jan 2, 2006"))
+
+	return s.sender.SendReport(ctx, s.digests.Account(digest.Tenant), digest.Recipients, subject, map[string]interface{}{
+		"Frequency": digest.Frequency,
+		"From":      from.Format("2006-01-02"),
+		"To":        to.Add(-time.Second).Format("2006-01-02"),
+		"Summary":   summary,
+		"Filtered":  filtered,
+		"Year":      to.Year(),
+	})
+}
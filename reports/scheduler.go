@@ -0,0 +1,182 @@
+package reports
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"email-tracker/analytics"
+	"email-tracker/cluster"
+	"email-tracker/config"
+	"email-tracker/models"
+	"email-tracker/notification"
+)
+
+// reportHour is the UTC hour at which scheduled reports are sent
+const reportHour = 8
+
+type EmailSource interface {
+	AllEmails() []*models.Email
+	TenantEmails(tenant string) []*models.Email
+}
+
+type ReportSender interface {
+	SendReport(ctx context.Context, account *notification.Account, to []string, subject string, data map[string]interface{}) error
+}
+
+// Scheduler periodically emails a summary of sends and engagement to the
+// configured report recipients.
+type Scheduler struct {
+	mu         sync.Mutex
+	frequency  string
+	recipients []string
+	reloaded   chan struct{}
+	source     EmailSource
+	sender     ReportSender
+	claimer    cluster.Claimer
+	digests    DigestSource
+}
+
+func NewScheduler(cfg *config.Config, source EmailSource, sender ReportSender) *Scheduler {
+	return &Scheduler{
+		frequency:  cfg.Reports.Frequency,
+		recipients: cfg.Reports.Recipients,
+		reloaded:   make(chan struct{}, 1),
+		source:     source,
+		sender:     sender,
+		claimer:    cluster.Local{},
+	}
+}
+
+// SetClaimer makes sure each report is sent by only one of the instances
+// sharing claimer. Call it before Run.
+func (s *Scheduler) SetClaimer(claimer cluster.Claimer) {
+	s.claimer = claimer
+}
+
+// ApplyConfig switches to a new report frequency and recipient list. A
+// running scheduler picks the change up immediately.
+func (s *Scheduler) ApplyConfig(cfg *config.Config) {
+	s.mu.Lock()
+	s.frequency = cfg.Reports.Frequency
+	s.recipients = cfg.Reports.Recipients
+	s.mu.Unlock()
+
+	select {
+	case s.reloaded <- struct{}{}:
+	default:
+	}
+}
+
+// Enabled reports whether a frequency and at least one recipient are set.
+func (s *Scheduler) Enabled() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.frequency != "" && len(s.recipients) > 0
+}
+
+// Run blocks, sending a report at the start of every period. While reports
+// are disabled it waits for a config reload to enable them.
+func (s *Scheduler) Run() {
+	for {
+		if !s.Enabled() {
+			<-s.reloaded
+			continue
+		}
+
+		frequency := s.currentFrequency()
+		next := nextRun(frequency, time.Now().UTC())
+		timer := time.NewTimer(time.Until(next))
+
+		select {
+		case <-timer.C:
+			from, to := period(frequency, next)
+			if !s.claim(fmt.Sprintf("report:%s:%s", frequency, from.Format("2006-01-02"))) {
+				continue
+			}
+			if err := s.Send(from, to); err != nil {
+				slog.Error("failed to send report", "frequency", s.currentFrequency(), "error", err)
+			}
+		case <-s.reloaded:
+			timer.Stop()
+		}
+	}
+}
+
+// claim reports whether this instance sends the report or digest of the
+// given name
+func (s *Scheduler) claim(name string) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	claimed, err := s.claimer.Claim(ctx, name, 24*time.Hour)
+	if err != nil {
+		slog.Error("failed to claim report", "report", name, "error", err)
+		return false
+	}
+	return claimed
+}
+
+func (s *Scheduler) currentFrequency() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.frequency
+}
+
+// Send builds the summary for [from, to) and emails it.
+func (s *Scheduler) Send(from, to time.Time) error {
+	s.mu.Lock()
+	frequency, recipients := s.frequency, s.recipients
+	s.mu.Unlock()
+
+	emails := s.source.AllEmails()
+	summary := analytics.Summarize(emails, from, to, false)
+	filtered := analytics.Summarize(emails, from, to, true)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	subject := fmt.Sprintf("📊 Email Tracker %s report: %s – %s",
+		frequency, from.Format("Jan 2"), to.Add(-time.Second).Format("Jan 2, 2006"))
+
+	return s.sender.SendReport(ctx, nil, recipients, subject, map[string]interface{}{
+		"Frequency": frequency,
+		"From":      from.Format("2006-01-02"),
+		"To":        to.Add(-time.Second).Format("2006-01-02"),
+		"Summary":   summary,
+		"Filtered":  filtered,
+		"Year":      to.Year(),
+	})
+}
+
+// nextRun returns the start of the next reporting period after now:
+// Monday morning for weekly reports, the first of the month for monthly ones.
+func nextRun(frequency string, now time.Time) time.Time {
+	today := time.Date(now.Year(), now.Month(), now.Day(), reportHour, 0, 0, 0, time.UTC)
+
+	if frequency == "monthly" {
+		next := time.Date(now.Year(), now.Month(), 1, reportHour, 0, 0, 0, time.UTC)
+		if !next.After(now) {
+			next = next.AddDate(0, 1, 0)
+		}
+		return next
+	}
+
+	daysUntilMonday := (int(time.Monday) - int(now.Weekday()) + 7) % 7
+	next := today.AddDate(0, 0, daysUntilMonday)
+	if !next.After(now) {
+		next = next.AddDate(0, 0, 7)
+	}
+	return next
+}
+
+// period returns the reporting period that ends at the given run time
+func period(frequency string, run time.Time) (time.Time, time.Time) {
+	to := time.Date(run.Year(), run.Month(), run.Day(), 0, 0, 0, 0, time.UTC)
+	if frequency == "monthly" {
+		return to.AddDate(0, -1, 0), to
+	}
+	return to.AddDate(0, 0, -7), to
+}
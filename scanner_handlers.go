@@ -0,0 +1,34 @@
+package main
+
+import (
+	"net/http"
+
+	"email-tracker/audit"
+
+	"github.com/gin-gonic/gin"
+)
+
+// listScanners returns the clients suspected of enumerating tracking IDs,
+// most recently seen first, and whether they're banned.
+func (s *Server) listScanners(c *gin.Context) {
+	scanners := s.tracker.Scanners()
+	banned := 0
+	for _, scanner := range scanners {
+		if scanner.BannedUntil != nil {
+			banned++
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{"scanners": scanners, "total": len(scanners), "banned": banned})
+}
+
+// unbanScanner lifts a suspected scanner's ban, e.g. for a mail provider's
+// image proxy caught by mistake, and clears what it was suspected for.
+func (s *Server) unbanScanner(c *gin.Context) {
+	ip := c.Param("ip")
+	if !s.tracker.Unban(ip) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "No tracking requests seen from this IP"})
+		return
+	}
+	s.recordAudit(c, audit.ActionScannerUnban, ip, nil)
+	c.JSON(http.StatusOK, gin.H{"message": "Ban lifted", "ip": ip})
+}
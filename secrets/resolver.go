@@ -0,0 +1,211 @@
+// Package secrets resolves config values that reference a secrets manager
+// instead of holding the secret itself:
+//
+//	vault:<path>#<key>        HashiCorp Vault (KV v1 or v2), using VAULT_ADDR and VAULT_TOKEN
+//	awssm:<secret-id>#<key>   AWS Secrets Manager, using the default AWS credential chain
+//
+// The #<key> part selects a field of a JSON or KV secret; without it the
+// whole secret string is used.
+package secrets
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+
+	"email-tracker/config"
+
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+	vault "github.com/hashicorp/vault/api"
+)
+
+const (
+	vaultPrefix = "vault:"
+	awsPrefix   = "awssm:"
+)
+
+// Resolver looks up secret references. Clients are created on first use so
+// deployments without references never touch Vault or AWS.
+type Resolver struct {
+	mu    sync.Mutex
+	vault *vault.Client
+	aws   *secretsmanager.Client
+}
+
+func NewResolver() *Resolver {
+	return &Resolver{}
+}
+
+// IsReference reports whether value points at a secrets manager.
+func IsReference(value string) bool {
+	return strings.HasPrefix(value, vaultPrefix) || strings.HasPrefix(value, awsPrefix)
+}
+
+// HasReferences reports whether any secret setting in cfg is a reference.
+func HasReferences(cfg *config.Config) bool {
+	for _, value := range cfg.SecretFields() {
+		if IsReference(*value) {
+			return true
+		}
+	}
+	for _, entries := range [][]string{cfg.Auth.APIKeys, cfg.Webhooks.Secrets} {
+		for _, entry := range entries {
+			if _, key, ok := strings.Cut(entry, ":"); ok && IsReference(key) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Resolve returns a copy of raw with every secret reference replaced by the
+// value it points at. raw itself is left untouched so it can be resolved
+// again later to pick up rotated secrets.
+func (r *Resolver) Resolve(ctx context.Context, raw *config.Config) (*config.Config, error) {
+	cfg := raw.Clone()
+
+	for name, value := range cfg.SecretFields() {
+		if !IsReference(*value) {
+			continue
+		}
+		secret, err := r.lookup(ctx, *value)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		*value = secret
+	}
+
+	if err := r.resolveEntries(ctx, cfg.Auth.APIKeys, "API key"); err != nil {
+		return nil, err
+	}
+	if err := r.resolveEntries(ctx, cfg.Webhooks.Secrets, "webhook secret"); err != nil {
+		return nil, err
+	}
+
+	return cfg, nil
+}
+
+// resolveEntries resolves the secret half of name:secret entries in place.
+// kind names the entries in errors.
+func (r *Resolver) resolveEntries(ctx context.Context, entries []string, kind string) error {
+	for i, entry := range entries {
+		name, key, ok := strings.Cut(entry, ":")
+		if !ok || !IsReference(key) {
+			continue
+		}
+		secret, err := r.lookup(ctx, key)
+		if err != nil {
+			return fmt.Errorf("%s %q: %w", kind, name, err)
+		}
+		entries[i] = name + ":" + secret
+	}
+	return nil
+}
+
+func (r *Resolver) lookup(ctx context.Context, ref string) (string, error) {
+	switch {
+	case strings.HasPrefix(ref, vaultPrefix):
+		path, key := splitRef(strings.TrimPrefix(ref, vaultPrefix))
+		return r.lookupVault(ctx, path, key)
+	case strings.HasPrefix(ref, awsPrefix):
+		id, key := splitRef(strings.TrimPrefix(ref, awsPrefix))
+		return r.lookupAWS(ctx, id, key)
+	default:
+		return ref, nil
+	}
+}
+
+func splitRef(ref string) (string, string) {
+	path, key, _ := strings.Cut(ref, "#")
+	return path, key
+}
+
+func (r *Resolver) lookupVault(ctx context.Context, path, key string) (string, error) {
+	client, err := r.vaultClient()
+	if err != nil {
+		return "", err
+	}
+
+	secret, err := client.Logical().ReadWithContext(ctx, path)
+	if err != nil {
+		return "", fmt.Errorf("vault read %s: %w", path, err)
+	}
+	if secret == nil || secret.Data == nil {
+		return "", fmt.Errorf("vault secret %s not found", path)
+	}
+
+	// KV v2 nests the secret's fields under "data"
+	data := secret.Data
+	if nested, ok := data["data"].(map[string]interface{}); ok {
+		data = nested
+	}
+
+	if key == "" {
+		return "", fmt.Errorf("vault reference %s needs a #key", path)
+	}
+	value, ok := data[key].(string)
+	if !ok {
+		return "", fmt.Errorf("vault secret %s has no string field %q", path, key)
+	}
+	return value, nil
+}
+
+func (r *Resolver) lookupAWS(ctx context.Context, id, key string) (string, error) {
+	client, err := r.awsClient(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	out, err := client.GetSecretValue(ctx, &secretsmanager.GetSecretValueInput{SecretId: &id})
+	if err != nil {
+		return "", fmt.Errorf("aws secret %s: %w", id, err)
+	}
+	if out.SecretString == nil {
+		return "", fmt.Errorf("aws secret %s has no string value", id)
+	}
+	if key == "" {
+		return *out.SecretString, nil
+	}
+
+	var fields map[string]interface{}
+	if err := json.Unmarshal([]byte(*out.SecretString), &fields); err != nil {
+		return "", fmt.Errorf("aws secret %s is not JSON, can't select %q: %w", id, key, err)
+	}
+	value, ok := fields[key].(string)
+	if !ok {
+		return "", fmt.Errorf("aws secret %s has no string field %q", id, key)
+	}
+	return value, nil
+}
+
+func (r *Resolver) vaultClient() (*vault.Client, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.vault == nil {
+		// Address and token come from VAULT_ADDR and VAULT_TOKEN
+		client, err := vault.NewClient(vault.DefaultConfig())
+		if err != nil {
+			return nil, fmt.Errorf("vault client: %w", err)
+		}
+		r.vault = client
+	}
+	return r.vault, nil
+}
+
+func (r *Resolver) awsClient(ctx context.Context) (*secretsmanager.Client, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.aws == nil {
+		awsCfg, err := awsconfig.LoadDefaultConfig(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("aws config: %w", err)
+		}
+		r.aws = secretsmanager.NewFromConfig(awsCfg)
+	}
+	return r.aws, nil
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"email-tracker/audit"
+	"email-tracker/segments"
+
+	"github.com/gin-gonic/gin"
+)
+
+// segmentRequest creates or updates a segment
+type segmentRequest struct {
+	Name  string          `json:"name"`
+	Match string          `json:"match"`
+	Rules []segments.Rule `json:"rules"`
+}
+
+// segmentView is a segment with how many contacts are in it right now
+type segmentView struct {
+	segments.Segment
+	Members int `json:"members"`
+}
+
+func (s *Server) segmentView(seg segments.Segment) segmentView {
+	members, _ := s.segments.Members(seg.Tenant, seg.ID)
+	return segmentView{Segment: seg, Members: len(members)}
+}
+
+// listSegments returns the tenant's segments by name, each with its
+// current member count.
+func (s *Server) listSegments(c *gin.Context) {
+	list := s.segments.All(currentTenant(c))
+	views := make([]segmentView, 0, len(list))
+	for _, seg := range list {
+		views = append(views, s.segmentView(seg))
+	}
+	c.JSON(http.StatusOK, views)
+}
+
+func (s *Server) getSegment(c *gin.Context) {
+	seg, ok := s.segments.Get(currentTenant(c), c.Param("id"))
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Segment not found"})
+		return
+	}
+	c.JSON(http.StatusOK, s.segmentView(seg))
+}
+
+// segmentContacts returns a page of the contacts in a segment right now,
+// by address.
+func (s *Server) segmentContacts(c *gin.Context) {
+	page, perPage, err := pagination(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	members, err := s.segments.Members(currentTenant(c), c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Segment not found"})
+		return
+	}
+	total := len(members)
+	start := min((page-1)*perPage, total)
+	c.JSON(http.StatusOK, gin.H{
+		"contacts": members[start:min(start+perPage, total)],
+		"total":    total,
+		"page":     page,
+		"per_page": perPage,
+	})
+}
+
+func (s *Server) createSegment(c *gin.Context) {
+	var req segmentRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		bindError(c, err)
+		return
+	}
+
+	seg, err := s.segments.Create(currentTenant(c), segments.Segment{Name: req.Name, Match: req.Match, Rules: req.Rules})
+	if !s.segmentSaved(c, err) {
+		return
+	}
+	s.recordAudit(c, audit.ActionSegmentCreate, seg.ID, map[string]string{"name": seg.Name, "rules": strconv.Itoa(len(seg.Rules))})
+	c.JSON(http.StatusCreated, s.segmentView(seg))
+}
+
+// updateSegment replaces a segment's name, match and rules. Campaigns yet
+// to be sent to it reach the members of the new rules.
+func (s *Server) updateSegment(c *gin.Context) {
+	var req segmentRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		bindError(c, err)
+		return
+	}
+
+	seg, err := s.segments.Update(currentTenant(c), c.Param("id"), segments.Segment{Name: req.Name, Match: req.Match, Rules: req.Rules})
+	if !s.segmentSaved(c, err) {
+		return
+	}
+	s.recordAudit(c, audit.ActionSegmentUpdate, seg.ID, map[string]string{"name": seg.Name, "rules": strconv.Itoa(len(seg.Rules))})
+	c.JSON(http.StatusOK, s.segmentView(seg))
+}
+
+// deleteSegment removes a segment, unless campaigns are still to be sent
+// to it.
+func (s *Server) deleteSegment(c *gin.Context) {
+	tenant, id := currentTenant(c), c.Param("id")
+	if _, ok := s.segments.Get(tenant, id); !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Segment not found"})
+		return
+	}
+	if using := s.campaigns.UsingSegment(tenant, id); len(using) > 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": "campaigns still to be sent use this segment: " + strings.Join(using, ", ")})
+		return
+	}
+
+	if _, err := s.segments.Delete(tenant, id); err != nil {
+		s.serverError(c, http.StatusInternalServerError, "failed to save the segments file", err)
+		return
+	}
+	s.recordAudit(c, audit.ActionSegmentDelete, id, nil)
+	c.Status(http.StatusNoContent)
+}
+
+// segmentSaved answers for a segment that couldn't be saved, reporting
+// whether it was.
+func (s *Server) segmentSaved(c *gin.Context, err error) bool {
+	switch {
+	case err == nil:
+		return true
+	case errors.Is(err, segments.ErrInvalid):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	case errors.Is(err, segments.ErrNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Segment not found"})
+	default:
+		s.serverError(c, http.StatusInternalServerError, "failed to save the segments file", err)
+	}
+	return false
+}
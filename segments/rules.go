@@ -0,0 +1,232 @@
+package segments
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"email-tracker/contacts"
+)
+
+// Rule operators. String fields and attributes compare regardless of case;
+// greater_than and less_than also compare attributes holding numbers.
+const (
+	OpEquals        = "equals"
+	OpNotEquals     = "not_equals"
+	OpContains      = "contains"
+	OpNotContains   = "not_contains"
+	OpStartsWith    = "starts_with"
+	OpEndsWith      = "ends_with"
+	OpGreaterThan   = "greater_than"
+	OpLessThan      = "less_than"
+	OpWithinDays    = "within_days"
+	OpNotWithinDays = "not_within_days"
+	OpSet           = "set"
+	OpNotSet        = "not_set"
+)
+
+// How a segment combines its rules
+const (
+	MatchAll = "all"
+	MatchAny = "any"
+)
+
+// attributePrefix starts the field of a rule on a custom attribute, as in
+// attributes.plan
+const attributePrefix = "attributes."
+
+// maxDays bounds within_days, so the cutoff stays a sensible time
+const maxDays = 36500
+
+var (
+	stringFields = []string{"email", "name", "company"}
+	numberFields = []string{"opens", "clicks"}
+	timeFields   = []string{"last_open_at", "last_click_at", "created_at"}
+
+	stringOps = []string{OpEquals, OpNotEquals, OpContains, OpNotContains, OpStartsWith, OpEndsWith, OpGreaterThan, OpLessThan, OpSet, OpNotSet}
+	numberOps = []string{OpEquals, OpNotEquals, OpGreaterThan, OpLessThan}
+	timeOps   = []string{OpWithinDays, OpNotWithinDays, OpSet, OpNotSet}
+)
+
+// Rule is one condition on a contact: a standard field, an engagement
+// field or attributes.<name>, an operator and the value it compares with.
+type Rule struct {
+	Field string `json:"field"`
+	Op    string `json:"op"`
+	Value string `json:"value,omitempty"`
+}
+
+// UnmarshalJSON takes a number value as well as a string, so rules such
+// as {"field": "opens", "op": "greater_than", "value": 3} read naturally.
+func (r *Rule) UnmarshalJSON(data []byte) error {
+	var raw struct {
+		Field string          `json:"field"`
+		Op    string          `json:"op"`
+		Value json.RawMessage `json:"value"`
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	r.Field, r.Op, r.Value = raw.Field, raw.Op, ""
+	if len(raw.Value) == 0 || string(raw.Value) == "null" {
+		return nil
+	}
+	if json.Unmarshal(raw.Value, &r.Value) == nil {
+		return nil
+	}
+	var number json.Number
+	if err := json.Unmarshal(raw.Value, &number); err != nil {
+		return errors.New("a rule's value must be a string or a number")
+	}
+	r.Value = number.String()
+	return nil
+}
+
+// validate checks the rule can be evaluated, returning it as stored
+func (r Rule) validate() (Rule, error) {
+	r.Field = strings.ToLower(strings.TrimSpace(r.Field))
+	r.Op = strings.ToLower(strings.TrimSpace(r.Op))
+	r.Value = strings.TrimSpace(r.Value)
+
+	var ops []string
+	switch {
+	case slices.Contains(stringFields, r.Field):
+		ops = stringOps
+	case slices.Contains(numberFields, r.Field):
+		ops = numberOps
+	case slices.Contains(timeFields, r.Field):
+		ops = timeOps
+	case strings.HasPrefix(r.Field, attributePrefix) && contacts.ValidAttribute(strings.TrimPrefix(r.Field, attributePrefix)):
+		ops = stringOps
+	default:
+		return Rule{}, fmt.Errorf("%w: field %q must be one of %s, %s, %s or attributes.<name>", ErrInvalid, r.Field,
+			strings.Join(stringFields, ", "), strings.Join(numberFields, ", "), strings.Join(timeFields, ", "))
+	}
+	if !slices.Contains(ops, r.Op) {
+		return Rule{}, fmt.Errorf("%w: op for %s must be one of %s", ErrInvalid, r.Field, strings.Join(ops, ", "))
+	}
+
+	switch r.Op {
+	case OpSet, OpNotSet:
+		r.Value = ""
+	case OpWithinDays, OpNotWithinDays:
+		if days, err := strconv.Atoi(r.Value); err != nil || days < 1 || days > maxDays {
+			return Rule{}, fmt.Errorf("%w: %s on %s needs a number of days from 1 to %d", ErrInvalid, r.Op, r.Field, maxDays)
+		}
+	case OpGreaterThan, OpLessThan:
+		if _, err := strconv.ParseFloat(r.Value, 64); err != nil {
+			return Rule{}, fmt.Errorf("%w: %s on %s needs a number", ErrInvalid, r.Op, r.Field)
+		}
+	default:
+		if slices.Contains(numberFields, r.Field) {
+			if _, err := strconv.Atoi(r.Value); err != nil {
+				return Rule{}, fmt.Errorf("%w: %s on %s needs a whole number", ErrInvalid, r.Op, r.Field)
+			}
+		} else if r.Value == "" {
+			return Rule{}, fmt.Errorf("%w: %s on %s needs a value", ErrInvalid, r.Op, r.Field)
+		}
+	}
+	return r, nil
+}
+
+// matches reports whether the contact meets the rule at now
+func (r Rule) matches(c *contacts.Contact, now time.Time) bool {
+	switch {
+	case slices.Contains(numberFields, r.Field):
+		count := c.Opens
+		if r.Field == "clicks" {
+			count = c.Clicks
+		}
+		return compareNumbers(r.Op, float64(count), r.Value)
+	case slices.Contains(timeFields, r.Field):
+		var at *time.Time
+		switch r.Field {
+		case "last_open_at":
+			at = c.LastOpenAt
+		case "last_click_at":
+			at = c.LastClickAt
+		default:
+			at = &c.CreatedAt
+		}
+		return matchTime(r.Op, at, r.Value, now)
+	}
+
+	value := c.Value(strings.TrimPrefix(r.Field, attributePrefix))
+	switch r.Op {
+	case OpSet:
+		return value != ""
+	case OpNotSet:
+		return value == ""
+	case OpGreaterThan, OpLessThan:
+		number, err := strconv.ParseFloat(value, 64)
+		return err == nil && compareNumbers(r.Op, number, r.Value)
+	}
+
+	value, want := strings.ToLower(value), strings.ToLower(r.Value)
+	switch r.Op {
+	case OpEquals:
+		return value == want
+	case OpNotEquals:
+		return value != want
+	case OpContains:
+		return strings.Contains(value, want)
+	case OpNotContains:
+		return !strings.Contains(value, want)
+	case OpStartsWith:
+		return strings.HasPrefix(value, want)
+	case OpEndsWith:
+		return strings.HasSuffix(value, want)
+	}
+	return false
+}
+
+func compareNumbers(op string, value float64, operand string) bool {
+	want, err := strconv.ParseFloat(operand, 64)
+	if err != nil {
+		return false
+	}
+	switch op {
+	case OpEquals:
+		return value == want
+	case OpNotEquals:
+		return value != want
+	case OpGreaterThan:
+		return value > want
+	case OpLessThan:
+		return value < want
+	}
+	return false
+}
+
+func matchTime(op string, at *time.Time, days string, now time.Time) bool {
+	switch op {
+	case OpSet:
+		return at != nil
+	case OpNotSet:
+		return at == nil
+	}
+	n, _ := strconv.Atoi(days)
+	within := at != nil && at.After(now.AddDate(0, 0, -n))
+	if op == OpWithinDays {
+		return within
+	}
+	return !within
+}
+
+// Matches reports whether the contact belongs to the segment at now.
+func (seg *Segment) Matches(c *contacts.Contact, now time.Time) bool {
+	for _, rule := range seg.Rules {
+		matched := rule.matches(c, now)
+		if seg.Match == MatchAny && matched {
+			return true
+		}
+		if seg.Match != MatchAny && !matched {
+			return false
+		}
+	}
+	return seg.Match != MatchAny
+}
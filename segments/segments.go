@@ -0,0 +1,274 @@
+// Package segments keeps each tenant's segments: named sets of rules over
+// contacts' fields, attributes and engagement. Membership is evaluated on
+// demand, so a segment always holds the contacts matching it right now,
+// and a campaign sent to one reaches its members at the time of sending.
+package segments
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"email-tracker/config"
+	"email-tracker/contacts"
+	"email-tracker/models"
+	"email-tracker/utils"
+)
+
+var (
+	// ErrInvalid matches, via errors.Is, segments refused as malformed
+	ErrInvalid = errors.New("invalid segment")
+	// ErrNotFound is returned for segments the tenant doesn't have
+	ErrNotFound = errors.New("segment not found")
+)
+
+const (
+	maxNameLen = 100
+	maxRules   = 20
+)
+
+// Segment is a tenant's named set of rules. A contact is a member when it
+// meets all of them, or any with Match set to any.
+type Segment struct {
+	ID        string    `json:"id"`
+	Tenant    string    `json:"tenant"`
+	Name      string    `json:"name"`
+	Match     string    `json:"match"`
+	Rules     []Rule    `json:"rules"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+func (seg *Segment) clone() Segment {
+	copied := *seg
+	copied.Rules = append([]Rule(nil), seg.Rules...)
+	return copied
+}
+
+// Store holds segments in memory and, when a file is configured, keeps
+// them in it as JSON Lines, one segment per line, rewritten on each
+// change.
+type Store struct {
+	mu       sync.RWMutex
+	segments map[string]*Segment
+	path     string
+	contacts *contacts.Store
+}
+
+// Open loads the segments kept in cfg's SEGMENTS_FILE, if any. Members are
+// evaluated against contacts. Without a file segments only live in memory.
+func Open(cfg *config.Config, contactStore *contacts.Store) (*Store, error) {
+	s := &Store{
+		segments: make(map[string]*Segment),
+		path:     cfg.Segments.File,
+		contacts: contactStore,
+	}
+	if s.path == "" {
+		return s, nil
+	}
+
+	file, err := os.Open(s.path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("open segments file: %w", err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		var seg Segment
+		if err := json.Unmarshal(scanner.Bytes(), &seg); err != nil {
+			return nil, fmt.Errorf("segments file line %d: %w", line, err)
+		}
+		s.segments[seg.ID] = &seg
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("read segments file: %w", err)
+	}
+	return s, nil
+}
+
+// All returns the tenant's segments by name.
+func (s *Store) All(tenant string) []Segment {
+	tenant = models.TenantOr(tenant)
+
+	s.mu.RLock()
+	all := []Segment{}
+	for _, seg := range s.segments {
+		if seg.Tenant == tenant {
+			all = append(all, seg.clone())
+		}
+	}
+	s.mu.RUnlock()
+
+	sort.Slice(all, func(i, j int) bool { return strings.ToLower(all[i].Name) < strings.ToLower(all[j].Name) })
+	return all
+}
+
+// Get returns the tenant's segment with the ID.
+func (s *Store) Get(tenant, id string) (Segment, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	seg, ok := s.segments[id]
+	if !ok || seg.Tenant != models.TenantOr(tenant) {
+		return Segment{}, false
+	}
+	return seg.clone(), true
+}
+
+// Create adds a segment to the tenant with seg's name, match and rules.
+func (s *Store) Create(tenant string, seg Segment) (Segment, error) {
+	seg, err := normalize(seg)
+	if err != nil {
+		return Segment{}, err
+	}
+	seg.ID = utils.GenerateUUID()
+	seg.Tenant = models.TenantOr(tenant)
+	seg.CreatedAt = time.Now().UTC()
+	seg.UpdatedAt = seg.CreatedAt
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.segments[seg.ID] = &seg
+	return seg.clone(), s.save()
+}
+
+// Update replaces the name, match and rules of the tenant's segment.
+func (s *Store) Update(tenant, id string, seg Segment) (Segment, error) {
+	seg, err := normalize(seg)
+	if err != nil {
+		return Segment{}, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	existing, ok := s.segments[id]
+	if !ok || existing.Tenant != models.TenantOr(tenant) {
+		return Segment{}, ErrNotFound
+	}
+	existing.Name, existing.Match, existing.Rules = seg.Name, seg.Match, seg.Rules
+	existing.UpdatedAt = time.Now().UTC()
+	return existing.clone(), s.save()
+}
+
+// Delete removes the tenant's segment, reporting whether it had it.
+func (s *Store) Delete(tenant, id string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	seg, ok := s.segments[id]
+	if !ok || seg.Tenant != models.TenantOr(tenant) {
+		return false, nil
+	}
+	delete(s.segments, id)
+	return true, s.save()
+}
+
+// Members returns the tenant's contacts in the segment right now, by
+// address.
+func (s *Store) Members(tenant, id string) ([]contacts.Contact, error) {
+	seg, ok := s.Get(tenant, id)
+	if !ok {
+		return nil, ErrNotFound
+	}
+	now := time.Now()
+	members := []contacts.Contact{}
+	for _, c := range s.contacts.All(seg.Tenant) {
+		if seg.Matches(&c, now) {
+			members = append(members, c)
+		}
+	}
+	return members, nil
+}
+
+// Recipients returns the addresses of the segment's members right now, for
+// a campaign sent to it.
+func (s *Store) Recipients(tenant, id string) ([]string, error) {
+	members, err := s.Members(tenant, id)
+	if err != nil {
+		return nil, err
+	}
+	recipients := make([]string, len(members))
+	for i, c := range members {
+		recipients[i] = c.Email
+	}
+	return recipients, nil
+}
+
+// normalize checks seg's name, match and rules, returning them as stored
+func normalize(seg Segment) (Segment, error) {
+	seg.Name = strings.TrimSpace(seg.Name)
+	if seg.Name == "" || utf8.RuneCountInString(seg.Name) > maxNameLen {
+		return Segment{}, fmt.Errorf("%w: name is required, up to %d characters", ErrInvalid, maxNameLen)
+	}
+	seg.Match = strings.ToLower(strings.TrimSpace(seg.Match))
+	if seg.Match == "" {
+		seg.Match = MatchAll
+	}
+	if seg.Match != MatchAll && seg.Match != MatchAny {
+		return Segment{}, fmt.Errorf("%w: match must be %s or %s", ErrInvalid, MatchAll, MatchAny)
+	}
+	if len(seg.Rules) == 0 || len(seg.Rules) > maxRules {
+		return Segment{}, fmt.Errorf("%w: a segment needs 1 to %d rules", ErrInvalid, maxRules)
+	}
+
+	rules := make([]Rule, len(seg.Rules))
+	for i, rule := range seg.Rules {
+		var err error
+		if rules[i], err = rule.validate(); err != nil {
+			return Segment{}, err
+		}
+	}
+	seg.Rules = rules
+	return seg, nil
+}
+
+// save rewrites the file. The new file is written alongside and renamed
+// over the old one, so a failure leaves the old one intact. Must be called
+// with s.mu held.
+func (s *Store) save() error {
+	if s.path == "" {
+		return nil
+	}
+
+	var lines []byte
+	for _, seg := range s.segments {
+		line, err := json.Marshal(seg)
+		if err != nil {
+			return err
+		}
+		lines = append(append(lines, line...), '\n')
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".*")
+	if err != nil {
+		return fmt.Errorf("rewrite segments file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	if err := tmp.Chmod(0o600); err != nil {
+		return fmt.Errorf("rewrite segments file: %w", err)
+	}
+	if _, err := tmp.Write(lines); err != nil {
+		return fmt.Errorf("rewrite segments file: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		return fmt.Errorf("rewrite segments file: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), s.path); err != nil {
+		return fmt.Errorf("rewrite segments file: %w", err)
+	}
+	return nil
+}
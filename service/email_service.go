@@ -7,22 +7,42 @@ import (
 	"time"
 
 	"email-tracker/config"
+	"email-tracker/consent"
+	"email-tracker/contacts"
+	"email-tracker/deliverability"
 	"email-tracker/models"
 	"email-tracker/notification"
+	"email-tracker/suppression"
+	"email-tracker/tenants"
 	"email-tracker/tracker"
+	"email-tracker/utils"
 )
 
+// UnsubscribePlaceholder in a body is replaced with the email's unsubscribe
+// link
+const UnsubscribePlaceholder = "{{unsubscribe_url}}"
+
 type EmailService struct {
-	config   *config.Config
-	tracker  *tracker.Tracker
-	notifier *notification.Sender
+	config       *config.Config
+	tracker      *tracker.Tracker
+	notifier     *notification.Sender
+	suppressions *suppression.Store
+	senders      *deliverability.Checker
+	consent      *consent.Store
+	tenants      *tenants.Store
+	contacts     *contacts.Store
 }
 
-func NewEmailService(cfg *config.Config, tr *tracker.Tracker, nt *notification.Sender) *EmailService {
+func NewEmailService(cfg *config.Config, tr *tracker.Tracker, nt *notification.Sender, sp *suppression.Store, dc *deliverability.Checker, cs *consent.Store, ts *tenants.Store, ct *contacts.Store) *EmailService {
 	return &EmailService{
-		config:   cfg,
-		tracker:  tr,
-		notifier: nt,
+		config:       cfg,
+		tracker:      tr,
+		notifier:     nt,
+		suppressions: sp,
+		senders:      dc,
+		consent:      cs,
+		tenants:      ts,
+		contacts:     ct,
 	}
 }
 
@@ -32,50 +52,149 @@ func (s *EmailService) SendTrackedEmail(
 	baseURL string,
 ) (string, error) {
 
+	tenant := models.TenantOr(req.TenantID)
+
+	// Suspended tenants send nothing, and the others no more than their
+	// quota
+	if err := s.tenants.CheckActive(tenant); err != nil {
+		return "", err
+	}
+	quota, retentionDays := s.tenants.Limits(tenant)
+	if quota.Enabled() {
+		now := time.Now().UTC()
+		day := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+		month := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+		sinceDay, sinceMonth := s.tracker.RecipientsSent(tenant, day, month)
+		if err := quota.Check(sinceDay, sinceMonth, len(req.To), now); err != nil {
+			return "", err
+		}
+	}
+	// Emails without a retention of their own are kept as long as the
+	// tenant's are
+	if req.RetentionDays > 0 {
+		retentionDays = req.RetentionDays
+	}
+
+	// Nothing is sent when any recipient is suppressed
+	if err := s.suppressions.Check(tenant, req.To); err != nil {
+		return "", err
+	}
+
+	// Marketing needs the recipients' confirmed consent
+	if req.Category == models.CategoryMarketing {
+		if err := s.consent.Guard(tenant, req.To); err != nil {
+			return "", err
+		}
+	}
+
+	// Tenants with sending settings of their own send as themselves
+	account := s.tenants.Account(tenant)
+	from := s.notifier.FromFor(account)
+
+	// Nor when the strict guard expects mail from the sender's domain to
+	// fail authentication
+	if err := s.senders.GuardVia(ctx, from, s.tenants.Via(tenant)); err != nil {
+		return "", err
+	}
+
 	// Generate tracking ID
 	trackingID, err := s.tracker.GenerateTrackingID()
 	if err != nil {
 		return "", fmt.Errorf("failed to generate tracking ID: %w", err)
 	}
 
+	// Only allowlisted markup is sent, and kept for the dashboard preview
+	sanitized := utils.SanitizeHTML(req.Body)
+
+	// Merge variables take the values of the recipient's contact. Emails
+	// to several recipients at once get the fallbacks.
+	var contact *contacts.Contact
+	if len(req.To) == 1 {
+		if c, ok := s.contacts.Get(tenant, req.To[0]); ok {
+			contact = &c
+		}
+	}
+	subject := contacts.Merge(req.Subject, contact, false)
+	body := contacts.Merge(sanitized, contact, true)
+
+	// Rewrite links for click tracking if requested
+	var links []string
+	if req.TrackClicks {
+		body, links = s.tracker.RewriteLinks(body, trackingID, baseURL)
+	}
+	body = strings.ReplaceAll(body, UnsubscribePlaceholder, s.tracker.UnsubscribeURL(trackingID, baseURL))
+
 	// Embed tracking pixel in email body
-	trackedBody, err := s.tracker.EmbedTrackingPixel(req.Body, trackingID, baseURL)
+	trackedBody, err := s.tracker.EmbedTrackingPixel(body, trackingID, baseURL)
 	if err != nil {
 		return "", fmt.Errorf("failed to embed tracking pixel: %w", err)
 	}
 
-	emailCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
-	defer cancel()
+	// Create email model
+	emailModel := &models.Email{
+		ID:             trackingID,
+		TenantID:       tenant,
+		From:           from,
+		To:             strings.Join(req.To, ","),
+		Subject:        subject,
+		Body:           sanitized,
+		TrackingID:     trackingID,
+		SentAt:         time.Now(),
+		NotifyOnOpen:   req.NotifyOnOpen,
+		NotifyEmail:    req.NotifyEmail,
+		CampaignID:     req.CampaignID,
+		Links:          links,
+		ABTestID:       req.ABTestID,
+		Variant:        req.Variant,
+		Tags:           req.Tags,
+		Category:       req.Category,
+		RetentionDays:  retentionDays,
+		DeliveryStatus: models.DeliveryStatusDelivered,
+	}
 
 	// Send email
-	if err := s.notifier.SendEmail(
-		emailCtx,
+	if err := s.notifier.SendEmailAs(
+		ctx,
+		account,
 		req.To,
-		req.Subject,
+		subject,
 		trackedBody,
 	); err != nil {
+		// Keep failed sends so funnels count them as sent but not delivered
+		emailModel.DeliveryStatus = models.DeliveryStatusFailed
+		s.tracker.RegisterEmail(emailModel, trackingID)
 		return "", fmt.Errorf("failed to send email: %w", err)
 	}
 
-	// Create and store email model
-	emailModel := &models.Email{
-		ID:           trackingID,
-		From:         s.config.SMTP.From,
-		To:           strings.Join(req.To, ","),
-		Subject:      req.Subject,
-		Body:         req.Body,
-		TrackingID:   trackingID,
-		SentAt:       time.Now(),
-		NotifyOnOpen: req.NotifyOnOpen,
-		NotifyEmail:  req.NotifyEmail,
-	}
-
 	// Register email for tracking
 	s.tracker.RegisterEmail(emailModel, trackingID)
 
 	return trackingID, nil
 }
 
+// Resend sends a previously sent email again under a new tracking ID, with
+// the same recipients, content and tracking options.
+func (s *EmailService) Resend(ctx context.Context, email *models.Email, baseURL string) (string, error) {
+	req := &models.EmailRequest{
+		To:           strings.Split(email.To, ","),
+		Subject:      email.Subject,
+		Body:         email.Body,
+		NotifyOnOpen: email.NotifyOnOpen,
+		NotifyEmail:  email.NotifyEmail,
+		CampaignID:   email.CampaignID,
+		TrackClicks:  len(email.Links) > 0,
+		ABTestID:     email.ABTestID,
+		Variant:      email.Variant,
+		Tags:         email.Tags,
+		Category:     email.Category,
+		TenantID:     email.Tenant(),
+
+		RetentionDays: email.RetentionDays,
+	}
+
+	return s.SendTrackedEmail(ctx, req, baseURL)
+}
+
 func (s *EmailService) GetTrackingInfo(trackingID string) (*models.TrackingEvent, error) {
 	// This would fetch from database in production
 	// For now, return nil
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"email-tracker/config"
+
+	"github.com/gin-gonic/gin"
+)
+
+// invalidationMemory is how long an invalidation is remembered, so a
+// response computed before it isn't cached after it. Responses that took
+// longer than this to compute aren't cached at all.
+const invalidationMemory = time.Minute
+
+// statsCacheStats describes how well the stats cache is doing
+type statsCacheStats struct {
+	Entries    int    `json:"entries"`
+	MaxEntries int    `json:"max_entries"`
+	Hits       uint64 `json:"hits"`
+	Misses     uint64 `json:"misses"`
+}
+
+type cachedResponse struct {
+	contentType string
+	body        []byte
+	expires     time.Time
+}
+
+// statsCache keeps rendered per-email and per-campaign stats responses for
+// a short while, so dashboards polling them and repeated lookups of popular
+// emails don't recompute them from the tracker every time. Responses are
+// grouped by scope, e.g. "tracking:<id>", and a scope is dropped as soon as
+// anything in it changes.
+type statsCache struct {
+	ttl        time.Duration
+	maxEntries int
+
+	mu          sync.Mutex
+	scopes      map[string]map[string]cachedResponse
+	entries     int
+	invalidated map[string]time.Time
+	lastSweep   time.Time
+
+	hits   atomic.Uint64
+	misses atomic.Uint64
+}
+
+func newStatsCache(cfg *config.Config) *statsCache {
+	return &statsCache{
+		ttl:         cfg.StatsCache.TTL,
+		maxEntries:  cfg.StatsCache.MaxEntries,
+		scopes:      make(map[string]map[string]cachedResponse),
+		invalidated: make(map[string]time.Time),
+	}
+}
+
+func (sc *statsCache) get(scope, key string, now time.Time) (cachedResponse, bool) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	response, ok := sc.scopes[scope][key]
+	if !ok || now.After(response.expires) {
+		return cachedResponse{}, false
+	}
+	return response, true
+}
+
+// put caches a response computed from data read at started, unless scope
+// was invalidated since. When the cache is full, expired entries are swept
+// out, and if that doesn't make room the response isn't cached.
+func (sc *statsCache) put(scope, key string, response cachedResponse, started time.Time) {
+	now := time.Now()
+	if now.Sub(started) > invalidationMemory {
+		return
+	}
+
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	if at, ok := sc.invalidated[scope]; ok && !at.Before(started) {
+		return
+	}
+	if sc.entries >= sc.maxEntries || now.Sub(sc.lastSweep) > invalidationMemory {
+		sc.sweep(now)
+		if sc.entries >= sc.maxEntries {
+			return
+		}
+	}
+
+	responses, ok := sc.scopes[scope]
+	if !ok {
+		responses = make(map[string]cachedResponse)
+		sc.scopes[scope] = responses
+	}
+	if _, exists := responses[key]; !exists {
+		sc.entries++
+	}
+	response.expires = now.Add(sc.ttl)
+	responses[key] = response
+}
+
+// invalidate drops every response cached for scope.
+func (sc *statsCache) invalidate(scope string) {
+	now := time.Now()
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	sc.entries -= len(sc.scopes[scope])
+	delete(sc.scopes, scope)
+	sc.invalidated[scope] = now
+	if now.Sub(sc.lastSweep) > invalidationMemory {
+		sc.sweep(now)
+	}
+}
+
+// sweep drops expired responses and invalidations old enough to forget.
+// Must be called with sc.mu held.
+func (sc *statsCache) sweep(now time.Time) {
+	sc.lastSweep = now
+	for scope, responses := range sc.scopes {
+		for key, response := range responses {
+			if now.After(response.expires) {
+				delete(responses, key)
+				sc.entries--
+			}
+		}
+		if len(responses) == 0 {
+			delete(sc.scopes, scope)
+		}
+	}
+	for scope, at := range sc.invalidated {
+		if now.Sub(at) > invalidationMemory {
+			delete(sc.invalidated, scope)
+		}
+	}
+}
+
+func (sc *statsCache) stats() statsCacheStats {
+	sc.mu.Lock()
+	entries := sc.entries
+	sc.mu.Unlock()
+
+	return statsCacheStats{
+		Entries:    entries,
+		MaxEntries: sc.maxEntries,
+		Hits:       sc.hits.Load(),
+		Misses:     sc.misses.Load(),
+	}
+}
+
+// capturingWriter keeps a copy of the response body as it is written
+type capturingWriter struct {
+	gin.ResponseWriter
+	body bytes.Buffer
+}
+
+func (w *capturingWriter) Write(data []byte) (int, error) {
+	w.body.Write(data)
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *capturingWriter) WriteString(s string) (int, error) {
+	w.body.WriteString(s)
+	return w.ResponseWriter.WriteString(s)
+}
+
+// cacheStats serves the stats of the tracking ID or campaign in the :id
+// parameter from the stats cache, keyed by the tenant and the full request
+// URI, since tenants sharing a campaign ID see different emails, and caches
+// successful responses. kind is "tracking" or "campaign". Responses carry
+// X-Cache: HIT or MISS.
+func (s *Server) cacheStats(kind string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if s.statsCache.ttl <= 0 {
+			c.Next()
+			return
+		}
+
+		scope := kind + ":" + c.Param("id")
+		key := currentTenant(c) + " " + c.Request.URL.RequestURI()
+		now := time.Now()
+		if response, ok := s.statsCache.get(scope, key, now); ok {
+			s.statsCache.hits.Add(1)
+			c.Header("X-Cache", "HIT")
+			c.Data(http.StatusOK, response.contentType, response.body)
+			c.Abort()
+			return
+		}
+		s.statsCache.misses.Add(1)
+
+		writer := &capturingWriter{ResponseWriter: c.Writer}
+		c.Writer = writer
+		c.Header("X-Cache", "MISS")
+		c.Next()
+		c.Writer = writer.ResponseWriter
+
+		if writer.Status() == http.StatusOK {
+			s.statsCache.put(scope, key, cachedResponse{
+				contentType: writer.Header().Get("Content-Type"),
+				body:        writer.body.Bytes(),
+			}, now)
+		}
+	}
+}
+
+// invalidateEmail drops the cached stats of a changed email and its
+// campaign.
+func (sc *statsCache) invalidateEmail(trackingID, campaignID string) {
+	sc.invalidate("tracking:" + trackingID)
+	if campaignID != "" {
+		sc.invalidate("campaign:" + campaignID)
+	}
+}
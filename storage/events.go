@@ -0,0 +1,126 @@
+// Package storage keeps tracking data somewhere that outlives the process.
+package storage
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"email-tracker/models"
+)
+
+// EventStore durably keeps tracking events
+type EventStore interface {
+	// SaveEvents writes events in one go; they are durable once it returns
+	SaveEvents(events []*models.TrackingEvent) error
+	// DeleteEvents removes the events match accepts and reports how many
+	// there were
+	DeleteEvents(match func(*models.TrackingEvent) bool) (int, error)
+	Close() error
+}
+
+// EventFile appends events to a JSON Lines file and syncs it after every
+// batch.
+type EventFile struct {
+	mu   sync.Mutex
+	path string
+	file *os.File
+}
+
+func OpenEventFile(path string) (*EventFile, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("open event file: %w", err)
+	}
+	return &EventFile{path: path, file: file}, nil
+}
+
+func (f *EventFile) SaveEvents(events []*models.TrackingEvent) error {
+	var buf []byte
+	for _, event := range events {
+		line, err := json.Marshal(event)
+		if err != nil {
+			return err
+		}
+		buf = append(append(buf, line...), '\n')
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if _, err := f.file.Write(buf); err != nil {
+		return fmt.Errorf("write event file: %w", err)
+	}
+	if err := f.file.Sync(); err != nil {
+		return fmt.Errorf("sync event file: %w", err)
+	}
+	return nil
+}
+
+// DeleteEvents rewrites the file without the events match accepts. The new
+// file is written alongside and renamed over the old one, so a failure
+// leaves the old one intact. Lines that don't parse are kept.
+func (f *EventFile) DeleteEvents(match func(*models.TrackingEvent) bool) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	in, err := os.Open(f.path)
+	if err != nil {
+		return 0, fmt.Errorf("read event file: %w", err)
+	}
+	defer in.Close()
+
+	tmp, err := os.CreateTemp(filepath.Dir(f.path), filepath.Base(f.path)+".*")
+	if err != nil {
+		return 0, fmt.Errorf("rewrite event file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	removed := 0
+	out := bufio.NewWriter(tmp)
+	scanner := bufio.NewScanner(in)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var event models.TrackingEvent
+		if json.Unmarshal(scanner.Bytes(), &event) == nil && match(&event) {
+			removed++
+			continue
+		}
+		out.Write(scanner.Bytes())
+		out.WriteByte('\n')
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, fmt.Errorf("read event file: %w", err)
+	}
+	if removed == 0 {
+		return 0, nil
+	}
+	if err := out.Flush(); err != nil {
+		return 0, fmt.Errorf("rewrite event file: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		return 0, fmt.Errorf("rewrite event file: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), f.path); err != nil {
+		return 0, fmt.Errorf("rewrite event file: %w", err)
+	}
+
+	// Appends have to go to the new file from now on
+	file, err := os.OpenFile(f.path, os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return removed, fmt.Errorf("reopen event file: %w", err)
+	}
+	f.file.Close()
+	f.file = file
+	return removed, nil
+}
+
+func (f *EventFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.file.Close()
+}
@@ -0,0 +1,243 @@
+// Package suppression keeps the addresses that must not be mailed again:
+// hard bounces, spam complaints, unsubscribes and ones added by hand. Each
+// tenant has a list of its own.
+package suppression
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"email-tracker/models"
+	"email-tracker/utils"
+)
+
+// Why an address is suppressed
+const (
+	ReasonHardBounce  = "hard_bounce"
+	ReasonComplaint   = "complaint"
+	ReasonUnsubscribe = "unsubscribe"
+	ReasonManual      = "manual"
+)
+
+// ErrSuppressed matches, via errors.Is, sends refused because a recipient
+// is suppressed
+var ErrSuppressed = errors.New("recipient is suppressed")
+
+// Error is a send refused for suppressed recipients
+type Error struct {
+	Addresses []string
+}
+
+func (e *Error) Error() string {
+	return "suppressed recipients: " + strings.Join(e.Addresses, ", ")
+}
+
+func (e *Error) Is(target error) bool {
+	return target == ErrSuppressed
+}
+
+// Entry is one suppressed address
+type Entry struct {
+	Tenant  string `json:"tenant"`
+	Address string `json:"email"`
+	Reason  string `json:"reason"`
+	// Source is the tracking ID of the email that led to the entry, if any
+	Source    string    `json:"source,omitempty"`
+	Note      string    `json:"note,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// change is a line of the suppression file
+type change struct {
+	Op string `json:"op"`
+	Entry
+}
+
+const (
+	opAdd    = "add"
+	opRemove = "remove"
+)
+
+// key identifies an address on a tenant's list
+type key struct {
+	tenant, address string
+}
+
+func keyOf(tenant, address string) key {
+	return key{models.TenantOr(tenant), utils.NormalizeAddress(address)}
+}
+
+// Store holds the suppression list in memory and, when a file is
+// configured, appends every change to it as JSON Lines so the list survives
+// restarts.
+type Store struct {
+	mu      sync.RWMutex
+	entries map[key]Entry
+	file    *os.File
+}
+
+// Open loads the list from path and appends changes to it. With an empty
+// path the list is only kept in memory.
+func Open(path string) (*Store, error) {
+	s := &Store{entries: make(map[key]Entry)}
+	if path == "" {
+		return s, nil
+	}
+
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("open suppression list: %w", err)
+	}
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var c change
+		if err := json.Unmarshal(scanner.Bytes(), &c); err != nil {
+			file.Close()
+			return nil, fmt.Errorf("read suppression list %s: %w", path, err)
+		}
+		s.apply(c)
+	}
+	if err := scanner.Err(); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("read suppression list %s: %w", path, err)
+	}
+
+	s.file = file
+	return s, nil
+}
+
+// apply makes a change in memory. Must be called with s.mu held, or before
+// the store is shared.
+func (s *Store) apply(c change) {
+	// Entries written before tenants belong to the default tenant
+	c.Tenant = models.TenantOr(c.Tenant)
+	switch c.Op {
+	case opAdd:
+		s.entries[keyOf(c.Tenant, c.Address)] = c.Entry
+	case opRemove:
+		delete(s.entries, keyOf(c.Tenant, c.Address))
+	}
+}
+
+// write appends a change to the file. Must be called with s.mu held.
+func (s *Store) write(c change) error {
+	if s.file == nil {
+		return nil
+	}
+	line, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	if _, err := s.file.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("write suppression list: %w", err)
+	}
+	return nil
+}
+
+// Add suppresses entry.Address for entry.Tenant. An address that is
+// already suppressed keeps its original entry, which is returned with
+// added false.
+func (s *Store) Add(entry Entry) (Entry, bool, error) {
+	entry.Tenant = models.TenantOr(entry.Tenant)
+	entry.Address = utils.NormalizeAddress(entry.Address)
+	entry.CreatedAt = time.Now().UTC()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if existing, ok := s.entries[keyOf(entry.Tenant, entry.Address)]; ok {
+		return existing, false, nil
+	}
+	c := change{Op: opAdd, Entry: entry}
+	s.apply(c)
+	return entry, true, s.write(c)
+}
+
+// Remove lifts the tenant's suppression of address, reporting whether
+// there was one.
+func (s *Store) Remove(tenant, address string) (bool, error) {
+	k := keyOf(tenant, address)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.entries[k]; !ok {
+		return false, nil
+	}
+	c := change{Op: opRemove, Entry: Entry{Tenant: k.tenant, Address: k.address, CreatedAt: time.Now().UTC()}}
+	s.apply(c)
+	return true, s.write(c)
+}
+
+// Get returns the tenant's entry for address, if it is suppressed.
+func (s *Store) Get(tenant, address string) (Entry, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	entry, ok := s.entries[keyOf(tenant, address)]
+	return entry, ok
+}
+
+// Check returns an *Error listing the addresses the tenant suppressed, or
+// nil when none are.
+func (s *Store) Check(tenant string, addresses []string) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var suppressed []string
+	for _, address := range addresses {
+		if _, ok := s.entries[keyOf(tenant, address)]; ok {
+			suppressed = append(suppressed, address)
+		}
+	}
+	if len(suppressed) > 0 {
+		return &Error{Addresses: suppressed}
+	}
+	return nil
+}
+
+// List returns the tenant's entries with the given reason, or all of them
+// when reason is empty, newest first.
+func (s *Store) List(tenant, reason string) []Entry {
+	tenant = models.TenantOr(tenant)
+
+	s.mu.RLock()
+	list := make([]Entry, 0)
+	for k, entry := range s.entries {
+		if k.tenant == tenant && (reason == "" || entry.Reason == reason) {
+			list = append(list, entry)
+		}
+	}
+	s.mu.RUnlock()
+
+	sort.Slice(list, func(i, j int) bool { return list[i].CreatedAt.After(list[j].CreatedAt) })
+	return list
+}
+
+// Len returns how many addresses are suppressed, across tenants.
+func (s *Store) Len() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.entries)
+}
+
+// Close closes the file.
+func (s *Store) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.file == nil {
+		return nil
+	}
+	err := s.file.Close()
+	s.file = nil
+	return err
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"email-tracker/audit"
+	"email-tracker/logging"
+	"email-tracker/models"
+	"email-tracker/suppression"
+	"email-tracker/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+// actorRecipient is the audit actor for unsubscribes, made by recipients
+// rather than users
+const actorRecipient = "recipient"
+
+type suppressionRequest struct {
+	Email  string `json:"email" binding:"required"`
+	Reason string `json:"reason"`
+	Note   string `json:"note"`
+}
+
+type complaintRequest struct {
+	Note string `json:"note"`
+}
+
+// listSuppressions returns the tenant's suppression list, newest first,
+// optionally narrowed down to one ?reason=.
+func (s *Server) listSuppressions(c *gin.Context) {
+	entries := s.suppressions.List(currentTenant(c), c.Query("reason"))
+	c.JSON(http.StatusOK, gin.H{"suppressions": entries, "total": len(entries)})
+}
+
+// addSuppression suppresses an address by hand. The reason defaults to
+// manual. An address that is already suppressed keeps its entry and is
+// answered with 200 instead of 201.
+func (s *Server) addSuppression(c *gin.Context) {
+	var req suppressionRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		bindError(c, err)
+		return
+	}
+	if !utils.ValidateEmail(req.Email) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid email address"})
+		return
+	}
+	switch req.Reason {
+	case "":
+		req.Reason = suppression.ReasonManual
+	case suppression.ReasonHardBounce, suppression.ReasonComplaint, suppression.ReasonUnsubscribe, suppression.ReasonManual:
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "reason must be hard_bounce, complaint, unsubscribe or manual"})
+		return
+	}
+
+	entry, added, err := s.suppressions.Add(suppression.Entry{
+		Tenant:  currentTenant(c),
+		Address: req.Email,
+		Reason:  req.Reason,
+		Note:    req.Note,
+	})
+	if err != nil {
+		s.serverError(c, http.StatusInternalServerError, "failed to save the suppression list", err)
+		return
+	}
+	if !added {
+		c.JSON(http.StatusOK, entry)
+		return
+	}
+	s.recordAudit(c, audit.ActionSuppressionAdd, logging.RecipientHash(entry.Address),
+		map[string]string{"address": entry.Address, "reason": entry.Reason})
+	c.JSON(http.StatusCreated, entry)
+}
+
+// deleteSuppression lets an address be mailed again.
+func (s *Server) deleteSuppression(c *gin.Context) {
+	tenant, address := currentTenant(c), c.Param("email")
+	entry, ok := s.suppressions.Get(tenant, address)
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Address is not suppressed"})
+		return
+	}
+	if _, err := s.suppressions.Remove(tenant, address); err != nil {
+		s.serverError(c, http.StatusInternalServerError, "failed to save the suppression list", err)
+		return
+	}
+	s.recordAudit(c, audit.ActionSuppressionRemove, logging.RecipientHash(entry.Address),
+		map[string]string{"address": entry.Address, "reason": entry.Reason})
+	c.JSON(http.StatusOK, gin.H{"message": "Suppression removed", "email": entry.Address})
+}
+
+// reportComplaint records a spam complaint against a sent email, e.g. from
+// a feedback loop report, and suppresses its recipients.
+func (s *Server) reportComplaint(c *gin.Context) {
+	var req complaintRequest
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			bindError(c, err)
+			return
+		}
+	}
+
+	email := s.tracker.GetEmail(c.Param("id"))
+	if email == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Email not found"})
+		return
+	}
+	s.recordAudit(c, audit.ActionEmailComplaint, email.TrackingID, nil)
+	added := s.suppressRecipients(c, auditActor(c), email, suppression.ReasonComplaint, req.Note)
+
+	c.JSON(http.StatusOK, gin.H{"message": "Complaint recorded", "suppressed": added})
+}
+
+// suppressRecipients puts every recipient of email on its tenant's
+// suppression list and returns the entries added. Failures to write the list are logged;
+// the addresses are suppressed in memory regardless.
+func (s *Server) suppressRecipients(c *gin.Context, actor string, email *models.Email, reason, note string) []suppression.Entry {
+	added := []suppression.Entry{}
+	for _, to := range strings.Split(email.To, ",") {
+		entry, isNew, err := s.suppressions.Add(suppression.Entry{
+			Tenant:  email.Tenant(),
+			Address: to,
+			Reason:  reason,
+			Source:  email.TrackingID,
+			Note:    note,
+		})
+		if err != nil {
+			slog.Error("failed to write suppression list", "recipient_hash", logging.RecipientHash(to), "error", err)
+		}
+		if !isNew {
+			continue
+		}
+		added = append(added, entry)
+		s.recordAuditAs(c, actor, audit.ActionSuppressionAdd, logging.RecipientHash(entry.Address),
+			map[string]string{"address": entry.Address, "reason": reason, "tracking_id": email.TrackingID})
+	}
+	return added
+}
+
+// unsubscribe serves the link put in emails through the unsubscribe
+// placeholder. GET only asks for confirmation, so link scanners following
+// it don't unsubscribe anyone; POST, which one-click unsubscribe also
+// uses, suppresses the email's recipients.
+func (s *Server) unsubscribe(c *gin.Context) {
+	trackingID := c.Param("id")
+	if !s.tracker.VerifyUnsubscribe(trackingID, c.Query("sig")) {
+		c.String(http.StatusNotFound, "404 page not found")
+		return
+	}
+	c.Header("Cache-Control", "no-store")
+
+	email := s.tracker.GetEmail(trackingID)
+	if email == nil {
+		c.HTML(http.StatusNotFound, "unsubscribe.html", gin.H{"title": "Unsubscribe", "expired": true})
+		return
+	}
+	if c.Request.Method != http.MethodPost {
+		c.HTML(http.StatusOK, "unsubscribe.html", gin.H{"title": "Unsubscribe"})
+		return
+	}
+
+	s.suppressRecipients(c, actorRecipient, email, suppression.ReasonUnsubscribe, "")
+	slog.Info("recipient unsubscribed", "tracking_id", trackingID, "recipient_hash", logging.RecipientHash(email.To))
+	c.HTML(http.StatusOK, "unsubscribe.html", gin.H{"title": "Unsubscribed", "done": true})
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"email-tracker/breaker"
+	"email-tracker/campaigns"
+	"email-tracker/geo"
+	"email-tracker/notification"
+	"email-tracker/tracker"
+	"email-tracker/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Thresholds above which the dashboard flags a system widget as unhealthy
+const (
+	smtpFailureRateWarning     = 20.0
+	notificationBacklogWarning = 50
+	queueDepthWarning          = 1000
+	geoFailureRateWarning      = 50.0
+)
+
+type storageHealth struct {
+	tracker.StorageStats
+	Counters      string `json:"counters"`
+	CountersError string `json:"counters_error,omitempty"`
+}
+
+// systemAlerts flags which parts of the system need attention
+type systemAlerts struct {
+	Queue         bool `json:"queue"`
+	SMTP          bool `json:"smtp"`
+	Notifications bool `json:"notifications"`
+	Storage       bool `json:"storage"`
+	Geo           bool `json:"geo"`
+}
+
+// systemHealth is what operators need to spot problems without reading logs
+type systemHealth struct {
+	Queue               campaigns.QueueStats       `json:"queue"`
+	SMTP                notification.DeliveryStats `json:"smtp"`
+	SMTPPool            notification.PoolStats     `json:"smtp_pool"`
+	SendAdmission       admissionStats             `json:"send_admission"`
+	NotificationBacklog int64                      `json:"notification_backlog"`
+	InvalidAttempts     uint64                     `json:"invalid_tracking_attempts"`
+	Storage             storageHealth              `json:"storage"`
+	Geo                 []geo.ProviderStats        `json:"geo"`
+	GeoQueue            tracker.GeoQueueStats      `json:"geo_queue"`
+	CircuitBreakers     []breaker.Status           `json:"circuit_breakers"`
+	Alerts              systemAlerts               `json:"alerts"`
+	Warnings            []string                   `json:"warnings"`
+	CheckedAt           time.Time                  `json:"checked_at"`
+}
+
+func (s *Server) systemHealth(ctx context.Context) *systemHealth {
+	health := &systemHealth{
+		Queue:               s.campaigns.Queue(),
+		SMTP:                s.notifier.Stats(),
+		SMTPPool:            s.notifier.PoolStats(),
+		SendAdmission:       s.sends.stats(),
+		NotificationBacklog: s.tracker.PendingNotifications(),
+		InvalidAttempts:     s.tracker.InvalidAttempts(),
+		Storage:             storageHealth{StorageStats: s.tracker.StorageStats(), Counters: "disabled"},
+		Geo:                 s.tracker.GeoStats(),
+		GeoQueue:            s.tracker.GeoQueue(),
+		CircuitBreakers:     s.circuitBreakers(),
+		Warnings:            []string{},
+		CheckedAt:           time.Now(),
+	}
+
+	if pinger, ok := s.counters.(interface{ Ping(context.Context) error }); ok {
+		ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+		defer cancel()
+
+		health.Storage.Counters = "ok"
+		if err := pinger.Ping(ctx); err != nil {
+			health.Storage.Counters = "unavailable"
+			health.Storage.CountersError = err.Error()
+			health.Alerts.Storage = true
+			health.Warnings = append(health.Warnings, "Redis counters are unreachable")
+		}
+	}
+
+	if health.SMTP.FailureRate >= smtpFailureRateWarning {
+		health.Alerts.SMTP = true
+		health.Warnings = append(health.Warnings, "SMTP failure rate is high")
+	}
+	if pool := health.SMTPPool; pool.QueueSize > 0 && pool.Queued >= pool.QueueSize {
+		health.Alerts.SMTP = true
+		health.Warnings = append(health.Warnings, "SMTP send queue is full")
+	}
+	if sends := health.SendAdmission; sends.InFlight >= sends.MaxInFlight && sends.Queued >= sends.MaxQueued {
+		health.Alerts.SMTP = true
+		health.Warnings = append(health.Warnings, "Send requests are being turned away")
+	}
+	if health.NotificationBacklog >= notificationBacklogWarning {
+		health.Alerts.Notifications = true
+		health.Warnings = append(health.Warnings, "Open notifications are backing up")
+	}
+	if health.Queue.PendingRecipients >= queueDepthWarning {
+		health.Alerts.Queue = true
+		health.Warnings = append(health.Warnings, "Outbound campaign queue is deep")
+	}
+	for _, provider := range health.Geo {
+		if provider.FailureRate >= geoFailureRateWarning {
+			health.Alerts.Geo = true
+			health.Warnings = append(health.Warnings, "Geo provider "+provider.Name+" is failing")
+		}
+	}
+	for _, circuit := range health.CircuitBreakers {
+		if circuit.State == breaker.Closed {
+			continue
+		}
+		if circuit.Name == "smtp" {
+			health.Alerts.SMTP = true
+		} else {
+			health.Alerts.Geo = true
+		}
+		health.Warnings = append(health.Warnings, "Circuit breaker for "+circuit.Name+" is open")
+	}
+
+	return health
+}
+
+// circuitBreakers reports the breakers around SMTP and the geo providers
+func (s *Server) circuitBreakers() []breaker.Status {
+	return append([]breaker.Status{s.notifier.Breaker()}, s.tracker.GeoBreakers()...)
+}
+
+func (s *Server) getSystemHealth(c *gin.Context) {
+	c.JSON(http.StatusOK, s.systemHealth(c.Request.Context()))
+}
+
+func (s *Server) getDeliveryStats(c *gin.Context) {
+	c.JSON(http.StatusOK, s.notifier.DeliveryReport())
+}
+
+// lossWarningWindow is how recent a loss must be to be warned about
+const lossWarningWindow = time.Hour
+
+// lossStats counts, since startup, every place data gets dropped instead of
+// blocking: full queues, failed enrichment and writes that didn't land
+type lossStats struct {
+	tracker.LossStats
+	LiveEventsDropped   utils.LossCount  `json:"live_events_dropped"`
+	CounterWritesFailed *utils.LossCount `json:"counter_writes_failed,omitempty"`
+	AuditWritesFailed   utils.LossCount  `json:"audit_writes_failed"`
+	WebhooksFailed      utils.LossCount  `json:"webhook_deliveries_failed"`
+}
+
+func (s *Server) lossStats() lossStats {
+	stats := lossStats{
+		LossStats:         s.tracker.LossStats(),
+		LiveEventsDropped: s.events.Dropped(),
+		AuditWritesFailed: s.auditFailures.Snapshot(),
+		WebhooksFailed:    s.webhooks.Failed(),
+	}
+	if redis, ok := s.counters.(interface{ WriteFailures() utils.LossCount }); ok {
+		failures := redis.WriteFailures()
+		stats.CounterWritesFailed = &failures
+	}
+	return stats
+}
+
+// warnings describes the losses seen within lossWarningWindow
+func (stats lossStats) warnings(now time.Time) []string {
+	type check struct {
+		count   utils.LossCount
+		message string
+	}
+	checks := []check{
+		{stats.GeoQueueFull, "opens stored without a location because the geo backfill queue was full"},
+		{stats.GeoLookupFailed, "opens stored without a location because every geo provider failed"},
+		{stats.GeoBackfillExpired, "opens stored without a location because geo quota didn't free up in time"},
+		{stats.NotificationsFailed, "open notifications that failed to send"},
+		{stats.NotificationsDropped, "open notifications dropped because the notification queue was full"},
+		{stats.EventsNotPersisted, "opens that couldn't be written to the event store"},
+		{stats.Evicted, "tracking IDs evicted from memory to stay within tracking.max_entries"},
+		{stats.LiveEventsDropped, "live events dropped for dashboard clients or webhooks that fell behind"},
+		{stats.AuditWritesFailed, "audit entries that couldn't be written to the audit file"},
+		{stats.WebhooksFailed, "webhook deliveries that failed after retrying"},
+	}
+	if stats.CounterWritesFailed != nil {
+		checks = append(checks, check{*stats.CounterWritesFailed, "Redis counter updates lost"})
+	}
+
+	warnings := []string{}
+	since := now.Add(-lossWarningWindow)
+	for _, check := range checks {
+		if check.count.Since(since) {
+			warnings = append(warnings, fmt.Sprintf("%d %s since startup, most recently at %s",
+				check.count.Count, check.message, check.count.LastAt.UTC().Format(time.RFC3339)))
+		}
+	}
+	return warnings
+}
+
+// getStats reports data lost to backpressure, with warnings for anything
+// lost in the last hour.
+func (s *Server) getStats(c *gin.Context) {
+	now := time.Now()
+	stats := s.lossStats()
+	c.JSON(http.StatusOK, gin.H{
+		"loss":       stats,
+		"warnings":   stats.warnings(now),
+		"checked_at": now,
+	})
+}
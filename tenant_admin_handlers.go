@@ -0,0 +1,327 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"email-tracker/audit"
+	"email-tracker/tenants"
+	"email-tracker/tracker"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Health thresholds over a tenant's last day of sends. Rates are only
+// judged once there are enough sends for them to mean something.
+const (
+	healthMinSends     = 20
+	healthFailureRate  = 0.05
+	healthBounceRate   = 0.05
+	healthQuotaWarning = 0.9
+)
+
+// Tenant health statuses
+const (
+	healthOK        = "ok"
+	healthDegraded  = "degraded"
+	healthSuspended = "suspended"
+)
+
+// tenantRequest creates or changes a tenant. Omitted fields are left as
+// they are on changes.
+type tenantRequest struct {
+	ID            string         `json:"id"`
+	Name          *string        `json:"name"`
+	Quota         *tenants.Quota `json:"quota"`
+	RetentionDays *int           `json:"retention_days"`
+	// BillingCustomer is the tenant's Stripe customer ID, "" for none
+	BillingCustomer *string `json:"billing_customer"`
+}
+
+// keyRequest issues a key. Grace is how long rotated keys keep working.
+type keyRequest struct {
+	Name  string `json:"name"`
+	Role  string `json:"role"`
+	Grace string `json:"grace"`
+}
+
+// tenantHealth is a registered tenant with how its sending is going
+type tenantHealth struct {
+	tenants.Tenant
+	Status string   `json:"status"`
+	Issues []string `json:"issues"`
+	// RecipientsToday and RecipientsThisMonth count against the quota
+	RecipientsToday     int               `json:"recipients_today"`
+	RecipientsThisMonth int               `json:"recipients_this_month"`
+	Last24h             *tracker.Activity `json:"last_24h"`
+	OwnSending          bool              `json:"own_sending"`
+	TrackingDomain      string            `json:"tracking_domain,omitempty"`
+}
+
+// healthOf works out a tenant's health from its activity over the last day
+func (s *Server) healthOf(t tenants.Tenant, last24h *tracker.Activity) tenantHealth {
+	if last24h == nil {
+		last24h = &tracker.Activity{}
+	}
+	now := time.Now().UTC()
+	day := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	month := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+	today, thisMonth := s.tracker.RecipientsSent(t.ID, day, month)
+	_, ownSending := s.tenants.Sending(t.ID)
+
+	h := tenantHealth{
+		Tenant:              t,
+		Status:              healthOK,
+		Issues:              []string{},
+		RecipientsToday:     today,
+		RecipientsThisMonth: thisMonth,
+		Last24h:             last24h,
+		OwnSending:          ownSending,
+		TrackingDomain:      s.tenants.TrackingDomain(t.ID),
+	}
+	issue := func(format string, args ...any) {
+		h.Status = healthDegraded
+		h.Issues = append(h.Issues, fmt.Sprintf(format, args...))
+	}
+
+	if sends := last24h.Emails; sends >= healthMinSends {
+		if rate := float64(last24h.Failed) / float64(sends); rate >= healthFailureRate {
+			issue("%.0f%% of sends in the last 24h failed", rate*100)
+		}
+		if rate := float64(last24h.Bounced) / float64(sends); rate >= healthBounceRate {
+			issue("%.0f%% of sends in the last 24h bounced", rate*100)
+		}
+	}
+	if t.Quota.Daily > 0 && float64(today) >= healthQuotaWarning*float64(t.Quota.Daily) {
+		issue("%d of the daily quota of %d recipients used", today, t.Quota.Daily)
+	}
+	if t.Quota.Monthly > 0 && float64(thisMonth) >= healthQuotaWarning*float64(t.Quota.Monthly) {
+		issue("%d of the monthly quota of %d recipients used", thisMonth, t.Quota.Monthly)
+	}
+	if t.Suspended {
+		h.Status = healthSuspended
+	}
+	return h
+}
+
+// listTenants returns the registered tenants with their health.
+func (s *Server) listTenants(c *gin.Context) {
+	activity := s.tracker.TenantActivity(time.Now().Add(-24 * time.Hour))
+	list := []tenantHealth{}
+	for _, t := range s.tenants.Tenants() {
+		list = append(list, s.healthOf(t, activity[t.ID]))
+	}
+	c.JSON(http.StatusOK, gin.H{"tenants": list})
+}
+
+// getTenant returns a registered tenant with its health.
+func (s *Server) getTenant(c *gin.Context) {
+	t, ok := s.tenants.Tenant(c.Param("tenant"))
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Tenant not found"})
+		return
+	}
+	activity := s.tracker.TenantActivity(time.Now().Add(-24 * time.Hour))
+	c.JSON(http.StatusOK, s.healthOf(t, activity[t.ID]))
+}
+
+// createTenant registers a tenant, with no limits unless given.
+func (s *Server) createTenant(c *gin.Context) {
+	var req tenantRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		bindError(c, err)
+		return
+	}
+	var name string
+	var quota tenants.Quota
+	var retentionDays int
+	if req.Name != nil {
+		name = *req.Name
+	}
+	if req.Quota != nil {
+		quota = *req.Quota
+	}
+	if req.RetentionDays != nil {
+		retentionDays = *req.RetentionDays
+	}
+	if req.BillingCustomer != nil && !s.tenantSaved(c, tenants.ValidateBillingCustomer(*req.BillingCustomer)) {
+		return
+	}
+
+	t, err := s.tenants.CreateTenant(req.ID, name, quota, retentionDays)
+	if !s.tenantSaved(c, err) {
+		return
+	}
+	if req.BillingCustomer != nil && *req.BillingCustomer != "" {
+		if t, err = s.tenants.SetBillingCustomer(t.ID, *req.BillingCustomer); !s.tenantSaved(c, err) {
+			return
+		}
+	}
+	s.recordAudit(c, audit.ActionTenantCreate, t.ID, limitDetails(t))
+	c.JSON(http.StatusCreated, t)
+}
+
+// updateTenant changes a tenant's name, quota or retention. A new retention
+// also applies to the emails it already sent that were kept as long as
+// the tenant's.
+func (s *Server) updateTenant(c *gin.Context) {
+	var req tenantRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		bindError(c, err)
+		return
+	}
+	current, ok := s.tenants.Tenant(c.Param("tenant"))
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Tenant not found"})
+		return
+	}
+	if req.Name != nil {
+		current.Name = *req.Name
+	}
+	if req.Quota != nil {
+		current.Quota = *req.Quota
+	}
+	if req.RetentionDays != nil {
+		current.RetentionDays = *req.RetentionDays
+	}
+	if req.BillingCustomer != nil && !s.tenantSaved(c, tenants.ValidateBillingCustomer(*req.BillingCustomer)) {
+		return
+	}
+
+	before, t, err := s.tenants.UpdateTenant(current.ID, current.Name, current.Quota, current.RetentionDays)
+	if !s.tenantSaved(c, err) {
+		return
+	}
+	if req.BillingCustomer != nil && *req.BillingCustomer != t.BillingCustomer {
+		if t, err = s.tenants.SetBillingCustomer(t.ID, *req.BillingCustomer); !s.tenantSaved(c, err) {
+			return
+		}
+	}
+	updated := s.tracker.SetTenantRetention(t.ID, before.RetentionDays, t.RetentionDays)
+	details := limitDetails(t)
+	details["emails_updated"] = strconv.Itoa(updated)
+	s.recordAudit(c, audit.ActionTenantUpdate, t.ID, details)
+	c.JSON(http.StatusOK, gin.H{"tenant": t, "emails_updated": updated})
+}
+
+// suspendTenant locks a tenant out and stops its sends.
+func (s *Server) suspendTenant(c *gin.Context) {
+	var req struct {
+		Reason string `json:"reason"`
+	}
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			bindError(c, err)
+			return
+		}
+	}
+
+	t, err := s.tenants.Suspend(c.Param("tenant"), req.Reason)
+	if !s.tenantSaved(c, err) {
+		return
+	}
+	s.recordAudit(c, audit.ActionTenantSuspend, t.ID, map[string]string{"reason": req.Reason})
+	c.JSON(http.StatusOK, t)
+}
+
+// resumeTenant lifts a suspension.
+func (s *Server) resumeTenant(c *gin.Context) {
+	t, err := s.tenants.Resume(c.Param("tenant"))
+	if !s.tenantSaved(c, err) {
+		return
+	}
+	s.recordAudit(c, audit.ActionTenantResume, t.ID, nil)
+	c.JSON(http.StatusOK, t)
+}
+
+// issueKey issues another API key to a tenant. The key is only shown in
+// this response.
+func (s *Server) issueKey(c *gin.Context) {
+	var req keyRequest
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			bindError(c, err)
+			return
+		}
+	}
+
+	key, secret, err := s.tenants.IssueKey(c.Param("tenant"), req.Name, req.Role)
+	if !s.tenantSaved(c, err) {
+		return
+	}
+	s.recordAudit(c, audit.ActionKeyIssue, key.Tenant, map[string]string{"key_id": key.ID, "name": key.Name, "role": key.Role})
+	c.JSON(http.StatusCreated, gin.H{"api_key": key, "key": secret})
+}
+
+// rotateKeys issues a new API key to a tenant and retires its others,
+// after the grace period when one is given.
+func (s *Server) rotateKeys(c *gin.Context) {
+	var req keyRequest
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			bindError(c, err)
+			return
+		}
+	}
+	var grace time.Duration
+	if req.Grace != "" {
+		var err error
+		if grace, err = time.ParseDuration(req.Grace); err != nil || grace < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "grace must be a duration like 24h"})
+			return
+		}
+	}
+
+	key, secret, err := s.tenants.RotateKeys(c.Param("tenant"), req.Name, req.Role, grace)
+	if !s.tenantSaved(c, err) {
+		return
+	}
+	s.recordAudit(c, audit.ActionKeyRotate, key.Tenant, map[string]string{"key_id": key.ID, "grace": grace.String()})
+	c.JSON(http.StatusCreated, gin.H{"api_key": key, "key": secret})
+}
+
+// revokeKey deletes one of a tenant's API keys at once.
+func (s *Server) revokeKey(c *gin.Context) {
+	tenant, keyID := c.Param("tenant"), c.Param("key")
+	ok, err := s.tenants.RevokeKey(tenant, keyID)
+	if err != nil {
+		s.serverError(c, http.StatusInternalServerError, "failed to save the tenants file", err)
+		return
+	}
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "API key not found"})
+		return
+	}
+	s.recordAudit(c, audit.ActionKeyRevoke, tenant, map[string]string{"key_id": keyID})
+	c.Status(http.StatusNoContent)
+}
+
+// tenantSaved answers for a registry change that failed, and reports
+// whether it succeeded.
+func (s *Server) tenantSaved(c *gin.Context, err error) bool {
+	switch {
+	case err == nil:
+		return true
+	case errors.Is(err, tenants.ErrInvalid):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	case errors.Is(err, tenants.ErrUnknownTenant):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Tenant not found"})
+	case errors.Is(err, tenants.ErrTenantExists):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	default:
+		s.serverError(c, http.StatusInternalServerError, "failed to save the tenants file", err)
+	}
+	return false
+}
+
+func limitDetails(t tenants.Tenant) map[string]string {
+	return map[string]string{
+		"daily_quota":      strconv.Itoa(t.Quota.Daily),
+		"monthly_quota":    strconv.Itoa(t.Quota.Monthly),
+		"retention_days":   strconv.Itoa(t.RetentionDays),
+		"billing_customer": t.BillingCustomer,
+	}
+}
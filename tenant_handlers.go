@@ -0,0 +1,365 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"email-tracker/audit"
+	"email-tracker/models"
+	"email-tracker/tenants"
+	"email-tracker/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+// sendingRequest is a tenant's sending settings as sent to the API. An
+// omitted password or DKIM key keeps the one set before.
+type sendingRequest struct {
+	SMTPHost     string `json:"smtp_host"`
+	SMTPPort     int    `json:"smtp_port"`
+	SMTPUsername string `json:"smtp_username"`
+	SMTPPassword string `json:"smtp_password"`
+	From         string `json:"from"`
+	DKIMDomain   string `json:"dkim_domain"`
+	DKIMSelector string `json:"dkim_selector"`
+	DKIMKey      string `json:"dkim_key"`
+}
+
+// getSending returns the tenant's own sending settings, without the SMTP
+// password and DKIM key, and with the DNS record the DKIM key needs.
+func (s *Server) getSending(c *gin.Context) {
+	sending, ok := s.tenants.Sending(currentTenant(c))
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Tenant sends through the configured SMTP server"})
+		return
+	}
+	c.JSON(http.StatusOK, sending)
+}
+
+// setSending replaces the tenant's sending settings. Passwords and keys are
+// only accepted when they can be stored encrypted.
+func (s *Server) setSending(c *gin.Context) {
+	var req sendingRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		bindError(c, err)
+		return
+	}
+
+	tenant := currentTenant(c)
+	sending, err := s.tenants.SetSending(tenant, tenants.Sending{
+		SMTPHost:     req.SMTPHost,
+		SMTPPort:     req.SMTPPort,
+		SMTPUsername: req.SMTPUsername,
+		SMTPPassword: req.SMTPPassword,
+		From:         req.From,
+		DKIMDomain:   req.DKIMDomain,
+		DKIMSelector: req.DKIMSelector,
+		DKIMKey:      req.DKIMKey,
+	})
+	switch {
+	case errors.Is(err, tenants.ErrInvalid):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	case errors.Is(err, tenants.ErrNoSecretKey):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	case err != nil:
+		s.serverError(c, http.StatusInternalServerError, "failed to save the tenants file", err)
+		return
+	}
+	s.recordAudit(c, audit.ActionSendingUpdate, tenant, map[string]string{
+		"smtp_host":   sending.SMTPHost,
+		"from":        sending.From,
+		"dkim_domain": sending.DKIMDomain,
+	})
+	c.JSON(http.StatusOK, sending)
+}
+
+// deleteSending drops the tenant's sending settings, so its mail goes
+// through the configured SMTP server again.
+func (s *Server) deleteSending(c *gin.Context) {
+	tenant := currentTenant(c)
+	ok, err := s.tenants.RemoveSending(tenant)
+	if err != nil {
+		s.serverError(c, http.StatusInternalServerError, "failed to save the tenants file", err)
+		return
+	}
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Tenant sends through the configured SMTP server"})
+		return
+	}
+	s.recordAudit(c, audit.ActionSendingRemove, tenant, nil)
+	c.Status(http.StatusNoContent)
+}
+
+// listDomains returns the tenant's tracking domains, with the TXT record
+// each needs to be verified.
+func (s *Server) listDomains(c *gin.Context) {
+	tenant := currentTenant(c)
+	c.JSON(http.StatusOK, gin.H{
+		"domains":         s.tenants.Domains(tenant),
+		"tracking_domain": s.tenants.TrackingDomain(tenant),
+	})
+}
+
+// addDomain adds a tracking domain for the tenant, to be verified once its
+// TXT record is published.
+func (s *Server) addDomain(c *gin.Context) {
+	var req struct {
+		Domain string `json:"domain" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		bindError(c, err)
+		return
+	}
+
+	tenant := currentTenant(c)
+	domain, err := s.tenants.AddDomain(tenant, req.Domain)
+	switch {
+	case errors.Is(err, tenants.ErrInvalid):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	case errors.Is(err, tenants.ErrDomainTaken):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	case err != nil:
+		s.serverError(c, http.StatusInternalServerError, "failed to save the tenants file", err)
+		return
+	}
+	s.recordAudit(c, audit.ActionDomainAdd, domain.Name, nil)
+	c.JSON(http.StatusCreated, domain)
+}
+
+// verifyDomain checks the domain's TXT record and, when it holds the
+// tenant's token, lets tracking links use the domain.
+func (s *Server) verifyDomain(c *gin.Context) {
+	tenant := currentTenant(c)
+	domain, err := s.tenants.VerifyDomain(c.Request.Context(), tenant, c.Param("domain"))
+	switch {
+	case errors.Is(err, tenants.ErrInvalid), errors.Is(err, tenants.ErrUnknownDomain):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Domain not found"})
+		return
+	case errors.Is(err, tenants.ErrDomainTaken):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	case errors.Is(err, tenants.ErrUnverified):
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+		return
+	case err != nil:
+		s.serverError(c, http.StatusInternalServerError, "failed to save the tenants file", err)
+		return
+	}
+	s.recordAudit(c, audit.ActionDomainVerify, domain.Name, nil)
+	c.JSON(http.StatusOK, domain)
+}
+
+// deleteDomain drops a tracking domain of the tenant. Links already sent
+// keep pointing at it, so it should keep resolving to the service for a
+// while.
+func (s *Server) deleteDomain(c *gin.Context) {
+	domain := c.Param("domain")
+	ok, err := s.tenants.RemoveDomain(currentTenant(c), domain)
+	if err != nil {
+		s.serverError(c, http.StatusInternalServerError, "failed to save the tenants file", err)
+		return
+	}
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Domain not found"})
+		return
+	}
+	s.recordAudit(c, audit.ActionDomainRemove, domain, nil)
+	c.Status(http.StatusNoContent)
+}
+
+// listWebhooks returns the tenant's webhooks, without their secrets, and
+// how deliveries to them went since startup.
+func (s *Server) listWebhooks(c *gin.Context) {
+	tenant := currentTenant(c)
+	c.JSON(http.StatusOK, gin.H{
+		"webhooks":   s.tenants.Webhooks(tenant),
+		"deliveries": s.webhooks.TenantStats(tenant),
+	})
+}
+
+// addWebhook subscribes an endpoint to the tenant's opens and clicks,
+// starting right away. The signing secret is only returned here.
+func (s *Server) addWebhook(c *gin.Context) {
+	var req struct {
+		Name   string   `json:"name" binding:"required"`
+		URL    string   `json:"url" binding:"required"`
+		Events []string `json:"events"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		bindError(c, err)
+		return
+	}
+
+	tenant := currentTenant(c)
+	webhook, err := s.tenants.AddWebhook(tenant, tenants.Webhook{Name: req.Name, URL: req.URL, Events: req.Events})
+	switch {
+	case errors.Is(err, tenants.ErrInvalid):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	case errors.Is(err, tenants.ErrWebhookExists), errors.Is(err, tenants.ErrNoSecretKey):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	case err != nil:
+		s.serverError(c, http.StatusInternalServerError, "failed to save the tenants file", err)
+		return
+	}
+	s.webhooks.Add(tenant, webhook.Name, webhook.URL, webhook.Secret, webhook.Events)
+	s.recordAudit(c, audit.ActionWebhookAdd, webhook.Name, map[string]string{
+		"url": utils.RedactURL(webhook.URL),
+	})
+	c.JSON(http.StatusCreated, gin.H{
+		"webhook": webhook,
+		"secret":  webhook.Secret,
+	})
+}
+
+// deleteWebhook stops delivering to one of the tenant's webhooks.
+func (s *Server) deleteWebhook(c *gin.Context) {
+	tenant, name := currentTenant(c), c.Param("name")
+	ok, err := s.tenants.RemoveWebhook(tenant, name)
+	if err != nil {
+		s.serverError(c, http.StatusInternalServerError, "failed to save the tenants file", err)
+		return
+	}
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Webhook not found"})
+		return
+	}
+	s.webhooks.Remove(tenant, name)
+	s.recordAudit(c, audit.ActionWebhookRemove, name, nil)
+	c.Status(http.StatusNoContent)
+}
+
+// getNotifications returns where the tenant's open notifications and
+// digests go.
+func (s *Server) getNotifications(c *gin.Context) {
+	notifications, ok := s.tenants.Notifications(currentTenant(c))
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Tenant has no notification settings"})
+		return
+	}
+	c.JSON(http.StatusOK, notifications)
+}
+
+// setNotifications replaces where the tenant's open notifications and
+// digests go.
+func (s *Server) setNotifications(c *gin.Context) {
+	var req struct {
+		OpenEmails       []string `json:"open_emails"`
+		DigestFrequency  string   `json:"digest_frequency"`
+		DigestRecipients []string `json:"digest_recipients"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		bindError(c, err)
+		return
+	}
+
+	tenant := currentTenant(c)
+	notifications, err := s.tenants.SetNotifications(tenant, tenants.Notifications{
+		OpenEmails:       req.OpenEmails,
+		DigestFrequency:  req.DigestFrequency,
+		DigestRecipients: req.DigestRecipients,
+	})
+	switch {
+	case errors.Is(err, tenants.ErrInvalid):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	case err != nil:
+		s.serverError(c, http.StatusInternalServerError, "failed to save the tenants file", err)
+		return
+	}
+	s.recordAudit(c, audit.ActionNotifyUpdate, tenant, map[string]string{
+		"open_emails":       strconv.Itoa(len(notifications.OpenEmails)),
+		"digest_frequency":  notifications.DigestFrequency,
+		"digest_recipients": strconv.Itoa(len(notifications.DigestRecipients)),
+	})
+	c.JSON(http.StatusOK, notifications)
+}
+
+// deleteNotifications drops the tenant's notification settings, so opens
+// only notify the addresses sends name and no digest is sent.
+func (s *Server) deleteNotifications(c *gin.Context) {
+	tenant := currentTenant(c)
+	ok, err := s.tenants.RemoveNotifications(tenant)
+	if err != nil {
+		s.serverError(c, http.StatusInternalServerError, "failed to save the tenants file", err)
+		return
+	}
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Tenant has no notification settings"})
+		return
+	}
+	s.recordAudit(c, audit.ActionNotifyRemove, tenant, nil)
+	c.Status(http.StatusNoContent)
+}
+
+// getBranding returns the name, logo and colors of the tenant's dashboard
+// and notifications.
+func (s *Server) getBranding(c *gin.Context) {
+	branding, ok := s.tenants.Branding(currentTenant(c))
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Tenant has no branding"})
+		return
+	}
+	c.JSON(http.StatusOK, branding)
+}
+
+// setBranding replaces the name, logo and colors of the tenant's dashboard
+// and notifications.
+func (s *Server) setBranding(c *gin.Context) {
+	var req struct {
+		Name         string `json:"name"`
+		LogoURL      string `json:"logo_url"`
+		PrimaryColor string `json:"primary_color"`
+		AccentColor  string `json:"accent_color"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		bindError(c, err)
+		return
+	}
+
+	tenant := currentTenant(c)
+	branding, err := s.tenants.SetBranding(tenant, models.Branding{
+		Name:         req.Name,
+		LogoURL:      req.LogoURL,
+		PrimaryColor: req.PrimaryColor,
+		AccentColor:  req.AccentColor,
+	})
+	switch {
+	case errors.Is(err, tenants.ErrInvalid):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	case err != nil:
+		s.serverError(c, http.StatusInternalServerError, "failed to save the tenants file", err)
+		return
+	}
+	s.recordAudit(c, audit.ActionBrandingUpdate, tenant, map[string]string{
+		"name":          branding.Name,
+		"logo_url":      branding.LogoURL,
+		"primary_color": branding.PrimaryColor,
+		"accent_color":  branding.AccentColor,
+	})
+	c.JSON(http.StatusOK, branding)
+}
+
+// deleteBranding puts the tenant's dashboard and notifications back on the
+// service's own look.
+func (s *Server) deleteBranding(c *gin.Context) {
+	tenant := currentTenant(c)
+	ok, err := s.tenants.RemoveBranding(tenant)
+	if err != nil {
+		s.serverError(c, http.StatusInternalServerError, "failed to save the tenants file", err)
+		return
+	}
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Tenant has no branding"})
+		return
+	}
+	s.recordAudit(c, audit.ActionBrandingRemove, tenant, nil)
+	c.Status(http.StatusNoContent)
+}
@@ -0,0 +1,99 @@
+package tenants
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"email-tracker/models"
+)
+
+const (
+	maxBrandName  = 80
+	maxLogoURLLen = 2048
+)
+
+var colorPattern = regexp.MustCompile(`^#[0-9a-fA-F]{6}$`)
+
+// applyBranding makes a branding change take effect. Must be called with
+// s.mu held, or before the store is shared.
+func (s *Store) applyBranding(c change) {
+	t := s.tenant(c.Tenant)
+	if c.Branding == nil {
+		t.branding = nil
+		return
+	}
+	b := *c.Branding
+	t.branding = &b
+}
+
+// Branding returns how the tenant's dashboard and notifications look, if
+// it set that.
+func (s *Store) Branding(tenantID string) (models.Branding, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	t, ok := s.tenants[models.TenantOr(tenantID)]
+	if !ok || t.branding == nil {
+		return models.Branding{}, false
+	}
+	return *t.branding, true
+}
+
+// SetBranding replaces the tenant's branding.
+func (s *Store) SetBranding(tenantID string, b models.Branding) (models.Branding, error) {
+	tenantID = models.TenantOr(tenantID)
+	b.Name = strings.TrimSpace(b.Name)
+	b.LogoURL = strings.TrimSpace(b.LogoURL)
+	b.PrimaryColor = strings.ToLower(b.PrimaryColor)
+	b.AccentColor = strings.ToLower(b.AccentColor)
+	if err := validateBranding(b); err != nil {
+		return models.Branding{}, err
+	}
+	b.UpdatedAt = time.Now().UTC()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return b, s.commit(change{Op: opSetBranding, Tenant: tenantID, Branding: &b})
+}
+
+// RemoveBranding puts the tenant back on the service's own look,
+// reporting whether it had branding.
+func (s *Store) RemoveBranding(tenantID string) (bool, error) {
+	tenantID = models.TenantOr(tenantID)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if t, ok := s.tenants[tenantID]; !ok || t.branding == nil {
+		return false, nil
+	}
+	return true, s.commit(change{Op: opSetBranding, Tenant: tenantID})
+}
+
+// validateBranding keeps to what is safe to put in the dashboard's styles
+// and in emails: plain hex colors and an https logo, which mail clients
+// load without warnings.
+func validateBranding(b models.Branding) error {
+	if utf8.RuneCountInString(b.Name) > maxBrandName {
+		return fmt.Errorf("%w: name can be up to %d characters", ErrInvalid, maxBrandName)
+	}
+	if strings.ContainsFunc(b.Name, func(r rune) bool { return r < ' ' }) {
+		return fmt.Errorf("%w: name can't contain control characters", ErrInvalid)
+	}
+	if b.LogoURL != "" {
+		u, err := url.Parse(b.LogoURL)
+		if err != nil || u.Scheme != "https" || u.Host == "" || len(b.LogoURL) > maxLogoURLLen {
+			return fmt.Errorf("%w: logo_url must be an absolute https URL", ErrInvalid)
+		}
+	}
+	for field, color := range map[string]string{"primary_color": b.PrimaryColor, "accent_color": b.AccentColor} {
+		if color != "" && !colorPattern.MatchString(color) {
+			return fmt.Errorf("%w: %s must be a color like #667eea", ErrInvalid, field)
+		}
+	}
+	return nil
+}
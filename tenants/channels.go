@@ -0,0 +1,290 @@
+package tenants
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
+	"slices"
+	"sort"
+	"time"
+
+	"email-tracker/events"
+	"email-tracker/models"
+	"email-tracker/utils"
+)
+
+// ErrWebhookExists is returned when adding a webhook under a name the
+// tenant already uses
+var ErrWebhookExists = errors.New("tenant already has a webhook of that name")
+
+// maxWebhooks caps the webhooks of one tenant, each of which gets every
+// one of its events
+const maxWebhooks = 10
+
+// secretPrefix starts every webhook signing secret generated here
+const secretPrefix = "whsec_"
+
+// Digest frequencies, as for the operator's reports
+const (
+	DigestWeekly  = "weekly"
+	DigestMonthly = "monthly"
+)
+
+var webhookNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,62}$`)
+
+// Webhook is an endpoint a tenant gets its opens and clicks at, signed with
+// a secret of its own. The secret is only shown when the webhook is added.
+type Webhook struct {
+	Name string `json:"name"`
+	URL  string `json:"url"`
+	// Events are the types delivered, open and click; all when empty
+	Events    []string  `json:"events"`
+	Secret    string    `json:"-"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// sealedWebhook is Webhook as written to the file, with the secret
+// age-encrypted
+type sealedWebhook struct {
+	Name      string    `json:"name"`
+	URL       string    `json:"url,omitempty"`
+	Events    []string  `json:"events,omitempty"`
+	Secret    string    `json:"secret,omitempty"`
+	CreatedAt time.Time `json:"created_at,omitzero"`
+}
+
+// Notifications is where a tenant's notifications go. Open notifications
+// for sends that ask for one without a notify_email go to OpenEmails, and
+// a digest of the tenant's sends goes to DigestRecipients every week or
+// month.
+type Notifications struct {
+	OpenEmails       []string  `json:"open_emails"`
+	DigestFrequency  string    `json:"digest_frequency,omitempty"`
+	DigestRecipients []string  `json:"digest_recipients"`
+	UpdatedAt        time.Time `json:"updated_at"`
+}
+
+// Digest is a tenant's scheduled digest
+type Digest struct {
+	Tenant     string
+	Frequency  string
+	Recipients []string
+}
+
+// applyChannels makes a webhook or notifications change take effect. Must
+// be called with s.mu held, or before the store is shared.
+func (s *Store) applyChannels(c change) error {
+	t := s.tenant(c.Tenant)
+	switch c.Op {
+	case opSetWebhook, opRemoveWebhook:
+		if c.Webhook == nil {
+			return errors.New("webhook missing")
+		}
+		if c.Op == opRemoveWebhook {
+			delete(t.webhooks, c.Webhook.Name)
+			return nil
+		}
+		secret, err := s.decrypt(c.Webhook.Secret)
+		if err != nil {
+			return fmt.Errorf("webhook secret: %w", err)
+		}
+		t.webhooks[c.Webhook.Name] = &Webhook{
+			Name:      c.Webhook.Name,
+			URL:       c.Webhook.URL,
+			Events:    slices.Clone(c.Webhook.Events),
+			Secret:    secret,
+			CreatedAt: c.Webhook.CreatedAt,
+		}
+	case opSetNotifications:
+		if c.Notifications == nil {
+			t.notifications = nil
+			return nil
+		}
+		n := *c.Notifications
+		t.notifications = &n
+	}
+	return nil
+}
+
+// Webhooks returns the tenant's webhooks by name, without their secrets.
+func (s *Store) Webhooks(tenantID string) []Webhook {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	webhooks := []Webhook{}
+	if t, ok := s.tenants[models.TenantOr(tenantID)]; ok {
+		for _, w := range t.webhooks {
+			webhook := *w
+			webhook.Secret = ""
+			webhooks = append(webhooks, webhook)
+		}
+	}
+	sort.Slice(webhooks, func(i, j int) bool { return webhooks[i].Name < webhooks[j].Name })
+	return webhooks
+}
+
+// AllWebhooks returns every tenant's webhooks, secrets included, for
+// delivery.
+func (s *Store) AllWebhooks() map[string][]Webhook {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	all := make(map[string][]Webhook)
+	for id, t := range s.tenants {
+		for _, w := range t.webhooks {
+			all[id] = append(all[id], *w)
+		}
+	}
+	return all
+}
+
+// AddWebhook subscribes an endpoint to the tenant's events, with a new
+// signing secret that is returned along with it. The secret is stored
+// encrypted, so it needs TENANTS_SECRET_KEY.
+func (s *Store) AddWebhook(tenantID string, webhook Webhook) (Webhook, error) {
+	tenantID = models.TenantOr(tenantID)
+	if err := validateWebhook(webhook); err != nil {
+		return Webhook{}, err
+	}
+
+	secret := make([]byte, 24)
+	if _, err := rand.Read(secret); err != nil {
+		return Webhook{}, fmt.Errorf("generate webhook secret: %w", err)
+	}
+	webhook.Secret = secretPrefix + base64.RawURLEncoding.EncodeToString(secret)
+	webhook.CreatedAt = time.Now().UTC()
+	if webhook.Events == nil {
+		webhook.Events = []string{}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t := s.tenant(tenantID)
+	if _, ok := t.webhooks[webhook.Name]; ok {
+		return Webhook{}, ErrWebhookExists
+	}
+	if len(t.webhooks) >= maxWebhooks {
+		return Webhook{}, fmt.Errorf("%w: a tenant can have up to %d webhooks", ErrInvalid, maxWebhooks)
+	}
+	sealed := &sealedWebhook{Name: webhook.Name, URL: webhook.URL, Events: webhook.Events, CreatedAt: webhook.CreatedAt}
+	var err error
+	if sealed.Secret, err = s.encrypt(webhook.Secret); err != nil {
+		return Webhook{}, err
+	}
+
+	stored := webhook
+	t.webhooks[webhook.Name] = &stored
+	return webhook, s.write(change{Op: opSetWebhook, Tenant: tenantID, Webhook: sealed})
+}
+
+// RemoveWebhook drops one of the tenant's webhooks, reporting whether it
+// had it.
+func (s *Store) RemoveWebhook(tenantID, name string) (bool, error) {
+	tenantID = models.TenantOr(tenantID)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t, ok := s.tenants[tenantID]
+	if !ok || t.webhooks[name] == nil {
+		return false, nil
+	}
+	return true, s.commit(change{Op: opRemoveWebhook, Tenant: tenantID, Webhook: &sealedWebhook{Name: name}})
+}
+
+// Notifications returns where the tenant's notifications go, if it set
+// that.
+func (s *Store) Notifications(tenantID string) (Notifications, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	t, ok := s.tenants[models.TenantOr(tenantID)]
+	if !ok || t.notifications == nil {
+		return Notifications{}, false
+	}
+	return *t.notifications, true
+}
+
+// SetNotifications replaces where the tenant's notifications go.
+func (s *Store) SetNotifications(tenantID string, n Notifications) (Notifications, error) {
+	tenantID = models.TenantOr(tenantID)
+	if n.OpenEmails == nil {
+		n.OpenEmails = []string{}
+	}
+	if n.DigestRecipients == nil {
+		n.DigestRecipients = []string{}
+	}
+	for _, address := range slices.Concat(n.OpenEmails, n.DigestRecipients) {
+		if !utils.ValidateEmail(address) {
+			return Notifications{}, fmt.Errorf("%w: %q is not an email address", ErrInvalid, address)
+		}
+	}
+	switch n.DigestFrequency {
+	case "", DigestWeekly, DigestMonthly:
+	default:
+		return Notifications{}, fmt.Errorf("%w: digest_frequency must be weekly or monthly", ErrInvalid)
+	}
+	if n.DigestFrequency != "" && len(n.DigestRecipients) == 0 {
+		return Notifications{}, fmt.Errorf("%w: a digest needs digest_recipients", ErrInvalid)
+	}
+	n.UpdatedAt = time.Now().UTC()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return n, s.commit(change{Op: opSetNotifications, Tenant: tenantID, Notifications: &n})
+}
+
+// RemoveNotifications drops the tenant's notification settings, reporting
+// whether it had any.
+func (s *Store) RemoveNotifications(tenantID string) (bool, error) {
+	tenantID = models.TenantOr(tenantID)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if t, ok := s.tenants[tenantID]; !ok || t.notifications == nil {
+		return false, nil
+	}
+	return true, s.commit(change{Op: opSetNotifications, Tenant: tenantID})
+}
+
+// OpenRecipients returns where the tenant's open notifications go when a
+// send doesn't say.
+func (s *Store) OpenRecipients(tenantID string) []string {
+	n, _ := s.Notifications(tenantID)
+	return n.OpenEmails
+}
+
+// Digests returns the digests tenants asked for.
+func (s *Store) Digests() []Digest {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var digests []Digest
+	for id, t := range s.tenants {
+		if n := t.notifications; n != nil && n.DigestFrequency != "" {
+			digests = append(digests, Digest{Tenant: id, Frequency: n.DigestFrequency, Recipients: slices.Clone(n.DigestRecipients)})
+		}
+	}
+	return digests
+}
+
+func validateWebhook(webhook Webhook) error {
+	if !webhookNamePattern.MatchString(webhook.Name) {
+		return fmt.Errorf("%w: name must be lowercase letters, digits, - and _", ErrInvalid)
+	}
+	u, err := url.Parse(webhook.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("%w: url must be an absolute http(s) URL", ErrInvalid)
+	}
+	for _, event := range webhook.Events {
+		if event != events.TypeOpen && event != events.TypeClick {
+			return fmt.Errorf("%w: events can be open and click", ErrInvalid)
+		}
+	}
+	return nil
+}
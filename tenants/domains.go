@@ -0,0 +1,288 @@
+package tenants
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"email-tracker/models"
+)
+
+// ErrDomainTaken is returned for a domain another tenant has verified
+var ErrDomainTaken = errors.New("domain is verified by another tenant")
+
+// ErrUnknownDomain is returned for a domain the tenant hasn't added
+var ErrUnknownDomain = errors.New("domain not added")
+
+// ErrUnverified matches, via errors.Is, verifications whose DNS record
+// wasn't found
+var ErrUnverified = errors.New("verification record not found")
+
+// challengePrefix and challengeValue make the TXT record proving a
+// tenant controls a domain
+const (
+	challengePrefix = "_email-tracker."
+	challengeValue  = "email-tracker-verification="
+)
+
+// Resolver is the DNS lookup verification needs; *net.Resolver has it
+type Resolver interface {
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+}
+
+// Domain is a tracking domain of a tenant, with the TXT record that
+// verifies it. Tracking links only use verified domains.
+type Domain struct {
+	Name        string     `json:"name"`
+	Verified    bool       `json:"verified"`
+	AddedAt     time.Time  `json:"added_at"`
+	VerifiedAt  *time.Time `json:"verified_at,omitempty"`
+	RecordName  string     `json:"record_name"`
+	RecordValue string     `json:"record_value"`
+}
+
+// domainRecord is a domain as held and written to the file
+type domainRecord struct {
+	Name       string     `json:"name"`
+	Token      string     `json:"token,omitempty"`
+	AddedAt    time.Time  `json:"added_at,omitzero"`
+	VerifiedAt *time.Time `json:"verified_at,omitempty"`
+}
+
+func (d *domainRecord) view() Domain {
+	return Domain{
+		Name:        d.Name,
+		Verified:    d.VerifiedAt != nil,
+		AddedAt:     d.AddedAt,
+		VerifiedAt:  d.VerifiedAt,
+		RecordName:  challengePrefix + d.Name,
+		RecordValue: challengeValue + d.Token,
+	}
+}
+
+// applyDomain makes a domain change take effect. Must be called with s.mu
+// held, or before the store is shared.
+func (s *Store) applyDomain(op, tenantID string, d *domainRecord) {
+	t := s.tenant(tenantID)
+	switch op {
+	case opAddDomain:
+		record := *d
+		t.domains[d.Name] = &record
+	case opVerifyDomain:
+		if record, ok := t.domains[d.Name]; ok {
+			record.VerifiedAt = d.VerifiedAt
+		}
+	case opRemoveDomain:
+		delete(t.domains, d.Name)
+	}
+}
+
+// Domains returns the tenant's tracking domains by name.
+func (s *Store) Domains(tenantID string) []Domain {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	domains := []Domain{}
+	if t, ok := s.tenants[models.TenantOr(tenantID)]; ok {
+		for _, d := range t.domains {
+			domains = append(domains, d.view())
+		}
+	}
+	sort.Slice(domains, func(i, j int) bool { return domains[i].Name < domains[j].Name })
+	return domains
+}
+
+// AddDomain adds a tracking domain for the tenant, unverified, with a new
+// token for its TXT record. Adding a domain again returns it as it is.
+func (s *Store) AddDomain(tenantID, name string) (Domain, error) {
+	tenantID = models.TenantOr(tenantID)
+	name, err := normalizeDomain(name)
+	if err != nil {
+		return Domain{}, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t := s.tenant(tenantID)
+	if d, ok := t.domains[name]; ok {
+		return d.view(), nil
+	}
+	if s.verifiedBy(name) != "" {
+		return Domain{}, ErrDomainTaken
+	}
+
+	token := make([]byte, 16)
+	if _, err := rand.Read(token); err != nil {
+		return Domain{}, fmt.Errorf("generate verification token: %w", err)
+	}
+	d := &domainRecord{Name: name, Token: hex.EncodeToString(token), AddedAt: time.Now().UTC()}
+	c := change{Op: opAddDomain, Tenant: tenantID, Domain: d}
+	s.applyDomain(c.Op, tenantID, d)
+	return d.view(), s.write(c)
+}
+
+// VerifyDomain looks up the domain's TXT record and, when it holds the
+// tenant's token, marks the domain verified. A verified domain stays so;
+// verifying it again checks the record is still there.
+func (s *Store) VerifyDomain(ctx context.Context, tenantID, name string) (Domain, error) {
+	tenantID = models.TenantOr(tenantID)
+	name, err := normalizeDomain(name)
+	if err != nil {
+		return Domain{}, err
+	}
+
+	s.mu.RLock()
+	var token string
+	if t, ok := s.tenants[tenantID]; ok {
+		if d, ok := t.domains[name]; ok {
+			token = d.Token
+		}
+	}
+	s.mu.RUnlock()
+	if token == "" {
+		return Domain{}, ErrUnknownDomain
+	}
+
+	// Looked up without the lock, as DNS can be slow
+	txts, err := s.resolver.LookupTXT(ctx, challengePrefix+name)
+	if err != nil {
+		return Domain{}, fmt.Errorf("%w: looking up %s: %v", ErrUnverified, challengePrefix+name, err)
+	}
+	found := false
+	for _, txt := range txts {
+		if strings.TrimSpace(txt) == challengeValue+token {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return Domain{}, fmt.Errorf("%w: %s has no TXT record %q", ErrUnverified, challengePrefix+name, challengeValue+token)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t, ok := s.tenants[tenantID]
+	if !ok || t.domains[name] == nil || t.domains[name].Token != token {
+		// Removed, or removed and added again, while looking it up
+		return Domain{}, ErrUnknownDomain
+	}
+	d := t.domains[name]
+	if d.VerifiedAt != nil {
+		return d.view(), nil
+	}
+	if owner := s.verifiedBy(name); owner != "" && owner != tenantID {
+		return Domain{}, ErrDomainTaken
+	}
+	now := time.Now().UTC()
+	c := change{Op: opVerifyDomain, Tenant: tenantID, Domain: &domainRecord{Name: name, VerifiedAt: &now}}
+	s.applyDomain(c.Op, tenantID, c.Domain)
+	return d.view(), s.write(c)
+}
+
+// RemoveDomain drops a tracking domain of the tenant, reporting whether it
+// had it. Links already sent keep pointing at it.
+func (s *Store) RemoveDomain(tenantID, name string) (bool, error) {
+	tenantID = models.TenantOr(tenantID)
+	name, err := normalizeDomain(name)
+	if err != nil {
+		return false, nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t, ok := s.tenants[tenantID]
+	if !ok || t.domains[name] == nil {
+		return false, nil
+	}
+	c := change{Op: opRemoveDomain, Tenant: tenantID, Domain: &domainRecord{Name: name}}
+	s.applyDomain(c.Op, tenantID, c.Domain)
+	return true, s.write(c)
+}
+
+// TrackingDomain returns the domain the tenant's tracking links use: the
+// first it verified, or "" when it has none and uses the configured base
+// URL.
+func (s *Store) TrackingDomain(tenantID string) string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	t, ok := s.tenants[models.TenantOr(tenantID)]
+	if !ok {
+		return ""
+	}
+	var first *domainRecord
+	for _, d := range t.domains {
+		if d.VerifiedAt == nil {
+			continue
+		}
+		if first == nil || d.VerifiedAt.Before(*first.VerifiedAt) ||
+			(d.VerifiedAt.Equal(*first.VerifiedAt) && d.Name < first.Name) {
+			first = d
+		}
+	}
+	if first == nil {
+		return ""
+	}
+	return first.Name
+}
+
+// IsVerifiedDomain reports whether a tenant has verified host, for
+// certificates to be issued for it.
+func (s *Store) IsVerifiedDomain(host string) bool {
+	host, err := normalizeDomain(host)
+	if err != nil {
+		return false
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.verifiedBy(host) != ""
+}
+
+// verifiedBy returns the tenant that verified name, if any. Must be called
+// with s.mu held.
+func (s *Store) verifiedBy(name string) string {
+	for id, t := range s.tenants {
+		if d, ok := t.domains[name]; ok && d.VerifiedAt != nil {
+			return id
+		}
+	}
+	return ""
+}
+
+// normalizeDomain lowercases a host name and checks it is one: dot
+// separated labels of letters, digits and hyphens, in at least two labels,
+// with a top level label that isn't numeric so IP addresses are refused.
+func normalizeDomain(name string) (string, error) {
+	name = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(name)), ".")
+	invalid := fmt.Errorf("%w: %q is not a domain name", ErrInvalid, name)
+	if name == "" || len(name) > 253 {
+		return "", invalid
+	}
+
+	labels := strings.Split(name, ".")
+	if len(labels) < 2 {
+		return "", invalid
+	}
+	for _, label := range labels {
+		if label == "" || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return "", invalid
+		}
+		for _, r := range label {
+			if (r < 'a' || r > 'z') && (r < '0' || r > '9') && r != '-' {
+				return "", invalid
+			}
+		}
+	}
+	if strings.Trim(labels[len(labels)-1], "0123456789") == "" {
+		return "", invalid
+	}
+	return name, nil
+}
@@ -0,0 +1,517 @@
+package tenants
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"time"
+
+	"email-tracker/auth"
+	"email-tracker/models"
+)
+
+// ErrTenantExists is returned when creating a tenant that is registered
+var ErrTenantExists = errors.New("tenant already exists")
+
+// ErrUnknownTenant is returned for a tenant that isn't registered
+var ErrUnknownTenant = errors.New("tenant not found")
+
+// ErrSuspended matches, via errors.Is, whatever a suspended tenant is
+// refused
+var ErrSuspended = errors.New("tenant is suspended")
+
+// ErrQuotaExceeded matches, via errors.Is, sends over a tenant's quota
+var ErrQuotaExceeded = errors.New("tenant's send quota is used up")
+
+var billingCustomerPattern = regexp.MustCompile(`^[A-Za-z0-9_]{1,255}$`)
+
+// keyPrefix starts every API key issued here, so leaked ones are easy to
+// search for
+const keyPrefix = "et_"
+
+// Quota limits the recipients a tenant's mail goes to per UTC day and
+// month; 0 is no limit.
+type Quota struct {
+	Daily   int `json:"daily"`
+	Monthly int `json:"monthly"`
+}
+
+// Enabled reports whether q limits anything.
+func (q Quota) Enabled() bool {
+	return q.Daily > 0 || q.Monthly > 0
+}
+
+// Check returns a *QuotaError when sending to n more recipients, after
+// day and month sent today and this month, would go over q.
+func (q Quota) Check(day, month, n int, now time.Time) error {
+	now = now.UTC()
+	if q.Daily > 0 && day+n > q.Daily {
+		return &QuotaError{Period: "daily", Limit: q.Daily, Used: day,
+			ResetAt: time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, time.UTC)}
+	}
+	if q.Monthly > 0 && month+n > q.Monthly {
+		return &QuotaError{Period: "monthly", Limit: q.Monthly, Used: month,
+			ResetAt: time.Date(now.Year(), now.Month()+1, 1, 0, 0, 0, 0, time.UTC)}
+	}
+	return nil
+}
+
+// QuotaError is a send refused for going over a tenant's quota
+type QuotaError struct {
+	Period  string
+	Limit   int
+	Used    int
+	ResetAt time.Time
+}
+
+func (e *QuotaError) Error() string {
+	return fmt.Sprintf("tenant's %s quota of %d recipients is used up (%d sent), it resets at %s",
+		e.Period, e.Limit, e.Used, e.ResetAt.Format(time.RFC3339))
+}
+
+func (e *QuotaError) Is(target error) bool {
+	return target == ErrQuotaExceeded
+}
+
+// Tenant is a tenant registered by the operator, with its limits and the
+// API keys issued to it. Tenants only named in AUTH_TENANTS aren't
+// registered and have no limits.
+type Tenant struct {
+	ID            string     `json:"id"`
+	Name          string     `json:"name,omitempty"`
+	CreatedAt     time.Time  `json:"created_at"`
+	Suspended     bool       `json:"suspended"`
+	SuspendedAt   *time.Time `json:"suspended_at,omitempty"`
+	SuspendReason string     `json:"suspend_reason,omitempty"`
+	Quota         Quota      `json:"quota"`
+	// RetentionDays keeps the tenant's emails this many days unless they
+	// or their campaign have a retention of their own; 0 keeps them as
+	// configured
+	RetentionDays int `json:"retention_days"`
+	// BillingCustomer is the tenant's Stripe customer ID, for its usage to
+	// be reported under
+	BillingCustomer string   `json:"billing_customer,omitempty"`
+	APIKeys         []APIKey `json:"api_keys"`
+}
+
+// APIKey is an API key issued to a tenant, without the key itself
+type APIKey struct {
+	ID        string     `json:"id"`
+	Tenant    string     `json:"tenant"`
+	Name      string     `json:"name"`
+	Role      string     `json:"role"`
+	CreatedAt time.Time  `json:"created_at"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+// profile is a registered tenant as held and written to the file
+type profile struct {
+	Name          string     `json:"name,omitempty"`
+	CreatedAt     time.Time  `json:"created_at"`
+	SuspendedAt   *time.Time `json:"suspended_at,omitempty"`
+	SuspendReason string     `json:"suspend_reason,omitempty"`
+	Quota         Quota      `json:"quota"`
+	RetentionDays int        `json:"retention_days,omitempty"`
+	// BillingCustomer is the tenant's Stripe customer ID
+	BillingCustomer string `json:"billing_customer,omitempty"`
+}
+
+// keyRecord is an issued API key as held and written to the file, with
+// the SHA-256 hash of the key in place of the key
+type keyRecord struct {
+	ID        string     `json:"id"`
+	Name      string     `json:"name,omitempty"`
+	Role      string     `json:"role,omitempty"`
+	Hash      string     `json:"hash,omitempty"`
+	CreatedAt time.Time  `json:"created_at,omitzero"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+func (k *keyRecord) expired(now time.Time) bool {
+	return k.ExpiresAt != nil && !now.Before(*k.ExpiresAt)
+}
+
+// applyRegistry makes a registry change take effect. Must be called with
+// s.mu held, or before the store is shared.
+func (s *Store) applyRegistry(c change) error {
+	t := s.tenant(c.Tenant)
+	switch c.Op {
+	case opSetTenant:
+		if c.Profile == nil {
+			return errors.New("tenant profile missing")
+		}
+		p := *c.Profile
+		t.profile = &p
+	case opAddKey, opExpireKey, opRevokeKey:
+		if c.Key == nil {
+			return errors.New("API key missing")
+		}
+		switch c.Op {
+		case opAddKey:
+			key := *c.Key
+			t.keys[key.ID] = &key
+		case opExpireKey:
+			if key, ok := t.keys[c.Key.ID]; ok {
+				key.ExpiresAt = c.Key.ExpiresAt
+			}
+		case opRevokeKey:
+			delete(t.keys, c.Key.ID)
+		}
+	}
+	return nil
+}
+
+// commit applies c and appends it to the file. Must be called with s.mu
+// held.
+func (s *Store) commit(c change) error {
+	if err := s.apply(c); err != nil {
+		return err
+	}
+	return s.write(c)
+}
+
+// registered returns the tenant when it is registered. Must be called with
+// s.mu held.
+func (s *Store) registered(id string) (*tenant, bool) {
+	t, ok := s.tenants[id]
+	if !ok || t.profile == nil {
+		return nil, false
+	}
+	return t, true
+}
+
+// view is a registered tenant as shown, with its unexpired keys
+func (t *tenant) view(id string, now time.Time) Tenant {
+	p := t.profile
+	view := Tenant{
+		ID:              id,
+		Name:            p.Name,
+		CreatedAt:       p.CreatedAt,
+		Suspended:       p.SuspendedAt != nil,
+		SuspendedAt:     p.SuspendedAt,
+		SuspendReason:   p.SuspendReason,
+		Quota:           p.Quota,
+		RetentionDays:   p.RetentionDays,
+		BillingCustomer: p.BillingCustomer,
+		APIKeys:         []APIKey{},
+	}
+	for _, key := range t.keys {
+		if !key.expired(now) {
+			view.APIKeys = append(view.APIKeys, key.view(id))
+		}
+	}
+	sort.Slice(view.APIKeys, func(i, j int) bool { return view.APIKeys[i].CreatedAt.Before(view.APIKeys[j].CreatedAt) })
+	return view
+}
+
+func (k *keyRecord) view(tenantID string) APIKey {
+	return APIKey{ID: k.ID, Tenant: tenantID, Name: k.Name, Role: k.Role, CreatedAt: k.CreatedAt, ExpiresAt: k.ExpiresAt}
+}
+
+// Tenants returns the registered tenants by ID.
+func (s *Store) Tenants() []Tenant {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	now := time.Now()
+	tenants := []Tenant{}
+	for id, t := range s.tenants {
+		if t.profile != nil {
+			tenants = append(tenants, t.view(id, now))
+		}
+	}
+	sort.Slice(tenants, func(i, j int) bool { return tenants[i].ID < tenants[j].ID })
+	return tenants
+}
+
+// Tenant returns a registered tenant.
+func (s *Store) Tenant(id string) (Tenant, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	t, ok := s.registered(id)
+	if !ok {
+		return Tenant{}, false
+	}
+	return t.view(id, time.Now()), true
+}
+
+// CreateTenant registers a tenant. Its users and API keys are put in it
+// with AUTH_TENANTS, or issued with IssueKey. The default tenant is the
+// operator's and can't be registered.
+func (s *Store) CreateTenant(id, name string, quota Quota, retentionDays int) (Tenant, error) {
+	if !models.ValidTenantID(id) || id == models.DefaultTenant {
+		return Tenant{}, fmt.Errorf("%w: %q is not a tenant ID of lowercase letters, digits, - and _, or is the operator's", ErrInvalid, id)
+	}
+	if err := validateLimits(quota, retentionDays); err != nil {
+		return Tenant{}, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.registered(id); ok {
+		return Tenant{}, ErrTenantExists
+	}
+	p := &profile{Name: name, CreatedAt: time.Now().UTC(), Quota: quota, RetentionDays: retentionDays}
+	if err := s.commit(change{Op: opSetTenant, Tenant: id, Profile: p}); err != nil {
+		return Tenant{}, err
+	}
+	return s.tenants[id].view(id, time.Now()), nil
+}
+
+// UpdateTenant changes a registered tenant's name and limits, returning it
+// as it was and as it is now.
+func (s *Store) UpdateTenant(id, name string, quota Quota, retentionDays int) (Tenant, Tenant, error) {
+	if err := validateLimits(quota, retentionDays); err != nil {
+		return Tenant{}, Tenant{}, err
+	}
+	return s.updateProfile(id, func(p *profile) {
+		p.Name, p.Quota, p.RetentionDays = name, quota, retentionDays
+	})
+}
+
+// SetBillingCustomer sets the Stripe customer a registered tenant's usage
+// is reported under, or stops reporting it for "".
+func (s *Store) SetBillingCustomer(id, customer string) (Tenant, error) {
+	if err := ValidateBillingCustomer(customer); err != nil {
+		return Tenant{}, err
+	}
+	_, t, err := s.updateProfile(id, func(p *profile) {
+		p.BillingCustomer = customer
+	})
+	return t, err
+}
+
+// ValidateBillingCustomer checks a Stripe customer ID, allowing "" for
+// none.
+func ValidateBillingCustomer(customer string) error {
+	if customer != "" && !billingCustomerPattern.MatchString(customer) {
+		return fmt.Errorf("%w: billing_customer must be a Stripe customer ID like cus_...", ErrInvalid)
+	}
+	return nil
+}
+
+// BillingCustomers returns the Stripe customer of each registered tenant
+// that has one.
+func (s *Store) BillingCustomers() map[string]string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	customers := make(map[string]string)
+	for id, t := range s.tenants {
+		if t.profile != nil && t.profile.BillingCustomer != "" {
+			customers[id] = t.profile.BillingCustomer
+		}
+	}
+	return customers
+}
+
+// Suspend stops a registered tenant's users and API keys from reaching
+// anything and its mail, campaigns included, from going out. Its tracking
+// links keep working.
+func (s *Store) Suspend(id, reason string) (Tenant, error) {
+	_, t, err := s.updateProfile(id, func(p *profile) {
+		if p.SuspendedAt == nil {
+			now := time.Now().UTC()
+			p.SuspendedAt = &now
+		}
+		p.SuspendReason = reason
+	})
+	return t, err
+}
+
+// Resume lifts a suspension.
+func (s *Store) Resume(id string) (Tenant, error) {
+	_, t, err := s.updateProfile(id, func(p *profile) {
+		p.SuspendedAt, p.SuspendReason = nil, ""
+	})
+	return t, err
+}
+
+func (s *Store) updateProfile(id string, update func(*profile)) (Tenant, Tenant, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t, ok := s.registered(id)
+	if !ok {
+		return Tenant{}, Tenant{}, ErrUnknownTenant
+	}
+	before := t.view(id, time.Now())
+	p := *t.profile
+	update(&p)
+	if err := s.commit(change{Op: opSetTenant, Tenant: id, Profile: &p}); err != nil {
+		return Tenant{}, Tenant{}, err
+	}
+	return before, t.view(id, time.Now()), nil
+}
+
+// CheckActive returns ErrSuspended for a suspended tenant.
+func (s *Store) CheckActive(tenantID string) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if t, ok := s.registered(models.TenantOr(tenantID)); ok && t.profile.SuspendedAt != nil {
+		if t.profile.SuspendReason != "" {
+			return fmt.Errorf("%w: %s", ErrSuspended, t.profile.SuspendReason)
+		}
+		return ErrSuspended
+	}
+	return nil
+}
+
+// Limits returns the tenant's quota and retention in days, which are zero
+// for tenants that aren't registered.
+func (s *Store) Limits(tenantID string) (Quota, int) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if t, ok := s.registered(models.TenantOr(tenantID)); ok {
+		return t.profile.Quota, t.profile.RetentionDays
+	}
+	return Quota{}, 0
+}
+
+// IssueKey issues a new API key to a registered tenant, with one of the
+// auth roles. The key is only returned here; just its hash is kept.
+func (s *Store) IssueKey(tenantID, name, role string) (APIKey, string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.issueKey(tenantID, name, role)
+}
+
+// RotateKeys issues a new key to the tenant and expires its other keys
+// after grace, or at once when grace is 0, so clients can move over to the
+// new key in the meantime.
+func (s *Store) RotateKeys(tenantID, name, role string, grace time.Duration) (APIKey, string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key, secret, err := s.issueKey(tenantID, name, role)
+	if err != nil {
+		return APIKey{}, "", err
+	}
+	now := time.Now().UTC()
+	expiresAt := now.Add(grace)
+	for id, old := range s.tenants[tenantID].keys {
+		if id == key.ID || old.expired(now) || (old.ExpiresAt != nil && old.ExpiresAt.Before(expiresAt)) {
+			continue
+		}
+		c := change{Op: opExpireKey, Tenant: tenantID, Key: &keyRecord{ID: id, ExpiresAt: &expiresAt}}
+		if grace <= 0 {
+			c = change{Op: opRevokeKey, Tenant: tenantID, Key: &keyRecord{ID: id}}
+		}
+		if err := s.commit(c); err != nil {
+			return APIKey{}, "", err
+		}
+	}
+	return key, secret, nil
+}
+
+// issueKey does IssueKey. Must be called with s.mu held.
+func (s *Store) issueKey(tenantID, name, role string) (APIKey, string, error) {
+	if role == "" {
+		role = auth.RoleAdmin
+	}
+	if !auth.ValidRole(role) {
+		return APIKey{}, "", fmt.Errorf("%w: role must be viewer, sender or admin", ErrInvalid)
+	}
+	if _, ok := s.registered(tenantID); !ok {
+		return APIKey{}, "", ErrUnknownTenant
+	}
+
+	id := make([]byte, 6)
+	secret := make([]byte, 32)
+	if _, err := rand.Read(id); err != nil {
+		return APIKey{}, "", fmt.Errorf("generate API key: %w", err)
+	}
+	if _, err := rand.Read(secret); err != nil {
+		return APIKey{}, "", fmt.Errorf("generate API key: %w", err)
+	}
+	key := keyPrefix + base64.RawURLEncoding.EncodeToString(secret)
+	record := &keyRecord{
+		ID:        hex.EncodeToString(id),
+		Name:      name,
+		Role:      role,
+		Hash:      hashKey(key),
+		CreatedAt: time.Now().UTC(),
+	}
+	if record.Name == "" {
+		record.Name = tenantID + "-" + record.ID
+	}
+	if err := s.commit(change{Op: opAddKey, Tenant: tenantID, Key: record}); err != nil {
+		return APIKey{}, "", err
+	}
+	return record.view(tenantID), key, nil
+}
+
+// RevokeKey deletes one of a tenant's keys, reporting whether it had it.
+func (s *Store) RevokeKey(tenantID, keyID string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t, ok := s.registered(tenantID)
+	if !ok || t.keys[keyID] == nil {
+		return false, nil
+	}
+	return true, s.commit(change{Op: opRevokeKey, Tenant: tenantID, Key: &keyRecord{ID: keyID}})
+}
+
+// LookupAPIKey returns the issued key a request's key matches, if it
+// hasn't expired.
+func (s *Store) LookupAPIKey(key string) (APIKey, bool) {
+	if len(key) <= len(keyPrefix) || key[:len(keyPrefix)] != keyPrefix {
+		return APIKey{}, false
+	}
+	hashed := hashKey(key)
+	now := time.Now()
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for id, t := range s.tenants {
+		for _, record := range t.keys {
+			if subtle.ConstantTimeCompare([]byte(record.Hash), []byte(hashed)) == 1 && !record.expired(now) {
+				return record.view(id), true
+			}
+		}
+	}
+	return APIKey{}, false
+}
+
+// HasAPIKeys reports whether any tenant has an issued key that hasn't
+// expired.
+func (s *Store) HasAPIKeys() bool {
+	now := time.Now()
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, t := range s.tenants {
+		for _, record := range t.keys {
+			if !record.expired(now) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func validateLimits(quota Quota, retentionDays int) error {
+	if quota.Daily < 0 || quota.Monthly < 0 {
+		return fmt.Errorf("%w: quotas can't be negative", ErrInvalid)
+	}
+	if retentionDays < 0 {
+		return fmt.Errorf("%w: retention_days can't be negative", ErrInvalid)
+	}
+	return nil
+}
+
+func hashKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
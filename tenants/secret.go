@@ -0,0 +1,59 @@
+package tenants
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+
+	"filippo.io/age"
+)
+
+// encrypt age-encrypts a secret to the store's identity and returns it in
+// base64. Empty secrets stay empty.
+func (s *Store) encrypt(secret string) (string, error) {
+	if secret == "" {
+		return "", nil
+	}
+	if s.identity == nil {
+		return "", ErrNoSecretKey
+	}
+
+	var out bytes.Buffer
+	w, err := age.Encrypt(&out, s.identity.Recipient())
+	if err != nil {
+		return "", fmt.Errorf("encrypt secret: %w", err)
+	}
+	if _, err := io.WriteString(w, secret); err != nil {
+		return "", fmt.Errorf("encrypt secret: %w", err)
+	}
+	if err := w.Close(); err != nil {
+		return "", fmt.Errorf("encrypt secret: %w", err)
+	}
+	return base64.StdEncoding.EncodeToString(out.Bytes()), nil
+}
+
+// decrypt reverses encrypt
+func (s *Store) decrypt(sealed string) (string, error) {
+	if sealed == "" {
+		return "", nil
+	}
+	if s.identity == nil {
+		return "", errors.New("encrypted, but TENANTS_SECRET_KEY is not set")
+	}
+
+	data, err := base64.StdEncoding.DecodeString(sealed)
+	if err != nil {
+		return "", fmt.Errorf("decrypt secret: %w", err)
+	}
+	r, err := age.Decrypt(bytes.NewReader(data), s.identity)
+	if err != nil {
+		return "", fmt.Errorf("decrypt secret: %w", err)
+	}
+	secret, err := io.ReadAll(r)
+	if err != nil {
+		return "", fmt.Errorf("decrypt secret: %w", err)
+	}
+	return string(secret), nil
+}
@@ -0,0 +1,456 @@
+// Package tenants keeps the settings tenants have of their own. A tenant's
+// sending settings let it send from its own SMTP server, address and
+// domain; its SMTP password and DKIM key are kept encrypted. Its tracking
+// domains, once verified through DNS, carry its tracking links. Tenants the
+// operator registers also have limits, can be suspended and get API keys
+// of their own. Tenants can also brand their dashboard and notifications.
+package tenants
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/mail"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"email-tracker/config"
+	"email-tracker/deliverability"
+	"email-tracker/models"
+	"email-tracker/notification"
+
+	"filippo.io/age"
+)
+
+// ErrInvalid matches, via errors.Is, settings refused as malformed
+var ErrInvalid = errors.New("invalid tenant settings")
+
+// ErrNoSecretKey is returned for secrets given while TENANTS_SECRET_KEY
+// isn't set, as they are never stored in the clear
+var ErrNoSecretKey = errors.New("TENANTS_SECRET_KEY is not set, so SMTP passwords and DKIM keys can't be stored")
+
+// defaultSMTPPort is used for a tenant's SMTP server without a port
+const defaultSMTPPort = 587
+
+// Sending is a tenant's own sending settings. Empty ones fall back to the
+// configured SMTP server and From address; without DKIM settings mail
+// goes out unsigned. The SMTP password and DKIM key are never shown, only
+// whether they are set, along with the DNS record the DKIM key needs.
+type Sending struct {
+	SMTPHost     string    `json:"smtp_host,omitempty"`
+	SMTPPort     int       `json:"smtp_port,omitempty"`
+	SMTPUsername string    `json:"smtp_username,omitempty"`
+	SMTPPassword string    `json:"-"`
+	From         string    `json:"from,omitempty"`
+	DKIMDomain   string    `json:"dkim_domain,omitempty"`
+	DKIMSelector string    `json:"dkim_selector,omitempty"`
+	DKIMKey      string    `json:"-"`
+	UpdatedAt    time.Time `json:"updated_at"`
+
+	PasswordSet    bool   `json:"smtp_password_set"`
+	DKIMKeySet     bool   `json:"dkim_key_set"`
+	DKIMRecordName string `json:"dkim_record_name,omitempty"`
+	DKIMRecord     string `json:"dkim_record,omitempty"`
+}
+
+// sealedSending is Sending as written to the file, with the password and
+// DKIM key age-encrypted
+type sealedSending struct {
+	SMTPHost     string    `json:"smtp_host,omitempty"`
+	SMTPPort     int       `json:"smtp_port,omitempty"`
+	SMTPUsername string    `json:"smtp_username,omitempty"`
+	SMTPPassword string    `json:"smtp_password,omitempty"`
+	From         string    `json:"from,omitempty"`
+	DKIMDomain   string    `json:"dkim_domain,omitempty"`
+	DKIMSelector string    `json:"dkim_selector,omitempty"`
+	DKIMKey      string    `json:"dkim_key,omitempty"`
+	UpdatedAt    time.Time `json:"updated_at"`
+}
+
+// change is a line of the tenants file
+type change struct {
+	Op      string         `json:"op"`
+	Tenant  string         `json:"tenant"`
+	Sending *sealedSending `json:"sending,omitempty"`
+	Domain  *domainRecord  `json:"domain,omitempty"`
+	Profile *profile       `json:"profile,omitempty"`
+	Key     *keyRecord     `json:"key,omitempty"`
+	Webhook *sealedWebhook `json:"webhook,omitempty"`
+	// Notifications and Branding are nil when they are removed
+	Notifications *Notifications   `json:"notifications,omitempty"`
+	Branding      *models.Branding `json:"branding,omitempty"`
+}
+
+const (
+	opSetSending    = "set_sending"
+	opRemoveSending = "remove_sending"
+	opAddDomain     = "add_domain"
+	opVerifyDomain  = "verify_domain"
+	opRemoveDomain  = "remove_domain"
+	opSetTenant     = "set_tenant"
+	opAddKey        = "add_key"
+	opExpireKey     = "expire_key"
+	opRevokeKey     = "revoke_key"
+
+	opSetWebhook       = "set_webhook"
+	opRemoveWebhook    = "remove_webhook"
+	opSetNotifications = "set_notifications"
+	opSetBranding      = "set_branding"
+)
+
+// tenant is what is held for one tenant. account is nil while it sends as
+// configured, and profile while it isn't registered.
+type tenant struct {
+	sending Sending
+	account *notification.Account
+	domains map[string]*domainRecord
+	profile *profile
+	keys    map[string]*keyRecord
+
+	webhooks      map[string]*Webhook
+	notifications *Notifications
+	branding      *models.Branding
+}
+
+// Store holds the tenants' settings in memory and, when a file is
+// configured, appends every change to it as JSON Lines so they survive
+// restarts.
+type Store struct {
+	mu       sync.RWMutex
+	tenants  map[string]*tenant
+	identity *age.X25519Identity
+	resolver Resolver
+	file     *os.File
+}
+
+// Open loads the settings from TENANTS_FILE, decrypting their secrets with
+// TENANTS_SECRET_KEY, and appends changes to it from then on.
+func Open(cfg *config.Config) (*Store, error) {
+	s := &Store{tenants: make(map[string]*tenant), resolver: net.DefaultResolver}
+	if cfg.Tenants.SecretKey != "" {
+		identity, err := age.ParseX25519Identity(cfg.Tenants.SecretKey)
+		if err != nil {
+			return nil, fmt.Errorf("TENANTS_SECRET_KEY: %w", err)
+		}
+		s.identity = identity
+	}
+	path := cfg.Tenants.File
+	if path == "" {
+		return s, nil
+	}
+
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("open tenants file: %w", err)
+	}
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var c change
+		if err := json.Unmarshal(scanner.Bytes(), &c); err != nil {
+			file.Close()
+			return nil, fmt.Errorf("read tenants file %s: %w", path, err)
+		}
+		if err := s.apply(c); err != nil {
+			file.Close()
+			return nil, fmt.Errorf("read tenants file %s: tenant %s: %w", path, c.Tenant, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("read tenants file %s: %w", path, err)
+	}
+
+	s.file = file
+	return s, nil
+}
+
+// apply makes c take effect. Must be called with s.mu held, or before the
+// store is shared.
+func (s *Store) apply(c change) error {
+	c.Tenant = models.TenantOr(c.Tenant)
+	switch c.Op {
+	case opSetSending:
+		if c.Sending == nil {
+			return errors.New("sending settings missing")
+		}
+		sending, err := s.unseal(c.Sending)
+		if err != nil {
+			return err
+		}
+		account, err := accountFor(sending)
+		if err != nil {
+			return err
+		}
+		t := s.tenant(c.Tenant)
+		t.sending, t.account = sending, account
+	case opRemoveSending:
+		t := s.tenant(c.Tenant)
+		t.sending, t.account = Sending{}, nil
+	case opAddDomain, opVerifyDomain, opRemoveDomain:
+		if c.Domain == nil {
+			return errors.New("domain missing")
+		}
+		s.applyDomain(c.Op, c.Tenant, c.Domain)
+	case opSetTenant, opAddKey, opExpireKey, opRevokeKey:
+		return s.applyRegistry(c)
+	case opSetWebhook, opRemoveWebhook, opSetNotifications:
+		return s.applyChannels(c)
+	case opSetBranding:
+		s.applyBranding(c)
+	}
+	return nil
+}
+
+// tenant returns what is held for id, adding it when there is nothing yet.
+// Must be called with s.mu held.
+func (s *Store) tenant(id string) *tenant {
+	t, ok := s.tenants[id]
+	if !ok {
+		t = &tenant{
+			domains:  make(map[string]*domainRecord),
+			keys:     make(map[string]*keyRecord),
+			webhooks: make(map[string]*Webhook),
+		}
+		s.tenants[id] = t
+	}
+	return t
+}
+
+func (s *Store) write(c change) error {
+	if s.file == nil {
+		return nil
+	}
+	line, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	if _, err := s.file.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("write tenants file: %w", err)
+	}
+	return nil
+}
+
+// Sending returns the tenant's sending settings, if it has any.
+func (s *Store) Sending(tenantID string) (Sending, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	t, ok := s.tenants[models.TenantOr(tenantID)]
+	if !ok || t.account == nil {
+		return Sending{}, false
+	}
+	return view(t), true
+}
+
+// SetSending replaces the tenant's sending settings. An empty password or
+// DKIM key keeps the one set before.
+func (s *Store) SetSending(tenantID string, sending Sending) (Sending, error) {
+	tenantID = models.TenantOr(tenantID)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if existing, ok := s.tenants[tenantID]; ok && existing.account != nil {
+		if sending.SMTPPassword == "" {
+			sending.SMTPPassword = existing.sending.SMTPPassword
+		}
+		if sending.DKIMKey == "" {
+			sending.DKIMKey = existing.sending.DKIMKey
+		}
+	}
+	if sending.SMTPHost != "" && sending.SMTPPort == 0 {
+		sending.SMTPPort = defaultSMTPPort
+	}
+	sending.UpdatedAt = time.Now().UTC()
+
+	if err := validate(sending); err != nil {
+		return Sending{}, err
+	}
+	account, err := accountFor(sending)
+	if err != nil {
+		return Sending{}, err
+	}
+	sealed, err := s.seal(sending)
+	if err != nil {
+		return Sending{}, err
+	}
+
+	t := s.tenant(tenantID)
+	t.sending, t.account = sending, account
+	return view(t), s.write(change{Op: opSetSending, Tenant: tenantID, Sending: sealed})
+}
+
+// RemoveSending drops the tenant's sending settings, so it sends as
+// configured again, reporting whether it had any.
+func (s *Store) RemoveSending(tenantID string) (bool, error) {
+	tenantID = models.TenantOr(tenantID)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if t, ok := s.tenants[tenantID]; !ok || t.account == nil {
+		return false, nil
+	}
+	c := change{Op: opRemoveSending, Tenant: tenantID}
+	s.apply(c)
+	return true, s.write(c)
+}
+
+// Account returns what the tenant's mail is sent as, or nil when it sends
+// as configured.
+func (s *Store) Account(tenantID string) *notification.Account {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if t, ok := s.tenants[models.TenantOr(tenantID)]; ok {
+		return t.account
+	}
+	return nil
+}
+
+// Via returns what the deliverability checks look at for the tenant's
+// mail, or nil when it sends as configured.
+func (s *Store) Via(tenantID string) *deliverability.Via {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	t, ok := s.tenants[models.TenantOr(tenantID)]
+	if !ok || t.account == nil {
+		return nil
+	}
+	via := &deliverability.Via{SMTPHost: t.sending.SMTPHost, Username: t.sending.SMTPUsername}
+	if t.sending.DKIMSelector != "" {
+		via.DKIMSelectors = []string{t.sending.DKIMSelector}
+	}
+	return via
+}
+
+// Close closes the file.
+func (s *Store) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.file == nil {
+		return nil
+	}
+	err := s.file.Close()
+	s.file = nil
+	return err
+}
+
+// view is the tenant's settings as shown, without secrets
+func view(t *tenant) Sending {
+	sending := t.sending
+	sending.PasswordSet = sending.SMTPPassword != ""
+	sending.DKIMKeySet = sending.DKIMKey != ""
+	sending.SMTPPassword, sending.DKIMKey = "", ""
+	if t.account.DKIM != nil {
+		sending.DKIMRecordName = t.account.DKIM.RecordName()
+		sending.DKIMRecord = t.account.DKIM.Record()
+	}
+	return sending
+}
+
+func validate(sending Sending) error {
+	invalid := func(format string, args ...any) error {
+		return fmt.Errorf("%w: %s", ErrInvalid, fmt.Sprintf(format, args...))
+	}
+
+	if sending.SMTPHost == "" && (sending.SMTPUsername != "" || sending.SMTPPassword != "") {
+		return invalid("smtp_username and smtp_password need smtp_host")
+	}
+	if sending.SMTPPort < 0 || sending.SMTPPort > 65535 {
+		return invalid("smtp_port must be between 1 and 65535")
+	}
+	if sending.From != "" {
+		if _, err := mail.ParseAddress(sending.From); err != nil {
+			return invalid("from is not an email address")
+		}
+	}
+
+	dkim := sending.DKIMDomain != "" || sending.DKIMSelector != "" || sending.DKIMKey != ""
+	if !dkim {
+		return nil
+	}
+	if sending.DKIMDomain == "" || sending.DKIMSelector == "" || sending.DKIMKey == "" {
+		return invalid("dkim_domain, dkim_selector and dkim_key go together")
+	}
+	if sending.From == "" {
+		return invalid("DKIM signing needs a from address in the DKIM domain")
+	}
+	// DMARC only counts signatures whose domain aligns with the From domain
+	from, _ := mail.ParseAddress(sending.From)
+	_, domain, _ := strings.Cut(strings.ToLower(from.Address), "@")
+	dkimDomain := strings.ToLower(sending.DKIMDomain)
+	if domain != dkimDomain && !strings.HasSuffix(domain, "."+dkimDomain) {
+		return invalid("from must be in dkim_domain %s or one of its subdomains", dkimDomain)
+	}
+	return nil
+}
+
+// accountFor builds what mail is sent as from a tenant's settings
+func accountFor(sending Sending) (*notification.Account, error) {
+	account := &notification.Account{
+		Host:     sending.SMTPHost,
+		Port:     sending.SMTPPort,
+		Username: sending.SMTPUsername,
+		Password: sending.SMTPPassword,
+		From:     sending.From,
+	}
+	if sending.DKIMKey != "" {
+		signer, err := notification.NewDKIMSigner(sending.DKIMDomain, sending.DKIMSelector, sending.DKIMKey)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalid, err)
+		}
+		account.DKIM = signer
+	}
+	return account, nil
+}
+
+// seal encrypts the settings' secrets for the file
+func (s *Store) seal(sending Sending) (*sealedSending, error) {
+	sealed := &sealedSending{
+		SMTPHost:     sending.SMTPHost,
+		SMTPPort:     sending.SMTPPort,
+		SMTPUsername: sending.SMTPUsername,
+		From:         sending.From,
+		DKIMDomain:   sending.DKIMDomain,
+		DKIMSelector: sending.DKIMSelector,
+		UpdatedAt:    sending.UpdatedAt,
+	}
+	var err error
+	if sealed.SMTPPassword, err = s.encrypt(sending.SMTPPassword); err != nil {
+		return nil, err
+	}
+	if sealed.DKIMKey, err = s.encrypt(sending.DKIMKey); err != nil {
+		return nil, err
+	}
+	return sealed, nil
+}
+
+// unseal decrypts settings read from the file
+func (s *Store) unseal(sealed *sealedSending) (Sending, error) {
+	sending := Sending{
+		SMTPHost:     sealed.SMTPHost,
+		SMTPPort:     sealed.SMTPPort,
+		SMTPUsername: sealed.SMTPUsername,
+		From:         sealed.From,
+		DKIMDomain:   sealed.DKIMDomain,
+		DKIMSelector: sealed.DKIMSelector,
+		UpdatedAt:    sealed.UpdatedAt,
+	}
+	var err error
+	if sending.SMTPPassword, err = s.decrypt(sealed.SMTPPassword); err != nil {
+		return Sending{}, fmt.Errorf("SMTP password: %w", err)
+	}
+	if sending.DKIMKey, err = s.decrypt(sealed.DKIMKey); err != nil {
+		return Sending{}, fmt.Errorf("DKIM key: %w", err)
+	}
+	return sending, nil
+}
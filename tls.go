@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"sync/atomic"
+
+	"email-tracker/config"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// certificate serves the certificate from TLS_CERT_FILE and TLS_KEY_FILE,
+// reloaded on SIGHUP so renewed certificates are picked up without a
+// restart.
+type certificate struct {
+	certFile, keyFile string
+	current           atomic.Pointer[tls.Certificate]
+}
+
+func loadCertificate(certFile, keyFile string) (*certificate, error) {
+	c := &certificate{certFile: certFile, keyFile: keyFile}
+	if err := c.reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// reload reads the files again. On failure the previous certificate stays
+// in use.
+func (c *certificate) reload() error {
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return fmt.Errorf("load TLS certificate: %w", err)
+	}
+	c.current.Store(&cert)
+	return nil
+}
+
+func (c *certificate) get(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return c.current.Load(), nil
+}
+
+// setupTLS returns the TLS config for the main listener and, when
+// TLS_HTTP_PORT is set, the handler for the plain HTTP one: it answers
+// Let's Encrypt's HTTP challenges when using autocert and redirects
+// everything else to HTTPS.
+func (s *Server) setupTLS(cfg *config.Config) (*tls.Config, http.Handler, error) {
+	var tlsConfig *tls.Config
+	var httpHandler http.Handler = s.redirectToHTTPS()
+
+	if cfg.TLS.CertFile != "" {
+		cert, err := loadCertificate(cfg.TLS.CertFile, cfg.TLS.KeyFile)
+		if err != nil {
+			return nil, nil, err
+		}
+		s.certificate = cert
+		tlsConfig = &tls.Config{GetCertificate: cert.get, MinVersion: tls.VersionTLS12}
+	} else {
+		// Tenants' verified tracking domains get certificates too
+		configured := autocert.HostWhitelist(cfg.TLS.AutocertDomains...)
+		manager := &autocert.Manager{
+			Prompt: autocert.AcceptTOS,
+			HostPolicy: func(ctx context.Context, host string) error {
+				if s.tenants.IsVerifiedDomain(host) {
+					return nil
+				}
+				return configured(ctx, host)
+			},
+			Cache: autocert.DirCache(cfg.TLS.AutocertCacheDir),
+			Email: cfg.TLS.AutocertEmail,
+		}
+		// Also answers the TLS-ALPN challenge on the HTTPS port, so
+		// TLS_HTTP_PORT isn't needed when it is 443
+		tlsConfig = manager.TLSConfig()
+		tlsConfig.MinVersion = tls.VersionTLS12
+		httpHandler = manager.HTTPHandler(httpHandler)
+	}
+
+	if cfg.TLS.HTTPPort == "" {
+		httpHandler = nil
+	}
+	return tlsConfig, httpHandler, nil
+}
+
+// redirectToHTTPS sends plain HTTP requests to the same URL on the HTTPS
+// port. 308 keeps the method, so API clients POSTing over HTTP aren't
+// silently turned into GETs.
+func (s *Server) redirectToHTTPS() http.Handler {
+	port := s.config.Server.Port
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if port != "443" {
+			host = net.JoinHostPort(host, port)
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusPermanentRedirect)
+	})
+}
+
+// reloadCertificate picks up a renewed TLS_CERT_FILE on reload. A change
+// of the paths themselves needs a restart.
+func (s *Server) reloadCertificate(cfg *config.Config) {
+	if s.certificate == nil || cfg.TLS.CertFile != s.certificate.certFile || cfg.TLS.KeyFile != s.certificate.keyFile {
+		return
+	}
+	if err := s.certificate.reload(); err != nil {
+		slog.Error("keeping the previous TLS certificate", "error", err)
+		return
+	}
+	slog.Info("TLS certificate reloaded", "file", s.certificate.certFile)
+}
@@ -0,0 +1,84 @@
+package tracker
+
+import (
+	"strings"
+	"time"
+
+	"email-tracker/models"
+)
+
+// Activity is what a tenant sent over a period, and how it went
+type Activity struct {
+	Emails     int        `json:"emails"`
+	Recipients int        `json:"recipients"`
+	Failed     int        `json:"failed"`
+	Bounced    int        `json:"bounced"`
+	Opened     int        `json:"opened"`
+	LastSentAt *time.Time `json:"last_sent_at,omitempty"`
+}
+
+// TenantActivity returns each tenant's activity for the emails it sent
+// since since. Only tenants that sent any are in it.
+func (t *Tracker) TenantActivity(since time.Time) map[string]*Activity {
+	activity := make(map[string]*Activity)
+	for _, s := range t.shards {
+		s.mu.RLock()
+		for _, email := range s.trackingData {
+			if email.SentAt.Before(since) {
+				continue
+			}
+			a, ok := activity[email.Tenant()]
+			if !ok {
+				a = &Activity{}
+				activity[email.Tenant()] = a
+			}
+			a.Emails++
+			a.Recipients += recipientCount(email)
+			switch email.DeliveryStatus {
+			case models.DeliveryStatusFailed:
+				a.Failed++
+			case models.DeliveryStatusBounced:
+				a.Bounced++
+			}
+			if email.FilteredStats.UniqueOpens > 0 {
+				a.Opened++
+			}
+			if a.LastSentAt == nil || email.SentAt.After(*a.LastSentAt) {
+				sentAt := email.SentAt
+				a.LastSentAt = &sentAt
+			}
+		}
+		s.mu.RUnlock()
+	}
+	return activity
+}
+
+// RecipientsSent returns how many recipients the tenant's mail went to
+// since day and since month, for quotas. Failed sends don't count.
+func (t *Tracker) RecipientsSent(tenant string, day, month time.Time) (int, int) {
+	var sinceDay, sinceMonth int
+	for _, s := range t.shards {
+		s.mu.RLock()
+		for _, email := range s.trackingData {
+			if email.Tenant() != tenant || email.DeliveryStatus == models.DeliveryStatusFailed {
+				continue
+			}
+			n := recipientCount(email)
+			if !email.SentAt.Before(month) {
+				sinceMonth += n
+			}
+			if !email.SentAt.Before(day) {
+				sinceDay += n
+			}
+		}
+		s.mu.RUnlock()
+	}
+	return sinceDay, sinceMonth
+}
+
+func recipientCount(email *models.Email) int {
+	if email.To == "" {
+		return 0
+	}
+	return strings.Count(email.To, ",") + 1
+}
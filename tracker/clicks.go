@@ -0,0 +1,184 @@
+package tracker
+
+import (
+	"fmt"
+	"html"
+	"net/http"
+	"regexp"
+	"strconv"
+	"time"
+
+	"email-tracker/analytics"
+	"email-tracker/events"
+	"email-tracker/logging"
+	"email-tracker/models"
+	"email-tracker/usage"
+	"email-tracker/utils"
+)
+
+// hrefPattern matches absolute http(s) links in double- or single-quoted
+// href attributes.
+var hrefPattern = regexp.MustCompile(`(?i)(href\s*=\s*)(?:"(https?://[^"]*)"|'(https?://[^']*)')`)
+
+// RewriteLinks replaces every absolute link in the body with a click-tracking
+// redirect and returns the rewritten body plus the original URLs. Links are
+// addressed by index so the redirect endpoint can't be abused as an open
+// redirect.
+func (t *Tracker) RewriteLinks(body, trackingID, baseURL string) (string, []string) {
+	var links []string
+	settings := t.settings.Load()
+
+	rewritten := hrefPattern.ReplaceAllStringFunc(body, func(match string) string {
+		parts := hrefPattern.FindStringSubmatch(match)
+		target := parts[2]
+		if target == "" {
+			target = parts[3]
+		}
+
+		links = append(links, html.UnescapeString(target))
+		link := fmt.Sprintf("%s/click/%s/%d", baseURL, trackingID, len(links)-1)
+		if sig := settings.sign(clickPayload(trackingID, len(links)-1)); sig != "" {
+			link += "?sig=" + sig
+		}
+		return fmt.Sprintf(`%s"%s"`, parts[1], link)
+	})
+
+	return rewritten, links
+}
+
+// clickPayload is what a click-tracking link's signature covers
+func clickPayload(trackingID string, index int) string {
+	return trackingID + "/" + strconv.Itoa(index)
+}
+
+// TrackClick records a click on a rewritten link and redirects the recipient
+// to the original URL.
+func (t *Tracker) TrackClick(w http.ResponseWriter, r *http.Request, trackingID, linkIndex string) {
+	settings := t.settings.Load()
+	index, err := strconv.Atoi(linkIndex)
+	if err != nil || index < 0 || !settings.verify(clickPayload(trackingID, index), r.URL.Query().Get("sig")) {
+		t.recordInvalidAttempt(r.Context(), trackingID, utils.GetClientIP(r, t.trustedProxies), r.UserAgent())
+		http.NotFound(w, r)
+		return
+	}
+
+	s := t.shardFor(trackingID)
+	s.mu.Lock()
+	email, exists := s.trackingData[trackingID]
+	if !exists || index >= len(email.Links) {
+		s.mu.Unlock()
+		t.recordInvalidAttempt(r.Context(), trackingID, utils.GetClientIP(r, t.trustedProxies), r.UserAgent())
+		http.NotFound(w, r)
+		return
+	}
+
+	target := email.Links[index]
+	ip := utils.GetClientIP(r, t.trustedProxies)
+
+	event := &models.ClickEvent{
+		ID:         utils.GenerateUUID(),
+		TrackingID: trackingID,
+		EmailID:    email.ID,
+		URL:        target,
+		IPAddress:  ip,
+		IPFamily:   utils.IPFamily(ip),
+		UserAgent:  r.UserAgent(),
+		ClickedAt:  time.Now(),
+	}
+	event.IsBot = settings.botFiltering && (utils.ParseUserAgent(event.UserAgent).IsBot ||
+		analytics.IsInstantOpen(email.SentAt, event.ClickedAt))
+	event.IPAddress, event.UserAgent = t.redact(settings, event.IPAddress, event.UserAgent)
+
+	s.clickEvents[trackingID] = append(s.clickEvents[trackingID], event)
+	email.RecordClick(event)
+	t.touch(s, trackingID, settings.maxEntries)
+	live := clickEvent(email, event)
+	shared := *event
+	s.mu.Unlock()
+
+	t.changed(trackingID, email.CampaignID)
+	t.counters.RecordClick(event, email.Tenant(), email.CampaignID)
+	t.meter(email.Tenant(), event.ClickedAt, usage.Counts{Clicks: 1})
+	if !event.IsBot {
+		t.engaged(email, event.ClickedAt, true)
+	}
+	t.events.Publish(live)
+	if t.shared != nil {
+		t.shared.SaveClick(&shared)
+	}
+
+	logging.FromContext(r.Context()).Info("link clicked", "tracking_id", trackingID,
+		"recipient_hash", logging.RecipientHash(email.To), "ip", event.IPAddress, "url", target)
+
+	w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
+	http.Redirect(w, r, target, http.StatusFound)
+}
+
+// clickEvent describes a click for live subscribers, along with the email's
+// updated counters.
+func clickEvent(email *models.Email, event *models.ClickEvent) events.Event {
+	return events.Event{
+		Type:        events.TypeClick,
+		Tenant:      email.Tenant(),
+		TrackingID:  email.TrackingID,
+		CampaignID:  email.CampaignID,
+		Subject:     email.Subject,
+		Recipient:   email.To,
+		URL:         event.URL,
+		IsBot:       event.IsBot,
+		TotalOpens:  email.Stats.TotalOpens,
+		UniqueOpens: email.Stats.UniqueOpens,
+		TotalClicks: email.Stats.TotalClicks,
+		At:          event.ClickedAt,
+	}
+}
+
+func (t *Tracker) GetClickEvents(trackingID string) []*models.ClickEvent {
+	s := t.shardFor(trackingID)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	clicks := make([]*models.ClickEvent, 0, len(s.clickEvents[trackingID]))
+	for _, click := range s.clickEvents[trackingID] {
+		copied := *click
+		clicks = append(clicks, &copied)
+	}
+	return clicks
+}
+
+// GetCampaignEmails returns every registered email the tenant sent as part
+// of the given campaign.
+func (t *Tracker) GetCampaignEmails(tenant, campaignID string) []*models.Email {
+	return t.filterEmails(func(email *models.Email) bool {
+		return email.CampaignID == campaignID && email.Tenant() == tenant
+	})
+}
+
+// GetABTestEmails returns every registered email of the tenant tagged with
+// the given A/B test ID.
+func (t *Tracker) GetABTestEmails(tenant, testID string) []*models.Email {
+	return t.filterEmails(func(email *models.Email) bool {
+		return email.ABTestID == testID && email.Tenant() == tenant
+	})
+}
+
+// TenantEmails returns every registered email of the tenant.
+func (t *Tracker) TenantEmails(tenant string) []*models.Email {
+	return t.filterEmails(func(email *models.Email) bool { return email.Tenant() == tenant })
+}
+
+// filterEmails returns copies of the registered emails keep accepts. keep
+// is called with a shard's lock held.
+func (t *Tracker) filterEmails(keep func(email *models.Email) bool) []*models.Email {
+	var emails []*models.Email
+	for _, s := range t.shards {
+		s.mu.RLock()
+		for _, email := range s.trackingData {
+			if keep(email) {
+				emails = append(emails, copyEmail(email))
+			}
+		}
+		s.mu.RUnlock()
+	}
+	return emails
+}
@@ -0,0 +1,21 @@
+package tracker
+
+// confirmPayload is what a consent confirm link's signature covers
+func confirmPayload(token string) string {
+	return "confirm/" + token
+}
+
+// ConfirmURL returns the double opt-in link for a consent token.
+func (t *Tracker) ConfirmURL(token, baseURL string) string {
+	link := baseURL + "/confirm/" + token
+	if sig := t.settings.Load().sign(confirmPayload(token)); sig != "" {
+		link += "?sig=" + sig
+	}
+	return link
+}
+
+// VerifyConfirm checks a confirm link's signature. Everything passes when
+// signing is off.
+func (t *Tracker) VerifyConfirm(token, signature string) bool {
+	return t.settings.Load().verify(confirmPayload(token), signature)
+}
@@ -0,0 +1,35 @@
+package tracker
+
+import (
+	"strings"
+	"time"
+
+	"email-tracker/models"
+)
+
+// Engagement keeps track of when a tenant's recipients last opened and
+// clicked
+type Engagement interface {
+	RecordOpen(tenant string, recipients []string, at time.Time)
+	RecordClick(tenant string, recipients []string, at time.Time)
+}
+
+// SetEngagement reports the opens and clicks recorded here, bots aside, by
+// the recipients of the email. Opens and clicks another instance shares
+// aren't reported again. Call it before serving requests.
+func (t *Tracker) SetEngagement(engagement Engagement) {
+	t.engagement = engagement
+}
+
+// engaged reports a human open, or a click when click is set, of email
+func (t *Tracker) engaged(email *models.Email, at time.Time, click bool) {
+	if t.engagement == nil || email.To == "" {
+		return
+	}
+	recipients := strings.Split(email.To, ",")
+	if click {
+		t.engagement.RecordClick(email.Tenant(), recipients, at)
+	} else {
+		t.engagement.RecordOpen(email.Tenant(), recipients, at)
+	}
+}
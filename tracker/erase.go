@@ -0,0 +1,78 @@
+package tracker
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"email-tracker/models"
+	"email-tracker/utils"
+)
+
+// RecipientDeletion reports what DeleteRecipient removed
+type RecipientDeletion struct {
+	Emails         int      `json:"emails_deleted"`
+	Opens          int      `json:"opens_deleted"`
+	Clicks         int      `json:"clicks_deleted"`
+	TrackingIDs    []string `json:"tracking_ids"`
+	PersistedOpens int      `json:"persisted_opens_deleted"`
+}
+
+// DeleteRecipient deletes every email the tenant sent to address, with all
+// its opens and clicks, from memory, the shared store, the event store and
+// the counters. Emails sent to several recipients at once are deleted whole,
+// since their opens can't be told apart. What was deleted is reported even
+// when a store fails; the deletion can be retried.
+func (t *Tracker) DeleteRecipient(ctx context.Context, tenant, address string) (RecipientDeletion, error) {
+	address = utils.NormalizeAddress(address)
+	report := RecipientDeletion{TrackingIDs: []string{}}
+	deleted := make(map[string]bool)
+
+	for _, s := range t.shards {
+		s.mu.Lock()
+		for trackingID, email := range s.trackingData {
+			if email.Tenant() != tenant || !sentTo(email, address) {
+				continue
+			}
+			report.Emails++
+			report.Opens += len(s.trackingEvents[trackingID])
+			report.Clicks += len(s.clickEvents[trackingID])
+			report.TrackingIDs = append(report.TrackingIDs, trackingID)
+			deleted[trackingID] = true
+
+			s.forget(trackingID)
+			if t.shared != nil {
+				t.shared.DeleteEmail(trackingID)
+			}
+			t.changed(trackingID, email.CampaignID)
+		}
+		s.mu.Unlock()
+	}
+	if len(deleted) == 0 {
+		return report, nil
+	}
+
+	if err := t.counters.DeleteTracking(ctx, report.TrackingIDs...); err != nil {
+		return report, fmt.Errorf("deleting counters: %w", err)
+	}
+	if t.persist != nil {
+		removed, err := t.persist.store.DeleteEvents(func(event *models.TrackingEvent) bool {
+			return deleted[event.TrackingID]
+		})
+		report.PersistedOpens = removed
+		if err != nil {
+			return report, fmt.Errorf("deleting from event store: %w", err)
+		}
+	}
+	return report, nil
+}
+
+// sentTo reports whether address is one of email's recipients
+func sentTo(email *models.Email, address string) bool {
+	for _, to := range strings.Split(email.To, ",") {
+		if utils.NormalizeAddress(to) == address {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,265 @@
+package tracker
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"strconv"
+	"time"
+
+	"email-tracker/breaker"
+	"email-tracker/config"
+	"email-tracker/geo"
+	"email-tracker/logging"
+	"email-tracker/models"
+	"email-tracker/utils"
+)
+
+// lookupGeo locates ip with the configured provider. On failure, and for
+// private or local addresses that no provider could place, the location
+// holds just the IP.
+func (t *Tracker) lookupGeo(ip string) (*models.GeoLocation, error) {
+	if !utils.IsPublicIP(ip) {
+		return &models.GeoLocation{IP: ip}, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), t.timeouts.Load().geo)
+	defer cancel()
+
+	location, err := t.geo.Lookup(ctx, ip)
+	if err != nil {
+		return &models.GeoLocation{IP: ip}, err
+	}
+	return location, nil
+}
+
+// GeoStats reports how each geo provider in the fallback chain is doing.
+func (t *Tracker) GeoStats() []geo.ProviderStats {
+	return t.geoChain.Stats()
+}
+
+// GeoBreakers reports the circuit breakers of the geo providers.
+func (t *Tracker) GeoBreakers() []breaker.Status {
+	return t.geoChain.Breakers()
+}
+
+// CheckGeo asks every geo provider to locate ip, skipping the cache, and
+// returns each provider's error by name.
+func (t *Tracker) CheckGeo(ctx context.Context, ip string) map[string]error {
+	return t.geoChain.Check(ctx, ip)
+}
+
+// GeoQueueStats describes the opens whose location is waiting for geo
+// quota to free up
+type GeoQueueStats struct {
+	Pending    int    `json:"pending"`
+	Backfilled uint64 `json:"backfilled"`
+	Dropped    uint64 `json:"dropped"`
+}
+
+// GeoQueue reports the backlog of deferred geo lookups.
+func (t *Tracker) GeoQueue() GeoQueueStats {
+	return GeoQueueStats{
+		Pending:    len(t.geoQueue),
+		Backfilled: t.geoBackfilled.Load(),
+		Dropped:    t.geoDropped.Snapshot().Count,
+	}
+}
+
+// LossStats counts opens stored with less than they should have, and
+// notifications that never went out
+type LossStats struct {
+	// The backfill queue was full, so the open was stored without a location
+	GeoQueueFull utils.LossCount `json:"geo_queue_full"`
+	// Every geo provider failed
+	GeoLookupFailed utils.LossCount `json:"geo_lookup_failed"`
+	// Quota didn't free up within geoBackfillMaxWait, or before shutdown
+	GeoBackfillExpired  utils.LossCount `json:"geo_backfill_expired"`
+	NotificationsFailed utils.LossCount `json:"notifications_failed"`
+	// The notification queue was full
+	NotificationsDropped utils.LossCount `json:"notifications_dropped"`
+	// The event store queue was full or a batch failed to write
+	EventsNotPersisted utils.LossCount `json:"events_not_persisted"`
+	// Tracking IDs dropped, with their events, to stay within the entry limit
+	Evicted utils.LossCount `json:"tracking_ids_evicted"`
+	// Changes that never reached the shared store, in multi-instance mode
+	SharedWritesFailed *utils.LossCount `json:"shared_writes_failed,omitempty"`
+}
+
+func (t *Tracker) LossStats() LossStats {
+	stats := LossStats{
+		GeoQueueFull:         t.geoDropped.Snapshot(),
+		GeoLookupFailed:      t.geoFailed.Snapshot(),
+		GeoBackfillExpired:   t.geoExpired.Snapshot(),
+		NotificationsFailed:  t.notificationsFailed.Snapshot(),
+		NotificationsDropped: t.notificationsDropped.Snapshot(),
+		EventsNotPersisted:   t.eventsNotPersisted.Snapshot(),
+		Evicted:              t.evicted.Snapshot(),
+	}
+	if shared, ok := t.shared.(interface{ WriteFailures() utils.LossCount }); ok {
+		failures := shared.WriteFailures()
+		stats.SharedWritesFailed = &failures
+	}
+	return stats
+}
+
+// geoJob is an open whose location lookup was deferred for quota
+type geoJob struct {
+	email  *models.Email
+	event  *models.TrackingEvent
+	ip     string
+	notify bool
+}
+
+const (
+	// geoRetryDelay is how long to wait when a provider is out of quota
+	// but didn't say for how long
+	geoRetryDelay = 30 * time.Second
+
+	// geoBackfillMaxWait is how long a deferred lookup is retried before
+	// the open is finished without a location
+	geoBackfillMaxWait = time.Hour
+)
+
+// enrichOpen fills in the location of an open that has already been
+// recorded, then announces it on the live feed and sends the open
+// notification if the email asked for one. ip is the raw address even when
+// the event stores a redacted one. When every provider is out of quota the
+// open is queued for RunGeoBackfill instead.
+func (t *Tracker) enrichOpen(email *models.Email, event *models.TrackingEvent, ip string, notify bool) {
+	geoInfo, err := t.lookupGeo(ip)
+	if errors.Is(err, geo.ErrQuotaExceeded) && t.deferGeo(geoJob{email, event, ip, notify}) {
+		return
+	}
+	if err != nil {
+		t.geoFailed.Add(1)
+		slog.Warn("geo lookup failed", "tracking_id", event.TrackingID, "error", err)
+	}
+	t.finishOpen(email, event, geoInfo, notify)
+}
+
+func (t *Tracker) deferGeo(job geoJob) bool {
+	select {
+	case t.geoQueue <- job:
+		return true
+	default:
+		t.geoDropped.Add(1)
+		slog.Warn("geo backfill queue is full, storing open without a location",
+			"tracking_id", job.event.TrackingID, "event_id", job.event.ID)
+		return false
+	}
+}
+
+// RunGeoBackfill works through opens deferred for geo quota, one at a time,
+// waiting as long as the providers ask before retrying each. It returns once
+// the queue is closed and drained; once the tracker is closing, each open
+// gets one more lookup and no waiting.
+func (t *Tracker) RunGeoBackfill() {
+	if t.geoQueue == nil {
+		return
+	}
+	defer close(t.geoDone)
+
+	for job := range t.geoQueue {
+		giveUp := time.Now().Add(geoBackfillMaxWait)
+		for {
+			geoInfo, err := t.lookupGeo(job.ip)
+
+			var quotaErr *geo.QuotaError
+			if errors.As(err, &quotaErr) && time.Now().Before(giveUp) && !t.closing() {
+				delay := quotaErr.RetryAfter
+				if delay <= 0 {
+					delay = geoRetryDelay
+				}
+				timer := time.NewTimer(delay)
+				select {
+				case <-timer.C:
+				case <-t.stopping:
+					timer.Stop()
+				}
+				continue
+			}
+
+			switch {
+			case errors.As(err, &quotaErr) && t.closing():
+				t.geoExpired.Add(1)
+				slog.Warn("shutting down, storing deferred open without a location",
+					"tracking_id", job.event.TrackingID, "error", err)
+			case errors.As(err, &quotaErr):
+				t.geoExpired.Add(1)
+				slog.Warn("gave up on deferred geo lookup", "tracking_id", job.event.TrackingID,
+					"waited", geoBackfillMaxWait, "error", err)
+			case err != nil:
+				t.geoFailed.Add(1)
+				slog.Warn("deferred geo lookup failed", "tracking_id", job.event.TrackingID, "error", err)
+			default:
+				t.geoBackfilled.Add(1)
+			}
+			t.finishOpen(job.email, job.event, geoInfo, job.notify)
+			break
+		}
+	}
+}
+
+// finishOpen records the location on the event and announces the open.
+func (t *Tracker) finishOpen(email *models.Email, event *models.TrackingEvent, geoInfo *models.GeoLocation, notify bool) {
+	// Coordinates are empty when the lookup failed; keep them at 0,0 then
+	var lat, lon float64
+	if geoInfo.Lat != "" && geoInfo.Lon != "" {
+		lat, _ = strconv.ParseFloat(geoInfo.Lat, 64)
+		lon, _ = strconv.ParseFloat(geoInfo.Lon, 64)
+	}
+
+	timezone := geoInfo.Timezone
+	// Not every provider reports a zone; estimate one from the longitude
+	if _, known := models.LoadTimezone(timezone); !known && geoInfo.Lon != "" {
+		timezone = models.InferTimezone(lon)
+	}
+	// Reverse DNS names often spell out the full address
+	reverseDNS := geoInfo.ReverseDNS
+	if t.settings.Load().ipMode != config.IPModeFull {
+		reverseDNS = ""
+	}
+
+	s := t.shardFor(event.TrackingID)
+	s.mu.Lock()
+	event.Country = geoInfo.Country
+	event.City = geoInfo.City
+	event.Region = geoInfo.Region
+	event.ISP = geoInfo.ISP
+	event.Timezone = timezone
+	event.Lat = lat
+	event.Lon = lon
+	event.ASN = geoInfo.ASN
+	event.ASOrg = geoInfo.ASOrg
+	event.ReverseDNS = reverseDNS
+	event.NetworkType = geoInfo.NetworkType
+	email.RecordLocation(event)
+
+	// Work on copies from here on, the originals may change under us. They
+	// are only made for the notification and the stores that keep them.
+	live := openEvent(email, event)
+	ip := event.IPAddress
+	campaignID := email.CampaignID
+	if notify {
+		email = copyEmail(email)
+	}
+	if notify || t.persist != nil || t.shared != nil {
+		event = copyEvent(event)
+	}
+	s.mu.Unlock()
+
+	t.changed(live.TrackingID, campaignID)
+	slog.Info("email opened", "tracking_id", live.TrackingID, "recipient_hash", logging.RecipientHash(live.Recipient),
+		"ip", ip, "city", live.City, "country", live.Country, "is_bot", live.IsBot)
+
+	t.events.Publish(live)
+	t.persistEvent(event)
+	if t.shared != nil {
+		t.shared.SaveOpen(event)
+	}
+
+	if notify {
+		t.queueNotification(email, event)
+	}
+}
@@ -0,0 +1,81 @@
+package tracker
+
+import "container/list"
+
+// recency orders tracking IDs by when they were last registered, opened or
+// clicked, so the least recently used can be evicted first.
+type recency struct {
+	order *list.List
+	index map[string]*list.Element
+}
+
+func newRecency() *recency {
+	return &recency{order: list.New(), index: make(map[string]*list.Element)}
+}
+
+// touch marks trackingID as just used and reports whether it is new
+func (r *recency) touch(trackingID string) bool {
+	if elem, ok := r.index[trackingID]; ok {
+		r.order.MoveToFront(elem)
+		return false
+	}
+	r.index[trackingID] = r.order.PushFront(trackingID)
+	return true
+}
+
+// remove forgets trackingID and reports whether it was there
+func (r *recency) remove(trackingID string) bool {
+	elem, ok := r.index[trackingID]
+	if ok {
+		r.order.Remove(elem)
+		delete(r.index, trackingID)
+	}
+	return ok
+}
+
+// oldest returns the least recently used tracking ID
+func (r *recency) oldest() (string, bool) {
+	elem := r.order.Back()
+	if elem == nil {
+		return "", false
+	}
+	return elem.Value.(string), true
+}
+
+func (r *recency) len() int {
+	return r.order.Len()
+}
+
+// touch marks trackingID as used in s and, when that takes the tracker over
+// maxEntries, evicts the least recently used tracking IDs of s along with
+// their events. Recency is only kept per shard, so the evicted ID is the
+// oldest of its shard rather than of the whole tracker. Must be called with
+// s.mu held.
+func (t *Tracker) touch(s *shard, trackingID string, maxEntries int) {
+	if s.recency.touch(trackingID) {
+		s.entries.Add(1)
+	}
+	if maxEntries <= 0 {
+		return
+	}
+	for s.entries.Load() > int64(maxEntries) {
+		oldest, _ := s.recency.oldest()
+		if oldest == trackingID {
+			// Nothing else in this shard; the next touch elsewhere evicts
+			break
+		}
+		s.forget(oldest)
+		t.evicted.Add(1)
+	}
+}
+
+// forget drops everything held for trackingID. Must be called with s.mu
+// held.
+func (s *shard) forget(trackingID string) {
+	delete(s.trackingData, trackingID)
+	delete(s.trackingEvents, trackingID)
+	delete(s.clickEvents, trackingID)
+	if s.recency.remove(trackingID) {
+		s.entries.Add(-1)
+	}
+}
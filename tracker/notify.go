@@ -0,0 +1,87 @@
+package tracker
+
+import (
+	"log/slog"
+	"sync"
+
+	"email-tracker/models"
+	"email-tracker/notification"
+)
+
+// NotificationChannels says where a tenant's open notifications go when a
+// send doesn't name an address, the account they are sent as and how they
+// look
+type NotificationChannels interface {
+	OpenRecipients(tenant string) []string
+	Account(tenant string) *notification.Account
+	Branding(tenant string) (models.Branding, bool)
+}
+
+// SetNotificationChannels sends open notifications by tenant. Call it
+// before serving requests.
+func (t *Tracker) SetNotificationChannels(channels NotificationChannels) {
+	t.channels = channels
+}
+
+// notificationRoute returns who an open notification for email goes to,
+// none when nobody asked for it, and the account it is sent as. A tenant's
+// notifications only ever go to its own addresses.
+func (t *Tracker) notificationRoute(email *models.Email) ([]string, *notification.Account) {
+	var recipients []string
+	if email.NotifyEmail != "" {
+		recipients = []string{email.NotifyEmail}
+	}
+	if t.channels == nil {
+		return recipients, nil
+	}
+	if recipients == nil {
+		recipients = t.channels.OpenRecipients(email.Tenant())
+	}
+	return recipients, t.channels.Account(email.Tenant())
+}
+
+// notificationBranding returns how notifications for email look, the
+// service's own look when its tenant has no branding.
+func (t *Tracker) notificationBranding(email *models.Email) models.Branding {
+	if t.channels == nil {
+		return models.Branding{}
+	}
+	branding, _ := t.channels.Branding(email.Tenant())
+	return branding
+}
+
+// notifyJob is an open notification waiting for a dispatcher worker
+type notifyJob struct {
+	email *models.Email
+	event *models.TrackingEvent
+}
+
+// queueNotification hands an open notification to the dispatcher without
+// waiting for SMTP. When the queue is full the notification is dropped, so a
+// slow mail server can't hold up geo backfill or pile up goroutines.
+func (t *Tracker) queueNotification(email *models.Email, event *models.TrackingEvent) {
+	select {
+	case t.notifyQueue <- notifyJob{email, event}:
+	default:
+		t.pendingNotifications.Add(-1)
+		t.notificationsDropped.Add(1)
+		slog.Warn("notification queue is full, dropping open notification",
+			"tracking_id", event.TrackingID, "event_id", event.ID)
+	}
+}
+
+// RunNotifications sends queued open notifications with a fixed number of
+// workers. It returns once the queue is closed and drained.
+func (t *Tracker) RunNotifications() {
+	defer close(t.notifyDone)
+
+	var wg sync.WaitGroup
+	for range t.notifyWorkers {
+		wg.Go(func() {
+			for job := range t.notifyQueue {
+				t.sendNotification(job.email, job.event)
+			}
+		})
+	}
+	wg.Wait()
+}
@@ -0,0 +1,124 @@
+package tracker
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+
+	"email-tracker/config"
+	"email-tracker/models"
+	"email-tracker/storage"
+)
+
+// eventBatcher collects opens and writes them to a store in batches, so the
+// pixel handler never waits on disk.
+type eventBatcher struct {
+	store    storage.EventStore
+	size     int
+	interval time.Duration
+	onFail   func(n int)
+
+	// mu keeps add from sending on events once close has closed it
+	mu     sync.RWMutex
+	closed bool
+	events chan *models.TrackingEvent
+	done   chan struct{}
+}
+
+// add queues event without blocking and reports whether it fit
+func (b *eventBatcher) add(event *models.TrackingEvent) bool {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	if b.closed {
+		return false
+	}
+	select {
+	case b.events <- event:
+		return true
+	default:
+		return false
+	}
+}
+
+// run writes a batch whenever it is full or the flush interval passes, and
+// the rest once the batcher is closed.
+func (b *eventBatcher) run() {
+	defer close(b.done)
+
+	ticker := time.NewTicker(b.interval)
+	defer ticker.Stop()
+
+	batch := make([]*models.TrackingEvent, 0, b.size)
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := b.store.SaveEvents(batch); err != nil {
+			b.onFail(len(batch))
+			slog.Error("failed to persist tracking events", "events", len(batch), "error", err)
+		}
+		batch = batch[:0]
+	}
+
+	for {
+		select {
+		case event, ok := <-b.events:
+			if !ok {
+				flush()
+				return
+			}
+			batch = append(batch, event)
+			if len(batch) >= b.size {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+// close stops accepting events and waits for the ones queued to be written
+func (b *eventBatcher) close(ctx context.Context) error {
+	b.mu.Lock()
+	if !b.closed {
+		b.closed = true
+		close(b.events)
+	}
+	b.mu.Unlock()
+
+	select {
+	case <-b.done:
+		return b.store.Close()
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// PersistEvents writes every open, once its location is known, to store in
+// batches of cfg.Storage.BatchSize or every cfg.Storage.FlushInterval,
+// whichever comes first.
+func (t *Tracker) PersistEvents(store storage.EventStore, cfg *config.Config) {
+	t.persist = &eventBatcher{
+		store:    store,
+		size:     cfg.Storage.BatchSize,
+		interval: cfg.Storage.FlushInterval,
+		onFail:   func(n int) { t.eventsNotPersisted.Add(uint64(n)) },
+		events:   make(chan *models.TrackingEvent, cfg.Storage.QueueSize),
+		done:     make(chan struct{}),
+	}
+	go t.persist.run()
+}
+
+// persistEvent queues an open for the event store, if there is one
+func (t *Tracker) persistEvent(event *models.TrackingEvent) {
+	if t.persist == nil {
+		return
+	}
+	if !t.persist.add(event) {
+		t.eventsNotPersisted.Add(1)
+		slog.Warn("event store queue is full, open not persisted",
+			"tracking_id", event.TrackingID, "event_id", event.ID)
+	}
+}
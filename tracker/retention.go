@@ -0,0 +1,205 @@
+package tracker
+
+import (
+	"log/slog"
+	"time"
+
+	"email-tracker/config"
+	"email-tracker/models"
+)
+
+// retention says how long emails and their events are kept and how often
+// old ones are removed
+type retention struct {
+	interval    time.Duration
+	emailMaxAge time.Duration
+	eventMaxAge time.Duration
+}
+
+func (t *Tracker) storeRetention(cfg *config.Config) {
+	t.retention.Store(&retention{
+		interval:    cfg.Retention.Interval,
+		emailMaxAge: cfg.Retention.EmailMaxAge,
+		eventMaxAge: cfg.Retention.EventMaxAge,
+	})
+}
+
+// RunCleanup removes expired entries on the configured interval. It picks up
+// retention changes from ApplyConfig on the next run.
+func (t *Tracker) RunCleanup() {
+	interval := t.retention.Load().interval
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		policy := t.retention.Load()
+		t.pruneEventStore(time.Now(), policy)
+		t.CleanupOldEntries(policy.emailMaxAge, policy.eventMaxAge)
+		t.cleanupShared(policy)
+
+		if policy.interval != interval {
+			interval = policy.interval
+			ticker.Reset(interval)
+		}
+	}
+}
+
+// CleanupOldEntries drops emails sent more than emailMaxAge ago, along with
+// all their events, and opens and clicks older than eventMaxAge. Emails with
+// a retention of their own are kept, events included, for that long
+// instead.
+func (t *Tracker) CleanupOldEntries(emailMaxAge, eventMaxAge time.Duration) {
+	now := time.Now()
+	for _, s := range t.shards {
+		s.mu.Lock()
+		s.cleanup(now, emailMaxAge, eventMaxAge)
+		s.mu.Unlock()
+	}
+}
+
+// cleanup does CleanupOldEntries for one shard. Must be called with s.mu
+// held.
+func (s *shard) cleanup(now time.Time, emailMaxAge, eventMaxAge time.Duration) {
+	for id, email := range s.trackingData {
+		maxAge, _ := email.Retention(emailMaxAge, eventMaxAge)
+		if email.SentAt.Before(now.Add(-maxAge)) {
+			s.forget(id)
+		}
+	}
+
+	for trackingID, events := range s.trackingEvents {
+		_, maxAge := s.trackingData[trackingID].Retention(emailMaxAge, eventMaxAge)
+		eventCutoff := now.Add(-maxAge)
+		var recentEvents []*models.TrackingEvent
+		for _, event := range events {
+			if event.OpenedAt.After(eventCutoff) {
+				recentEvents = append(recentEvents, event)
+			}
+		}
+		s.trackingEvents[trackingID] = recentEvents
+
+		// Nothing is left for an unknown ID once its opens expire
+		if _, known := s.trackingData[trackingID]; !known && len(recentEvents) == 0 {
+			s.forget(trackingID)
+		}
+	}
+
+	for trackingID, clicks := range s.clickEvents {
+		_, maxAge := s.trackingData[trackingID].Retention(emailMaxAge, eventMaxAge)
+		eventCutoff := now.Add(-maxAge)
+		var recentClicks []*models.ClickEvent
+		for _, click := range clicks {
+			if click.ClickedAt.After(eventCutoff) {
+				recentClicks = append(recentClicks, click)
+			}
+		}
+		s.clickEvents[trackingID] = recentClicks
+	}
+}
+
+// pruneEventStore removes the opens past their retention from the event
+// store, by the same cutoffs as cleanup. It runs before the cleanup, while
+// the emails the opens belong to are still known.
+func (t *Tracker) pruneEventStore(now time.Time, policy *retention) {
+	if t.persist == nil {
+		return
+	}
+	removed, err := t.persist.store.DeleteEvents(func(event *models.TrackingEvent) bool {
+		s := t.shardFor(event.TrackingID)
+		s.mu.RLock()
+		defer s.mu.RUnlock()
+
+		email := s.trackingData[event.TrackingID]
+		emailMaxAge, eventMaxAge := email.Retention(policy.emailMaxAge, policy.eventMaxAge)
+		if email != nil && email.SentAt.Before(now.Add(-emailMaxAge)) {
+			return true
+		}
+		return !event.OpenedAt.After(now.Add(-eventMaxAge))
+	})
+	if err != nil {
+		slog.Error("failed to prune event store", "removed", removed, "error", err)
+	}
+}
+
+// RetentionPolicy is the configured retention, which applies to every
+// email without a retention of its own
+type RetentionPolicy struct {
+	Interval    time.Duration
+	EmailMaxAge time.Duration
+	EventMaxAge time.Duration
+}
+
+// Retention returns the configured retention.
+func (t *Tracker) Retention() RetentionPolicy {
+	policy := t.retention.Load()
+	return RetentionPolicy{
+		Interval:    policy.interval,
+		EmailMaxAge: policy.emailMaxAge,
+		EventMaxAge: policy.eventMaxAge,
+	}
+}
+
+// RetentionOverrides counts the tenant's emails held with a retention of
+// their own, by their retention in days.
+func (t *Tracker) RetentionOverrides(tenant string) map[int]int {
+	counts := make(map[int]int)
+	for _, s := range t.shards {
+		s.mu.RLock()
+		for _, email := range s.trackingData {
+			if email.RetentionDays > 0 && email.Tenant() == tenant {
+				counts[email.RetentionDays]++
+			}
+		}
+		s.mu.RUnlock()
+	}
+	return counts
+}
+
+// SetCampaignRetention changes the retention of every email the tenant
+// already sent as part of the campaign, and reports how many changed.
+// Emails past the new retention go on the next cleanup.
+func (t *Tracker) SetCampaignRetention(tenant, campaignID string, days int) int {
+	updated := 0
+	for _, s := range t.shards {
+		s.mu.Lock()
+		for trackingID, email := range s.trackingData {
+			if email.CampaignID != campaignID || email.Tenant() != tenant || email.RetentionDays == days {
+				continue
+			}
+			email.RetentionDays = days
+			updated++
+			if t.shared != nil {
+				t.shared.SaveEmail(copyEmail(email))
+			}
+			t.changed(trackingID, campaignID)
+		}
+		s.mu.Unlock()
+	}
+	return updated
+}
+
+// SetTenantRetention moves the tenant's emails kept for from days, the
+// tenant's previous retention, to to days, and reports how many changed.
+// Emails with a retention of their own that happens to be from move too.
+func (t *Tracker) SetTenantRetention(tenant string, from, to int) int {
+	if from == to {
+		return 0
+	}
+	updated := 0
+	for _, s := range t.shards {
+		s.mu.Lock()
+		for trackingID, email := range s.trackingData {
+			if email.Tenant() != tenant || email.RetentionDays != from {
+				continue
+			}
+			email.RetentionDays = to
+			updated++
+			if t.shared != nil {
+				t.shared.SaveEmail(copyEmail(email))
+			}
+			t.changed(trackingID, email.CampaignID)
+		}
+		s.mu.Unlock()
+	}
+	return updated
+}
@@ -0,0 +1,260 @@
+package tracker
+
+import (
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"email-tracker/config"
+	"email-tracker/utils"
+
+	"golang.org/x/time/rate"
+)
+
+// Reasons a client was banned from /track and /click
+const (
+	BanInvalidIDs = "invalid_ids"
+	BanRateLimit  = "rate_limit"
+)
+
+// Scanner is a client suspected of enumerating tracking IDs: one that asked
+// for unknown or forged IDs, or went over the rate limit, in the current
+// window.
+type Scanner struct {
+	IP              string     `json:"ip"`
+	InvalidAttempts int        `json:"invalid_attempts"`
+	RateLimited     int        `json:"rate_limited"`
+	LastTrackingID  string     `json:"last_tracking_id"`
+	UserAgent       string     `json:"user_agent"`
+	LastSeen        time.Time  `json:"last_seen"`
+	BannedUntil     *time.Time `json:"banned_until,omitempty"`
+	BanReason       string     `json:"ban_reason,omitempty"`
+}
+
+// scanClient is what the detector knows about one client IP
+type scanClient struct {
+	limiter     *rate.Limiter
+	invalid     []time.Time
+	limited     []time.Time
+	lastSeen    time.Time
+	lastID      string
+	userAgent   string
+	bannedUntil time.Time
+	banReason   string
+}
+
+// scanDetector rate-limits /track and /click per client IP and counts the
+// hits for unknown tracking IDs. A client that crosses the alert threshold
+// inside the sliding window, with either, is reported and banned for a
+// while.
+type scanDetector struct {
+	mu        sync.Mutex
+	window    time.Duration
+	threshold int
+	perMinute int
+	banFor    time.Duration
+	exempt    []*net.IPNet
+	clients   map[string]*scanClient
+	pruned    time.Time
+}
+
+func newScanDetector(cfg *config.Config) *scanDetector {
+	d := &scanDetector{clients: make(map[string]*scanClient)}
+	d.configure(cfg)
+	return d
+}
+
+// configure changes the threshold, window, rate limit and bans, e.g. on
+// config reload. Bans already in place keep their end time.
+func (d *scanDetector) configure(cfg *config.Config) {
+	// Entries were validated when the config was loaded
+	exempt, _ := utils.ParseTrustedProxies(cfg.Security.ScanExemptIPs)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.threshold = cfg.Security.ScanAlertThreshold
+	d.window = cfg.Security.ScanAlertWindow
+	d.banFor = cfg.Security.ScanBanDuration
+	d.exempt = exempt
+	if d.perMinute != cfg.Security.ScanRateLimit {
+		d.perMinute = cfg.Security.ScanRateLimit
+		for _, client := range d.clients {
+			client.limiter = nil
+		}
+	}
+}
+
+// currentWindow returns the window and the ban duration
+func (d *scanDetector) currentWindow() (time.Duration, time.Duration) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.window, d.banFor
+}
+
+// admit reports whether a /track or /click request from ip may go ahead,
+// and if not, when to retry. banned is true only on the request that got
+// the client banned.
+func (d *scanDetector) admit(ip, trackingID, userAgent string, now time.Time) (retryAfter time.Duration, ok, banned bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.isExempt(ip) {
+		return 0, true, false
+	}
+	client := d.client(ip, now)
+	client.lastID, client.userAgent = trackingID, userAgent
+
+	if now.Before(client.bannedUntil) {
+		return client.bannedUntil.Sub(now), false, false
+	}
+	if d.perMinute <= 0 {
+		return 0, true, false
+	}
+
+	if client.limiter == nil {
+		// A minute's worth of burst, so the limit is on the average
+		client.limiter = rate.NewLimiter(rate.Every(time.Minute/time.Duration(d.perMinute)), d.perMinute)
+	}
+	if client.limiter.AllowN(now, 1) {
+		return 0, true, false
+	}
+
+	client.limited = append(d.recent(client.limited, now), now)
+	if d.threshold > 0 && len(client.limited) >= d.threshold && d.ban(client, BanRateLimit, now) {
+		return d.banFor, false, true
+	}
+	return time.Minute / time.Duration(d.perMinute), false, false
+}
+
+// record registers an invalid attempt from ip and returns the number of
+// attempts seen in the current window. alert is true only on the attempt
+// that crosses the threshold, so a sustained scan triggers a single alert.
+// banned is true when the attempt got the client banned, which happens
+// again if it carries on past a ban.
+func (d *scanDetector) record(ip, trackingID, userAgent string, now time.Time) (count int, alert, banned bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	client := d.client(ip, now)
+	client.lastID, client.userAgent = trackingID, userAgent
+	client.invalid = append(d.recent(client.invalid, now), now)
+
+	count = len(client.invalid)
+	alert = d.threshold > 0 && count == d.threshold
+	if d.threshold > 0 && count >= d.threshold && !now.Before(client.bannedUntil) && !d.isExempt(ip) {
+		banned = d.ban(client, BanInvalidIDs, now)
+	}
+	return count, alert, banned
+}
+
+// unban lifts ip's ban and forgets its history, e.g. for a mail provider's
+// image proxy caught by mistake
+func (d *scanDetector) unban(ip string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if _, ok := d.clients[ip]; !ok {
+		return false
+	}
+	delete(d.clients, ip)
+	return true
+}
+
+// suspects lists the clients with invalid attempts or rate-limited requests
+// in the current window, or a ban in force, most recently seen first
+func (d *scanDetector) suspects(now time.Time) []Scanner {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	scanners := []Scanner{}
+	for ip, client := range d.clients {
+		client.invalid = d.recent(client.invalid, now)
+		client.limited = d.recent(client.limited, now)
+		bannedNow := now.Before(client.bannedUntil)
+		if len(client.invalid) == 0 && len(client.limited) == 0 && !bannedNow {
+			continue
+		}
+		scanner := Scanner{
+			IP:              ip,
+			InvalidAttempts: len(client.invalid),
+			RateLimited:     len(client.limited),
+			LastTrackingID:  client.lastID,
+			UserAgent:       client.userAgent,
+			LastSeen:        client.lastSeen,
+		}
+		if bannedNow {
+			until := client.bannedUntil
+			scanner.BannedUntil, scanner.BanReason = &until, client.banReason
+		}
+		scanners = append(scanners, scanner)
+	}
+	sort.Slice(scanners, func(i, j int) bool { return scanners[i].LastSeen.After(scanners[j].LastSeen) })
+	return scanners
+}
+
+// client returns ip's entry, creating it if needed. Must hold d.mu.
+func (d *scanDetector) client(ip string, now time.Time) *scanClient {
+	d.prune(now)
+	client, ok := d.clients[ip]
+	if !ok {
+		client = &scanClient{}
+		d.clients[ip] = client
+	}
+	client.lastSeen = now
+	return client
+}
+
+// prune keeps the map from growing forever under a distributed scan, by
+// dropping clients that have been quiet for a window and a minute, when
+// the rate limiter has refilled, and aren't banned. Must hold d.mu.
+func (d *scanDetector) prune(now time.Time) {
+	if len(d.clients) <= 10000 || now.Sub(d.pruned) < 10*time.Second {
+		return
+	}
+	d.pruned = now
+	cutoff := now.Add(-d.window - time.Minute)
+	for ip, client := range d.clients {
+		if client.lastSeen.Before(cutoff) && !now.Before(client.bannedUntil) {
+			delete(d.clients, ip)
+		}
+	}
+}
+
+// recent drops the times that fell out of the window. Must hold d.mu.
+func (d *scanDetector) recent(times []time.Time, now time.Time) []time.Time {
+	cutoff := now.Add(-d.window)
+	kept := times[:0]
+	for _, ts := range times {
+		if ts.After(cutoff) {
+			kept = append(kept, ts)
+		}
+	}
+	return kept
+}
+
+// ban refuses client's requests for the ban duration, if bans are on. Must
+// hold d.mu.
+func (d *scanDetector) ban(client *scanClient, reason string, now time.Time) bool {
+	if d.banFor <= 0 {
+		return false
+	}
+	client.bannedUntil, client.banReason = now.Add(d.banFor), reason
+	return true
+}
+
+// isExempt reports whether ip is in SCAN_EXEMPT_IPS. Must hold d.mu.
+func (d *scanDetector) isExempt(ip string) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	for _, ipNet := range d.exempt {
+		if ipNet.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,89 @@
+package tracker
+
+import (
+	"sort"
+	"strings"
+
+	"email-tracker/models"
+)
+
+// Status filters for SearchEmails
+const (
+	StatusOpened   = "opened"
+	StatusUnopened = "unopened"
+	StatusBounced  = "bounced"
+	StatusFailed   = "failed"
+)
+
+// EmailQuery selects a page of a tenant's emails. Search matches recipients
+// and subjects case-insensitively; Tag and Status narrow the results
+// further.
+type EmailQuery struct {
+	Tenant   string
+	Search   string
+	Tag      string
+	Status   string
+	Filtered bool
+	Page     int
+	PerPage  int
+}
+
+// SearchEmails returns the requested page of matching emails, newest first,
+// along with the total number of matches.
+func (t *Tracker) SearchEmails(q EmailQuery) ([]*models.Email, int) {
+	search := strings.ToLower(strings.TrimSpace(q.Search))
+	tag := strings.ToLower(strings.TrimSpace(q.Tag))
+
+	matches := t.filterEmails(func(email *models.Email) bool {
+		if email.Tenant() != q.Tenant {
+			return false
+		}
+		if search != "" &&
+			!strings.Contains(strings.ToLower(email.To), search) &&
+			!strings.Contains(strings.ToLower(email.Subject), search) {
+			return false
+		}
+		if tag != "" && !hasTag(email, tag) {
+			return false
+		}
+		return q.Status == "" || hasStatus(email, q.Status, q.Filtered)
+	})
+
+	sort.Slice(matches, func(i, j int) bool { return matches[i].SentAt.After(matches[j].SentAt) })
+
+	total := len(matches)
+	start := (q.Page - 1) * q.PerPage
+	if q.Page < 1 || q.PerPage < 1 || start >= total {
+		return nil, total
+	}
+	end := start + q.PerPage
+	if end > total {
+		end = total
+	}
+	return matches[start:end], total
+}
+
+func hasTag(email *models.Email, tag string) bool {
+	for _, t := range email.Tags {
+		if strings.ToLower(t) == tag {
+			return true
+		}
+	}
+	return false
+}
+
+func hasStatus(email *models.Email, status string, filtered bool) bool {
+	switch status {
+	case StatusOpened:
+		return email.OpenStats(filtered).TotalOpens > 0
+	case StatusUnopened:
+		return email.OpenStats(filtered).TotalOpens == 0 &&
+			email.DeliveryStatus == models.DeliveryStatusDelivered
+	case StatusBounced:
+		return email.DeliveryStatus == models.DeliveryStatusBounced
+	case StatusFailed:
+		return email.DeliveryStatus == models.DeliveryStatusFailed
+	default:
+		return false
+	}
+}
@@ -0,0 +1,183 @@
+package tracker
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"hash/maphash"
+	"io"
+	"sync"
+	"time"
+
+	"email-tracker/config"
+	"email-tracker/utils"
+)
+
+// settings are the tracking behaviors that can change at runtime
+type settings struct {
+	dedupWindow     time.Duration
+	botFiltering    bool
+	signatureSecret []byte
+	// macs holds HMACs keyed with signatureSecret, reset and reused
+	// across requests
+	macs sync.Pool
+	// ipMode is config.IPModeFull, IPModeTruncate or IPModeHash
+	ipMode         string
+	storeUserAgent bool
+	// hashKey keys the hashes of redacted values: the configured salt, or
+	// the per-process key when there is none
+	hashKey []byte
+	// maxEntries caps the tracking IDs held in memory; 0 means no limit
+	maxEntries   int
+	storeUnknown bool
+}
+
+func (t *Tracker) storeSettings(cfg *config.Config) {
+	s := &settings{
+		dedupWindow:     cfg.Tracking.DedupWindow,
+		botFiltering:    cfg.Tracking.BotFiltering,
+		signatureSecret: []byte(cfg.Tracking.SignatureSecret),
+		ipMode:          cfg.Tracking.IPMode,
+		storeUserAgent:  cfg.Tracking.StoreUserAgent,
+		hashKey:         t.redactKey,
+		maxEntries:      cfg.Tracking.MaxEntries,
+		storeUnknown:    cfg.Tracking.StoreUnknownOpens,
+	}
+	if cfg.Tracking.HashSalt != "" {
+		s.hashKey = []byte(cfg.Tracking.HashSalt)
+	}
+	s.macs.New = func() any { return hmac.New(sha256.New, s.signatureSecret) }
+	t.settings.Store(s)
+}
+
+// signatureLen is the length of an encoded signature: 16 bytes of HMAC in
+// unpadded base64
+var signatureLen = base64.RawURLEncoding.EncodedLen(16)
+
+// signInto writes payload's signature into dst, which must hold
+// signatureLen bytes.
+func (s *settings) signInto(dst []byte, payload string) {
+	mac := s.macs.Get().(hash.Hash)
+	mac.Reset()
+	io.WriteString(mac, payload)
+	var sum [sha256.Size]byte
+	base64.RawURLEncoding.Encode(dst, mac.Sum(sum[:0])[:16])
+	s.macs.Put(mac)
+}
+
+// sign returns the signature for a pixel or link URL, or "" when signing is
+// off.
+func (s *settings) sign(payload string) string {
+	if len(s.signatureSecret) == 0 {
+		return ""
+	}
+	dst := make([]byte, signatureLen)
+	s.signInto(dst, payload)
+	return string(dst)
+}
+
+// verify checks a URL's signature. Everything passes when signing is off.
+func (s *settings) verify(payload, signature string) bool {
+	if len(s.signatureSecret) == 0 {
+		return true
+	}
+	if len(signature) != signatureLen {
+		return false
+	}
+	var expected [24]byte
+	s.signInto(expected[:signatureLen], payload)
+	return hmac.Equal([]byte(signature), expected[:signatureLen])
+}
+
+// newRedactKey returns the per-process key redacted IPs and user agents are
+// hashed with when no salt is configured, so the hashes can't be reversed by
+// trying every IPv4 address.
+func newRedactKey() []byte {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		panic(fmt.Sprintf("tracker: generating redaction key: %v", err))
+	}
+	return key
+}
+
+// redact truncates or hashes the IP and hashes the user agent as
+// configured, before the event is stored, persisted or notified about.
+// Hashes still tell clients apart, so unique opens and clicks keep counting
+// correctly; truncated IPs merge clients on the same network.
+func (t *Tracker) redact(s *settings, ip, userAgent string) (string, string) {
+	switch s.ipMode {
+	case config.IPModeTruncate:
+		ip = utils.TruncateIP(ip)
+	case config.IPModeHash:
+		ip = s.pseudonym(ip)
+	}
+	if !s.storeUserAgent {
+		userAgent = s.pseudonym(userAgent)
+	}
+	return ip, userAgent
+}
+
+func (s *settings) pseudonym(value string) string {
+	if value == "" {
+		return ""
+	}
+	mac := hmac.New(sha256.New, s.hashKey)
+	mac.Write([]byte(value))
+	return "anon-" + hex.EncodeToString(mac.Sum(nil)[:8])
+}
+
+// openDedup remembers the last open per email and client so repeated opens
+// inside the dedup window (image proxies, re-renders) are counted once.
+// Clients are remembered by a 64-bit hash of the tracking ID, IP and user
+// agent rather than the strings themselves.
+type openDedup struct {
+	mu        sync.Mutex
+	seed      maphash.Seed
+	seen      map[uint64]time.Time
+	lastSweep time.Time
+}
+
+func newOpenDedup() *openDedup {
+	return &openDedup{seed: maphash.MakeSeed(), seen: make(map[uint64]time.Time)}
+}
+
+// duplicate reports whether the client was seen opening trackingID within
+// window, and records it
+func (d *openDedup) duplicate(trackingID, ip, userAgent string, now time.Time, window time.Duration) bool {
+	if window <= 0 {
+		return false
+	}
+
+	var h maphash.Hash
+	h.SetSeed(d.seed)
+	h.WriteString(trackingID)
+	h.WriteByte(0)
+	h.WriteString(ip)
+	h.WriteByte(0)
+	h.WriteString(userAgent)
+	key := h.Sum64()
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	// Keep the map from growing forever, sweeping at most once a window so
+	// a burst of distinct clients doesn't rescan it on every open
+	if len(d.seen) > 10000 && now.Sub(d.lastSweep) > window {
+		d.lastSweep = now
+		for k, at := range d.seen {
+			if now.Sub(at) > window {
+				delete(d.seen, k)
+			}
+		}
+	}
+
+	if at, ok := d.seen[key]; ok && now.Sub(at) < window {
+		return true
+	}
+	d.seen[key] = now
+	return false
+}
@@ -0,0 +1,51 @@
+package tracker
+
+import (
+	"hash/maphash"
+	"sync"
+	"sync/atomic"
+
+	"email-tracker/models"
+)
+
+// shardCount is how many shards the tracking state is split into, so opens,
+// clicks and sends for different tracking IDs rarely wait on one another.
+const shardCount = 32
+
+// shard holds the tracking IDs that hash to it, under its own lock.
+type shard struct {
+	// mu guards the maps below and the emails and events stored in them.
+	// Emails and events handed out to callers are copies, so they can be
+	// read without holding it.
+	mu             sync.RWMutex
+	trackingData   map[string]*models.Email
+	trackingEvents map[string][]*models.TrackingEvent
+	clickEvents    map[string][]*models.ClickEvent
+	recency        *recency
+
+	// entries counts the tracking IDs held across all shards, for the
+	// entry limit
+	entries *atomic.Int64
+}
+
+// newShards returns n empty shards sharing one entry count. Trackers use
+// shardCount; tests compare against fewer.
+func newShards(n int) []*shard {
+	shards := make([]*shard, n)
+	entries := new(atomic.Int64)
+	for i := range shards {
+		shards[i] = &shard{
+			trackingData:   make(map[string]*models.Email),
+			trackingEvents: make(map[string][]*models.TrackingEvent),
+			clickEvents:    make(map[string][]*models.ClickEvent),
+			recency:        newRecency(),
+			entries:        entries,
+		}
+	}
+	return shards
+}
+
+// shardFor returns the shard trackingID lives in
+func (t *Tracker) shardFor(trackingID string) *shard {
+	return t.shards[maphash.String(t.shardSeed, trackingID)%uint64(len(t.shards))]
+}
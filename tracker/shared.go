@@ -0,0 +1,155 @@
+package tracker
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"email-tracker/cluster"
+	"email-tracker/models"
+)
+
+// SharedStore receives every change to the tracking state, so other
+// instances can see it. Saves must not block.
+type SharedStore interface {
+	SaveEmail(email *models.Email)
+	SaveOpen(event *models.TrackingEvent)
+	SaveClick(event *models.ClickEvent)
+	DeleteEmail(trackingID string)
+	// Cleanup removes what is past its retention, as CleanupOldEntries
+	// does in memory
+	Cleanup(ctx context.Context, now time.Time, emailMaxAge, eventMaxAge time.Duration) error
+	// Close writes out the changes still queued
+	Close(ctx context.Context) error
+}
+
+// sharedCleanupTimeout bounds a cleanup of the shared store
+const sharedCleanupTimeout = 5 * time.Minute
+
+// Share sends every change to store and runs the store's cleanup on
+// whichever instance claimer picks. Call it before serving requests.
+func (t *Tracker) Share(store SharedStore, claimer cluster.Claimer) {
+	t.shared = store
+	t.claimer = claimer
+}
+
+// cleanupShared removes expired entries from the shared store, once per
+// retention interval across all instances.
+func (t *Tracker) cleanupShared(policy *retention) {
+	if t.shared == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), sharedCleanupTimeout)
+	defer cancel()
+
+	// Claimed for most of an interval, so each instance's next tick finds
+	// the claim expired or held by whoever ran last
+	claimed, err := t.claimer.Claim(ctx, "cleanup", policy.interval*9/10)
+	if err != nil {
+		slog.Error("failed to claim shared store cleanup", "error", err)
+		return
+	}
+	if !claimed {
+		return
+	}
+
+	if err := t.shared.Cleanup(ctx, time.Now(), policy.emailMaxAge, policy.eventMaxAge); err != nil {
+		slog.Error("failed to clean up shared store", "error", err)
+	}
+}
+
+// ApplySharedEmail adds or updates an email registered or changed by another
+// instance. Its open and click counts are rebuilt from the events applied
+// here rather than taken from the other instance.
+func (t *Tracker) ApplySharedEmail(email *models.Email) {
+	s := t.shardFor(email.TrackingID)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if existing, ok := s.trackingData[email.TrackingID]; ok {
+		if existing.CampaignID != email.CampaignID {
+			t.changed(email.TrackingID, existing.CampaignID)
+		}
+		stats, filtered := existing.Stats, existing.FilteredStats
+		*existing = *email
+		existing.Stats, existing.FilteredStats = stats, filtered
+		t.changed(email.TrackingID, email.CampaignID)
+		return
+	}
+
+	email.Stats, email.FilteredStats = models.EmailStats{}, models.EmailStats{}
+	s.trackingData[email.TrackingID] = email
+	t.touch(s, email.TrackingID, t.settings.Load().maxEntries)
+	t.changed(email.TrackingID, email.CampaignID)
+}
+
+// ApplySharedOpen records an open another instance served.
+func (t *Tracker) ApplySharedOpen(event *models.TrackingEvent) {
+	s := t.shardFor(event.TrackingID)
+	s.mu.Lock()
+	email, ok := s.trackingData[event.TrackingID]
+	if !ok || hasOpen(s.trackingEvents[event.TrackingID], event.ID) {
+		s.mu.Unlock()
+		return
+	}
+	s.trackingEvents[event.TrackingID] = append(s.trackingEvents[event.TrackingID], event)
+	email.RecordOpen(event)
+	t.touch(s, event.TrackingID, t.settings.Load().maxEntries)
+	live := openEvent(email, event)
+	campaignID := email.CampaignID
+	s.mu.Unlock()
+
+	t.changed(event.TrackingID, campaignID)
+	t.events.Publish(live)
+}
+
+// ApplySharedClick records a click another instance redirected.
+func (t *Tracker) ApplySharedClick(event *models.ClickEvent) {
+	s := t.shardFor(event.TrackingID)
+	s.mu.Lock()
+	email, ok := s.trackingData[event.TrackingID]
+	if !ok || hasClick(s.clickEvents[event.TrackingID], event.ID) {
+		s.mu.Unlock()
+		return
+	}
+	s.clickEvents[event.TrackingID] = append(s.clickEvents[event.TrackingID], event)
+	email.RecordClick(event)
+	t.touch(s, event.TrackingID, t.settings.Load().maxEntries)
+	live := clickEvent(email, event)
+	campaignID := email.CampaignID
+	s.mu.Unlock()
+
+	t.changed(event.TrackingID, campaignID)
+	t.events.Publish(live)
+}
+
+// ApplySharedDelete forgets an email another instance deleted.
+func (t *Tracker) ApplySharedDelete(trackingID string) {
+	s := t.shardFor(trackingID)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if email, ok := s.trackingData[trackingID]; ok {
+		t.changed(trackingID, email.CampaignID)
+	}
+	s.forget(trackingID)
+}
+
+func hasOpen(events []*models.TrackingEvent, id string) bool {
+	for _, event := range events {
+		if event.ID == id {
+			return true
+		}
+	}
+	return false
+}
+
+func hasClick(clicks []*models.ClickEvent, id string) bool {
+	for _, click := range clicks {
+		if click.ID == id {
+			return true
+		}
+	}
+	return false
+}
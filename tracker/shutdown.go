@@ -0,0 +1,68 @@
+package tracker
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+func (t *Tracker) closing() bool {
+	select {
+	case <-t.stopping:
+		return true
+	default:
+		return false
+	}
+}
+
+// Close drains the tracker's background work in the order it flows: opens
+// still being geolocated, then deferred lookups, then the event store and
+// the shared store, and queued notifications last since they are the
+// slowest to go out. Every step stops waiting when ctx is done, and the
+// ones after it are skipped, since they could still be fed.
+func (t *Tracker) Close(ctx context.Context) error {
+	t.stopOnce.Do(func() { close(t.stopping) })
+
+	if err := waitGroup(ctx, &t.enriching); err != nil {
+		return fmt.Errorf("waiting for geo lookups: %w", err)
+	}
+	if t.geoQueue != nil {
+		close(t.geoQueue)
+		if err := wait(ctx, t.geoDone); err != nil {
+			return fmt.Errorf("draining geo backfill queue: %w", err)
+		}
+	}
+	if t.persist != nil {
+		if err := t.persist.close(ctx); err != nil {
+			return fmt.Errorf("flushing event store: %w", err)
+		}
+	}
+	if t.shared != nil {
+		if err := t.shared.Close(ctx); err != nil {
+			return fmt.Errorf("flushing shared store: %w", err)
+		}
+	}
+	close(t.notifyQueue)
+	if err := wait(ctx, t.notifyDone); err != nil {
+		return fmt.Errorf("draining notification queue: %w", err)
+	}
+	return nil
+}
+
+func wait(ctx context.Context, done <-chan struct{}) error {
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func waitGroup(ctx context.Context, wg *sync.WaitGroup) error {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	return wait(ctx, done)
+}
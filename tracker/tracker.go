@@ -6,37 +6,154 @@ import (
 	"crypto/rand"
 	"encoding/base64"
 	"fmt"
+	"hash/maphash"
+	"html"
 	"html/template"
+	"log/slog"
+	"net"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"email-tracker/analytics"
+	"email-tracker/cluster"
+	"email-tracker/config"
+	"email-tracker/counters"
+	"email-tracker/events"
+	"email-tracker/geo"
+	"email-tracker/logging"
 	"email-tracker/models"
+	"email-tracker/notification"
+	"email-tracker/usage"
 	"email-tracker/utils"
 )
 
 type NotificationSender interface {
-	SendNotification(ctx context.Context, to []string, subject string, data map[string]interface{}) error
+	SendNotification(ctx context.Context, account *notification.Account, to []string, subject string, data map[string]interface{}) error
+	SendEmail(ctx context.Context, to []string, subject, body string) error
 }
 
 type Tracker struct {
 	notificationSender NotificationSender
-	trackingData       map[string]*models.Email
-	trackingEvents     map[string][]*models.TrackingEvent
-	pixelTemplate      *template.Template
+	channels           NotificationChannels
+	usage              UsageMeter
+	engagement         Engagement
+	counters           counters.Counters
+	events             *events.Broker
+
+	// shards hold the emails, opens and clicks, split by tracking ID
+	shards        []*shard
+	shardSeed     maphash.Seed
+	pixelTemplate *template.Template
+	pixelPath     string
+	dedup         *openDedup
+	redactKey     []byte
+	geo           geo.Provider
+	geoChain      *geo.Chain
+	geoQueue      chan geoJob
+	geoDone       chan struct{}
+	notifyQueue   chan notifyJob
+	notifyWorkers int
+	notifyDone    chan struct{}
+	enriching     sync.WaitGroup
+	stopping      chan struct{}
+	stopOnce      sync.Once
+	persist       *eventBatcher
+	shared        SharedStore
+	claimer       cluster.Claimer
+	onChange      []func(trackingID, campaignID string)
+
+	invalidAttempts      atomic.Uint64
+	pendingNotifications atomic.Int64
+	geoBackfilled        atomic.Uint64
+	geoDropped           utils.LossCounter
+	geoFailed            utils.LossCounter
+	geoExpired           utils.LossCounter
+	notificationsDropped utils.LossCounter
+	eventsNotPersisted   utils.LossCounter
+	evicted              utils.LossCounter
+	notificationsFailed  utils.LossCounter
+	scans                *scanDetector
+	trustedProxies       []*net.IPNet
+	scanAlertEmail       atomic.Value
+	timeouts             atomic.Pointer[timeouts]
+	retention            atomic.Pointer[retention]
+	settings             atomic.Pointer[settings]
 }
 
-func NewTracker(notificationSender NotificationSender) *Tracker {
-	tmpl, err := template.ParseFiles("templates/tracking_pixel.html")
-	if err != nil {
-		fmt.Printf("Warning: Could not load tracking pixel template: %v\n", err)
-	}
+// timeouts bounds the tracker's outbound calls
+type timeouts struct {
+	geo          time.Duration
+	notification time.Duration
+}
 
-	return &Tracker{
+// NewTracker embeds the tracking pixel from templates, as loaded by
+// web.Templates. Geo providers make their requests with client.
+func NewTracker(cfg *config.Config, templates *template.Template, client *http.Client, notificationSender NotificationSender, counters counters.Counters, broker *events.Broker) *Tracker {
+	// Entries were validated when the config was loaded
+	trustedProxies, _ := utils.ParseTrustedProxies(cfg.Server.TrustedProxies)
+
+	t := &Tracker{
 		notificationSender: notificationSender,
-		trackingData:       make(map[string]*models.Email),
-		trackingEvents:     make(map[string][]*models.TrackingEvent),
-		pixelTemplate:      tmpl,
+		counters:           counters,
+		events:             broker,
+		shards:             newShards(shardCount),
+		shardSeed:          maphash.MakeSeed(),
+		claimer:            cluster.Local{},
+		pixelTemplate:      templates.Lookup("tracking_pixel.html"),
+		pixelPath:          cfg.Tracking.PixelPath,
+		dedup:              newOpenDedup(),
+		redactKey:          newRedactKey(),
+		scans:              newScanDetector(cfg),
+		trustedProxies:     trustedProxies,
+		notifyQueue:        make(chan notifyJob, cfg.Notifications.QueueSize),
+		notifyWorkers:      cfg.Notifications.Workers,
+		notifyDone:         make(chan struct{}),
+		geoDone:            make(chan struct{}),
+		stopping:           make(chan struct{}),
+	}
+
+	chain, err := geo.NewChain(cfg, client)
+	if err != nil {
+		slog.Warn("some geo providers are unavailable", "error", err)
+	}
+	t.geoChain = chain
+	network, err := geo.NewNetwork(cfg, chain)
+	if err != nil {
+		slog.Warn("ASN database unavailable, looking ASNs up over DNS", "error", err)
+	}
+	t.geo = geo.NewCache(cfg, network)
+	if cfg.GeoAPI.QueueSize > 0 {
+		t.geoQueue = make(chan geoJob, cfg.GeoAPI.QueueSize)
 	}
+	t.scanAlertEmail.Store(cfg.Security.ScanAlertEmail)
+	t.storeTimeouts(cfg)
+	t.storeRetention(cfg)
+	t.storeSettings(cfg)
+
+	return t
+}
+
+// ApplyConfig updates the settings that can change at runtime: the scan
+// alert recipient, threshold, window, rate limit and bans, timeouts, retention and tracking
+// behavior. The pixel path needs a restart.
+func (t *Tracker) ApplyConfig(cfg *config.Config) {
+	t.scans.configure(cfg)
+	t.scanAlertEmail.Store(cfg.Security.ScanAlertEmail)
+	t.storeTimeouts(cfg)
+	t.storeRetention(cfg)
+	t.storeSettings(cfg)
+}
+
+func (t *Tracker) storeTimeouts(cfg *config.Config) {
+	t.timeouts.Store(&timeouts{
+		geo:          cfg.Timeouts.Geo,
+		notification: cfg.Timeouts.Notification,
+	})
 }
 
 func (t *Tracker) GenerateTrackingID() (string, error) {
@@ -49,18 +166,18 @@ func (t *Tracker) GenerateTrackingID() (string, error) {
 }
 
 func (t *Tracker) EmbedTrackingPixel(emailContent, trackingID, baseURL string) (string, error) {
-	if t.pixelTemplate == nil {
-		return "", fmt.Errorf("tracking pixel template not loaded")
-	}
-
 	data := struct {
 		BaseURL    string
+		PixelPath  string
 		TrackingID string
 		Timestamp  int64
+		Signature  string
 	}{
 		BaseURL:    baseURL,
+		PixelPath:  t.pixelPath,
 		TrackingID: trackingID,
 		Timestamp:  time.Now().Unix(),
+		Signature:  t.settings.Load().sign(trackingID),
 	}
 
 	var pixelHTML bytes.Buffer
@@ -71,19 +188,43 @@ func (t *Tracker) EmbedTrackingPixel(emailContent, trackingID, baseURL string) (
 	return emailContent + pixelHTML.String(), nil
 }
 
+// TrackEmailOpen serves the pixel and flushes it before recording anything,
+// so the recipient's client never waits on the tracker and every request
+// answers the same way, whatever happens to it afterwards.
 func (t *Tracker) TrackEmailOpen(w http.ResponseWriter, r *http.Request, trackingID, baseURL string) {
-	ip := utils.GetClientIP(r)
+	writePixel(w)
+	if flusher, ok := w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+
+	t.recordOpen(r, trackingID, baseURL)
+}
+
+// recordOpen stores an open for a pixel that has already been served.
+func (t *Tracker) recordOpen(r *http.Request, trackingID, baseURL string) {
+	ip := utils.GetClientIP(r, t.trustedProxies)
 	userAgent := r.UserAgent()
+	settings := t.settings.Load()
 
-	geoInfo, err := utils.GetGeoLocation(ip)
-	if err != nil {
-		fmt.Printf("Error getting geo location: %v\n", err)
+	// Unsigned or forged pixel URLs are treated like unknown tracking IDs
+	if !settings.verify(trackingID, queryValue(r.URL.RawQuery, "sig")) {
+		t.recordInvalidAttempt(r.Context(), trackingID, ip, userAgent)
+		return
 	}
 
 	deviceInfo := utils.ParseUserAgent(userAgent)
 
+	s := t.shardFor(trackingID)
+	s.mu.Lock()
+	email, exists := s.trackingData[trackingID]
+
+	// Count repeated loads from the same client as a single open
+	if exists && t.dedup.duplicate(trackingID, ip, userAgent, time.Now(), settings.dedupWindow) {
+		s.mu.Unlock()
+		return
+	}
+
 	var emailID string
-	email, exists := t.trackingData[trackingID]
 	if exists {
 		emailID = email.ID
 	}
@@ -94,55 +235,210 @@ func (t *Tracker) TrackEmailOpen(w http.ResponseWriter, r *http.Request, trackin
 		EmailID:    emailID,
 		BaseURL:    baseURL,
 		IPAddress:  ip,
+		IPFamily:   utils.IPFamily(ip),
 		UserAgent:  userAgent,
-		Country:    geoInfo.Country,
-		City:       geoInfo.City,
-		Region:     geoInfo.Region,
-		ISP:        geoInfo.ISP,
 		OpenedAt:   time.Now(),
 		DeviceType: deviceInfo.DeviceType,
 		Browser:    deviceInfo.Browser,
 		OS:         deviceInfo.OS,
+		IsBot:      deviceInfo.IsBot && settings.botFiltering,
+
+		ClientName:    deviceInfo.ClientName,
+		ClientVersion: deviceInfo.ClientVersion,
+		OSVersion:     deviceInfo.OSVersion,
+		EmailClient:   deviceInfo.EmailClient,
 	}
+	event.IPAddress, event.UserAgent = t.redact(settings, event.IPAddress, event.UserAgent)
 
-	t.trackingEvents[trackingID] = append(t.trackingEvents[trackingID], event)
+	if exists {
+		event.IsBot = event.IsBot || settings.botFiltering && analytics.IsInstantOpen(email.SentAt, event.OpenedAt)
+		email.RecordOpen(event)
+	}
+	// Opens for unknown IDs are only counted unless asked for, so random
+	// IDs can't fill up memory
+	if exists || settings.storeUnknown {
+		s.trackingEvents[trackingID] = append(s.trackingEvents[trackingID], event)
+		t.touch(s, trackingID, settings.maxEntries)
+	}
+	s.mu.Unlock()
 
-	fmt.Printf("📧 Email opened - Tracking ID: %s, BaseURL: %s, IP: %s, Location: %s, %s\n",
-		trackingID, baseURL, ip, event.City, event.Country)
+	if exists {
+		t.changed(trackingID, email.CampaignID)
+	} else if settings.storeUnknown {
+		t.changed(trackingID, "")
+	}
 
-	// Send notification if needed
-	if exists && email.NotifyOnOpen {
-		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-		defer cancel()
+	if exists {
+		t.counters.RecordOpen(event, email.Tenant(), email.CampaignID)
+		t.meter(email.Tenant(), event.OpenedAt, usage.Counts{Opens: 1})
+		if !event.IsBot {
+			t.engaged(email, event.OpenedAt, false)
+		}
+	} else {
+		t.recordInvalidAttempt(r.Context(), trackingID, ip, userAgent)
+	}
 
-		if err := t.notificationSender.SendNotification(ctx, []string{email.NotifyEmail},
-			fmt.Sprintf("📧 Email Opened: %s", email.Subject),
-			map[string]interface{}{
-				"EmailSubject": email.Subject,
-				"Recipient":    email.To,
-				"OpenedAt":     event.OpenedAt.Format("2006-01-02 15:04:05"),
-				"IPAddress":    event.IPAddress,
-				"Location":     fmt.Sprintf("%s, %s, %s", event.City, event.Region, event.Country),
-				"Device":       event.DeviceType,
-				"Browser":      event.Browser,
-				"OS":           event.OS,
-				"ISP":          event.ISP,
-				"TrackingURL":  fmt.Sprintf("%s/track/%s", event.BaseURL, event.TrackingID),
-				"BaseURL":      event.BaseURL,
-				"Year":         event.OpenedAt.Year(),
-			}); err != nil {
-			fmt.Printf("Failed to send notification: %v\n", err)
+	// Look the location up and notify in the background, so the handler
+	// doesn't hold on to the connection for the lookup
+	if exists {
+		notify := email.NotifyOnOpen
+		if notify {
+			t.pendingNotifications.Add(1)
 		}
+		t.enriching.Go(func() { t.enrichOpen(email, event, ip, notify) })
 	}
+}
 
-	// Serve tracking pixel
-	w.Header().Set("Content-Type", "image/gif")
-	w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
-	w.Header().Set("Pragma", "no-cache")
-	w.Header().Set("Expires", "0")
+// Pixel response headers, stored straight into the header map so serving
+// a pixel doesn't canonicalize keys or allocate values. net/http only reads
+// them, and appending to one with Header.Add copies it first since each is
+// full.
+var (
+	pixelContentType   = []string{"image/gif"}
+	pixelContentLength = []string{strconv.Itoa(len(gifData))}
+	pixelCacheControl  = []string{"no-cache, no-store, must-revalidate"}
+	pixelPragma        = []string{"no-cache"}
+	pixelExpires       = []string{"0"}
+)
+
+// writePixel serves the tracking GIF.
+func writePixel(w http.ResponseWriter) {
+	h := w.Header()
+	h["Content-Type"] = pixelContentType
+	h["Content-Length"] = pixelContentLength
+	h["Cache-Control"] = pixelCacheControl
+	h["Pragma"] = pixelPragma
+	h["Expires"] = pixelExpires
+	w.WriteHeader(http.StatusOK)
 	w.Write(gifData)
 }
 
+// queryValue returns the first value of key in a raw query string without
+// parsing the whole query into a map.
+func queryValue(rawQuery, key string) string {
+	for rawQuery != "" {
+		var pair string
+		pair, rawQuery, _ = strings.Cut(rawQuery, "&")
+		name, value, _ := strings.Cut(pair, "=")
+		if name != key {
+			continue
+		}
+		if strings.ContainsAny(value, "%+") {
+			value, _ = url.QueryUnescape(value)
+		}
+		return value
+	}
+	return ""
+}
+
+// AdmitTracking reports whether a /track or /click request for trackingID
+// may go ahead. It doesn't if its client is over SCAN_RATE_LIMIT or banned
+// as a suspected scanner; retryAfter is then how long to wait.
+func (t *Tracker) AdmitTracking(r *http.Request, trackingID string) (retryAfter time.Duration, ok bool) {
+	ip := utils.GetClientIP(r, t.trustedProxies)
+	retryAfter, ok, banned := t.scans.admit(ip, trackingID, r.UserAgent(), time.Now())
+	if banned {
+		logging.FromContext(r.Context()).Error("banned tracking client over the rate limit",
+			"ip", ip, "until", time.Now().Add(retryAfter))
+	}
+	return retryAfter, ok
+}
+
+// Scanners lists the clients suspected of enumerating tracking IDs
+func (t *Tracker) Scanners() []Scanner {
+	return t.scans.suspects(time.Now())
+}
+
+// Unban lifts a suspected scanner's ban and clears its history. It reports
+// false if nothing was known about ip.
+func (t *Tracker) Unban(ip string) bool {
+	return t.scans.unban(ip)
+}
+
+// recordInvalidAttempt counts a hit for an unknown tracking ID and raises an
+// alert when a single IP looks like it is scanning for valid IDs.
+func (t *Tracker) recordInvalidAttempt(ctx context.Context, trackingID, ip, userAgent string) {
+	total := t.invalidAttempts.Add(1)
+	count, alert, banned := t.scans.record(ip, trackingID, userAgent, time.Now())
+
+	logger := logging.FromContext(ctx).With("tracking_id", trackingID, "ip", ip)
+	logger.Warn("invalid tracking attempt", "attempts_from_ip", count, "total_attempts", total)
+	if banned {
+		logger.Error("banned tracking client for invalid tracking IDs", "attempts_from_ip", count)
+	}
+
+	if !alert {
+		return
+	}
+
+	window, banFor := t.scans.currentWindow()
+	logger.Error("possible tracking ID scan", "attempts_from_ip", count, "window", window)
+
+	alertEmail := t.scanAlertEmail.Load().(string)
+	if alertEmail == "" {
+		return
+	}
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), t.timeouts.Load().notification)
+		defer cancel()
+
+		body := fmt.Sprintf(
+			"<p>Detected %d requests for unknown tracking IDs from <strong>%s</strong> within %s.</p>"+
+				"<p>User-Agent: %s</p><p>Last tracking ID tried: %s</p>",
+			count, html.EscapeString(ip), window,
+			html.EscapeString(userAgent), html.EscapeString(trackingID),
+		)
+		if banned {
+			body += fmt.Sprintf("<p>Its tracking requests are refused for %s. "+
+				"An admin can lift the ban with DELETE /api/scanners/%s.</p>", banFor, html.EscapeString(ip))
+		}
+		if err := t.notificationSender.SendEmail(ctx, []string{alertEmail},
+			fmt.Sprintf("🚨 Possible tracking ID scan from %s", ip), body); err != nil {
+			logger.Error("failed to send scan alert", "error", err)
+		}
+	}()
+}
+
+// InvalidAttempts returns how many /track and /click requests referenced an
+// unknown tracking ID since startup.
+func (t *Tracker) InvalidAttempts() uint64 {
+	return t.invalidAttempts.Load()
+}
+
+// PendingNotifications returns how many open notifications are waiting to be
+// sent, including those whose location is still being looked up.
+func (t *Tracker) PendingNotifications() int64 {
+	return t.pendingNotifications.Load()
+}
+
+// StorageStats counts what the tracker currently holds in memory.
+type StorageStats struct {
+	Backend     string `json:"backend"`
+	Emails      int    `json:"emails"`
+	OpenEvents  int    `json:"open_events"`
+	ClickEvents int    `json:"click_events"`
+}
+
+func (t *Tracker) StorageStats() StorageStats {
+	stats := StorageStats{Backend: "memory"}
+	if t.shared != nil {
+		stats.Backend = "redis"
+	}
+	for _, s := range t.shards {
+		s.mu.RLock()
+		stats.Emails += len(s.trackingData)
+		for _, events := range s.trackingEvents {
+			stats.OpenEvents += len(events)
+		}
+		for _, clicks := range s.clickEvents {
+			stats.ClickEvents += len(clicks)
+		}
+		s.mu.RUnlock()
+	}
+	return stats
+}
+
 var gifData = []byte{
 	0x47, 0x49, 0x46, 0x38, 0x39, 0x61,
 	0x01, 0x00, 0x01, 0x00, 0x80, 0x00,
@@ -153,72 +449,313 @@ var gifData = []byte{
 }
 
 func (t *Tracker) sendNotification(email *models.Email, event *models.TrackingEvent) {
+	defer t.pendingNotifications.Add(-1)
+
 	// Subject for the notification email
 	subject := fmt.Sprintf("📧 Email Opened: %s", email.Subject)
 
+	// The recipient's clock, when their timezone is known
+	var openedAtLocal string
+	if local, ok := event.LocalOpenedAt(); ok {
+		openedAtLocal = fmt.Sprintf("%s (%s)", local.Format("2006-01-02 15:04:05 MST"), event.Timezone)
+	}
+
 	// Prepare template data
 	data := map[string]interface{}{
-		"EmailSubject": email.Subject,
-		"Recipient":    email.To,
-		"OpenedAt":     event.OpenedAt.Format("2006-01-02 15:04:05"),
-		"IPAddress":    event.IPAddress,
-		"Location":     fmt.Sprintf("%s, %s, %s", event.City, event.Region, event.Country),
-		"Device":       event.DeviceType,
-		"Browser":      event.Browser,
-		"OS":           event.OS,
-		"ISP":          event.ISP,
-		"TrackingURL":  fmt.Sprintf("%s/track/%s", event.BaseURL, event.TrackingID),
-		"BaseURL":      event.BaseURL,
-		"Year":         event.OpenedAt.Year(),
-	}
-
-	// Recipients
-	recipients := []string{email.NotifyEmail}
-
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		"EmailSubject":  email.Subject,
+		"Recipient":     email.To,
+		"OpenedAt":      event.OpenedAt.UTC().Format("2006-01-02 15:04:05 UTC"),
+		"OpenedAtLocal": openedAtLocal,
+		"IPAddress":     event.IPAddress,
+		"Location":      fmt.Sprintf("%s, %s, %s", event.City, event.Region, event.Country),
+		"Device":        event.DeviceType,
+		"Browser":       event.Browser,
+		"EmailClient":   event.EmailClient,
+		"OS":            event.OS,
+		"ISP":           event.ISP,
+		"TrackingURL":   fmt.Sprintf("%s%s/%s", event.BaseURL, t.pixelPath, event.TrackingID),
+		"BaseURL":       event.BaseURL,
+		"Year":          event.OpenedAt.Year(),
+		"Branding":      t.notificationBranding(email),
+	}
+
+	// Recipients, the send's own or the tenant's
+	recipients, account := t.notificationRoute(email)
+	if len(recipients) == 0 {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), t.timeouts.Load().notification)
 	defer cancel()
 
 	// Send the notification email
-	if err := t.notificationSender.SendNotification(ctx, recipients, subject, data); err != nil {
-		fmt.Printf("Failed to send notification: %v\n", err)
+	if err := t.notificationSender.SendNotification(ctx, account, recipients, subject, data); err != nil {
+		t.notificationsFailed.Add(1)
+		slog.Error("failed to send open notification", "tracking_id", email.TrackingID,
+			"recipient_hash", logging.RecipientHash(recipients[0]), "error", err)
+	}
+}
+
+// openEvent describes an open for live subscribers, along with the email's
+// updated counters.
+func openEvent(email *models.Email, event *models.TrackingEvent) events.Event {
+	return events.Event{
+		Type:        events.TypeOpen,
+		Tenant:      email.Tenant(),
+		TrackingID:  email.TrackingID,
+		CampaignID:  email.CampaignID,
+		Subject:     email.Subject,
+		Recipient:   email.To,
+		City:        event.City,
+		Country:     event.Country,
+		DeviceType:  event.DeviceType,
+		Browser:     event.Browser,
+		EmailClient: event.EmailClient,
+		OS:          event.OS,
+		IsBot:       event.IsBot,
+		TotalOpens:  email.Stats.TotalOpens,
+		UniqueOpens: email.Stats.UniqueOpens,
+		TotalClicks: email.Stats.TotalClicks,
+		At:          event.OpenedAt,
+	}
+}
+
+// OnChange registers fn to be told whenever what is held for a tracking ID
+// changes: the email is registered, updated, bounced or deleted, or an open
+// or click is recorded for it. campaignID is the email's campaign, if any.
+// Ageing out and eviction aren't reported. fn may be called with the
+// tracking ID's shard locked, so it must be quick and must not call back
+// into the tracker. Call before serving requests.
+func (t *Tracker) OnChange(fn func(trackingID, campaignID string)) {
+	t.onChange = append(t.onChange, fn)
+}
+
+func (t *Tracker) changed(trackingID, campaignID string) {
+	for _, fn := range t.onChange {
+		fn(trackingID, campaignID)
 	}
 }
 
+// RegisterEmail starts tracking email. The tracker owns it from then on;
+// callers must not change it.
 func (t *Tracker) RegisterEmail(email *models.Email, trackingID string) {
-	t.trackingData[trackingID] = email
+	s := t.shardFor(trackingID)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.trackingData[trackingID] = email
+	t.touch(s, trackingID, t.settings.Load().maxEntries)
+	if t.shared != nil {
+		t.shared.SaveEmail(copyEmail(email))
+	}
+	t.changed(trackingID, email.CampaignID)
+	if email.DeliveryStatus != models.DeliveryStatusFailed {
+		t.meter(email.Tenant(), email.SentAt, usage.Counts{Emails: 1, Recipients: int64(recipientCount(email))})
+	}
+}
+
+// DeleteEmail forgets an email along with its opens and clicks. It reports
+// whether the email existed.
+func (t *Tracker) DeleteEmail(trackingID string) bool {
+	s := t.shardFor(trackingID)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	email, exists := s.trackingData[trackingID]
+	if !exists {
+		return false
+	}
+
+	s.forget(trackingID)
+	if t.shared != nil {
+		t.shared.DeleteEmail(trackingID)
+	}
+	t.changed(trackingID, email.CampaignID)
+	return true
+}
+
+// MarkBounced records a bounce reported for the email behind trackingID.
+func (t *Tracker) MarkBounced(trackingID, bounceType, reason string) (*models.Email, error) {
+	s := t.shardFor(trackingID)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	email, exists := s.trackingData[trackingID]
+	if !exists {
+		return nil, fmt.Errorf("email not found")
+	}
+
+	now := time.Now()
+	email.DeliveryStatus = models.DeliveryStatusBounced
+	email.BouncedAt = &now
+	email.BounceType = bounceType
+	email.BounceReason = reason
+
+	if t.shared != nil {
+		t.shared.SaveEmail(copyEmail(email))
+	}
+	t.changed(trackingID, email.CampaignID)
+	return copyEmail(email), nil
+}
+
+// GetEmail returns the registered email for a tracking ID, including its open
+// aggregates, or nil if the ID is unknown.
+func (t *Tracker) GetEmail(trackingID string) *models.Email {
+	s := t.shardFor(trackingID)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if email, exists := s.trackingData[trackingID]; exists {
+		return copyEmail(email)
+	}
+	return nil
 }
 
 func (t *Tracker) GetTrackingStats(trackingID string) *models.TrackingEvent {
-	if events, exists := t.trackingEvents[trackingID]; exists && len(events) > 0 {
-		return events[len(events)-1]
+	s := t.shardFor(trackingID)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if events, exists := s.trackingEvents[trackingID]; exists && len(events) > 0 {
+		return copyEvent(events[len(events)-1])
 	}
 	return nil
 }
 
 func (t *Tracker) GetAllTrackingEvents(trackingID string) []*models.TrackingEvent {
-	if events, exists := t.trackingEvents[trackingID]; exists {
-		return events
+	s := t.shardFor(trackingID)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if events, exists := s.trackingEvents[trackingID]; exists {
+		return copyEvents(nil, events)
 	}
 	return nil
 }
 
-func (t *Tracker) CleanupOldEntries(maxAge time.Duration) {
-	cutoff := time.Now().Add(-maxAge)
+// AllEmails returns every registered email. Shards are read one at a time,
+// so this isn't a snapshot of a single instant.
+func (t *Tracker) AllEmails() []*models.Email {
+	var emails []*models.Email
+	for _, s := range t.shards {
+		s.mu.RLock()
+		for _, email := range s.trackingData {
+			emails = append(emails, copyEmail(email))
+		}
+		s.mu.RUnlock()
+	}
+	return emails
+}
+
+// OwnedBy reports whether the tenant may see what is held for trackingID.
+// Events outlive their email when events are kept longer than emails; with
+// no email to tell whose they are, they are left to the default tenant.
+func (t *Tracker) OwnedBy(trackingID, tenant string) bool {
+	s := t.shardFor(trackingID)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return ownedBy(s.trackingData[trackingID], tenant)
+}
+
+// ownedBy is OwnedBy for an email looked up with its shard locked
+func ownedBy(email *models.Email, tenant string) bool {
+	if email == nil {
+		return tenant == models.DefaultTenant
+	}
+	return email.Tenant() == tenant
+}
+
+// AllTrackingEvents returns every stored event the tenant owns.
+func (t *Tracker) AllTrackingEvents(tenant string) []*models.TrackingEvent {
+	var all []*models.TrackingEvent
+	for _, s := range t.shards {
+		s.mu.RLock()
+		for trackingID, events := range s.trackingEvents {
+			if ownedBy(s.trackingData[trackingID], tenant) {
+				all = copyEvents(all, events)
+			}
+		}
+		s.mu.RUnlock()
+	}
+	return all
+}
+
+// GetCampaignEvents returns the events of every email the tenant sent as
+// part of the given campaign.
+func (t *Tracker) GetCampaignEvents(tenant, campaignID string) []*models.TrackingEvent {
+	var all []*models.TrackingEvent
+	for _, s := range t.shards {
+		s.mu.RLock()
+		for trackingID, email := range s.trackingData {
+			if email.CampaignID == campaignID && email.Tenant() == tenant {
+				all = copyEvents(all, s.trackingEvents[trackingID])
+			}
+		}
+		s.mu.RUnlock()
+	}
+	return all
+}
 
-	for id, email := range t.trackingData {
-		if email.SentAt.Before(cutoff) {
-			delete(t.trackingData, id)
-			delete(t.trackingEvents, id)
+// GetRecipientEvents returns the open events of every email of the tenant
+// with at least one recipient address accepted by match.
+func (t *Tracker) GetRecipientEvents(tenant string, match func(recipient string) bool) []*models.TrackingEvent {
+	var all []*models.TrackingEvent
+	for _, s := range t.shards {
+		s.mu.RLock()
+		for trackingID, email := range s.trackingData {
+			if email.Tenant() != tenant {
+				continue
+			}
+			for _, to := range strings.Split(email.To, ",") {
+				if match(strings.ToLower(strings.TrimSpace(to))) {
+					all = copyEvents(all, s.trackingEvents[trackingID])
+					break
+				}
+			}
 		}
+		s.mu.RUnlock()
 	}
+	return all
+}
 
-	for trackingID, events := range t.trackingEvents {
-		var recentEvents []*models.TrackingEvent
-		for _, event := range events {
-			if event.OpenedAt.After(cutoff) {
-				recentEvents = append(recentEvents, event)
+// DetectAnomalies re-runs anomaly detection for every email with opens and
+// stores the findings as warnings on the email's stats.
+func (t *Tracker) DetectAnomalies() {
+	for _, s := range t.shards {
+		s.mu.Lock()
+		for trackingID, email := range s.trackingData {
+			events := s.trackingEvents[trackingID]
+			if len(events) == 0 {
+				continue
 			}
+
+			warnings := analytics.Anomalies(email, events)
+			if len(warnings) > len(email.Stats.Warnings) {
+				slog.Warn("anomalies detected", "tracking_id", trackingID, "anomalies", len(warnings))
+			}
+			email.Stats.Warnings = warnings
 		}
-		t.trackingEvents[trackingID] = recentEvents
+		s.mu.Unlock()
+	}
+}
+
+// copyEmail returns a copy of email that stays consistent while the
+// original keeps being updated. Slices are shared, since the tracker only
+// ever appends to them or replaces them.
+func copyEmail(email *models.Email) *models.Email {
+	copied := *email
+	return &copied
+}
+
+func copyEvent(event *models.TrackingEvent) *models.TrackingEvent {
+	copied := *event
+	return &copied
+}
+
+// copyEvents appends copies of events to dst
+func copyEvents(dst, events []*models.TrackingEvent) []*models.TrackingEvent {
+	for _, event := range events {
+		dst = append(dst, copyEvent(event))
 	}
+	return dst
 }
@@ -0,0 +1,195 @@
+package tracker
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"email-tracker/config"
+	"email-tracker/counters"
+	"email-tracker/events"
+	"email-tracker/models"
+	"email-tracker/web"
+)
+
+// newTestTracker returns a tracker on the default config, with nothing
+// running in the background.
+func newTestTracker(tb testing.TB) *Tracker {
+	return newTestTrackerWithShards(tb, shardCount)
+}
+
+// newTestTrackerWithShards is newTestTracker with its state split into
+// shards shards, 1 being a single lock over everything.
+func newTestTrackerWithShards(tb testing.TB, shards int) *Tracker {
+	tb.Helper()
+	slog.SetDefault(slog.New(slog.DiscardHandler))
+	cfg, err := config.LoadConfig(config.Options{})
+	if err != nil {
+		tb.Fatalf("load config: %v", err)
+	}
+	templates, err := web.Templates("")
+	if err != nil {
+		tb.Fatalf("load templates: %v", err)
+	}
+	t := NewTracker(cfg, templates, http.DefaultClient, nil, counters.Noop{}, events.NewBroker())
+	t.shards = newShards(shards)
+	// Opens are enriched in the background
+	tb.Cleanup(t.enriching.Wait)
+	return t
+}
+
+func testEmail(trackingID string, sentAt time.Time) *models.Email {
+	return &models.Email{
+		ID:             trackingID,
+		TrackingID:     trackingID,
+		To:             "someone@example.com",
+		Subject:        "Hello",
+		SentAt:         sentAt,
+		DeliveryStatus: models.DeliveryStatusDelivered,
+	}
+}
+
+// openRequest is a signed pixel request for trackingID from a private
+// address, so no geo provider is asked where it is
+func (t *Tracker) openRequest(trackingID string, client int) *http.Request {
+	r := httptest.NewRequest(http.MethodGet, "/track/"+trackingID+"?sig="+t.settings.Load().sign(trackingID), nil)
+	r.RemoteAddr = fmt.Sprintf("10.0.%d.%d:4321", client/256%256, client%256)
+	r.Header.Set("User-Agent", fmt.Sprintf("Mozilla/5.0 (Windows NT 10.0) Thunderbird/%d", client))
+	return r
+}
+
+// TestConcurrentOpensRegistersAndCleanup runs opens, registrations and
+// cleanups against the same shards at once. It finds nothing by itself;
+// run it with go test -race ./tracker to catch unsynchronized access.
+func TestConcurrentOpensRegistersAndCleanup(t *testing.T) {
+	tr := newTestTracker(t)
+
+	const (
+		workers = 8
+		rounds  = 200
+	)
+	// Half of the emails are old enough for every cleanup to drop them
+	old := time.Now().Add(-48 * time.Hour)
+	for i := range workers * rounds {
+		sentAt := time.Now()
+		if i%2 == 1 {
+			sentAt = old
+		}
+		id := fmt.Sprintf("seed-%d", i)
+		tr.RegisterEmail(testEmail(id, sentAt), id)
+	}
+
+	var wg sync.WaitGroup
+	for w := range workers {
+		wg.Go(func() {
+			for i := range rounds {
+				id := fmt.Sprintf("seed-%d", w*rounds+i)
+				tr.TrackEmailOpen(httptest.NewRecorder(), tr.openRequest(id, w*rounds+i), id, "http://localhost")
+			}
+		})
+		wg.Go(func() {
+			for i := range rounds {
+				id := fmt.Sprintf("new-%d-%d", w, i)
+				tr.RegisterEmail(testEmail(id, time.Now()), id)
+			}
+		})
+	}
+	wg.Go(func() {
+		for range rounds {
+			tr.CleanupOldEntries(24*time.Hour, 24*time.Hour)
+		}
+	})
+	wg.Wait()
+
+	// Registered emails that are recent enough survive cleanup
+	for w := range workers {
+		for i := range rounds {
+			id := fmt.Sprintf("new-%d-%d", w, i)
+			if tr.GetEmail(id) == nil {
+				t.Fatalf("email %s was registered but is gone", id)
+			}
+		}
+	}
+	for i := range workers * rounds {
+		id := fmt.Sprintf("seed-%d", i)
+		email := tr.GetEmail(id)
+		if i%2 == 1 {
+			if email != nil {
+				t.Fatalf("email %s is past retention but still kept", id)
+			}
+			continue
+		}
+		if email == nil || email.Stats.TotalOpens != 1 {
+			t.Fatalf("email %s should be kept with its one open, got %+v", id, email)
+		}
+	}
+}
+
+// BenchmarkTrackEmailOpen serves the pixel for a known email, building
+// the request and waiting for the background enrichment each time, so
+// the figures are those of a whole open. Every open comes from another
+// address, so none is deduplicated.
+func BenchmarkTrackEmailOpen(b *testing.B) {
+	tr := newTestTracker(b)
+	const id = "bench"
+	tr.RegisterEmail(testEmail(id, time.Now().Add(-time.Hour)), id)
+	sig := tr.settings.Load().sign(id)
+
+	b.ReportAllocs()
+	i := 0
+	for b.Loop() {
+		r := httptest.NewRequest(http.MethodGet, "/track/"+id+"?sig="+sig, nil)
+		r.RemoteAddr = fmt.Sprintf("10.%d.%d.%d:4321", i>>16&255, i>>8&255, i&255)
+		r.Header.Set("User-Agent", "Mozilla/5.0 (Windows NT 10.0; Win64; x64) Thunderbird/115.0")
+		tr.TrackEmailOpen(httptest.NewRecorder(), r, id, "http://localhost")
+		tr.enriching.Wait()
+		i++
+	}
+}
+
+// BenchmarkParallelOpensAndRegisters mixes opens of known emails with
+// sends of new ones, three to one, from every goroutine at once, which is
+// what the sharded store is meant to keep from queueing on a single lock.
+// It runs against a single shard, as the store was before sharding, and
+// the shards trackers use. Compare them at -cpu 1,4,8.
+func BenchmarkParallelOpensAndRegisters(b *testing.B) {
+	for _, shards := range []int{1, shardCount} {
+		b.Run(fmt.Sprintf("shards=%d", shards), func(b *testing.B) {
+			benchmarkParallelOpensAndRegisters(b, shards)
+		})
+	}
+}
+
+func benchmarkParallelOpensAndRegisters(b *testing.B, shards int) {
+	tr := newTestTrackerWithShards(b, shards)
+	const known = 1024
+	sigs := make([]string, known)
+	for i := range known {
+		id := fmt.Sprintf("known-%d", i)
+		tr.RegisterEmail(testEmail(id, time.Now().Add(-time.Hour)), id)
+		sigs[i] = tr.settings.Load().sign(id)
+	}
+
+	var next atomic.Int64
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			n := int(next.Add(1))
+			if n%4 == 0 {
+				id := fmt.Sprintf("sent-%d", n)
+				tr.RegisterEmail(testEmail(id, time.Now()), id)
+				continue
+			}
+			id := fmt.Sprintf("known-%d", n%known)
+			r := httptest.NewRequest(http.MethodGet, "/track/"+id+"?sig="+sigs[n%known], nil)
+			r.RemoteAddr = fmt.Sprintf("10.%d.%d.%d:4321", n>>16&255, n>>8&255, n&255)
+			r.Header.Set("User-Agent", "Mozilla/5.0 (Windows NT 10.0; Win64; x64) Thunderbird/115.0")
+			tr.TrackEmailOpen(httptest.NewRecorder(), r, id, "http://localhost")
+		}
+	})
+}
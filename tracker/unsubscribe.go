@@ -0,0 +1,23 @@
+package tracker
+
+// unsubscribePayload is what an unsubscribe link's signature covers. It
+// differs from the pixel's so a pixel URL can't be turned into one.
+func unsubscribePayload(trackingID string) string {
+	return "unsubscribe/" + trackingID
+}
+
+// UnsubscribeURL returns the link that unsubscribes the recipients of the
+// email behind trackingID.
+func (t *Tracker) UnsubscribeURL(trackingID, baseURL string) string {
+	link := baseURL + "/unsubscribe/" + trackingID
+	if sig := t.settings.Load().sign(unsubscribePayload(trackingID)); sig != "" {
+		link += "?sig=" + sig
+	}
+	return link
+}
+
+// VerifyUnsubscribe checks an unsubscribe link's signature. Everything
+// passes when signing is off.
+func (t *Tracker) VerifyUnsubscribe(trackingID, signature string) bool {
+	return t.settings.Load().verify(unsubscribePayload(trackingID), signature)
+}
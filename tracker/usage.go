@@ -0,0 +1,54 @@
+package tracker
+
+import (
+	"encoding/json"
+	"time"
+
+	"email-tracker/usage"
+)
+
+// UsageMeter adds up what each tenant uses, for billing
+type UsageMeter interface {
+	Add(tenant string, at time.Time, n usage.Counts)
+}
+
+// SetUsageMeter meters the emails registered for sending, other than
+// failed sends, and the opens and clicks recorded here. Opens and clicks
+// another instance shares aren't metered again. Call it before serving
+// requests.
+func (t *Tracker) SetUsageMeter(meter UsageMeter) {
+	t.usage = meter
+}
+
+// meter adds n to the tenant's usage, when metering
+func (t *Tracker) meter(tenant string, at time.Time, n usage.Counts) {
+	if t.usage != nil {
+		t.usage.Add(tenant, at, n)
+	}
+}
+
+// TenantStorage returns the bytes each tenant's emails, opens and clicks
+// take up, measured as their JSON. Only tenants with emails are in it.
+func (t *Tracker) TenantStorage() map[string]int64 {
+	storage := make(map[string]int64)
+	for _, s := range t.shards {
+		s.mu.RLock()
+		for trackingID, email := range s.trackingData {
+			size := jsonSize(email)
+			for _, event := range s.trackingEvents[trackingID] {
+				size += jsonSize(event)
+			}
+			for _, click := range s.clickEvents[trackingID] {
+				size += jsonSize(click)
+			}
+			storage[email.Tenant()] += size
+		}
+		s.mu.RUnlock()
+	}
+	return storage
+}
+
+func jsonSize(v any) int64 {
+	data, _ := json.Marshal(v)
+	return int64(len(data))
+}
@@ -0,0 +1,149 @@
+package usage
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"email-tracker/config"
+	"email-tracker/utils"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	keyPrefix = "email-tracker:usage"
+
+	// Increments run off the request path but shouldn't pile up if Redis
+	// is slow
+	writeTimeout = 500 * time.Millisecond
+
+	// fieldReported and fieldStorage follow the tenant in a month's hash
+	// fields, along with the metrics
+	fieldReported = "reported"
+	fieldStorage  = "storage_bytes"
+)
+
+// raiseTo sets a hash field to a value when it is higher, keeping the most
+// storage seen
+var raiseTo = redis.NewScript(`
+local current = tonumber(redis.call("HGET", KEYS[1], ARGV[1]) or "0")
+if tonumber(ARGV[2]) > current then
+	redis.call("HSET", KEYS[1], ARGV[1], ARGV[2])
+end
+return 0`)
+
+// RedisMeter keeps usage in one Redis hash per month, with a
+// tenant:metric field per count, so the instances of a cluster add up to
+// the same totals.
+type RedisMeter struct {
+	client        *redis.Client
+	writeFailures utils.LossCounter
+}
+
+func NewRedisMeter(cfg *config.Config) *RedisMeter {
+	return &RedisMeter{
+		client: redis.NewClient(&redis.Options{
+			Addr:     fmt.Sprintf("%s:%d", cfg.Redis.Host, cfg.Redis.Port),
+			Password: cfg.Redis.Password,
+			DB:       cfg.Redis.DB,
+		}),
+	}
+}
+
+func (r *RedisMeter) Add(tenant string, at time.Time, n Counts) {
+	go r.incr(tenant, at, n)
+}
+
+func (r *RedisMeter) incr(tenant string, at time.Time, n Counts) {
+	ctx, cancel := context.WithTimeout(context.Background(), writeTimeout)
+	defer cancel()
+
+	key := monthKey(at)
+	pipe := r.client.Pipeline()
+	for metric, value := range map[string]int64{
+		MetricEmails: n.Emails, MetricRecipients: n.Recipients, MetricOpens: n.Opens, MetricClicks: n.Clicks,
+	} {
+		if value != 0 {
+			pipe.HIncrBy(ctx, key, tenant+":"+metric, value)
+		}
+	}
+	if n.StorageBytes > 0 {
+		raiseTo.Run(ctx, pipe, []string{key}, tenant+":"+fieldStorage, n.StorageBytes)
+	}
+	pipe.Expire(ctx, key, keepMonths*31*24*time.Hour)
+
+	if _, err := pipe.Exec(ctx); err != nil {
+		r.writeFailures.Add(1)
+		slog.Error("failed to update Redis usage", "tenant", tenant, "error", err)
+	}
+}
+
+func (r *RedisMeter) Month(ctx context.Context, month time.Time) ([]Usage, error) {
+	fields, err := r.client.HGetAll(ctx, monthKey(month)).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	byTenant := make(map[string]*Usage)
+	for field, value := range fields {
+		tenant, metric, ok := strings.Cut(field, ":")
+		if !ok || metric == fieldReported {
+			continue
+		}
+		u, ok := byTenant[tenant]
+		if !ok {
+			u = &Usage{Tenant: tenant, Month: MonthKey(month)}
+			byTenant[tenant] = u
+		}
+		n, _ := strconv.ParseInt(value, 10, 64)
+		switch metric {
+		case MetricEmails:
+			u.Emails = n
+		case MetricRecipients:
+			u.Recipients = n
+		case MetricOpens:
+			u.Opens = n
+		case MetricClicks:
+			u.Clicks = n
+		case fieldStorage:
+			u.StorageBytes = n
+		}
+	}
+
+	usage := make([]Usage, 0, len(byTenant))
+	for _, u := range byTenant {
+		usage = append(usage, *u)
+	}
+	sort.Slice(usage, func(i, j int) bool { return usage[i].Tenant < usage[j].Tenant })
+	return usage, nil
+}
+
+func (r *RedisMeter) Reported(ctx context.Context, tenant string, month time.Time) (int64, error) {
+	n, err := r.client.HGet(ctx, monthKey(month), tenant+":"+fieldReported).Int64()
+	if err == redis.Nil {
+		return 0, nil
+	}
+	return n, err
+}
+
+func (r *RedisMeter) SetReported(ctx context.Context, tenant string, month time.Time, n int64) error {
+	return r.client.HSet(ctx, monthKey(month), tenant+":"+fieldReported, n).Err()
+}
+
+// WriteFailures counts increments lost because Redis didn't take them.
+func (r *RedisMeter) WriteFailures() utils.LossCount {
+	return r.writeFailures.Snapshot()
+}
+
+func (r *RedisMeter) Close() error {
+	return r.client.Close()
+}
+
+func monthKey(month time.Time) string {
+	return keyPrefix + ":" + MonthKey(month)
+}
@@ -0,0 +1,197 @@
+package usage
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"email-tracker/cluster"
+	"email-tracker/config"
+)
+
+// lateReportWindow is how long into a month the last of the month before
+// is still reported. Stripe takes meter events up to 35 days old.
+const lateReportWindow = 72 * time.Hour
+
+// Customers has the billing customer each tenant is charged as
+type Customers interface {
+	BillingCustomers() map[string]string
+}
+
+// StripeReporter reports each tenant's usage to a Stripe billing meter
+// as it grows, so Stripe bills it with the tenant's subscription. Each
+// report is the growth since the last one, sent as a meter event with the
+// tenant's Stripe customer ID.
+type StripeReporter struct {
+	client    *http.Client
+	apiURL    string
+	apiKey    string
+	event     string
+	metric    string
+	interval  time.Duration
+	meter     Meter
+	customers Customers
+	claimer   cluster.Claimer
+}
+
+// NewStripeReporter returns a reporter of meter, or nil when no Stripe API
+// key is configured.
+func NewStripeReporter(cfg *config.Config, client *http.Client, meter Meter, customers Customers) *StripeReporter {
+	if cfg.Usage.StripeAPIKey == "" {
+		return nil
+	}
+	return &StripeReporter{
+		client:    client,
+		apiURL:    strings.TrimSuffix(cfg.Usage.StripeAPIURL, "/"),
+		apiKey:    cfg.Usage.StripeAPIKey,
+		event:     cfg.Usage.StripeMeterEvent,
+		metric:    cfg.Usage.StripeMetric,
+		interval:  cfg.Usage.StripeInterval,
+		meter:     meter,
+		customers: customers,
+		claimer:   cluster.Local{},
+	}
+}
+
+// SetClaimer makes sure each round of reports is sent by only one of the
+// instances sharing claimer. Call it before Run.
+func (r *StripeReporter) SetClaimer(claimer cluster.Claimer) {
+	r.claimer = claimer
+}
+
+// Run blocks, reporting every interval.
+func (r *StripeReporter) Run() {
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		if !r.claim(now) {
+			continue
+		}
+		if err := r.Report(context.Background(), now.UTC()); err != nil {
+			slog.Error("failed to report usage to Stripe", "error", err)
+		}
+	}
+}
+
+// claim reports whether this instance reports for the interval now is in
+func (r *StripeReporter) claim(now time.Time) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	name := fmt.Sprintf("usage-report:%d", now.Truncate(r.interval).Unix())
+	claimed, err := r.claimer.Claim(ctx, name, r.interval)
+	if err != nil {
+		slog.Error("failed to claim usage report", "report", name, "error", err)
+		return false
+	}
+	return claimed
+}
+
+// Report sends what each tenant with a billing customer used since the
+// last report, for this month and, early on, the month before. It carries
+// on past a tenant that fails, returning the first error.
+func (r *StripeReporter) Report(ctx context.Context, now time.Time) error {
+	customers := r.customers.BillingCustomers()
+	if len(customers) == 0 {
+		return nil
+	}
+
+	months := []time.Time{now}
+	thisMonth := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+	if now.Sub(thisMonth) < lateReportWindow {
+		months = append([]time.Time{thisMonth.AddDate(0, -1, 0)}, months...)
+	}
+
+	var firstErr error
+	for _, month := range months {
+		usage, err := r.meter.Month(ctx, month)
+		if err != nil {
+			return fmt.Errorf("read usage for %s: %w", MonthKey(month), err)
+		}
+		// Usage of a month past is stamped at its end, so Stripe bills it
+		// in that month
+		at := now
+		if end := time.Date(month.Year(), month.Month()+1, 1, 0, 0, 0, 0, time.UTC); end.Before(now) {
+			at = end.Add(-time.Second)
+		}
+		for _, u := range usage {
+			customer, ok := customers[u.Tenant]
+			if !ok {
+				continue
+			}
+			if err := r.reportTenant(ctx, u, customer, month, at); err != nil {
+				slog.Error("failed to report tenant usage to Stripe", "tenant", u.Tenant, "month", u.Month, "error", err)
+				if firstErr == nil {
+					firstErr = err
+				}
+			}
+		}
+	}
+	return firstErr
+}
+
+func (r *StripeReporter) reportTenant(ctx context.Context, u Usage, customer string, month, at time.Time) error {
+	reported, err := r.meter.Reported(ctx, u.Tenant, month)
+	if err != nil {
+		return err
+	}
+	total := u.Metric(r.metric)
+	if total <= reported {
+		return nil
+	}
+
+	// The identifier makes Stripe drop a report sent again after its
+	// answer was lost
+	identifier := fmt.Sprintf("%s-%s-%d", u.Tenant, u.Month, reported)
+	if err := r.send(ctx, customer, total-reported, identifier, at); err != nil {
+		return err
+	}
+	return r.meter.SetReported(ctx, u.Tenant, month, total)
+}
+
+// send creates one meter event
+func (r *StripeReporter) send(ctx context.Context, customer string, value int64, identifier string, at time.Time) error {
+	form := url.Values{
+		"event_name":                  {r.event},
+		"identifier":                  {identifier},
+		"timestamp":                   {strconv.FormatInt(at.Unix(), 10)},
+		"payload[stripe_customer_id]": {customer},
+		"payload[value]":              {strconv.FormatInt(value, 10)},
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, r.apiURL+"/v1/billing/meter_events", strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+r.apiKey)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 200 && resp.StatusCode <= 299 {
+		return nil
+	}
+
+	var answer struct {
+		Error struct {
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if json.Unmarshal(body, &answer) == nil && answer.Error.Message != "" {
+		return fmt.Errorf("stripe answered %s: %s", resp.Status, answer.Error.Message)
+	}
+	return fmt.Errorf("stripe answered %s", resp.Status)
+}
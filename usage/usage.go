@@ -0,0 +1,317 @@
+// Package usage meters what each tenant uses per calendar month, for
+// billing: the emails and recipients it sent, the opens and clicks
+// tracked for it and the storage its data takes up.
+package usage
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"email-tracker/config"
+)
+
+// Metrics a usage can be billed by
+const (
+	MetricEmails     = "emails"
+	MetricRecipients = "recipients"
+	MetricOpens      = "opens"
+	MetricClicks     = "clicks"
+)
+
+// keepMonths is how many months of usage are kept, the current one
+// included
+const keepMonths = 24
+
+// flushInterval is how often the file meter writes its counts
+const flushInterval = time.Minute
+
+// Counts is usage to add, or added up over a month. StorageBytes isn't
+// added up: a month keeps the most seen in it.
+type Counts struct {
+	Emails       int64 `json:"emails"`
+	Recipients   int64 `json:"recipients"`
+	Opens        int64 `json:"opens"`
+	Clicks       int64 `json:"clicks"`
+	StorageBytes int64 `json:"storage_bytes"`
+}
+
+// Metric returns the count of one of the billable metrics.
+func (c Counts) Metric(metric string) int64 {
+	switch metric {
+	case MetricEmails:
+		return c.Emails
+	case MetricRecipients:
+		return c.Recipients
+	case MetricOpens:
+		return c.Opens
+	case MetricClicks:
+		return c.Clicks
+	}
+	return 0
+}
+
+func (c *Counts) add(n Counts) {
+	c.Emails += n.Emails
+	c.Recipients += n.Recipients
+	c.Opens += n.Opens
+	c.Clicks += n.Clicks
+	c.StorageBytes = max(c.StorageBytes, n.StorageBytes)
+}
+
+// Usage is one tenant's usage in one month, as "2006-01"
+type Usage struct {
+	Tenant string `json:"tenant"`
+	Month  string `json:"month"`
+	Counts
+}
+
+// Meter adds up usage by tenant and month.
+type Meter interface {
+	// Add counts n for the tenant in the month of at. It doesn't wait on
+	// storage.
+	Add(tenant string, at time.Time, n Counts)
+	// Month returns every tenant's usage in the month of month, by tenant.
+	Month(ctx context.Context, month time.Time) ([]Usage, error)
+	// Reported and SetReported keep how much of a tenant's month was
+	// reported for billing
+	Reported(ctx context.Context, tenant string, month time.Time) (int64, error)
+	SetReported(ctx context.Context, tenant string, month time.Time, n int64) error
+	Close() error
+}
+
+// New returns a meter shared through Redis when it is enabled, as the
+// instances of a cluster all add to it, and one kept in cfg.Usage.File
+// otherwise.
+func New(cfg *config.Config) (Meter, error) {
+	if cfg.Redis.Enabled {
+		return NewRedisMeter(cfg), nil
+	}
+	return OpenFile(cfg.Usage.File)
+}
+
+// MonthKey is how a month is named, "2006-01"
+func MonthKey(t time.Time) string {
+	return t.UTC().Format("2006-01")
+}
+
+// record is a tenant's month as held and written to the file
+type record struct {
+	Usage
+	Reported int64 `json:"reported,omitempty"`
+}
+
+// FileMeter keeps usage in memory and writes it to a JSON Lines file, one
+// line per tenant and month, every minute and when closed. Without a file
+// it only lives in memory.
+type FileMeter struct {
+	mu      sync.Mutex
+	path    string
+	records map[string]map[string]*record
+	dirty   bool
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// OpenFile loads the usage kept in path, if any, and starts writing to it.
+func OpenFile(path string) (*FileMeter, error) {
+	m := &FileMeter{
+		path:    path,
+		records: make(map[string]map[string]*record),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	if path == "" {
+		close(m.done)
+		return m, nil
+	}
+
+	file, err := os.Open(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("open usage file: %w", err)
+	}
+	if err == nil {
+		defer file.Close()
+		scanner := bufio.NewScanner(file)
+		for line := 1; scanner.Scan(); line++ {
+			var r record
+			if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+				return nil, fmt.Errorf("usage file line %d: %w", line, err)
+			}
+			m.month(r.Month)[r.Tenant] = &r
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, fmt.Errorf("read usage file: %w", err)
+		}
+	}
+
+	go m.run()
+	return m, nil
+}
+
+// month returns the records of a month. Must be called with m.mu held.
+func (m *FileMeter) month(key string) map[string]*record {
+	records, ok := m.records[key]
+	if !ok {
+		records = make(map[string]*record)
+		m.records[key] = records
+	}
+	return records
+}
+
+// record returns a tenant's record for a month. Must be called with m.mu
+// held.
+func (m *FileMeter) record(tenant, month string) *record {
+	records := m.month(month)
+	r, ok := records[tenant]
+	if !ok {
+		r = &record{Usage: Usage{Tenant: tenant, Month: month}}
+		records[tenant] = r
+	}
+	return r
+}
+
+func (m *FileMeter) Add(tenant string, at time.Time, n Counts) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.record(tenant, MonthKey(at)).add(n)
+	m.dirty = true
+}
+
+func (m *FileMeter) Month(_ context.Context, month time.Time) ([]Usage, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	usage := []Usage{}
+	for _, r := range m.records[MonthKey(month)] {
+		usage = append(usage, r.Usage)
+	}
+	sort.Slice(usage, func(i, j int) bool { return usage[i].Tenant < usage[j].Tenant })
+	return usage, nil
+}
+
+func (m *FileMeter) Reported(_ context.Context, tenant string, month time.Time) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if r, ok := m.records[MonthKey(month)][tenant]; ok {
+		return r.Reported, nil
+	}
+	return 0, nil
+}
+
+func (m *FileMeter) SetReported(_ context.Context, tenant string, month time.Time, n int64) error {
+	m.mu.Lock()
+	m.record(tenant, MonthKey(month)).Reported = n
+	m.dirty = true
+	m.mu.Unlock()
+
+	// Written right away, so a restart doesn't report it again
+	return m.flush()
+}
+
+// run writes the counts every flushInterval until the meter is closed
+func (m *FileMeter) run() {
+	defer close(m.done)
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := m.flush(); err != nil {
+				slog.Error("failed to write usage file", "error", err)
+			}
+		case <-m.stop:
+			return
+		}
+	}
+}
+
+// flush rewrites the file with the months kept, when anything changed. The
+// new file is written alongside and renamed over the old one, so a failure
+// leaves the old one intact.
+func (m *FileMeter) flush() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.path == "" || !m.dirty {
+		return nil
+	}
+
+	oldest := MonthKey(time.Now().UTC().AddDate(0, -(keepMonths - 1), 0))
+	var lines []byte
+	for month, records := range m.records {
+		if month < oldest {
+			delete(m.records, month)
+			continue
+		}
+		for _, r := range records {
+			line, err := json.Marshal(r)
+			if err != nil {
+				return err
+			}
+			lines = append(append(lines, line...), '\n')
+		}
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(m.path), filepath.Base(m.path)+".*")
+	if err != nil {
+		return fmt.Errorf("rewrite usage file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	if _, err := tmp.Write(lines); err != nil {
+		return fmt.Errorf("rewrite usage file: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		return fmt.Errorf("rewrite usage file: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), m.path); err != nil {
+		return fmt.Errorf("rewrite usage file: %w", err)
+	}
+	m.dirty = false
+	return nil
+}
+
+// Close stops the periodic writes and writes the counts one last time.
+func (m *FileMeter) Close() error {
+	select {
+	case <-m.stop:
+		return nil
+	default:
+		close(m.stop)
+	}
+	<-m.done
+	return m.flush()
+}
+
+var csvHeader = []string{"tenant", "month", "emails", "recipients", "opens", "clicks", "storage_bytes"}
+
+// WriteCSV writes usage as CSV, one row per tenant and month.
+func WriteCSV(w io.Writer, usage []Usage) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write(csvHeader); err != nil {
+		return err
+	}
+	for _, u := range usage {
+		record := []string{u.Tenant, u.Month}
+		for _, n := range []int64{u.Emails, u.Recipients, u.Opens, u.Clicks, u.StorageBytes} {
+			record = append(record, strconv.FormatInt(n, 10))
+		}
+		if err := cw.Write(record); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"email-tracker/usage"
+
+	"github.com/gin-gonic/gin"
+)
+
+// exportUsage returns each tenant's usage in a month, this one unless
+// month=2006-01 says otherwise, as JSON or, with format=csv, as CSV.
+func (s *Server) exportUsage(c *gin.Context) {
+	month := time.Now().UTC()
+	if q := c.Query("month"); q != "" {
+		parsed, err := time.Parse("2006-01", q)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "month must be like 2006-01"})
+			return
+		}
+		month = parsed
+	}
+
+	// This month's storage is measured again, rather than as of the
+	// hourly measurement
+	if usage.MonthKey(month) == usage.MonthKey(time.Now()) {
+		now := time.Now()
+		for tenant, bytes := range s.tracker.TenantStorage() {
+			s.usage.Add(tenant, now, usage.Counts{StorageBytes: bytes})
+		}
+	}
+
+	tenantUsage, err := s.usage.Month(c.Request.Context(), month)
+	if err != nil {
+		s.serverError(c, http.StatusServiceUnavailable, "failed to read usage", err)
+		return
+	}
+
+	switch c.DefaultQuery("format", "json") {
+	case "json":
+		var total usage.Counts
+		for _, u := range tenantUsage {
+			total.Emails += u.Emails
+			total.Recipients += u.Recipients
+			total.Opens += u.Opens
+			total.Clicks += u.Clicks
+			total.StorageBytes += u.StorageBytes
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"month":   usage.MonthKey(month),
+			"tenants": tenantUsage,
+			"total":   total,
+		})
+	case "csv":
+		c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="usage-%s.csv"`, usage.MonthKey(month)))
+		c.Header("Content-Type", "text/csv")
+		if err := usage.WriteCSV(c.Writer, tenantUsage); err != nil {
+			c.Error(err)
+		}
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "format must be json or csv"})
+	}
+}
@@ -1,159 +1,161 @@
 package utils
 
 import (
-	"encoding/json"
 	"fmt"
-	"io"
 	"net"
 	"net/http"
+	"net/netip"
 	"strings"
-	"time"
-
-	"email-tracker/models"
 )
 
-type DeviceInfo struct {
-	DeviceType string
-	Browser    string
-	OS         string
-}
-
-func GetClientIP(r *http.Request) string {
-	// 1. Cloudflare / some CDNs / modern proxies sometimes use this
-	if cf := r.Header.Get("CF-Connecting-IP"); cf != "" {
-		if ip := net.ParseIP(cf); ip != nil {
-			return ip.String()
+// ParseTrustedProxies parses the IPs and CIDRs of proxies whose forwarding
+// headers can be believed.
+func ParseTrustedProxies(entries []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(entries))
+	for _, entry := range entries {
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid trusted proxy %q", entry)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
 		}
-	}
-
-	// 2. X-Real-IP  (set by nginx/apache when configured with real_ip module)
-	if real := r.Header.Get("X-Real-IP"); real != "" {
-		if ip := net.ParseIP(real); ip != nil {
-			return ip.String()
+		_, ipNet, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q: %w", entry, err)
 		}
+		nets = append(nets, ipNet)
 	}
+	return nets, nil
+}
 
-	// 3. X-Forwarded-For – take the RIGHTMOST non-private IP
-	if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
-		parts := strings.Split(xff, ",")
-		for i := len(parts) - 1; i >= 0; i-- {
-			ipStr := strings.TrimSpace(parts[i])
-			if ip := net.ParseIP(ipStr); ip != nil {
-				// Skip private/reserved ranges (very rough check)
-				if !ip.IsPrivate() && !ip.IsLoopback() && !ip.IsMulticast() {
-					return ipStr
-				}
-			}
+func isTrusted(ip net.IP, trusted []*net.IPNet) bool {
+	for _, ipNet := range trusted {
+		if ipNet.Contains(ip) {
+			return true
 		}
 	}
-
-	// 4. Fallback – direct connection or no proxy headers
-	host, _, err := net.SplitHostPort(r.RemoteAddr)
-	if err == nil {
-		return host
-	}
-	return r.RemoteAddr
+	return false
 }
 
-func GetGeoLocation(ip string) (*models.GeoLocation, error) {
-	// ip-api.com
-	if location, err := getGeoFromIPAPI(ip); err == nil {
-		return location, nil
-	}
+// sharedAddressSpace is the carrier-grade NAT range (RFC 6598), which is no
+// more locatable than a private network
+var sharedAddressSpace = netip.MustParsePrefix("100.64.0.0/10")
 
-	// Fallback: Return basic info
-	return &models.GeoLocation{
-		IP: ip,
-	}, fmt.Errorf("could not determine location")
+// NormalizeIP returns ip in canonical form: IPv4-mapped IPv6 addresses such
+// as ::ffff:1.2.3.4 become plain IPv4, IPv6 is compressed and lowercased and
+// zones are dropped. Anything that isn't an IP is returned unchanged.
+func NormalizeIP(ip string) string {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return ip
+	}
+	return addr.WithZone("").Unmap().String()
 }
 
-func getGeoFromIPAPI(ip string) (*models.GeoLocation, error) {
-	url := fmt.Sprintf("http://ip-api.com/json/%s", ip)
-
-	client := &http.Client{Timeout: 5 * time.Second}
-	resp, err := client.Get(url)
+// IPFamily reports whether ip is "ipv4" or "ipv6", or "" if it isn't an IP.
+func IPFamily(ip string) string {
+	addr, err := netip.ParseAddr(ip)
 	if err != nil {
-		return nil, err
+		return ""
 	}
-	defer resp.Body.Close()
+	if addr.Unmap().Is4() {
+		return "ipv4"
+	}
+	return "ipv6"
+}
 
-	body, err := io.ReadAll(resp.Body)
+// IsPublicIP reports whether ip is a routable internet address. Private,
+// loopback, link-local, CGNAT and unspecified addresses, which geo
+// providers can't place, are not.
+func IsPublicIP(ip string) bool {
+	addr, err := netip.ParseAddr(ip)
 	if err != nil {
-		return nil, err
+		return false
 	}
+	addr = addr.WithZone("").Unmap()
+	return addr.IsGlobalUnicast() && !addr.IsPrivate() && !sharedAddressSpace.Contains(addr)
+}
 
-	var data struct {
-		Status  string  `json:"status"`
-		Country string  `json:"country"`
-		Region  string  `json:"regionName"`
-		City    string  `json:"city"`
-		ISP     string  `json:"isp"`
-		Lat     float64 `json:"lat"`
-		Lon     float64 `json:"lon"`
+// TruncateIP zeroes the host part of ip: the last octet of an IPv4
+// address, everything past the /48 of an IPv6 one. Anything that isn't an
+// IP is dropped, since it can't be truncated.
+func TruncateIP(ip string) string {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return ""
 	}
-
-	if err := json.Unmarshal(body, &data); err != nil {
-		return nil, err
+	addr = addr.WithZone("").Unmap()
+	bits := 48
+	if addr.Is4() {
+		bits = 24
 	}
+	prefix, _ := addr.Prefix(bits)
+	return prefix.Addr().String()
+}
 
-	if data.Status != "success" {
-		return nil, fmt.Errorf("API returned non-success status")
-	}
-	fmt.Println("data:")
-	return &models.GeoLocation{
-		IP:      ip,
-		Country: data.Country,
-		City:    data.City,
-		Region:  data.Region,
-		ISP:     data.ISP,
-		Lat:     fmt.Sprintf("%f", data.Lat),
-		Lon:     fmt.Sprintf("%f", data.Lon),
-	}, nil
+// GetClientIP returns the normalized address of the client behind r.
+// Forwarding headers are only honored when the direct peer is one of the
+// trusted proxies, since anyone can set them otherwise.
+func GetClientIP(r *http.Request, trusted []*net.IPNet) string {
+	return NormalizeIP(clientIP(r, trusted))
 }
 
-func ParseUserAgent(userAgent string) *DeviceInfo {
-	info := &DeviceInfo{
-		DeviceType: "Desktop",
-		Browser:    "Unknown",
-		OS:         "Unknown",
+// IsHTTPS reports whether the client reached us over HTTPS, either directly
+// or through a trusted proxy that says so in X-Forwarded-Proto.
+func IsHTTPS(r *http.Request, trusted []*net.IPNet) bool {
+	if r.TLS != nil {
+		return true
+	}
+	peer := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		peer = host
 	}
+	if peerIP := net.ParseIP(peer); peerIP == nil || !isTrusted(peerIP, trusted) {
+		return false
+	}
+	return strings.EqualFold(r.Header.Get("X-Forwarded-Proto"), "https")
+}
 
-	ua := strings.ToLower(userAgent)
+func clientIP(r *http.Request, trusted []*net.IPNet) string {
+	peer := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		peer = host
+	}
+	if peerIP := net.ParseIP(peer); peerIP == nil || !isTrusted(peerIP, trusted) {
+		return peer
+	}
 
-	// Detect device type
-	if strings.Contains(ua, "mobile") {
-		info.DeviceType = "Mobile"
-	} else if strings.Contains(ua, "tablet") {
-		info.DeviceType = "Tablet"
+	// 1. Cloudflare / some CDNs / modern proxies sometimes use this
+	if cf := r.Header.Get("CF-Connecting-IP"); cf != "" {
+		if ip := net.ParseIP(cf); ip != nil {
+			return ip.String()
+		}
 	}
 
-	// Detect browser
-	switch {
-	case strings.Contains(ua, "chrome"):
-		info.Browser = "Chrome"
-	case strings.Contains(ua, "firefox"):
-		info.Browser = "Firefox"
-	case strings.Contains(ua, "safari") && !strings.Contains(ua, "chrome"):
-		info.Browser = "Safari"
-	case strings.Contains(ua, "edge"):
-		info.Browser = "Edge"
-	case strings.Contains(ua, "opera"):
-		info.Browser = "Opera"
+	// 2. X-Real-IP  (set by nginx/apache when configured with real_ip module)
+	if real := r.Header.Get("X-Real-IP"); real != "" {
+		if ip := net.ParseIP(real); ip != nil {
+			return ip.String()
+		}
 	}
 
-	// Detect OS
-	switch {
-	case strings.Contains(ua, "windows"):
-		info.OS = "Windows"
-	case strings.Contains(ua, "mac os"):
-		info.OS = "macOS"
-	case strings.Contains(ua, "linux"):
-		info.OS = "Linux"
-	case strings.Contains(ua, "android"):
-		info.OS = "Android"
-	case strings.Contains(ua, "iphone") || strings.Contains(ua, "ipad"):
-		info.OS = "iOS"
+	// 3. X-Forwarded-For – take the RIGHTMOST IP that isn't one of our proxies
+	if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
+		parts := strings.Split(xff, ",")
+		for i := len(parts) - 1; i >= 0; i-- {
+			ipStr := strings.TrimSpace(parts[i])
+			if ip := net.ParseIP(ipStr); ip != nil && !isTrusted(ip, trusted) {
+				return ip.String()
+			}
+		}
 	}
 
-	return info
+	// 4. Fallback – the proxy sent no usable forwarding headers
+	return peer
 }
@@ -2,16 +2,29 @@ package utils
 
 import (
 	"crypto/rand"
+	"encoding/hex"
 	"fmt"
+	"net/mail"
 	"os"
 	"regexp"
 	"strings"
 )
 
 func GenerateUUID() string {
-	b := make([]byte, 16)
-	rand.Read(b)
-	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+	var b [16]byte
+	rand.Read(b[:])
+
+	var out [36]byte
+	hex.Encode(out[0:8], b[0:4])
+	out[8] = '-'
+	hex.Encode(out[9:13], b[4:6])
+	out[13] = '-'
+	hex.Encode(out[14:18], b[6:8])
+	out[18] = '-'
+	hex.Encode(out[19:23], b[8:10])
+	out[23] = '-'
+	hex.Encode(out[24:], b[10:])
+	return string(out[:])
 }
 
 func ValidateEmail(email string) bool {
@@ -20,18 +33,13 @@ func ValidateEmail(email string) bool {
 	return re.MatchString(email)
 }
 
-func SanitizeHTML(input string) string {
-	// Remove potentially dangerous tags
-	re := regexp.MustCompile(`<script.*?>.*?</script>`)
-	input = re.ReplaceAllString(input, "")
-
-	re = regexp.MustCompile(`on\w+=".*?"`)
-	input = re.ReplaceAllString(input, "")
-
-	re = regexp.MustCompile(`javascript:`)
-	input = re.ReplaceAllString(input, "")
-
-	return input
+// NormalizeAddress lowercases an email address, taking it out of a
+// "Name <address>" form if need be, so addresses can be compared.
+func NormalizeAddress(address string) string {
+	if addr, err := mail.ParseAddress(address); err == nil {
+		address = addr.Address
+	}
+	return strings.ToLower(strings.TrimSpace(address))
 }
 
 func ExtractDomain(email string) string {
@@ -0,0 +1,38 @@
+package utils
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// LossCounter counts occurrences of data being dropped or left incomplete,
+// remembering when it last happened. The zero value is ready to use.
+type LossCounter struct {
+	count atomic.Uint64
+	last  atomic.Int64
+}
+
+// LossCount is a snapshot of a LossCounter
+type LossCount struct {
+	Count  uint64     `json:"count"`
+	LastAt *time.Time `json:"last_at,omitempty"`
+}
+
+func (c *LossCounter) Add(n uint64) {
+	c.count.Add(n)
+	c.last.Store(time.Now().UnixNano())
+}
+
+func (c *LossCounter) Snapshot() LossCount {
+	snapshot := LossCount{Count: c.count.Load()}
+	if last := c.last.Load(); last != 0 {
+		at := time.Unix(0, last)
+		snapshot.LastAt = &at
+	}
+	return snapshot
+}
+
+// Since reports whether anything was lost after t.
+func (l LossCount) Since(t time.Time) bool {
+	return l.LastAt != nil && l.LastAt.After(t)
+}
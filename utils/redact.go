@@ -0,0 +1,30 @@
+package utils
+
+import (
+	"errors"
+	"net/url"
+)
+
+// RedactURL drops the credentials, query and fragment from raw, where API
+// keys and tokens are usually passed, keeping enough to tell which
+// endpoint it is.
+func RedactURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "[unparseable URL]"
+	}
+	u.User = nil
+	u.RawQuery = ""
+	u.Fragment = ""
+	return u.String()
+}
+
+// RedactURLError returns err with the URL of a failed HTTP request
+// redacted, as net/http puts the whole URL, keys included, in its errors.
+func RedactURLError(err error) error {
+	var urlErr *url.Error
+	if !errors.As(err, &urlErr) {
+		return err
+	}
+	return &url.Error{Op: urlErr.Op, URL: RedactURL(urlErr.URL), Err: urlErr.Err}
+}
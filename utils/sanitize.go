@@ -0,0 +1,218 @@
+package utils
+
+import (
+	"bytes"
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+// allowedElements are the tags kept in sanitized HTML: what email layouts
+// are built from, without anything that runs code, loads other documents
+// or submits data.
+var allowedElements = map[string]bool{
+	"a": true, "abbr": true, "address": true, "b": true, "big": true, "blockquote": true,
+	"body": true, "br": true, "caption": true, "center": true, "cite": true, "code": true,
+	"col": true, "colgroup": true, "dd": true, "del": true, "div": true, "dl": true,
+	"dt": true, "em": true, "font": true, "h1": true, "h2": true, "h3": true, "h4": true,
+	"h5": true, "h6": true, "head": true, "hr": true, "html": true, "i": true, "img": true,
+	"ins": true, "li": true, "meta": true, "ol": true, "p": true, "pre": true, "q": true,
+	"s": true, "small": true, "span": true, "strike": true, "strong": true, "style": true,
+	"sub": true, "sup": true, "table": true, "tbody": true, "td": true, "tfoot": true,
+	"th": true, "thead": true, "title": true, "tr": true, "u": true, "ul": true,
+}
+
+// droppedWithContent are removed together with everything inside them;
+// other tags that aren't allowed are removed but their text is kept.
+var droppedWithContent = map[string]bool{
+	"applet": true, "embed": true, "frame": true, "frameset": true, "iframe": true,
+	"math": true, "noembed": true, "noframes": true, "noscript": true, "object": true,
+	"script": true, "select": true, "svg": true, "template": true, "textarea": true,
+	"xmp": true,
+}
+
+// allowedAttributes are kept on any allowed element. href and src are
+// handled separately, as their URLs need checking.
+var allowedAttributes = map[string]bool{
+	"align": true, "alt": true, "bgcolor": true, "border": true, "cellpadding": true,
+	"cellspacing": true, "class": true, "color": true, "cols": true, "colspan": true,
+	"dir": true, "face": true, "height": true, "hspace": true, "lang": true,
+	"rowspan": true, "size": true, "span": true, "style": true, "summary": true,
+	"title": true, "valign": true, "vspace": true, "width": true,
+}
+
+// metaAttributes are the only ones kept on meta, which could otherwise
+// redirect with http-equiv="refresh"
+var metaAttributes = map[string]bool{"charset": true, "name": true, "content": true}
+
+// linkSchemes are the URL schemes allowed in href; imageSchemes in src
+var (
+	linkSchemes  = map[string]bool{"http": true, "https": true, "mailto": true, "tel": true}
+	imageSchemes = map[string]bool{"http": true, "https": true, "cid": true}
+)
+
+// unsafeCSS are fragments that make a style run code or fetch URLs, which
+// drop the whole style attribute or element they appear in
+var unsafeCSS = []string{"expression", "javascript:", "vbscript:", "url(", "@import", "behavior", "-moz-binding"}
+
+// SanitizeHTML keeps only allowlisted elements and attributes of input, so
+// a body can be sent and shown in a browser without running anything:
+// scripts, frames, forms, event handlers, javascript: URLs and CSS that
+// executes or loads URLs are all removed. Comments are dropped. Text is
+// re-escaped, so markup hidden in malformed tags can't come back.
+func SanitizeHTML(input string) string {
+	var out bytes.Buffer
+	z := html.NewTokenizer(strings.NewReader(input))
+
+	// skipping is the element whose content is being dropped, and depth
+	// how many of it are open, in case they nest
+	skipping, depth := "", 0
+	inStyle := false
+	for {
+		tt := z.Next()
+		if tt == html.ErrorToken {
+			// io.EOF, as input is read from memory
+			return out.String()
+		}
+		token := z.Token()
+
+		if skipping != "" {
+			switch {
+			case tt == html.StartTagToken && token.Data == skipping:
+				depth++
+			case tt == html.EndTagToken && token.Data == skipping:
+				if depth--; depth == 0 {
+					skipping = ""
+				}
+			}
+			continue
+		}
+
+		switch tt {
+		case html.StartTagToken, html.SelfClosingTagToken:
+			if droppedWithContent[token.Data] && tt == html.StartTagToken {
+				skipping, depth = token.Data, 1
+				continue
+			}
+			if !allowedElements[token.Data] {
+				continue
+			}
+			if token.Data == "style" && tt == html.StartTagToken {
+				// The CSS is only known once its text is read, so look
+				// ahead and drop the element if it isn't safe
+				if z.Next() != html.TextToken {
+					// Empty <style></style>, nothing to keep
+					continue
+				}
+				css := string(z.Text())
+				if !safeCSS(css) {
+					skipping, depth = "style", 1
+					continue
+				}
+				out.WriteString("<style>")
+				out.WriteString(css)
+				inStyle = true
+				continue
+			}
+			writeStartTag(&out, token, tt == html.SelfClosingTagToken)
+		case html.EndTagToken:
+			if !allowedElements[token.Data] {
+				continue
+			}
+			if token.Data == "style" {
+				if !inStyle {
+					continue
+				}
+				inStyle = false
+			}
+			out.WriteString("</" + token.Data + ">")
+		case html.TextToken:
+			out.WriteString(html.EscapeString(token.Data))
+		case html.DoctypeToken:
+			out.WriteString("<!DOCTYPE " + html.EscapeString(token.Data) + ">")
+		}
+	}
+}
+
+func writeStartTag(out *bytes.Buffer, token html.Token, selfClosing bool) {
+	out.WriteString("<" + token.Data)
+	link := false
+	for _, attr := range token.Attr {
+		if attr.Namespace != "" || !allowedAttribute(token.Data, attr) {
+			continue
+		}
+		out.WriteString(" " + attr.Key + `="` + html.EscapeString(attr.Val) + `"`)
+		link = link || attr.Key == "href"
+	}
+	if link {
+		// Links leave the email without handing it over to the page
+		out.WriteString(` rel="noopener noreferrer"`)
+	}
+	if selfClosing {
+		out.WriteString(" /")
+	}
+	out.WriteString(">")
+}
+
+func allowedAttribute(element string, attr html.Attribute) bool {
+	if element == "meta" {
+		return metaAttributes[attr.Key]
+	}
+	switch attr.Key {
+	case "href":
+		return element == "a" && safeURL(attr.Val, linkSchemes)
+	case "src":
+		return element == "img" && (safeURL(attr.Val, imageSchemes) || safeDataImage(attr.Val))
+	case "target":
+		return element == "a" && attr.Val == "_blank"
+	case "style":
+		return safeCSS(attr.Val)
+	}
+	return allowedAttributes[attr.Key]
+}
+
+// safeURL reports whether raw is relative or uses one of schemes. Browsers
+// ignore whitespace and control characters in schemes, so "java\tscript:"
+// is checked as javascript:.
+func safeURL(raw string, schemes map[string]bool) bool {
+	cleaned := strings.Map(func(r rune) rune {
+		if r <= ' ' {
+			return -1
+		}
+		return r
+	}, strings.ToLower(raw))
+
+	colon := strings.IndexByte(cleaned, ':')
+	if colon < 0 || strings.ContainsAny(cleaned[:colon], "/?#") {
+		// Relative, including placeholders like {{unsubscribe_url}}
+		return true
+	}
+	return schemes[cleaned[:colon]]
+}
+
+// safeDataImage allows inline raster images, but not SVG, which can carry
+// scripts
+func safeDataImage(raw string) bool {
+	raw = strings.ToLower(strings.TrimSpace(raw))
+	for _, prefix := range []string{"data:image/png;", "data:image/gif;", "data:image/jpeg;", "data:image/webp;"} {
+		if strings.HasPrefix(raw, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func safeCSS(css string) bool {
+	// CSS escapes like \65xpression would hide the fragments
+	lower := strings.ToLower(css)
+	if strings.Contains(lower, `\`) {
+		return false
+	}
+	lower = strings.Join(strings.Fields(lower), "")
+	for _, fragment := range unsafeCSS {
+		if strings.Contains(lower, fragment) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,46 @@
+package utils
+
+import "testing"
+
+func TestSanitizeHTML(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  string
+	}{
+		{"script with a space before >", `<p>hi</p><script >alert(1)</script>`, `<p>hi</p>`},
+		{"uppercase script", `<SCRIPT>alert(1)</SCRIPT><p>x</p>`, `<p>x</p>`},
+		{"split script tag", `<scr<script>ipt>alert(1)</script>`, `ipt&gt;alert(1)`},
+		{"single-quoted handler", `<img src="x.png" onerror='alert(1)'>`, `<img src="x.png">`},
+		{"unquoted handler", `<img src=x onerror=alert(1)//>`, `<img src="x">`},
+		{"handler hidden in a quoted value", `<p title="a&quot; onmouseover=&quot;alert(1)">x</p>`, `<p title="a&#34; onmouseover=&#34;alert(1)">x</p>`},
+		{"tab in javascript: href", "<a href=\"java\tscript:alert(1)\">x</a>", `<a>x</a>`},
+		{"decimal entity in javascript: href", `<a href="&#106;avascript:alert(1)">x</a>`, `<a>x</a>`},
+		{"hex entities in javascript: href", `<a href="&#x6A;&#x61;vascript:alert(1)">x</a>`, `<a>x</a>`},
+		{"named entity colon in href", `<a href="javascript&colon;alert(1)">x</a>`, `<a>x</a>`},
+		{"https link", `<a href="https://example.com">x</a>`, `<a href="https://example.com" rel="noopener noreferrer">x</a>`},
+		{"placeholder link", `<a href="{{unsubscribe_url}}">x</a>`, `<a href="{{unsubscribe_url}}" rel="noopener noreferrer">x</a>`},
+		{"CSS expression", `<div style="width: expression(alert(1))">x</div>`, `<div>x</div>`},
+		{"CSS url", `<div style="background:url(https://evil.test/x)">x</div>`, `<div>x</div>`},
+		{"escaped CSS url", `<div style="background: u\72l(x)">x</div>`, `<div>x</div>`},
+		{"plain CSS", `<div style="color:red">x</div>`, `<div style="color:red">x</div>`},
+		{"style element with url", `<style>p{background:url(https://evil.test)}</style><p>x</p>`, `<p>x</p>`},
+		{"plain style element", `<style>p{color:red}</style>`, `<style>p{color:red}</style>`},
+		{"meta refresh", `<meta http-equiv="refresh" content="0;url=https://evil.test"><meta charset="utf-8">`, `<meta content="0;url=https://evil.test"><meta charset="utf-8">`},
+		{"svg onload", `<svg onload="alert(1)"><circle/></svg><p>x</p>`, `<p>x</p>`},
+		{"unclosed svg drops the rest", `<svg/onload=alert(1)><p>x</p>`, ``},
+		{"SVG data URL", `<img src="data:image/svg+xml;base64,PHN2Zz4=">`, `<img>`},
+		{"PNG data URL", `<img src="data:image/png;base64,iVBORw0KGgo=">`, `<img src="data:image/png;base64,iVBORw0KGgo=">`},
+		{"iframe", `<iframe src="https://evil.test"></iframe><p>x</p>`, `<p>x</p>`},
+		{"form", `<form action="https://evil.test"><input name=a></form>`, ``},
+		{"comment", `<!-- <script>alert(1)</script> --><p>x</p>`, `<p>x</p>`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := SanitizeHTML(tt.input); got != tt.want {
+				t.Errorf("SanitizeHTML(%q) = %q, want %q", tt.input, got, tt.want)
+			}
+		})
+	}
+}
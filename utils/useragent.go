@@ -0,0 +1,228 @@
+package utils
+
+import (
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/mileusna/useragent"
+)
+
+type DeviceInfo struct {
+	DeviceType    string
+	Browser       string
+	OS            string
+	IsBot         bool
+	ClientName    string
+	ClientVersion string
+	OSVersion     string
+	EmailClient   string
+}
+
+// botSignatures are lowercase user-agent fragments of crawlers, link
+// previewers, security scanners and HTTP libraries that fetch images without
+// a human looking at them
+var botSignatures = []string{
+	// Crawlers and link previewers
+	"bot", "crawler", "spider", "slurp", "scanner", "preview", "facebookexternalhit",
+	"whatsapp", "embedly", "ahrefs", "semrush", "bytespider", "ia_archiver",
+
+	// Scripted and headless clients
+	"curl", "wget", "python-requests", "python-urllib", "aiohttp", "httpx", "go-http-client",
+	"java/", "okhttp", "apache-httpclient", "libwww-perl", "node-fetch", "axios", "undici",
+	"postmanruntime", "insomnia", "httpie", "scrapy", "headless", "phantomjs", "puppeteer",
+	"playwright", "selenium",
+
+	// Mail security gateways that prefetch links and images
+	"barracuda", "mimecast", "proofpoint", "messagelabs", "symantec", "trendmicro",
+	"forcepoint", "fireeye", "ironport", "sophos", "zscaler", "cisco", "paloalto",
+
+	// Vulnerability scanners
+	"zgrab", "masscan", "nmap", "nuclei", "nikto", "sqlmap", "censys", "shodan",
+}
+
+// emailClients maps lowercase user-agent fragments to the mail client or
+// webmail proxy they identify, most specific first
+var emailClients = []struct {
+	signature string
+	client    string
+}{
+	{"googleimageproxy", "Gmail"},
+	{"yahoomailproxy", "Yahoo Mail"},
+	{"outlook-ios", "Outlook for iOS"},
+	{"outlook-android", "Outlook for Android"},
+	{"microsoft outlook", "Outlook"},
+	{"ms-office", "Outlook"},
+	{"microsoft office", "Outlook"},
+	{"windowsmail", "Windows Mail"},
+	{"thunderbird", "Thunderbird"},
+	{"airmail", "Airmail"},
+	{"superhuman", "Superhuman"},
+	{"sparkdesktop", "Spark"},
+	{"applemail", "Apple Mail"},
+}
+
+// mailProxies fetch images on behalf of a person reading the email, so they
+// are opens even though the parser may take them for bots
+var mailProxies = []string{"googleimageproxy", "yahoomailproxy"}
+
+// knownBrowsers are parser names worth reporting as a browser as-is
+var knownBrowsers = map[string]bool{
+	useragent.Chrome: true, useragent.Firefox: true, useragent.Safari: true,
+	useragent.MobileSafari: true, useragent.Edge: true, useragent.Opera: true,
+	useragent.OperaMini: true, useragent.OperaTouch: true, useragent.Vivaldi: true,
+	useragent.SamsungBrowser: true, useragent.InternetExplorer: true,
+	useragent.HeadlessChrome: true,
+}
+
+// genericProducts appear in most user agents and say nothing about the client
+var genericProducts = map[string]bool{
+	"mozilla": true, "applewebkit": true, "khtml": true, "gecko": true,
+	"safari": true, "mobile": true, "version": true, "like": true,
+}
+
+// productToken matches the "Name/1.2" tokens a user agent is made of
+var productToken = regexp.MustCompile(`([A-Za-z][\w.\-]*)/([\w.\-]+)`)
+
+// deviceCacheSize bounds the parsed user agents kept. A handful of mail
+// clients and proxies make up most opens, so a small cache catches them.
+const deviceCacheSize = 4096
+
+var deviceCache = struct {
+	sync.RWMutex
+	devices map[string]*DeviceInfo
+}{devices: make(map[string]*DeviceInfo)}
+
+// ParseUserAgent describes the client behind a user agent. Results are
+// cached and shared between callers, who must not modify them.
+func ParseUserAgent(userAgent string) *DeviceInfo {
+	deviceCache.RLock()
+	info, ok := deviceCache.devices[userAgent]
+	deviceCache.RUnlock()
+	if ok {
+		return info
+	}
+
+	info = parseUserAgent(userAgent)
+
+	deviceCache.Lock()
+	if len(deviceCache.devices) >= deviceCacheSize {
+		clear(deviceCache.devices)
+	}
+	deviceCache.devices[userAgent] = info
+	deviceCache.Unlock()
+	return info
+}
+
+func parseUserAgent(userAgent string) *DeviceInfo {
+	ua := useragent.Parse(userAgent)
+
+	info := &DeviceInfo{
+		DeviceType: "Desktop",
+		Browser:    "Unknown",
+		OS:         "Unknown",
+		OSVersion:  ua.OSVersion,
+		IsBot:      userAgent == "" || isBot(ua),
+	}
+
+	switch {
+	case ua.Tablet:
+		info.DeviceType = "Tablet"
+	case ua.Mobile:
+		info.DeviceType = "Mobile"
+	}
+	if ua.OS != "" {
+		info.OS = ua.OS
+	}
+
+	info.ClientName, info.ClientVersion = clientOf(ua)
+	if info.ClientName != "" {
+		info.Browser = info.ClientName
+	}
+	info.EmailClient = emailClientOf(ua)
+
+	return info
+}
+
+// clientOf names the program behind the user agent. The parser's answer is
+// used when it found a name and version; otherwise the last product token
+// that isn't boilerplate is, which catches apps it doesn't know such as
+// Thunderbird.
+func clientOf(ua useragent.UserAgent) (name, version string) {
+	// GoogleImageProxy poses as an old Firefox on "Gecko"
+	name = strings.TrimPrefix(ua.Name, "Gecko ")
+	if knownBrowsers[name] || (ua.Bot && name != "") {
+		return name, ua.Version
+	}
+	if name != "" && ua.Version != "" && !genericProducts[strings.ToLower(name)] {
+		return name, ua.Version
+	}
+
+	// Ignore anything in parentheses, which holds platform details
+	depth := 0
+	stripped := strings.Map(func(r rune) rune {
+		switch r {
+		case '(':
+			depth++
+		case ')':
+			depth--
+			return ' '
+		}
+		if depth > 0 {
+			return ' '
+		}
+		return r
+	}, ua.String)
+
+	name, version = "", ""
+	for _, match := range productToken.FindAllStringSubmatch(stripped, -1) {
+		if !genericProducts[strings.ToLower(match[1])] {
+			name, version = match[1], match[2]
+		}
+	}
+	return name, version
+}
+
+// emailClientOf names the mail app or webmail image proxy that fetched the
+// pixel, or "" when it looks like a plain browser. Apple Mail sends Safari's
+// user agent minus the Safari and Version tokens.
+func emailClientOf(ua useragent.UserAgent) string {
+	lower := strings.ToLower(ua.String)
+	for _, c := range emailClients {
+		if strings.Contains(lower, c.signature) {
+			return c.client
+		}
+	}
+
+	apple := ua.OS == useragent.IOS || ua.OS == useragent.MacOS
+	if apple && strings.Contains(lower, "applewebkit/") &&
+		!strings.Contains(lower, "safari/") && !strings.Contains(lower, "version/") {
+		return "Apple Mail"
+	}
+	return ""
+}
+
+func isBot(ua useragent.UserAgent) bool {
+	lower := strings.ToLower(ua.String)
+	for _, proxy := range mailProxies {
+		if strings.Contains(lower, proxy) {
+			return false
+		}
+	}
+	return ua.Bot || hasBotSignature(lower)
+}
+
+func hasBotSignature(ua string) bool {
+	for _, signature := range botSignatures {
+		if strings.Contains(ua, signature) {
+			return true
+		}
+	}
+	return false
+}
+
+// IsBotUserAgent reports whether the user agent matches a known bot, scanner
+// or scripted HTTP client.
+func IsBotUserAgent(userAgent string) bool {
+	return isBot(useragent.Parse(userAgent))
+}
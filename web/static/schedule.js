@@ -0,0 +1,9 @@
+// Converts the browser-local datetime picker of schedule forms into an
+// RFC 3339 timestamp the server can parse unambiguously.
+document.querySelectorAll('form[data-schedule]').forEach(function (form) {
+    form.addEventListener('submit', function () {
+        const picker = form.querySelector('input[type=datetime-local]');
+        const hidden = form.querySelector('input[name=scheduled_at]');
+        hidden.value = picker.value ? new Date(picker.value).toISOString() : '';
+    });
+});
@@ -0,0 +1,108 @@
+// Package web holds the HTML templates and static dashboard assets, embedded
+// into the binary so it runs from any working directory.
+package web
+
+import (
+	"embed"
+	"errors"
+	"fmt"
+	"html/template"
+	"io/fs"
+	"os"
+	"sort"
+)
+
+//go:embed templates static
+var embedded embed.FS
+
+// FS returns the asset filesystem. When overrideDir is set, files found
+// there take precedence over the embedded ones, so templates can be
+// customized without rebuilding.
+func FS(overrideDir string) fs.FS {
+	if overrideDir == "" {
+		return embedded
+	}
+	return overlay{upper: os.DirFS(overrideDir), lower: embedded}
+}
+
+// templateNames are the templates the service renders. Templates fails
+// when one is missing, rather than the first page or email that needs it.
+var templateNames = []string{
+	"branding.html",
+	"campaign.html",
+	"campaigns.html",
+	"consent.html",
+	"consent_email.html",
+	"dashboard.html",
+	"email.html",
+	"login.html",
+	"notification.html",
+	"report.html",
+	"tracking_pixel.html",
+	"unsubscribe.html",
+}
+
+// Templates parses every template once, for the dashboard, notification and
+// report emails and the tracking pixel to share.
+func Templates(overrideDir string) (*template.Template, error) {
+	tmpl, err := template.ParseFS(FS(overrideDir), "templates/*.html")
+	if err != nil {
+		return nil, fmt.Errorf("parse templates: %w", err)
+	}
+	for _, name := range templateNames {
+		if tmpl.Lookup(name) == nil {
+			return nil, fmt.Errorf("template %s is missing", name)
+		}
+	}
+	return tmpl, nil
+}
+
+// Static returns the static dashboard assets rooted at the static directory.
+func Static(overrideDir string) fs.FS {
+	static, err := fs.Sub(FS(overrideDir), "static")
+	if err != nil {
+		// Only fails for invalid paths, and "static" is valid
+		panic(err)
+	}
+	return static
+}
+
+// overlay serves files from upper, falling back to lower for anything upper
+// doesn't have. Directory listings are merged.
+type overlay struct {
+	upper, lower fs.FS
+}
+
+func (o overlay) Open(name string) (fs.File, error) {
+	f, err := o.upper.Open(name)
+	if err == nil {
+		return f, nil
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	return o.lower.Open(name)
+}
+
+func (o overlay) ReadDir(name string) ([]fs.DirEntry, error) {
+	upper, upperErr := fs.ReadDir(o.upper, name)
+	lower, lowerErr := fs.ReadDir(o.lower, name)
+	if upperErr != nil && lowerErr != nil {
+		return nil, lowerErr
+	}
+
+	entries := make(map[string]fs.DirEntry, len(upper)+len(lower))
+	for _, entry := range lower {
+		entries[entry.Name()] = entry
+	}
+	for _, entry := range upper {
+		entries[entry.Name()] = entry
+	}
+
+	merged := make([]fs.DirEntry, 0, len(entries))
+	for _, entry := range entries {
+		merged = append(merged, entry)
+	}
+	sort.Slice(merged, func(i, j int) bool { return merged[i].Name() < merged[j].Name() })
+	return merged, nil
+}
@@ -0,0 +1,78 @@
+package webhook
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SignatureHeader carries a delivery's signature as t=<unix seconds>,
+// v1=<hex HMAC-SHA256 of "<t>.<body>">
+const SignatureHeader = "X-Signature"
+
+// DefaultTolerance is how old a delivery receivers should still accept.
+// Deliveries are signed afresh on every attempt, so retries stay inside it.
+const DefaultTolerance = 5 * time.Minute
+
+var (
+	// ErrInvalidSignature is a signature that is missing, malformed or
+	// doesn't match the body
+	ErrInvalidSignature = errors.New("invalid webhook signature")
+	// ErrExpired is a correctly signed delivery outside the replay window
+	ErrExpired = errors.New("webhook signature timestamp outside tolerance")
+)
+
+// Sign returns the X-Signature value for body sent at timestamp.
+func Sign(secret []byte, timestamp time.Time, body []byte) string {
+	t := strconv.FormatInt(timestamp.Unix(), 10)
+	return "t=" + t + ",v1=" + hex.EncodeToString(mac(secret, t, body))
+}
+
+// Verify checks an X-Signature value against body, and that it was made
+// within tolerance of now, so a captured delivery can't be replayed later.
+// Receivers should also remember the X-Webhook-ID of deliveries seen within
+// the tolerance, as a retry carries the same ID.
+func Verify(secret []byte, header string, body []byte, tolerance time.Duration, now time.Time) error {
+	var t string
+	var signatures [][]byte
+	for _, part := range strings.Split(header, ",") {
+		key, value, _ := strings.Cut(strings.TrimSpace(part), "=")
+		switch key {
+		case "t":
+			t = value
+		case "v1":
+			if sig, err := hex.DecodeString(value); err == nil {
+				signatures = append(signatures, sig)
+			}
+		}
+	}
+	unix, err := strconv.ParseInt(t, 10, 64)
+	if err != nil || len(signatures) == 0 {
+		return ErrInvalidSignature
+	}
+
+	expected := mac(secret, t, body)
+	valid := false
+	for _, sig := range signatures {
+		valid = valid || hmac.Equal(sig, expected)
+	}
+	if !valid {
+		return ErrInvalidSignature
+	}
+	if age := now.Sub(time.Unix(unix, 0)); age > tolerance || age < -tolerance {
+		return ErrExpired
+	}
+	return nil
+}
+
+func mac(secret []byte, timestamp string, body []byte) []byte {
+	h := hmac.New(sha256.New, secret)
+	h.Write([]byte(timestamp))
+	h.Write([]byte{'.'})
+	h.Write(body)
+	return h.Sum(nil)
+}
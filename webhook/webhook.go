@@ -0,0 +1,361 @@
+// Package webhook delivers opens and clicks to HTTP endpoints as they
+// happen, signed so receivers can tell they came from the tracker.
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"email-tracker/config"
+	"email-tracker/events"
+	"email-tracker/models"
+	"email-tracker/utils"
+)
+
+// Headers sent with every delivery besides the signature
+const (
+	// IDHeader identifies the delivery; retries of it carry the same ID
+	IDHeader = "X-Webhook-ID"
+	// EventHeader is the event type, "open" or "click"
+	EventHeader = "X-Webhook-Event"
+)
+
+// retryDelays are the waits between attempts at a delivery
+var retryDelays = []time.Duration{time.Second, 5 * time.Second}
+
+// Delivery is the JSON body POSTed for an event
+type Delivery struct {
+	ID        string       `json:"id"`
+	Type      string       `json:"type"`
+	CreatedAt time.Time    `json:"created_at"`
+	Data      events.Event `json:"data"`
+}
+
+// EndpointStats describes the deliveries to one endpoint since startup.
+// The URL is shown without its query or credentials. Endpoints a tenant
+// added itself are Managed, the others come from the configuration.
+type EndpointStats struct {
+	Name      string          `json:"name"`
+	Tenant    string          `json:"tenant"`
+	URL       string          `json:"url"`
+	Managed   bool            `json:"managed"`
+	Delivered uint64          `json:"delivered"`
+	Failed    utils.LossCount `json:"failed"`
+}
+
+type endpoint struct {
+	name   string
+	url    string
+	secret []byte
+	// tenant is the only one whose events the endpoint is sent
+	tenant string
+	// types are the event types sent, all of them when empty
+	types   []string
+	managed bool
+	client  *http.Client
+
+	unsubscribe func()
+	delivered   atomic.Uint64
+	failed      utils.LossCounter
+}
+
+// wants reports whether event is for e: of its tenant, and of a type it
+// asked for
+func (e *endpoint) wants(event events.Event) bool {
+	if models.TenantOr(event.Tenant) != e.tenant {
+		return false
+	}
+	return len(e.types) == 0 || slices.Contains(e.types, event.Type)
+}
+
+// Dispatcher sends every event published on the broker to each endpoint.
+// Every endpoint has its own subscription and works through it in order,
+// so a slow one only falls behind itself.
+type Dispatcher struct {
+	client *http.Client
+	// public is the client for the endpoints tenants add, which may only
+	// be on the internet
+	public  *http.Client
+	timeout time.Duration
+	broker  *events.Broker
+
+	mu        sync.Mutex
+	endpoints []*endpoint
+	started   bool
+	stopping  chan struct{}
+	running   sync.WaitGroup
+}
+
+// New returns a dispatcher for the endpoints in WEBHOOK_URLS. Endpoints
+// without a secret in WEBHOOK_SECRETS are left out, as deliveries are never
+// sent unsigned. WEBHOOK_TENANTS ("name:tenant,...") gives an endpoint
+// the events of one tenant; the others get the default tenant's.
+// Endpoints tenants add are delivered to through public.
+func New(cfg *config.Config, client, public *http.Client, broker *events.Broker) *Dispatcher {
+	secrets := make(map[string]string)
+	for _, entry := range cfg.Webhooks.Secrets {
+		if name, secret, ok := strings.Cut(entry, ":"); ok && secret != "" {
+			secrets[name] = secret
+		}
+	}
+
+	tenants := make(map[string]string)
+	for _, entry := range cfg.Webhooks.Tenants {
+		if name, tenant, ok := strings.Cut(entry, ":"); ok {
+			tenants[name] = tenant
+		}
+	}
+
+	d := &Dispatcher{
+		client:   client,
+		public:   public,
+		timeout:  cfg.Webhooks.Timeout,
+		broker:   broker,
+		stopping: make(chan struct{}),
+	}
+	for _, entry := range cfg.Webhooks.URLs {
+		name, url, ok := strings.Cut(entry, "=")
+		if !ok || name == "" || url == "" {
+			slog.Error("skipping malformed WEBHOOK_URLS entry, expected name=url", "name", name)
+			continue
+		}
+		secret, ok := secrets[name]
+		if !ok {
+			slog.Error("skipping webhook without a secret in WEBHOOK_SECRETS", "name", name)
+			continue
+		}
+		d.endpoints = append(d.endpoints, &endpoint{
+			name:   name,
+			url:    url,
+			secret: []byte(secret),
+			tenant: models.TenantOr(tenants[name]),
+			client: client,
+		})
+	}
+	return d
+}
+
+// Start subscribes every endpoint to the broker and starts delivering.
+func (d *Dispatcher) Start() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.started = true
+	for _, e := range d.endpoints {
+		d.subscribe(e)
+	}
+	if len(d.endpoints) > 0 {
+		slog.Info("delivering webhooks", "endpoints", len(d.endpoints))
+	}
+}
+
+// subscribe starts delivering to e. Must be called with d.mu held.
+func (d *Dispatcher) subscribe(e *endpoint) {
+	ch, unsubscribe := d.broker.Subscribe()
+	e.unsubscribe = unsubscribe
+	d.running.Add(1)
+	go func() {
+		defer d.running.Done()
+		for event := range ch {
+			if !e.wants(event) {
+				continue
+			}
+			d.deliver(e, event)
+		}
+	}()
+}
+
+// Add delivers the tenant's events of the given types, or all of them, to
+// url, signed with secret. It replaces an endpoint the tenant added under
+// the same name, and is delivered to from then on if the dispatcher has
+// started.
+func (d *Dispatcher) Add(tenant, name, url, secret string, types []string) {
+	e := &endpoint{
+		name:    name,
+		url:     url,
+		secret:  []byte(secret),
+		tenant:  models.TenantOr(tenant),
+		types:   slices.Clone(types),
+		managed: true,
+		client:  d.public,
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.remove(e.tenant, name)
+	d.endpoints = append(d.endpoints, e)
+	if d.started && !d.stopped() {
+		d.subscribe(e)
+	}
+}
+
+// Remove stops delivering to an endpoint the tenant added. Deliveries
+// already under way finish.
+func (d *Dispatcher) Remove(tenant, name string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.remove(models.TenantOr(tenant), name)
+}
+
+// remove drops a managed endpoint. Must be called with d.mu held.
+func (d *Dispatcher) remove(tenant, name string) {
+	d.endpoints = slices.DeleteFunc(d.endpoints, func(e *endpoint) bool {
+		if !e.managed || e.tenant != tenant || e.name != name {
+			return false
+		}
+		if e.unsubscribe != nil {
+			e.unsubscribe()
+		}
+		return true
+	})
+}
+
+// Close stops taking new events and waits, up to ctx, for the ones already
+// received to be delivered. Failed deliveries aren't retried from then on.
+func (d *Dispatcher) Close(ctx context.Context) error {
+	d.mu.Lock()
+	close(d.stopping)
+	for _, e := range d.endpoints {
+		if e.unsubscribe != nil {
+			e.unsubscribe()
+		}
+	}
+	d.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		d.running.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// deliver POSTs event to e, retrying failures a few times. Each attempt is
+// signed with its own timestamp.
+func (d *Dispatcher) deliver(e *endpoint, event events.Event) {
+	delivery := Delivery{
+		ID:        utils.GenerateUUID(),
+		Type:      event.Type,
+		CreatedAt: time.Now().UTC(),
+		Data:      event,
+	}
+	body, err := json.Marshal(delivery)
+	if err != nil {
+		e.failed.Add(1)
+		slog.Error("failed to encode webhook", "webhook", e.name, "error", err)
+		return
+	}
+
+	for attempt := 0; ; attempt++ {
+		err = d.post(e, delivery, body)
+		if err == nil {
+			e.delivered.Add(1)
+			return
+		}
+		if attempt == len(retryDelays) || d.stopped() {
+			break
+		}
+		slog.Warn("webhook delivery failed, retrying", "webhook", e.name, "delivery_id", delivery.ID,
+			"attempt", attempt+1, "error", err)
+		select {
+		case <-time.After(retryDelays[attempt]):
+		case <-d.stopping:
+		}
+	}
+	e.failed.Add(1)
+	slog.Error("webhook delivery failed", "webhook", e.name, "delivery_id", delivery.ID,
+		"type", delivery.Type, "tracking_id", event.TrackingID, "error", err)
+}
+
+func (d *Dispatcher) post(e *endpoint, delivery Delivery, body []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), d.timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("invalid URL %s", utils.RedactURL(e.url))
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "email-tracker-webhook")
+	req.Header.Set(IDHeader, delivery.ID)
+	req.Header.Set(EventHeader, delivery.Type)
+	req.Header.Set(SignatureHeader, Sign(e.secret, time.Now(), body))
+
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return utils.RedactURLError(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("endpoint answered %s", resp.Status)
+	}
+	return nil
+}
+
+func (d *Dispatcher) stopped() bool {
+	select {
+	case <-d.stopping:
+		return true
+	default:
+		return false
+	}
+}
+
+// Stats reports the deliveries to each endpoint.
+func (d *Dispatcher) Stats() []EndpointStats {
+	return d.TenantStats("")
+}
+
+// TenantStats reports the deliveries to the tenant's endpoints, or to
+// every endpoint for "".
+func (d *Dispatcher) TenantStats(tenant string) []EndpointStats {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	stats := make([]EndpointStats, 0, len(d.endpoints))
+	for _, e := range d.endpoints {
+		if tenant != "" && e.tenant != models.TenantOr(tenant) {
+			continue
+		}
+		stats = append(stats, EndpointStats{
+			Name:      e.name,
+			Tenant:    e.tenant,
+			URL:       utils.RedactURL(e.url),
+			Managed:   e.managed,
+			Delivered: e.delivered.Load(),
+			Failed:    e.failed.Snapshot(),
+		})
+	}
+	return stats
+}
+
+// Failed counts deliveries given up on, across all endpoints.
+func (d *Dispatcher) Failed() utils.LossCount {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var total utils.LossCount
+	for _, e := range d.endpoints {
+		failed := e.failed.Snapshot()
+		total.Count += failed.Count
+		if failed.LastAt != nil && (total.LastAt == nil || failed.LastAt.After(*total.LastAt)) {
+			total.LastAt = failed.LastAt
+		}
+	}
+	return total
+}